@@ -0,0 +1,186 @@
+package collab
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// A server exposed to the internet shouldn't host sessions for anyone who
+// finds it. With access_tokens in its config, every client must present a
+// token in its hello: one of the static tokens listed, or a JWT signed with
+// the shared HS256 secret, so tokens can be minted per user without
+// restarting the server. Each token may be limited in how many sessions
+// created with it are live at once; joining an existing session doesn't
+// count against the limit. Clients send access_token from their config to
+// the server and to the hosted relay.
+//
+// AccessTokens are the tokens a server accepts
+type AccessTokens struct {
+	Tokens         []StaticToken `json:"tokens,omitempty"`
+	JWTSecret      string        `json:"jwt_secret,omitempty"`       // HS256 key for signed tokens
+	JWTAudience    string        `json:"jwt_audience,omitempty"`     // required "aud" of signed tokens, if set
+	JWTMaxSessions int           `json:"jwt_max_sessions,omitempty"` // for signed tokens without a max_sessions claim
+}
+
+// StaticToken is a token listed in the server's config
+type StaticToken struct {
+	Name        string `json:"name"`
+	Token       string `json:"token"`
+	MaxSessions int    `json:"max_sessions,omitempty"` // 0 leaves it unlimited
+}
+
+// tokenGrant is what a verified token allows. Name is what it is known by
+// in logs and the session limit.
+type tokenGrant struct {
+	name        string
+	maxSessions int
+}
+
+// accessTokenClaims are the claims read from a signed token
+type accessTokenClaims struct {
+	Subject     string   `json:"sub"`
+	Audience    audience `json:"aud"`
+	ExpiresAt   int64    `json:"exp"`
+	NotBefore   int64    `json:"nbf"`
+	MaxSessions *int     `json:"max_sessions"`
+}
+
+func (t AccessTokens) enabled() bool {
+	return len(t.Tokens) > 0 || t.JWTSecret != ""
+}
+
+func (t AccessTokens) Validate() error {
+	names := make(map[string]bool)
+	for i, token := range t.Tokens {
+		if token.Name == "" || token.Token == "" {
+			return fmt.Errorf("tokens[%d] needs a name and a token", i)
+		}
+		if names[token.Name] {
+			return fmt.Errorf("token name %q is used twice", token.Name)
+		}
+		names[token.Name] = true
+		if token.MaxSessions < 0 {
+			return fmt.Errorf("max_sessions of %q must not be negative", token.Name)
+		}
+	}
+	if t.JWTSecret != "" && len(t.JWTSecret) < 32 {
+		return fmt.Errorf("jwt_secret must be at least 32 bytes")
+	}
+	if t.JWTMaxSessions < 0 {
+		return fmt.Errorf("jwt_max_sessions must not be negative")
+	}
+	return nil
+}
+
+// Verify checks a token against the static ones, then as a signed token
+func (t AccessTokens) Verify(token string, now time.Time) (tokenGrant, error) {
+	if token == "" {
+		return tokenGrant{}, fmt.Errorf("access token required")
+	}
+	for _, static := range t.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(static.Token)) == 1 {
+			return tokenGrant{name: static.Name, maxSessions: static.MaxSessions}, nil
+		}
+	}
+	if t.JWTSecret == "" || strings.Count(token, ".") != 2 {
+		return tokenGrant{}, fmt.Errorf("unknown access token")
+	}
+	return t.verifyJWT(token, now)
+}
+
+func (t AccessTokens) verifyJWT(token string, now time.Time) (tokenGrant, error) {
+	parts := strings.Split(token, ".")
+	decode := base64.RawURLEncoding.DecodeString
+	
+	var header map[string]string
+	rawHeader, err := decode(parts[0])
+	if err != nil || json.Unmarshal(rawHeader, &header) != nil {
+		return tokenGrant{}, fmt.Errorf("malformed token header")
+	}
+	if header["alg"] != "HS256" {
+		return tokenGrant{}, fmt.Errorf("unsupported token algorithm %q", header["alg"])
+	}
+	signature, err := decode(parts[2])
+	if err != nil {
+		return tokenGrant{}, fmt.Errorf("malformed token signature")
+	}
+	mac := hmac.New(sha256.New, []byte(t.JWTSecret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return tokenGrant{}, fmt.Errorf("invalid token signature")
+	}
+	
+	var claims accessTokenClaims
+	rawClaims, err := decode(parts[1])
+	if err != nil || json.Unmarshal(rawClaims, &claims) != nil {
+		return tokenGrant{}, fmt.Errorf("malformed token claims")
+	}
+	if claims.Subject == "" {
+		return tokenGrant{}, fmt.Errorf("token has no subject")
+	}
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0)) {
+		return tokenGrant{}, fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0)) {
+		return tokenGrant{}, fmt.Errorf("token not valid yet")
+	}
+	if t.JWTAudience != "" && !claims.Audience.contains(t.JWTAudience) {
+		return tokenGrant{}, fmt.Errorf("token not issued for %s", t.JWTAudience)
+	}
+	
+	grant := tokenGrant{name: "jwt:" + claims.Subject, maxSessions: t.JWTMaxSessions}
+	if claims.MaxSessions != nil {
+		grant.maxSessions = *claims.MaxSessions
+	}
+	return grant, nil
+}
+
+// SetAccessTokens has the server require a token from every client; set it
+// before Serve
+func (cs *CollabServer) SetAccessTokens(tokens AccessTokens) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.tokens = tokens
+}
+
+// authorize checks the token a hello carries, when the server requires one.
+// The grant is nil when it doesn't.
+func (cs *CollabServer) authorize(hello protocol.ServerHello) (*tokenGrant, error) {
+	cs.mutex.Lock()
+	tokens := cs.tokens
+	cs.mutex.Unlock()
+	if !tokens.enabled() {
+		return nil, nil
+	}
+	grant, err := tokens.Verify(hello.AccessToken, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+// checkTokenSessions refuses a new session when the token that would create
+// it already has as many live ones as it may. Caller holds cs.mutex.
+func (cs *CollabServer) checkTokenSessions(grant *tokenGrant) error {
+	if grant == nil || grant.maxSessions <= 0 {
+		return nil
+	}
+	live := 0
+	for _, room := range cs.sessions {
+		if room.token == grant.name {
+			live++
+		}
+	}
+	if live >= grant.maxSessions {
+		return fmt.Errorf("access token %s is at its limit of %d sessions", grant.name, grant.maxSessions)
+	}
+	return nil
+}
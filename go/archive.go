@@ -0,0 +1,202 @@
+package collab
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+)
+
+// With archive_sessions set, leaving a session writes everything kept about
+// it to one zip under <data_dir>/archives/:
+//
+//	manifest.json      the session, who took part and what the archive holds
+//	initial/<file>     the document as this user first had it
+//	final/<file>       the document as this user left it
+//	oplog.json         the operations since the op log's latest snapshot, or
+//	                   every stored operation, and the content they apply to
+//	chat.json          the chat transcript
+//	attribution.json   who wrote what, as export_attribution gives it
+//	contributions.json per-user statistics
+//
+// Operations and chat come from the op log and the store, so without
+// op_log_dir or store_path the archive holds less; the manifest says what
+// was left out and why.
+const archiveDirName = "archives"
+
+// ArchiveManifest describes a session archive
+type ArchiveManifest struct {
+	SessionID  string          `json:"session_id"`
+	FilePath   string          `json:"file_path"`
+	CreatedBy  string          `json:"created_by"`
+	CreatedAt  time.Time       `json:"created_at"`
+	ArchivedAt time.Time       `json:"archived_at"`
+	ArchivedBy string          `json:"archived_by"`
+	Peers      []protocol.Peer `json:"peers"`
+	Files      []string        `json:"files"`
+	Missing    []string        `json:"missing,omitempty"` // what couldn't be included, and why
+}
+
+// archivedOpLog is the op log as archived: operations apply to Base in order
+type archivedOpLog struct {
+	Base       string               `json:"base"`
+	Operations []protocol.Operation `json:"operations"`
+}
+
+// archiveEntry is one file of an archive
+type archiveEntry struct {
+	name string
+	data []byte
+}
+
+// archiveSession writes the session's archive and returns its path. It runs
+// before leaving, while the document and op log are still open.
+func (cm *CollabManager) archiveSession(session *session.Session) (string, error) {
+	if cm.dataDir == "" {
+		return "", fmt.Errorf("no data directory")
+	}
+	
+	session.Mutex.RLock()
+	manifest := ArchiveManifest{
+		SessionID:  session.ID,
+		FilePath:   session.FilePath,
+		CreatedBy:  session.CreatedBy,
+		CreatedAt:  session.CreatedAt,
+		ArchivedAt: time.Now().UTC(),
+		ArchivedBy: cm.sessionManager.GetUserID(),
+		Peers:      make([]protocol.Peer, 0, len(session.Peers)),
+	}
+	for _, peer := range session.Peers {
+		manifest.Peers = append(manifest.Peers, *peer)
+	}
+	initial := session.Content
+	session.Mutex.RUnlock()
+	
+	name := path.Base(filepath.ToSlash(session.FilePath))
+	if name == "." || name == "/" {
+		name = "document"
+	}
+	entries := []archiveEntry{
+		{name: "initial/" + name, data: []byte(initial)},
+		{name: "final/" + name, data: []byte(cm.syncManager.GetDocumentContent())},
+	}
+	add := func(name string, value interface{}) {
+		data, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			manifest.Missing = append(manifest.Missing, fmt.Sprintf("%s: %v", name, err))
+			return
+		}
+		entries = append(entries, archiveEntry{name: name, data: data})
+	}
+	
+	opLog, err := cm.archivedOpLog(session.ID, initial)
+	if err != nil {
+		manifest.Missing = append(manifest.Missing, "oplog.json: "+err.Error())
+	} else {
+		add("oplog.json", opLog)
+	}
+	
+	if chat, err := cm.sessionManager.LoadChat(session.ID); err != nil {
+		manifest.Missing = append(manifest.Missing, "chat.json: "+err.Error())
+	} else {
+		add("chat.json", chat)
+	}
+	
+	// Attribution needs every operation, which only the store has
+	if ops, err := cm.sessionManager.LoadOperations(session.ID); err != nil {
+		manifest.Missing = append(manifest.Missing, "attribution.json: "+err.Error())
+	} else if data, err := encodeAttribution(session.ID, buildAttribution(ops), AttributionJSON); err != nil {
+		manifest.Missing = append(manifest.Missing, "attribution.json: "+err.Error())
+	} else {
+		entries = append(entries, archiveEntry{name: "attribution.json", data: data})
+	}
+	
+	add("contributions.json", cm.contributions.Report())
+	
+	for _, entry := range entries {
+		manifest.Files = append(manifest.Files, entry.name)
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	entries = append([]archiveEntry{{name: "manifest.json", data: data}}, entries...)
+	
+	dir := filepath.Join(cm.dataDir, archiveDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	archivePath := filepath.Join(dir, fmt.Sprintf("%s-%s.zip", session.ID, manifest.ArchivedAt.Format("20060102-150405")))
+	if err := writeArchive(archivePath, entries, manifest.ArchivedAt); err != nil {
+		return "", err
+	}
+	return archivePath, nil
+}
+
+// archivedOpLog compacts the op log and returns what is left of it, or the
+// stored operations when there is no op log
+func (cm *CollabManager) archivedOpLog(sessionID, initial string) (*archivedOpLog, error) {
+	if cm.opLog != nil {
+		if err := cm.opLog.Compact(); err != nil {
+			log.Printf("Archiving the op log uncompacted: %v", err)
+		}
+		base, ops, err := cm.opLog.Replay()
+		if err != nil {
+			return nil, err
+		}
+		return &archivedOpLog{Base: base, Operations: ops}, nil
+	}
+	
+	ops, err := cm.sessionManager.LoadOperations(sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("needs op_log_dir or store_path in the config file")
+	}
+	return &archivedOpLog{Base: initial, Operations: ops}, nil
+}
+
+// writeArchive writes the entries to a new zip at archivePath
+func writeArchive(archivePath string, entries []archiveEntry, modified time.Time) error {
+	file, err := os.OpenFile(archivePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", archivePath, err)
+	}
+	
+	archive := zip.NewWriter(file)
+	for _, entry := range entries {
+		writer, err := archive.CreateHeader(&zip.FileHeader{Name: entry.name, Method: zip.Deflate, Modified: modified})
+		if err == nil {
+			_, err = writer.Write(entry.data)
+		}
+		if err != nil {
+			file.Close()
+			os.Remove(archivePath)
+			return fmt.Errorf("failed to write %s to %s: %v", entry.name, archivePath, err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		file.Close()
+		os.Remove(archivePath)
+		return fmt.Errorf("failed to write %s: %v", archivePath, err)
+	}
+	return file.Close()
+}
+
+// sendSessionArchived tells Neovim where a session's archive went
+func (cm *CollabManager) sendSessionArchived(sessionID, archivePath string, err error) {
+	event := protocol.SessionArchivedEvent{SessionID: sessionID, Path: archivePath}
+	if err != nil {
+		log.Printf("Failed to archive session %s: %v", sessionID, err)
+		event.Error = err.Error()
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgSessionArchived, event)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send session archive: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package collab
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Attribution export formats
+const (
+	AttributionJSON = "json"
+	AttributionCSV  = "csv"
+)
+
+// AttributionRecord is one applied operation: who made it, when, and which
+// byte range of the document it touched at the time
+type AttributionRecord struct {
+	Seq         int    `json:"seq"`
+	OperationID string `json:"operation_id"`
+	UserID      string `json:"user_id"`
+	Timestamp   string `json:"timestamp"` // RFC 3339, UTC
+	Type        string `json:"type"`
+	Start       int    `json:"start"`
+	End         int    `json:"end"` // exclusive; equals Start for deletions
+	Length      int    `json:"length"`
+	Content     string `json:"content,omitempty"` // inserted text
+}
+
+func newAttributionRecord(seq int, op protocol.Operation) AttributionRecord {
+	record := AttributionRecord{
+		Seq:         seq,
+		OperationID: op.ID,
+		UserID:      op.UserID,
+		Timestamp:   time.Unix(0, op.Timestamp).UTC().Format(time.RFC3339Nano),
+		Type:        string(op.Type),
+		Start:       op.Position,
+		End:         op.Position,
+	}
+	
+	switch op.Type {
+	case protocol.OpInsert:
+		record.Length = len(op.Content)
+		record.End = op.Position + len(op.Content)
+		record.Content = op.Content
+	case protocol.OpDelete:
+		record.Length = op.Length
+	case protocol.OpReplace:
+		// Blob mode replaces the whole document, which may be binary
+		record.Start = 0
+		record.Length = len(op.Content)
+		record.End = len(op.Content)
+	}
+	return record
+}
+
+// buildAttribution turns a session's operation log into attribution records
+func buildAttribution(ops []protocol.Operation) []AttributionRecord {
+	records := make([]AttributionRecord, 0, len(ops))
+	for i, op := range ops {
+		records = append(records, newAttributionRecord(i+1, op))
+	}
+	return records
+}
+
+// encodeAttribution renders records as JSON or CSV
+func encodeAttribution(sessionID string, records []AttributionRecord, format string) ([]byte, error) {
+	switch format {
+	case AttributionJSON:
+		return json.MarshalIndent(struct {
+			SessionID  string              `json:"session_id"`
+			ExportedAt string              `json:"exported_at"`
+			Operations []AttributionRecord `json:"operations"`
+		}{sessionID, time.Now().UTC().Format(time.RFC3339), records}, "", "  ")
+
+	case AttributionCSV:
+		var buf bytes.Buffer
+		writer := csv.NewWriter(&buf)
+		writer.Write([]string{"seq", "operation_id", "user_id", "timestamp", "type", "start", "end", "length", "content"})
+		for _, r := range records {
+			writer.Write([]string{
+				strconv.Itoa(r.Seq), r.OperationID, r.UserID, r.Timestamp, r.Type,
+				strconv.Itoa(r.Start), strconv.Itoa(r.End), strconv.Itoa(r.Length), r.Content,
+			})
+		}
+		writer.Flush()
+		return buf.Bytes(), writer.Error()
+	}
+	return nil, fmt.Errorf("unsupported attribution format %q", format)
+}
+
+// attributionFormat picks the format from the request, falling back to the
+// output file's extension and then JSON
+func attributionFormat(format, path string) string {
+	if format != "" {
+		return strings.ToLower(format)
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return AttributionCSV
+	}
+	return AttributionJSON
+}
+
+// handleExportAttribution exports who wrote what for a session, the current
+// one by default. It reads the store, so it also works after the session ended.
+func (cm *CollabManager) handleExportAttribution(req *protocol.ExportAttributionRequest) *protocol.Message {
+	sessionID := req.SessionID
+	if sessionID == "" {
+		session := cm.sessionManager.GetCurrentSession()
+		if session == nil {
+			return createErrorMessage("no_session", "Not in a session; pass session_id to export a past one")
+		}
+		sessionID = session.ID
+	}
+	
+	ops, err := cm.sessionManager.LoadOperations(sessionID)
+	if err != nil {
+		return createErrorMessage("export_attribution_failed", err.Error())
+	}
+	
+	format := attributionFormat(req.Format, req.Path)
+	records := buildAttribution(ops)
+	data, err := encodeAttribution(sessionID, records, format)
+	if err != nil {
+		return createErrorMessage("export_attribution_failed", err.Error())
+	}
+	
+	response := protocol.ExportAttributionResponse{
+		SessionID: sessionID,
+		Format:    format,
+		Count:     len(records),
+	}
+	if req.Path != "" {
+		if err := os.WriteFile(req.Path, data, 0600); err != nil {
+			return createErrorMessage("export_attribution_failed", fmt.Sprintf("failed to write %s: %v", req.Path, err))
+		}
+		response.Path = req.Path
+	} else {
+		response.Data = string(data)
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgAttributionExported, response)
+	return msg
+}
@@ -0,0 +1,59 @@
+package collab
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/EmreDay1/collab.nvim/go/p2p"
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+var trafficKinds = map[string]bool{
+	p2p.TrafficOps:       true,
+	p2p.TrafficCursor:    true,
+	p2p.TrafficChat:      true,
+	p2p.TrafficSnapshots: true,
+	p2p.TrafficOther:     true,
+}
+
+// validateBandwidthBudgets checks a config's budgets name known kinds
+func validateBandwidthBudgets(budgets map[string]int) error {
+	for kind, kib := range budgets {
+		if !trafficKinds[kind] {
+			return fmt.Errorf("unknown kind %q", kind)
+		}
+		if kib <= 0 {
+			return fmt.Errorf("%s must be positive", kind)
+		}
+	}
+	return nil
+}
+
+// trafficBudgets converts configured KiB per minute to bytes per window
+func trafficBudgets(budgets map[string]int) map[string]int64 {
+	perWindow := make(map[string]int64, len(budgets))
+	for kind, kib := range budgets {
+		perWindow[kind] = int64(kib) * 1024
+	}
+	return perWindow
+}
+
+// sendTrafficWarning tells Neovim a kind of traffic is over its budget
+func (cm *CollabManager) sendTrafficWarning(warning p2p.TrafficWarning) {
+	log.Printf("%s traffic used %d bytes in the last %ds, over its budget of %d",
+		warning.Kind, warning.Bytes, warning.WindowSeconds, warning.Budget)
+	if err := cm.sendEvent(protocol.MsgBandwidthWarning, warning); err != nil {
+		log.Printf("Failed to send bandwidth warning: %v", err)
+	}
+}
+
+// handleGetMetrics reports the traffic with every peer so far, how long
+// local edits take to reach them and how far behind each peer is
+func (cm *CollabManager) handleGetMetrics() *protocol.Message {
+	report := cm.p2pManager.TrafficReport()
+	latency := cm.latency.Report()
+	report.Latency = &latency
+	report.Frontiers = cm.frontierReport()
+	msg, _ := protocol.NewMessage(protocol.MsgMetrics, report)
+	return msg
+}
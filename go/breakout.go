@@ -0,0 +1,459 @@
+package collab
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// Breakouts split a session into smaller groups working on their own fork of
+// the document. The host keeps every fork; members only the one they are in.
+// Breakout traffic travels on multiplexed session channels labeled with the
+// breakout ID, so moving peers around never opens new connections.
+//
+// Merging diffs the fork against the document it was forked from and rebases
+// those changes over whatever happened in the main session since.
+
+// Breakout is one group and its document fork
+type Breakout struct {
+	ID        string
+	Name      string
+	CreatedAt time.Time
+	Base      string          // main document at fork time
+	Members   map[string]bool // user IDs
+	sync      *collabsync.SyncManager
+}
+
+func breakoutID(sessionID, name string) string {
+	return sessionID + "/breakout/" + name
+}
+
+func newBreakout(sessionID, name, userID, content string) *Breakout {
+	sm := collabsync.NewSyncManager()
+	sm.SetUserID(userID)
+	sm.InitializeDocument(content)
+	
+	return &Breakout{
+		ID:        breakoutID(sessionID, name),
+		Name:      name,
+		CreatedAt: time.Now(),
+		Base:      content,
+		Members:   make(map[string]bool),
+		sync:      sm,
+	}
+}
+
+func (b *Breakout) info() protocol.BreakoutInfo {
+	members := make([]string, 0, len(b.Members))
+	for userID := range b.Members {
+		members = append(members, userID)
+	}
+	sort.Strings(members)
+	
+	return protocol.BreakoutInfo{
+		Name:         b.Name,
+		BreakoutID:   b.ID,
+		CreatedAt:    b.CreatedAt,
+		Members:      members,
+		DocumentSize: len(b.sync.GetDocumentContent()),
+	}
+}
+
+// BreakoutManager tracks breakouts: all of them on the host, the joined one
+// on members
+type BreakoutManager struct {
+	breakouts map[string]*Breakout // by name
+	joined    *Breakout            // member side
+	mutex     sync.Mutex
+}
+
+func NewBreakoutManager() *BreakoutManager {
+	return &BreakoutManager{breakouts: make(map[string]*Breakout)}
+}
+
+// memberOf returns the breakout a peer is in, if any. Callers hold the mutex.
+func (bm *BreakoutManager) memberOf(userID string) *Breakout {
+	for _, b := range bm.breakouts {
+		if b.Members[userID] {
+			return b
+		}
+	}
+	return nil
+}
+
+// byID returns the breakout with the given channel ID
+func (bm *BreakoutManager) byID(id string) *Breakout {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	
+	if bm.joined != nil && bm.joined.ID == id {
+		return bm.joined
+	}
+	for _, b := range bm.breakouts {
+		if b.ID == id {
+			return b
+		}
+	}
+	return nil
+}
+
+func (bm *BreakoutManager) Joined() *Breakout {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	return bm.joined
+}
+
+// RemoveMember drops a peer that left the session from its breakout
+func (bm *BreakoutManager) RemoveMember(userID string) {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	if b := bm.memberOf(userID); b != nil {
+		delete(b.Members, userID)
+	}
+}
+
+func (bm *BreakoutManager) Reset() {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	for _, b := range bm.breakouts {
+		b.sync.Close()
+	}
+	bm.breakouts = make(map[string]*Breakout)
+	bm.joined = nil
+}
+
+func (bm *BreakoutManager) List() []protocol.BreakoutInfo {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	
+	infos := make([]protocol.BreakoutInfo, 0, len(bm.breakouts))
+	for _, b := range bm.breakouts {
+		infos = append(infos, b.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// handleCreateBreakout forks the current document into a new breakout and
+// moves the given peers into it
+func (cm *CollabManager) handleCreateBreakout(req *protocol.CreateBreakoutRequest) *protocol.Message {
+	session := cm.hostSession()
+	if session == nil {
+		return createErrorMessage("create_breakout_failed", "Only the host can create breakouts")
+	}
+	if req.Name == "" {
+		return createErrorMessage("create_breakout_failed", "name is required")
+	}
+	
+	cm.breakouts.mutex.Lock()
+	if _, exists := cm.breakouts.breakouts[req.Name]; exists {
+		cm.breakouts.mutex.Unlock()
+		return createErrorMessage("create_breakout_failed", "Breakout "+req.Name+" already exists")
+	}
+	b := newBreakout(session.ID, req.Name, cm.sessionManager.GetUserID(), cm.syncManager.GetDocumentContent())
+	b.sync.SetClock(cm.clock)
+	cm.breakouts.breakouts[req.Name] = b
+	cm.breakouts.mutex.Unlock()
+	
+	for _, userID := range req.Peers {
+		if err := cm.moveToBreakout(userID, req.Name); err != nil {
+			log.Printf("Failed to move %s to breakout %s: %v", userID, req.Name, err)
+		}
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgBreakoutList, protocol.BreakoutListResponse{Breakouts: cm.breakouts.List()})
+	return msg
+}
+
+func (cm *CollabManager) handleMoveToBreakout(req *protocol.MoveToBreakoutRequest) *protocol.Message {
+	session := cm.hostSession()
+	if session == nil {
+		return createErrorMessage("move_peer_failed", "Only the host can move peers")
+	}
+	if err := cm.moveToBreakout(req.UserID, req.Name); err != nil {
+		return createErrorMessage("move_peer_failed", err.Error())
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgBreakoutList, protocol.BreakoutListResponse{Breakouts: cm.breakouts.List()})
+	return msg
+}
+
+// moveToBreakout moves a peer into the named breakout, or back to the main
+// session when name is empty, and tells the peer what to edit now
+func (cm *CollabManager) moveToBreakout(userID, name string) error {
+	cm.breakouts.mutex.Lock()
+	var target *Breakout
+	if name != "" {
+		target = cm.breakouts.breakouts[name]
+		if target == nil {
+			cm.breakouts.mutex.Unlock()
+			return fmt.Errorf("no breakout named %s", name)
+		}
+	}
+	previous := cm.breakouts.memberOf(userID)
+	if previous == target {
+		cm.breakouts.mutex.Unlock()
+		return nil
+	}
+	if previous != nil {
+		delete(previous.Members, userID)
+	}
+	if target != nil {
+		target.Members[userID] = true
+	}
+	cm.breakouts.mutex.Unlock()
+	
+	if previous != nil {
+		if err := cm.p2pManager.DetachSession(userID, previous.ID); err != nil {
+			log.Printf("Failed to detach breakout %s from %s: %v", previous.Name, userID, err)
+		}
+	}
+	
+	assignment := protocol.BreakoutAssignment{Content: cm.syncManager.GetDocumentContent()}
+	if target != nil {
+		if _, err := cm.p2pManager.AttachSession(userID, target.ID); err != nil {
+			return err
+		}
+		assignment = protocol.BreakoutAssignment{
+			Name:       target.Name,
+			BreakoutID: target.ID,
+			Content:    target.sync.GetDocumentContent(),
+		}
+	}
+	
+	msg, err := protocol.NewMessage(protocol.MsgBreakoutAssigned, assignment)
+	if err != nil {
+		return err
+	}
+	payload, err := msg.ToJSON()
+	if err != nil {
+		return err
+	}
+	return cm.p2pManager.SendMessage(userID, payload)
+}
+
+func (cm *CollabManager) handleListBreakouts() *protocol.Message {
+	if cm.hostSession() == nil {
+		return createErrorMessage("list_breakouts_failed", "Only the host tracks breakouts")
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgBreakoutList, protocol.BreakoutListResponse{Breakouts: cm.breakouts.List()})
+	return msg
+}
+
+// handleMergeBreakout applies a breakout's changes to the main document
+func (cm *CollabManager) handleMergeBreakout(ctx context.Context, req *protocol.MergeBreakoutRequest) *protocol.Message {
+	session := cm.hostSession()
+	if session == nil {
+		return createErrorMessage("merge_breakout_failed", "Only the host can merge breakouts")
+	}
+	
+	cm.breakouts.mutex.Lock()
+	b := cm.breakouts.breakouts[req.Name]
+	cm.breakouts.mutex.Unlock()
+	if b == nil {
+		return createErrorMessage("merge_breakout_failed", "No breakout named "+req.Name)
+	}
+	
+	// Changes on both sides are expressed against the fork point, so the
+	// breakout's edits can be transformed past the main session's
+	applied := 0
+	for _, diffOp := range cm.rebaseEdits(b.Base, b.sync.GetDocumentContent()) {
+		var op protocol.Operation
+		switch diffOp.Type {
+		case protocol.OpInsert:
+			op = cm.syncManager.CreateInsertOperation(diffOp.Position, diffOp.Content)
+		case protocol.OpDelete:
+			op = cm.syncManager.CreateDeleteOperation(diffOp.Position, diffOp.Length)
+		}
+		if err := cm.syncManager.ApplyLocalOperation(ctx, op); err != nil {
+			return createErrorMessage("merge_breakout_failed", err.Error())
+		}
+		applied++
+	}
+	
+	if req.Close {
+		cm.breakouts.mutex.Lock()
+		members := make([]string, 0, len(b.Members))
+		for userID := range b.Members {
+			members = append(members, userID)
+		}
+		cm.breakouts.mutex.Unlock()
+		
+		for _, userID := range members {
+			if err := cm.moveToBreakout(userID, ""); err != nil {
+				log.Printf("Failed to return %s to the main session: %v", userID, err)
+			}
+		}
+		
+		cm.breakouts.mutex.Lock()
+		delete(cm.breakouts.breakouts, b.Name)
+		cm.breakouts.mutex.Unlock()
+	}
+	
+	content, encoding := cm.contentForClient(cm.syncManager.GetDocumentContent(), session.Mode)
+	msg, _ := protocol.NewMessage(protocol.MsgBreakoutMerged, protocol.BreakoutMergedResponse{
+		Name:            b.Name,
+		Operations:      applied,
+		Closed:          req.Close,
+		Content:         content,
+		ContentEncoding: encoding,
+	})
+	return msg
+}
+
+// handlePeerBreakoutAssigned switches a member into (or out of) a breakout
+// when the host says so
+func (cm *CollabManager) handlePeerBreakoutAssigned(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy != userID {
+		return
+	}
+	
+	var assignment protocol.BreakoutAssignment
+	if err := msg.ParseData(&assignment); err != nil {
+		return
+	}
+	
+	cm.breakouts.mutex.Lock()
+	if assignment.BreakoutID == "" {
+		cm.breakouts.joined = nil
+	} else {
+		b := newBreakout(session.ID, assignment.Name, cm.sessionManager.GetUserID(), assignment.Content)
+		b.sync.SetClock(cm.clock)
+		b.ID = assignment.BreakoutID
+		cm.breakouts.joined = b
+	}
+	cm.breakouts.mutex.Unlock()
+	
+	content, encoding := cm.contentForClient(assignment.Content, session.Mode)
+	assignment.Content = content
+	assignment.ContentEncoding = encoding
+	event, _ := protocol.NewMessage(protocol.MsgBreakoutAssigned, assignment)
+	if err := cm.sendMessage(event); err != nil {
+		log.Printf("Failed to send breakout assignment: %v", err)
+	}
+}
+
+// handleBreakoutOperation applies a local edit made while in a breakout and
+// sends it to the host, who relays it to the rest of the group
+func (cm *CollabManager) handleBreakoutOperation(ctx context.Context, b *Breakout, op protocol.Operation) error {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return fmt.Errorf("no active session")
+	}
+	
+	if err := b.sync.ApplyLocalOperation(ctx, op); err != nil {
+		return err
+	}
+	
+	frame, err := protocol.EncodeOperationFrame([]protocol.Operation{op})
+	if err != nil {
+		return err
+	}
+	return cm.p2pManager.SendSessionMessage(session.CreatedBy, b.ID, frame)
+}
+
+// handleSessionMessage handles traffic on multiplexed session channels, which
+// carry breakout and remote file operations
+func (cm *CollabManager) handleSessionMessage(sessionID, userID string, data []byte) {
+	if f := cm.remoteFiles.byID(sessionID); f != nil {
+		cm.handleRemoteFileMessage(f, userID, data)
+		return
+	}
+	
+	b := cm.breakouts.byID(sessionID)
+	if b == nil {
+		return
+	}
+	
+	op, err := decodeSessionOperation(data)
+	if err != nil {
+		log.Printf("Dropping breakout %s message from %s: %v", b.Name, userID, err)
+		return
+	}
+	
+	// The host trusts the connection's identity; members trust the host's relay
+	host := cm.hostSession() != nil
+	if host {
+		op.UserID = userID
+	}
+	
+	if err := b.sync.ApplyRemoteOperation(context.Background(), op); err != nil {
+		log.Printf("Failed to apply breakout %s operation from %s: %v", b.Name, userID, err)
+		return
+	}
+	
+	// The host relays to the other members
+	if host {
+		cm.relayBreakoutOperation(b, userID, op)
+	}
+	
+	event, _ := protocol.NewMessage(protocol.MsgDocumentOperation, protocol.DocumentOperation{
+		Type:       string(op.Type),
+		Position:   op.Position,
+		Content:    op.Content,
+		Length:     op.Length,
+		UserID:     op.UserID,
+		Breakout:   b.Name,
+		Provenance: op.Provenance,
+	})
+	if err := cm.sendMessage(event); err != nil {
+		log.Printf("Failed to send breakout operation: %v", err)
+	}
+}
+
+// relayBreakoutOperation passes a member's operation on to the rest of the
+// breakout
+func (cm *CollabManager) relayBreakoutOperation(b *Breakout, from string, op protocol.Operation) {
+	frame, err := protocol.EncodeOperationFrame([]protocol.Operation{op})
+	if err != nil {
+		log.Printf("Failed to relay breakout operation: %v", err)
+		return
+	}
+	
+	cm.breakouts.mutex.Lock()
+	members := make([]string, 0, len(b.Members))
+	for member := range b.Members {
+		if member != from {
+			members = append(members, member)
+		}
+	}
+	cm.breakouts.mutex.Unlock()
+	
+	for _, member := range members {
+		if err := cm.p2pManager.SendSessionMessage(member, b.ID, frame); err != nil {
+			log.Printf("Failed to relay breakout operation to %s: %v", member, err)
+		}
+	}
+}
+
+// decodeSessionOperation reads an operation from a session channel, as a
+// binary frame or, from peers that predate those, a JSON message
+func decodeSessionOperation(data []byte) (protocol.Operation, error) {
+	if protocol.IsOperationFrame(data) {
+		ops, err := protocol.DecodeOperationFrame(data)
+		if err != nil {
+			return protocol.Operation{}, err
+		}
+		if len(ops) != 1 {
+			return protocol.Operation{}, fmt.Errorf("expected one operation, got %d", len(ops))
+		}
+		return ops[0], nil
+	}
+	
+	var op protocol.Operation
+	msg, err := protocol.ParseMessage(data)
+	if err == nil && msg.Type != protocol.MsgDocumentOperation {
+		err = fmt.Errorf("unexpected %s message", msg.Type)
+	}
+	if err == nil {
+		err = msg.ParseData(&op)
+	}
+	return op, err
+}
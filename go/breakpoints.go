@@ -0,0 +1,275 @@
+package collab
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+)
+
+// Breakpoints are shared, so a pair debugging with nvim-dap stops in the
+// same places. Neovim sends a file's breakpoints whenever they change there,
+// replacing the ones shared for it before; the host keeps them all and sends
+// everyone the whole set after each change. Breakpoints in the session's
+// document stay on their line while it is edited: each is kept as the offset
+// of its line's start, which edits move like any other position.
+const maxFileBreakpoints = 1000
+
+type breakpointEntry struct {
+	protocol.Breakpoint
+	offset int
+}
+
+// BreakpointSet is the session's breakpoints by file
+type BreakpointSet struct {
+	files map[string][]*breakpointEntry
+	mutex sync.Mutex
+}
+
+func NewBreakpointSet() *BreakpointSet {
+	return &BreakpointSet{files: make(map[string][]*breakpointEntry)}
+}
+
+// Set replaces a file's breakpoints, reporting whether they changed. A
+// breakpoint already on a line keeps who set it.
+func (bs *BreakpointSet) Set(file string, breakpoints []protocol.Breakpoint, userID, content string) bool {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	
+	setBy := make(map[int]string)
+	current := bs.fileLocked(file, content)
+	for _, bp := range current {
+		setBy[bp.Line] = bp.UserID
+	}
+	
+	next := make([]protocol.Breakpoint, 0, len(breakpoints))
+	for _, bp := range breakpoints {
+		bp.File, bp.UserID = file, userID
+		if owner, ok := setBy[bp.Line]; ok {
+			bp.UserID = owner
+		}
+		next = append(next, bp)
+	}
+	next = sortBreakpoints(next)
+	if equalBreakpoints(current, next) {
+		return false
+	}
+	
+	bs.setLocked(file, next, content)
+	return true
+}
+
+// List returns every breakpoint, by file and line
+func (bs *BreakpointSet) List(content string) []protocol.Breakpoint {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	
+	files := make([]string, 0, len(bs.files))
+	for file := range bs.files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	
+	breakpoints := []protocol.Breakpoint{}
+	for _, file := range files {
+		breakpoints = append(breakpoints, bs.fileLocked(file, content)...)
+	}
+	return breakpoints
+}
+
+// Load replaces the set with the host's
+func (bs *BreakpointSet) Load(breakpoints []protocol.Breakpoint, content string) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	
+	byFile := make(map[string][]protocol.Breakpoint)
+	for _, bp := range breakpoints {
+		byFile[bp.File] = append(byFile[bp.File], bp)
+	}
+	bs.files = make(map[string][]*breakpointEntry)
+	for file, breakpoints := range byFile {
+		bs.setLocked(file, sortBreakpoints(breakpoints), content)
+	}
+}
+
+// Transform moves the breakpoints in the session's document past an edit
+func (bs *BreakpointSet) Transform(op protocol.Operation) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	
+	for _, entry := range bs.files[""] {
+		entry.offset = transformOffset(entry.offset, op)
+	}
+}
+
+func (bs *BreakpointSet) Reset() {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	bs.files = make(map[string][]*breakpointEntry)
+}
+
+func (bs *BreakpointSet) setLocked(file string, breakpoints []protocol.Breakpoint, content string) {
+	if len(breakpoints) == 0 {
+		delete(bs.files, file)
+		return
+	}
+	entries := make([]*breakpointEntry, 0, len(breakpoints))
+	for _, bp := range breakpoints {
+		entry := &breakpointEntry{Breakpoint: bp}
+		if file == "" {
+			entry.offset = offsetOf(content, bp.Line, 0)
+		}
+		entries = append(entries, entry)
+	}
+	bs.files[file] = entries
+}
+
+// fileLocked returns a file's breakpoints on their current lines. Deleting
+// the lines between two breakpoints can bring them onto one line, where the
+// first is kept.
+func (bs *BreakpointSet) fileLocked(file, content string) []protocol.Breakpoint {
+	breakpoints := make([]protocol.Breakpoint, 0, len(bs.files[file]))
+	for _, entry := range bs.files[file] {
+		bp := entry.Breakpoint
+		if file == "" {
+			bp.Line, _ = lineColumnOf(content, entry.offset)
+		}
+		breakpoints = append(breakpoints, bp)
+	}
+	return sortBreakpoints(breakpoints)
+}
+
+// sortBreakpoints orders breakpoints by line, keeping the first on each
+func sortBreakpoints(breakpoints []protocol.Breakpoint) []protocol.Breakpoint {
+	sort.SliceStable(breakpoints, func(i, j int) bool {
+		return breakpoints[i].Line < breakpoints[j].Line
+	})
+	kept := breakpoints[:0]
+	for _, bp := range breakpoints {
+		if n := len(kept); n > 0 && kept[n-1].Line == bp.Line {
+			continue
+		}
+		kept = append(kept, bp)
+	}
+	return kept
+}
+
+func equalBreakpoints(a, b []protocol.Breakpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkBreakpoints validates a set_breakpoints request, returning its file
+func checkBreakpoints(session *session.Session, req *protocol.SetBreakpointsRequest) (string, error) {
+	file, err := sharedFile(session, req.File)
+	if err != nil {
+		return "", err
+	}
+	if len(req.Breakpoints) > maxFileBreakpoints {
+		return "", fmt.Errorf("at most %d breakpoints can be shared per file", maxFileBreakpoints)
+	}
+	for _, bp := range req.Breakpoints {
+		if bp.Line < 0 {
+			return "", fmt.Errorf("breakpoint line %d is negative", bp.Line)
+		}
+	}
+	return file, nil
+}
+
+// handleSetBreakpoints shares a file's breakpoints. Members send them to the
+// host, whose breakpoints event is the answer.
+func (cm *CollabManager) handleSetBreakpoints(req *protocol.SetBreakpointsRequest) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	file, err := checkBreakpoints(session, req)
+	if err != nil {
+		return createErrorMessage("set_breakpoints_failed", err.Error())
+	}
+	
+	if cm.hostSession() == nil {
+		if err := cm.broadcastToPeers(protocol.MsgSetBreakpoints, req); err != nil {
+			return createErrorMessage("set_breakpoints_failed", err.Error())
+		}
+		return createStatusMessage("breakpoints_set", "Sent to the host")
+	}
+	cm.setBreakpoints(cm.sessionManager.GetUserID(), file, req.Breakpoints)
+	return createStatusMessage("breakpoints_set", fmt.Sprintf("%d breakpoints", len(req.Breakpoints)))
+}
+
+// handlePeerSetBreakpoints applies a member's breakpoints on the host
+func (cm *CollabManager) handlePeerSetBreakpoints(userID string, msg *protocol.Message) {
+	session := cm.hostSession()
+	if session == nil {
+		return
+	}
+	var req protocol.SetBreakpointsRequest
+	if err := msg.ParseData(&req); err != nil {
+		return
+	}
+	file, err := checkBreakpoints(session, &req)
+	if err != nil {
+		log.Printf("Ignoring breakpoints from %s: %v", userID, err)
+		return
+	}
+	cm.setBreakpoints(userID, file, req.Breakpoints)
+}
+
+// setBreakpoints updates the host's set and sends it to everyone if it changed
+func (cm *CollabManager) setBreakpoints(userID, file string, breakpoints []protocol.Breakpoint) {
+	if !cm.breakpoints.Set(file, breakpoints, userID, cm.syncManager.GetDocumentContent()) {
+		return
+	}
+	event := cm.breakpointsEvent(userID)
+	if err := cm.broadcastToPeers(protocol.MsgBreakpoints, event); err != nil {
+		log.Printf("Failed to send breakpoints: %v", err)
+	}
+	cm.sendBreakpoints(event)
+}
+
+// handlePeerBreakpoints takes over the set the host sent
+func (cm *CollabManager) handlePeerBreakpoints(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy != userID {
+		return
+	}
+	var event protocol.BreakpointsEvent
+	if err := msg.ParseData(&event); err != nil {
+		return
+	}
+	cm.breakpoints.Load(event.Breakpoints, cm.syncManager.GetDocumentContent())
+	cm.sendBreakpoints(cm.breakpointsEvent(event.ChangedBy))
+}
+
+func (cm *CollabManager) handleGetBreakpoints() *protocol.Message {
+	if cm.sessionManager.GetCurrentSession() == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgBreakpoints, cm.breakpointsEvent(""))
+	return msg
+}
+
+func (cm *CollabManager) breakpointsEvent(changedBy string) protocol.BreakpointsEvent {
+	return protocol.BreakpointsEvent{
+		Breakpoints: cm.breakpoints.List(cm.syncManager.GetDocumentContent()),
+		ChangedBy:   changedBy,
+	}
+}
+
+func (cm *CollabManager) sendBreakpoints(event protocol.BreakpointsEvent) {
+	msg, _ := protocol.NewMessage(protocol.MsgBreakpoints, event)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send breakpoints: %v", err)
+	}
+}
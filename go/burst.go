@@ -0,0 +1,253 @@
+package collab
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// Pastes and macro replays reach the backend as a quick run of operations
+// from one user. Instead of transforming and relaying each of them, the ones
+// already waiting in the input are taken together, adjacent edits are merged
+// (consecutive inserts into one insert, repeated deletes into one delete) and
+// the result is applied in a single turn on the document. Peers get it as one
+// batch, apply it in one turn as well and hand it to Neovim as one
+// document_operations event, so the buffer changes once.
+const maxBurstOperations = 1000
+
+// collectBurst gathers the document operations from first's user queued
+// right behind it, without waiting for more to arrive. It returns the
+// message to handle, a document_operations batch when there was a burst, and
+// the first queued line that wasn't part of it. The batch carries the id of
+// its last operation and folds in the others', so each operation gets the
+// batch's response.
+func (cm *CollabManager) collectBurst(first *protocol.Message, queue <-chan []byte) (*protocol.Message, []byte) {
+	var op protocol.DocumentOperation
+	if err := first.ParseData(&op); err != nil || !cm.batchesOperations(op.File) {
+		return first, nil
+	}
+	
+	batch := protocol.DocumentOperations{Operations: []protocol.DocumentOperation{op}}
+	ids := []json.RawMessage{first.ID}
+	var next []byte
+collect:
+	for len(batch.Operations) < maxBurstOperations {
+		select {
+		case line, ok := <-queue:
+			if !ok {
+				break collect
+			}
+			var queued protocol.DocumentOperation
+			msg, err := protocol.ParseMessage(line)
+			if err != nil || msg.Type != protocol.MsgDocumentOperation || msg.ParseData(&queued) != nil || queued.UserID != op.UserID || queued.File != op.File {
+				next = line
+				break collect
+			}
+			batch.Operations = append(batch.Operations, queued)
+			ids = append(ids, msg.ID)
+		default:
+			break collect
+		}
+	}
+	
+	if len(batch.Operations) == 1 {
+		return first, next
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgDocumentOperations, batch)
+	msg.ID = ids[len(ids)-1]
+	msg.Folded = ids[:len(ids)-1]
+	return msg, next
+}
+
+// batchesOperations tells whether a burst of edits to file can be applied
+// as one batch. Each position counts on the document the operations before
+// it left, which only applying them in turn translates from a legacy
+// encoding. Breakout forks, remote files and blobs take their edits one at a
+// time too.
+func (cm *CollabManager) batchesOperations(file string) bool {
+	return cm.breakouts.Joined() == nil && file == "" && cm.clientCharset == CharsetUTF8 && cm.syncManager.GetContentMode() == collabsync.ContentModeText
+}
+
+// coalesceOperations merges each operation into the one before it where a
+// single operation has the same effect
+func coalesceOperations(ops []protocol.Operation) []protocol.Operation {
+	merged := make([]protocol.Operation, 0, len(ops))
+	for _, op := range ops {
+		if n := len(merged); n > 0 && mergeOperation(&merged[n-1], op) {
+			continue
+		}
+		merged = append(merged, op)
+	}
+	return merged
+}
+
+// mergeOperation folds op into prev when it continues it: text inserted at
+// either end of the previous insert, or deleted forward or backward from the
+// previous delete. Edits made by different tools stay apart.
+func mergeOperation(prev *protocol.Operation, op protocol.Operation) bool {
+	if prev.UserID != op.UserID || prev.Type != op.Type || prev.Provenance != op.Provenance {
+		return false
+	}
+	switch {
+	case op.Type == protocol.OpInsert && op.Position == prev.Position+len(prev.Content):
+		prev.Content += op.Content
+	case op.Type == protocol.OpInsert && op.Position == prev.Position:
+		prev.Content = op.Content + prev.Content
+	case op.Type == protocol.OpDelete && op.Position == prev.Position:
+		prev.Length += op.Length
+		return true
+	case op.Type == protocol.OpDelete && op.Position+op.Length == prev.Position:
+		prev.Position = op.Position
+		prev.Length += op.Length
+		return true
+	default:
+		return false
+	}
+	prev.Length = len(prev.Content)
+	return true
+}
+
+// handleDocumentOperations applies a burst of operations from Neovim,
+// answering the requests with ids once it was applied
+func (cm *CollabManager) handleDocumentOperations(ctx context.Context, ids []json.RawMessage, batch *protocol.DocumentOperations) *protocol.Message {
+	if len(batch.Operations) == 0 {
+		return createErrorMessage("invalid_operation", "operations is empty")
+	}
+	if !cm.batchesOperations(batch.Operations[0].File) {
+		return cm.handleEachOperation(ctx, ids[len(ids)-1], batch.Operations)
+	}
+	
+	userID := batch.Operations[0].UserID
+	if _, needsControl := cm.editAccess(userID); needsControl && cm.canSuggest(userID) {
+		return cm.suggestEdits(batch.Operations)
+	}
+	
+	ops := make([]protocol.Operation, 0, len(batch.Operations))
+	for i := range batch.Operations {
+		syncOp, failure := cm.prepareDocumentOperation(&batch.Operations[i], cm.syncManager)
+		if failure != nil {
+			return failure
+		}
+		ops = append(ops, syncOp)
+	}
+	if failure := cm.checkRules(ops, ""); failure != nil {
+		return failure
+	}
+	ops = coalesceOperations(ops)
+	
+	var response *protocol.Message
+	if cm.opFlow.run(func(queued bool) {
+		response = cm.applyDocumentOperations(ctx, ops, len(batch.Operations))
+		if queued {
+			cm.respond(response, ids...)
+		}
+	}) {
+		return createStatusMessage("operation_queued", "Document operations queued until the document is ready")
+	}
+	return response
+}
+
+// handleEachOperation handles a burst one operation at a time, answering
+// each as if it had come on its own; the last answer has the request's id
+func (cm *CollabManager) handleEachOperation(ctx context.Context, id json.RawMessage, ops []protocol.DocumentOperation) *protocol.Message {
+	var response *protocol.Message
+	for i := range ops {
+		if response != nil {
+			if err := cm.sendMessage(response); err != nil {
+				log.Printf("Failed to send response: %v", err)
+			}
+		}
+		var opID json.RawMessage
+		if i == len(ops)-1 {
+			opID = id
+		}
+		response = cm.handleDocumentOperation(ctx, opID, &ops[i])
+	}
+	return response
+}
+
+// applyDocumentOperations applies coalesced operations in order. What was
+// applied before a failure stays applied and still reaches peers.
+func (cm *CollabManager) applyDocumentOperations(ctx context.Context, ops []protocol.Operation, received int) *protocol.Message {
+	userID := cm.sessionManager.GetUserID()
+	var relay []protocol.Operation
+	for _, syncOp := range ops {
+		var err error
+		if syncOp.UserID == userID {
+			syncOp = cm.stampOperation(syncOp)
+			err = cm.syncManager.ApplyLocalOperation(ctx, syncOp)
+		} else {
+			err = cm.syncManager.ApplyRemoteOperation(ctx, syncOp)
+		}
+		if errors.Is(err, collabsync.ErrOperationHeld) || errors.Is(err, collabsync.ErrOperationReplayed) {
+			continue
+		}
+		if err != nil {
+			if relayErr := cm.relayOperations(relay); relayErr != nil {
+				log.Printf("Failed to relay operations: %v", relayErr)
+			}
+			return createErrorMessage("operation_failed", err.Error())
+		}
+		if syncOp.UserID == userID {
+			relay = append(relay, syncOp)
+		}
+	}
+	
+	if err := cm.relayOperations(relay); err != nil {
+		return createErrorMessage("operation_failed", err.Error())
+	}
+	return createStatusMessage("operations_applied", fmt.Sprintf("%d document operations applied as %d", received, len(ops)))
+}
+
+// handleServerOperations applies a batch relayed by the server in one turn
+func (cm *CollabManager) handleServerOperations(userID string, msg *protocol.Message) {
+	var batch protocol.OperationBatch
+	if err := msg.ParseData(&batch); err != nil {
+		return
+	}
+	for i := range batch.Operations {
+		batch.Operations[i].UserID = userID
+	}
+	cm.ackOperations(userID, batch.Operations)
+	if cm.holdWhilePaused(batch.Operations) {
+		return
+	}
+	
+	cm.opFlow.run(func(queued bool) {
+		cm.afterTransactions("", func() { cm.applyServerOperations(batch.Operations) })
+	})
+}
+
+// applyServerOperations applies a relayed batch and passes it on to Neovim
+// as a single event
+func (cm *CollabManager) applyServerOperations(ops []protocol.Operation) {
+	if len(ops) == 0 || !cm.acceptsPeerOperation(ops[0].UserID) {
+		return
+	}
+	
+	var event protocol.DocumentOperations
+	for _, op := range ops {
+		err := cm.syncManager.ApplyRemoteOperation(context.Background(), op)
+		if errors.Is(err, collabsync.ErrOperationHeld) || errors.Is(err, collabsync.ErrOperationReplayed) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to apply operation from %s: %v", op.UserID, err)
+			break
+		}
+		event.Operations = append(event.Operations, cm.clientOperation(op))
+	}
+	if len(event.Operations) == 0 {
+		return
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgDocumentOperations, event)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send operations: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package collab
+
+import (
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+)
+
+// Peers tell each other what their client is and can handle: Neovim or a
+// program embedding the engine, its version, collab.nvim's version, and
+// whether it handles chat and multi-file (project) sessions. Neovim
+// describes itself with client_info when it starts; the backend passes that
+// on to the peers in the session and to each that joins. Neovim gets a
+// peer_capabilities event, naming what the peer lacks, and the roster
+// carries it from then on. Broadcasts of a kind a peer can't handle skip it.
+// Peers that never describe themselves, as older versions don't, are
+// assumed to handle everything.
+const (
+	maxCapabilityField = 64
+)
+
+// featureFor names the feature a peer needs to handle msgType, if any
+func featureFor(msgType string) string {
+	switch msgType {
+	case protocol.MsgChat:
+		return protocol.FeatureChat
+	case protocol.MsgListProjectFiles, protocol.MsgOpenRemoteFile, protocol.MsgCloseRemoteFile:
+		return protocol.FeatureMultiFile
+	}
+	return ""
+}
+
+// moduleVersion returns collab.nvim's version as built, "" when unknown
+func moduleVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return ""
+}
+
+// CapabilityRoster holds what the local client and each peer can handle
+type CapabilityRoster struct {
+	local *protocol.PeerCapabilities
+	peers map[string]protocol.PeerCapabilities
+	mutex sync.RWMutex
+}
+
+func NewCapabilityRoster() *CapabilityRoster {
+	return &CapabilityRoster{peers: make(map[string]protocol.PeerCapabilities)}
+}
+
+func (cr *CapabilityRoster) SetLocal(caps protocol.PeerCapabilities) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.local = &caps
+}
+
+// Local returns what the local client said it is, nil before it said
+func (cr *CapabilityRoster) Local() *protocol.PeerCapabilities {
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	if cr.local == nil {
+		return nil
+	}
+	caps := *cr.local
+	return &caps
+}
+
+func (cr *CapabilityRoster) Set(userID string, caps protocol.PeerCapabilities) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.peers[userID] = caps
+}
+
+func (cr *CapabilityRoster) Get(userID string) (protocol.PeerCapabilities, bool) {
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	caps, ok := cr.peers[userID]
+	return caps, ok
+}
+
+// Forget drops a peer's capabilities, e.g. when it leaves
+func (cr *CapabilityRoster) Forget(userID string) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	delete(cr.peers, userID)
+}
+
+// ResetPeers forgets every peer, keeping the local client's
+func (cr *CapabilityRoster) ResetPeers() {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.peers = make(map[string]protocol.PeerCapabilities)
+}
+
+// Lacking returns the peers known not to handle msgType
+func (cr *CapabilityRoster) Lacking(msgType string) map[string]bool {
+	feature := featureFor(msgType)
+	if feature == "" {
+		return nil
+	}
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	var lacking map[string]bool
+	for userID, caps := range cr.peers {
+		if !caps.Has(feature) {
+			if lacking == nil {
+				lacking = make(map[string]bool)
+			}
+			lacking[userID] = true
+		}
+	}
+	return lacking
+}
+
+// clipCapabilities bounds the free-form fields a peer sent
+func clipCapabilities(caps protocol.PeerCapabilities) protocol.PeerCapabilities {
+	clip := func(s string) string {
+		if len(s) > maxCapabilityField {
+			return s[:maxCapabilityField]
+		}
+		return s
+	}
+	caps.Client = clip(caps.Client)
+	caps.ClientVersion = clip(caps.ClientVersion)
+	caps.PluginVersion = clip(caps.PluginVersion)
+	return caps
+}
+
+// sendToPeersExcept sends payload to every connected peer not in skip, for
+// broadcasts some peers can't handle
+func (cm *CollabManager) sendToPeersExcept(payload []byte, skip map[string]bool) error {
+	peers := cm.p2pManager.GetConnectedPeers()
+	sort.Strings(peers)
+	var lastErr error
+	for _, userID := range peers {
+		if skip[userID] {
+			continue
+		}
+		if err := cm.p2pManager.SendMessage(userID, payload); err != nil {
+			log.Printf("Failed to send message to peer %s: %v", userID, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// handleClientInfo records what the local client is and can handle, and
+// tells the peers already in the session
+func (cm *CollabManager) handleClientInfo(req *protocol.PeerCapabilities) *protocol.Message {
+	if req.Client == "" {
+		return createErrorMessage("client_info_failed", "client is required")
+	}
+	caps := clipCapabilities(*req)
+	if caps.PluginVersion == "" {
+		caps.PluginVersion = moduleVersion()
+	}
+	cm.capabilities.SetLocal(caps)
+	
+	if session := cm.sessionManager.GetCurrentSession(); session != nil {
+		cm.recordCapabilities(session, cm.sessionManager.GetUserID(), caps)
+		if err := cm.broadcastToPeers(protocol.MsgPeerCapabilities, caps); err != nil {
+			log.Printf("Failed to send capabilities: %v", err)
+		}
+	}
+	return createStatusMessage(protocol.MsgClientInfo, caps.Client+" "+caps.ClientVersion)
+}
+
+// sendCapabilities tells a peer that joined what the local client can handle
+func (cm *CollabManager) sendCapabilities(userID string) {
+	if caps := cm.capabilities.Local(); caps != nil {
+		cm.sendToPeer(userID, protocol.MsgPeerCapabilities, caps)
+	}
+}
+
+// recordCapabilities puts caps on userID's roster entry, if the roster has one
+func (cm *CollabManager) recordCapabilities(session *session.Session, userID string, caps protocol.PeerCapabilities) {
+	session.Mutex.Lock()
+	defer session.Mutex.Unlock()
+	if peer, ok := session.Peers[userID]; ok {
+		peer.Capabilities = &caps
+	}
+}
+
+// handlePeerCapabilities records what a peer can handle and tells Neovim
+func (cm *CollabManager) handlePeerCapabilities(userID string, msg *protocol.Message) {
+	var caps protocol.PeerCapabilities
+	if userID == protocol.ServerUserID || msg.ParseData(&caps) != nil {
+		return
+	}
+	caps = clipCapabilities(caps)
+	cm.capabilities.Set(userID, caps)
+	
+	event := protocol.PeerCapabilitiesEvent{UserID: userID, Capabilities: caps, Missing: caps.Missing()}
+	if session := cm.sessionManager.GetCurrentSession(); session != nil {
+		cm.recordCapabilities(session, userID, caps)
+		event.Name = peerName(session, userID)
+	}
+	if err := cm.sendEvent(protocol.MsgPeerCapabilities, event); err != nil {
+		log.Printf("Failed to send peer capabilities: %v", err)
+	}
+}
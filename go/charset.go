@@ -0,0 +1,130 @@
+package collab
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+)
+
+// CharsetUTF8 is the encoding the sync model always operates in
+const CharsetUTF8 = "utf-8"
+
+// legacyCharsets maps Neovim 'fileencoding' names to their codecs
+var legacyCharsets = map[string]encoding.Encoding{
+	"latin1":     charmap.ISO8859_1,
+	"iso-8859-1": charmap.ISO8859_1,
+	"cp1252":     charmap.Windows1252,
+	"sjis":       japanese.ShiftJIS,
+	"shift_jis":  japanese.ShiftJIS,
+	"shift-jis":  japanese.ShiftJIS,
+	"cp932":      japanese.ShiftJIS,
+	"euc-jp":     japanese.EUCJP,
+}
+
+// normalizeCharset canonicalizes a charset name. An empty name means unknown.
+func normalizeCharset(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case "utf8", "utf-8":
+		return CharsetUTF8
+	}
+	return name
+}
+
+// lookupCharset returns the codec for a legacy charset, or nil for UTF-8
+func lookupCharset(name string) (encoding.Encoding, error) {
+	name = normalizeCharset(name)
+	if name == CharsetUTF8 {
+		return nil, nil
+	}
+	enc, exists := legacyCharsets[name]
+	if !exists {
+		return nil, fmt.Errorf("unsupported file encoding: %s", name)
+	}
+	return enc, nil
+}
+
+// detectCharset guesses the encoding of content. Valid UTF-8 is taken as is;
+// otherwise Shift-JIS is preferred when it decodes cleanly, with latin1 as the
+// fallback since every byte sequence is valid latin1.
+func detectCharset(content string) string {
+	if utf8.ValidString(content) {
+		return CharsetUTF8
+	}
+	
+	decoded, err := japanese.ShiftJIS.NewDecoder().String(content)
+	if err == nil && !strings.ContainsRune(decoded, utf8.RuneError) {
+		return "shift_jis"
+	}
+	
+	return "latin1"
+}
+
+// decodeCharset converts content from the given charset to UTF-8
+func decodeCharset(content, charset string) (string, error) {
+	enc, err := lookupCharset(charset)
+	if err != nil {
+		return "", err
+	}
+	if enc == nil {
+		if !utf8.ValidString(content) {
+			return "", fmt.Errorf("content is not valid UTF-8")
+		}
+		return content, nil
+	}
+	
+	decoded, err := enc.NewDecoder().String(content)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s content: %v", charset, err)
+	}
+	return decoded, nil
+}
+
+// encodeCharset converts UTF-8 content back to the given charset. Characters
+// the charset can't represent (e.g. a peer typing emoji into a latin1 file)
+// are replaced rather than failing the whole conversion.
+func encodeCharset(content, charset string) (string, error) {
+	enc, err := lookupCharset(charset)
+	if err != nil {
+		return "", err
+	}
+	if enc == nil {
+		return content, nil
+	}
+	
+	encoded, err := encoding.ReplaceUnsupported(enc.NewEncoder()).String(content)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode content as %s: %v", charset, err)
+	}
+	return encoded, nil
+}
+
+// charsetOffset translates a byte offset into document as encoded in charset
+// into the matching byte offset in the UTF-8 document
+func charsetOffset(document, charset string, offset int) (int, error) {
+	enc, err := lookupCharset(charset)
+	if err != nil {
+		return 0, err
+	}
+	if enc == nil || offset <= 0 {
+		return offset, nil
+	}
+	
+	encoded, err := encodeCharset(document, charset)
+	if err != nil {
+		return 0, err
+	}
+	if offset > len(encoded) {
+		offset = len(encoded)
+	}
+	
+	prefix, err := decodeCharset(encoded[:offset], charset)
+	if err != nil {
+		return 0, err
+	}
+	return len(prefix), nil
+}
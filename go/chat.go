@@ -0,0 +1,274 @@
+package collab
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+)
+
+// Chat goes to everyone in the session as plain text. A message starting
+// with "/" is a command instead: the sender's backend runs it against the
+// subsystem it names and answers with a system message only the sender sees,
+// so commands behave the same whichever client typed them. "//" sends a
+// message that starts with a slash.
+const chatCommandPrefix = "/"
+
+// chatCommandHelp is what /help lists
+var chatCommandHelp = []string{
+	"/who - list who is in the session, the host and who has control",
+	"/control [user] - request control, or as the host hand it to user for a while",
+	"/release - give up control",
+	"/checkpoint - as the host, save a checkpoint of the session now",
+	"/mute <user> - hide user's chat messages and cursor",
+	"/unmute <user> - show user's chat messages and cursor again",
+	"/help - show this list",
+}
+
+// handleSendChat shares a chat message with the session or runs a command
+func (cm *CollabManager) handleSendChat(req *protocol.SendChatRequest) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	text := strings.TrimSpace(req.Text)
+	if text == "" {
+		return createErrorMessage("send_chat_failed", "text is required")
+	}
+	
+	if strings.HasPrefix(text, chatCommandPrefix) && !strings.HasPrefix(text, chatCommandPrefix+chatCommandPrefix) {
+		return cm.chatReply(cm.runChatCommand(session, text))
+	}
+	text = strings.TrimPrefix(text, chatCommandPrefix)
+	
+	userID := cm.sessionManager.GetUserID()
+	event := protocol.ChatEvent{UserID: userID, Text: text, SentAt: time.Now().UTC()}
+	if err := cm.broadcastToPeers(protocol.MsgChat, event); err != nil {
+		return createErrorMessage("send_chat_failed", err.Error())
+	}
+	cm.sessionManager.RecordChat(userID, text)
+	
+	event.Name = peerName(session, userID)
+	msg, _ := protocol.NewMessage(protocol.MsgChat, event)
+	return msg
+}
+
+// handlePeerChat passes a peer's chat message on to Neovim unless the local
+// user muted them
+func (cm *CollabManager) handlePeerChat(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return
+	}
+	var event protocol.ChatEvent
+	if err := msg.ParseData(&event); err != nil || event.Text == "" {
+		return
+	}
+	cm.sessionManager.RecordChat(userID, event.Text)
+	if cm.mutes.Muted(userID) {
+		return
+	}
+	
+	event.UserID, event.Name, event.System = userID, peerName(session, userID), false
+	if event.SentAt.IsZero() {
+		event.SentAt = time.Now().UTC()
+	}
+	if err := cm.sendEvent(protocol.MsgChat, event); err != nil {
+		log.Printf("Failed to send chat: %v", err)
+	}
+}
+
+// chatReply is a system message answering a command
+func (cm *CollabManager) chatReply(text string) *protocol.Message {
+	msg, _ := protocol.NewMessage(protocol.MsgChat, protocol.ChatEvent{Text: text, SentAt: time.Now().UTC(), System: true})
+	return msg
+}
+
+// runChatCommand runs a slash command and returns the reply
+func (cm *CollabManager) runChatCommand(session *session.Session, text string) string {
+	fields := strings.Fields(strings.TrimPrefix(text, chatCommandPrefix))
+	if len(fields) == 0 {
+		return "Type /help for the list of commands"
+	}
+	name, args := strings.ToLower(fields[0]), fields[1:]
+	
+	switch name {
+	case "help":
+		return strings.Join(chatCommandHelp, "\n")
+	
+	case "who":
+		return cm.chatWho(session)
+	
+	case "control":
+		if len(args) == 0 {
+			return cm.chatResult(cm.handleControlRequest(&protocol.ControlRequest{RequestedBy: cm.sessionManager.GetUserID()}), "Control requested")
+		}
+		userID, err := findPeer(session, args[0])
+		if err != nil {
+			return err.Error()
+		}
+		return cm.chatResult(cm.handleGrantTemporaryControl(&protocol.GrantTemporaryControlRequest{UserID: userID}),
+			fmt.Sprintf("%s has control for %v", peerName(session, userID), defaultHandControlDuration))
+	
+	case "release":
+		return cm.chatResult(cm.handleReleaseControl(), "Control released")
+	
+	case "checkpoint":
+		return cm.chatCheckpoint(session)
+	
+	case "mute", "unmute":
+		if len(args) == 0 {
+			return fmt.Sprintf("Usage: /%s <user>", name)
+		}
+		userID, err := findPeer(session, args[0])
+		if err != nil {
+			return err.Error()
+		}
+		if name == "mute" {
+			return cm.chatResult(cm.mutePeer(session, userID), "Muted "+peerName(session, userID))
+		}
+		return cm.chatResult(cm.unmutePeer(session, userID), "Unmuted "+peerName(session, userID))
+	}
+	return fmt.Sprintf("Unknown command /%s, type /help for the list", name)
+}
+
+// chatResult turns a handler's response into a reply. Anything but an error
+// also goes to Neovim as usual, so its view of the session stays current.
+func (cm *CollabManager) chatResult(response *protocol.Message, done string) string {
+	if response.Type == protocol.MsgError {
+		var failure protocol.ErrorMessage
+		if response.ParseData(&failure) == nil && failure.Message != "" {
+			return failure.Message
+		}
+		return "Failed"
+	}
+	if err := cm.sendMessage(response); err != nil {
+		log.Printf("Failed to send %s: %v", response.Type, err)
+	}
+	return done
+}
+
+// chatWho lists the session's members, the host first
+func (cm *CollabManager) chatWho(session *session.Session) string {
+	raised := make(map[string]bool)
+	for _, hand := range cm.hands.List() {
+		raised[hand.UserID] = true
+	}
+	clock := cm.syncManager.GetVectorClock()
+	
+	session.Mutex.RLock()
+	defer session.Mutex.RUnlock()
+	
+	userIDs := make([]string, 0, len(session.Peers))
+	for userID := range session.Peers {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Slice(userIDs, func(i, j int) bool {
+		if (userIDs[i] == session.CreatedBy) != (userIDs[j] == session.CreatedBy) {
+			return userIDs[i] == session.CreatedBy
+		}
+		return userIDs[i] < userIDs[j]
+	})
+	
+	lines := []string{fmt.Sprintf("%d in the session:", len(userIDs))}
+	for _, userID := range userIDs {
+		var notes []string
+		if userID == cm.sessionManager.GetUserID() {
+			notes = append(notes, "you")
+		}
+		if userID == session.CreatedBy {
+			notes = append(notes, "host")
+		}
+		if userID == session.Controller {
+			notes = append(notes, "has control")
+		}
+		if raised[userID] {
+			notes = append(notes, "hand raised")
+		}
+		if cm.mutes.Muted(userID) {
+			notes = append(notes, "muted")
+		}
+		if behind, ok := cm.frontiers.Behind(userID, clock); ok && behind > 0 {
+			notes = append(notes, fmt.Sprintf("%d operations behind", behind))
+		}
+		if caps, ok := cm.capabilities.Get(userID); ok {
+			for _, feature := range caps.Missing() {
+				notes = append(notes, "no "+strings.ReplaceAll(feature, "_", "-"))
+			}
+		}
+		
+		line := userID
+		if name := session.Peers[userID].Name; name != "" && name != userID {
+			line = fmt.Sprintf("%s (%s)", name, userID)
+		}
+		if len(notes) > 0 {
+			line += " - " + strings.Join(notes, ", ")
+		}
+		lines = append(lines, line)
+	}
+	if watching := cm.spectators.Load(); watching > 0 {
+		lines = append(lines, fmt.Sprintf("%d spectators watching", watching))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// chatCheckpoint saves a checkpoint now rather than on the next tick
+func (cm *CollabManager) chatCheckpoint(session *session.Session) string {
+	if cm.hostSession() == nil {
+		return "Only the host keeps checkpoints"
+	}
+	path := cm.checkpointPath()
+	if path == "" {
+		return "Checkpoints need a data directory"
+	}
+	
+	cm.checkpoint()
+	cm.liveness.mutex.Lock()
+	saved := strings.HasPrefix(cm.liveness.checkpointed, session.ID+"@")
+	cm.liveness.mutex.Unlock()
+	if !saved {
+		return "Failed to save a checkpoint, see the log"
+	}
+	return "Checkpoint saved to " + path
+}
+
+// findPeer resolves a user ID or a name, ignoring case, to a member's ID
+func findPeer(session *session.Session, who string) (string, error) {
+	who = strings.TrimPrefix(who, "@")
+	
+	session.Mutex.RLock()
+	defer session.Mutex.RUnlock()
+	
+	if _, ok := session.Peers[who]; ok {
+		return who, nil
+	}
+	var matches []string
+	for userID, peer := range session.Peers {
+		if strings.EqualFold(peer.Name, who) || strings.EqualFold(userID, who) {
+			matches = append(matches, userID)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no one called %s is in the session", who)
+	case 1:
+		return matches[0], nil
+	}
+	sort.Strings(matches)
+	return "", fmt.Errorf("%s could be any of %s", who, strings.Join(matches, ", "))
+}
+
+// peerName is a member's display name, or their ID without one
+func peerName(session *session.Session, userID string) string {
+	session.Mutex.RLock()
+	defer session.Mutex.RUnlock()
+	
+	if peer, ok := session.Peers[userID]; ok && peer.Name != "" {
+		return peer.Name
+	}
+	return userID
+}
@@ -0,0 +1,137 @@
+package collab
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// A peer's clock is compared with the local one by probe: the peer answers
+// with its time, and its offset is that time less the midpoint of the round
+// trip. The estimate is off by at most half the round trip, so it is kept
+// with the round trip it was measured over. Members probe the host every
+// clockProbeInterval and run their HybridClock at the host's time.
+const clockProbeInterval = 30 * time.Second
+
+type clockOffset struct {
+	offset     time.Duration // the peer's clock less the local one
+	rtt        time.Duration
+	measuredAt time.Time
+}
+
+// ClockOffsets holds the latest measured offset of each peer's clock
+type ClockOffsets struct {
+	peers map[string]clockOffset
+	mutex sync.Mutex
+}
+
+func NewClockOffsets() *ClockOffsets {
+	return &ClockOffsets{peers: make(map[string]clockOffset)}
+}
+
+// Observe records a probe of userID sent at sentAt and answered with their
+// time peerTime, received at receivedAt
+func (co *ClockOffsets) Observe(userID string, sentAt, peerTime, receivedAt time.Time) {
+	rtt := receivedAt.Sub(sentAt)
+	if rtt < 0 {
+		return
+	}
+	midpoint := sentAt.Add(rtt / 2)
+	
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	co.peers[userID] = clockOffset{offset: peerTime.Sub(midpoint), rtt: rtt, measuredAt: receivedAt}
+}
+
+// Get returns a peer's offset, if it was measured
+func (co *ClockOffsets) Get(userID string) (clockOffset, bool) {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	offset, ok := co.peers[userID]
+	return offset, ok
+}
+
+func (co *ClockOffsets) Remove(userID string) {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	delete(co.peers, userID)
+}
+
+// probeClocks asks every connected peer for their time
+func (cm *CollabManager) probeClocks() {
+	probe := protocol.ClockProbeMessage{SentAt: time.Now().UnixNano()}
+	for _, userID := range cm.p2pManager.GetConnectedPeers() {
+		cm.sendToPeer(userID, protocol.MsgClockProbe, probe)
+	}
+}
+
+// probeHostClock asks the session's host for their time, unless the local
+// user is the host
+func (cm *CollabManager) probeHostClock() {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy == cm.sessionManager.GetUserID() {
+		return
+	}
+	cm.sendToPeer(session.CreatedBy, protocol.MsgClockProbe, protocol.ClockProbeMessage{SentAt: time.Now().UnixNano()})
+}
+
+// runClockProbes keeps the clock at the host's time until stop is closed
+func (cm *CollabManager) runClockProbes(stop <-chan struct{}) {
+	ticker := time.NewTicker(clockProbeInterval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			cm.probeHostClock()
+		}
+	}
+}
+
+// handlePeerClockProbe answers a peer's probe with the local time
+func (cm *CollabManager) handlePeerClockProbe(userID string, msg *protocol.Message) {
+	var probe protocol.ClockProbeMessage
+	if err := msg.ParseData(&probe); err != nil {
+		return
+	}
+	cm.sendToPeer(userID, protocol.MsgClockReply, protocol.ClockProbeMessage{SentAt: probe.SentAt, Time: time.Now().UnixNano()})
+}
+
+// handlePeerClockReply records the offset a probe measured
+func (cm *CollabManager) handlePeerClockReply(userID string, msg *protocol.Message) {
+	receivedAt := time.Now()
+	var reply protocol.ClockProbeMessage
+	if err := msg.ParseData(&reply); err != nil || reply.SentAt == 0 || reply.Time == 0 {
+		return
+	}
+	sentAt := time.Unix(0, reply.SentAt)
+	if sentAt.After(receivedAt) {
+		log.Printf("Ignoring clock reply from %s to a probe not sent yet", userID)
+		return
+	}
+	cm.clocks.Observe(userID, sentAt, time.Unix(0, reply.Time), receivedAt)
+	
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy != userID || userID == cm.sessionManager.GetUserID() {
+		return
+	}
+	offset, _ := cm.clocks.Get(userID)
+	if !cm.clock.SetOffset(offset.offset) {
+		return
+	}
+	log.Printf("Clock is %s off the host's", offset.offset.Round(time.Millisecond))
+	err := cm.sendEvent(protocol.MsgClockSkew, protocol.ClockSkewEvent{
+		UserID:   userID,
+		Name:     peerName(session, userID),
+		OffsetMS: offset.offset.Milliseconds(),
+		Skewed:   offset.offset.Abs() > collabsync.ClockSkewWarning,
+	})
+	if err != nil {
+		log.Printf("Failed to send clock skew: %v", err)
+	}
+}
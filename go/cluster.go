@@ -0,0 +1,350 @@
+package collab
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Several `collab serve` instances can run behind one load balancer. A
+// session lives on one instance, which claims it in Redis under
+// "collab:session:<id>" with its cluster address; connections for the
+// session that land on another instance are passed through to the owner, so
+// its members all meet there. Signaling servers share their rooms the same
+// way. Claims expire after clusterClaimTTL unless the
+// owner renews them, so sessions of an instance that died can be created
+// again elsewhere. Instances reach each other on the cluster listener, which
+// is plain TCP and belongs on a private network.
+const (
+	clusterClaimTTL    = 30 * time.Second
+	clusterKeyPrefix   = "collab:session:"
+	clusterDialTimeout = 5 * time.Second
+)
+
+// ClusterConfig joins `collab serve` instances into one deployment
+type ClusterConfig struct {
+	RedisURL  string `json:"redis_url"`           // redis://[:password@]host:port[/db]
+	Listen    string `json:"listen"`              // where other instances connect, e.g. ":7424"
+	Advertise string `json:"advertise,omitempty"` // how they reach it; Listen when unset
+}
+
+func (c ClusterConfig) enabled() bool {
+	return c.RedisURL != ""
+}
+
+// serverCluster is an instance's view of the deployment. A nil cluster is a
+// standalone server.
+type serverCluster struct {
+	redis   *redisClient
+	address string // this instance's cluster address
+	owned   map[string]bool
+	mutex   sync.Mutex
+}
+
+func newServerCluster(config ClusterConfig) (*serverCluster, error) {
+	if config.Listen == "" {
+		return nil, fmt.Errorf("cluster.listen is required with cluster.redis_url")
+	}
+	redis, err := newRedisClient(config.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+	address := config.Advertise
+	if address == "" {
+		address = config.Listen
+	}
+	if host, _, err := net.SplitHostPort(address); err != nil || host == "" {
+		return nil, fmt.Errorf("cluster address %q needs a host other instances can reach; set cluster.advertise", address)
+	}
+	return &serverCluster{redis: redis, address: address, owned: make(map[string]bool)}, nil
+}
+
+// route returns the instance a hello belongs on, or "" for this one. A
+// create claims the session unless another instance has it.
+func (sc *serverCluster) route(hello protocol.ServerHello) (string, error) {
+	if sc == nil {
+		return "", nil
+	}
+	if hello.Create != nil {
+		return sc.claim(hello.SessionID)
+	}
+	return sc.owner(hello.SessionID)
+}
+
+// claim claims a session for this instance unless another instance has it,
+// returning that one, or "" for this one. A claim this instance already held
+// is kept renewed.
+func (sc *serverCluster) claim(sessionID string) (string, error) {
+	if sc == nil {
+		return "", nil
+	}
+	claimed, err := sc.redis.setNX(clusterKeyPrefix+sessionID, sc.address, clusterClaimTTL)
+	if err != nil {
+		return "", err
+	}
+	if !claimed {
+		owner, err := sc.owner(sessionID)
+		if err != nil || owner != "" {
+			return owner, err
+		}
+	}
+	sc.mutex.Lock()
+	sc.owned[sessionID] = true
+	sc.mutex.Unlock()
+	return "", nil
+}
+
+// owner returns the instance that has a session, or "" for this one or none
+func (sc *serverCluster) owner(sessionID string) (string, error) {
+	owner, err := sc.redis.get(clusterKeyPrefix + sessionID)
+	if err != nil || owner == sc.address {
+		return "", err
+	}
+	return owner, nil
+}
+
+// release gives up the claim on a session that ended here
+func (sc *serverCluster) release(sessionID string) {
+	if sc == nil {
+		return
+	}
+	sc.mutex.Lock()
+	owned := sc.owned[sessionID]
+	delete(sc.owned, sessionID)
+	sc.mutex.Unlock()
+	if !owned {
+		return
+	}
+	
+	key := clusterKeyPrefix + sessionID
+	if owner, err := sc.redis.get(key); err == nil && owner == sc.address {
+		if err := sc.redis.del(key); err != nil {
+			log.Printf("Failed to release session %s: %v", sessionID, err)
+		}
+	}
+}
+
+// releaseClaim gives up the cluster's claim on a session unless it is still
+// live here
+func (cs *CollabServer) releaseClaim(sessionID string) {
+	cs.mutex.Lock()
+	_, live := cs.sessions[sessionID]
+	cs.mutex.Unlock()
+	if !live {
+		cs.cluster.release(sessionID)
+	}
+}
+
+// renewClaims keeps the claims on this instance's sessions alive until stop
+// is closed
+func (sc *serverCluster) renewClaims(stop <-chan struct{}) {
+	ticker := time.NewTicker(clusterClaimTTL / 3)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		sc.mutex.Lock()
+		owned := make([]string, 0, len(sc.owned))
+		for sessionID := range sc.owned {
+			owned = append(owned, sessionID)
+		}
+		sc.mutex.Unlock()
+		
+		for _, sessionID := range owned {
+			if err := sc.redis.expire(clusterKeyPrefix+sessionID, clusterClaimTTL); err != nil {
+				log.Printf("Failed to renew the claim on session %s: %v", sessionID, err)
+			}
+		}
+	}
+}
+
+// forward passes a connection whose hello was already read through to the
+// instance that owns its session
+func (sc *serverCluster) forward(conn net.Conn, hello []byte, owner string) error {
+	upstream, err := net.DialTimeout("tcp", owner, clusterDialTimeout)
+	if err != nil {
+		return fmt.Errorf("the session's server is unreachable")
+	}
+	if err := protocol.WriteFrame(upstream, hello); err != nil {
+		upstream.Close()
+		return fmt.Errorf("the session's server is unreachable")
+	}
+	conn.SetDeadline(time.Time{})
+	
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go pipe(upstream, conn)
+	go pipe(conn, upstream)
+	<-done
+	conn.Close()
+	upstream.Close()
+	<-done
+	return nil
+}
+
+// redisClient speaks just enough RESP for session claims, over one
+// connection that is redialed after a failure
+type redisClient struct {
+	address  string
+	password string
+	db       int
+	conn     net.Conn
+	reader   *bufio.Reader
+	mutex    sync.Mutex
+}
+
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid Redis URL %q, expected redis://host:port", rawURL)
+	}
+	rc := &redisClient{address: u.Host}
+	if u.Port() == "" {
+		rc.address = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		rc.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if rc.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+	return rc, nil
+}
+
+func (rc *redisClient) setNX(key, value string, ttl time.Duration) (bool, error) {
+	reply, err := rc.do("SET", key, value, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return reply != nil, err
+}
+
+// get returns "" for a missing key
+func (rc *redisClient) get(key string) (string, error) {
+	reply, err := rc.do("GET", key)
+	value, _ := reply.(string)
+	return value, err
+}
+
+func (rc *redisClient) expire(key string, ttl time.Duration) error {
+	_, err := rc.do("PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (rc *redisClient) del(key string) error {
+	_, err := rc.do("DEL", key)
+	return err
+}
+
+// do sends a command and returns its reply: a string, an int64 or nil
+func (rc *redisClient) do(args ...string) (interface{}, error) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	
+	if rc.conn == nil {
+		if err := rc.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := rc.roundTrip(args)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		rc.conn.Close()
+		rc.conn = nil
+	}
+	return reply, err
+}
+
+func (rc *redisClient) dial() error {
+	conn, err := net.DialTimeout("tcp", rc.address, clusterDialTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to reach Redis at %s: %v", rc.address, err)
+	}
+	rc.conn, rc.reader = conn, bufio.NewReader(conn)
+	
+	var setup [][]string
+	if rc.password != "" {
+		setup = append(setup, []string{"AUTH", rc.password})
+	}
+	if rc.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(rc.db)})
+	}
+	for _, args := range setup {
+		if _, err := rc.roundTrip(args); err != nil {
+			conn.Close()
+			rc.conn = nil
+			return fmt.Errorf("Redis %s failed: %v", args[0], err)
+		}
+	}
+	return nil
+}
+
+func (rc *redisClient) roundTrip(args []string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(clusterDialTimeout))
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(rc.conn, command.String()); err != nil {
+		return nil, err
+	}
+	return rc.readReply()
+}
+
+// redisError is an error reply, after which the connection is still usable
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+func (rc *redisClient) readReply() (interface{}, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty Redis reply")
+	}
+	
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rc.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	}
+	return nil, fmt.Errorf("unexpected Redis reply %q", line)
+}
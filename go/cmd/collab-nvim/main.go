@@ -0,0 +1,96 @@
+// Command collab-nvim is the backend Neovim talks to over stdin and stdout,
+// with `daemon` the same backend shared by several Neovims over a Unix
+// socket, or with `serve` the central server clients connect to (or, with
+// -signaling, a signaling server for peer-to-peer sessions).
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	
+	collab "github.com/EmreDay1/collab.nvim/go"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// setupGracefulShutdown handles cleanup on process termination
+func setupGracefulShutdown(cleanup func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	
+	go func() {
+		<-c
+		log.Println("Shutting down gracefully...")
+		cleanup()
+		os.Exit(0)
+	}()
+}
+
+func main() {
+	// Setup logging to stderr (stdout is reserved for communication with Neovim)
+	log.SetOutput(os.Stderr)
+	log.SetPrefix("[collab.nvim] ")
+	
+	configPath := flag.String("config", collab.DefaultConfigPath(), "path to the JSON config file")
+	wireFormat := flag.String("wire", collab.WireJSON, "encoding of messages with Neovim: json, framed-json or msgpack")
+	flag.Parse()
+	
+	config, err := collab.LoadConfig(*configPath)
+	if err != nil {
+		log.Printf("Using default configuration: %v", err)
+		config = collab.DefaultConfig()
+	}
+	
+	// `collab serve` runs the central server instead of talking to Neovim
+	switch flag.Arg(0) {
+	case "serve":
+		if err := collab.RunServe(config, flag.Args()[1:]); err != nil {
+			log.Fatalf("Server failed: %v", err)
+		}
+		return
+	case "ot-vectors":
+		if err := collabsync.RunTransformVectors(flag.Args()[1:]); err != nil {
+			log.Fatalf("Transform vectors: %v", err)
+		}
+		return
+	case "check-convergence":
+		if err := collabsync.RunCheckConvergence(flag.Args()[1:]); err != nil {
+			log.Fatalf("Convergence check failed: %v", err)
+		}
+		return
+	}
+	
+	log.Println("Starting collab.nvim Go process")
+	
+	shutdownTracing, err := collab.InitTracing(config)
+	if err != nil {
+		log.Printf("Tracing disabled: %v", err)
+	}
+	
+	// Initialize collaboration manager
+	collabManager := collab.NewCollabManager(config)
+	
+	// Setup graceful shutdown
+	setupGracefulShutdown(func() {
+		collabManager.Close()
+		shutdownTracing()
+		log.Println("Cleanup completed")
+	})
+	
+	// Main message processing loop
+	if flag.Arg(0) == "daemon" {
+		err = collab.RunDaemon(collabManager, flag.Args()[1:])
+	} else {
+		if err := collabManager.SetWireFormat(*wireFormat); err != nil {
+			log.Fatalf("%v", err)
+		}
+		err = collabManager.Run(os.Stdin)
+	}
+	if err != nil {
+		log.Printf("Scanner error: %v", err)
+	}
+	
+	log.Println("collab.nvim Go process terminated")
+}
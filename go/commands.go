@@ -0,0 +1,583 @@
+package collab
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Peers can ask the host to run one of the commands the host's config
+// allows, say "make test". The host's Neovim approves or denies each request.
+// An approved command runs on the host without a shell, one at a time, with
+// a time limit, a cap on how much output is shared and, on Linux, the CPU,
+// memory and process limits its config sets. Its output is a read-only
+// document every peer keeps: the host appends to it as the command writes
+// and streams the appends to everyone, and a peer that missed some of it,
+// say by joining mid-run, asks the host for all of it. The last
+// maxCommandOutputs runs' documents are kept.
+const (
+	defaultCommandTimeout     = 5 * time.Minute
+	defaultCommandOutputBytes = 1 << 20
+	maxCommandOutputs         = 8
+	
+	// How long output may keep trickling in from processes the command left
+	// behind once it was stopped
+	commandWaitDelay = 5 * time.Second
+)
+
+// SharedCommand is a command the host lets peers ask for
+type SharedCommand struct {
+	Command        []string `json:"command"`       // program and arguments
+	Dir            string   `json:"dir,omitempty"` // relative to the project root in project sessions
+	TimeoutSeconds int      `json:"timeout_seconds,omitempty"`
+	MaxOutputBytes int      `json:"max_output_bytes,omitempty"`
+	
+	// Resource limits, none when 0. CPU time and memory (address space) are
+	// per process; processes count all of the host user's, as RLIMIT_NPROC
+	// does.
+	MaxCPUSeconds int `json:"max_cpu_seconds,omitempty"`
+	MaxMemoryMB   int `json:"max_memory_mb,omitempty"`
+	MaxProcesses  int `json:"max_processes,omitempty"`
+}
+
+func (sc SharedCommand) timeout() time.Duration {
+	if sc.TimeoutSeconds <= 0 {
+		return defaultCommandTimeout
+	}
+	return time.Duration(sc.TimeoutSeconds) * time.Second
+}
+
+func (sc SharedCommand) maxOutputBytes() int {
+	if sc.MaxOutputBytes <= 0 {
+		return defaultCommandOutputBytes
+	}
+	return sc.MaxOutputBytes
+}
+
+func (sc SharedCommand) limited() bool {
+	return sc.MaxCPUSeconds > 0 || sc.MaxMemoryMB > 0 || sc.MaxProcesses > 0
+}
+
+// commandRequest is a request waiting for the host's answer
+type commandRequest struct {
+	ID          string
+	UserID      string
+	Name        string
+	Command     []string // as allowed when requested
+	RequestedAt time.Time
+}
+
+// CommandRunner keeps the host's pending command requests and the command
+// running, if any
+type CommandRunner struct {
+	commands map[string]SharedCommand
+	pending  map[string]commandRequest
+	nextID   int
+	running  string // run ID, "" when idle
+	cancel   context.CancelFunc
+	mutex    sync.Mutex
+}
+
+func NewCommandRunner(commands map[string]SharedCommand) *CommandRunner {
+	return &CommandRunner{commands: commands, pending: make(map[string]commandRequest)}
+}
+
+// SetCommands replaces the allowed commands. Requests for commands no longer
+// allowed are dropped; a command already running keeps running.
+func (cr *CommandRunner) SetCommands(commands map[string]SharedCommand) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.commands = commands
+	for id, request := range cr.pending {
+		if _, allowed := commands[request.Name]; !allowed {
+			delete(cr.pending, id)
+		}
+	}
+}
+
+// Request records a request for an allowed command
+func (cr *CommandRunner) Request(userID, name string) (commandRequest, error) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	
+	command, allowed := cr.commands[name]
+	if !allowed {
+		return commandRequest{}, fmt.Errorf("%q is not a shared command", name)
+	}
+	cr.nextID++
+	request := commandRequest{
+		ID:          fmt.Sprintf("cmd-%d", cr.nextID),
+		UserID:      userID,
+		Name:        name,
+		Command:     command.Command,
+		RequestedAt: time.Now(),
+	}
+	cr.pending[request.ID] = request
+	return request, nil
+}
+
+// Take removes a pending request so it is answered only once
+func (cr *CommandRunner) Take(requestID string) (commandRequest, bool) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	
+	request, exists := cr.pending[requestID]
+	delete(cr.pending, requestID)
+	return request, exists
+}
+
+// start claims the runner for a request's command
+func (cr *CommandRunner) start(request commandRequest) (SharedCommand, context.Context, error) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	
+	if cr.running != "" {
+		return SharedCommand{}, nil, fmt.Errorf("%s is still running", cr.running)
+	}
+	command, allowed := cr.commands[request.Name]
+	if !allowed {
+		return SharedCommand{}, nil, fmt.Errorf("%q is no longer a shared command", request.Name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), command.timeout())
+	cr.running, cr.cancel = request.ID, cancel
+	return command, ctx, nil
+}
+
+func (cr *CommandRunner) finish() {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	
+	if cr.cancel != nil {
+		cr.cancel()
+	}
+	cr.running, cr.cancel = "", nil
+}
+
+// Reset drops pending requests and stops the running command, e.g. when the
+// session ends
+func (cr *CommandRunner) Reset() {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	
+	cr.pending = make(map[string]commandRequest)
+	if cr.cancel != nil {
+		cr.cancel()
+	}
+}
+
+// commandOutput shares what a command writes, up to its limit, without
+// splitting characters between chunks
+type commandOutput struct {
+	cm      *CollabManager
+	event   protocol.CommandOutputEvent
+	limit   int
+	partial []byte // start of a character the next write completes
+	shared  int
+	dropped bool
+	mutex   sync.Mutex
+}
+
+func (o *commandOutput) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	
+	data := append(o.partial, p...)
+	o.partial = nil
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				o.partial = append([]byte(nil), data[i:]...)
+				data = data[:i]
+			}
+			break
+		}
+	}
+	
+	if room := o.limit - o.shared; len(data) > room {
+		data = data[:max(room, 0)]
+		o.dropped = true
+	}
+	if len(data) > 0 {
+		event := o.event
+		event.Offset = o.shared
+		event.Data = string(data)
+		o.shared += len(data)
+		o.cm.commandOutputs.Append(event)
+		o.cm.publishCommandEvent(protocol.MsgCommandOutput, event)
+	}
+	return len(p), nil
+}
+
+// handleRequestCommand asks the host to run a shared command. The host's own
+// requests need no approval.
+func (cm *CollabManager) handleRequestCommand(req *protocol.RequestCommandRequest) *protocol.Message {
+	if cm.sessionManager.GetCurrentSession() == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	if req.Name == "" {
+		return createErrorMessage("request_command_failed", "name is required")
+	}
+	
+	if cm.hostSession() != nil {
+		request, err := cm.commands.Request(cm.sessionManager.GetUserID(), req.Name)
+		if err != nil {
+			return createErrorMessage("request_command_failed", err.Error())
+		}
+		cm.commands.Take(request.ID)
+		if err := cm.runCommand(request); err != nil {
+			return createErrorMessage("request_command_failed", err.Error())
+		}
+		return createStatusMessage("command_started", request.Name)
+	}
+	
+	// Only the host acts on it; other peers ignore the message
+	if err := cm.broadcastToPeers(protocol.MsgRequestCommand, req); err != nil {
+		return createErrorMessage("request_command_failed", err.Error())
+	}
+	return createStatusMessage("command_requested", "Waiting for the host to approve "+req.Name)
+}
+
+// handlePeerCommandRequest passes a peer's request on to the host's Neovim,
+// or refuses it straight away if the command isn't shared
+func (cm *CollabManager) handlePeerCommandRequest(userID string, msg *protocol.Message) {
+	if cm.hostSession() == nil {
+		return
+	}
+	var req protocol.RequestCommandRequest
+	if err := msg.ParseData(&req); err != nil {
+		return
+	}
+	
+	request, err := cm.commands.Request(userID, req.Name)
+	if err != nil {
+		cm.denyCommand(userID, req.Name, err.Error())
+		return
+	}
+	
+	event, _ := protocol.NewMessage(protocol.MsgCommandRequested, protocol.CommandRequestedEvent{
+		RequestID: request.ID,
+		UserID:    userID,
+		Name:      request.Name,
+		Command:   request.Command,
+	})
+	if err := cm.sendMessage(event); err != nil {
+		log.Printf("Failed to send command request: %v", err)
+	}
+}
+
+// handleAnswerCommand runs or refuses a peer's request
+func (cm *CollabManager) handleAnswerCommand(req *protocol.AnswerCommandRequest) *protocol.Message {
+	if cm.hostSession() == nil {
+		return createErrorMessage("answer_command_failed", "Only the host can answer command requests")
+	}
+	request, exists := cm.commands.Take(req.RequestID)
+	if !exists {
+		return createErrorMessage("answer_command_failed", "No pending request "+req.RequestID)
+	}
+	
+	if !req.Approved {
+		reason := req.Reason
+		if reason == "" {
+			reason = "The host declined"
+		}
+		cm.denyCommand(request.UserID, request.Name, reason)
+		return createStatusMessage("command_denied", request.Name)
+	}
+	
+	if err := cm.runCommand(request); err != nil {
+		cm.denyCommand(request.UserID, request.Name, err.Error())
+		return createErrorMessage("answer_command_failed", err.Error())
+	}
+	return createStatusMessage("command_started", request.Name)
+}
+
+// denyCommand tells the requester their command won't run
+func (cm *CollabManager) denyCommand(userID, name, reason string) {
+	msg, _ := protocol.NewMessage(protocol.MsgCommandDenied, protocol.CommandDeniedEvent{Name: name, Reason: reason})
+	payload, err := msg.ToJSON()
+	if err != nil {
+		return
+	}
+	if err := cm.p2pManager.SendMessage(userID, payload); err != nil {
+		log.Printf("Failed to refuse command for %s: %v", userID, err)
+	}
+}
+
+// runCommand starts an approved command, streaming its output to everyone
+func (cm *CollabManager) runCommand(request commandRequest) error {
+	command, ctx, err := cm.commands.start(request)
+	if err != nil {
+		return err
+	}
+	if len(command.Command) == 0 {
+		cm.commands.finish()
+		return fmt.Errorf("shared command %q is empty", request.Name)
+	}
+	
+	cmd := exec.CommandContext(ctx, command.Command[0], command.Command[1:]...)
+	cmd.Dir = command.Dir
+	if cm.sessionRoot != "" && !filepath.IsAbs(command.Dir) {
+		cmd.Dir = filepath.Join(cm.sessionRoot, command.Dir)
+	}
+	cmd.WaitDelay = commandWaitDelay
+	
+	output := &commandOutput{
+		cm:    cm,
+		event: protocol.CommandOutputEvent{RunID: request.ID, Name: request.Name, RequestedBy: request.UserID},
+		limit: command.maxOutputBytes(),
+	}
+	cmd.Stdout, cmd.Stderr = output, output
+	
+	started := time.Now()
+	cm.commandOutputs.Start(protocol.CommandOutputDocument{RunID: request.ID, Name: request.Name, RequestedBy: request.UserID})
+	if err := startLimited(cmd, command); err != nil {
+		cm.commands.finish()
+		cm.commandOutputs.Remove(request.ID)
+		return err
+	}
+	log.Printf("Running %s for %s", request.Name, request.UserID)
+	
+	go func() {
+		defer cm.commands.finish()
+		err := cmd.Wait()
+		
+		output.mutex.Lock()
+		finished := protocol.CommandFinishedEvent{
+			RunID:       request.ID,
+			Name:        request.Name,
+			RequestedBy: request.UserID,
+			ExitCode:    cmd.ProcessState.ExitCode(),
+			DurationMS:  time.Since(started).Milliseconds(),
+			OutputBytes: output.shared,
+			Truncated:   output.dropped,
+		}
+		output.mutex.Unlock()
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			finished.Error = fmt.Sprintf("stopped after %v", command.timeout())
+		case err != nil && finished.ExitCode < 0:
+			finished.Error = err.Error()
+		}
+		cm.commandOutputs.Finish(finished)
+		cm.publishCommandEvent(protocol.MsgCommandFinished, finished)
+	}()
+	return nil
+}
+
+// publishCommandEvent sends a command event to the local Neovim and to peers
+func (cm *CollabManager) publishCommandEvent(msgType string, event interface{}) {
+	msg, _ := protocol.NewMessage(msgType, event)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send %s: %v", msgType, err)
+	}
+	if err := cm.broadcastToPeers(msgType, event); err != nil {
+		log.Printf("Failed to share %s: %v", msgType, err)
+	}
+}
+
+// handlePeerCommandEvent keeps the host's command output documents up to
+// date and passes the host's command events on to Neovim. Output that doesn't
+// follow what this peer has means it missed some; the host then sends all
+// of it.
+func (cm *CollabManager) handlePeerCommandEvent(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy != userID {
+		return
+	}
+	switch msg.Type {
+	case protocol.MsgCommandOutput:
+		var event protocol.CommandOutputEvent
+		if err := msg.ParseData(&event); err != nil {
+			return
+		}
+		appended, missing := cm.commandOutputs.Append(event)
+		if missing {
+			cm.sendToPeer(userID, protocol.MsgGetCommandOutput, protocol.GetCommandOutputRequest{RunID: event.RunID})
+		}
+		if !appended {
+			return
+		}
+	case protocol.MsgCommandFinished:
+		var event protocol.CommandFinishedEvent
+		if err := msg.ParseData(&event); err != nil {
+			return
+		}
+		cm.commandOutputs.Finish(event)
+	}
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send %s: %v", msg.Type, err)
+	}
+}
+
+// handleGetCommandOutput returns a run's output document, the latest run's
+// without a run ID. A member without it asks the host, whose answer arrives
+// as a command_output_document event.
+func (cm *CollabManager) handleGetCommandOutput(req *protocol.GetCommandOutputRequest) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	if doc, ok := cm.commandOutputs.Get(req.RunID); ok {
+		msg, _ := protocol.NewMessage(protocol.MsgCommandOutputDocument, doc)
+		return msg
+	}
+	if cm.hostSession() != nil {
+		return createErrorMessage("get_command_output_failed", "No such command output")
+	}
+	cm.sendToPeer(session.CreatedBy, protocol.MsgGetCommandOutput, req)
+	return createStatusMessage("command_output_requested", "Asking the host for the command's output")
+}
+
+// handlePeerGetCommandOutput sends a member the output document it asked for
+func (cm *CollabManager) handlePeerGetCommandOutput(userID string, msg *protocol.Message) {
+	if cm.hostSession() == nil {
+		return
+	}
+	var req protocol.GetCommandOutputRequest
+	if err := msg.ParseData(&req); err != nil {
+		return
+	}
+	if doc, ok := cm.commandOutputs.Get(req.RunID); ok {
+		cm.sendToPeer(userID, protocol.MsgCommandOutputDocument, doc)
+	}
+}
+
+// handlePeerCommandOutputDocument replaces a run's output document with the
+// host's and shows it to Neovim
+func (cm *CollabManager) handlePeerCommandOutputDocument(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy != userID {
+		return
+	}
+	var doc protocol.CommandOutputDocument
+	if err := msg.ParseData(&doc); err != nil || doc.RunID == "" {
+		return
+	}
+	cm.commandOutputs.Replace(doc)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send %s: %v", msg.Type, err)
+	}
+}
+
+// CommandOutputs keeps the output documents of the last runs, oldest first
+type CommandOutputs struct {
+	runs    []*protocol.CommandOutputDocument
+	missing map[string]bool // runs the host was asked for
+	mutex   sync.Mutex
+}
+
+func NewCommandOutputs() *CommandOutputs {
+	return &CommandOutputs{missing: make(map[string]bool)}
+}
+
+func (co *CommandOutputs) findLocked(runID string) *protocol.CommandOutputDocument {
+	if runID == "" && len(co.runs) > 0 {
+		return co.runs[len(co.runs)-1]
+	}
+	for _, doc := range co.runs {
+		if doc.RunID == runID {
+			return doc
+		}
+	}
+	return nil
+}
+
+func (co *CommandOutputs) addLocked(doc *protocol.CommandOutputDocument) {
+	co.runs = append(co.runs, doc)
+	if len(co.runs) > maxCommandOutputs {
+		co.runs[0] = nil
+		co.runs = co.runs[1:]
+	}
+}
+
+// Start begins an empty document for a run
+func (co *CommandOutputs) Start(doc protocol.CommandOutputDocument) {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	doc.Content = ""
+	co.addLocked(&doc)
+}
+
+// Append adds output at its offset. It reports whether it did, and whether
+// output before it is missing, which is not asked for twice.
+func (co *CommandOutputs) Append(event protocol.CommandOutputEvent) (appended, missing bool) {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	
+	doc := co.findLocked(event.RunID)
+	if doc == nil && event.RunID != "" && event.Offset == 0 {
+		doc = &protocol.CommandOutputDocument{RunID: event.RunID, Name: event.Name, RequestedBy: event.RequestedBy}
+		co.addLocked(doc)
+	}
+	switch {
+	case doc == nil || event.Offset > len(doc.Content):
+		if co.missing[event.RunID] {
+			return false, false
+		}
+		co.missing[event.RunID] = true
+		return false, true
+	case event.Offset < len(doc.Content):
+		// Already in the document the host sent
+		return false, false
+	}
+	doc.Content += event.Data
+	return true, false
+}
+
+// Finish records how a run ended
+func (co *CommandOutputs) Finish(event protocol.CommandFinishedEvent) {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	if doc := co.findLocked(event.RunID); doc != nil && event.RunID != "" {
+		doc.Finished = &event
+	}
+}
+
+// Replace takes the host's document for a run
+func (co *CommandOutputs) Replace(doc protocol.CommandOutputDocument) {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	delete(co.missing, doc.RunID)
+	if existing := co.findLocked(doc.RunID); existing != nil {
+		*existing = doc
+		return
+	}
+	co.addLocked(&doc)
+}
+
+// Remove forgets a run that never started
+func (co *CommandOutputs) Remove(runID string) {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	for i, doc := range co.runs {
+		if doc.RunID == runID {
+			co.runs = append(co.runs[:i], co.runs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Get returns a copy of a run's document, the latest run's without a run ID
+func (co *CommandOutputs) Get(runID string) (protocol.CommandOutputDocument, bool) {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	doc := co.findLocked(runID)
+	if doc == nil {
+		return protocol.CommandOutputDocument{}, false
+	}
+	return *doc, true
+}
+
+func (co *CommandOutputs) Reset() {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	co.runs = nil
+	co.missing = make(map[string]bool)
+}
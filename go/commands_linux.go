@@ -0,0 +1,44 @@
+package collab
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// startLimited starts a shared command in its own process group, so stopping
+// it stops what it started too, and applies the command's resource limits to
+// it. Limits are set once the process exists, so its first moments run
+// without them; children it starts afterwards inherit them.
+func startLimited(cmd *exec.Cmd, command SharedCommand) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	
+	limits := []struct {
+		resource int
+		value    int
+	}{
+		{unix.RLIMIT_CPU, command.MaxCPUSeconds},
+		{unix.RLIMIT_AS, command.MaxMemoryMB << 20},
+		{unix.RLIMIT_NPROC, command.MaxProcesses},
+	}
+	for _, limit := range limits {
+		if limit.value <= 0 {
+			continue
+		}
+		rlimit := unix.Rlimit{Cur: uint64(limit.value), Max: uint64(limit.value)}
+		if err := unix.Prlimit(cmd.Process.Pid, limit.resource, &rlimit, nil); err != nil {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			cmd.Wait()
+			return fmt.Errorf("failed to limit shared command: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package collab
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// startLimited starts a shared command. Resource limits are only enforced on
+// Linux, so a command that sets any is refused elsewhere rather than run
+// without them.
+func startLimited(cmd *exec.Cmd, command SharedCommand) error {
+	if command.limited() {
+		return fmt.Errorf("resource limits for shared commands are only supported on Linux")
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,64 @@
+package collab
+
+import (
+	"testing"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+func TestCommandOutputDocument(t *testing.T) {
+	cm, _ := newTestManager(t)
+	cm.commands.SetCommands(map[string]SharedCommand{"greet": {Command: []string{"echo", "hello"}}})
+	request, err := cm.commands.Request("bob", "greet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.runCommand(request); err != nil {
+		t.Fatal(err)
+	}
+	
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		doc, ok := cm.commandOutputs.Get(request.ID)
+		if ok && doc.Finished != nil {
+			if doc.Content != "hello\n" || doc.Finished.ExitCode != 0 {
+				t.Errorf("document = %q, exit code %d, want hello and 0", doc.Content, doc.Finished.ExitCode)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the command didn't finish in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if latest, _ := cm.commandOutputs.Get(""); latest.RunID != request.ID {
+		t.Errorf("latest run = %q, want %q", latest.RunID, request.ID)
+	}
+}
+
+func TestCommandOutputCatchesUp(t *testing.T) {
+	outputs := NewCommandOutputs()
+	event := protocol.CommandOutputEvent{RunID: "cmd-1", Name: "test", Offset: 6, Data: "world\n"}
+	
+	// Joined mid-run: the host is asked for the document once
+	if appended, missing := outputs.Append(event); appended || !missing {
+		t.Fatalf("appended %v, missing %v, want the document asked for", appended, missing)
+	}
+	event.Offset, event.Data = 12, "again\n"
+	if appended, missing := outputs.Append(event); appended || missing {
+		t.Fatalf("appended %v, missing %v, want it asked for only once", appended, missing)
+	}
+	
+	outputs.Replace(protocol.CommandOutputDocument{RunID: "cmd-1", Name: "test", Content: "hello\nworld\nagain\n"})
+	if appended, _ := outputs.Append(event); appended {
+		t.Error("output the host's document already had was appended again")
+	}
+	event.Offset, event.Data = 18, "done\n"
+	if appended, _ := outputs.Append(event); !appended {
+		t.Error("output following the document wasn't appended")
+	}
+	if doc, _ := outputs.Get("cmd-1"); doc.Content != "hello\nworld\nagain\ndone\n" {
+		t.Errorf("document = %q", doc.Content)
+	}
+}
@@ -0,0 +1,219 @@
+package collab
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// The config file is checked for changes every configWatchInterval, and
+// reload_config rereads it on demand. Settings the running backend can take
+// over are applied in place; the others keep their running value until a
+// restart and are reported as needing one. Reloads happen on the message
+// loop, between messages from Neovim.
+const configWatchInterval = 2 * time.Second
+
+// liveSettings apply a changed setting, by its name in the config file.
+// Connection settings only affect connections made afterwards.
+var liveSettings = map[string]func(cm *CollabManager, config *Config) error{
+	"proxy_url": func(cm *CollabManager, config *Config) error {
+		return cm.p2pManager.SetProxy(config.proxyURL())
+	},
+	"ssh": func(cm *CollabManager, config *Config) error {
+		cm.p2pManager.SetSSHConfig(config.SSH)
+		return nil
+	},
+	"network_policy": func(cm *CollabManager, config *Config) error {
+		return cm.p2pManager.SetNetworkPolicy(config.NetworkPolicy)
+	},
+	"disable_mdns": func(cm *CollabManager, config *Config) error {
+		cm.p2pManager.SetDisableMDNS(config.DisableMDNS)
+		return nil
+	},
+	"slow_operation_ms": func(cm *CollabManager, config *Config) error {
+		cm.slowThreshold = time.Duration(config.SlowOperationMS) * time.Millisecond
+		return nil
+	},
+	"sync_budget_ms": func(cm *CollabManager, config *Config) error {
+		cm.latency.SetBudget(time.Duration(config.SyncBudgetMS) * time.Millisecond)
+		return nil
+	},
+	"memory_budget_mb": func(cm *CollabManager, config *Config) error {
+		if config.MemoryBudgetMB <= 0 {
+			cm.memoryBudget = 0
+			cm.memoryPressure = false
+			debug.SetMemoryLimit(math.MaxInt64)
+			return nil
+		}
+		cm.setMemoryBudget(config.MemoryBudgetMB)
+		return nil
+	},
+	"archive_sessions": func(cm *CollabManager, config *Config) error {
+		cm.archiveSessions = config.ArchiveSessions
+		return nil
+	},
+	"extension_limits": func(cm *CollabManager, config *Config) error {
+		cm.extensions.SetLimits(config.ExtensionLimits)
+		return nil
+	},
+	"peer_rate_limit": func(cm *CollabManager, config *Config) error {
+		cm.peerLimiter.SetLimit(config.PeerRateLimit)
+		return nil
+	},
+	"project_limits": func(cm *CollabManager, config *Config) error {
+		cm.projectLimits = config.ProjectLimits.WithDefaults()
+		return nil
+	},
+	"write_through": func(cm *CollabManager, config *Config) error {
+		cm.diskWriter.SetConfig(config.WriteThrough)
+		return nil
+	},
+	"typing_privacy": func(cm *CollabManager, config *Config) error {
+		cm.typing.SetConfig(config.TypingPrivacy)
+		if !config.TypingPrivacy.Enabled {
+			cm.flushTyping()
+		}
+		return nil
+	},
+	"shared_commands": func(cm *CollabManager, config *Config) error {
+		cm.commands.SetCommands(config.SharedCommands)
+		return nil
+	},
+	"access_token": func(cm *CollabManager, config *Config) error {
+		cm.p2pManager.SetAccessToken(config.AccessToken)
+		if cm.relayClient != nil {
+			cm.relayClient.SetAccessToken(config.AccessToken)
+		}
+		return nil
+	},
+	"bandwidth_budgets": func(cm *CollabManager, config *Config) error {
+		cm.p2pManager.SetTrafficBudgets(trafficBudgets(config.BandwidthBudgets), cm.sendTrafficWarning)
+		return nil
+	},
+}
+
+// configSetting is a top-level field of Config
+type configSetting struct {
+	name  string
+	index int
+}
+
+// changedSettings lists the settings whose values differ, in file order
+func changedSettings(old, config *Config) []configSetting {
+	oldValue := reflect.ValueOf(old).Elem()
+	newValue := reflect.ValueOf(config).Elem()
+	fields := oldValue.Type()
+	
+	var changed []configSetting
+	for i := 0; i < fields.NumField(); i++ {
+		name, _, _ := strings.Cut(fields.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, configSetting{name: name, index: i})
+		}
+	}
+	return changed
+}
+
+// reloadConfig rereads the config file and applies what changed. The config
+// kept afterwards has the new values of applied settings and the running
+// values of the rest, so a setting needing a restart is reported until then.
+func (cm *CollabManager) reloadConfig() protocol.ConfigReloadedEvent {
+	event := protocol.ConfigReloadedEvent{Path: cm.config.path, Applied: []string{}, RestartRequired: []string{}}
+	if cm.config.path == "" {
+		event.Error = "no config file was given"
+		return event
+	}
+	
+	config, err := LoadConfig(cm.config.path)
+	if err != nil {
+		event.Error = err.Error()
+		return event
+	}
+	
+	running := *cm.config
+	current := reflect.ValueOf(&running).Elem()
+	var failed []string
+	for _, setting := range changedSettings(cm.config, config) {
+		apply, live := liveSettings[setting.name]
+		if !live {
+			event.RestartRequired = append(event.RestartRequired, setting.name)
+			continue
+		}
+		if err := apply(cm, config); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", setting.name, err))
+			continue
+		}
+		current.Field(setting.index).Set(reflect.ValueOf(config).Elem().Field(setting.index))
+		event.Applied = append(event.Applied, setting.name)
+	}
+	cm.config = &running
+	
+	if len(failed) > 0 {
+		event.Error = "failed to apply " + strings.Join(failed, "; ")
+	}
+	return event
+}
+
+// watchConfig signals the message loop whenever the config file's size or
+// modification time changes. A file that can't be read is left alone until
+// it can be again.
+func (cm *CollabManager) watchConfig(path string) {
+	var lastSize int64
+	var lastModified time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastSize, lastModified = info.Size(), info.ModTime()
+	}
+	
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(path)
+		if err != nil || (info.Size() == lastSize && info.ModTime().Equal(lastModified)) {
+			continue
+		}
+		lastSize, lastModified = info.Size(), info.ModTime()
+		
+		select {
+		case cm.configChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// handleReloadConfig rereads the config file on request
+func (cm *CollabManager) handleReloadConfig() *protocol.Message {
+	event := cm.reloadConfig()
+	if event.Error != "" && len(event.Applied) == 0 && len(event.RestartRequired) == 0 {
+		return createErrorMessage("reload_config_failed", event.Error)
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgConfigReloaded, event)
+	return msg
+}
+
+// sendConfigReloaded tells Neovim the config file changed and what of it
+// took effect. Saving the file without changing a setting says nothing.
+func (cm *CollabManager) sendConfigReloaded(event protocol.ConfigReloadedEvent) {
+	if event.Error == "" && len(event.Applied) == 0 && len(event.RestartRequired) == 0 {
+		return
+	}
+	if event.Error != "" {
+		log.Printf("Reloading %s: %s", event.Path, event.Error)
+	}
+	if len(event.RestartRequired) > 0 {
+		log.Printf("Settings in %s changed that need a restart: %s", event.Path, strings.Join(event.RestartRequired, ", "))
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgConfigReloaded, event)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send config reload: %v", err)
+	}
+}
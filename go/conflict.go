@@ -0,0 +1,63 @@
+package collab
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// useConflictStrategy has the sync manager order concurrent edits as the
+// session's settings ask
+func (cm *CollabManager) useConflictStrategy(session *session.Session) {
+	strategy, err := collabsync.NewConflictStrategy(session.Settings.ConflictStrategy, session.CurrentController)
+	if err != nil {
+		log.Printf("Ordering concurrent edits by timestamp: %v", err)
+		strategy = collabsync.TimestampStrategy{}
+	}
+	cm.syncManager.SetConflictStrategy(strategy)
+}
+
+// sendConflictHeld asks Neovim to accept or reject a remote edit the manual
+// strategy is holding
+func (cm *CollabManager) sendConflictHeld(remoteOp protocol.Operation, localOps []protocol.Operation) {
+	event := protocol.ConflictHeldEvent{Remote: cm.clientOperation(remoteOp)}
+	for _, op := range localOps {
+		event.Local = append(event.Local, cm.clientOperation(op))
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgConflictHeld, event)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send conflict: %v", err)
+	}
+}
+
+// handleResolveConflict releases the held operations, passing on to Neovim
+// the ones that stay applied and to peers the edits reverting a rejection
+func (cm *CollabManager) handleResolveConflict(req *protocol.ResolveConflictRequest) *protocol.Message {
+	applied, revert, err := cm.syncManager.ResolveHeld(context.Background(), req.Accept)
+	if err != nil {
+		return createErrorMessage("resolve_conflict_failed", err.Error())
+	}
+
+	for _, op := range applied {
+		event, _ := protocol.NewMessage(protocol.MsgDocumentOperation, cm.clientOperation(op))
+		if err := cm.sendMessage(event); err != nil {
+			log.Printf("Failed to send operation: %v", err)
+		}
+	}
+	if err := cm.relayOperations(revert); err != nil {
+		return createErrorMessage("resolve_conflict_failed", err.Error())
+	}
+
+	resolution := "accepted"
+	if !req.Accept {
+		resolution = "rejected"
+	}
+	if held := cm.syncManager.HeldOperations(); held > 0 {
+		resolution += fmt.Sprintf(", %d operations still held", held)
+	}
+	return createStatusMessage("conflict_resolved", resolution)
+}
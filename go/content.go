@@ -0,0 +1,113 @@
+package collab
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// Content transfer encodings accepted on the Lua <-> Go boundary
+const (
+	ContentEncodingNone   = ""
+	ContentEncodingBase64 = "base64"
+)
+
+// binarySniffLen is how much of the content is inspected when deciding
+// whether it is text (same window git uses)
+const binarySniffLen = 8000
+
+// isBinaryContent reports whether content looks like binary data rather than
+// text. A NUL byte anywhere in the sniffed window is decisive; otherwise the
+// content is binary when more than 10% of it is non-printable control bytes.
+func isBinaryContent(content string) bool {
+	sample := content
+	if len(sample) > binarySniffLen {
+		sample = sample[:binarySniffLen]
+	}
+	if len(sample) == 0 {
+		return false
+	}
+	
+	if strings.IndexByte(sample, 0) >= 0 {
+		return true
+	}
+	
+	controlBytes := 0
+	for i := 0; i < len(sample); i++ {
+		c := sample[i]
+		switch {
+		case c == '\t', c == '\n', c == '\r', c == '\f', c == '\b', c == 0x1b:
+			// Whitespace and escape sequences show up in ordinary text files
+		case c < 0x20, c == 0x7f:
+			controlBytes++
+		}
+	}
+	
+	return controlBytes*10 > len(sample)
+}
+
+// decodeContent converts content received from Neovim into raw bytes
+func decodeContent(content, encoding string) (string, error) {
+	switch encoding {
+	case ContentEncodingNone:
+		return content, nil
+	case ContentEncodingBase64:
+		decoded, err := base64.StdEncoding.DecodeString(content)
+		if err != nil {
+			return "", fmt.Errorf("invalid base64 content: %v", err)
+		}
+		return string(decoded), nil
+	default:
+		return "", fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+}
+
+// encodeContent prepares raw content for sending to Neovim. Blob content is
+// always base64 encoded since JSON strings can't carry arbitrary bytes.
+func encodeContent(content, mode string) (string, string) {
+	if mode == collabsync.ContentModeBlob {
+		return base64.StdEncoding.EncodeToString([]byte(content)), ContentEncodingBase64
+	}
+	return content, ContentEncodingNone
+}
+
+// Line ending conventions. Content is always held with LF internally and the
+// original convention is restored when exporting.
+const (
+	LineEndingLF   = "lf"
+	LineEndingCRLF = "crlf"
+)
+
+// detectLineEnding returns the dominant line ending convention of content.
+// Files without any line breaks default to LF.
+func detectLineEnding(content string) string {
+	crlf := strings.Count(content, "\r\n")
+	lf := strings.Count(content, "\n") - crlf
+	if crlf > lf {
+		return LineEndingCRLF
+	}
+	return LineEndingLF
+}
+
+// normalizeLineEndings converts CRLF line endings to LF
+func normalizeLineEndings(content string) string {
+	if !strings.Contains(content, "\r\n") {
+		return content
+	}
+	return strings.ReplaceAll(content, "\r\n", "\n")
+}
+
+// restoreLineEndings converts normalized content back to the given convention
+func restoreLineEndings(content, lineEnding string) string {
+	if lineEnding != LineEndingCRLF {
+		return content
+	}
+	return strings.ReplaceAll(content, "\n", "\r\n")
+}
+
+// isValidLineEnding reports whether lineEnding names a supported convention
+func isValidLineEnding(lineEnding string) bool {
+	return lineEnding == LineEndingLF || lineEnding == LineEndingCRLF
+}
@@ -0,0 +1,188 @@
+package collab
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Contribution reports summarize who did how much in a session, for
+// interviewers and instructors. The current session is tallied as operations
+// are applied, so no history has to be kept; past sessions are rebuilt from
+// the store's operation log.
+
+// UserContribution is one user's share of a session
+type UserContribution struct {
+	UserID        string    `json:"user_id"`
+	Operations    int       `json:"operations"`
+	CharsInserted int       `json:"chars_inserted"`
+	CharsDeleted  int       `json:"chars_deleted"`
+	ActiveMinutes int       `json:"active_minutes"` // minutes with at least one operation
+	FilesTouched  []string  `json:"files_touched"`
+	FirstEditAt   time.Time `json:"first_edit_at"`
+	LastEditAt    time.Time `json:"last_edit_at"`
+	
+	minutes map[int64]bool
+}
+
+// ContributionReport lists every user who changed the document, most
+// characters inserted first
+type ContributionReport struct {
+	SessionID   string             `json:"session_id"`
+	GeneratedAt time.Time          `json:"generated_at"`
+	Users       []UserContribution `json:"users"`
+}
+
+// ContributionTracker tallies the operations applied to one session
+type ContributionTracker struct {
+	sessionID string
+	filePath  string
+	users     map[string]*UserContribution
+	mutex     sync.Mutex
+}
+
+func NewContributionTracker() *ContributionTracker {
+	return &ContributionTracker{users: make(map[string]*UserContribution)}
+}
+
+// Start begins tallying a session, dropping the previous one
+func (ct *ContributionTracker) Start(sessionID, filePath string) {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+	ct.sessionID = sessionID
+	ct.filePath = filePath
+	ct.users = make(map[string]*UserContribution)
+}
+
+// Add counts an applied operation towards its author
+func (ct *ContributionTracker) Add(op protocol.Operation) {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+	
+	if ct.sessionID == "" || op.UserID == "" {
+		return
+	}
+	user, exists := ct.users[op.UserID]
+	if !exists {
+		user = &UserContribution{UserID: op.UserID, minutes: make(map[int64]bool)}
+		if ct.filePath != "" {
+			user.FilesTouched = []string{ct.filePath}
+		}
+		ct.users[op.UserID] = user
+	}
+	
+	user.Operations++
+	switch op.Type {
+	case protocol.OpInsert:
+		user.CharsInserted += utf8.RuneCountInString(op.Content)
+	case protocol.OpDelete:
+		// Deletes carry the removed text when the author still had it
+		if len(op.Content) == op.Length {
+			user.CharsDeleted += utf8.RuneCountInString(op.Content)
+		} else {
+			user.CharsDeleted += op.Length
+		}
+	}
+	
+	at := time.Unix(0, op.Timestamp).UTC()
+	if user.FirstEditAt.IsZero() || at.Before(user.FirstEditAt) {
+		user.FirstEditAt = at
+	}
+	if at.After(user.LastEditAt) {
+		user.LastEditAt = at
+	}
+	user.minutes[at.Unix()/60] = true
+	user.ActiveMinutes = len(user.minutes)
+}
+
+// Report returns the tally so far
+func (ct *ContributionTracker) Report() ContributionReport {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+	
+	report := ContributionReport{
+		SessionID:   ct.sessionID,
+		GeneratedAt: time.Now().UTC(),
+		Users:       make([]UserContribution, 0, len(ct.users)),
+	}
+	for _, user := range ct.users {
+		entry := *user
+		entry.FilesTouched = append([]string{}, user.FilesTouched...)
+		report.Users = append(report.Users, entry)
+	}
+	sort.Slice(report.Users, func(i, j int) bool {
+		if report.Users[i].CharsInserted != report.Users[j].CharsInserted {
+			return report.Users[i].CharsInserted > report.Users[j].CharsInserted
+		}
+		return report.Users[i].UserID < report.Users[j].UserID
+	})
+	return report
+}
+
+// ReportFor returns the tally if it is for sessionID
+func (ct *ContributionTracker) ReportFor(sessionID string) (ContributionReport, bool) {
+	ct.mutex.Lock()
+	current := ct.sessionID
+	ct.mutex.Unlock()
+	
+	if current == "" || current != sessionID {
+		return ContributionReport{}, false
+	}
+	return ct.Report(), true
+}
+
+// buildContributions tallies a stored session's operation log
+func buildContributions(sessionID, filePath string, ops []protocol.Operation) ContributionReport {
+	tracker := NewContributionTracker()
+	tracker.Start(sessionID, filePath)
+	for _, op := range ops {
+		tracker.Add(op)
+	}
+	return tracker.Report()
+}
+
+// handleContributionReport reports on the current session by default, or on
+// a past one from the store
+func (cm *CollabManager) handleContributionReport(req *protocol.ContributionReportRequest) *protocol.Message {
+	sessionID := req.SessionID
+	if sessionID == "" {
+		session := cm.sessionManager.GetCurrentSession()
+		if session == nil {
+			return createErrorMessage("no_session", "Not in a session; pass session_id to report on a past one")
+		}
+		sessionID = session.ID
+	}
+	
+	// The last session is still tallied after leaving it
+	report, tallied := cm.contributions.ReportFor(sessionID)
+	if !tallied {
+		stored, err := cm.sessionManager.GetStoredSession(sessionID)
+		if err != nil {
+			return createErrorMessage("contribution_report_failed", err.Error())
+		}
+		ops, err := cm.sessionManager.LoadOperations(sessionID)
+		if err != nil {
+			return createErrorMessage("contribution_report_failed", err.Error())
+		}
+		report = buildContributions(sessionID, stored.FilePath, ops)
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgContributionReport, report)
+	return msg
+}
+
+// sendContributionReport sends Neovim the current session's report as it
+// ends, if anyone changed the document
+func (cm *CollabManager) sendContributionReport() {
+	report := cm.contributions.Report()
+	if len(report.Users) == 0 {
+		return
+	}
+	if err := cm.sendEvent(protocol.MsgContributionReport, report); err != nil {
+		log.Printf("Failed to send contribution report: %v", err)
+	}
+}
@@ -0,0 +1,363 @@
+package collab
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+)
+
+// Asking for control goes through whoever hands it out: the peer with
+// control, or the host when nobody has it or the controller isn't on the
+// roster. The host takes control without asking. The approver's Neovim gets
+// a control_requested event and answers with grant_control or deny_control
+// and the user_id. Either answer goes to every peer, so everyone agrees on
+// who has control: grant_control names who passed control to whom, and
+// deny_control who was refused. Peers take a grant from the host or from
+// whoever has control, and the server tracks them the same way. A
+// controller other than the host who passes control on refuses the requests
+// still waiting on them, since they can no longer grant them.
+//
+// When the controller disconnects or times out, control doesn't stay with
+// them: the host passes it to whoever has waited longest for it, or leaves
+// it free, and tells everyone with grant_control. The other peers free it as
+// soon as they notice, and take the host's grant when it comes. Neovim gets
+// a controller_left event either way. Requests the controller had yet to
+// answer go to the host instead.
+
+// ControlRequests are the peers waiting on the local user for control, and
+// who the local user is waiting on
+type ControlRequests struct {
+	pending map[string]time.Time
+	askedOf string
+	mutex   sync.Mutex
+}
+
+// Asked records who the local user asked for control, "" once answered
+func (cr *ControlRequests) Asked(approver string) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.askedOf = approver
+}
+
+// AskedOf returns who the local user is waiting on for control, if anyone
+func (cr *ControlRequests) AskedOf() string {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	return cr.askedOf
+}
+
+// Add records a request, reporting false if userID was already waiting
+func (cr *ControlRequests) Add(userID string) bool {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if cr.pending == nil {
+		cr.pending = make(map[string]time.Time)
+	}
+	if _, ok := cr.pending[userID]; ok {
+		return false
+	}
+	cr.pending[userID] = time.Now()
+	return true
+}
+
+// Take removes userID's request, reporting false if there was none
+func (cr *ControlRequests) Take(userID string) bool {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	_, ok := cr.pending[userID]
+	delete(cr.pending, userID)
+	return ok
+}
+
+// Next removes the request waiting longest and returns who made it, "" when
+// nobody is waiting
+func (cr *ControlRequests) Next() string {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	next := ""
+	for userID, at := range cr.pending {
+		if next == "" || at.Before(cr.pending[next]) {
+			next = userID
+		}
+	}
+	delete(cr.pending, next)
+	return next
+}
+
+// Drain removes every request and returns who made them, oldest first
+func (cr *ControlRequests) Drain() []string {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	users := make([]string, 0, len(cr.pending))
+	for userID := range cr.pending {
+		users = append(users, userID)
+	}
+	sort.Slice(users, func(i, j int) bool { return cr.pending[users[i]].Before(cr.pending[users[j]]) })
+	cr.pending = nil
+	return users
+}
+
+func (cr *ControlRequests) Reset() {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.pending = nil
+	cr.askedOf = ""
+}
+
+// canHandOutControl reports whether userID may grant or refuse control: the
+// host always may, and so may whoever has control outside read-only presets
+func canHandOutControl(session *session.Session, userID string) bool {
+	session.Mutex.RLock()
+	defer session.Mutex.RUnlock()
+	if userID == session.CreatedBy {
+		return true
+	}
+	return userID == session.Controller && !session.Settings.ReadOnlyJoiners
+}
+
+// controlApprover returns who a request for control goes to, "" when nobody
+// who could answer it is in the session
+func controlApprover(session *session.Session, requester string) string {
+	session.Mutex.RLock()
+	defer session.Mutex.RUnlock()
+	if session.Controller != "" && session.Controller != requester {
+		if _, ok := session.Peers[session.Controller]; ok {
+			return session.Controller
+		}
+	}
+	if _, ok := session.Peers[session.CreatedBy]; ok {
+		return session.CreatedBy
+	}
+	return ""
+}
+
+// handleControlRequest takes control on the host and asks whoever hands it
+// out elsewhere
+func (cm *CollabManager) handleControlRequest(req *protocol.ControlRequest) *protocol.Message {
+	// Only process if the request is from the current user
+	userID := cm.sessionManager.GetUserID()
+	if req.RequestedBy != userID {
+		return createErrorMessage("invalid_control_request", "Can only request control for yourself")
+	}
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("control_request_failed", "no active session")
+	}
+	
+	if session.CreatedBy == userID {
+		status, err := cm.sessionManager.RequestControl()
+		if err != nil {
+			return createErrorMessage("control_request_failed", err.Error())
+		}
+		if err := cm.broadcastToPeers(protocol.MsgGrantControl, protocol.ControlTransfer{FromUser: userID, ToUser: userID}); err != nil {
+			log.Printf("Failed to announce control: %v", err)
+		}
+		msg, _ := protocol.NewMessage(protocol.MsgControlStatus, status)
+		return msg
+	}
+	
+	session.Mutex.RLock()
+	controller := session.Controller
+	readOnly := session.Settings.ReadOnlyJoiners
+	preset := session.Settings.Preset
+	session.Mutex.RUnlock()
+	if controller == userID {
+		msg, _ := protocol.NewMessage(protocol.MsgControlStatus, protocol.ControlStatus{CurrentController: userID, HasControl: true})
+		return msg
+	}
+	if readOnly {
+		return createErrorMessage("control_request_failed", fmt.Sprintf("only the host can hand out control in a %s session", preset))
+	}
+	
+	approver := controlApprover(session, userID)
+	if approver == "" {
+		return createErrorMessage("control_request_failed", "nobody who can hand out control is in the session")
+	}
+	cm.controlRequests.Asked(approver)
+	cm.sendToPeer(approver, protocol.MsgRequestControl, protocol.ControlRequest{RequestedBy: userID})
+	return createStatusMessage("control_request_sent", "Waiting for "+peerName(session, approver))
+}
+
+// handleGrantControl passes control to a peer, whether or not they asked,
+// and tells everyone
+func (cm *CollabManager) handleGrantControl(req *protocol.AnswerControlRequest) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	if req.UserID == "" {
+		return createErrorMessage("grant_control_failed", "user_id is required")
+	}
+	userID := cm.sessionManager.GetUserID()
+	if !canHandOutControl(session, userID) {
+		return createErrorMessage("grant_control_failed", "Only the host or whoever has control can hand it out")
+	}
+	
+	if err := cm.sessionManager.SetController(req.UserID); err != nil {
+		return createErrorMessage("grant_control_failed", err.Error())
+	}
+	cm.controlRequests.Take(req.UserID)
+	if cm.hands.Lower(req.UserID) {
+		cm.sendHandsChanged()
+	}
+	if err := cm.broadcastToPeers(protocol.MsgGrantControl, protocol.ControlTransfer{FromUser: userID, ToUser: req.UserID}); err != nil {
+		log.Printf("Failed to announce control grant: %v", err)
+	}
+	
+	if !canHandOutControl(session, userID) {
+		cm.denyWaitingControl(session, req.UserID)
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgControlStatus, protocol.ControlStatus{CurrentController: req.UserID, HasControl: req.UserID == userID})
+	return msg
+}
+
+// handleDenyControl refuses a peer's request for control
+func (cm *CollabManager) handleDenyControl(req *protocol.AnswerControlRequest) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	if !cm.controlRequests.Take(req.UserID) {
+		return createErrorMessage("deny_control_failed", fmt.Sprintf("%s hasn't asked for control", req.UserID))
+	}
+	cm.denyControl(req.UserID, req.Reason)
+	return createStatusMessage("control_denied", "Refused "+peerName(session, req.UserID))
+}
+
+// denyControl tells every peer that userID was refused control
+func (cm *CollabManager) denyControl(userID, reason string) {
+	denial := protocol.ControlDenial{UserID: userID, DeniedBy: cm.sessionManager.GetUserID(), Reason: reason}
+	if err := cm.broadcastToPeers(protocol.MsgDenyControl, denial); err != nil {
+		log.Printf("Failed to announce control denial: %v", err)
+	}
+}
+
+// denyWaitingControl refuses the requests waiting on the local user once
+// control went to controller without them
+func (cm *CollabManager) denyWaitingControl(session *session.Session, controller string) {
+	reason := "control went to " + peerName(session, controller)
+	for _, waiting := range cm.controlRequests.Drain() {
+		cm.denyControl(waiting, reason)
+	}
+}
+
+// handlePeerRequestControl passes a peer's request for control to Neovim,
+// or refuses it when the local user can't hand control out
+func (cm *CollabManager) handlePeerRequestControl(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || userID == protocol.ServerUserID {
+		return
+	}
+	if !canHandOutControl(session, cm.sessionManager.GetUserID()) {
+		reason := "they no longer have control; ask again"
+		cm.sendToPeer(userID, protocol.MsgDenyControl, protocol.ControlDenial{UserID: userID, DeniedBy: cm.sessionManager.GetUserID(), Reason: reason})
+		return
+	}
+	if !cm.controlRequests.Add(userID) {
+		return
+	}
+	
+	event := protocol.ControlRequestedEvent{UserID: userID, Name: peerName(session, userID)}
+	if err := cm.sendEvent(protocol.MsgControlRequested, event); err != nil {
+		log.Printf("Failed to send control request: %v", err)
+	}
+}
+
+// handlePeerGrantControl applies control passed on by the host or by
+// whoever had it
+func (cm *CollabManager) handlePeerGrantControl(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	var transfer protocol.ControlTransfer
+	if session == nil || msg.ParseData(&transfer) != nil || !canHandOutControl(session, userID) {
+		return
+	}
+	if err := cm.sessionManager.SetController(transfer.ToUser); err != nil {
+		return
+	}
+	localID := cm.sessionManager.GetUserID()
+	if !canHandOutControl(session, localID) {
+		cm.denyWaitingControl(session, transfer.ToUser)
+	}
+	if transfer.ToUser == localID {
+		cm.controlRequests.Asked("")
+	}
+	if cm.hands.Lower(transfer.ToUser) {
+		cm.sendHandsChanged()
+	}
+	
+	status := protocol.ControlStatus{CurrentController: transfer.ToUser, HasControl: transfer.ToUser == localID}
+	event, _ := protocol.NewMessage(protocol.MsgControlStatus, status)
+	if err := cm.sendMessage(event); err != nil {
+		log.Printf("Failed to send control status: %v", err)
+	}
+}
+
+// handlePeerDenyControl tells Neovim when the local user's request for
+// control was refused
+func (cm *CollabManager) handlePeerDenyControl(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	var denial protocol.ControlDenial
+	if session == nil || msg.ParseData(&denial) != nil || denial.UserID != cm.sessionManager.GetUserID() {
+		return
+	}
+	cm.controlRequests.Asked("")
+	denial.DeniedBy = userID
+	denial.Name = peerName(session, userID)
+	event, _ := protocol.NewMessage(protocol.MsgControlDenied, denial)
+	if err := cm.sendMessage(event); err != nil {
+		log.Printf("Failed to send control denial: %v", err)
+	}
+}
+
+// controllerLeft frees control held by a peer that left; the host passes it
+// on. A request still waiting on the peer goes to the host.
+func (cm *CollabManager) controllerLeft(userID string) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return
+	}
+	localID := cm.sessionManager.GetUserID()
+	host := session.CreatedBy == localID
+	if cm.controlRequests.AskedOf() == userID && !host && session.CreatedBy != userID {
+		cm.controlRequests.Asked(session.CreatedBy)
+		cm.sendToPeer(session.CreatedBy, protocol.MsgRequestControl, protocol.ControlRequest{RequestedBy: localID})
+	}
+	
+	session.Mutex.RLock()
+	controller := session.Controller
+	session.Mutex.RUnlock()
+	if controller != userID {
+		return
+	}
+	
+	next := ""
+	if host {
+		next = cm.controlRequests.Next()
+	}
+	if err := cm.sessionManager.SetController(next); err != nil {
+		return
+	}
+	log.Printf("Controller %s left; control went to %q", userID, next)
+	if host {
+		if err := cm.broadcastToPeers(protocol.MsgGrantControl, protocol.ControlTransfer{FromUser: localID, ToUser: next}); err != nil {
+			log.Printf("Failed to announce control handoff: %v", err)
+		}
+	}
+	
+	event := protocol.ControllerLeftEvent{
+		UserID:            userID,
+		Name:              peerName(session, userID),
+		CurrentController: next,
+		HasControl:        next == localID,
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgControllerLeft, event)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send controller left: %v", err)
+	}
+}
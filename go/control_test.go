@@ -0,0 +1,97 @@
+package collab
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+)
+
+// newTestManager returns a manager hosting a session, with what it would
+// write to Neovim discarded
+func newTestManager(t *testing.T) (*CollabManager, *session.Session) {
+	t.Helper()
+	cm := NewCollabManager(&Config{})
+	cm.SetOutput(io.Discard)
+	t.Cleanup(cm.Close)
+	session, err := cm.sessionManager.CreateSession("main.go", "package main\n", "", "", "", protocol.SessionSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cm, session
+}
+
+// addTestPeer adds a connected WebRTC peer without data channels to the
+// manager and to its session
+func addTestPeer(t *testing.T, cm *CollabManager, session *session.Session, userID string) {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.p2pManager.AddConnectedPeer(userID, pc)
+	
+	session.Mutex.Lock()
+	session.Peers[userID] = &protocol.Peer{UserID: userID, Name: userID}
+	session.Mutex.Unlock()
+}
+
+// disconnectWithin disconnects a peer, failing when reporting it as left
+// doesn't return in time
+func disconnectWithin(t *testing.T, cm *CollabManager, userID string, timeout time.Duration) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- cm.p2pManager.DisconnectPeer(userID) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("disconnecting %s didn't return within %v", userID, timeout)
+	}
+}
+
+func TestControllerDisconnectHandsControlOn(t *testing.T) {
+	cm, session := newTestManager(t)
+	addTestPeer(t, cm, session, "bob")
+	addTestPeer(t, cm, session, "carol")
+	if err := cm.sessionManager.SetController("bob"); err != nil {
+		t.Fatal(err)
+	}
+	cm.controlRequests.Add("carol")
+	
+	disconnectWithin(t, cm, "bob", 5*time.Second)
+	
+	session.Mutex.RLock()
+	controller := session.Controller
+	session.Mutex.RUnlock()
+	if controller != "carol" {
+		t.Errorf("controller = %q after bob left, want carol, who was waiting", controller)
+	}
+	if peers := cm.p2pManager.GetConnectedPeers(); len(peers) != 1 || peers[0] != "carol" {
+		t.Errorf("connected peers = %v, want [carol]", peers)
+	}
+}
+
+func TestControllerDisconnectWithoutRequests(t *testing.T) {
+	cm, session := newTestManager(t)
+	addTestPeer(t, cm, session, "bob")
+	addTestPeer(t, cm, session, "carol")
+	if err := cm.sessionManager.SetController("bob"); err != nil {
+		t.Fatal(err)
+	}
+	
+	disconnectWithin(t, cm, "bob", 5*time.Second)
+	
+	session.Mutex.RLock()
+	controller := session.Controller
+	session.Mutex.RUnlock()
+	if controller != "" {
+		t.Errorf("controller = %q after bob left, want nobody", controller)
+	}
+}
@@ -0,0 +1,319 @@
+package collab
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+)
+
+// `collab-nvim daemon` serves every Neovim of a user from one process over a
+// Unix socket instead of stdin and stdout. Each attached Neovim's messages
+// are handled on the one message loop in the order they arrive, and
+// everything the backend sends goes to all of them, so they share one
+// session: a second Neovim opened on a project attaches to the session the
+// first one is in rather than starting a process of its own that would
+// conflict with it. A Neovim that attaches is told the current session with
+// its document. The daemon exits once the last Neovim detaches. Requests'
+// ids are tagged with the Neovim that sent them on the way in, so each
+// response carries its id only to that Neovim; the others get it as an
+// event, without one, and never mistake it for the answer to a request of
+// their own with the same id.
+const (
+	daemonSocketName = "daemon.sock"
+	
+	// How long a write to an attached Neovim may take before it is detached,
+	// so one stuck client can't hold up the others
+	daemonWriteTimeout = 5 * time.Second
+)
+
+// DaemonAttachedEvent tells a Neovim that attached to the daemon how many
+// are attached and which session they share, if any
+type DaemonAttachedEvent struct {
+	Clients   int                           `json:"clients"`
+	SessionID string                        `json:"session_id,omitempty"`
+	Session   *protocol.JoinSessionResponse `json:"session,omitempty"`
+}
+
+// DefaultDaemonSocket returns $XDG_RUNTIME_DIR/collab.nvim/daemon.sock, or a
+// per-user directory under the temporary directory when it isn't set
+func DefaultDaemonSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "collab.nvim", daemonSocketName)
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("collab.nvim-%d", os.Getuid()), daemonSocketName)
+}
+
+// daemonHub fans the attached Neovims' messages into one input and the
+// backend's output out to all of them
+type daemonHub struct {
+	cm      *CollabManager
+	input   *io.PipeWriter
+	clients map[int]net.Conn
+	nextID  int
+	mutex   sync.Mutex
+	
+	inputMutex sync.Mutex // keeps each client's lines whole
+	detached   chan struct{}
+}
+
+func newDaemonHub(cm *CollabManager, input *io.PipeWriter) *daemonHub {
+	return &daemonHub{
+		cm:       cm,
+		input:    input,
+		clients:  make(map[int]net.Conn),
+		detached: make(chan struct{}, 1),
+	}
+}
+
+// daemonRequestID is a request's id tagged with the Neovim that sent it
+type daemonRequestID struct {
+	Client int             `json:"client"`
+	ID     json.RawMessage `json:"id"`
+}
+
+// tagRequest tags the id of a line from Neovim client, if it has one
+func tagRequest(client int, line []byte) []byte {
+	msg, err := protocol.ParseMessage(line)
+	if err != nil || len(msg.ID) == 0 {
+		return line
+	}
+	msg.ID, _ = json.Marshal(daemonRequestID{Client: client, ID: msg.ID})
+	tagged, err := msg.ToJSON()
+	if err != nil {
+		return line
+	}
+	return tagged
+}
+
+// Write sends output to every attached Neovim. Each call is one message.
+func (h *daemonHub) Write(data []byte) (int, error) {
+	client, reply, event := -1, data, data
+	if msg, err := protocol.ParseMessage(data); err == nil && len(msg.ID) > 0 {
+		var tag daemonRequestID
+		if json.Unmarshal(msg.ID, &tag) == nil {
+			client = tag.Client
+			msg.ID = tag.ID
+			reply = outputLine(msg)
+			msg.ID = nil
+			event = outputLine(msg)
+		}
+	}
+	
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for id, conn := range h.clients {
+		if id == client {
+			h.writeLocked(id, conn, reply)
+		} else {
+			h.writeLocked(id, conn, event)
+		}
+	}
+	return len(data), nil
+}
+
+func outputLine(msg *protocol.Message) []byte {
+	data, _ := msg.ToJSON()
+	return append(data, '\n')
+}
+
+// sendTo sends a message to one attached Neovim
+func (h *daemonHub) sendTo(id int, msg *protocol.Message) {
+	data, err := msg.ToJSON()
+	if err != nil {
+		return
+	}
+	
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if conn, attached := h.clients[id]; attached {
+		h.writeLocked(id, conn, append(data, '\n'))
+	}
+}
+
+// writeLocked writes to one client, detaching it when the write fails
+func (h *daemonHub) writeLocked(id int, conn net.Conn, data []byte) {
+	conn.SetWriteDeadline(time.Now().Add(daemonWriteTimeout))
+	if _, err := conn.Write(data); err != nil {
+		log.Printf("Detaching Neovim %d: %v", id, err)
+		conn.Close()
+		delete(h.clients, id)
+	}
+}
+
+// attach serves a newly connected Neovim until it disconnects
+func (h *daemonHub) attach(conn net.Conn) {
+	h.mutex.Lock()
+	h.nextID++
+	id := h.nextID
+	h.clients[id] = conn
+	h.mutex.Unlock()
+	log.Printf("Neovim %d attached", id)
+	
+	// The hello and the session are read on the message loop, so they
+	// reach the new client in order with everything else
+	h.cm.onLoop(func() {
+		msg, _ := protocol.NewMessage(protocol.MsgHello, protocol.HelloEvent{Generation: h.cm.liveness.generation})
+		h.sendTo(id, msg)
+		
+		h.mutex.Lock()
+		event := DaemonAttachedEvent{Clients: len(h.clients)}
+		h.mutex.Unlock()
+		if session := h.cm.sessionManager.GetCurrentSession(); session != nil {
+			event.SessionID = session.ID
+			event.Session = h.cm.attachedSession(session)
+		}
+		msg, _ = protocol.NewMessage(protocol.MsgDaemonAttached, event)
+		h.sendTo(id, msg)
+	})
+	
+	reader := newLineReader(conn, h.cm.maxMessageBytes)
+	for {
+		line, err := reader.next()
+		if tooLarge, ok := err.(*messageTooLargeError); ok {
+			log.Printf("Skipping message from Neovim %d: %v", id, tooLarge)
+			h.sendTo(id, createErrorMessage("message_too_large", tooLarge.Error()))
+			continue
+		}
+		if err != nil {
+			break
+		}
+		if len(line) == 0 {
+			continue
+		}
+		
+		h.inputMutex.Lock()
+		_, err = h.input.Write(append(tagRequest(id, line), '\n'))
+		h.inputMutex.Unlock()
+		if err != nil {
+			break
+		}
+	}
+	
+	h.mutex.Lock()
+	conn.Close()
+	delete(h.clients, id)
+	remaining := len(h.clients)
+	h.mutex.Unlock()
+	log.Printf("Neovim %d detached, %d still attached", id, remaining)
+	
+	if remaining == 0 {
+		select {
+		case h.detached <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// attachedSession describes the current session to a Neovim attaching to
+// it, the way joining it would have
+func (cm *CollabManager) attachedSession(session *session.Session) *protocol.JoinSessionResponse {
+	session.Mutex.RLock()
+	peers := make([]protocol.Peer, 0, len(session.Peers))
+	for _, peer := range session.Peers {
+		peers = append(peers, *peer)
+	}
+	session.Mutex.RUnlock()
+	
+	content, encoding := cm.contentForClient(cm.syncManager.GetDocumentContent(), session.Mode)
+	response := &protocol.JoinSessionResponse{
+		UserID:          cm.sessionManager.GetUserID(),
+		FilePath:        cm.localFilePath(session),
+		Content:         content,
+		ContentEncoding: encoding,
+		Mode:            session.Mode,
+		LineEnding:      session.LineEnding,
+		FileEncoding:    cm.clientCharset,
+		Peers:           peers,
+		Settings:        session.Settings,
+		Spectators:      int(cm.spectators.Load()),
+	}
+	if session.Project {
+		response.RelativePath = session.FilePath
+		response.IgnoreRules = session.IgnoreRules
+	}
+	if !session.CanEdit(response.UserID) || cm.spectating {
+		response.ReadOnly = true
+	}
+	if session.Settings.FollowHost {
+		response.Follow = session.CreatedBy
+	}
+	return response
+}
+
+// listenDaemon listens on socketPath, replacing a socket left behind by a
+// daemon that is gone but refusing to take over from one still running
+func listenDaemon(socketPath string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", filepath.Dir(socketPath), err)
+	}
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", socketPath)
+	}
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket %s: %v", socketPath, err)
+	}
+	
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// RunDaemon implements `collab-nvim daemon`, serving Neovims that connect to
+// the socket with cm until the last of them detaches
+func RunDaemon(cm *CollabManager, args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	socketPath := flags.String("socket", DefaultDaemonSocket(), "Unix socket Neovim connects to")
+	flags.Parse(args)
+	
+	listener, err := listenDaemon(*socketPath)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	log.Printf("Daemon listening on %s", *socketPath)
+	
+	input, inputWriter := io.Pipe()
+	hub := newDaemonHub(cm, inputWriter)
+	cm.SetOutput(hub)
+	cm.liveness.shared = true
+	
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to accept Neovim: %v", err)
+				continue
+			}
+			go hub.attach(conn)
+		}
+	}()
+	go func() {
+		<-hub.detached
+		log.Printf("Last Neovim detached; stopping the daemon")
+		listener.Close()
+		inputWriter.Close()
+	}()
+	
+	return cm.Run(input)
+}
@@ -0,0 +1,331 @@
+package collab
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// The demo peer is a pretend collaborator for trying a session out alone:
+// it joins the local user's session in-process and follows a script,
+// typing and deleting a character at a time, moving its cursor and
+// chatting, so highlights, conflicts and keybindings can be checked before
+// inviting anyone. Its edits reach Neovim as a peer's would. Since they only
+// exist on this machine, it only joins a peer-to-peer session the local
+// user hosts alone, and leaves when a real peer connects.
+const (
+	demoPeerID   = "demo-peer"
+	demoPeerName = "Demo Peer"
+	
+	defaultDemoTypingMS = 80
+	defaultDemoDelayMS  = 1000
+	maxDemoSteps        = 1000
+)
+
+const (
+	DemoMove   = "move"
+	DemoType   = "type"
+	DemoDelete = "delete"
+	DemoChat   = "chat"
+	DemoWait   = "wait"
+)
+
+// defaultDemoScript shows each kind of step once
+var defaultDemoScript = []protocol.DemoStep{
+	{Action: DemoChat, Text: "Hi! I'm a demo peer, here to show what a collaborator looks like."},
+	{Action: DemoMove, Line: -1},
+	{Action: DemoType, Text: "\nThis line was typed by the demo peer.\n"},
+	{Action: DemoMove, Line: 0},
+	{Action: DemoType, Text: "demo: "},
+	{Action: DemoWait, DelayMS: 2000},
+	{Action: DemoDelete, Length: len("demo: ")},
+	{Action: DemoChat, Text: "That's all. stop_demo_peer sends me away."},
+}
+
+// demoRunner is the running demo peer, if any
+type demoRunner struct {
+	stop  chan struct{}
+	mutex sync.Mutex
+}
+
+// start reports false if the demo peer is running already
+func (dr *demoRunner) start() (chan struct{}, bool) {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	
+	if dr.stop != nil {
+		return nil, false
+	}
+	dr.stop = make(chan struct{})
+	return dr.stop, true
+}
+
+// end stops the demo peer, reporting false if it wasn't running
+func (dr *demoRunner) end() bool {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	
+	if dr.stop == nil {
+		return false
+	}
+	close(dr.stop)
+	dr.stop = nil
+	return true
+}
+
+// checkDemoScript validates a script, returning the default one for none
+func checkDemoScript(script []protocol.DemoStep) ([]protocol.DemoStep, error) {
+	if len(script) == 0 {
+		return defaultDemoScript, nil
+	}
+	if len(script) > maxDemoSteps {
+		return nil, fmt.Errorf("a script has at most %d steps", maxDemoSteps)
+	}
+	for i, step := range script {
+		switch step.Action {
+		case DemoMove, DemoWait:
+		case DemoType, DemoChat:
+			if step.Text == "" {
+				return nil, fmt.Errorf("step %d: %s needs text", i+1, step.Action)
+			}
+		case DemoDelete:
+			if step.Length <= 0 {
+				return nil, fmt.Errorf("step %d: delete needs a positive length", i+1)
+			}
+		default:
+			return nil, fmt.Errorf("step %d: unknown action %q", i+1, step.Action)
+		}
+		if step.DelayMS < 0 {
+			return nil, fmt.Errorf("step %d: delay_ms is negative", i+1)
+		}
+	}
+	return script, nil
+}
+
+func (cm *CollabManager) handleStartDemoPeer(req *protocol.StartDemoPeerRequest) *protocol.Message {
+	session := cm.hostSession()
+	if session == nil {
+		return createErrorMessage("start_demo_peer_failed", "The demo peer joins sessions you host")
+	}
+	if cm.p2pManager.ServerMode() || len(cm.p2pManager.GetConnectedPeers()) > 0 {
+		return createErrorMessage("start_demo_peer_failed", "The demo peer only joins a peer-to-peer session nobody else is in")
+	}
+	if cm.syncManager.GetContentMode() != collabsync.ContentModeText {
+		return createErrorMessage("start_demo_peer_failed", "The demo peer only edits text")
+	}
+	script, err := checkDemoScript(req.Script)
+	if err != nil {
+		return createErrorMessage("start_demo_peer_failed", err.Error())
+	}
+	typing := time.Duration(req.TypingMS) * time.Millisecond
+	if req.TypingMS <= 0 {
+		typing = defaultDemoTypingMS * time.Millisecond
+	}
+	stop, ok := cm.demo.start()
+	if !ok {
+		return createErrorMessage("start_demo_peer_failed", "The demo peer is already in the session")
+	}
+	
+	peer := protocol.Peer{UserID: demoPeerID, Name: demoPeerName}
+	session.Mutex.Lock()
+	session.Peers[demoPeerID] = &peer
+	session.Mutex.Unlock()
+	cm.sendDemoPeerEvent(protocol.MsgPeerJoined, protocol.PeerJoinedEvent{Peer: peer})
+	
+	go cm.runDemoPeer(session, script, req.Repeat, typing, stop)
+	return createStatusMessage("demo_peer_started", fmt.Sprintf("%d steps", len(script)))
+}
+
+func (cm *CollabManager) handleStopDemoPeer() *protocol.Message {
+	if !cm.stopDemoPeer() {
+		return createErrorMessage("stop_demo_peer_failed", "The demo peer isn't in the session")
+	}
+	return createStatusMessage("demo_peer_stopped", "The demo peer left")
+}
+
+// stopDemoPeer takes the demo peer out of the session, reporting false if
+// it wasn't in it
+func (cm *CollabManager) stopDemoPeer() bool {
+	if !cm.demo.end() {
+		return false
+	}
+	if session := cm.sessionManager.GetCurrentSession(); session != nil {
+		session.Mutex.Lock()
+		delete(session.Peers, demoPeerID)
+		session.Mutex.Unlock()
+	}
+	cm.presence.Remove(demoPeerID)
+	cm.sendDemoPeerEvent(protocol.MsgPeerLeft, protocol.PeerLeftEvent{UserID: demoPeerID})
+	return true
+}
+
+func (cm *CollabManager) sendDemoPeerEvent(msgType string, event interface{}) {
+	msg, _ := protocol.NewMessage(msgType, event)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send %s: %v", msgType, err)
+	}
+}
+
+// runDemoPeer follows the script until it ends or stop is closed
+func (cm *CollabManager) runDemoPeer(session *session.Session, script []protocol.DemoStep, repeat bool, typing time.Duration, stop <-chan struct{}) {
+	demo := &demoCursor{cm: cm, session: session}
+	wait := func(d time.Duration) bool {
+		select {
+		case <-stop:
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+	
+	for {
+		for _, step := range script {
+			delay := time.Duration(step.DelayMS) * time.Millisecond
+			if step.DelayMS == 0 && step.Action != DemoWait {
+				delay = defaultDemoDelayMS * time.Millisecond
+			}
+			if !wait(delay) {
+				return
+			}
+			
+			switch step.Action {
+			case DemoMove:
+				demo.move(step.Line, step.Column)
+			case DemoChat:
+				demo.chat(step.Text)
+			case DemoType:
+				for _, r := range step.Text {
+					if !wait(typing) {
+						return
+					}
+					if err := demo.insert(string(r)); err != nil {
+						log.Printf("Demo peer stopped: %v", err)
+						cm.stopDemoPeer()
+						return
+					}
+				}
+			case DemoDelete:
+				for i := 0; i < step.Length; i++ {
+					if !wait(typing) {
+						return
+					}
+					if err := demo.backspace(); err != nil {
+						log.Printf("Demo peer stopped: %v", err)
+						cm.stopDemoPeer()
+						return
+					}
+				}
+			}
+		}
+		if !repeat {
+			cm.stopDemoPeer()
+			return
+		}
+	}
+}
+
+// demoCursor is where the demo peer types, as a byte offset
+type demoCursor struct {
+	cm      *CollabManager
+	session *session.Session
+	offset  int
+	seq     int64
+}
+
+// move puts the cursor at a line and column, or at the end for a negative
+// line
+func (dc *demoCursor) move(line, column int) {
+	content := dc.cm.syncManager.GetDocumentContent()
+	if line < 0 {
+		dc.offset = len(content)
+	} else {
+		dc.offset = offsetOf(content, line, column)
+	}
+	dc.showPresence(content)
+}
+
+func (dc *demoCursor) insert(text string) error {
+	return dc.edit(func(content string) (protocol.Operation, bool) {
+		dc.offset = min(dc.offset, len(content))
+		return protocol.Operation{Type: protocol.OpInsert, Position: dc.offset, Content: text}, true
+	})
+}
+
+// backspace deletes the character before the cursor
+func (dc *demoCursor) backspace() error {
+	return dc.edit(func(content string) (protocol.Operation, bool) {
+		dc.offset = min(dc.offset, len(content))
+		if dc.offset == 0 {
+			return protocol.Operation{}, false
+		}
+		start := dc.offset - 1
+		for start > 0 && !utf8.RuneStart(content[start]) {
+			start--
+		}
+		return protocol.Operation{Type: protocol.OpDelete, Position: start, Length: dc.offset - start}, true
+	})
+}
+
+// edit applies the operation build returns for the document as it is once
+// it is free, as a peer's, and passes it on to Neovim
+func (dc *demoCursor) edit(build func(content string) (protocol.Operation, bool)) error {
+	var err error
+	done := make(chan struct{})
+	dc.cm.opFlow.run(func(queued bool) {
+		defer close(done)
+		content := dc.cm.syncManager.GetDocumentContent()
+		op, ok := build(content)
+		if !ok {
+			return
+		}
+		dc.seq++
+		op.ID = collabsync.GenerateOperationID(demoPeerID)
+		op.UserID = demoPeerID
+		op.Timestamp = dc.cm.syncManager.Timestamp()
+		op.VectorClock = dc.cm.syncManager.GetVectorClock()
+		op.VectorClock[demoPeerID] = dc.seq
+		
+		err = dc.cm.syncManager.ApplyRemoteOperation(context.Background(), op)
+		if errors.Is(err, collabsync.ErrOperationHeld) {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		if op.Type == protocol.OpInsert {
+			dc.offset = op.Position + len(op.Content)
+		} else {
+			dc.offset = op.Position
+		}
+		
+		event, _ := protocol.NewMessage(protocol.MsgDocumentOperation, dc.cm.clientOperation(op))
+		if sendErr := dc.cm.sendMessage(event); sendErr != nil {
+			log.Printf("Failed to send operation: %v", sendErr)
+		}
+		dc.showPresence(dc.cm.syncManager.GetDocumentContent())
+	})
+	<-done
+	return err
+}
+
+func (dc *demoCursor) showPresence(content string) {
+	line, column := lineColumnOf(content, dc.offset)
+	dc.cm.updatePresence(protocol.PresenceState{UserID: demoPeerID, Line: line, Column: column})
+}
+
+func (dc *demoCursor) chat(text string) {
+	dc.cm.sessionManager.RecordChat(demoPeerID, text)
+	if dc.cm.mutes.Muted(demoPeerID) {
+		return
+	}
+	dc.cm.sendDemoPeerEvent(protocol.MsgChat, protocol.ChatEvent{UserID: demoPeerID, Name: demoPeerName, Text: text, SentAt: time.Now().UTC()})
+}
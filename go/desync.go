@@ -0,0 +1,229 @@
+package collab
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+)
+
+// The host sends everyone a digest of its document every digestInterval
+// while it changes. A member whose document has reached the same vector
+// clock but hashes differently has diverged from the host, which no amount
+// of waiting will fix. It then writes an incident bundle under data_dir
+// (the system's temporary directory without one) with what a bug report
+// about it needs: both digests and clocks, the operations it applied last
+// with their text left out, the settings sync depends on and the versions
+// involved. The document itself never goes into the bundle. Neovim gets a
+// desync_detected event with its path; one bundle is written per
+// divergence, and another only after the documents agreed again.
+const (
+	digestInterval = 10 * time.Second
+	
+	// Operations of the local history kept in a bundle
+	incidentOperations = 200
+	
+	incidentDir = "incidents"
+)
+
+// desyncState remembers the digest last sent and whether a divergence was
+// already reported
+type desyncState struct {
+	sent     string // session and version of the digest last broadcast
+	diverged bool
+	mutex    sync.Mutex
+}
+
+func (ds *desyncState) Reset() {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	ds.sent, ds.diverged = "", false
+}
+
+// incidentOperation is an operation in a bundle, with its length in place
+// of its text
+type incidentOperation struct {
+	ID           string                 `json:"id"`
+	UserID       string                 `json:"user_id"`
+	Type         protocol.OperationType `json:"type"`
+	Position     int                    `json:"position"`
+	Length       int                    `json:"length,omitempty"`
+	ContentBytes int                    `json:"content_bytes,omitempty"`
+	Timestamp    int64                  `json:"timestamp"`
+	VectorClock  protocol.VectorClock   `json:"vector_clock"`
+	Provenance   string                 `json:"provenance,omitempty"`
+}
+
+// desyncIncident is the bundle written when a divergence is found
+type desyncIncident struct {
+	DetectedAt time.Time               `json:"detected_at"`
+	SessionID  string                  `json:"session_id"`
+	UserID     string                  `json:"user_id"`
+	HostID     string                  `json:"host_id"`
+	Local      protocol.DocumentDigest `json:"local"`
+	Host       protocol.DocumentDigest `json:"host"`
+	Operations []incidentOperation     `json:"operations"`
+	Config     map[string]interface{}  `json:"config"`
+	Versions   map[string]string       `json:"versions"`
+}
+
+// runDigestBroadcasts sends the hosted document's digest every
+// digestInterval until stop is closed
+func (cm *CollabManager) runDigestBroadcasts(stop <-chan struct{}) {
+	ticker := time.NewTicker(digestInterval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			cm.broadcastDigest()
+		}
+	}
+}
+
+// broadcastDigest sends members the hosted document's digest, unless it
+// hasn't changed since the last one
+func (cm *CollabManager) broadcastDigest() {
+	session := cm.hostSession()
+	if session == nil || len(cm.p2pManager.GetConnectedPeers()) == 0 {
+		return
+	}
+	digest := cm.syncManager.Digest()
+	key := fmt.Sprintf("%s@%d", session.ID, digest.Version)
+	
+	cm.desync.mutex.Lock()
+	unchanged := key == cm.desync.sent
+	cm.desync.sent = key
+	cm.desync.mutex.Unlock()
+	if unchanged {
+		return
+	}
+	if err := cm.broadcastToPeers(protocol.MsgDocumentDigest, digest); err != nil {
+		log.Printf("Failed to send document digest: %v", err)
+	}
+}
+
+// handlePeerDocumentDigest compares the host's digest with the local
+// document once both have seen the same operations
+func (cm *CollabManager) handlePeerDocumentDigest(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy != userID || userID == cm.sessionManager.GetUserID() {
+		return
+	}
+	var host protocol.DocumentDigest
+	if err := msg.ParseData(&host); err != nil || host.SHA256 == "" {
+		return
+	}
+	local := cm.syncManager.Digest()
+	if !local.VectorClock.Equals(host.VectorClock) {
+		return
+	}
+	
+	cm.desync.mutex.Lock()
+	report := local.SHA256 != host.SHA256 && !cm.desync.diverged
+	cm.desync.diverged = local.SHA256 != host.SHA256
+	cm.desync.mutex.Unlock()
+	if !report {
+		return
+	}
+	
+	log.Printf("Document diverged from the host's at version %d", local.Version)
+	event := protocol.DesyncDetectedEvent{SessionID: session.ID, HostID: userID, Version: local.Version}
+	path, err := cm.writeIncident(session, userID, local, host)
+	if err != nil {
+		log.Printf("Failed to write desync incident: %v", err)
+		event.Error = err.Error()
+	}
+	event.Path = path
+	forward, _ := protocol.NewMessage(protocol.MsgDesyncDetected, event)
+	if err := cm.sendMessage(forward); err != nil {
+		log.Printf("Failed to send desync: %v", err)
+	}
+}
+
+// writeIncident writes a bundle about a divergence and returns its path
+func (cm *CollabManager) writeIncident(session *session.Session, hostID string, local, host protocol.DocumentDigest) (string, error) {
+	incident := desyncIncident{
+		DetectedAt: time.Now().UTC(),
+		SessionID:  session.ID,
+		UserID:     cm.sessionManager.GetUserID(),
+		HostID:     hostID,
+		Local:      local,
+		Host:       host,
+		Operations: []incidentOperation{},
+		Config:     cm.incidentConfig(session),
+		Versions:   incidentVersions(),
+	}
+	for _, op := range cm.syncManager.RecentOperations(incidentOperations) {
+		incident.Operations = append(incident.Operations, incidentOperation{
+			ID:           op.ID,
+			UserID:       op.UserID,
+			Type:         op.Type,
+			Position:     op.Position,
+			Length:       op.Length,
+			ContentBytes: len(op.Content),
+			Timestamp:    op.Timestamp,
+			VectorClock:  op.VectorClock,
+			Provenance:   op.Provenance,
+		})
+	}
+	data, err := json.MarshalIndent(incident, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	
+	dir := os.TempDir()
+	if cm.dataDir != "" {
+		dir = cm.dataDir
+	}
+	dir = filepath.Join(dir, incidentDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("desync-%s-%s.json", session.ID, incident.DetectedAt.Format("20060102-150405"))
+	path := filepath.Join(dir, name)
+	return path, os.WriteFile(path, data, 0600)
+}
+
+// incidentConfig is the part of the setup sync depends on, without URLs,
+// tokens or paths
+func (cm *CollabManager) incidentConfig(session *session.Session) map[string]interface{} {
+	session.Mutex.RLock()
+	settings := session.Settings
+	session.Mutex.RUnlock()
+	return map[string]interface{}{
+		"content_mode":      cm.syncManager.GetContentMode(),
+		"line_ending":       session.LineEnding,
+		"charset":           session.Charset,
+		"client_charset":    cm.clientCharset,
+		"conflict_strategy": settings.ConflictStrategy,
+		"preset":            settings.Preset,
+		"project":           session.Project,
+		"server_mode":       cm.p2pManager.ServerMode(),
+		"relay":             cm.relayClient != nil,
+		"spectating":        cm.spectating,
+		"peers":             len(cm.p2pManager.GetConnectedPeers()),
+	}
+}
+
+// incidentVersions lists the versions of the backend and its formats
+func incidentVersions() map[string]string {
+	versions := map[string]string{
+		"go":              runtime.Version(),
+		"operation_frame": fmt.Sprint(protocol.OperationFrameVersion),
+		"session_state":   fmt.Sprint(sessionStateVersion),
+	}
+	if version := moduleVersion(); version != "" {
+		versions["module"] = version
+	}
+	return versions
+}
@@ -0,0 +1,346 @@
+package collab
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/EmreDay1/collab.nvim/go/p2p"
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// diagnose runs the checks behind most "it's not connecting" reports and
+// answers with a diagnosis event: whether the STUN servers show a public
+// address, whether the TURN servers grant a relay, whether the relay or
+// central server can be reached, how far peers' clocks are off, how long
+// messages from Neovim take to arrive, and how close the document's history
+// is to the memory budget. The network checks run in the background, so the
+// request itself is answered right away with a diagnosing status.
+const (
+	// How long ICE gathering and dials may take
+	diagnoseTimeout = 5 * time.Second
+	
+	// How long peers have to answer clock probes
+	clockProbeWait = time.Second
+	
+	// Stdio delays beyond this are reported as warnings, as are clock
+	// offsets beyond collabsync.ClockSkewWarning
+	stdioLatencyWarning = 100 * time.Millisecond
+	
+	// Tracked memory above this fraction of the budget is reported
+	historyPressureWarning = 0.8
+)
+
+const (
+	CheckOK      = "ok"
+	CheckWarning = "warning"
+	CheckFailed  = "failed"
+	CheckSkipped = "skipped"
+)
+
+func (cm *CollabManager) handleDiagnose(req *protocol.DiagnoseRequest) *protocol.Message {
+	// These read the loop's own state, so they run before handing off
+	stdio := cm.checkStdio(req.SentAt)
+	history := cm.checkHistory()
+	
+	go func() {
+		checks := []protocol.DiagnosticCheck{stdio, history}
+		checks = append(checks, cm.runNetworkChecks()...)
+		event := protocol.DiagnosisEvent{Checks: checks, Report: diagnosisReport(checks)}
+		msg, _ := protocol.NewMessage(protocol.MsgDiagnosis, event)
+		if err := cm.sendMessage(msg); err != nil {
+			log.Printf("Failed to send diagnosis: %v", err)
+		}
+	}()
+	return createStatusMessage("diagnosing", "Running checks")
+}
+
+// runNetworkChecks runs the checks that wait on the network side by side
+func (cm *CollabManager) runNetworkChecks() []protocol.DiagnosticCheck {
+	checks := []func() protocol.DiagnosticCheck{
+		cm.checkSTUN,
+		cm.checkTURN,
+		cm.checkSignaling,
+		cm.checkClockSkew,
+	}
+	results := make([]protocol.DiagnosticCheck, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check func() protocol.DiagnosticCheck) {
+			defer wg.Done()
+			results[i] = check()
+		}(i, check)
+	}
+	wg.Wait()
+	return results
+}
+
+// diagnosisReport lays the checks out one per line
+func diagnosisReport(checks []protocol.DiagnosticCheck) string {
+	var report strings.Builder
+	report.WriteString("collab.nvim diagnosis\n")
+	problems := 0
+	for _, check := range checks {
+		fmt.Fprintf(&report, "%-8s %-10s %s\n", check.Status, check.Name, check.Detail)
+		if check.Status == CheckWarning || check.Status == CheckFailed {
+			problems++
+		}
+	}
+	if problems == 0 {
+		report.WriteString("No problems found")
+	} else {
+		fmt.Fprintf(&report, "%d problems found", problems)
+	}
+	return report.String()
+}
+
+// checkStdio times the diagnose request's trip from Neovim
+func (cm *CollabManager) checkStdio(sentAt int64) protocol.DiagnosticCheck {
+	check := protocol.DiagnosticCheck{Name: "stdio"}
+	if sentAt <= 0 {
+		check.Status = CheckSkipped
+		check.Detail = "the request had no sent_at to time it by"
+		return check
+	}
+	latency := time.Since(time.UnixMilli(sentAt))
+	if latency < 0 {
+		latency = 0
+	}
+	check.Status = CheckOK
+	check.Detail = fmt.Sprintf("%dms from Neovim to the backend", latency.Milliseconds())
+	if latency > stdioLatencyWarning {
+		check.Status = CheckWarning
+		check.Detail += "; the backend is falling behind Neovim's messages"
+	}
+	return check
+}
+
+// checkHistory reports how much memory the document and its histories hold
+func (cm *CollabManager) checkHistory() protocol.DiagnosticCheck {
+	check := protocol.DiagnosticCheck{Name: "history", Status: CheckOK}
+	usage := cm.memoryUsage()
+	stats := cm.syncManager.GetStats()
+	check.Detail = fmt.Sprintf("%d operations in history, %d in the document, %d waiting; %d KB tracked",
+		stats.HistorySize, stats.DocumentOps, stats.PendingLocalOps, usage.Total/1024)
+	
+	switch {
+	case cm.memoryBudget <= 0:
+		check.Detail += ", no memory budget"
+	case cm.memoryPressure:
+		check.Status = CheckWarning
+		check.Detail += fmt.Sprintf(" of a %d KB budget; history is being trimmed", cm.memoryBudget/1024)
+	case float64(usage.Total) > float64(cm.memoryBudget)*historyPressureWarning:
+		check.Status = CheckWarning
+		check.Detail += fmt.Sprintf(" of a %d KB budget, nearly used up", cm.memoryBudget/1024)
+	default:
+		check.Detail += fmt.Sprintf(" of a %d KB budget", cm.memoryBudget/1024)
+	}
+	return check
+}
+
+// checkSTUN looks for a public address through the STUN servers
+func (cm *CollabManager) checkSTUN() protocol.DiagnosticCheck {
+	check := protocol.DiagnosticCheck{Name: "stun"}
+	servers, skip := cm.diagnosticICEServers("stun:", "stuns:")
+	if skip != "" {
+		check.Status, check.Detail = CheckSkipped, skip
+		return check
+	}
+	if len(servers) == 0 {
+		check.Status, check.Detail = CheckSkipped, "no STUN servers configured"
+		return check
+	}
+	
+	candidates, err := cm.p2pManager.GatherCandidates(servers, false, diagnoseTimeout)
+	if err != nil {
+		check.Status, check.Detail = CheckFailed, err.Error()
+		return check
+	}
+	for _, candidate := range candidates {
+		if candidate.Typ == webrtc.ICECandidateTypeSrflx {
+			check.Status = CheckOK
+			check.Detail = fmt.Sprintf("public address %s:%d", candidate.Address, candidate.Port)
+			return check
+		}
+	}
+	check.Status = CheckFailed
+	check.Detail = fmt.Sprintf("no answer from %s within %s; outgoing UDP may be blocked", strings.Join(serverURLs(servers), ", "), diagnoseTimeout)
+	return check
+}
+
+// checkTURN asks the TURN servers for a relay allocation
+func (cm *CollabManager) checkTURN() protocol.DiagnosticCheck {
+	check := protocol.DiagnosticCheck{Name: "turn"}
+	servers, skip := cm.diagnosticICEServers("turn:", "turns:")
+	if skip != "" {
+		check.Status, check.Detail = CheckSkipped, skip
+		return check
+	}
+	if len(servers) == 0 {
+		check.Status = CheckSkipped
+		check.Detail = "no TURN servers configured; peers behind strict NATs or firewalls can't connect"
+		return check
+	}
+	
+	candidates, err := cm.p2pManager.GatherCandidates(servers, true, diagnoseTimeout)
+	if err != nil {
+		check.Status, check.Detail = CheckFailed, err.Error()
+		return check
+	}
+	for _, candidate := range candidates {
+		if candidate.Typ == webrtc.ICECandidateTypeRelay {
+			check.Status = CheckOK
+			check.Detail = fmt.Sprintf("relay address %s:%d", candidate.Address, candidate.Port)
+			return check
+		}
+	}
+	check.Status = CheckFailed
+	check.Detail = fmt.Sprintf("no allocation from %s within %s; check the credentials", strings.Join(serverURLs(servers), ", "), diagnoseTimeout)
+	return check
+}
+
+// diagnosticICEServers returns the ICE servers in use with one of the
+// schemes, or why WebRTC isn't used at all
+func (cm *CollabManager) diagnosticICEServers(schemes ...string) ([]webrtc.ICEServer, string) {
+	if cm.p2pManager.ServerMode() {
+		return nil, "server mode sends everything through server_url"
+	}
+	servers, err := cm.p2pManager.CurrentICEServers()
+	if err != nil {
+		return nil, err.Error()
+	}
+	
+	var matching []webrtc.ICEServer
+	for _, server := range servers {
+		var urls []string
+		for _, u := range server.URLs {
+			for _, scheme := range schemes {
+				if strings.HasPrefix(u, scheme) {
+					urls = append(urls, u)
+				}
+			}
+		}
+		if len(urls) > 0 {
+			server.URLs = urls
+			matching = append(matching, server)
+		}
+	}
+	return matching, ""
+}
+
+func serverURLs(servers []webrtc.ICEServer) []string {
+	var urls []string
+	for _, server := range servers {
+		urls = append(urls, server.URLs...)
+	}
+	return urls
+}
+
+// checkSignaling connects to the central server in server mode, or else to
+// the signaling server or the hosted relay for room codes
+func (cm *CollabManager) checkSignaling() protocol.DiagnosticCheck {
+	check := protocol.DiagnosticCheck{Name: "signaling"}
+	serverURL, signalingURL := cm.p2pManager.SignalingURLs()
+	
+	start := time.Now()
+	switch {
+	case serverURL != "":
+		u, _ := url.Parse(serverURL)
+		if err := cm.p2pManager.CheckTransport(p2p.TransportServer, u.Host); err != nil {
+			check.Status, check.Detail = CheckFailed, err.Error()
+			return check
+		}
+		conn, err := cm.p2pManager.DialSignaling(u.Host, diagnoseTimeout)
+		if err != nil {
+			check.Status = CheckFailed
+			check.Detail = fmt.Sprintf("can't reach the server at %s: %v", u.Host, err)
+			return check
+		}
+		conn.Close()
+		check.Detail = fmt.Sprintf("reached the server at %s in %dms", u.Host, time.Since(start).Milliseconds())
+	
+	case signalingURL != "":
+		u, _ := url.Parse(signalingURL)
+		if err := cm.p2pManager.CheckTransport(p2p.TransportWebRTC, u.Host); err != nil {
+			check.Status, check.Detail = CheckFailed, err.Error()
+			return check
+		}
+		conn, err := cm.p2pManager.DialSignaling(u.Host, diagnoseTimeout)
+		if err != nil {
+			check.Status = CheckFailed
+			check.Detail = fmt.Sprintf("can't reach the signaling server at %s: %v", u.Host, err)
+			return check
+		}
+		conn.Close()
+		check.Detail = fmt.Sprintf("reached the signaling server at %s in %dms", u.Host, time.Since(start).Milliseconds())
+	
+	case cm.relayClient != nil:
+		if err := cm.relayClient.Ping(); err != nil {
+			check.Status, check.Detail = CheckFailed, err.Error()
+			return check
+		}
+		check.Detail = fmt.Sprintf("reached the relay at %s in %dms", cm.relayClient.baseURL.Host, time.Since(start).Milliseconds())
+	
+	default:
+		check.Status = CheckSkipped
+		check.Detail = "no relay_url or server_url configured; sessions are joined with invites"
+		return check
+	}
+	check.Status = CheckOK
+	return check
+}
+
+// checkClockSkew probes the peers' clocks and reports the furthest off
+func (cm *CollabManager) checkClockSkew() protocol.DiagnosticCheck {
+	check := protocol.DiagnosticCheck{Name: "clock_skew"}
+	peers := cm.p2pManager.GetConnectedPeers()
+	if len(peers) == 0 {
+		check.Status, check.Detail = CheckSkipped, "no peers connected"
+		return check
+	}
+	
+	start := time.Now()
+	cm.probeClocks()
+	time.Sleep(clockProbeWait)
+	
+	var worst time.Duration
+	var worstPeer string
+	var unanswered []string
+	for _, userID := range peers {
+		offset, ok := cm.clocks.Get(userID)
+		if !ok || offset.measuredAt.Before(start) {
+			unanswered = append(unanswered, userID)
+			continue
+		}
+		if skew := offset.offset.Abs(); worstPeer == "" || skew > worst {
+			worst, worstPeer = skew, userID
+		}
+	}
+	if worstPeer == "" {
+		check.Status = CheckFailed
+		check.Detail = fmt.Sprintf("no peer answered within %s", clockProbeWait)
+		return check
+	}
+	
+	name := worstPeer
+	if session := cm.sessionManager.GetCurrentSession(); session != nil {
+		name = peerName(session, worstPeer)
+	}
+	check.Status = CheckOK
+	check.Detail = fmt.Sprintf("largest offset %s (%s)", worst.Round(time.Millisecond), name)
+	if worst > collabsync.ClockSkewWarning {
+		check.Status = CheckWarning
+		check.Detail += "; a wrong system clock skews which edit wins a conflict"
+	}
+	if len(unanswered) > 0 {
+		check.Detail += fmt.Sprintf("; %d peers didn't answer", len(unanswered))
+	}
+	return check
+}
@@ -0,0 +1,208 @@
+package collab
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Other Neovim plugins can talk to their counterparts on peers' machines
+// through collab.nvim's connections with extension messages. Each plugin uses
+// its own namespace, and each namespace is limited in message size and rate
+// on both ends, so a chatty plugin can't crowd out document traffic.
+var extensionNamespacePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+// defaultExtensionLimits apply to namespaces the config doesn't list
+var defaultExtensionLimits = ExtensionLimits{
+	MaxBytes:  64 * 1024,
+	PerSecond: 10,
+	Burst:     20,
+}
+
+// ExtensionLimits caps one namespace's traffic; zero fields use the defaults
+type ExtensionLimits struct {
+	MaxBytes  int     `json:"max_bytes,omitempty"`  // payload size
+	PerSecond float64 `json:"per_second,omitempty"` // sustained messages per second
+	Burst     int     `json:"burst,omitempty"`      // messages allowed at once
+}
+
+func (el ExtensionLimits) withDefaults(defaults ExtensionLimits) ExtensionLimits {
+	if el.MaxBytes <= 0 {
+		el.MaxBytes = defaults.MaxBytes
+	}
+	if el.PerSecond <= 0 {
+		el.PerSecond = defaults.PerSecond
+	}
+	if el.Burst <= 0 {
+		el.Burst = defaults.Burst
+	}
+	return el
+}
+
+// tokenBucket allows burst messages at once, refilled at perSecond
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (tb *tokenBucket) take(perSecond float64, burst int, now time.Time) bool {
+	if tb.last.IsZero() {
+		tb.tokens = float64(burst)
+	} else {
+		tb.tokens += now.Sub(tb.last).Seconds() * perSecond
+		if tb.tokens > float64(burst) {
+			tb.tokens = float64(burst)
+		}
+	}
+	tb.last = now
+	
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// ExtensionLimiter enforces the limits per namespace for local messages and
+// per peer and namespace for received ones
+type ExtensionLimiter struct {
+	limits   map[string]ExtensionLimits
+	defaults ExtensionLimits
+	buckets  map[string]*tokenBucket
+	mutex    sync.Mutex
+}
+
+// NewExtensionLimiter uses limits by namespace, where "*" replaces the
+// defaults for namespaces that aren't listed
+func NewExtensionLimiter(limits map[string]ExtensionLimits) *ExtensionLimiter {
+	el := &ExtensionLimiter{buckets: make(map[string]*tokenBucket)}
+	el.SetLimits(limits)
+	return el
+}
+
+// SetLimits replaces the limits by namespace, keeping the buckets
+func (el *ExtensionLimiter) SetLimits(limits map[string]ExtensionLimits) {
+	defaults := defaultExtensionLimits
+	if wildcard, ok := limits["*"]; ok {
+		defaults = wildcard.withDefaults(defaultExtensionLimits)
+	}
+	byNamespace := make(map[string]ExtensionLimits)
+	for namespace, limit := range limits {
+		if namespace != "*" {
+			byNamespace[namespace] = limit.withDefaults(defaults)
+		}
+	}
+	
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+	el.limits = byNamespace
+	el.defaults = defaults
+}
+
+func (el *ExtensionLimiter) limitsFor(namespace string) ExtensionLimits {
+	if limits, ok := el.limits[namespace]; ok {
+		return limits
+	}
+	return el.defaults
+}
+
+// Check validates a message from userID ("" for the local user) and counts
+// it against its namespace's rate
+func (el *ExtensionLimiter) Check(userID string, ext *protocol.ExtensionMessage) error {
+	if !extensionNamespacePattern.MatchString(ext.Namespace) {
+		return fmt.Errorf("invalid extension namespace %q", ext.Namespace)
+	}
+	
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+	
+	limits := el.limitsFor(ext.Namespace)
+	if len(ext.Payload) > limits.MaxBytes {
+		return fmt.Errorf("%s payload of %d bytes exceeds its limit of %d", ext.Namespace, len(ext.Payload), limits.MaxBytes)
+	}
+	
+	key := userID + "/" + ext.Namespace
+	bucket, exists := el.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{}
+		el.buckets[key] = bucket
+	}
+	if !bucket.take(limits.PerSecond, limits.Burst, time.Now()) {
+		return fmt.Errorf("%s is sending faster than %g messages per second", ext.Namespace, limits.PerSecond)
+	}
+	return nil
+}
+
+// Forget drops a peer's rate state, e.g. when it leaves
+func (el *ExtensionLimiter) Forget(userID string) {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+	
+	for key := range el.buckets {
+		if strings.HasPrefix(key, userID+"/") {
+			delete(el.buckets, key)
+		}
+	}
+}
+
+// handleExtension sends a plugin's message to the peers it names, or to
+// everyone
+func (cm *CollabManager) handleExtension(ext *protocol.ExtensionMessage) *protocol.Message {
+	if cm.sessionManager.GetCurrentSession() == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	if err := cm.extensions.Check("", ext); err != nil {
+		return createErrorMessage("extension_rejected", err.Error())
+	}
+	
+	// Recipients learn the sender from the connection, not the message
+	outgoing := protocol.ExtensionMessage{Namespace: ext.Namespace, Payload: ext.Payload}
+	if len(ext.To) == 0 {
+		if err := cm.broadcastToPeers(protocol.MsgExtension, outgoing); err != nil {
+			return createErrorMessage("extension_failed", err.Error())
+		}
+		return nil
+	}
+	
+	msg, err := protocol.NewMessage(protocol.MsgExtension, outgoing)
+	if err != nil {
+		return createErrorMessage("extension_failed", err.Error())
+	}
+	data, _ := msg.ToJSON()
+	var failed []string
+	for _, userID := range ext.To {
+		if err := cm.p2pManager.SendMessage(userID, data); err != nil {
+			log.Printf("Failed to send %s extension message to %s: %v", ext.Namespace, userID, err)
+			failed = append(failed, userID)
+		}
+	}
+	if len(failed) > 0 {
+		return createErrorMessage("extension_failed", "Could not reach "+strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// handlePeerExtension passes a peer's extension message on to Neovim, where
+// the plugin owning the namespace picks it up
+func (cm *CollabManager) handlePeerExtension(userID string, msg *protocol.Message) {
+	var ext protocol.ExtensionMessage
+	if err := msg.ParseData(&ext); err != nil {
+		return
+	}
+	if err := cm.extensions.Check(userID, &ext); err != nil {
+		log.Printf("Dropping extension message from %s: %v", userID, err)
+		return
+	}
+	
+	ext.From = userID
+	ext.To = nil
+	event, _ := protocol.NewMessage(protocol.MsgExtension, ext)
+	if err := cm.sendMessage(event); err != nil {
+		log.Printf("Failed to send extension message: %v", err)
+	}
+}
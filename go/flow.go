@@ -0,0 +1,174 @@
+package collab
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Document operations take turns: one operation or resync (joining,
+// importing a saved state) works on the document at a time. Operations
+// arriving meanwhile, from Neovim or from peers, are queued and applied in
+// order once it's done, so a slow transform or a replaced document never
+// costs an edit. When the wait gets long Neovim gets a busy event asking it
+// to hold its edits, and a ready event once the queue has drained. A full
+// queue makes further operations wait for room instead of dropping them.
+const (
+	operationQueueSize     = 512
+	operationQueueHighMark = operationQueueSize / 2
+	
+	// How long an operation may hold the document before queueing behind it
+	// counts as busy
+	busyAfter = 100 * time.Millisecond
+	
+	flowOperation = "operation"
+	flowResync    = "resync"
+)
+
+// operationFlow queues document operations while the document is taken
+type operationFlow struct {
+	held    bool
+	holder  string    // flowOperation or flowResync while held
+	since   time.Time // when the holder took the document
+	queue   []func()
+	busy    bool // Neovim was told to hold its edits
+	applied int  // queued operations applied since then
+	drained func(applied, total int, done bool)
+	output  *neovimOutput
+	changed *sync.Cond
+	mutex   sync.Mutex
+}
+
+func newOperationFlow(output *neovimOutput) *operationFlow {
+	f := &operationFlow{output: output}
+	f.changed = sync.NewCond(&f.mutex)
+	return f
+}
+
+// take marks the document as held; the caller holds the mutex
+func (f *operationFlow) take(holder string) {
+	f.held, f.holder, f.since = true, holder, time.Now()
+}
+
+// acquire waits for the document and takes it for a resync, which Neovim
+// is told about straight away
+func (f *operationFlow) acquire() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	
+	for f.held {
+		f.changed.Wait()
+	}
+	f.take(flowResync)
+	f.announceBusy()
+}
+
+// run applies work now when the document is free, or queues it to be
+// applied once it is. work is told whether it was queued; run returns the
+// same.
+func (f *operationFlow) run(work func(queued bool)) bool {
+	f.mutex.Lock()
+	for f.held && len(f.queue) >= operationQueueSize {
+		f.changed.Wait()
+	}
+	if f.held {
+		f.queue = append(f.queue, func() { work(true) })
+		if f.holder == flowResync || len(f.queue) >= operationQueueHighMark || time.Since(f.since) >= busyAfter {
+			f.announceBusy()
+		}
+		f.mutex.Unlock()
+		return true
+	}
+	f.take(flowOperation)
+	f.mutex.Unlock()
+	
+	work(false)
+	f.release()
+	return false
+}
+
+// onDrained has the next release tell drained how far it got through the
+// queue after each operation, and once it is empty
+func (f *operationFlow) onDrained(drained func(applied, total int, done bool)) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.drained = drained
+}
+
+// release applies the operations queued meanwhile, in order, then frees the
+// document
+func (f *operationFlow) release() {
+	applied := 0
+	for {
+		f.mutex.Lock()
+		drained := f.drained
+		if len(f.queue) == 0 {
+			f.held, f.holder = false, ""
+			f.drained = nil
+			f.announceReady()
+			f.changed.Broadcast()
+			f.mutex.Unlock()
+			if drained != nil {
+				drained(applied, applied, true)
+			}
+			return
+		}
+		work := f.queue[0]
+		f.queue = f.queue[1:]
+		f.take(flowOperation)
+		if f.busy {
+			f.applied++
+		}
+		total := applied + 1 + len(f.queue)
+		f.changed.Broadcast()
+		f.mutex.Unlock()
+		
+		work()
+		applied++
+		if drained != nil {
+			drained(applied, total, false)
+		}
+	}
+}
+
+// announceBusy tells Neovim to hold its edits; the caller holds the mutex,
+// which keeps busy and ready events in order
+func (f *operationFlow) announceBusy() {
+	if f.busy {
+		return
+	}
+	f.busy, f.applied = true, 0
+	
+	log.Printf("Document busy with %s; %d operations queued", f.holder, len(f.queue))
+	msg, _ := protocol.NewMessage(protocol.MsgBusy, protocol.BusyEvent{Reason: f.holder, Queued: len(f.queue)})
+	if err := f.output.send(msg); err != nil {
+		log.Printf("Failed to send busy event: %v", err)
+	}
+}
+
+// announceReady lets Neovim send its edits again; the caller holds the mutex
+func (f *operationFlow) announceReady() {
+	if !f.busy {
+		return
+	}
+	f.busy = false
+	
+	msg, _ := protocol.NewMessage(protocol.MsgReady, protocol.ReadyEvent{Applied: f.applied})
+	if err := f.output.send(msg); err != nil {
+		log.Printf("Failed to send ready event: %v", err)
+	}
+}
+
+// resync runs a handler that replaces the document while operations queue
+// up behind it. Its response, with the id of the request it answers, goes
+// to Neovim before any of them, since they apply to the new document, so
+// resync itself returns nil.
+func (cm *CollabManager) resync(id json.RawMessage, handler func() *protocol.Message) *protocol.Message {
+	cm.opFlow.acquire()
+	cm.respond(handler(), id)
+	cm.opFlow.release()
+	return nil
+}
@@ -0,0 +1,190 @@
+package collab
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// captureOutput has the manager write to a buffer read by outputMessages
+func captureOutput(cm *CollabManager) *bytes.Buffer {
+	var out bytes.Buffer
+	cm.SetOutput(&out)
+	return &out
+}
+
+// outputMessages parses what the manager wrote to Neovim
+func outputMessages(t *testing.T, out *bytes.Buffer) []*protocol.Message {
+	t.Helper()
+	var messages []*protocol.Message
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		msg, err := protocol.ParseMessage([]byte(line))
+		if err != nil {
+			t.Fatalf("output %q: %v", line, err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func TestResyncAnswersWithRequestID(t *testing.T) {
+	cm, _ := newTestManager(t)
+	requests := []struct {
+		msgType string
+		data    interface{}
+	}{
+		{protocol.MsgJoinSession, protocol.JoinSessionRequest{SessionID: "abc", LineEnding: "cr"}},
+		{protocol.MsgImportSessionState, protocol.ImportSessionStateRequest{Path: t.TempDir() + "/missing.json"}},
+	}
+	for i, request := range requests {
+		out := captureOutput(cm)
+		msg, _ := protocol.NewMessage(request.msgType, request.data)
+		msg.ID = []byte{byte('1' + i)}
+		if response := cm.HandleMessage(context.Background(), msg); response != nil {
+			t.Fatalf("%s answered %s directly, want it sent ahead of queued operations", request.msgType, response.Type)
+		}
+		
+		var answered bool
+		for _, sent := range outputMessages(t, out) {
+			if sent.Type == protocol.MsgError {
+				answered = true
+				if string(sent.ID) != string(msg.ID) {
+					t.Errorf("%s answered with id %s, want %s", request.msgType, sent.ID, msg.ID)
+				}
+			}
+		}
+		if !answered {
+			t.Errorf("%s was never answered", request.msgType)
+		}
+	}
+}
+
+func TestQueuedOperationsAnswerWithRequestID(t *testing.T) {
+	cm, _ := newTestManager(t)
+	cm.syncManager.InitializeDocument("package main\n")
+	userID := cm.sessionManager.GetUserID()
+	out := captureOutput(cm)
+	
+	// A resync holds the document while Neovim's edits arrive
+	cm.opFlow.acquire()
+	requests := []struct {
+		msgType string
+		data    interface{}
+	}{
+		{protocol.MsgDocumentOperation, protocol.DocumentOperation{Type: "insert", Position: 0, Content: "// a\n", UserID: userID}},
+		{protocol.MsgDocumentOperations, protocol.DocumentOperations{Operations: []protocol.DocumentOperation{
+			{Type: "insert", Position: 0, Content: "b", UserID: userID},
+			{Type: "insert", Position: 1, Content: "c", UserID: userID},
+		}}},
+		{protocol.MsgApplyTransaction, protocol.TransactionRequest{Edits: []protocol.TransactionEdit{
+			{Operations: []protocol.DocumentOperation{{Type: "insert", Position: 0, Content: "d"}}},
+		}}},
+	}
+	for i, request := range requests {
+		msg, _ := protocol.NewMessage(request.msgType, request.data)
+		msg.ID = []byte{byte('1' + i)}
+		response := cm.HandleMessage(context.Background(), msg)
+		var status protocol.StatusMessage
+		if response == nil || response.ParseData(&status) != nil || !strings.HasSuffix(status.Status, "_queued") {
+			t.Fatalf("%s answered %v, want it queued", request.msgType, response)
+		}
+	}
+	out.Reset()
+	cm.opFlow.release()
+	
+	var ids []string
+	for _, sent := range outputMessages(t, out) {
+		var status protocol.StatusMessage
+		if sent.Type != protocol.MsgStatus || sent.ParseData(&status) != nil {
+			continue
+		}
+		if !strings.HasSuffix(status.Status, "_applied") {
+			t.Errorf("queued request answered %s: %s", status.Status, status.Info)
+		}
+		ids = append(ids, string(sent.ID))
+	}
+	if strings.Join(ids, ",") != "1,2,3" {
+		t.Errorf("queued requests answered with ids %v, want 1, 2 and 3", ids)
+	}
+	if content := cm.syncManager.GetDocumentContent(); content != "dbc// a\npackage main\n" {
+		t.Errorf("document = %q, want the queued edits applied in order", content)
+	}
+}
+
+func TestBurstAnswersEveryOperation(t *testing.T) {
+	cm, _ := newTestManager(t)
+	cm.syncManager.InitializeDocument("package main\n")
+	userID := cm.sessionManager.GetUserID()
+	out := captureOutput(cm)
+	
+	typed := func(id, content string) *protocol.Message {
+		msg, _ := protocol.NewMessage(protocol.MsgDocumentOperation, protocol.DocumentOperation{Type: "insert", Position: 0, Content: content, UserID: userID})
+		msg.ID = []byte(id)
+		return msg
+	}
+	queue := make(chan []byte, 2)
+	for _, msg := range []*protocol.Message{typed("2", "b"), typed("3", "a")} {
+		line, _ := msg.ToJSON()
+		queue <- line
+	}
+	msg, next := cm.collectBurst(typed("1", "c"), queue)
+	if msg.Type != protocol.MsgDocumentOperations || next != nil {
+		t.Fatalf("collected %s, want one document_operations batch", msg.Type)
+	}
+	
+	response := cm.HandleMessage(context.Background(), msg)
+	if response == nil || string(response.ID) != "3" {
+		t.Fatalf("response = %v, want it to answer the last operation", response)
+	}
+	var ids []string
+	for _, sent := range outputMessages(t, out) {
+		if sent.Type == protocol.MsgStatus {
+			ids = append(ids, string(sent.ID))
+		}
+	}
+	if strings.Join(ids, ",") != "1,2" {
+		t.Errorf("folded operations answered with ids %v, want 1 and 2", ids)
+	}
+	if content := cm.syncManager.GetDocumentContent(); content != "abcpackage main\n" {
+		t.Errorf("document = %q, want the burst applied", content)
+	}
+}
+
+func TestResyncAnswersBetweenBusyAndReady(t *testing.T) {
+	cm, _ := newTestManager(t)
+	cm.syncManager.InitializeDocument("package main\n")
+	userID := cm.sessionManager.GetUserID()
+	out := captureOutput(cm)
+	
+	// Neovim keeps typing while the document is replaced
+	cm.resync([]byte("9"), func() *protocol.Message {
+		for i, content := range []string{"a", "b"} {
+			msg, _ := protocol.NewMessage(protocol.MsgDocumentOperation, protocol.DocumentOperation{Type: "insert", Position: 0, Content: content, UserID: userID})
+			msg.ID = []byte{byte('1' + i)}
+			var status protocol.StatusMessage
+			if response := cm.HandleMessage(context.Background(), msg); response == nil || response.ParseData(&status) != nil || !strings.HasSuffix(status.Status, "_queued") {
+				t.Fatalf("operation %s answered %v, want it queued behind the resync", msg.ID, response)
+			}
+		}
+		cm.syncManager.InitializeDocument("package other\n")
+		return createStatusMessage("state_imported", "")
+	})
+	
+	var order []string
+	for _, sent := range outputMessages(t, out) {
+		order = append(order, sent.Type+":"+string(sent.ID))
+	}
+	want := "busy:,status:9,status:1,status:2,ready:"
+	if strings.Join(order, ",") != want {
+		t.Errorf("sent %v, want %s", order, want)
+	}
+	if content := cm.syncManager.GetDocumentContent(); content != "bapackage other\n" {
+		t.Errorf("document = %q, want the queued edits applied to the new document", content)
+	}
+}
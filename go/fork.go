@@ -0,0 +1,209 @@
+package collab
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// A peer can fork the shared document into a private copy to try something
+// out without anyone watching: Neovim opens the copy in a local-only buffer,
+// and the backend keeps the document as it was when forked. Proposing the
+// buffer back diffs it against that snapshot, moves the changes past what
+// the session did since, as merging a breakout does, and sends them to
+// whoever has control as one suggestion. Forks are dropped on leaving.
+const maxForks = 20
+
+// documentFork is the document as it was when a private copy was made
+type documentFork struct {
+	id       string
+	name     string
+	base     string
+	forkedAt time.Time
+}
+
+// ForkSet holds the local user's forks of the current session's document
+type ForkSet struct {
+	forks  map[string]*documentFork
+	nextID int
+	mutex  sync.Mutex
+}
+
+func NewForkSet() *ForkSet {
+	return &ForkSet{forks: make(map[string]*documentFork)}
+}
+
+// Add records a fork of base
+func (fs *ForkSet) Add(name, base string) (*documentFork, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	
+	if len(fs.forks) >= maxForks {
+		return nil, fmt.Errorf("at most %d forks can be open; discard one first", maxForks)
+	}
+	fs.nextID++
+	fork := &documentFork{id: "fork-" + strconv.Itoa(fs.nextID), name: name, base: base, forkedAt: time.Now().UTC()}
+	if fork.name == "" {
+		fork.name = fork.id
+	}
+	fs.forks[fork.id] = fork
+	return fork, nil
+}
+
+func (fs *ForkSet) Get(id string) *documentFork {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.forks[id]
+}
+
+func (fs *ForkSet) Remove(id string) bool {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if _, ok := fs.forks[id]; !ok {
+		return false
+	}
+	delete(fs.forks, id)
+	return true
+}
+
+func (fs *ForkSet) Reset() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.forks = make(map[string]*documentFork)
+}
+
+// rebaseEdits turns the changes from base to edited into operations on the
+// current document, moved past what changed there since base. Deletions of
+// text that is already gone drop out.
+func (cm *CollabManager) rebaseEdits(base, edited string) []protocol.Operation {
+	forked := collabsync.DiffOperations(base, edited)
+	main := collabsync.DiffOperations(base, cm.syncManager.GetDocumentContent())
+	for i := range forked {
+		for j := range main {
+			forked[i], main[j] = cm.syncManager.InclusionTransform(forked[i], main[j], false),
+				cm.syncManager.InclusionTransform(main[j], forked[i], true)
+		}
+	}
+	
+	kept := forked[:0]
+	for _, op := range forked {
+		if op.Type == protocol.OpDelete && op.Length == 0 {
+			continue
+		}
+		kept = append(kept, op)
+	}
+	return kept
+}
+
+// handleForkDocument snapshots the document into a private copy
+func (cm *CollabManager) handleForkDocument(req *protocol.ForkDocumentRequest) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	if cm.syncManager.GetContentMode() != collabsync.ContentModeText {
+		return createErrorMessage("fork_document_failed", "Only text documents can be forked")
+	}
+	
+	base := cm.syncManager.GetDocumentContent()
+	version := cm.syncManager.GetDocumentVersion()
+	fork, err := cm.forks.Add(req.Name, base)
+	if err != nil {
+		return createErrorMessage("fork_document_failed", err.Error())
+	}
+	
+	authors := []protocol.ForkAuthor{}
+	if report, ok := cm.contributions.ReportFor(session.ID); ok {
+		for _, user := range report.Users {
+			if user.CharsInserted == 0 {
+				continue
+			}
+			authors = append(authors, protocol.ForkAuthor{
+				UserID:        user.UserID,
+				Name:          peerName(session, user.UserID),
+				CharsInserted: user.CharsInserted,
+				LastEditAt:    user.LastEditAt,
+			})
+		}
+	}
+	
+	content, encoding := cm.contentForClient(base, collabsync.ContentModeText)
+	msg, _ := protocol.NewMessage(protocol.MsgDocumentForked, protocol.DocumentForkedResponse{
+		ForkID:          fork.id,
+		Name:            fork.name,
+		SessionID:       session.ID,
+		FilePath:        session.FilePath,
+		Content:         content,
+		ContentEncoding: encoding,
+		Version:         version,
+		ForkedAt:        fork.forkedAt,
+		ForkedBy:        cm.sessionManager.GetUserID(),
+		Authors:         authors,
+	})
+	return msg
+}
+
+// handleProposeFork sends what changed in a fork's buffer as a suggestion.
+// With control, the suggestion is the local user's own to accept or dismiss.
+func (cm *CollabManager) handleProposeFork(req *protocol.ProposeForkRequest) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	fork := cm.forks.Get(req.ForkID)
+	if fork == nil {
+		return createErrorMessage("propose_fork_failed", "No fork "+req.ForkID)
+	}
+	
+	edited, err := decodeContent(req.Content, req.ContentEncoding)
+	if err != nil {
+		return createErrorMessage("invalid_content", err.Error())
+	}
+	if cm.clientCharset != CharsetUTF8 {
+		if edited, err = decodeCharset(edited, cm.clientCharset); err != nil {
+			return createErrorMessage("invalid_encoding", err.Error())
+		}
+	}
+	ops := cm.rebaseEdits(fork.base, normalizeLineEndings(edited))
+	if len(ops) == 0 {
+		return createStatusMessage("fork_unchanged", fork.name+" has no changes to propose")
+	}
+	if len(ops) > maxBurstOperations {
+		return createErrorMessage("propose_fork_failed", fmt.Sprintf("%s changes the document in %d places; at most %d can be proposed at once", fork.name, len(ops), maxBurstOperations))
+	}
+	
+	userID := cm.sessionManager.GetUserID()
+	var response *protocol.Message
+	if failure, _ := cm.editAccess(userID); failure == nil {
+		for i := range ops {
+			ops[i].UserID = userID
+		}
+		s := cm.suggestions.Add(userID, ops)
+		event, _ := protocol.NewMessage(protocol.MsgEditSuggested, cm.suggestionEvent(session, s))
+		if err := cm.sendMessage(event); err != nil {
+			return createErrorMessage("propose_fork_failed", err.Error())
+		}
+		response = createStatusMessage("edit_suggested", fork.name+" is pending as suggestion "+s.id)
+	} else {
+		response = cm.sendSuggestion(session, ops)
+		if response.Type == protocol.MsgError {
+			return response
+		}
+	}
+	
+	if req.Close {
+		cm.forks.Remove(fork.id)
+	}
+	return response
+}
+
+func (cm *CollabManager) handleDiscardFork(req *protocol.DiscardForkRequest) *protocol.Message {
+	if !cm.forks.Remove(req.ForkID) {
+		return createErrorMessage("discard_fork_failed", "No fork "+req.ForkID)
+	}
+	return createStatusMessage("fork_discarded", req.ForkID)
+}
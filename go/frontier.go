@@ -0,0 +1,199 @@
+package collab
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Peers tell each other how far they have applied the document: every
+// frontierInterval, while it changed, each broadcasts its vector clock in a
+// frontier message, and again when a peer joins. A peer's frontier against
+// the local clock gives how many operations it lacks, which get_metrics
+// lists per peer and /who shows. When a peer falls frontierLagOps or more
+// behind, Neovim gets a peer_lagging event, and another once it caught up,
+// so the UI can show who is lagging and the host can pause for them. Peers
+// that never report a frontier, as older versions don't, aren't listed.
+const (
+	frontierInterval = 2 * time.Second
+	frontierLagOps   = 50
+)
+
+type peerFrontier struct {
+	clock      protocol.VectorClock
+	reportedAt time.Time
+	lagging    bool
+}
+
+// FrontierTracker keeps how far each peer has applied the document
+type FrontierTracker struct {
+	peers map[string]*peerFrontier
+	sent  protocol.VectorClock // the local frontier last broadcast
+	mutex sync.Mutex
+}
+
+func NewFrontierTracker() *FrontierTracker {
+	return &FrontierTracker{peers: make(map[string]*peerFrontier)}
+}
+
+// operationsBehind counts the operations in local that frontier lacks
+func operationsBehind(local, frontier protocol.VectorClock) int64 {
+	var behind int64
+	for userID, count := range local {
+		if count > frontier[userID] {
+			behind += count - frontier[userID]
+		}
+	}
+	return behind
+}
+
+// Changed reports whether clock differs from the frontier last broadcast,
+// taking it as broadcast
+func (ft *FrontierTracker) Changed(clock protocol.VectorClock) bool {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	if ft.sent != nil && ft.sent.Equals(clock) {
+		return false
+	}
+	ft.sent = clock.Copy()
+	return true
+}
+
+// Resend has the local frontier broadcast again, e.g. for a peer that joined
+func (ft *FrontierTracker) Resend() {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	ft.sent = nil
+}
+
+// Set records a peer's frontier
+func (ft *FrontierTracker) Set(userID string, clock protocol.VectorClock, now time.Time) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	peer, ok := ft.peers[userID]
+	if !ok {
+		peer = &peerFrontier{}
+		ft.peers[userID] = peer
+	}
+	peer.clock = clock
+	peer.reportedAt = now
+}
+
+// Forget drops a peer, e.g. when it leaves
+func (ft *FrontierTracker) Forget(userID string) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	delete(ft.peers, userID)
+}
+
+// Reset forgets every peer, e.g. on leaving a session
+func (ft *FrontierTracker) Reset() {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	ft.peers = make(map[string]*peerFrontier)
+	ft.sent = nil
+}
+
+// Behind returns how many operations of local userID lacks, false when they
+// never reported a frontier
+func (ft *FrontierTracker) Behind(userID string, local protocol.VectorClock) (int64, bool) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	peer, ok := ft.peers[userID]
+	if !ok {
+		return 0, false
+	}
+	return operationsBehind(local, peer.clock), true
+}
+
+// Report lists how far each peer is behind local, by user ID
+func (ft *FrontierTracker) Report(local protocol.VectorClock) []protocol.PeerFrontier {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	report := make([]protocol.PeerFrontier, 0, len(ft.peers))
+	for userID, peer := range ft.peers {
+		report = append(report, protocol.PeerFrontier{
+			UserID:     userID,
+			Behind:     operationsBehind(local, peer.clock),
+			Lagging:    peer.lagging,
+			ReportedAt: peer.reportedAt,
+		})
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].UserID < report[j].UserID })
+	return report
+}
+
+// Check returns the peers that fell behind local or caught up since the
+// last check
+func (ft *FrontierTracker) Check(local protocol.VectorClock) []protocol.PeerLaggingEvent {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	var changed []protocol.PeerLaggingEvent
+	for userID, peer := range ft.peers {
+		behind := operationsBehind(local, peer.clock)
+		lagging := behind >= frontierLagOps
+		if lagging != peer.lagging {
+			peer.lagging = lagging
+			changed = append(changed, protocol.PeerLaggingEvent{UserID: userID, Behind: behind, Lagging: lagging})
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].UserID < changed[j].UserID })
+	return changed
+}
+
+// runFrontiers shares the local frontier and tells Neovim which peers lag
+// until stop is closed
+func (cm *CollabManager) runFrontiers(stop <-chan struct{}) {
+	ticker := time.NewTicker(frontierInterval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			session := cm.sessionManager.GetCurrentSession()
+			if session == nil {
+				continue
+			}
+			clock := cm.syncManager.GetVectorClock()
+			if cm.frontiers.Changed(clock) {
+				if err := cm.broadcastToPeers(protocol.MsgFrontier, protocol.FrontierMessage{VectorClock: clock}); err != nil {
+					log.Printf("Failed to send frontier: %v", err)
+				}
+			}
+			for _, event := range cm.frontiers.Check(clock) {
+				event.Name = peerName(session, event.UserID)
+				if event.Lagging {
+					log.Printf("%s is %d operations behind", event.Name, event.Behind)
+				}
+				if err := cm.sendEvent(protocol.MsgPeerLagging, event); err != nil {
+					log.Printf("Failed to send peer lagging: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// frontierReport lists how far each peer is behind, with their names
+func (cm *CollabManager) frontierReport() []protocol.PeerFrontier {
+	report := cm.frontiers.Report(cm.syncManager.GetVectorClock())
+	if session := cm.sessionManager.GetCurrentSession(); session != nil {
+		for i := range report {
+			report[i].Name = peerName(session, report[i].UserID)
+		}
+	}
+	return report
+}
+
+// handlePeerFrontier records how far a peer has applied the document
+func (cm *CollabManager) handlePeerFrontier(userID string, msg *protocol.Message) {
+	var frontier protocol.FrontierMessage
+	if userID == protocol.ServerUserID || msg.ParseData(&frontier) != nil || frontier.VectorClock == nil {
+		return
+	}
+	cm.frontiers.Set(userID, frontier.VectorClock, time.Now())
+}
@@ -0,0 +1,173 @@
+package collab
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// A host handoff moves a live session to another machine: the old host
+// exports everything needed to keep hosting into a file, the new host imports
+// it and takes over under the same session ID, so room codes and invites
+// already handed out keep working.
+const sessionStateVersion = 1
+
+func (cm *CollabManager) handleExportSessionState(req *protocol.ExportSessionStateRequest) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	if req.Path == "" {
+		return createErrorMessage("export_session_failed", "path is required")
+	}
+	
+	document := cm.syncManager.GetDocumentState()
+	content, encoding := encodeContent(document.Content, session.Mode)
+	
+	session.Mutex.RLock()
+	state := protocol.SessionState{
+		Version:         sessionStateVersion,
+		ExportedAt:      time.Now().UTC(),
+		ExportedBy:      cm.sessionManager.GetUserID(),
+		SessionID:       session.ID,
+		CreatedAt:       session.CreatedAt,
+		FilePath:        session.FilePath,
+		Project:         session.Project,
+		Ignore:          session.IgnoreRules,
+		Mode:            session.Mode,
+		LineEnding:      session.LineEnding,
+		Charset:         session.Charset,
+		RoomCode:        session.RoomCode,
+		Controller:      session.Controller,
+		Settings:        session.Settings,
+		Peers:           make([]protocol.Peer, 0, len(session.Peers)),
+		Content:         content,
+		ContentEncoding: encoding,
+		DocumentVersion: document.Version,
+		VectorClock:     document.VectorClock,
+		ICEPolicy:       cm.p2pManager.GetICEPolicy(),
+	}
+	for _, peer := range session.Peers {
+		state.Peers = append(state.Peers, *peer)
+	}
+	session.Mutex.RUnlock()
+	
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return createErrorMessage("export_session_failed", err.Error())
+	}
+	// The file holds the whole document, so keep it private
+	if err := os.WriteFile(req.Path, data, 0600); err != nil {
+		return createErrorMessage("export_session_failed", fmt.Sprintf("failed to write %s: %v", req.Path, err))
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgSessionStateExported, protocol.ExportSessionStateResponse{
+		SessionID:       session.ID,
+		Path:            req.Path,
+		DocumentVersion: state.DocumentVersion,
+		PeerCount:       len(state.Peers),
+	})
+	return msg
+}
+
+func (cm *CollabManager) handleImportSessionState(req *protocol.ImportSessionStateRequest) *protocol.Message {
+	state, err := readSessionState(req.Path)
+	if err != nil {
+		return createErrorMessage("import_session_failed", err.Error())
+	}
+	if state.Version != sessionStateVersion {
+		return createErrorMessage("import_session_failed", fmt.Sprintf("unsupported session state version %d", state.Version))
+	}
+	if state.SessionID == "" {
+		return createErrorMessage("import_session_failed", "session state has no session ID")
+	}
+	
+	// Neovim on the new machine may edit the file in another encoding
+	charset := normalizeCharset(req.FileEncoding)
+	if charset == "" {
+		charset = state.Charset
+	}
+	if charset != "" {
+		if _, err := lookupCharset(charset); err != nil {
+			return createErrorMessage("invalid_encoding", err.Error())
+		}
+	}
+	
+	content, err := decodeContent(state.Content, state.ContentEncoding)
+	if err != nil {
+		return createErrorMessage("invalid_content", err.Error())
+	}
+	
+	if err := cm.p2pManager.SetICEPolicy(state.ICEPolicy); err != nil {
+		return createErrorMessage("invalid_ice_policy", err.Error())
+	}
+	
+	root := ""
+	if req.Root != "" {
+		if root, err = cleanSessionRoot(req.Root); err != nil {
+			return createErrorMessage("invalid_root", err.Error())
+		}
+	}
+	
+	session, err := cm.sessionManager.RestoreSession(state, content)
+	if err != nil {
+		return createErrorMessage("import_session_failed", err.Error())
+	}
+	if err := cm.joinProject(session, root); err != nil {
+		cm.sessionManager.LeaveSession()
+		return createErrorMessage("import_session_failed", err.Error())
+	}
+	
+	cm.syncManager.SetContentMode(session.Mode)
+	cm.syncManager.RestoreDocument(content, state.DocumentVersion, state.VectorClock)
+	cm.useConflictStrategy(session)
+	cm.openOpLog(session.ID, content)
+	cm.contributions.Start(session.ID, session.FilePath)
+	
+	cm.clientCharset = charset
+	
+	// The clock of a timed session moves with the host
+	cm.startSessionClock(session)
+	
+	peers := make([]protocol.Peer, 0, len(session.Peers))
+	for _, peer := range session.Peers {
+		peers = append(peers, *peer)
+	}
+	
+	clientContent, encoding := cm.contentForClient(content, session.Mode)
+	response := protocol.ImportSessionStateResponse{
+		SessionID:       session.ID,
+		UserID:          cm.sessionManager.GetUserID(),
+		PreviousHost:    state.ExportedBy,
+		FilePath:        cm.localFilePath(session),
+		Content:         clientContent,
+		ContentEncoding: encoding,
+		Mode:            session.Mode,
+		LineEnding:      session.LineEnding,
+		FileEncoding:    charset,
+		RoomCode:        session.RoomCode,
+		Peers:           peers,
+	}
+	if session.Project {
+		response.RelativePath = session.FilePath
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgSessionStateImported, response)
+	return msg
+}
+
+// readSessionState reads an exported session state file
+func readSessionState(path string) (*protocol.SessionState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	var state protocol.SessionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid session state: %v", err)
+	}
+	return &state, nil
+}
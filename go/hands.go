@@ -0,0 +1,257 @@
+package collab
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+)
+
+// Raised hands are a lightweight way for followers to get the host's
+// attention, separate from control: raising a hand changes nothing, the host
+// decides who to call on and may hand them control for a limited time.
+const defaultHandControlDuration = 5 * time.Minute
+
+// HandQueue keeps raised hands in the order they went up
+type HandQueue struct {
+	hands []protocol.RaisedHand
+	mutex sync.Mutex
+}
+
+// Raise adds a hand, reporting false if it was already up
+func (hq *HandQueue) Raise(userID string) bool {
+	hq.mutex.Lock()
+	defer hq.mutex.Unlock()
+
+	for _, hand := range hq.hands {
+		if hand.UserID == userID {
+			return false
+		}
+	}
+	hq.hands = append(hq.hands, protocol.RaisedHand{UserID: userID, RaisedAt: time.Now()})
+	return true
+}
+
+// Lower removes a hand, reporting false if it wasn't up
+func (hq *HandQueue) Lower(userID string) bool {
+	hq.mutex.Lock()
+	defer hq.mutex.Unlock()
+
+	for i, hand := range hq.hands {
+		if hand.UserID == userID {
+			hq.hands = append(hq.hands[:i], hq.hands[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the raised hands, oldest first
+func (hq *HandQueue) List() []protocol.RaisedHand {
+	hq.mutex.Lock()
+	defer hq.mutex.Unlock()
+	return append([]protocol.RaisedHand{}, hq.hands...)
+}
+
+func (hq *HandQueue) Reset() {
+	hq.mutex.Lock()
+	defer hq.mutex.Unlock()
+	hq.hands = nil
+}
+
+// hostSession returns the current session if the local user hosts it
+func (cm *CollabManager) hostSession() *session.Session {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy != cm.sessionManager.GetUserID() {
+		return nil
+	}
+	return session
+}
+
+func (cm *CollabManager) handleRaiseHand() *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	if cm.hostSession() != nil {
+		return createErrorMessage("raise_hand_failed", "The host doesn't need to raise a hand")
+	}
+
+	// Only the host keeps the queue; other peers ignore the message
+	if err := cm.broadcastToPeers(protocol.MsgRaiseHand, struct{}{}); err != nil {
+		return createErrorMessage("raise_hand_failed", err.Error())
+	}
+	return createStatusMessage("hand_raised", "Waiting for the host")
+}
+
+// handleLowerHand lowers the local user's hand, or lets the host dismiss
+// someone else's
+func (cm *CollabManager) handleLowerHand(req *protocol.LowerHandRequest) *protocol.Message {
+	if cm.sessionManager.GetCurrentSession() == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+
+	if cm.hostSession() != nil {
+		if req.UserID == "" {
+			return createErrorMessage("lower_hand_failed", "user_id is required for the host")
+		}
+		if cm.hands.Lower(req.UserID) {
+			cm.sendHandsChanged()
+		}
+		return createStatusMessage("hand_lowered", "Dismissed "+req.UserID)
+	}
+
+	if err := cm.broadcastToPeers(protocol.MsgLowerHand, struct{}{}); err != nil {
+		return createErrorMessage("lower_hand_failed", err.Error())
+	}
+	return createStatusMessage("hand_lowered", "Hand lowered")
+}
+
+// handleGrantTemporaryControl lets the host call on a peer: they get control
+// until the duration runs out, then it reverts to the host
+func (cm *CollabManager) handleGrantTemporaryControl(req *protocol.GrantTemporaryControlRequest) *protocol.Message {
+	session := cm.hostSession()
+	if session == nil {
+		return createErrorMessage("grant_control_failed", "Only the host can grant control")
+	}
+	if req.UserID == "" {
+		return createErrorMessage("grant_control_failed", "user_id is required")
+	}
+
+	duration := time.Duration(req.DurationSeconds) * time.Second
+	if duration <= 0 {
+		duration = defaultHandControlDuration
+	}
+
+	if err := cm.sessionManager.SetController(req.UserID); err != nil {
+		return createErrorMessage("grant_control_failed", err.Error())
+	}
+	if cm.hands.Lower(req.UserID) {
+		cm.sendHandsChanged()
+	}
+
+	expiresAt := time.Now().Add(duration)
+	cm.scheduleControlRevert(req.UserID, duration)
+
+	status := &protocol.ControlStatus{CurrentController: req.UserID, ExpiresAt: &expiresAt}
+	if err := cm.broadcastToPeers(protocol.MsgControlStatus, status); err != nil {
+		log.Printf("Failed to announce control grant: %v", err)
+	}
+
+	msg, _ := protocol.NewMessage(protocol.MsgControlStatus, status)
+	return msg
+}
+
+// scheduleControlRevert returns control to the host after duration, unless
+// it has moved on to someone else by then
+func (cm *CollabManager) scheduleControlRevert(userID string, duration time.Duration) {
+	cm.controlMutex.Lock()
+	defer cm.controlMutex.Unlock()
+
+	if cm.controlRevert != nil {
+		cm.controlRevert.Stop()
+	}
+	cm.controlRevert = time.AfterFunc(duration, func() {
+		session := cm.hostSession()
+		if session == nil {
+			return
+		}
+		session.Mutex.RLock()
+		current := session.Controller
+		session.Mutex.RUnlock()
+		if current != userID {
+			return
+		}
+
+		hostID := cm.sessionManager.GetUserID()
+		if err := cm.sessionManager.SetController(hostID); err != nil {
+			log.Printf("Failed to revert control: %v", err)
+			return
+		}
+		log.Printf("Temporary control for %s expired", userID)
+
+		status := &protocol.ControlStatus{CurrentController: hostID}
+		if err := cm.broadcastToPeers(protocol.MsgControlStatus, status); err != nil {
+			log.Printf("Failed to announce control revert: %v", err)
+		}
+		msg, _ := protocol.NewMessage(protocol.MsgControlStatus, protocol.ControlStatus{CurrentController: hostID, HasControl: true})
+		if err := cm.sendMessage(msg); err != nil {
+			log.Printf("Failed to send control status: %v", err)
+		}
+	})
+}
+
+func (cm *CollabManager) stopControlRevert() {
+	cm.controlMutex.Lock()
+	defer cm.controlMutex.Unlock()
+
+	if cm.controlRevert != nil {
+		cm.controlRevert.Stop()
+		cm.controlRevert = nil
+	}
+}
+
+// handlePeerHand updates the host's queue when a peer raises or lowers a hand
+func (cm *CollabManager) handlePeerHand(userID string, msg *protocol.Message) {
+	if cm.hostSession() == nil {
+		return
+	}
+
+	var changed bool
+	if msg.Type == protocol.MsgRaiseHand {
+		changed = cm.hands.Raise(userID)
+	} else {
+		changed = cm.hands.Lower(userID)
+	}
+	if changed {
+		cm.sendHandsChanged()
+	}
+}
+
+// handlePeerControlStatus applies control changes announced by the host
+func (cm *CollabManager) handlePeerControlStatus(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy != userID {
+		return
+	}
+
+	var status protocol.ControlStatus
+	if err := msg.ParseData(&status); err != nil {
+		return
+	}
+	if err := cm.sessionManager.SetController(status.CurrentController); err != nil {
+		return
+	}
+
+	status.HasControl = status.CurrentController == cm.sessionManager.GetUserID()
+	event, _ := protocol.NewMessage(protocol.MsgControlStatus, status)
+	if err := cm.sendMessage(event); err != nil {
+		log.Printf("Failed to send control status: %v", err)
+	}
+}
+
+// sendHandsChanged sends the host's Neovim the current queue
+func (cm *CollabManager) sendHandsChanged() {
+	if err := cm.sendEvent(protocol.MsgHandsChanged, protocol.HandsChangedEvent{Hands: cm.hands.List()}); err != nil {
+		log.Printf("Failed to send raised hands: %v", err)
+	}
+}
+
+// broadcastToPeers wraps data in a message and sends it to every peer that
+// can handle it
+func (cm *CollabManager) broadcastToPeers(msgType string, data interface{}) error {
+	msg, err := protocol.NewMessage(msgType, data)
+	if err != nil {
+		return err
+	}
+	payload, err := msg.ToJSON()
+	if err != nil {
+		return err
+	}
+	if lacking := cm.capabilities.Lacking(msgType); len(lacking) > 0 {
+		return cm.sendToPeersExcept(payload, lacking)
+	}
+	return cm.p2pManager.BroadcastMessage(payload)
+}
@@ -0,0 +1,156 @@
+package collab
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Project sessions leave out what the project's .gitignore and .collabignore
+// leave out, so dependencies and build output are never offered for
+// sharing. Rules use gitignore syntax and are read from the root only; the
+// host's effective rules travel with the session, so every member sees the
+// same set of files. .collabignore comes last and can re-include (`!`) what
+// .gitignore excludes.
+var ignoreFiles = []string{".gitignore", ".collabignore"}
+
+// defaultIgnoreRules apply to every project
+var defaultIgnoreRules = []string{".git/"}
+
+// ignoreRule is one parsed gitignore pattern
+type ignoreRule struct {
+	segments []string // pattern split at slashes
+	anchored bool     // matched from the root instead of against any name
+	negate   bool
+	dirOnly  bool
+}
+
+// parseIgnoreRule parses a gitignore line, reporting false for blank lines
+// and comments
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:] // escaped leading ! or #
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	rule.segments = strings.Split(line, "/")
+	return rule, true
+}
+
+// matches reports whether the rule applies to a slash-separated path
+func (r ignoreRule) matches(rel string, dir bool) bool {
+	if r.dirOnly && !dir {
+		return false
+	}
+	names := strings.Split(rel, "/")
+	if !r.anchored {
+		ok, _ := path.Match(r.segments[0], names[len(names)-1])
+		return ok
+	}
+	return matchSegments(r.segments, names)
+}
+
+// matchSegments matches path segments against pattern segments, where "**"
+// stands for any number of segments
+func matchSegments(pattern, names []string) bool {
+	if len(pattern) == 0 {
+		return len(names) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(names); i++ {
+			if matchSegments(pattern[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(names) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], names[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], names[1:])
+}
+
+// IgnoreRules decides which project files are left out
+type IgnoreRules struct {
+	lines []string
+	rules []ignoreRule
+}
+
+func NewIgnoreRules(lines []string) *IgnoreRules {
+	ir := &IgnoreRules{lines: lines}
+	for _, line := range lines {
+		if rule, ok := parseIgnoreRule(line); ok {
+			ir.rules = append(ir.rules, rule)
+		}
+	}
+	return ir
+}
+
+// loadIgnoreRules reads the effective rules of the project at root
+func loadIgnoreRules(root string) *IgnoreRules {
+	lines := append([]string(nil), defaultIgnoreRules...)
+	for _, name := range ignoreFiles {
+		file, err := os.Open(filepath.Join(root, name))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if _, ok := parseIgnoreRule(scanner.Text()); ok {
+				lines = append(lines, strings.TrimRight(scanner.Text(), " \t\r"))
+			}
+		}
+		file.Close()
+	}
+	return NewIgnoreRules(lines)
+}
+
+// Lines returns the rules as written, for session metadata
+func (ir *IgnoreRules) Lines() []string {
+	return ir.lines
+}
+
+// Ignored reports whether a slash-separated path relative to the root is
+// left out. As in git, nothing inside an ignored directory comes back.
+func (ir *IgnoreRules) Ignored(rel string, dir bool) bool {
+	names := strings.Split(rel, "/")
+	for i := 1; i < len(names); i++ {
+		if ir.ignoredSelf(strings.Join(names[:i], "/"), true) {
+			return true
+		}
+	}
+	return ir.ignoredSelf(rel, dir)
+}
+
+// ignoredSelf applies the last rule matching the path itself
+func (ir *IgnoreRules) ignoredSelf(rel string, dir bool) bool {
+	for i := len(ir.rules) - 1; i >= 0; i-- {
+		if ir.rules[i].matches(rel, dir) {
+			return !ir.rules[i].negate
+		}
+	}
+	return false
+}
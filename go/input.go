@@ -0,0 +1,189 @@
+package collab
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Messages from Neovim are read ahead of processing into a bounded queue.
+// A message over the size limit is skipped and reported instead of ending
+// the loop. When the queue fills past its high mark Neovim gets a
+// backpressure event asking it to hold further messages, and another once
+// the queue has drained below its low mark.
+const (
+	defaultMaxMessageBytes = 32 << 20
+	
+	inputQueueSize     = 256
+	inputQueueHighMark = 192
+	inputQueueLowMark  = 32
+)
+
+// messageTooLargeError reports a message that was skipped for its size
+type messageTooLargeError struct {
+	size  int
+	limit int
+}
+
+func (e *messageTooLargeError) Error() string {
+	return fmt.Sprintf("message of %d bytes exceeds the limit of %d", e.size, e.limit)
+}
+
+// lineReader reads newline-separated messages of at most limit bytes, any of
+// which may instead come preceded by its length, or once framed, only
+// messages preceded by their length
+type lineReader struct {
+	reader *bufio.Reader
+	limit  int
+	framed bool
+}
+
+func newLineReader(r io.Reader, limit int) *lineReader {
+	if limit <= 0 {
+		limit = defaultMaxMessageBytes
+	}
+	return &lineReader{reader: bufio.NewReaderSize(r, 64*1024), limit: limit}
+}
+
+// next returns the next message without its newline. A message over the
+// limit is read to its end without being kept, and reported with a
+// *messageTooLargeError.
+func (lr *lineReader) next() ([]byte, error) {
+	if lr.framed {
+		return lr.nextFrame()
+	}
+	if b, err := lr.reader.Peek(1); err == nil && startsFrame(b[0]) {
+		return lr.nextFrame()
+	}
+	
+	var line []byte
+	size := 0
+	for {
+		chunk, err := lr.reader.ReadSlice('\n')
+		size += len(chunk)
+		if len(line) <= lr.limit {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || size == 0) {
+			return nil, err
+		}
+		if err == nil {
+			size-- // the newline
+		}
+		break
+	}
+	
+	if size > lr.limit {
+		return nil, &messageTooLargeError{size: size, limit: lr.limit}
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// startsFrame tells whether b, the first byte of a message, is the start of
+// a length rather than of a line: a control character other than the
+// whitespace JSON may start with. Only lengths of 144 MiB and more start
+// with those.
+func startsFrame(b byte) bool {
+	return b < 0x20 && b != '\t' && b != '\n' && b != '\r'
+}
+
+// nextFrame returns the next message after its 4-byte big-endian length
+func (lr *lineReader) nextFrame() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(lr.reader, header[:]); err != nil {
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[:]))
+	if size > int64(lr.limit) {
+		if _, err := lr.reader.Discard(int(size)); err != nil {
+			return nil, err
+		}
+		return nil, &messageTooLargeError{size: int(size), limit: lr.limit}
+	}
+	
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(lr.reader, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// inputFlow tracks whether Neovim has been asked to hold its messages
+type inputFlow struct {
+	paused bool
+	output *neovimOutput
+	mutex  sync.Mutex
+}
+
+// update pauses or resumes Neovim for the number of messages queued
+func (f *inputFlow) update(queued int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	
+	switch {
+	case !f.paused && queued >= inputQueueHighMark:
+		f.paused = true
+	case f.paused && queued <= inputQueueLowMark:
+		f.paused = false
+	default:
+		return
+	}
+	
+	if f.paused {
+		log.Printf("Falling behind with %d messages queued; asking Neovim to wait", queued)
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgBackpressure, protocol.BackpressureEvent{Paused: f.paused, Queued: queued})
+	if err := f.output.send(msg); err != nil {
+		log.Printf("Failed to send backpressure event: %v", err)
+	}
+}
+
+// readInput queues messages from input until it ends, then closes the queue
+// and returns how reading ended (nil for the end of input)
+func (cm *CollabManager) readInput(input io.Reader, queue chan<- []byte) error {
+	defer close(queue)
+	
+	reader := newLineReader(input, cm.maxMessageBytes)
+	format := cm.output.Format()
+	reader.framed = format != WireJSON
+	for {
+		line, err := reader.next()
+		if tooLarge, ok := err.(*messageTooLargeError); ok {
+			log.Printf("Skipping message: %v", tooLarge)
+			cm.sendMessage(createErrorMessage("message_too_large", tooLarge.Error()))
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if format == WireMsgpack {
+			if line, err = protocol.MsgpackToJSON(line); err != nil {
+				log.Printf("Skipping message: %v", err)
+				cm.sendMessage(createErrorMessage("parse_error", err.Error()))
+				continue
+			}
+		}
+		if requested, ok := cm.requestedWireFormat(line); ok {
+			format = requested
+			reader.framed = format != WireJSON
+		}
+		
+		queue <- line
+		cm.inputFlow.update(len(queue))
+	}
+}
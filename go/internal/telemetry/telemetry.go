@@ -0,0 +1,34 @@
+// Package telemetry holds the tracer and span attributes the engine's
+// packages share.
+package telemetry
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans cover stdin → handleMessage → SyncManager transform → P2P broadcast.
+// Until tracing is enabled the global provider is a no-op, so instrumented
+// code costs next to nothing.
+var Tracer = otel.Tracer("collab.nvim")
+
+// Span attribute keys
+const (
+	AttrMessageType   = attribute.Key("collab.message.type")
+	AttrOperationType = attribute.Key("collab.operation.type")
+	AttrOperationUser = attribute.Key("collab.operation.user_id")
+	AttrLocalOps      = attribute.Key("collab.sync.local_ops")
+	AttrPayloadBytes  = attribute.Key("collab.payload.bytes")
+	AttrPeerCount     = attribute.Key("collab.p2p.peers")
+)
+
+// EndSpan records err on the span, if any, and ends it
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
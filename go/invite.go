@@ -0,0 +1,77 @@
+package collab
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Invite URIs carry everything needed to join a session from another device,
+// e.g. "collab://join/3f2a9c1d0b7e4a5f?code=blue-otter-42"
+const inviteURIScheme = "collab"
+
+// buildInviteURI returns the join URI for a session, with its room code if any
+func buildInviteURI(sessionID, roomCode string) string {
+	u := url.URL{
+		Scheme: inviteURIScheme,
+		Host:   "join",
+		Path:   "/" + url.PathEscape(sessionID),
+	}
+	if roomCode != "" {
+		u.RawQuery = url.Values{"code": {roomCode}}.Encode()
+	}
+	return u.String()
+}
+
+// isInviteURI reports whether s is a collab:// join URI
+func isInviteURI(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), inviteURIScheme+"://")
+}
+
+// parseInviteURI extracts the session ID and room code from a join URI
+func parseInviteURI(raw string) (string, string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid invite URI: %v", err)
+	}
+	if u.Scheme != inviteURIScheme || u.Host != "join" {
+		return "", "", fmt.Errorf("not a collab invite URI: %s", raw)
+	}
+	
+	sessionID := strings.Trim(u.Path, "/")
+	roomCode := u.Query().Get("code")
+	if sessionID == "" && roomCode == "" {
+		return "", "", fmt.Errorf("invite URI has no session or room code")
+	}
+	
+	return sessionID, roomCode, nil
+}
+
+// renderQRMatrix encodes content as a QR code, one string per row with '1'
+// for dark modules and '0' for light ones. The quiet zone is included so the
+// matrix scans as-is.
+func renderQRMatrix(content string) ([]string, error) {
+	code, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode QR code: %v", err)
+	}
+	
+	bitmap := code.Bitmap()
+	rows := make([]string, len(bitmap))
+	for y, line := range bitmap {
+		var row strings.Builder
+		row.Grow(len(line))
+		for _, dark := range line {
+			if dark {
+				row.WriteByte('1')
+			} else {
+				row.WriteByte('0')
+			}
+		}
+		rows[y] = row.String()
+	}
+	
+	return rows, nil
+}
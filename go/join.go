@@ -0,0 +1,193 @@
+package collab
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/p2p"
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Joining a peer-to-peer session takes it from the peers already in it.
+// The joiner connects through the signaling server, or uses the connection
+// an accepted invite or SSH tunnel already made, and asks every connected
+// peer with request_session_state. The host answers with the session as it
+// has it: the document at its version and vector clock, the roster and the
+// settings, which the joiner starts from. A member's answer is taken when
+// the host's doesn't follow within joinHostGrace. The host adds the joiner
+// to its roster before answering, and sends the jump list, breakpoints and
+// rules once the joiner has the session. Peers only answer for the session
+// they are in. Documents over p2p.SnapshotInlineLimit come on a snapshot
+// channel (see p2p/snapshot.go) instead.
+const (
+	joinStateTimeout = 30 * time.Second
+	joinHostGrace    = 3 * time.Second
+	
+	// How often peers that connected since are asked
+	joinStateRetry = 500 * time.Millisecond
+)
+
+// stateAnswer is a peer's answer to request_session_state
+type stateAnswer struct {
+	from  string
+	state protocol.ServerWelcome
+}
+
+// stateWait is a join waiting for the session from its peers. Readers
+// handing over an answer hold the peer's later messages until the join
+// installed the session or gave up, so none arrive before it.
+type stateWait struct {
+	sessionID string
+	answers   chan stateAnswer
+	done      chan struct{}
+}
+
+// fetchSessionState asks the session's connected peers for it and returns
+// the host's answer, or a member's when the host doesn't answer. Call
+// endSessionStateWait once the session is installed.
+func (cm *CollabManager) fetchSessionState(sessionID string) (*protocol.ServerWelcome, string, error) {
+	wait := &stateWait{
+		sessionID: sessionID,
+		answers:   make(chan stateAnswer, 16),
+		done:      make(chan struct{}),
+	}
+	if previous := cm.joinWait.Swap(wait); previous != nil {
+		close(previous.done)
+	}
+	
+	asked := make(map[string]bool)
+	ask := func() {
+		for _, userID := range cm.p2pManager.GetConnectedPeers() {
+			if !asked[userID] {
+				asked[userID] = true
+				cm.sendToPeer(userID, protocol.MsgRequestSessionState, protocol.SessionStateRequest{SessionID: sessionID, Snapshots: true})
+			}
+		}
+	}
+	ask()
+	
+	ticker := time.NewTicker(joinStateRetry)
+	defer ticker.Stop()
+	timeout := time.NewTimer(joinStateTimeout)
+	defer timeout.Stop()
+	var grace <-chan time.Time
+	var fallback *stateAnswer
+	for {
+		select {
+		case answer := <-wait.answers:
+			if answer.from == answer.state.CreatedBy {
+				return &answer.state, answer.from, nil
+			}
+			if fallback == nil {
+				fallback = &answer
+				grace = time.After(joinHostGrace)
+			}
+		case <-grace:
+			log.Printf("Host of %s didn't answer; joining with %s's copy", sessionID, fallback.from)
+			return &fallback.state, fallback.from, nil
+		case <-ticker.C:
+			ask()
+		case <-timeout.C:
+			if fallback != nil {
+				return &fallback.state, fallback.from, nil
+			}
+			if len(asked) == 0 {
+				return nil, "", fmt.Errorf("no peer of session %s connected within %v", sessionID, joinStateTimeout)
+			}
+			return nil, "", fmt.Errorf("no peer of session %s answered within %v", sessionID, joinStateTimeout)
+		}
+	}
+}
+
+// welcomeHas reports whether userID is on a session's roster
+func welcomeHas(state *protocol.ServerWelcome, userID string) bool {
+	for _, peer := range state.Peers {
+		if peer.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// endSessionStateWait lets peers' messages held for the join through
+func (cm *CollabManager) endSessionStateWait() {
+	if wait := cm.joinWait.Swap(nil); wait != nil {
+		close(wait.done)
+	}
+}
+
+// handlePeerSessionState hands a peer's answer to the join waiting for it,
+// holding the peer's later messages until the join is through, however long
+// downloading a snapshot takes
+func (cm *CollabManager) handlePeerSessionState(userID string, msg *protocol.Message) {
+	wait := cm.joinWait.Load()
+	var state protocol.ServerWelcome
+	if wait == nil || msg.ParseData(&state) != nil || state.SessionID != wait.sessionID {
+		return
+	}
+	select {
+	case wait.answers <- stateAnswer{from: userID, state: state}:
+	default:
+		return
+	}
+	<-wait.done
+}
+
+// handlePeerRequestSessionState answers a joiner with the session, adding
+// them to the roster on the host
+func (cm *CollabManager) handlePeerRequestSessionState(userID string, msg *protocol.Message) {
+	var req protocol.SessionStateRequest
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || cm.p2pManager.ServerMode() || msg.ParseData(&req) != nil || req.SessionID != session.ID {
+		return
+	}
+	host := session.CreatedBy == cm.sessionManager.GetUserID()
+	
+	document := cm.syncManager.GetDocumentState()
+	session.Mutex.Lock()
+	if host {
+		if _, ok := session.Peers[userID]; !ok {
+			session.Peers[userID] = &protocol.Peer{UserID: userID}
+		}
+		if caps, ok := cm.capabilities.Get(userID); ok {
+			session.Peers[userID].Capabilities = &caps
+		}
+	}
+	state := protocol.ServerWelcome{
+		SessionID:  session.ID,
+		CreatedBy:  session.CreatedBy,
+		CreatedAt:  session.CreatedAt,
+		Controller: session.Controller,
+		Spec: protocol.ServerSessionSpec{
+			FilePath:   session.FilePath,
+			Project:    session.Project,
+			Ignore:     session.IgnoreRules,
+			Content:    document.Content,
+			Mode:       session.Mode,
+			LineEnding: session.LineEnding,
+			Charset:    session.Charset,
+			Settings:   session.Settings,
+		},
+		Version:     document.Version,
+		VectorClock: document.VectorClock,
+		Peers:       make([]protocol.Peer, 0, len(session.Peers)),
+	}
+	for _, peer := range session.Peers {
+		state.Peers = append(state.Peers, *peer)
+	}
+	session.Mutex.Unlock()
+	
+	if req.Snapshots && len(state.Spec.Content) > p2p.SnapshotInlineLimit && cm.p2pManager.CanSendSnapshot(userID) {
+		offer := cm.p2pManager.ServeSnapshot([]byte(state.Spec.Content))
+		state.Spec.Content = ""
+		state.Snapshot = &offer
+	}
+	cm.sendToPeer(userID, protocol.MsgSessionState, state)
+	if host {
+		cm.sessionManager.RecordPeerJoined(session.ID, protocol.Peer{UserID: userID})
+		cm.sendToPeer(userID, protocol.MsgJumpList, cm.jumpListEvent(""))
+		cm.sendToPeer(userID, protocol.MsgBreakpoints, cm.breakpointsEvent(""))
+		cm.sendOperationRules(userID)
+	}
+}
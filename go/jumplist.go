@@ -0,0 +1,617 @@
+package collab
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+)
+
+// The diagnostics and comments peers share make up one jump list for the
+// session, ordered by file and position like a quickfix list, with a cursor
+// everyone moves together. The host keeps the list: members send it what
+// they share and where to move, and it sends every peer the list whenever
+// the list or the cursor changes, so going through the errors together is
+// one walk rather than each peer's own. Entries in the session's document
+// move with its edits on every peer; entries in other project files stay
+// where they were shared.
+const (
+	JumpDiagnostic = "diagnostic"
+	JumpComment    = "comment"
+	
+	// Diagnostics one user may share for one file, so a noisy linter can't
+	// flood everyone's list
+	maxSharedDiagnostics = 500
+)
+
+// jumpEntry is one shared diagnostic or comment. Entries in the session's
+// document (file "") keep a byte offset that edits move instead of a line
+// and column.
+type jumpEntry struct {
+	id       string
+	kind     string
+	file     string
+	offset   int
+	line     int
+	column   int
+	severity int
+	source   string
+	message  string
+	users    []string
+}
+
+// position returns the entry's line and column in the current content
+func (e *jumpEntry) position(content string) (int, int) {
+	if e.file == "" {
+		return lineColumnOf(content, e.offset)
+	}
+	return e.line, e.column
+}
+
+// JumpList is the session's shared diagnostics and comments and the item
+// the walk through them is on
+type JumpList struct {
+	entries []*jumpEntry
+	current string     // ID of the current item, "" before the walk starts
+	anchor  *jumpEntry // where the current item was, to carry on from once it's gone
+	nextID  int
+	mutex   sync.Mutex
+}
+
+func (jl *JumpList) newEntry(kind, file string, line, column int, content string) *jumpEntry {
+	jl.nextID++
+	entry := &jumpEntry{id: strconv.Itoa(jl.nextID), kind: kind, file: file, line: line, column: column}
+	if file == "" {
+		entry.offset = offsetOf(content, line, column)
+	}
+	return entry
+}
+
+// SetDiagnostics replaces a user's diagnostics for a file, reporting whether
+// anything changed. Diagnostics shared again unchanged keep their IDs.
+func (jl *JumpList) SetDiagnostics(userID, file string, diagnostics []protocol.SharedDiagnostic, content string) bool {
+	jl.mutex.Lock()
+	defer jl.mutex.Unlock()
+	
+	previous := make(map[string]string)
+	kept := jl.entries[:0]
+	for _, entry := range jl.entries {
+		if entry.kind == JumpDiagnostic && entry.file == file && entry.users[0] == userID {
+			line, column := entry.position(content)
+			previous[diagnosticKey(line, column, entry.severity, entry.source, entry.message)] = entry.id
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	jl.entries = kept
+	
+	changed := len(previous) != len(diagnostics)
+	for _, diagnostic := range diagnostics {
+		entry := jl.newEntry(JumpDiagnostic, file, diagnostic.Line, diagnostic.Column, content)
+		entry.severity, entry.source, entry.message = diagnostic.Severity, diagnostic.Source, diagnostic.Message
+		entry.users = []string{userID}
+		if id, ok := previous[diagnosticKey(diagnostic.Line, diagnostic.Column, diagnostic.Severity, diagnostic.Source, diagnostic.Message)]; ok {
+			entry.id = id
+		} else {
+			changed = true
+		}
+		jl.entries = append(jl.entries, entry)
+	}
+	return changed
+}
+
+func diagnosticKey(line, column, severity int, source, message string) string {
+	return fmt.Sprintf("%d:%d:%d:%s:%s", line, column, severity, source, message)
+}
+
+// AddComment adds a comment and returns its ID
+func (jl *JumpList) AddComment(userID, file string, line, column int, text, content string) string {
+	jl.mutex.Lock()
+	defer jl.mutex.Unlock()
+	
+	entry := jl.newEntry(JumpComment, file, line, column, content)
+	entry.message = text
+	entry.users = []string{userID}
+	jl.entries = append(jl.entries, entry)
+	return entry.id
+}
+
+// RemoveComment removes a comment; only its author or the host may
+func (jl *JumpList) RemoveComment(id, userID string, host bool) error {
+	jl.mutex.Lock()
+	defer jl.mutex.Unlock()
+	
+	for i, entry := range jl.entries {
+		if entry.id != id {
+			continue
+		}
+		if entry.kind != JumpComment {
+			return fmt.Errorf("%s is a diagnostic; its author shares diagnostics again to remove it", id)
+		}
+		if !host && entry.users[0] != userID {
+			return fmt.Errorf("only the author or the host can remove a comment")
+		}
+		jl.entries = append(jl.entries[:i], jl.entries[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("no item %s", id)
+}
+
+// RemoveUser drops the diagnostics of a peer who left; their comments stay.
+// It reports whether anything was removed.
+func (jl *JumpList) RemoveUser(userID string) bool {
+	jl.mutex.Lock()
+	defer jl.mutex.Unlock()
+	
+	kept := jl.entries[:0]
+	for _, entry := range jl.entries {
+		if entry.kind != JumpDiagnostic || entry.users[0] != userID {
+			kept = append(kept, entry)
+		}
+	}
+	removed := len(kept) != len(jl.entries)
+	jl.entries = kept
+	return removed
+}
+
+// Move moves the current item to id, or step items from it. Without a
+// current item, stepping forward starts at the first and back at the last.
+func (jl *JumpList) Move(id string, step int, content string) error {
+	jl.mutex.Lock()
+	defer jl.mutex.Unlock()
+	
+	items := jl.itemsLocked(content)
+	if len(items) == 0 {
+		return fmt.Errorf("the jump list is empty")
+	}
+	index := jl.currentIndexLocked(items, content)
+	switch {
+	case id != "":
+		index = -1
+		for i, item := range items {
+			if containsString(item.IDs, id) {
+				index = i
+			}
+		}
+		if index < 0 {
+			return fmt.Errorf("no item %s", id)
+		}
+	case step == 0:
+		return fmt.Errorf("id or step is required")
+	case index < 0 && step > 0:
+		index = step - 1
+	case index < 0:
+		index = len(items) + step
+	default:
+		index += step
+	}
+	if index < 0 || index >= len(items) {
+		return fmt.Errorf("no more items")
+	}
+	jl.setCurrentLocked(items[index])
+	return nil
+}
+
+// Snapshot returns the items in order and the current one's ID
+func (jl *JumpList) Snapshot(content string) ([]protocol.JumpItem, string) {
+	jl.mutex.Lock()
+	defer jl.mutex.Unlock()
+	
+	items := jl.itemsLocked(content)
+	if index := jl.currentIndexLocked(items, content); index >= 0 {
+		return items, items[index].ID
+	}
+	return items, ""
+}
+
+// Load replaces the list with the host's
+func (jl *JumpList) Load(items []protocol.JumpItem, current string, content string) {
+	jl.mutex.Lock()
+	defer jl.mutex.Unlock()
+	
+	jl.entries = make([]*jumpEntry, 0, len(items))
+	jl.current, jl.anchor = "", nil
+	for _, item := range items {
+		entry := &jumpEntry{
+			id:       item.ID,
+			kind:     item.Kind,
+			file:     item.File,
+			line:     item.Line,
+			column:   item.Column,
+			severity: item.Severity,
+			source:   item.Source,
+			message:  item.Message,
+			users:    item.Users,
+		}
+		if entry.file == "" {
+			entry.offset = offsetOf(content, item.Line, item.Column)
+		}
+		jl.entries = append(jl.entries, entry)
+		if item.ID == current {
+			jl.setCurrentLocked(item)
+		}
+	}
+}
+
+// Transform moves the entries in the session's document past an edit
+func (jl *JumpList) Transform(op protocol.Operation) {
+	jl.mutex.Lock()
+	defer jl.mutex.Unlock()
+	
+	for _, entry := range jl.entries {
+		transformJumpEntry(entry, op)
+	}
+	if jl.anchor != nil {
+		transformJumpEntry(jl.anchor, op)
+	}
+}
+
+func transformJumpEntry(entry *jumpEntry, op protocol.Operation) {
+	if entry.file == "" {
+		entry.offset = transformOffset(entry.offset, op)
+	}
+}
+
+// transformOffset moves a position in the document past an edit: text
+// inserted at or before it pushes it along, and deleting text around it
+// leaves it where the deletion was
+func transformOffset(offset int, op protocol.Operation) int {
+	switch op.Type {
+	case protocol.OpInsert:
+		if offset >= op.Position {
+			return offset + len(op.Content)
+		}
+	case protocol.OpDelete:
+		if offset >= op.Position+op.Length {
+			return offset - op.Length
+		}
+		if offset > op.Position {
+			return op.Position
+		}
+	case protocol.OpReplace:
+		return min(offset, len(op.Content))
+	}
+	return offset
+}
+
+func (jl *JumpList) Reset() {
+	jl.mutex.Lock()
+	defer jl.mutex.Unlock()
+	jl.entries = nil
+	jl.current, jl.anchor = "", nil
+}
+
+// itemsLocked sorts the entries into items, merging the same diagnostic
+// shared by several peers into one item
+func (jl *JumpList) itemsLocked(content string) []protocol.JumpItem {
+	items := make([]protocol.JumpItem, 0, len(jl.entries))
+	for _, entry := range jl.entries {
+		line, column := entry.position(content)
+		items = append(items, protocol.JumpItem{
+			ID:       entry.id,
+			Kind:     entry.kind,
+			File:     entry.file,
+			Line:     line,
+			Column:   column,
+			Severity: entry.severity,
+			Source:   entry.source,
+			Message:  entry.message,
+			Users:    entry.users,
+			IDs:      []string{entry.id},
+		})
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return compareJumpItems(&items[i], &items[j]) < 0
+	})
+	
+	merged := items[:0]
+	for _, item := range items {
+		if n := len(merged); n > 0 && item.Kind == JumpDiagnostic && compareJumpItems(&merged[n-1], &item) == 0 {
+			last := &merged[n-1]
+			last.IDs = append(last.IDs, item.IDs...)
+			for _, userID := range item.Users {
+				if !containsString(last.Users, userID) {
+					last.Users = append(last.Users, userID)
+				}
+			}
+			continue
+		}
+		item.Users = append([]string{}, item.Users...)
+		merged = append(merged, item)
+	}
+	return merged
+}
+
+// compareJumpItems orders items by file and position, then errors before
+// warnings before comments
+func compareJumpItems(a, b *protocol.JumpItem) int {
+	if c := strings.Compare(a.File, b.File); c != 0 {
+		return c
+	}
+	if a.Line != b.Line {
+		return a.Line - b.Line
+	}
+	if a.Column != b.Column {
+		return a.Column - b.Column
+	}
+	if a.Kind != b.Kind {
+		if a.Kind == JumpDiagnostic {
+			return -1
+		}
+		return 1
+	}
+	if a.Severity != b.Severity {
+		return a.Severity - b.Severity
+	}
+	if c := strings.Compare(a.Source, b.Source); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Message, b.Message)
+}
+
+// currentIndexLocked finds the current item. When it is gone, such as a
+// diagnostic that was fixed, the walk carries on from the next item after
+// where it was.
+func (jl *JumpList) currentIndexLocked(items []protocol.JumpItem, content string) int {
+	if jl.current == "" {
+		return -1
+	}
+	for i, item := range items {
+		if containsString(item.IDs, jl.current) {
+			return i
+		}
+	}
+	
+	jl.current = ""
+	if jl.anchor == nil {
+		return -1
+	}
+	line, column := jl.anchor.position(content)
+	for i, item := range items {
+		if item.File > jl.anchor.file || (item.File == jl.anchor.file && (item.Line > line || (item.Line == line && item.Column >= column))) {
+			jl.setCurrentLocked(item)
+			return i
+		}
+	}
+	jl.anchor = nil
+	return -1
+}
+
+func (jl *JumpList) setCurrentLocked(item protocol.JumpItem) {
+	jl.current = item.ID
+	jl.anchor = &jumpEntry{file: item.File, line: item.Line, column: item.Column}
+	for _, entry := range jl.entries {
+		if entry.id == item.ID && entry.file == "" {
+			jl.anchor.offset = entry.offset
+		}
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// offsetOf returns the byte offset of a 0-based line and byte column,
+// clamped to the content
+func offsetOf(content string, line, column int) int {
+	offset := 0
+	for ; line > 0; line-- {
+		next := strings.IndexByte(content[offset:], '\n')
+		if next < 0 {
+			return len(content)
+		}
+		offset += next + 1
+	}
+	end := strings.IndexByte(content[offset:], '\n')
+	if end < 0 {
+		end = len(content) - offset
+	}
+	return offset + max(0, min(column, end))
+}
+
+// lineColumnOf returns the 0-based line and byte column of an offset
+func lineColumnOf(content string, offset int) (int, int) {
+	offset = max(0, min(offset, len(content)))
+	line := strings.Count(content[:offset], "\n")
+	return line, offset - (strings.LastIndexByte(content[:offset], '\n') + 1)
+}
+
+// sharedFile checks a file named in a request, "" standing for the session's
+// document
+func sharedFile(session *session.Session, file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	if !session.Project {
+		return "", fmt.Errorf("only project sessions share other files")
+	}
+	file, err := cleanRemotePath(file)
+	if err != nil || file == session.FilePath {
+		return "", err
+	}
+	return file, nil
+}
+
+// handleJumpListRequest changes the jump list. The host's requests apply
+// directly; members' go to the host, and the list it sends back is their
+// answer.
+func (cm *CollabManager) handleJumpListRequest(msg *protocol.Message) *protocol.Message {
+	if cm.sessionManager.GetCurrentSession() == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	
+	info := "Sent to the host"
+	if cm.hostSession() == nil {
+		if err := cm.broadcastToPeers(msg.Type, msg.Data); err != nil {
+			return createErrorMessage("jump_list_failed", err.Error())
+		}
+	} else {
+		var err error
+		if info, err = cm.updateJumpList(cm.sessionManager.GetUserID(), msg); err != nil {
+			return createErrorMessage("jump_list_failed", err.Error())
+		}
+	}
+	
+	// Diagnostics are shared whenever they change, so they go unanswered
+	// like cursor moves
+	if msg.Type == protocol.MsgShareDiagnostics {
+		return nil
+	}
+	return createStatusMessage("jump_list_updated", info)
+}
+
+// updateJumpList applies a peer's request to the host's list and sends the
+// list to everyone if it changed
+func (cm *CollabManager) updateJumpList(userID string, msg *protocol.Message) (string, error) {
+	session := cm.hostSession()
+	if session == nil {
+		return "", fmt.Errorf("only the host keeps the jump list")
+	}
+	content := cm.syncManager.GetDocumentContent()
+	
+	var info, movedBy string
+	switch msg.Type {
+	case protocol.MsgShareDiagnostics:
+		var req protocol.ShareDiagnosticsRequest
+		if err := msg.ParseData(&req); err != nil {
+			return "", err
+		}
+		file, err := sharedFile(session, req.File)
+		if err != nil {
+			return "", err
+		}
+		if len(req.Diagnostics) > maxSharedDiagnostics {
+			return "", fmt.Errorf("at most %d diagnostics can be shared per file", maxSharedDiagnostics)
+		}
+		for _, diagnostic := range req.Diagnostics {
+			if diagnostic.Severity < 1 || diagnostic.Severity > 4 {
+				return "", fmt.Errorf("severity must be 1 (error) to 4 (hint)")
+			}
+			if diagnostic.Line < 0 || diagnostic.Column < 0 || diagnostic.Message == "" {
+				return "", fmt.Errorf("diagnostics need a position and a message")
+			}
+		}
+		if !cm.jumpList.SetDiagnostics(userID, file, req.Diagnostics, content) {
+			return "", nil
+		}
+		info = fmt.Sprintf("%d diagnostics shared", len(req.Diagnostics))
+	
+	case protocol.MsgAddComment:
+		var req protocol.AddCommentRequest
+		if err := msg.ParseData(&req); err != nil {
+			return "", err
+		}
+		file, err := sharedFile(session, req.File)
+		if err != nil {
+			return "", err
+		}
+		if strings.TrimSpace(req.Text) == "" || req.Line < 0 || req.Column < 0 {
+			return "", fmt.Errorf("comments need a position and text")
+		}
+		info = cm.jumpList.AddComment(userID, file, req.Line, req.Column, req.Text, content)
+	
+	case protocol.MsgRemoveJumpItem:
+		var req protocol.RemoveJumpItemRequest
+		if err := msg.ParseData(&req); err != nil {
+			return "", err
+		}
+		if err := cm.jumpList.RemoveComment(req.ID, userID, userID == session.CreatedBy); err != nil {
+			return "", err
+		}
+		info = "Removed " + req.ID
+	
+	case protocol.MsgJumpTo:
+		var req protocol.JumpToRequest
+		if err := msg.ParseData(&req); err != nil {
+			return "", err
+		}
+		if err := cm.jumpList.Move(req.ID, req.Step, content); err != nil {
+			return "", err
+		}
+		movedBy = userID
+	
+	default:
+		return "", fmt.Errorf("unexpected %s", msg.Type)
+	}
+	
+	cm.sendJumpList(movedBy)
+	return info, nil
+}
+
+// handlePeerJumpListRequest applies a member's request on the host
+func (cm *CollabManager) handlePeerJumpListRequest(userID string, msg *protocol.Message) {
+	if cm.hostSession() == nil {
+		return
+	}
+	if _, err := cm.updateJumpList(userID, msg); err != nil {
+		log.Printf("Ignoring %s from %s: %v", msg.Type, userID, err)
+	}
+}
+
+// handlePeerJumpList takes over the list the host sent
+func (cm *CollabManager) handlePeerJumpList(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy != userID {
+		return
+	}
+	var event protocol.JumpListEvent
+	if err := msg.ParseData(&event); err != nil {
+		return
+	}
+	cm.jumpList.Load(event.Items, event.Current, cm.syncManager.GetDocumentContent())
+	cm.sendJumpListEvent(cm.jumpListEvent(event.MovedBy))
+}
+
+func (cm *CollabManager) handleGetJumpList() *protocol.Message {
+	if cm.sessionManager.GetCurrentSession() == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgJumpList, cm.jumpListEvent(""))
+	return msg
+}
+
+// handleSubscribeJumpList turns jump_list events to Neovim on or off,
+// answering a subscription with the list as it is
+func (cm *CollabManager) handleSubscribeJumpList(req *protocol.SubscribeJumpListRequest) *protocol.Message {
+	cm.jumpListSubscribed.Store(req.Subscribe)
+	if !req.Subscribe {
+		return createStatusMessage("jump_list_unsubscribed", "")
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgJumpList, cm.jumpListEvent(""))
+	return msg
+}
+
+func (cm *CollabManager) jumpListEvent(movedBy string) protocol.JumpListEvent {
+	items, current := cm.jumpList.Snapshot(cm.syncManager.GetDocumentContent())
+	return protocol.JumpListEvent{Items: items, Current: current, MovedBy: movedBy}
+}
+
+// sendJumpList sends the host's list to every member and to its own Neovim
+func (cm *CollabManager) sendJumpList(movedBy string) {
+	event := cm.jumpListEvent(movedBy)
+	if err := cm.broadcastToPeers(protocol.MsgJumpList, event); err != nil {
+		log.Printf("Failed to send jump list: %v", err)
+	}
+	cm.sendJumpListEvent(event)
+}
+
+// sendJumpListEvent sends Neovim the list if it subscribed to it
+func (cm *CollabManager) sendJumpListEvent(event protocol.JumpListEvent) {
+	if !cm.jumpListSubscribed.Load() {
+		return
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgJumpList, event)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send jump list: %v", err)
+	}
+}
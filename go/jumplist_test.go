@@ -0,0 +1,23 @@
+package collab
+
+import (
+	"testing"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+func TestPeerLeavingWithDiagnosticsUpdatesJumpList(t *testing.T) {
+	cm, session := newTestManager(t)
+	addTestPeer(t, cm, session, "bob")
+	addTestPeer(t, cm, session, "carol")
+	cm.jumpList.SetDiagnostics("bob", "", []protocol.SharedDiagnostic{{Line: 1, Message: "unused import"}}, session.Content)
+	cm.jumpList.AddComment("bob", "", 1, 0, "why main?", session.Content)
+	
+	disconnectWithin(t, cm, "bob", 5*time.Second)
+	
+	items, _ := cm.jumpList.Snapshot(session.Content)
+	if len(items) != 1 || items[0].Kind != JumpComment {
+		t.Errorf("jump list after bob left = %+v, want only his comment", items)
+	}
+}
@@ -0,0 +1,275 @@
+package collab
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Local edits are timed from being sent until every peer acknowledged them:
+// a peer that receives operations answers the sender with operation_ack
+// naming their IDs, through the server in server mode. get_metrics reports
+// percentiles of the latest maxLatencySamples times. When the 90th
+// percentile of the last latencyWindow, or an edit still waiting on a peer,
+// goes past sync_budget_ms, Neovim gets a sync_degraded event, and another
+// once edits are back within it. Peers that never acknowledged an edit, as
+// older versions don't, aren't waited for.
+const (
+	maxLatencySamples    = 256
+	maxPendingAcks       = 4096
+	latencyWindow        = 30 * time.Second
+	latencyCheckInterval = time.Second
+	
+	// Edits unacknowledged this long are given up on, not counted
+	maxAckWait = time.Minute
+)
+
+type pendingAck struct {
+	sentAt  time.Time
+	waiting map[string]bool
+}
+
+type latencySample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// LatencyTracker times local edits until every peer acknowledged them
+type LatencyTracker struct {
+	budget   time.Duration
+	pending  map[string]*pendingAck
+	ackers   map[string]bool // peers known to acknowledge edits
+	samples  []latencySample // ring of the latest samples
+	next     int
+	degraded bool
+	mutex    sync.Mutex
+}
+
+func NewLatencyTracker(budget time.Duration) *LatencyTracker {
+	return &LatencyTracker{
+		budget:  budget,
+		pending: make(map[string]*pendingAck),
+		ackers:  make(map[string]bool),
+	}
+}
+
+// SetBudget changes the latency past which sync counts as degraded, 0 to
+// never tell
+func (lt *LatencyTracker) SetBudget(budget time.Duration) {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	lt.budget = budget
+}
+
+// Sent starts timing ops, sent to peers
+func (lt *LatencyTracker) Sent(ops []protocol.Operation, peers []string, now time.Time) {
+	if len(peers) == 0 {
+		return
+	}
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	for _, op := range ops {
+		if op.ID == "" || len(lt.pending) >= maxPendingAcks {
+			continue
+		}
+		waiting := make(map[string]bool, len(peers))
+		for _, userID := range peers {
+			waiting[userID] = true
+		}
+		lt.pending[op.ID] = &pendingAck{sentAt: now, waiting: waiting}
+	}
+}
+
+// Acked records that userID received the operations ids
+func (lt *LatencyTracker) Acked(userID string, ids []string, now time.Time) {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	lt.ackers[userID] = true
+	for _, id := range ids {
+		pending, ok := lt.pending[id]
+		if !ok || !pending.waiting[userID] {
+			continue
+		}
+		delete(pending.waiting, userID)
+		if !lt.waitingOnAcker(pending) {
+			lt.record(now.Sub(pending.sentAt), now)
+			delete(lt.pending, id)
+		}
+	}
+}
+
+// waitingOnAcker reports whether an edit still waits on a peer known to
+// acknowledge edits. Caller holds mutex.
+func (lt *LatencyTracker) waitingOnAcker(pending *pendingAck) bool {
+	for userID := range pending.waiting {
+		if lt.ackers[userID] {
+			return true
+		}
+	}
+	return false
+}
+
+// record adds a sample. Caller holds mutex.
+func (lt *LatencyTracker) record(latency time.Duration, now time.Time) {
+	sample := latencySample{at: now, latency: latency}
+	if len(lt.samples) < maxLatencySamples {
+		lt.samples = append(lt.samples, sample)
+		return
+	}
+	lt.samples[lt.next] = sample
+	lt.next = (lt.next + 1) % maxLatencySamples
+}
+
+// Forget stops waiting on a peer, e.g. when it leaves
+func (lt *LatencyTracker) Forget(userID string) {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	delete(lt.ackers, userID)
+	for id, pending := range lt.pending {
+		delete(pending.waiting, userID)
+		if len(pending.waiting) == 0 {
+			delete(lt.pending, id)
+		}
+	}
+}
+
+// Reset drops the edits in flight, e.g. on leaving a session. Samples are
+// kept for get_metrics.
+func (lt *LatencyTracker) Reset() {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	lt.pending = make(map[string]*pendingAck)
+	lt.ackers = make(map[string]bool)
+}
+
+// percentile returns the pth percentile of sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+// Report returns the percentiles of the latest samples
+func (lt *LatencyTracker) Report() protocol.OperationLatency {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	
+	latencies := make([]time.Duration, len(lt.samples))
+	for i, sample := range lt.samples {
+		latencies[i] = sample.latency
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return protocol.OperationLatency{
+		Samples:  len(latencies),
+		P50MS:    percentile(latencies, 50).Milliseconds(),
+		P90MS:    percentile(latencies, 90).Milliseconds(),
+		P99MS:    percentile(latencies, 99).Milliseconds(),
+		MaxMS:    percentile(latencies, 100).Milliseconds(),
+		Pending:  len(lt.pending),
+		BudgetMS: lt.budget.Milliseconds(),
+		Degraded: lt.degraded,
+	}
+}
+
+// Check gives up on edits waiting too long and tells whether sync became
+// degraded or recovered since the last check
+func (lt *LatencyTracker) Check(now time.Time) (protocol.SyncDegradedEvent, bool) {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	
+	overdue := make(map[string]bool)
+	for id, pending := range lt.pending {
+		// Edits only waiting on peers that may never acknowledge them go
+		// sooner, so they don't crowd out the rest
+		age := now.Sub(pending.sentAt)
+		if age > maxAckWait || (age > latencyWindow && !lt.waitingOnAcker(pending)) {
+			delete(lt.pending, id)
+			continue
+		}
+		if lt.budget > 0 && age > lt.budget {
+			for userID := range pending.waiting {
+				if lt.ackers[userID] {
+					overdue[userID] = true
+				}
+			}
+		}
+	}
+	
+	var recent []time.Duration
+	for _, sample := range lt.samples {
+		if now.Sub(sample.at) <= latencyWindow {
+			recent = append(recent, sample.latency)
+		}
+	}
+	sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+	p90 := percentile(recent, 90)
+	
+	degraded := lt.budget > 0 && (p90 > lt.budget || len(overdue) > 0)
+	if degraded == lt.degraded {
+		return protocol.SyncDegradedEvent{}, false
+	}
+	lt.degraded = degraded
+	
+	event := protocol.SyncDegradedEvent{
+		Degraded: degraded,
+		P90MS:    p90.Milliseconds(),
+		BudgetMS: lt.budget.Milliseconds(),
+		Waiting:  []string{},
+	}
+	for userID := range overdue {
+		event.Waiting = append(event.Waiting, userID)
+	}
+	sort.Strings(event.Waiting)
+	return event, true
+}
+
+// runLatencyChecks tells Neovim when sync degrades or recovers until stop
+// is closed
+func (cm *CollabManager) runLatencyChecks(stop <-chan struct{}) {
+	ticker := time.NewTicker(latencyCheckInterval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			event, changed := cm.latency.Check(time.Now())
+			if !changed {
+				continue
+			}
+			if event.Degraded {
+				log.Printf("Sync degraded: edits take %dms to reach peers (budget %dms), waiting on %v", event.P90MS, event.BudgetMS, event.Waiting)
+			}
+			if err := cm.sendEvent(protocol.MsgSyncDegraded, event); err != nil {
+				log.Printf("Failed to send sync degraded: %v", err)
+			}
+		}
+	}
+}
+
+// ackOperations tells the peer that sent ops they arrived
+func (cm *CollabManager) ackOperations(userID string, ops []protocol.Operation) {
+	ids := make([]string, 0, len(ops))
+	for _, op := range ops {
+		if op.ID != "" {
+			ids = append(ids, op.ID)
+		}
+	}
+	if len(ids) > 0 && userID != protocol.ServerUserID {
+		cm.sendToPeer(userID, protocol.MsgOperationAck, protocol.OperationAckMessage{IDs: ids})
+	}
+}
+
+// handlePeerOperationAck records a peer's acknowledgment of local edits
+func (cm *CollabManager) handlePeerOperationAck(userID string, msg *protocol.Message) {
+	var ack protocol.OperationAckMessage
+	if userID == protocol.ServerUserID || msg.ParseData(&ack) != nil {
+		return
+	}
+	cm.latency.Acked(userID, ack.IDs, time.Now())
+}
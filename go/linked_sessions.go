@@ -0,0 +1,353 @@
+package collab
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// The host of a session on the central server can share its document into
+// other sessions, such as a mentor's into each of several students'. The
+// other session's host accepts with accept_session_link; its document is
+// then changed to match by edits its members apply like any other, and from
+// then on an edit in any linked session reaches all of them, in one order.
+// Rosters, chat, cursors, control and rules stay within each session.
+// Either host can unlink a session, which keeps a copy of the document as it
+// was; unlinking the source ends the link for everyone. Sessions on other
+// instances of a cluster can't be linked.
+const maxLinkedSessions = 16
+
+// sessionLink is sessions sharing one document: the source's, which the
+// others took over when they were linked
+type sessionLink struct {
+	source *serverSession
+	rooms  []*serverSession // in order of session ID, the source included
+	sync   *collabsync.SyncManager
+}
+
+func (link *sessionLink) ids() []string {
+	ids := []string{link.source.session.ID}
+	for _, room := range link.rooms {
+		if room != link.source {
+			ids = append(ids, room.session.ID)
+		}
+	}
+	return ids
+}
+
+// linkedRooms returns room and every session linked with it, in order of
+// session ID
+func (cs *CollabServer) linkedRooms(rooms ...*serverSession) []*serverSession {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	
+	seen := make(map[*serverSession]bool)
+	var linked []*serverSession
+	for _, room := range rooms {
+		group := []*serverSession{room}
+		if room.link != nil {
+			group = room.link.rooms
+		}
+		for _, r := range group {
+			if !seen[r] {
+				seen[r] = true
+				linked = append(linked, r)
+			}
+		}
+	}
+	sort.Slice(linked, func(i, j int) bool { return linked[i].session.ID < linked[j].session.ID })
+	return linked
+}
+
+// lockLinked locks rooms and every session linked with them, in order of
+// session ID so that two callers never wait on each other. A link only
+// changes under the locks of every session it involves, so once they are
+// held it stays as it was.
+func (cs *CollabServer) lockLinked(rooms ...*serverSession) []*serverSession {
+	for {
+		locked := cs.linkedRooms(rooms...)
+		for _, room := range locked {
+			room.mutex.Lock()
+		}
+		current := cs.linkedRooms(rooms...)
+		if len(current) == len(locked) {
+			same := true
+			for i := range current {
+				same = same && current[i] == locked[i]
+			}
+			if same {
+				return locked
+			}
+		}
+		unlockRooms(locked)
+	}
+}
+
+func unlockRooms(rooms []*serverSession) {
+	for i := len(rooms) - 1; i >= 0; i-- {
+		rooms[i].mutex.Unlock()
+	}
+}
+
+// relayLinked passes operations applied in room on to the sessions linked
+// with it. Caller holds every room's mutex.
+func (cs *CollabServer) relayLinked(rooms []*serverSession, room *serverSession, member *serverMember, ops []protocol.Operation, msg *protocol.Message) {
+	for _, other := range rooms {
+		if other == room {
+			continue
+		}
+		for _, op := range ops {
+			other.rules.Transform(op)
+			stored := op
+			stored.UserID = member.actor
+			persist("append operation", cs.store.AppendOperation(other.session.ID, stored))
+		}
+		cs.broadcast(other, member.peer.UserID, msg, "")
+	}
+}
+
+// handleLinkRequest acts on a host's link_session, accept_session_link or
+// unlink_session, telling them when it can't
+func (cs *CollabServer) handleLinkRequest(room *serverSession, member *serverMember, msg *protocol.Message) {
+	room.mutex.Lock()
+	host := room.members[member.peer.UserID] == member && member.peer.UserID == room.session.CreatedBy
+	room.mutex.Unlock()
+	var req protocol.SessionLinkRequest
+	if !host || msg.ParseData(&req) != nil {
+		return
+	}
+	
+	var err error
+	switch msg.Type {
+	case protocol.MsgLinkSession:
+		err = cs.offerLink(room, member, req.SessionID)
+	case protocol.MsgAcceptSessionLink:
+		err = cs.acceptLink(room, req.SessionID)
+	case protocol.MsgUnlinkSession:
+		err = cs.unlinkFrom(room, req.SessionID)
+	}
+	if err != nil {
+		refusal, _ := protocol.NewMessage(protocol.MsgSessionLinks, protocol.SessionLinksEvent{Sessions: []string{}, Error: err.Error()})
+		data, _ := refusal.ToJSON()
+		if err := member.send(protocol.ServerEnvelope{Data: data}); err != nil {
+			log.Printf("Failed to relay to %s: %v", member.peer.UserID, err)
+		}
+	}
+}
+
+// offerLink records that room's host offered to share its document into
+// another session, and tells that session's host
+func (cs *CollabServer) offerLink(room *serverSession, member *serverMember, target string) error {
+	cs.mutex.Lock()
+	other, ok := cs.sessions[target]
+	switch {
+	case !ok:
+		cs.mutex.Unlock()
+		return fmt.Errorf("no session %s on this server", target)
+	case other == room:
+		cs.mutex.Unlock()
+		return fmt.Errorf("a session can't be linked with itself")
+	case room.link != nil && room.link.source != room:
+		cs.mutex.Unlock()
+		return fmt.Errorf("only %s can share the document it shares", room.link.source.session.ID)
+	case other.link != nil:
+		cs.mutex.Unlock()
+		return fmt.Errorf("session %s is already linked", target)
+	}
+	cs.linkOffers[target] = room.session.ID
+	cs.mutex.Unlock()
+	
+	offer, _ := protocol.NewMessage(protocol.MsgSessionLinkOffered, protocol.SessionLinkOfferedEvent{
+		SessionID: room.session.ID,
+		FilePath:  room.session.FilePath,
+		Host:      member.peer.Name,
+	})
+	data, _ := offer.ToJSON()
+	other.mutex.Lock()
+	host, ok := other.members[other.session.CreatedBy]
+	other.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("the host of %s isn't connected", target)
+	}
+	if err := host.send(protocol.ServerEnvelope{Data: data}); err != nil {
+		return fmt.Errorf("failed to reach the host of %s: %v", target, err)
+	}
+	persist("record audit", cs.store.AppendAudit(room.session.ID, member.actor, "offer_link", target))
+	return nil
+}
+
+// acceptLink links room with the session that offered to share its
+// document. Room's members get the edits that turn their document into it.
+func (cs *CollabServer) acceptLink(room *serverSession, sourceID string) error {
+	cs.mutex.Lock()
+	source, ok := cs.sessions[sourceID]
+	offered := cs.linkOffers[room.session.ID] == sourceID
+	cs.mutex.Unlock()
+	if !ok || !offered {
+		return fmt.Errorf("session %s hasn't offered a link", sourceID)
+	}
+	
+	rooms := cs.lockLinked(source, room)
+	defer unlockRooms(rooms)
+	
+	cs.mutex.Lock()
+	var err error
+	switch {
+	case source.closed || room.closed:
+		err = fmt.Errorf("session %s has ended", sourceID)
+	case source.link != nil && source.link.source != source, room.link != nil:
+		err = fmt.Errorf("session %s is already linked", sourceID)
+	case source.session.Mode != collabsync.ContentModeText || room.session.Mode != collabsync.ContentModeText:
+		err = fmt.Errorf("only text documents can be linked")
+	case len(rooms) > maxLinkedSessions:
+		err = fmt.Errorf("at most %d sessions can be linked", maxLinkedSessions)
+	}
+	if err != nil {
+		cs.mutex.Unlock()
+		return err
+	}
+	delete(cs.linkOffers, room.session.ID)
+	cs.mutex.Unlock()
+	
+	// Members catch up as they would with anyone's edits
+	var ops []protocol.Operation
+	for _, diffOp := range collabsync.DiffOperations(room.sync.GetDocumentContent(), source.sync.GetDocumentContent()) {
+		var op protocol.Operation
+		if diffOp.Type == protocol.OpInsert {
+			op = room.sync.CreateInsertOperation(diffOp.Position, diffOp.Content)
+		} else {
+			op = room.sync.CreateDeleteOperation(diffOp.Position, diffOp.Length)
+		}
+		room.rules.Transform(op)
+		persist("append operation", cs.store.AppendOperation(room.session.ID, op))
+		ops = append(ops, op)
+	}
+	if len(ops) > 0 {
+		catchUp, _ := protocol.NewMessage(protocol.MsgDocumentOperations, protocol.OperationBatch{Operations: ops})
+		cs.broadcast(room, "", catchUp, "")
+	}
+	
+	cs.mutex.Lock()
+	link := source.link
+	if link == nil {
+		link = &sessionLink{source: source, rooms: []*serverSession{source}, sync: source.sync}
+		source.link = link
+	}
+	room.sync.Close()
+	room.sync = link.sync
+	room.link = link
+	link.rooms = append(link.rooms, room)
+	sort.Slice(link.rooms, func(i, j int) bool { return link.rooms[i].session.ID < link.rooms[j].session.ID })
+	event := protocol.SessionLinksEvent{Source: source.session.ID, Sessions: link.ids()}
+	cs.mutex.Unlock()
+	
+	announce, _ := protocol.NewMessage(protocol.MsgSessionLinks, event)
+	for _, r := range link.rooms {
+		cs.broadcast(r, "", announce, "")
+	}
+	log.Printf("Linked session %s with %s", room.session.ID, sourceID)
+	persist("record audit", cs.store.AppendAudit(room.session.ID, room.session.CreatedBy, "accept_link", sourceID))
+	return nil
+}
+
+// unlinkFrom unlinks room, or as the source of its link one of the
+// sessions linked with it
+func (cs *CollabServer) unlinkFrom(room *serverSession, target string) error {
+	if target == "" || target == room.session.ID {
+		if !cs.unlink(room) {
+			return fmt.Errorf("session %s isn't linked", room.session.ID)
+		}
+		return nil
+	}
+	
+	cs.mutex.Lock()
+	other, ok := cs.sessions[target]
+	allowed := ok && room.link != nil && room.link.source == room && other.link == room.link
+	cs.mutex.Unlock()
+	if !allowed {
+		return fmt.Errorf("session %s isn't linked with this one", target)
+	}
+	cs.unlink(other)
+	return nil
+}
+
+// unlink takes room out of its link, with its own copy of the document as
+// it is now. The source leaving ends the link, as does only one session
+// being left in it. Reports whether room was linked.
+func (cs *CollabServer) unlink(room *serverSession) bool {
+	rooms := cs.lockLinked(room)
+	defer unlockRooms(rooms)
+	
+	cs.mutex.Lock()
+	link := room.link
+	if link == nil {
+		cs.mutex.Unlock()
+		return false
+	}
+	var remaining []*serverSession
+	if room != link.source {
+		for _, r := range link.rooms {
+			if r != room {
+				remaining = append(remaining, r)
+			}
+		}
+	}
+	if len(remaining) == 1 {
+		remaining = nil
+	}
+	link.rooms = remaining
+	
+	content := link.sync.GetDocumentContent()
+	events := make(map[*serverSession]protocol.SessionLinksEvent, len(rooms))
+	for _, r := range rooms {
+		if r.link == link && len(remaining) > 0 && r != room {
+			events[r] = protocol.SessionLinksEvent{Source: link.source.session.ID, Sessions: link.ids()}
+			continue
+		}
+		r.link = nil
+		if r != link.source {
+			r.sync = newServerDocument(r.session, content)
+		}
+		events[r] = protocol.SessionLinksEvent{Sessions: []string{}}
+	}
+	cs.mutex.Unlock()
+	
+	for r, event := range events {
+		announce, _ := protocol.NewMessage(protocol.MsgSessionLinks, event)
+		cs.broadcast(r, "", announce, "")
+	}
+	log.Printf("Unlinked session %s", room.session.ID)
+	persist("record audit", cs.store.AppendAudit(room.session.ID, room.session.CreatedBy, "unlink", link.source.session.ID))
+	return true
+}
+
+// handleSessionLink passes the host's link_session, accept_session_link or
+// unlink_session on to the server, which answers with session_links
+func (cm *CollabManager) handleSessionLink(msgType string, req *protocol.SessionLinkRequest) *protocol.Message {
+	if cm.hostSession() == nil {
+		return createErrorMessage(msgType+"_failed", "Only the host can link sessions")
+	}
+	if !cm.p2pManager.ServerMode() {
+		return createErrorMessage(msgType+"_failed", "Sessions can only be linked on a central server")
+	}
+	if msgType != protocol.MsgUnlinkSession && req.SessionID == "" {
+		return createErrorMessage(msgType+"_failed", "session_id is required")
+	}
+	if err := cm.broadcastToPeers(msgType, req); err != nil {
+		return createErrorMessage(msgType+"_failed", err.Error())
+	}
+	return createStatusMessage(msgType, "Sent to the server")
+}
+
+// handleServerSessionLink passes on a link offer or the sessions now linked
+func (cm *CollabManager) handleServerSessionLink(userID string, msg *protocol.Message) {
+	if userID != protocol.ServerUserID || cm.sessionManager.GetCurrentSession() == nil {
+		return
+	}
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send %s: %v", msg.Type, err)
+	}
+}
@@ -0,0 +1,25 @@
+package collab
+
+import (
+	"log"
+
+	"github.com/EmreDay1/collab.nvim/go/p2p"
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// applySyncProfile paces the local user's presence for the slowest peer and
+// tells Neovim how the session is adapting
+func (cm *CollabManager) applySyncProfile(profile p2p.SyncProfile, links []protocol.LinkQuality) {
+	log.Printf("Sync profile is now %s", profile.Name)
+	cm.presenceEncoder.SetInterval(profile.PresenceInterval)
+	
+	err := cm.sendEvent(protocol.MsgSyncProfile, protocol.SyncProfileEvent{
+		Profile:            profile.Name,
+		PresenceIntervalMS: profile.PresenceInterval.Milliseconds(),
+		CompressAbove:      profile.CompressAbove,
+		Links:              links,
+	})
+	if err != nil {
+		log.Printf("Failed to send sync profile: %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package collab
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Neovim and the backend exchange keepalives so each notices when the other
+// restarted or stopped responding. Every process start takes the next
+// generation number and announces it with a hello event. Neovim sends a
+// keepalive every few seconds carrying its own generation and the last one
+// it saw from the backend. A backend seeing an older generation there knows
+// it replaced a process that crashed while in a session: a host's session is
+// restored from the checkpoint written while it ran, anyone else is asked to
+// join again instead of silently starting out empty.
+const (
+	keepaliveInterval = 5 * time.Second
+	keepaliveTimeout  = 3 * keepaliveInterval
+	
+	generationFile = "generation"
+	checkpointFile = "checkpoint.json"
+)
+
+// liveness is the backend's side of the keepalive protocol
+type liveness struct {
+	generation     uint64
+	peerGeneration uint64 // Neovim's, 0 before the first keepalive
+	lastKeepalive  time.Time
+	silent         bool   // Neovim missed keepalives and was reported
+	recovered      bool   // the restart handshake already ran
+	checkpointed   string // session and document version last saved
+	shared         bool   // several Neovims attach through the daemon
+	watch          sync.Once
+	mutex          sync.Mutex
+}
+
+// nextGeneration takes the generation after the one recorded in dir. Without
+// a usable dir the clock stands in, which still only ever grows.
+func nextGeneration(dir string) uint64 {
+	fallback := uint64(time.Now().Unix())
+	if dir == "" {
+		return fallback
+	}
+	path := filepath.Join(dir, generationFile)
+	
+	var generation uint64
+	if data, err := os.ReadFile(path); err == nil {
+		generation, _ = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	}
+	generation++
+	
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("Failed to record generation: %v", err)
+		return fallback
+	}
+	if err := os.WriteFile(path, []byte(strconv.FormatUint(generation, 10)), 0600); err != nil {
+		log.Printf("Failed to record generation: %v", err)
+		return fallback
+	}
+	return generation
+}
+
+func (cm *CollabManager) checkpointPath() string {
+	if cm.dataDir == "" {
+		return ""
+	}
+	return filepath.Join(cm.dataDir, checkpointFile)
+}
+
+// sendHello announces this process's generation to Neovim
+func (cm *CollabManager) sendHello() {
+	msg, _ := protocol.NewMessage(protocol.MsgHello, protocol.HelloEvent{Generation: cm.liveness.generation})
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send hello: %v", err)
+	}
+}
+
+// handleKeepalive answers Neovim's keepalive and runs the restart handshake
+// the first time one shows that this process replaced another
+func (cm *CollabManager) handleKeepalive(id json.RawMessage, req *protocol.KeepaliveMessage) *protocol.Message {
+	lv := &cm.liveness
+	lv.mutex.Lock()
+	if lv.peerGeneration != 0 && req.Generation != lv.peerGeneration && !lv.shared {
+		log.Printf("Neovim side restarted (generation %d, was %d)", req.Generation, lv.peerGeneration)
+	}
+	if lv.silent {
+		log.Printf("Neovim is responding again")
+	}
+	lv.peerGeneration = req.Generation
+	lv.lastKeepalive = time.Now()
+	lv.silent = false
+	restarted := !lv.recovered && req.PeerGeneration != 0 && req.PeerGeneration != lv.generation
+	if req.PeerGeneration != 0 {
+		lv.recovered = true
+	}
+	lv.mutex.Unlock()
+	
+	lv.watch.Do(func() { go cm.watchKeepalives() })
+	
+	if restarted && req.SessionID != "" && cm.sessionManager.GetCurrentSession() == nil {
+		log.Printf("Replacing generation %d, which was in session %s", req.PeerGeneration, req.SessionID)
+		return cm.resync(id, func() *protocol.Message { return cm.recoverSession(req.SessionID) })
+	}
+	cm.checkpoint()
+	
+	response := protocol.KeepaliveMessage{Generation: lv.generation, PeerGeneration: req.Generation}
+	if session := cm.sessionManager.GetCurrentSession(); session != nil {
+		response.SessionID = session.ID
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgKeepalive, response)
+	return msg
+}
+
+// recoverSession restores the session a crashed predecessor hosted from its
+// checkpoint, or asks Neovim to join again
+func (cm *CollabManager) recoverSession(sessionID string) *protocol.Message {
+	reason := "the backend restarted without a checkpoint of the session"
+	if path := cm.checkpointPath(); path != "" {
+		if state, err := readSessionState(path); err == nil && state.SessionID == sessionID {
+			response := cm.handleImportSessionState(&protocol.ImportSessionStateRequest{Path: path})
+			if response.Type != protocol.MsgError {
+				log.Printf("Restored session %s from checkpoint", sessionID)
+				return response
+			}
+			reason = "restoring the checkpoint failed"
+		}
+	}
+	
+	log.Printf("Asking Neovim to rejoin session %s: %s", sessionID, reason)
+	msg, _ := protocol.NewMessage(protocol.MsgResyncRequired, protocol.ResyncRequiredEvent{SessionID: sessionID, Reason: reason})
+	return msg
+}
+
+// checkpoint saves the hosted session whenever its document has changed, so
+// a restarted backend can restore it. Only hosts checkpoint: anyone else can
+// join again.
+func (cm *CollabManager) checkpoint() {
+	path := cm.checkpointPath()
+	session := cm.sessionManager.GetCurrentSession()
+	if path == "" || session == nil || session.CreatedBy != cm.sessionManager.GetUserID() {
+		return
+	}
+	
+	key := fmt.Sprintf("%s@%d", session.ID, cm.syncManager.GetDocumentVersion())
+	cm.liveness.mutex.Lock()
+	unchanged := key == cm.liveness.checkpointed
+	cm.liveness.mutex.Unlock()
+	if unchanged {
+		return
+	}
+	
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Printf("Failed to write checkpoint: %v", err)
+		return
+	}
+	if response := cm.handleExportSessionState(&protocol.ExportSessionStateRequest{Path: path}); response.Type == protocol.MsgError {
+		log.Printf("Failed to write checkpoint")
+		return
+	}
+	cm.liveness.mutex.Lock()
+	cm.liveness.checkpointed = key
+	cm.liveness.mutex.Unlock()
+}
+
+// removeCheckpoint forgets the checkpoint once the session was left on
+// purpose
+func (cm *CollabManager) removeCheckpoint() {
+	if path := cm.checkpointPath(); path != "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove checkpoint: %v", err)
+		}
+	}
+	cm.liveness.mutex.Lock()
+	cm.liveness.checkpointed = ""
+	cm.liveness.mutex.Unlock()
+}
+
+// watchKeepalives reports when Neovim stops sending keepalives, and saves a
+// checkpoint in case it doesn't come back
+func (cm *CollabManager) watchKeepalives() {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	
+	for range ticker.C {
+		lv := &cm.liveness
+		lv.mutex.Lock()
+		missed := !lv.silent && time.Since(lv.lastKeepalive) > keepaliveTimeout
+		if missed {
+			lv.silent = true
+		}
+		lv.mutex.Unlock()
+		
+		if missed {
+			log.Printf("No keepalive from Neovim for %v", keepaliveTimeout)
+			cm.checkpoint()
+		}
+	}
+}
@@ -0,0 +1,2041 @@
+// Package collab is the engine behind the collab.nvim plugin: CollabManager
+// answers Neovim's messages and ties sessions, sync and peers together.
+package collab
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/EmreDay1/collab.nvim/go/internal/telemetry"
+	"github.com/EmreDay1/collab.nvim/go/p2p"
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// CollabManager is the collaboration engine behind one Neovim instance
+type CollabManager struct {
+	sessionManager *session.SessionManager
+	p2pManager     *p2p.P2PManager
+	syncManager    *collabsync.SyncManager
+	
+	// Encoding the local Neovim reads and writes the shared file in
+	clientCharset  string
+	
+	// Hosted relay for room codes, nil when none is configured
+	relayClient    *RelayClient
+	
+	// Sign-in with the configured identity provider, nil when none is
+	oidc           *OIDCClient
+	
+	// Where session events are posted, nil when no webhooks are configured
+	webhooks       *WebhookNotifier
+	
+	// On-disk log of the current session's operations, nil when disabled
+	opLogDir       string
+	opLog          *OpLog
+	
+	// Handling time above which a slow_operation warning is sent, 0 to disable
+	slowThreshold  time.Duration
+	
+	// Where messages for Neovim are written and in which wire format, and the
+	// categories of events it turned off
+	output          *neovimOutput
+	subscriptions   *eventSubscriptions
+	
+	// Largest message accepted from Neovim, and whether it was asked to wait
+	maxMessageBytes int
+	inputFlow       inputFlow
+	
+	// Document operations queued behind a slow one or a resync
+	opFlow          *operationFlow
+	
+	// Keepalives with Neovim and this process's generation
+	liveness        liveness
+	
+	// Memory budget in bytes, 0 when not enforced
+	memoryBudget    int64
+	memoryPressure  bool
+	lastMemoryCheck time.Time
+	
+	// How far each peer's clock is from the local one, and the clock
+	// stamping operations, kept at the host's time
+	clocks          *ClockOffsets
+	clock           *collabsync.HybridClock
+	stopClockProbes chan struct{}
+	
+	// How long local edits take to be acknowledged by every peer
+	latency         *LatencyTracker
+	stopLatency     chan struct{}
+	
+	// How far each peer has applied the document
+	frontiers       *FrontierTracker
+	stopFrontiers   chan struct{}
+	
+	// Digests of the hosted document sent to members, who compare them to
+	// catch divergence
+	desync          desyncState
+	stopDigests     chan struct{}
+	
+	// Remote peers' presence, sent to Neovim as batched deltas, and the
+	// binary frames presence travels in between peers
+	presence        *PresenceTracker
+	presenceEncoder *protocol.PresenceEncoder
+	presenceDecoder *protocol.PresenceDecoder
+	
+	// Raised hands (host only) and the timer reverting temporary control
+	hands           *HandQueue
+	
+	// Peers waiting on the local user to answer their request for control
+	controlRequests ControlRequests
+	
+	// Edits peers without control suggested to the local user
+	suggestions     *SuggestionQueue
+	
+	// Others' edits held while the local user paused sync
+	syncPause       SyncPause
+	
+	// The close_session under way, on the host or a member
+	ending          sessionEnd
+	
+	// Progress of the join under way, reported to Neovim, and the join
+	// waiting for a peer-to-peer session from its peers
+	joinProgress    joinProgress
+	joinWait        atomic.Pointer[stateWait]
+	
+	// The pretend collaborator for trying a session out alone
+	demo            demoRunner
+	controlRevert   *time.Timer
+	controlMutex    sync.Mutex
+	
+	// Breakout groups and their document forks
+	breakouts       *BreakoutManager
+	
+	// Project files opened on demand, each its own document
+	remoteFiles     *RemoteFileManager
+	transactions    *TransactionAssembler
+	
+	// Shared diagnostics and comments, and whether Neovim follows them
+	jumpList           *JumpList
+	jumpListSubscribed atomic.Bool
+	
+	// Debugger breakpoints shared by everyone in the session
+	breakpoints     *BreakpointSet
+	
+	// The host's rules for members' edits
+	rules           *RuleSet
+	
+	// The local user's private copies of the document
+	forks           *ForkSet
+	
+	// What the local client and each peer's can handle
+	capabilities    *CapabilityRoster
+	
+	// Per-user statistics of the current session
+	contributions   *ContributionTracker
+	
+	// Commands peers may ask the host to run
+	commands        *CommandRunner
+	commandOutputs  *CommandOutputs
+	
+	// Peers whose chat and cursor the local user muted
+	mutes           *PeerMutes
+	
+	// Limits on other plugins' extension messages
+	extensions      *ExtensionLimiter
+	
+	// Hooks around message handling and operations, and the built-in one
+	// limiting how fast peers may send
+	pipeline        *Pipeline
+	peerLimiter     *PeerRateLimiter
+	
+	// Whether the local user only watches the current session through the
+	// central server, and how many spectators are watching it
+	spectating      bool
+	spectators      atomic.Int64
+	
+	// Local checkout of the current project session, "" otherwise, and how
+	// much of a project is offered for sharing
+	sessionRoot   string
+	projectLimits protocol.ProjectLimits
+	
+	// Countdown of a timed session (host only) and where its results go
+	sessionClock    *SessionClock
+	dataDir         string
+	
+	// Whether leaving a session archives it under dataDir
+	archiveSessions bool
+	
+	// Writes of the hosted document to its file, when write_through is on
+	diskWriter      *diskWriter
+	
+	// Local edits held back until committed, when typing_privacy is on
+	typing          *typingBuffer
+	
+	// The config in effect, and a signal that its file changed
+	config          *Config
+	configChanged   chan struct{}
+	
+	// Work other goroutines hand to the message loop
+	loopCalls       chan func()
+}
+
+func NewCollabManager(config *Config) *CollabManager {
+	output := newNeovimOutput()
+	cm := &CollabManager{
+		output:          output,
+		subscriptions:   newEventSubscriptions(),
+		inputFlow:       inputFlow{output: output},
+		joinProgress:    joinProgress{output: output},
+		sessionManager:  session.NewSessionManager(),
+		p2pManager:      p2p.NewP2PManager(),
+		syncManager:     collabsync.NewSyncManager(),
+		clientCharset:   CharsetUTF8,
+		opLogDir:        config.OpLogDir,
+		hands:           &HandQueue{},
+		suggestions:     &SuggestionQueue{},
+		breakouts:       NewBreakoutManager(),
+		remoteFiles:     NewRemoteFileManager(),
+		transactions:    NewTransactionAssembler(),
+		jumpList:        &JumpList{},
+		breakpoints:     NewBreakpointSet(),
+		rules:           NewRuleSet(),
+		forks:           NewForkSet(),
+		capabilities:    NewCapabilityRoster(),
+		clocks:          NewClockOffsets(),
+		clock:           &collabsync.HybridClock{},
+		stopClockProbes: make(chan struct{}),
+		stopDigests:     make(chan struct{}),
+		latency:         NewLatencyTracker(time.Duration(config.SyncBudgetMS) * time.Millisecond),
+		stopLatency:     make(chan struct{}),
+		frontiers:       NewFrontierTracker(),
+		stopFrontiers:   make(chan struct{}),
+		contributions:   NewContributionTracker(),
+		extensions:      NewExtensionLimiter(config.ExtensionLimits),
+		commands:        NewCommandRunner(config.SharedCommands),
+		commandOutputs:  NewCommandOutputs(),
+		mutes:           NewPeerMutes(),
+		pipeline:        NewPipeline(),
+		peerLimiter:     NewPeerRateLimiter(config.PeerRateLimit),
+		sessionClock:    &SessionClock{},
+		dataDir:         config.dataDir(),
+		slowThreshold:   time.Duration(config.SlowOperationMS) * time.Millisecond,
+		maxMessageBytes: config.MaxMessageBytes,
+		archiveSessions: config.ArchiveSessions,
+		diskWriter:      newDiskWriter(config.WriteThrough),
+		typing:          newTypingBuffer(config.TypingPrivacy),
+		config:          config,
+		configChanged:   make(chan struct{}, 1),
+		loopCalls:       make(chan func(), 16),
+		opFlow:          newOperationFlow(output),
+		projectLimits:   config.ProjectLimits.WithDefaults(),
+	}
+	
+	cm.setMemoryBudget(config.MemoryBudgetMB)
+	cm.liveness.generation = nextGeneration(cm.dataDir)
+	
+	if config.StorePath != "" {
+		store, err := session.OpenStore(config.StorePath)
+		if err != nil {
+			log.Printf("Keeping session history in memory: %v", err)
+		} else {
+			cm.sessionManager.SetStore(store)
+		}
+	}
+	
+	logMessages, logOperations := loggingHooks()
+	validateMessages, validateOperations := validationHooks()
+	cm.pipeline.UseMessageHook(logMessages)
+	cm.pipeline.UseMessageHook(validateMessages)
+	cm.pipeline.UseMessageHook(cm.peerLimiter.Hook())
+	cm.pipeline.UseOperationHook(logOperations)
+	cm.pipeline.UseOperationHook(validateOperations)
+	cm.registerHandlers(cm.pipeline)
+	cm.registerPeerHandlers(cm.pipeline)
+	
+	// Set user ID for sync manager
+	cm.syncManager.SetUserID(cm.sessionManager.GetUserID())
+	cm.syncManager.SetOperationHooks(cm.pipeline)
+	
+	// Set up event handlers for sync manager
+	cm.syncManager.SetEventHandlers(
+		func(content string) {
+			// Document changed - could notify Neovim here
+			log.Printf("Document changed: %d chars", len(content))
+		},
+		func(op protocol.Operation) {
+			// Operation applied - could broadcast to peers here
+			log.Printf("Operation applied: %s by %s", op.Type, op.UserID)
+			cm.sessionManager.RecordOperation(op)
+			cm.contributions.Add(op)
+			cm.jumpList.Transform(op)
+			cm.breakpoints.Transform(op)
+			cm.rules.Transform(op)
+			cm.suggestions.Transform(op)
+			cm.scheduleWriteThrough()
+			if cm.opLog != nil {
+				if err := cm.opLog.Append(op); err != nil {
+					log.Printf("Failed to log operation: %v", err)
+				}
+			}
+		},
+		func(localOp, remoteOp, resolution protocol.Operation) {
+			// Conflict resolved
+			log.Printf("Conflict resolved between %s and %s", localOp.UserID, remoteOp.UserID)
+		},
+	)
+	cm.syncManager.SetConflictHeldHandler(cm.sendConflictHeld)
+	cm.syncManager.SetClock(cm.clock)
+	go cm.runClockProbes(cm.stopClockProbes)
+	go cm.runDigestBroadcasts(cm.stopDigests)
+	go cm.runLatencyChecks(cm.stopLatency)
+	go cm.runFrontiers(cm.stopFrontiers)
+	
+	cm.presenceEncoder = protocol.NewPresenceEncoder(cm.sendPresenceFrame)
+	cm.presenceDecoder = protocol.NewPresenceDecoder()
+	cm.presence = NewPresenceTracker(func(delta protocol.PresenceDelta) {
+		if err := cm.sendEvent(protocol.MsgPresenceChanged, delta); err != nil {
+			log.Printf("Failed to send presence update: %v", err)
+		}
+	}, cm.sendPeerSwitchedFile)
+	
+	// Set up P2P event handlers
+	cm.p2pManager.SetUserID(cm.sessionManager.GetUserID())
+	if err := cm.p2pManager.SetProxy(config.proxyURL()); err != nil {
+		log.Printf("Ignoring proxy configuration: %v", err)
+	}
+	cm.p2pManager.SetSSHConfig(config.SSH)
+	if err := cm.p2pManager.SetNetworkPolicy(config.NetworkPolicy); err != nil {
+		log.Printf("Ignoring network policy: %v", err)
+	}
+	cm.p2pManager.SetDisableMDNS(config.DisableMDNS)
+	if err := cm.p2pManager.SetServer(config.ServerURL, config.TLSPins); err != nil {
+		log.Printf("Ignoring server configuration: %v", err)
+	}
+	if err := cm.p2pManager.SetSignaling(config.SignalingURL, config.TLSPins); err != nil {
+		log.Printf("Ignoring signaling configuration: %v", err)
+	}
+	cm.p2pManager.SetAccessToken(config.AccessToken)
+	go cm.p2pManager.MeasureRelays()
+	
+	if config.OIDC.enabled() {
+		httpClient := newPinnedHTTPClient(cm.p2pManager.SignalingDialer(), config.TLSPins, oidcRequestTimeout)
+		cm.oidc = NewOIDCClient(config.OIDC, httpClient)
+	}
+	
+	if config.RelayURL != "" {
+		relayClient, err := NewRelayClient(config.RelayURL, cm.p2pManager.SignalingDialer(), config.TLSPins)
+		if err != nil {
+			log.Printf("Hosted relay disabled: %v", err)
+		} else {
+			relayClient.SetIDTokenSource(cm.idToken)
+			relayClient.SetAccessToken(config.AccessToken)
+			cm.relayClient = relayClient
+		}
+	}
+	if len(config.Webhooks) > 0 {
+		httpClient := newPinnedHTTPClient(cm.p2pManager.SignalingDialer(), config.TLSPins, webhookRequestTimeout)
+		cm.webhooks = NewWebhookNotifier(config.Webhooks, httpClient)
+	}
+	cm.p2pManager.SetEventHandlers(
+		func(userID string) {
+			// Peer joined
+			log.Printf("Peer joined: %s", userID)
+			cm.enforcePeerCap(userID)
+			if cm.stopDemoPeer() {
+				log.Printf("Demo peer left for %s", userID)
+			}
+			cm.presenceEncoder.Resend()
+			cm.frontiers.Resend()
+			cm.sendCapabilities(userID)
+			cm.notifyWebhooks(WebhookPeerJoined, userID)
+			if session := cm.sessionManager.GetCurrentSession(); session != nil && session.CreatedBy == userID {
+				cm.probeHostClock()
+			}
+			// In server mode members never ask the host for the session
+			if cm.hostSession() != nil && cm.p2pManager.ServerMode() {
+				cm.sendToPeer(userID, protocol.MsgJumpList, cm.jumpListEvent(""))
+				cm.sendToPeer(userID, protocol.MsgBreakpoints, cm.breakpointsEvent(""))
+				cm.sendOperationRules(userID)
+			}
+		},
+		func(userID string) {
+			// Peer left
+			log.Printf("Peer left: %s", userID)
+			cm.notifyWebhooks(WebhookPeerLeft, userID)
+			cm.presence.Remove(userID)
+			cm.presenceDecoder.Remove(userID)
+			cm.clocks.Remove(userID)
+			cm.extensions.Forget(userID)
+			cm.capabilities.Forget(userID)
+			cm.latency.Forget(userID)
+			cm.frontiers.Forget(userID)
+			cm.controlRequests.Take(userID)
+			cm.controllerLeft(userID)
+			cm.peerLimiter.Forget(userID)
+			if cm.hands.Lower(userID) {
+				cm.sendHandsChanged()
+			}
+			cm.breakouts.RemoveMember(userID)
+			cm.remoteFiles.RemoveMember(userID)
+			if cm.jumpList.RemoveUser(userID) && cm.hostSession() != nil {
+				cm.sendJumpList("")
+			}
+		},
+		func(userID string, data []byte) {
+			// Message received from peer
+			log.Printf("Message from %s: %d bytes", userID, len(data))
+			cm.handlePeerMessage(userID, data)
+		},
+	)
+	cm.p2pManager.SetSessionMessageHandler(cm.handleSessionMessage)
+	cm.p2pManager.SetSyncProfileHandler(cm.applySyncProfile)
+	cm.p2pManager.SetTrafficBudgets(trafficBudgets(config.BandwidthBudgets), cm.sendTrafficWarning)
+	
+	return cm
+}
+
+// HandleMessage processes a message from Neovim and returns the response
+// with the message's id, nil when there is none
+func (cm *CollabManager) HandleMessage(ctx context.Context, msg *protocol.Message) *protocol.Message {
+	ctx, span := telemetry.Tracer.Start(ctx, "collab.handle_message", trace.WithAttributes(telemetry.AttrMessageType.String(msg.Type)))
+	defer span.End()
+	
+	// Document operations report their own timing with operation details
+	if msg.Type != protocol.MsgDocumentOperation {
+		defer cm.warnIfSlow(msg.Type, nil, time.Now())
+	}
+	
+	response := cm.pipeline.handleMessage(ctx, "", msg)
+	if response != nil {
+		cm.respond(response, msg.Folded...)
+		response.ID = msg.ID
+	}
+	return response
+}
+
+// registerHandlers routes each type of message from Neovim to its handler
+func (cm *CollabManager) registerHandlers(p *Pipeline) {
+	// Session management
+	p.Handle(protocol.MsgCreateSession, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.CreateSessionRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleCreateSession(&req)
+	})
+	
+	p.Handle(protocol.MsgJoinSession, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.JoinSessionRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		response := cm.resync(msg.ID, func() *protocol.Message { return cm.handleJoinSession(&req) })
+		cm.endSessionStateWait()
+		return response
+	})
+	
+	p.Handle(protocol.MsgLeaveSession, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.LeaveSessionRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleLeaveSession(&req)
+	})
+	
+	p.Handle(protocol.MsgListSessions, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.ListSessionsRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleListSessions(&req)
+	})
+	
+	p.Handle(protocol.MsgReplayLog, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.ReplayLogRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleReplayLog(&req)
+	})
+	
+	p.Handle(protocol.MsgCreateInvite, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleCreateInvite()
+	})
+	
+	p.Handle(protocol.MsgAcceptInvite, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.AcceptInviteRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleAcceptInvite(&req)
+	})
+	
+	p.Handle(protocol.MsgCompleteInvite, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.CompleteInviteRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleCompleteInvite(&req)
+	})
+	
+	p.Handle(protocol.MsgShareInvite, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleShareInvite()
+	})
+	
+	p.Handle(protocol.MsgOpenSSHTunnel, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.OpenSSHTunnelRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleOpenSSHTunnel(&req)
+	})
+	
+	p.Handle(protocol.MsgConnectSSHTunnel, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.ConnectSSHTunnelRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleConnectSSHTunnel(&req)
+	})
+	
+	p.Handle(protocol.MsgExportSessionState, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.ExportSessionStateRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleExportSessionState(&req)
+	})
+	
+	p.Handle(protocol.MsgListProjectFiles, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.ListProjectFilesRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleListProjectFiles(&req)
+	})
+	
+	p.Handle(protocol.MsgOpenRemoteFile, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.OpenRemoteFileRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleOpenRemoteFile(&req)
+	})
+	
+	p.Handle(protocol.MsgCloseRemoteFile, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.CloseRemoteFileRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleCloseRemoteFile(&req)
+	})
+	
+	p.Handle(protocol.MsgImportSessionState, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.ImportSessionStateRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.resync(msg.ID, func() *protocol.Message { return cm.handleImportSessionState(&req) })
+	})
+	
+	// Document operations
+	p.Handle(protocol.MsgDocumentOperation, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var op protocol.DocumentOperation
+		if err := msg.ParseData(&op); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleDocumentOperation(ctx, msg.ID, &op)
+	})
+	
+	p.Handle(protocol.MsgDocumentOperations, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var batch protocol.DocumentOperations
+		if err := msg.ParseData(&batch); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleDocumentOperations(ctx, append(msg.Folded, msg.ID), &batch)
+	})
+	
+	p.Handle(protocol.MsgApplyTransaction, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.TransactionRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleApplyTransaction(ctx, msg.ID, &req)
+	})
+	
+	p.Handle(protocol.MsgStartDemoPeer, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.StartDemoPeerRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleStartDemoPeer(&req)
+	})
+	
+	p.Handle(protocol.MsgStopDemoPeer, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleStopDemoPeer()
+	})
+	
+	p.Handle(protocol.MsgCloseSession, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleCloseSession()
+	})
+	
+	p.Handle(protocol.MsgSetTypingPrivacy, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.SetTypingPrivacyRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleSetTypingPrivacy(&req)
+	})
+	
+	p.Handle(protocol.MsgPauseSync, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handlePauseSync()
+	})
+	
+	p.Handle(protocol.MsgResumeSync, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleResumeSync()
+	})
+	
+	p.Handle(protocol.MsgExportDocument, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleExportDocument()
+	})
+	
+	p.Handle(protocol.MsgExportAttribution, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.ExportAttributionRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleExportAttribution(&req)
+	})
+	
+	p.Handle(protocol.MsgContributionReport, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.ContributionReportRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleContributionReport(&req)
+	})
+	
+	p.Handle(protocol.MsgCreateBreakout, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.CreateBreakoutRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleCreateBreakout(&req)
+	})
+	
+	p.Handle(protocol.MsgMoveToBreakout, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.MoveToBreakoutRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleMoveToBreakout(&req)
+	})
+	
+	p.Handle(protocol.MsgListBreakouts, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleListBreakouts()
+	})
+	
+	p.Handle(protocol.MsgMergeBreakout, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.MergeBreakoutRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleMergeBreakout(ctx, &req)
+	})
+	
+	jumpListRequest := func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleJumpListRequest(msg)
+	}
+	for _, msgType := range []string{protocol.MsgShareDiagnostics, protocol.MsgAddComment, protocol.MsgRemoveJumpItem, protocol.MsgJumpTo} {
+		p.Handle(msgType, jumpListRequest)
+	}
+	
+	p.Handle(protocol.MsgGetJumpList, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleGetJumpList()
+	})
+	
+	p.Handle(protocol.MsgSubscribeJumpList, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.SubscribeJumpListRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleSubscribeJumpList(&req)
+	})
+	
+	p.Handle(protocol.MsgSetBreakpoints, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.SetBreakpointsRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleSetBreakpoints(&req)
+	})
+	
+	p.Handle(protocol.MsgGetBreakpoints, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleGetBreakpoints()
+	})
+	
+	p.Handle(protocol.MsgSetOperationRules, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.OperationRules
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleSetOperationRules(&req)
+	})
+	
+	p.Handle(protocol.MsgGetOperationRules, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleGetOperationRules()
+	})
+	
+	sessionLink := func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.SessionLinkRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleSessionLink(msg.Type, &req)
+	}
+	for _, msgType := range []string{protocol.MsgLinkSession, protocol.MsgAcceptSessionLink, protocol.MsgUnlinkSession} {
+		p.Handle(msgType, sessionLink)
+	}
+	
+	p.Handle(protocol.MsgForkDocument, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.ForkDocumentRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleForkDocument(&req)
+	})
+	
+	p.Handle(protocol.MsgProposeFork, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.ProposeForkRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleProposeFork(&req)
+	})
+	
+	p.Handle(protocol.MsgDiscardFork, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.DiscardForkRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleDiscardFork(&req)
+	})
+	
+	p.Handle(protocol.MsgCursorMove, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var cursor protocol.CursorPosition
+		if err := msg.ParseData(&cursor); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleCursorMove(&cursor)
+	})
+	
+	p.Handle(protocol.MsgSelectionUpdate, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var update protocol.SelectionUpdate
+		if err := msg.ParseData(&update); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleSelectionUpdate(&update)
+	})
+	
+	p.Handle(protocol.MsgGetPresenceMap, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleGetPresenceMap()
+	})
+	
+	// Control management
+	p.Handle(protocol.MsgRequestControl, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.ControlRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleControlRequest(&req)
+	})
+	
+	p.Handle(protocol.MsgGrantControl, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.AnswerControlRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleGrantControl(&req)
+	})
+	
+	p.Handle(protocol.MsgDenyControl, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.AnswerControlRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleDenyControl(&req)
+	})
+	
+	p.Handle(protocol.MsgReleaseControl, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleReleaseControl()
+	})
+	
+	p.Handle(protocol.MsgRaiseHand, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleRaiseHand()
+	})
+	
+	p.Handle(protocol.MsgLowerHand, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.LowerHandRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleLowerHand(&req)
+	})
+	
+	p.Handle(protocol.MsgAcceptSuggestion, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.AnswerSuggestionRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleAcceptSuggestion(ctx, &req)
+	})
+	
+	p.Handle(protocol.MsgDismissSuggestion, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.AnswerSuggestionRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleDismissSuggestion(&req)
+	})
+	
+	p.Handle(protocol.MsgRequestCommand, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.RequestCommandRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleRequestCommand(&req)
+	})
+	
+	p.Handle(protocol.MsgAnswerCommand, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.AnswerCommandRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleAnswerCommand(&req)
+	})
+	
+	p.Handle(protocol.MsgGetCommandOutput, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.GetCommandOutputRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleGetCommandOutput(&req)
+	})
+	
+	p.Handle(protocol.MsgGrantTemporaryControl, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.GrantTemporaryControlRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleGrantTemporaryControl(&req)
+	})
+	
+	p.Handle(protocol.MsgResolveConflict, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.ResolveConflictRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleResolveConflict(&req)
+	})
+	
+	// Chat
+	p.Handle(protocol.MsgSendChat, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.SendChatRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleSendChat(&req)
+	})
+	
+	p.Handle(protocol.MsgMutePeer, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.MutePeerRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleMutePeer(&req)
+	})
+	
+	p.Handle(protocol.MsgUnmutePeer, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.MutePeerRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleUnmutePeer(&req)
+	})
+	
+	// Identity
+	p.Handle(protocol.MsgLogin, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleLogin()
+	})
+	
+	p.Handle(protocol.MsgLogout, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleLogout()
+	})
+	
+	// Extensions
+	p.Handle(protocol.MsgExtension, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var ext protocol.ExtensionMessage
+		if err := msg.ParseData(&ext); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleExtension(&ext)
+	})
+	
+	// System messages
+	p.Handle(protocol.MsgClientInfo, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.PeerCapabilities
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleClientInfo(&req)
+	})
+	
+	p.Handle(protocol.MsgHealthCheck, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return createStatusMessage("healthy", "Go process running")
+	})
+	
+	p.Handle(protocol.MsgGetMetrics, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleGetMetrics()
+	})
+	
+	p.Handle(protocol.MsgDiagnose, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.DiagnoseRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleDiagnose(&req)
+	})
+	
+	p.Handle(protocol.MsgReloadConfig, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return cm.handleReloadConfig()
+	})
+	
+	p.Handle(protocol.MsgKeepalive, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.KeepaliveMessage
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleKeepalive(msg.ID, &req)
+	})
+	
+	p.Handle(protocol.MsgWireFormat, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.WireFormatRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleWireFormat(msg.ID, &req)
+	})
+	
+	p.Handle(protocol.MsgSubscribe, func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		var req protocol.SubscribeRequest
+		if err := msg.ParseData(&req); err != nil {
+			return createErrorMessage("parse_error", err.Error())
+		}
+		return cm.handleSubscribe(&req)
+	})
+}
+
+// handlePeerMessage dispatches messages received from peers. The sender is
+// identified by the connection, not by anything in the message.
+func (cm *CollabManager) handlePeerMessage(userID string, data []byte) {
+	if protocol.IsPresenceFrame(data) {
+		cm.handlePeerPresenceFrame(userID, data)
+		return
+	}
+	
+	msg, err := protocol.ParseMessage(data)
+	if err != nil {
+		return
+	}
+	
+	cm.pipeline.handleMessage(context.Background(), userID, msg)
+}
+
+// registerPeerHandlers routes each type of message from peers to its handler
+func (cm *CollabManager) registerPeerHandlers(p *Pipeline) {
+	p.HandlePeer(protocol.MsgCursorMove, cm.handlePeerPresence)
+	p.HandlePeer(protocol.MsgSelectionUpdate, cm.handlePeerSelection)
+	for _, msgType := range []string{protocol.MsgRaiseHand, protocol.MsgLowerHand} {
+		p.HandlePeer(msgType, cm.handlePeerHand)
+	}
+	p.HandlePeer(protocol.MsgControlStatus, cm.handlePeerControlStatus)
+	p.HandlePeer(protocol.MsgRequestControl, cm.handlePeerRequestControl)
+	p.HandlePeer(protocol.MsgGrantControl, cm.handlePeerGrantControl)
+	p.HandlePeer(protocol.MsgDenyControl, cm.handlePeerDenyControl)
+	p.HandlePeer(protocol.MsgSuggestEdit, cm.handlePeerSuggestEdit)
+	p.HandlePeer(protocol.MsgSuggestionAnswered, cm.handlePeerSuggestionAnswered)
+	p.HandlePeer(protocol.MsgRequestCommand, cm.handlePeerCommandRequest)
+	p.HandlePeer(protocol.MsgOpenRemoteFile, cm.handlePeerOpenRemoteFile)
+	p.HandlePeer(protocol.MsgCloseRemoteFile, cm.handlePeerCloseRemoteFile)
+	p.HandlePeer(protocol.MsgRemoteFileOpened, cm.handlePeerRemoteFileOpened)
+	p.HandlePeer(protocol.MsgListProjectFiles, func(userID string, msg *protocol.Message) {
+		cm.handlePeerListProjectFiles(userID)
+	})
+	p.HandlePeer(protocol.MsgProjectFiles, cm.handlePeerProjectFiles)
+	for _, msgType := range []string{protocol.MsgShareDiagnostics, protocol.MsgAddComment, protocol.MsgRemoveJumpItem, protocol.MsgJumpTo} {
+		p.HandlePeer(msgType, cm.handlePeerJumpListRequest)
+	}
+	p.HandlePeer(protocol.MsgJumpList, cm.handlePeerJumpList)
+	p.HandlePeer(protocol.MsgSetBreakpoints, cm.handlePeerSetBreakpoints)
+	p.HandlePeer(protocol.MsgBreakpoints, cm.handlePeerBreakpoints)
+	p.HandlePeer(protocol.MsgOperationRules, cm.handlePeerOperationRules)
+	p.HandlePeer(protocol.MsgRuleViolation, cm.handlePeerRuleViolation)
+	for _, msgType := range []string{protocol.MsgCommandDenied, protocol.MsgCommandOutput, protocol.MsgCommandFinished} {
+		p.HandlePeer(msgType, cm.handlePeerCommandEvent)
+	}
+	p.HandlePeer(protocol.MsgGetCommandOutput, cm.handlePeerGetCommandOutput)
+	p.HandlePeer(protocol.MsgCommandOutputDocument, cm.handlePeerCommandOutputDocument)
+	p.HandlePeer(protocol.MsgChat, cm.handlePeerChat)
+	p.HandlePeer(protocol.MsgBreakoutAssigned, cm.handlePeerBreakoutAssigned)
+	for _, msgType := range []string{protocol.MsgSessionCountdown, protocol.MsgSessionExpired} {
+		p.HandlePeer(msgType, cm.handlePeerSessionClock)
+	}
+	p.HandlePeer(protocol.MsgSpectatorCount, cm.handleSpectatorCount)
+	for _, msgType := range []string{protocol.MsgSessionLinkOffered, protocol.MsgSessionLinks} {
+		p.HandlePeer(msgType, cm.handleServerSessionLink)
+	}
+	p.HandlePeer(protocol.MsgDocumentOperation, cm.handleServerOperation)
+	p.HandlePeer(protocol.MsgDocumentOperations, cm.handleServerOperations)
+	p.HandlePeer(protocol.MsgTransactionPart, cm.handlePeerTransactionPart)
+	p.HandlePeer(protocol.MsgExtension, cm.handlePeerExtension)
+	p.HandlePeer(protocol.MsgPeerCapabilities, cm.handlePeerCapabilities)
+	p.HandlePeer(protocol.MsgOperationAck, cm.handlePeerOperationAck)
+	p.HandlePeer(protocol.MsgFrontier, cm.handlePeerFrontier)
+	p.HandlePeer(protocol.MsgRequestSessionState, cm.handlePeerRequestSessionState)
+	p.HandlePeer(protocol.MsgSessionState, cm.handlePeerSessionState)
+	p.HandlePeer(protocol.MsgClockProbe, cm.handlePeerClockProbe)
+	p.HandlePeer(protocol.MsgClockReply, cm.handlePeerClockReply)
+	p.HandlePeer(protocol.MsgDocumentDigest, cm.handlePeerDocumentDigest)
+	p.HandlePeer(protocol.MsgCloseProposed, cm.handlePeerCloseProposed)
+	p.HandlePeer(protocol.MsgCloseAck, cm.handlePeerCloseAck)
+	p.HandlePeer(protocol.MsgSessionClosed, cm.handlePeerSessionClosed)
+}
+
+// Session handlers
+func (cm *CollabManager) handleCreateSession(req *protocol.CreateSessionRequest) *protocol.Message {
+	content, err := decodeContent(req.Content, req.ContentEncoding)
+	if err != nil {
+		return createErrorMessage("invalid_content", err.Error())
+	}
+	
+	// Refuse binary files unless explicitly shared as whole-file blobs, since
+	// character-level OT would corrupt them
+	mode := collabsync.ContentModeText
+	if isBinaryContent(content) {
+		if !req.AllowBinary {
+			return createErrorMessage("binary_content", fmt.Sprintf("%s looks like a binary file; set allow_binary to share it as a whole-file blob", req.FilePath))
+		}
+		mode = collabsync.ContentModeBlob
+	}
+	
+	// Text is synchronized as UTF-8 with LF line endings; the original
+	// encoding and convention are remembered so exports can restore them
+	lineEnding := ""
+	charset := ""
+	if mode == collabsync.ContentModeText {
+		charset = normalizeCharset(req.FileEncoding)
+		if charset == "" {
+			charset = detectCharset(content)
+		}
+		content, err = decodeCharset(content, charset)
+		if err != nil {
+			return createErrorMessage("invalid_encoding", err.Error())
+		}
+		
+		lineEnding = detectLineEnding(content)
+		content = normalizeLineEndings(content)
+	}
+	
+	if req.ICEPolicy != nil {
+		if err := cm.p2pManager.SetICEPolicy(*req.ICEPolicy); err != nil {
+			return createErrorMessage("invalid_ice_policy", err.Error())
+		}
+	}
+	if req.UseRelay && cm.relayClient == nil {
+		return createErrorMessage("relay_not_configured", "use_relay requires relay_url in the config file")
+	}
+	settings, err := settingsForPreset(req.Preset)
+	if err != nil {
+		return createErrorMessage("invalid_preset", err.Error())
+	}
+	if req.DurationMinutes < 0 {
+		return createErrorMessage("invalid_duration", "duration_minutes must not be negative")
+	}
+	if req.DurationMinutes > 0 {
+		endsAt := time.Now().Add(time.Duration(req.DurationMinutes) * time.Minute).UTC()
+		settings.EndsAt = &endsAt
+	}
+	if _, err := collabsync.NewConflictStrategy(req.ConflictStrategy, nil); err != nil {
+		return createErrorMessage("invalid_conflict_strategy", err.Error())
+	}
+	settings.ConflictStrategy = req.ConflictStrategy
+	
+	// Project sessions share the file's path relative to the project root
+	filePath, root := req.FilePath, ""
+	if req.Root != "" {
+		if root, err = cleanSessionRoot(req.Root); err != nil {
+			return createErrorMessage("invalid_root", err.Error())
+		}
+		if filePath, err = sessionRelativePath(root, req.FilePath); err != nil {
+			return createErrorMessage("invalid_root", err.Error())
+		}
+	}
+	
+	session, err := cm.sessionManager.CreateSession(filePath, content, mode, lineEnding, charset, settings)
+	if err != nil {
+		return createErrorMessage("create_session_failed", err.Error())
+	}
+	if root != "" {
+		session.Project = true
+		session.IgnoreRules = loadIgnoreRules(root).Lines()
+	}
+	cm.sessionRoot = root
+	
+	// Initialize sync manager with document content
+	cm.syncManager.SetContentMode(mode)
+	cm.syncManager.InitializeDocument(content)
+	cm.useConflictStrategy(session)
+	cm.openOpLog(session.ID, content)
+	cm.contributions.Start(session.ID, session.FilePath)
+	
+	cm.clientCharset = charset
+	
+	// In server mode the session lives on the server; nothing else connects
+	if cm.p2pManager.ServerMode() {
+		_, err := cm.p2pManager.ConnectServer(protocol.ServerHello{
+			SessionID: session.ID,
+			IDToken:   cm.idToken(),
+			Create: &protocol.ServerSessionSpec{
+				FilePath:   session.FilePath,
+				Project:    session.Project,
+				Ignore:     session.IgnoreRules,
+				Content:    content,
+				Mode:       mode,
+				LineEnding: lineEnding,
+				Charset:    charset,
+				Settings:   settings,
+			},
+		}, nil)
+		if err != nil {
+			cm.sessionManager.LeaveSession()
+			cm.closeOpLog()
+			return createErrorMessage("server_connection_failed", err.Error())
+		}
+	}
+	
+	// Peers find the session through the signaling server, when there is one
+	if err := cm.p2pManager.JoinSignaling(session.ID); err != nil {
+		cm.sessionManager.LeaveSession()
+		cm.closeOpLog()
+		return createErrorMessage("signaling_failed", err.Error())
+	}
+	
+	// Publish a room code so collaborators never have to see the session hash
+	roomCode := ""
+	if req.UseRelay {
+		roomCode, err = cm.relayClient.RegisterRoom(session.ID)
+		if err != nil {
+			cm.sessionManager.LeaveSession()
+			cm.closeOpLog()
+			return createErrorMessage("relay_registration_failed", err.Error())
+		}
+		cm.sessionManager.SetRoomCode(session.ID, roomCode)
+	}
+	
+	cm.startSessionClock(session)
+	
+	response := protocol.CreateSessionResponse{
+		SessionID:    session.ID,
+		UserID:       cm.sessionManager.GetUserID(),
+		Mode:         mode,
+		LineEnding:   lineEnding,
+		FileEncoding: charset,
+		RoomCode:     roomCode,
+		Settings:     settings,
+	}
+	if session.Project {
+		response.RelativePath = session.FilePath
+	}
+	cm.notifyWebhooks(WebhookSessionCreated, response.UserID)
+	
+	msg, _ := protocol.NewMessage(protocol.MsgSessionCreated, response)
+	return msg
+}
+
+func (cm *CollabManager) handleJoinSession(req *protocol.JoinSessionRequest) *protocol.Message {
+	if req.LineEnding != "" && !isValidLineEnding(req.LineEnding) {
+		return createErrorMessage("invalid_line_ending", "Unknown line ending: "+req.LineEnding)
+	}
+	
+	charset := normalizeCharset(req.FileEncoding)
+	if charset != "" {
+		if _, err := lookupCharset(charset); err != nil {
+			return createErrorMessage("invalid_encoding", err.Error())
+		}
+	}
+	
+	if req.ICEPolicy != nil {
+		if err := cm.p2pManager.SetICEPolicy(*req.ICEPolicy); err != nil {
+			return createErrorMessage("invalid_ice_policy", err.Error())
+		}
+	}
+	
+	root := ""
+	if req.Root != "" {
+		var err error
+		if root, err = cleanSessionRoot(req.Root); err != nil {
+			return createErrorMessage("invalid_root", err.Error())
+		}
+	}
+	
+	// Room codes are resolved to session IDs through the hosted relay
+	sessionID := req.SessionID
+	roomCode := req.RoomCode
+	if isInviteURI(sessionID) {
+		uriSessionID, uriRoomCode, err := parseInviteURI(sessionID)
+		if err != nil {
+			return createErrorMessage("invalid_invite", err.Error())
+		}
+		sessionID = uriSessionID
+		if sessionID == "" && roomCode == "" {
+			roomCode = uriRoomCode
+		}
+	}
+	if roomCode == "" && isRoomCode(sessionID) {
+		roomCode = sessionID
+	}
+	if roomCode != "" {
+		if cm.relayClient == nil {
+			return createErrorMessage("relay_not_configured", "joining by room code requires relay_url in the config file")
+		}
+		resolved, err := cm.relayClient.ResolveRoom(roomCode)
+		if err != nil {
+			return createErrorMessage("join_session_failed", err.Error())
+		}
+		sessionID = resolved
+	}
+	
+	if req.Spectate && !cm.p2pManager.ServerMode() {
+		return createErrorMessage("join_session_failed", "spectating requires server_url in the config file")
+	}
+	
+	var session *session.Session
+	var welcome *protocol.ServerWelcome
+	var err error
+	cm.joinProgress.start()
+	if cm.p2pManager.ServerMode() {
+		welcome, err = cm.p2pManager.ConnectServer(protocol.ServerHello{SessionID: sessionID, IDToken: cm.idToken(), Spectator: req.Spectate}, cm.joinProgress.snapshot)
+		if err == nil {
+			session, err = cm.sessionManager.JoinServerSession(welcome)
+		}
+	} else if err = cm.p2pManager.JoinSignaling(sessionID); err == nil {
+		var from string
+		welcome, from, err = cm.fetchSessionState(sessionID)
+		if err == nil {
+			welcome.Spectators = 0
+			if !welcomeHas(welcome, cm.sessionManager.GetUserID()) {
+				welcome.Peers = append(welcome.Peers, protocol.Peer{UserID: cm.sessionManager.GetUserID()})
+			}
+			if welcome.Snapshot != nil {
+				var content []byte
+				content, err = cm.p2pManager.FetchSnapshot(from, *welcome.Snapshot, cm.joinProgress.snapshot)
+				welcome.Spec.Content = string(content)
+			}
+		}
+		if err == nil {
+			cm.joinProgress.snapshot(len(welcome.Spec.Content), len(welcome.Spec.Content))
+			session, err = cm.sessionManager.JoinSession(welcome, "from "+from)
+			cm.probeHostClock()
+		} else {
+			cm.p2pManager.LeaveSignaling()
+		}
+	}
+	if err != nil {
+		cm.p2pManager.CloseServer()
+		return createErrorMessage("join_session_failed", err.Error())
+	}
+	if err := cm.joinProject(session, root); err != nil {
+		cm.sessionManager.LeaveSession()
+		cm.p2pManager.CloseServer()
+		cm.p2pManager.LeaveSignaling()
+		return createErrorMessage("join_session_failed", err.Error())
+	}
+	
+	if charset == "" {
+		charset = session.Charset
+	}
+	cm.clientCharset = charset
+	cm.spectating = req.Spectate
+	
+	// Initialize sync manager with session content
+	cm.syncManager.SetContentMode(session.Mode)
+	if welcome != nil {
+		cm.syncManager.RestoreDocument(session.Content, welcome.Version, welcome.VectorClock)
+		cm.spectators.Store(int64(welcome.Spectators))
+	} else {
+		cm.syncManager.InitializeDocument(session.Content)
+	}
+	cm.useConflictStrategy(session)
+	cm.openOpLog(session.ID, session.Content)
+	cm.contributions.Start(session.ID, session.FilePath)
+	
+	// Convert peers map to slice
+	peers := make([]protocol.Peer, 0, len(session.Peers))
+	for _, peer := range session.Peers {
+		peers = append(peers, *peer)
+	}
+	
+	// Flag joiners whose local convention differs so the UI can keep the
+	// shared file's fileformat instead of flipping every line ending
+	mismatch := session.Mode == collabsync.ContentModeText && req.LineEnding != "" && req.LineEnding != session.LineEnding
+	if mismatch {
+		log.Printf("Line ending mismatch: session uses %s, joiner uses %s", session.LineEnding, req.LineEnding)
+	}
+	
+	content, encoding := cm.contentForClient(session.Content, session.Mode)
+	response := protocol.JoinSessionResponse{
+		UserID:             cm.sessionManager.GetUserID(),
+		FilePath:           cm.localFilePath(session),
+		Content:            content,
+		ContentEncoding:    encoding,
+		Mode:               session.Mode,
+		LineEnding:         session.LineEnding,
+		LineEndingMismatch: mismatch,
+		FileEncoding:       charset,
+		Peers:              peers,
+		Settings:           session.Settings,
+	}
+	if session.Project {
+		response.RelativePath = session.FilePath
+		response.IgnoreRules = session.IgnoreRules
+	}
+	if !session.CanEdit(response.UserID) || cm.spectating {
+		response.ReadOnly = true
+	}
+	response.Spectators = int(cm.spectators.Load())
+	if session.Settings.FollowHost {
+		response.Follow = session.CreatedBy
+	}
+	cm.notifyWebhooks(WebhookSessionJoined, response.UserID)
+	cm.opFlow.onDrained(cm.replayProgress)
+	
+	msg, _ := protocol.NewMessage(protocol.MsgSessionJoined, response)
+	return msg
+}
+
+func (cm *CollabManager) handleLeaveSession(req *protocol.LeaveSessionRequest) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	
+	// Written and archived while the document and op log are still open
+	cm.flushWriteThrough()
+	cm.flushTyping()
+	var archivePath string
+	var archiveErr error
+	if session != nil && cm.archiveSessions {
+		archivePath, archiveErr = cm.archiveSession(session)
+	}
+	
+	err := cm.sessionManager.LeaveSession()
+	if err != nil {
+		return createErrorMessage("leave_session_failed", err.Error())
+	}
+	if session != nil && cm.archiveSessions {
+		cm.sendSessionArchived(session.ID, archivePath, archiveErr)
+	}
+	cm.closeOpLog()
+	cm.removeCheckpoint()
+	cm.sessionRoot = ""
+	cm.sendContributionReport()
+	cm.presence.Reset()
+	cm.presenceEncoder.Reset()
+	cm.presenceDecoder.Reset()
+	cm.hands.Reset()
+	cm.controlRequests.Reset()
+	cm.suggestions.Reset()
+	cm.syncPause.Reset()
+	cm.ending.Reset()
+	cm.desync.Reset()
+	cm.stopDemoPeer()
+	cm.diskWriter.Reset()
+	cm.typing.Reset()
+	cm.commands.Reset()
+	cm.commandOutputs.Reset()
+	cm.mutes.Reset()
+	cm.spectating = false
+	cm.spectators.Store(0)
+	cm.stopControlRevert()
+	cm.breakouts.Reset()
+	cm.remoteFiles.Reset()
+	cm.transactions.Reset()
+	cm.jumpList.Reset()
+	cm.breakpoints.Reset()
+	cm.rules.Reset()
+	cm.forks.Reset()
+	cm.capabilities.ResetPeers()
+	cm.latency.Reset()
+	cm.frontiers.Reset()
+	cm.clock.SetOffset(0)
+	cm.sessionClock.Stop()
+	cm.p2pManager.CloseServer()
+	cm.p2pManager.LeaveSignaling()
+	if session != nil {
+		cm.notifySessionWebhooks(WebhookSessionEnded, session, cm.sessionManager.GetUserID())
+	}
+	
+	// The host frees the room code so it can be reused
+	if session != nil && session.RoomCode != "" && session.CreatedBy == cm.sessionManager.GetUserID() && cm.relayClient != nil {
+		if err := cm.relayClient.ReleaseRoom(session.RoomCode); err != nil {
+			log.Printf("Failed to release room %s: %v", session.RoomCode, err)
+		}
+	}
+	
+	return createStatusMessage("left", "Left session successfully")
+}
+
+func (cm *CollabManager) handleListSessions(req *protocol.ListSessionsRequest) *protocol.Message {
+	sessions, err := cm.sessionManager.ListSessions(*req)
+	if err != nil {
+		return createErrorMessage("list_sessions_failed", err.Error())
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgSessionList, protocol.SessionListResponse{Sessions: sessions})
+	return msg
+}
+
+// openOpLog starts logging the current session's operations to disk
+func (cm *CollabManager) openOpLog(sessionID, content string) {
+	cm.closeOpLog()
+	if cm.opLogDir == "" {
+		return
+	}
+	
+	opLog, err := OpenOpLog(cm.opLogDir, sessionID, content)
+	if err != nil {
+		log.Printf("Op log disabled for session %s: %v", sessionID, err)
+		return
+	}
+	cm.opLog = opLog
+}
+
+func (cm *CollabManager) closeOpLog() {
+	if cm.opLog == nil {
+		return
+	}
+	if err := cm.opLog.Close(); err != nil {
+		log.Printf("Failed to close op log: %v", err)
+	}
+	cm.opLog = nil
+}
+
+func (cm *CollabManager) handleReplayLog(req *protocol.ReplayLogRequest) *protocol.Message {
+	if cm.opLogDir == "" {
+		return createErrorMessage("op_log_disabled", "replaying requires op_log_dir in the config file")
+	}
+	if req.SessionID == "" || filepath.Base(req.SessionID) != req.SessionID {
+		return createErrorMessage("invalid_session", "Invalid session ID: "+req.SessionID)
+	}
+	
+	opLog := cm.opLog
+	session := cm.sessionManager.GetCurrentSession()
+	if opLog == nil || session == nil || session.ID != req.SessionID {
+		if _, err := os.Stat(filepath.Join(cm.opLogDir, req.SessionID)); err != nil {
+			return createErrorMessage("replay_failed", "No op log for session "+req.SessionID)
+		}
+		var err error
+		opLog, err = OpenOpLog(cm.opLogDir, req.SessionID, "")
+		if err != nil {
+			return createErrorMessage("replay_failed", err.Error())
+		}
+		defer opLog.Close()
+	}
+	
+	content, opCount, err := opLog.Recover()
+	if err != nil {
+		return createErrorMessage("replay_failed", err.Error())
+	}
+	
+	mode := collabsync.ContentModeText
+	if isBinaryContent(content) {
+		mode = collabsync.ContentModeBlob
+	}
+	content, encoding := cm.contentForClient(content, mode)
+	
+	msg, _ := protocol.NewMessage(protocol.MsgLogReplayed, protocol.ReplayLogResponse{
+		SessionID:       req.SessionID,
+		Content:         content,
+		ContentEncoding: encoding,
+		OpCount:         opCount,
+	})
+	return msg
+}
+
+// Manual signaling handlers
+func (cm *CollabManager) handleCreateInvite() *protocol.Message {
+	current := cm.sessionManager.GetCurrentSession()
+	if current == nil {
+		return createErrorMessage("no_session", "Create a session before inviting peers")
+	}
+	
+	inviteID := session.GenerateUserID()
+	blob, err := cm.p2pManager.CreateManualOffer(inviteID, current.ID)
+	if err != nil {
+		return createErrorMessage("create_invite_failed", err.Error())
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgInviteCreated, protocol.CreateInviteResponse{
+		InviteID: inviteID,
+		Blob:     blob,
+	})
+	return msg
+}
+
+func (cm *CollabManager) handleAcceptInvite(req *protocol.AcceptInviteRequest) *protocol.Message {
+	blob, offer, err := cm.p2pManager.AcceptManualOffer(req.Blob)
+	if err != nil {
+		return createErrorMessage("accept_invite_failed", err.Error())
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgInviteAccepted, protocol.AcceptInviteResponse{
+		SessionID:  offer.SessionID,
+		HostUserID: offer.UserID,
+		Blob:       blob,
+	})
+	return msg
+}
+
+func (cm *CollabManager) handleCompleteInvite(req *protocol.CompleteInviteRequest) *protocol.Message {
+	userID, err := cm.p2pManager.CompleteManualOffer(req.Blob)
+	if err != nil {
+		return createErrorMessage("complete_invite_failed", err.Error())
+	}
+	
+	return createStatusMessage("invite_completed", "Connecting to peer "+userID)
+}
+
+func (cm *CollabManager) handleOpenSSHTunnel(req *protocol.OpenSSHTunnelRequest) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	
+	uri, err := cm.p2pManager.ListenSSH(req.Address, session.ID)
+	if err != nil {
+		return createErrorMessage("ssh_tunnel_failed", err.Error())
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgSSHTunnelOpened, protocol.SSHTunnelOpenedResponse{URI: uri})
+	return msg
+}
+
+func (cm *CollabManager) handleConnectSSHTunnel(req *protocol.ConnectSSHTunnelRequest) *protocol.Message {
+	// Joiners connect first, then join through the tunnel
+	sessionID := req.SessionID
+	if session := cm.sessionManager.GetCurrentSession(); session != nil {
+		sessionID = session.ID
+	}
+	if sessionID == "" {
+		return createErrorMessage("no_session", "session_id is required before joining the session")
+	}
+	
+	userID, err := cm.p2pManager.ConnectSSH(req.URI, sessionID)
+	if err != nil {
+		return createErrorMessage("ssh_tunnel_failed", err.Error())
+	}
+	
+	return createStatusMessage("ssh_tunnel_connected", "Connected to peer "+userID)
+}
+
+func (cm *CollabManager) handleShareInvite() *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	
+	// The host registers a short code on demand if the session doesn't have one
+	roomCode := session.RoomCode
+	if roomCode == "" && cm.relayClient != nil && session.CreatedBy == cm.sessionManager.GetUserID() {
+		code, err := cm.relayClient.RegisterRoom(session.ID)
+		if err != nil {
+			log.Printf("Sharing invite without a short code: %v", err)
+		} else {
+			roomCode = code
+			cm.sessionManager.SetRoomCode(session.ID, roomCode)
+		}
+	}
+	
+	uri := buildInviteURI(session.ID, roomCode)
+	qr, err := renderQRMatrix(uri)
+	if err != nil {
+		return createErrorMessage("share_invite_failed", err.Error())
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgInviteShared, protocol.ShareInviteResponse{
+		URI:       uri,
+		ShortCode: roomCode,
+		QR:        qr,
+	})
+	return msg
+}
+
+// Document operation handlers
+func (cm *CollabManager) handleDocumentOperation(ctx context.Context, id json.RawMessage, op *protocol.DocumentOperation) *protocol.Message {
+	defer cm.warnIfSlow(protocol.MsgDocumentOperation, op, time.Now())
+	
+	// Remote files are documents of their own
+	if op.File != "" {
+		f := cm.remoteFiles.Get(op.File)
+		if f == nil {
+			return createErrorMessage("operation_failed", op.File+" is not open")
+		}
+		syncOp, failure := cm.prepareDocumentOperation(op, f.sync)
+		if failure != nil {
+			return failure
+		}
+		if failure := cm.checkRules([]protocol.Operation{syncOp}, f.Path); failure != nil {
+			return failure
+		}
+		if err := cm.handleRemoteFileOperation(ctx, f, syncOp); err != nil {
+			return createErrorMessage("operation_failed", err.Error())
+		}
+		return createStatusMessage("operation_applied", "Remote file operation processed successfully")
+	}
+	
+	// Without control, the edit goes to the controller as a suggestion
+	if _, needsControl := cm.editAccess(op.UserID); needsControl && cm.canSuggest(op.UserID) {
+		return cm.suggestEdits([]protocol.DocumentOperation{*op})
+	}
+	
+	syncOp, failure := cm.prepareDocumentOperation(op, cm.syncManager)
+	if failure != nil {
+		return failure
+	}
+	
+	// Members of a breakout edit its fork, not the main document
+	if b := cm.breakouts.Joined(); b != nil && op.UserID == cm.sessionManager.GetUserID() {
+		if err := cm.handleBreakoutOperation(ctx, b, syncOp); err != nil {
+			return createErrorMessage("operation_failed", err.Error())
+		}
+		return createStatusMessage("operation_applied", "Breakout operation processed successfully")
+	}
+	if failure := cm.checkRules([]protocol.Operation{syncOp}, ""); failure != nil {
+		return failure
+	}
+	
+	// While the document is busy the operation waits its turn, and Neovim
+	// hears how it went once it was applied
+	var response *protocol.Message
+	if cm.opFlow.run(func(queued bool) {
+		response = cm.applyDocumentOperation(ctx, syncOp)
+		if queued {
+			cm.respond(response, id)
+		}
+	}) {
+		return createStatusMessage("operation_queued", "Document operation queued until the document is ready")
+	}
+	return response
+}
+
+// prepareDocumentOperation checks an operation from Neovim and converts it
+// into a sync operation on sm's UTF-8 document, or returns the error to send
+// back
+func (cm *CollabManager) prepareDocumentOperation(op *protocol.DocumentOperation, sm *collabsync.SyncManager) (protocol.Operation, *protocol.Message) {
+	if failure, _ := cm.editAccess(op.UserID); failure != nil {
+		return protocol.Operation{}, failure
+	}
+	return cm.convertDocumentOperation(op, sm)
+}
+
+// editAccess returns the error for an edit userID may not make, and whether
+// it is only for lack of control, which an edit suggestion gets around
+func (cm *CollabManager) editAccess(userID string) (*protocol.Message, bool) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return nil, false
+	}
+	
+	// Followers in broadcast sessions watch; only the host and whoever it
+	// hands control to may edit. Breakout forks are open to their members.
+	// Nobody edits once a timed session has ended.
+	session.Mutex.RLock()
+	expired := session.Expired
+	session.Mutex.RUnlock()
+	if expired {
+		return createErrorMessage("read_only", "The session has ended"), false
+	}
+	if cm.spectating {
+		return createErrorMessage("read_only", "Spectators can't edit"), false
+	}
+	if userID == cm.sessionManager.GetUserID() && cm.ending.Closing() {
+		return createErrorMessage("read_only", "The session is closing"), false
+	}
+	if cm.breakouts.Joined() == nil && !session.CanEdit(userID) {
+		return createErrorMessage("read_only", "Only the host can edit in a "+session.Settings.Preset+" session"), true
+	}
+	return nil, false
+}
+
+// convertDocumentOperation converts an operation from Neovim into a sync
+// operation on sm's UTF-8 document
+func (cm *CollabManager) convertDocumentOperation(op *protocol.DocumentOperation, sm *collabsync.SyncManager) (protocol.Operation, *protocol.Message) {
+	content, err := decodeContent(op.Content, op.ContentEncoding)
+	if err != nil {
+		return protocol.Operation{}, createErrorMessage("invalid_content", err.Error())
+	}
+	position, length := op.Position, op.Length
+	if sm.GetContentMode() == collabsync.ContentModeText {
+		// Clients editing in a legacy encoding send content and byte offsets
+		// in that encoding; translate both into the UTF-8 document
+		if cm.clientCharset != CharsetUTF8 {
+			content, err = decodeCharset(content, cm.clientCharset)
+			if err != nil {
+				return protocol.Operation{}, createErrorMessage("invalid_encoding", err.Error())
+			}
+			
+			document := sm.GetDocumentContent()
+			start, err := charsetOffset(document, cm.clientCharset, op.Position)
+			if err != nil {
+				return protocol.Operation{}, createErrorMessage("invalid_encoding", err.Error())
+			}
+			end, err := charsetOffset(document, cm.clientCharset, op.Position+op.Length)
+			if err != nil {
+				return protocol.Operation{}, createErrorMessage("invalid_encoding", err.Error())
+			}
+			position, length = start, end-start
+		}
+		
+		content = normalizeLineEndings(content)
+		if op.Type == string(protocol.OpInsert) {
+			length = len(content)
+		}
+	}
+	
+	// Convert protocol operation to sync operation
+	return protocol.Operation{
+		Type:       protocol.OperationType(op.Type),
+		Position:   position,
+		Content:    content,
+		Length:     length,
+		UserID:     op.UserID,
+		Timestamp:  sm.Timestamp(),
+		ID:         collabsync.GenerateOperationID(op.UserID),
+		Provenance: op.Provenance,
+	}, nil
+}
+
+// applyDocumentOperation applies an operation from Neovim to the document
+func (cm *CollabManager) applyDocumentOperation(ctx context.Context, syncOp protocol.Operation) *protocol.Message {
+	// Apply as local or remote operation based on user ID
+	var err error
+	if syncOp.UserID == cm.sessionManager.GetUserID() {
+		syncOp = cm.stampOperation(syncOp)
+		err = cm.syncManager.ApplyLocalOperation(ctx, syncOp)
+	} else {
+		err = cm.syncManager.ApplyRemoteOperation(ctx, syncOp)
+	}
+	
+	if errors.Is(err, collabsync.ErrOperationHeld) {
+		return createStatusMessage("operation_held", "Waiting for resolve_conflict")
+	}
+	if errors.Is(err, collabsync.ErrOperationReplayed) {
+		return createStatusMessage("operation_skipped", "The document already contains this operation")
+	}
+	if err != nil {
+		return createErrorMessage("operation_failed", err.Error())
+	}
+	
+	// Local edits go to the server, which orders them with everyone else's,
+	// or straight to every peer
+	if syncOp.UserID == cm.sessionManager.GetUserID() {
+		if err := cm.relayOperations([]protocol.Operation{syncOp}); err != nil {
+			return createErrorMessage("operation_failed", err.Error())
+		}
+	}
+	
+	return createStatusMessage("operation_applied", "Document operation processed successfully")
+}
+
+// handleExportDocument returns the shared document as it should be written to
+// disk, with the file's original line endings restored
+func (cm *CollabManager) handleExportDocument() *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("export_failed", "no active session")
+	}
+	
+	content := cm.syncManager.GetDocumentContent()
+	if session.Mode == collabsync.ContentModeText {
+		content = restoreLineEndings(content, session.LineEnding)
+	}
+	content, encoding := cm.contentForClient(content, session.Mode)
+	
+	response := protocol.ExportDocumentResponse{
+		FilePath:        cm.localFilePath(session),
+		Content:         content,
+		ContentEncoding: encoding,
+		LineEnding:      session.LineEnding,
+		FileEncoding:    cm.clientCharset,
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgDocumentExported, response)
+	return msg
+}
+
+// contentForClient prepares document content for the local Neovim, converting
+// text back to the client's encoding. Anything that isn't UTF-8 text travels
+// base64 encoded since JSON strings can't carry it.
+func (cm *CollabManager) contentForClient(content, mode string) (string, string) {
+	if mode == collabsync.ContentModeText && cm.clientCharset != CharsetUTF8 {
+		encoded, err := encodeCharset(content, cm.clientCharset)
+		if err != nil {
+			log.Printf("Failed to convert content to %s: %v", cm.clientCharset, err)
+			return encodeContent(content, mode)
+		}
+		return base64.StdEncoding.EncodeToString([]byte(encoded)), ContentEncodingBase64
+	}
+	return encodeContent(content, mode)
+}
+
+func (cm *CollabManager) handleCursorMove(cursor *protocol.CursorPosition) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return nil
+	}
+	file, err := sharedFile(session, cursor.File)
+	if err != nil {
+		return createErrorMessage("invalid_cursor", err.Error())
+	}
+	cursor.File = file
+	
+	// Server envelopes carry JSON, so the server relays full cursor_move
+	// messages; peers get compact presence frames
+	if cm.p2pManager.ServerMode() {
+		if err := cm.broadcastToPeers(protocol.MsgCursorMove, cursor); err != nil {
+			log.Printf("Failed to send cursor: %v", err)
+		}
+		return nil // No response needed for cursor moves
+	}
+	
+	cm.presenceEncoder.Update(protocol.PresenceState{
+		Line:           cursor.Line,
+		Column:         cursor.Column,
+		ViewportTop:    cursor.ViewportTop,
+		ViewportBottom: cursor.ViewportBottom,
+		File:           file,
+	})
+	return nil // No response needed for cursor moves
+}
+
+// enforcePeerCap disconnects a peer that joined a session already at its cap
+func (cm *CollabManager) enforcePeerCap(userID string) {
+	// The server enforces the cap itself
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || cm.p2pManager.ServerMode() || !session.OverPeerCap(len(cm.p2pManager.GetConnectedPeers())) {
+		return
+	}
+	
+	log.Printf("Session %s is full (%d peers), disconnecting %s", session.ID, session.Settings.MaxPeers, userID)
+	if err := cm.p2pManager.DisconnectPeer(userID); err != nil {
+		log.Printf("Failed to disconnect peer %s: %v", userID, err)
+	}
+}
+
+// Control handlers
+func (cm *CollabManager) handleReleaseControl() *protocol.Message {
+	status, err := cm.sessionManager.ReleaseControl()
+	if err != nil {
+		return createErrorMessage("control_release_failed", err.Error())
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgControlStatus, status)
+	return msg
+}
+
+// warnIfSlow tells Neovim when handling a message took longer than the
+// threshold, so users can see why the session feels laggy
+func (cm *CollabManager) warnIfSlow(msgType string, op *protocol.DocumentOperation, start time.Time) {
+	elapsed := time.Since(start)
+	if cm.slowThreshold <= 0 || elapsed < cm.slowThreshold {
+		return
+	}
+	
+	stats := cm.syncManager.GetStats()
+	warning := protocol.SlowOperationWarning{
+		MessageType:     msgType,
+		DurationMS:      elapsed.Milliseconds(),
+		ThresholdMS:     cm.slowThreshold.Milliseconds(),
+		DocumentSize:    stats.DocumentSize,
+		HistorySize:     stats.HistorySize,
+		DocumentOps:     stats.DocumentOps,
+		PendingLocalOps: stats.PendingLocalOps,
+	}
+	if op != nil {
+		warning.OperationType = op.Type
+		warning.OperationLength = op.Length
+		if op.Type == string(protocol.OpInsert) || op.Type == string(protocol.OpReplace) {
+			warning.OperationLength = len(op.Content)
+		}
+		if op.UserID != cm.sessionManager.GetUserID() {
+			warning.TransformMS = stats.LastTransform.Milliseconds()
+		}
+	}
+	
+	log.Printf("Slow %s: %v (document %d bytes, %d ops in history)", msgType, elapsed, stats.DocumentSize, stats.HistorySize)
+	
+	if err := cm.sendEvent(protocol.MsgSlowOperation, warning); err != nil {
+		log.Printf("Failed to send slow operation warning: %v", err)
+	}
+}
+
+// Helper functions
+func createErrorMessage(code, message string) *protocol.Message {
+	errorMsg := protocol.ErrorMessage{
+		Code:    code,
+		Message: message,
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgError, errorMsg)
+	return msg
+}
+
+func createStatusMessage(status, info string) *protocol.Message {
+	statusMsg := protocol.StatusMessage{
+		Status: status,
+		Info:   info,
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgStatus, statusMsg)
+	return msg
+}
+
+// SetOutput sends the messages meant for Neovim to w instead of stdout, e.g.
+// when the engine is embedded in another program
+func (cm *CollabManager) SetOutput(w io.Writer) {
+	cm.output.setWriter(w)
+}
+
+// sendMessage sends a message to Neovim in the current wire format
+func (cm *CollabManager) sendMessage(msg *protocol.Message) error {
+	return cm.output.send(msg)
+}
+
+// respond sends a response once for each id of a request it answers, e.g.
+// after the request waited for its turn on the document
+func (cm *CollabManager) respond(response *protocol.Message, ids ...json.RawMessage) {
+	for _, id := range ids {
+		answer := *response
+		answer.ID = id
+		if err := cm.sendMessage(&answer); err != nil {
+			log.Printf("Failed to send response: %v", err)
+		}
+	}
+}
+
+// Pipeline returns the hooks run around messages and operations, for
+// embedders to register their own
+func (cm *CollabManager) Pipeline() *Pipeline {
+	return cm.pipeline
+}
+
+// Run handles messages read line by line from input, sending responses to
+// the output, until input ends
+func (cm *CollabManager) Run(input io.Reader) error {
+	cm.sendHello()
+	
+	queue := make(chan []byte, inputQueueSize)
+	readErr := make(chan error, 1)
+	go func() { readErr <- cm.readInput(input, queue) }()
+	if cm.config.path != "" {
+		go cm.watchConfig(cm.config.path)
+	}
+	
+	// Main message processing loop. A line read ahead while collecting a
+	// burst of operations is handled next.
+	var next []byte
+	for {
+		line := next
+		next = nil
+		if line == nil {
+			var ok bool
+			select {
+			case line, ok = <-queue:
+			case <-cm.configChanged:
+				cm.sendConfigReloaded(cm.reloadConfig())
+				continue
+			case call := <-cm.loopCalls:
+				call()
+				continue
+			}
+			if !ok {
+				break
+			}
+		}
+		cm.inputFlow.update(len(queue))
+		ctx, span := telemetry.Tracer.Start(context.Background(), "collab.message")
+		
+		// Parse incoming message
+		_, parseSpan := telemetry.Tracer.Start(ctx, "collab.parse", trace.WithAttributes(telemetry.AttrPayloadBytes.Int(len(line))))
+		msg, err := protocol.ParseMessage(line)
+		telemetry.EndSpan(parseSpan, err)
+		if err != nil {
+			log.Printf("Failed to parse message: %v", err)
+			errorMsg := createErrorMessage("parse_error", err.Error())
+			cm.sendMessage(errorMsg)
+			telemetry.EndSpan(span, err)
+			continue
+		}
+		
+		if msg.Type == protocol.MsgDocumentOperation {
+			msg, next = cm.collectBurst(msg, queue)
+		}
+		span.SetAttributes(telemetry.AttrMessageType.String(msg.Type))
+		
+		// Process message and get response
+		response := cm.HandleMessage(ctx, msg)
+		
+		// Send response back to Neovim
+		_, respondSpan := telemetry.Tracer.Start(ctx, "collab.respond")
+		err = cm.sendMessage(response)
+		telemetry.EndSpan(respondSpan, err)
+		if err != nil {
+			log.Printf("Failed to send response: %v", err)
+		}
+		span.End()
+		
+		cm.checkMemoryBudget()
+	}
+	
+	return <-readErr
+}
+
+// onLoop runs f on the message loop between messages
+func (cm *CollabManager) onLoop(f func()) {
+	cm.loopCalls <- f
+}
+
+// Close ends the current session's background work and closes the store
+func (cm *CollabManager) Close() {
+	// TODO: Cleanup connections, save state, etc.
+	cm.closeOpLog()
+	cm.presence.Close()
+	close(cm.stopClockProbes)
+	close(cm.stopDigests)
+	close(cm.stopLatency)
+	close(cm.stopFrontiers)
+	cm.sessionClock.Stop()
+	if err := cm.sessionManager.Close(); err != nil {
+		log.Printf("Failed to close session store: %v", err)
+	}
+}
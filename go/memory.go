@@ -0,0 +1,93 @@
+package collab
+
+import (
+	"log"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Memory accounting is approximate: it counts the bytes we hold on purpose
+// (document, operation histories, buffers) rather than everything the Go
+// runtime allocates, which is reported alongside for comparison.
+const (
+	memoryCheckInterval = 5 * time.Second
+	memoryRecoverRatio  = 0.8 // pressure clears below this fraction of the budget
+)
+
+func (cm *CollabManager) memoryUsage() protocol.MemoryUsage {
+	usage := cm.syncManager.MemoryUsage()
+	usage.Network = cm.p2pManager.MemoryUsage()
+	usage.Total = usage.Document + usage.Operations + usage.History + usage.Buffers + usage.Network
+	
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	usage.Heap = int64(stats.HeapAlloc)
+	return usage
+}
+
+// setMemoryBudget applies the budget, also using it as the runtime's soft
+// memory limit so the GC works harder before the process balloons
+func (cm *CollabManager) setMemoryBudget(budgetMB int) {
+	if budgetMB <= 0 {
+		return
+	}
+	cm.memoryBudget = int64(budgetMB) * 1024 * 1024
+	debug.SetMemoryLimit(cm.memoryBudget)
+}
+
+// checkMemoryBudget degrades gracefully when tracked memory exceeds the
+// budget: compact the op log, release caches, and tell Neovim about it.
+// It runs on the message loop so it never races with operation handling.
+func (cm *CollabManager) checkMemoryBudget() {
+	if cm.memoryBudget <= 0 || time.Since(cm.lastMemoryCheck) < memoryCheckInterval {
+		return
+	}
+	cm.lastMemoryCheck = time.Now()
+	
+	usage := cm.memoryUsage()
+	if usage.Total <= cm.memoryBudget {
+		if cm.memoryPressure && float64(usage.Total) < float64(cm.memoryBudget)*memoryRecoverRatio {
+			cm.memoryPressure = false
+			cm.sendMemoryPressure(protocol.MemoryPressureNormal, usage, nil)
+		}
+		return
+	}
+	
+	actions := make([]string, 0, 3)
+	if cm.opLog != nil {
+		if err := cm.opLog.Compact(); err != nil {
+			log.Printf("Memory pressure: op log compaction failed: %v", err)
+		} else {
+			actions = append(actions, "compacted_op_log")
+		}
+	}
+	cm.syncManager.ReleaseMemory()
+	actions = append(actions, "trimmed_history")
+	cm.p2pManager.ReleaseMemory()
+	actions = append(actions, "expired_partial_messages")
+	debug.FreeOSMemory()
+	
+	after := cm.memoryUsage()
+	log.Printf("Memory pressure: %d bytes tracked against a %d byte budget, %d after trimming", usage.Total, cm.memoryBudget, after.Total)
+	
+	// Only announce the transition; trimming repeats quietly while it lasts
+	if !cm.memoryPressure {
+		cm.memoryPressure = true
+		cm.sendMemoryPressure(protocol.MemoryPressureHigh, after, actions)
+	}
+}
+
+func (cm *CollabManager) sendMemoryPressure(level string, usage protocol.MemoryUsage, actions []string) {
+	msg, _ := protocol.NewMessage(protocol.MsgMemoryPressure, protocol.MemoryPressureEvent{
+		Level:   level,
+		Budget:  cm.memoryBudget,
+		Usage:   usage,
+		Actions: actions,
+	})
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send memory pressure event: %v", err)
+	}
+}
@@ -0,0 +1,391 @@
+package collab
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Cross-cutting behaviour runs as hooks around the handlers instead of inside
+// them. Message hooks wrap every message from Neovim and from peers, and
+// operation hooks wrap every operation applied to the document. Before hooks
+// run in the order they were registered and any of them can veto; after hooks
+// run in reverse, like unwinding middleware, and also see vetoed messages.
+// Handlers are registered with the pipeline by message type, so a new type of
+// message is one more registration rather than another case in a switch.
+
+// MessageHandler answers a message from Neovim, nil for no response
+type MessageHandler func(ctx context.Context, msg *protocol.Message) *protocol.Message
+
+// PeerMessageHandler handles a message from the peer with user ID from
+type PeerMessageHandler func(from string, msg *protocol.Message)
+
+// MessageHook wraps message handling. from is "" for messages from Neovim and
+// the sender's user ID for messages from peers.
+type MessageHook struct {
+	Name string
+	
+	// Before returns an error to veto the message: Neovim gets it back as an
+	// error message, a peer's message is dropped
+	Before func(ctx context.Context, from string, msg *protocol.Message) error
+	
+	// After sees the response sent to Neovim, nil for peer messages
+	After func(ctx context.Context, from string, msg *protocol.Message, response *protocol.Message)
+}
+
+// OperationHook wraps applying an operation to the document
+type OperationHook struct {
+	Name string
+	
+	// Before may adjust the operation, or return an error to veto it
+	Before func(ctx context.Context, op *protocol.Operation, local bool) error
+	
+	// After sees the operation and whether applying it failed
+	After func(ctx context.Context, op protocol.Operation, local bool, err error)
+}
+
+// Veto is a hook's refusal with the error code Neovim should see
+type Veto struct {
+	Code   string
+	Reason string
+}
+
+func (v *Veto) Error() string {
+	return v.Reason
+}
+
+// vetoCode returns the error code for a hook's error
+func vetoCode(err error) string {
+	var veto *Veto
+	if errors.As(err, &veto) {
+		return veto.Code
+	}
+	return "rejected"
+}
+
+// Pipeline holds the registered handlers and hooks. A nil pipeline applies
+// operations bare.
+type Pipeline struct {
+	handlers       map[string]MessageHandler
+	peerHandlers   map[string]PeerMessageHandler
+	messageHooks   []MessageHook
+	operationHooks []OperationHook
+	mutex          sync.RWMutex
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline{
+		handlers:     make(map[string]MessageHandler),
+		peerHandlers: make(map[string]PeerMessageHandler),
+	}
+}
+
+// Handle registers the handler for a type of message from Neovim, replacing
+// any handler it had
+func (p *Pipeline) Handle(msgType string, handler MessageHandler) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.handlers[msgType] = handler
+}
+
+// HandlePeer registers the handler for a type of message from peers,
+// replacing any handler it had
+func (p *Pipeline) HandlePeer(msgType string, handler PeerMessageHandler) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.peerHandlers[msgType] = handler
+}
+
+// UseMessageHook adds a hook around message handling, replacing any hook
+// with the same name
+func (p *Pipeline) UseMessageHook(hook MessageHook) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	
+	for i, existing := range p.messageHooks {
+		if existing.Name == hook.Name {
+			p.messageHooks[i] = hook
+			return
+		}
+	}
+	p.messageHooks = append(p.messageHooks, hook)
+}
+
+// UseOperationHook adds a hook around applying operations, replacing any
+// hook with the same name
+func (p *Pipeline) UseOperationHook(hook OperationHook) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	
+	for i, existing := range p.operationHooks {
+		if existing.Name == hook.Name {
+			p.operationHooks[i] = hook
+			return
+		}
+	}
+	p.operationHooks = append(p.operationHooks, hook)
+}
+
+// Remove unregisters the message and operation hooks with this name
+func (p *Pipeline) Remove(name string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	
+	messageHooks := p.messageHooks[:0:0]
+	for _, hook := range p.messageHooks {
+		if hook.Name != name {
+			messageHooks = append(messageHooks, hook)
+		}
+	}
+	operationHooks := p.operationHooks[:0:0]
+	for _, hook := range p.operationHooks {
+		if hook.Name != name {
+			operationHooks = append(operationHooks, hook)
+		}
+	}
+	p.messageHooks, p.operationHooks = messageHooks, operationHooks
+}
+
+// handleMessage runs a message through the hooks and, unless one vetoes it,
+// the handler registered for its type. Neovim gets an error for a type
+// without a handler; peers' messages of such types are ignored.
+func (p *Pipeline) handleMessage(ctx context.Context, from string, msg *protocol.Message) *protocol.Message {
+	p.mutex.RLock()
+	hooks := p.messageHooks
+	handler, peerHandler := p.handlers[msg.Type], p.peerHandlers[msg.Type]
+	p.mutex.RUnlock()
+	
+	var response *protocol.Message
+	var veto error
+	ran := 0
+	for _, hook := range hooks {
+		ran++
+		if hook.Before == nil {
+			continue
+		}
+		if veto = hook.Before(ctx, from, msg); veto != nil {
+			break
+		}
+	}
+	switch {
+	case veto != nil && from == "":
+		response = createErrorMessage(vetoCode(veto), veto.Error())
+	case veto != nil:
+		log.Printf("Dropping %s from %s: %v", msg.Type, from, veto)
+	case from != "":
+		if peerHandler != nil {
+			peerHandler(from, msg)
+		}
+	case handler != nil:
+		response = handler(ctx, msg)
+	default:
+		response = createErrorMessage("unknown_message_type", "Unknown message type: "+msg.Type)
+	}
+	
+	for i := ran - 1; i >= 0; i-- {
+		if hooks[i].After != nil {
+			hooks[i].After(ctx, from, msg, response)
+		}
+	}
+	return response
+}
+
+// ApplyOperation runs an operation through the hooks and, unless one vetoes
+// it, apply
+func (p *Pipeline) ApplyOperation(ctx context.Context, op protocol.Operation, local bool, apply func(ctx context.Context, op protocol.Operation) error) error {
+	if p == nil {
+		return apply(ctx, op)
+	}
+	p.mutex.RLock()
+	hooks := p.operationHooks
+	p.mutex.RUnlock()
+	
+	var err error
+	ran := 0
+	for _, hook := range hooks {
+		ran++
+		if hook.Before == nil {
+			continue
+		}
+		if err = hook.Before(ctx, &op, local); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = apply(ctx, op)
+	}
+	
+	for i := ran - 1; i >= 0; i-- {
+		if hooks[i].After != nil {
+			hooks[i].After(ctx, op, local, err)
+		}
+	}
+	return err
+}
+
+// loggingHooks log every message and any failure to handle it or apply an
+// operation
+func loggingHooks() (MessageHook, OperationHook) {
+	messages := MessageHook{
+		Name: "logging",
+		Before: func(ctx context.Context, from string, msg *protocol.Message) error {
+			if from == "" {
+				log.Printf("Received message: %s", msg.Type)
+			} else {
+				log.Printf("Received %s from %s", msg.Type, from)
+			}
+			return nil
+		},
+		After: func(ctx context.Context, from string, msg *protocol.Message, response *protocol.Message) {
+			if response == nil || response.Type != protocol.MsgError {
+				return
+			}
+			var failure protocol.ErrorMessage
+			if response.ParseData(&failure) == nil {
+				log.Printf("%s failed: %s (%s)", msg.Type, failure.Message, failure.Code)
+			}
+		},
+	}
+	operations := OperationHook{
+		Name: "logging",
+		After: func(ctx context.Context, op protocol.Operation, local bool, err error) {
+			if err != nil {
+				log.Printf("Failed to apply %s operation by %s: %v", op.Type, op.UserID, err)
+			}
+		},
+	}
+	return messages, operations
+}
+
+// validationHooks refuse malformed messages and operations before any
+// handler sees them
+func validationHooks() (MessageHook, OperationHook) {
+	messages := MessageHook{
+		Name: "validation",
+		Before: func(ctx context.Context, from string, msg *protocol.Message) error {
+			if msg.Type == "" {
+				return &Veto{Code: "invalid_message", Reason: "message has no type"}
+			}
+			// Lua encodes an empty table as an empty array
+			switch data := string(msg.Data); {
+			case data == "", data == "null", data == "[]", data[0] == '{':
+			default:
+				return &Veto{Code: "invalid_message", Reason: msg.Type + " data must be an object"}
+			}
+			return nil
+		},
+	}
+	operations := OperationHook{
+		Name: "validation",
+		Before: func(ctx context.Context, op *protocol.Operation, local bool) error {
+			switch op.Type {
+			case protocol.OpInsert, protocol.OpDelete, protocol.OpReplace:
+			default:
+				return fmt.Errorf("unknown operation type %q", op.Type)
+			}
+			if op.Position < 0 || op.Length < 0 {
+				return fmt.Errorf("operation range %d+%d is negative", op.Position, op.Length)
+			}
+			if !validProvenance(op.Provenance) {
+				return fmt.Errorf("invalid operation provenance %q", op.Provenance)
+			}
+			return nil
+		},
+	}
+	return messages, operations
+}
+
+// maxProvenanceLength bounds an operation's provenance tag
+const maxProvenanceLength = 32
+
+// validProvenance reports whether a provenance tag is empty or a short name
+// of lowercase letters, digits and ".", "_", ":" or "-"
+func validProvenance(tag string) bool {
+	if len(tag) > maxProvenanceLength {
+		return false
+	}
+	for _, c := range tag {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '_', c == ':', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// RateLimit caps how many messages each peer may send
+type RateLimit struct {
+	PerSecond float64 `json:"per_second,omitempty"`
+	Burst     int     `json:"burst,omitempty"`
+}
+
+// defaultPeerRateLimit leaves room for fast typing and pasting in bursts;
+// presence frames aren't counted
+var defaultPeerRateLimit = RateLimit{PerSecond: 200, Burst: 400}
+
+// PeerRateLimiter drops messages from peers sending faster than the limit.
+// Neovim's own messages aren't limited.
+type PeerRateLimiter struct {
+	limit   RateLimit
+	buckets map[string]*tokenBucket
+	mutex   sync.Mutex
+}
+
+func NewPeerRateLimiter(limit RateLimit) *PeerRateLimiter {
+	rl := &PeerRateLimiter{buckets: make(map[string]*tokenBucket)}
+	rl.SetLimit(limit)
+	return rl
+}
+
+// SetLimit changes the limit for every peer. Buckets keep their tokens, so a
+// peer's burst changes as its bucket refills.
+func (rl *PeerRateLimiter) SetLimit(limit RateLimit) {
+	if limit.PerSecond <= 0 {
+		limit.PerSecond = defaultPeerRateLimit.PerSecond
+	}
+	if limit.Burst <= 0 {
+		limit.Burst = defaultPeerRateLimit.Burst
+	}
+	
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.limit = limit
+}
+
+// Hook returns the limiter as a message hook
+func (rl *PeerRateLimiter) Hook() MessageHook {
+	return MessageHook{
+		Name: "rate_limit",
+		Before: func(ctx context.Context, from string, msg *protocol.Message) error {
+			if from == "" {
+				return nil
+			}
+			
+			rl.mutex.Lock()
+			defer rl.mutex.Unlock()
+			
+			bucket, exists := rl.buckets[from]
+			if !exists {
+				bucket = &tokenBucket{}
+				rl.buckets[from] = bucket
+			}
+			if !bucket.take(rl.limit.PerSecond, rl.limit.Burst, time.Now()) {
+				return fmt.Errorf("sending faster than %g messages per second", rl.limit.PerSecond)
+			}
+			return nil
+		},
+	}
+}
+
+// Forget drops a peer's rate state, e.g. when it leaves
+func (rl *PeerRateLimiter) Forget(userID string) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	delete(rl.buckets, userID)
+}
@@ -0,0 +1,50 @@
+package collab
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+func TestPipelineDispatchesByType(t *testing.T) {
+	cm, _ := newTestManager(t)
+	cm.Pipeline().Handle("test_ping", func(ctx context.Context, msg *protocol.Message) *protocol.Message {
+		return createStatusMessage("pong", "")
+	})
+	var from []string
+	cm.Pipeline().HandlePeer("test_ping", func(userID string, msg *protocol.Message) {
+		from = append(from, userID)
+	})
+	
+	msg, _ := protocol.NewMessage("test_ping", nil)
+	msg.ID = []byte("1")
+	var status protocol.StatusMessage
+	response := cm.HandleMessage(context.Background(), msg)
+	if response == nil || response.ParseData(&status) != nil || status.Status != "pong" || string(response.ID) != "1" {
+		t.Fatalf("response = %v, want the registered handler's answer", response)
+	}
+	
+	unknown, _ := protocol.NewMessage("test_unknown", nil)
+	var failure protocol.ErrorMessage
+	if response := cm.HandleMessage(context.Background(), unknown); response == nil || response.ParseData(&failure) != nil || failure.Code != "unknown_message_type" {
+		t.Errorf("unregistered type answered %v, want unknown_message_type", response)
+	}
+	
+	// Peers' messages go to the peer handler, after the hooks
+	cm.Pipeline().UseMessageHook(MessageHook{
+		Name: "test_veto",
+		Before: func(ctx context.Context, userID string, msg *protocol.Message) error {
+			if userID == "mallory" {
+				return &Veto{Code: "test", Reason: "not listening"}
+			}
+			return nil
+		},
+	})
+	data, _ := msg.ToJSON()
+	cm.handlePeerMessage("bob", data)
+	cm.handlePeerMessage("mallory", data)
+	if len(from) != 1 || from[0] != "bob" {
+		t.Errorf("peer handler saw messages from %v, want only bob", from)
+	}
+}
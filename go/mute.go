@@ -0,0 +1,101 @@
+package collab
+
+import (
+	"log"
+	"sync"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+)
+
+// Muting a peer hides their chat and cursor from the local user only; their
+// edits still apply, since the document has to stay in sync. The backend
+// drops what is muted as it arrives, so none of it reaches Neovim. Muting
+// also takes the peer's cursor off the presence Neovim was last sent.
+type PeerMutes struct {
+	users map[string]bool
+	mutex sync.Mutex
+}
+
+func NewPeerMutes() *PeerMutes {
+	return &PeerMutes{users: make(map[string]bool)}
+}
+
+// Mute reports false if userID was muted already
+func (mt *PeerMutes) Mute(userID string) bool {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	
+	muted := mt.users[userID]
+	mt.users[userID] = true
+	return !muted
+}
+
+// Unmute reports false if userID wasn't muted
+func (mt *PeerMutes) Unmute(userID string) bool {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	
+	muted := mt.users[userID]
+	delete(mt.users, userID)
+	return muted
+}
+
+func (mt *PeerMutes) Muted(userID string) bool {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	return mt.users[userID]
+}
+
+func (mt *PeerMutes) Reset() {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	mt.users = make(map[string]bool)
+}
+
+func (cm *CollabManager) handleMutePeer(req *protocol.MutePeerRequest) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	userID, err := findPeer(session, req.UserID)
+	if err != nil {
+		return createErrorMessage("mute_peer_failed", err.Error())
+	}
+	return cm.mutePeer(session, userID)
+}
+
+func (cm *CollabManager) handleUnmutePeer(req *protocol.MutePeerRequest) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	userID, err := findPeer(session, req.UserID)
+	if err != nil {
+		return createErrorMessage("unmute_peer_failed", err.Error())
+	}
+	return cm.unmutePeer(session, userID)
+}
+
+// mutePeer stops passing a member's chat and cursor on to Neovim
+func (cm *CollabManager) mutePeer(session *session.Session, userID string) *protocol.Message {
+	if userID == cm.sessionManager.GetUserID() {
+		return createErrorMessage("mute_peer_failed", "You can't mute yourself")
+	}
+	if !cm.mutes.Mute(userID) {
+		return createErrorMessage("mute_peer_failed", peerName(session, userID)+" is muted already")
+	}
+	cm.presence.Remove(userID)
+	log.Printf("Muted %s", userID)
+	return createStatusMessage("peer_muted", userID)
+}
+
+// unmutePeer passes a member's chat and cursor on again, from their next
+// message on
+func (cm *CollabManager) unmutePeer(session *session.Session, userID string) *protocol.Message {
+	if !cm.mutes.Unmute(userID) {
+		return createErrorMessage("unmute_peer_failed", peerName(session, userID)+" wasn't muted")
+	}
+	log.Printf("Unmuted %s", userID)
+	return createStatusMessage("peer_unmuted", userID)
+}
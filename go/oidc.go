@@ -0,0 +1,641 @@
+package collab
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Users can sign in with the organization's OpenID Connect provider so the
+// server and relay know who they are. Neovim can't host a redirect, so the
+// client uses the device authorization flow (RFC 8628): the user opens a URL
+// and enters a short code while the backend polls for the tokens. The ID
+// token is then presented to the server, which verifies it against the
+// provider's keys and records the verified name and email instead of the
+// random per-run user ID.
+const (
+	oidcRequestTimeout = 10 * time.Second
+	oidcDefaultPoll    = 5 * time.Second
+	oidcRefreshMargin  = time.Minute
+	oidcKeyRefetch     = time.Minute
+	oidcMaxResponse    = 1024 * 1024
+)
+
+// OIDCConfig names the provider and the client registered with it. The
+// server uses the same settings to check tokens were issued for this client.
+type OIDCConfig struct {
+	Issuer       string   `json:"issuer,omitempty"`
+	ClientID     string   `json:"client_id,omitempty"`
+	ClientSecret string   `json:"client_secret,omitempty"` // only for providers that require one for device flow
+	Scopes       []string `json:"scopes,omitempty"`        // defaults to openid, profile, email, offline_access
+}
+
+func (c OIDCConfig) enabled() bool {
+	return c.Issuer != ""
+}
+
+func (c OIDCConfig) Validate() error {
+	if c.Issuer == "" {
+		return nil
+	}
+	u, err := url.Parse(c.Issuer)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid issuer %q", c.Issuer)
+	}
+	if u.Scheme != "https" && u.Hostname() != "localhost" {
+		return fmt.Errorf("issuer must use https, got %s", c.Issuer)
+	}
+	if c.ClientID == "" {
+		return fmt.Errorf("client_id is required with an issuer")
+	}
+	return nil
+}
+
+// Identity is a verified user
+type Identity struct {
+	Subject string `json:"subject"`
+	Email   string `json:"email,omitempty"`
+	Name    string `json:"name,omitempty"`
+}
+
+// Label is how the identity appears in logs: the email when there is one
+func (id Identity) Label() string {
+	if id.Email != "" {
+		return id.Email
+	}
+	return id.Subject
+}
+
+// oidcDiscovery is the part of the provider's metadata used here
+type oidcDiscovery struct {
+	Issuer                      string `json:"issuer"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	JWKSURI                     string `json:"jwks_uri"`
+}
+
+func discoverOIDC(client *http.Client, issuer string) (*oidcDiscovery, error) {
+	var discovery oidcDiscovery
+	endpoint := strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(client, endpoint, &discovery); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %v", err)
+	}
+	if strings.TrimRight(discovery.Issuer, "/") != strings.TrimRight(issuer, "/") {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %s, expected %s", discovery.Issuer, issuer)
+	}
+	return &discovery, nil
+}
+
+func getJSON(client *http.Client, endpoint string, v interface{}) error {
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponse)).Decode(v)
+}
+
+// idTokenClaims are the ID token claims used here
+type idTokenClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Email     string   `json:"email"`
+	Verified  *bool    `json:"email_verified"`
+	Name      string   `json:"name"`
+}
+
+// audience is a single string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, value := range a {
+		if value == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+func (c idTokenClaims) identity() Identity {
+	id := Identity{Subject: c.Subject, Name: c.Name}
+	// An email the provider hasn't verified doesn't identify anyone
+	if c.Verified == nil || *c.Verified {
+		id.Email = c.Email
+	}
+	return id
+}
+
+// splitJWT decodes a compact JWT without checking its signature
+func splitJWT(token string) (header map[string]string, claims idTokenClaims, signed, signature []byte, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, claims, nil, nil, fmt.Errorf("malformed token")
+	}
+	decode := base64.RawURLEncoding.DecodeString
+	
+	rawHeader, err := decode(parts[0])
+	if err != nil {
+		return nil, claims, nil, nil, fmt.Errorf("malformed token header")
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, claims, nil, nil, fmt.Errorf("malformed token header")
+	}
+	rawClaims, err := decode(parts[1])
+	if err != nil {
+		return nil, claims, nil, nil, fmt.Errorf("malformed token claims")
+	}
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return nil, claims, nil, nil, fmt.Errorf("malformed token claims")
+	}
+	signature, err = decode(parts[2])
+	if err != nil {
+		return nil, claims, nil, nil, fmt.Errorf("malformed token signature")
+	}
+	return header, claims, []byte(parts[0] + "." + parts[1]), signature, nil
+}
+
+// checkClaims validates who issued the token, for whom, and when
+func checkClaims(claims idTokenClaims, config OIDCConfig, now time.Time) error {
+	if strings.TrimRight(claims.Issuer, "/") != strings.TrimRight(config.Issuer, "/") {
+		return fmt.Errorf("token issued by %s, not %s", claims.Issuer, config.Issuer)
+	}
+	if !claims.Audience.contains(config.ClientID) {
+		return fmt.Errorf("token not issued for client %s", config.ClientID)
+	}
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0)) {
+		return fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0)) {
+		return fmt.Errorf("token not valid yet")
+	}
+	if claims.Subject == "" {
+		return fmt.Errorf("token has no subject")
+	}
+	return nil
+}
+
+// jsonWebKey is one key of the provider's JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(data), nil
+	}
+	
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// OIDCVerifier checks ID tokens on the server
+type OIDCVerifier struct {
+	config     OIDCConfig
+	httpClient *http.Client
+	jwksURI    string
+	
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	mutex     sync.Mutex
+}
+
+func NewOIDCVerifier(config OIDCConfig, httpClient *http.Client) (*OIDCVerifier, error) {
+	discovery, err := discoverOIDC(httpClient, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	verifier := &OIDCVerifier{config: config, httpClient: httpClient, jwksURI: discovery.JWKSURI}
+	if err := verifier.fetchKeys(); err != nil {
+		return nil, err
+	}
+	return verifier, nil
+}
+
+// fetchKeys reloads the provider's signing keys. Caller holds mutex or is
+// the constructor.
+func (v *OIDCVerifier) fetchKeys() error {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(v.httpClient, v.jwksURI, &jwks); err != nil {
+		return fmt.Errorf("failed to fetch OIDC keys: %v", err)
+	}
+	
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	return nil
+}
+
+// key returns the signing key for kid, refetching the key set when the
+// provider has rotated keys since the last fetch
+func (v *OIDCVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(v.fetchedAt) > oidcKeyRefetch {
+		if err := v.fetchKeys(); err != nil {
+			return nil, err
+		}
+		if key, ok := v.keys[kid]; ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// Verify checks an ID token's signature and claims and returns who it names
+func (v *OIDCVerifier) Verify(token string) (Identity, error) {
+	header, claims, signed, signature, err := splitJWT(token)
+	if err != nil {
+		return Identity{}, err
+	}
+	key, err := v.key(header["kid"])
+	if err != nil {
+		return Identity{}, err
+	}
+	
+	digest := sha256.Sum256(signed)
+	switch header["alg"] {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) != nil {
+			return Identity{}, fmt.Errorf("invalid token signature")
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return Identity{}, fmt.Errorf("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return Identity{}, fmt.Errorf("invalid token signature")
+		}
+	default:
+		return Identity{}, fmt.Errorf("unsupported token algorithm %q", header["alg"])
+	}
+	
+	if err := checkClaims(claims, v.config, time.Now()); err != nil {
+		return Identity{}, err
+	}
+	return claims.identity(), nil
+}
+
+// deviceAuthorization is the provider's answer to a device login request
+type deviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// tokenResponse is a token endpoint response, successful or not
+type tokenResponse struct {
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+// OIDCClient signs the local user in and keeps their ID token fresh
+type OIDCClient struct {
+	config     OIDCConfig
+	httpClient *http.Client
+	
+	identity     *Identity
+	idToken      string
+	refreshToken string
+	expiresAt    time.Time
+	cancelLogin  context.CancelFunc
+	mutex        sync.Mutex
+}
+
+func NewOIDCClient(config OIDCConfig, httpClient *http.Client) *OIDCClient {
+	return &OIDCClient{config: config, httpClient: httpClient}
+}
+
+func (oc *OIDCClient) scopes() string {
+	if len(oc.config.Scopes) > 0 {
+		return strings.Join(oc.config.Scopes, " ")
+	}
+	return "openid profile email offline_access"
+}
+
+// StartLogin begins a device login and calls done from another goroutine
+// once the user has approved it, it was denied, or it timed out
+func (oc *OIDCClient) StartLogin(done func(*Identity, error)) (*deviceAuthorization, error) {
+	discovery, err := discoverOIDC(oc.httpClient, oc.config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	if discovery.DeviceAuthorizationEndpoint == "" {
+		return nil, fmt.Errorf("%s does not support device login", oc.config.Issuer)
+	}
+	
+	var auth deviceAuthorization
+	form := url.Values{"client_id": {oc.config.ClientID}, "scope": {oc.scopes()}}
+	if err := oc.postForm(discovery.DeviceAuthorizationEndpoint, form, &auth); err != nil {
+		return nil, fmt.Errorf("device login failed: %v", err)
+	}
+	if auth.DeviceCode == "" || auth.UserCode == "" {
+		return nil, fmt.Errorf("device login failed: incomplete response")
+	}
+	
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(auth.ExpiresIn)*time.Second)
+	oc.mutex.Lock()
+	if oc.cancelLogin != nil {
+		oc.cancelLogin()
+	}
+	oc.cancelLogin = cancel
+	oc.mutex.Unlock()
+	
+	go func() {
+		defer cancel()
+		identity, err := oc.pollToken(ctx, discovery.TokenEndpoint, auth)
+		if ctx.Err() == context.Canceled {
+			return // superseded by another login or a logout
+		}
+		done(identity, err)
+	}()
+	return &auth, nil
+}
+
+// pollToken waits for the user to approve the login
+func (oc *OIDCClient) pollToken(ctx context.Context, tokenEndpoint string, auth deviceAuthorization) (*Identity, error) {
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = oidcDefaultPoll
+	}
+	
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("login was not approved in time")
+		case <-time.After(interval):
+		}
+		
+		var tokens tokenResponse
+		err := oc.postForm(tokenEndpoint, url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {auth.DeviceCode},
+			"client_id":   {oc.config.ClientID},
+		}, &tokens)
+		if err != nil && tokens.Error == "" {
+			return nil, err
+		}
+		
+		switch tokens.Error {
+		case "":
+			return oc.accept(tokens)
+		case "authorization_pending":
+		case "slow_down":
+			interval += oidcDefaultPoll
+		default:
+			if tokens.Description != "" {
+				return nil, fmt.Errorf("login failed: %s", tokens.Description)
+			}
+			return nil, fmt.Errorf("login failed: %s", tokens.Error)
+		}
+	}
+}
+
+// accept stores a token response after checking its ID token's claims. The
+// token came straight from the provider over TLS, so its signature is left
+// to the server.
+func (oc *OIDCClient) accept(tokens tokenResponse) (*Identity, error) {
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("provider returned no ID token; is the openid scope allowed?")
+	}
+	_, claims, _, _, err := splitJWT(tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkClaims(claims, oc.config, time.Now()); err != nil {
+		return nil, err
+	}
+	
+	identity := claims.identity()
+	oc.mutex.Lock()
+	defer oc.mutex.Unlock()
+	oc.identity = &identity
+	oc.idToken = tokens.IDToken
+	if tokens.RefreshToken != "" {
+		oc.refreshToken = tokens.RefreshToken
+	}
+	oc.expiresAt = time.Unix(claims.ExpiresAt, 0)
+	return &identity, nil
+}
+
+// IDToken returns a current ID token, refreshing it when it is about to
+// expire. It is empty when the user hasn't signed in.
+func (oc *OIDCClient) IDToken() (string, error) {
+	oc.mutex.Lock()
+	token, refresh, expiresAt := oc.idToken, oc.refreshToken, oc.expiresAt
+	oc.mutex.Unlock()
+	
+	if token == "" || time.Until(expiresAt) > oidcRefreshMargin {
+		return token, nil
+	}
+	if refresh == "" {
+		return "", fmt.Errorf("sign-in expired; log in again")
+	}
+	
+	discovery, err := discoverOIDC(oc.httpClient, oc.config.Issuer)
+	if err != nil {
+		return "", err
+	}
+	var tokens tokenResponse
+	err = oc.postForm(discovery.TokenEndpoint, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refresh},
+		"client_id":     {oc.config.ClientID},
+		"scope":         {oc.scopes()},
+	}, &tokens)
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh sign-in: %v", err)
+	}
+	if _, err := oc.accept(tokens); err != nil {
+		return "", fmt.Errorf("failed to refresh sign-in: %v", err)
+	}
+	log.Printf("Refreshed OIDC sign-in")
+	
+	oc.mutex.Lock()
+	defer oc.mutex.Unlock()
+	return oc.idToken, nil
+}
+
+// Identity returns the signed-in user, or nil
+func (oc *OIDCClient) Identity() *Identity {
+	oc.mutex.Lock()
+	defer oc.mutex.Unlock()
+	return oc.identity
+}
+
+// Logout forgets the tokens and stops a pending login
+func (oc *OIDCClient) Logout() {
+	oc.mutex.Lock()
+	defer oc.mutex.Unlock()
+	
+	if oc.cancelLogin != nil {
+		oc.cancelLogin()
+		oc.cancelLogin = nil
+	}
+	oc.identity = nil
+	oc.idToken = ""
+	oc.refreshToken = ""
+}
+
+// postForm posts to a provider endpoint and decodes the JSON reply. Error
+// replies are decoded too, since token errors are part of the device flow.
+func (oc *OIDCClient) postForm(endpoint string, form url.Values, v interface{}) error {
+	if oc.config.ClientSecret != "" {
+		form.Set("client_secret", oc.config.ClientSecret)
+	}
+	resp, err := oc.httpClient.PostForm(endpoint, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponse)).Decode(v)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	return decodeErr
+}
+
+func (cm *CollabManager) handleLogin() *protocol.Message {
+	if cm.oidc == nil {
+		return createErrorMessage("oidc_not_configured", "login requires oidc issuer and client_id in the config file")
+	}
+	
+	auth, err := cm.oidc.StartLogin(func(identity *Identity, err error) {
+		var msg *protocol.Message
+		if err != nil {
+			msg = createErrorMessage("login_failed", err.Error())
+		} else {
+			log.Printf("Signed in as %s", identity.Label())
+			msg, _ = protocol.NewMessage(protocol.MsgLoggedIn, identity)
+		}
+		if err := cm.sendMessage(msg); err != nil {
+			log.Printf("Failed to send login result: %v", err)
+		}
+	})
+	if err != nil {
+		return createErrorMessage("login_failed", err.Error())
+	}
+	
+	msg, _ := protocol.NewMessage(protocol.MsgLoginPending, protocol.LoginPendingResponse{
+		UserCode:                auth.UserCode,
+		VerificationURI:         auth.VerificationURI,
+		VerificationURIComplete: auth.VerificationURIComplete,
+		ExpiresAt:               time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second),
+	})
+	return msg
+}
+
+func (cm *CollabManager) handleLogout() *protocol.Message {
+	if cm.oidc != nil {
+		cm.oidc.Logout()
+	}
+	return createStatusMessage("logged_out", "Signed out")
+}
+
+// idToken returns the token to present to the server and relay, if signed in
+func (cm *CollabManager) idToken() string {
+	if cm.oidc == nil {
+		return ""
+	}
+	token, err := cm.oidc.IDToken()
+	if err != nil {
+		log.Printf("Connecting without sign-in: %v", err)
+	}
+	return token
+}
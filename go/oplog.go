@@ -0,0 +1,449 @@
+package collab
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// The op log persists every applied operation for a session as JSON lines in
+// numbered segment files. Once enough segments are sealed, a background pass
+// folds them into a snapshot of the document and deletes them, so disk use
+// tracks the document size rather than the session length.
+//
+//	<dir>/<session>/snapshot-000003.json   content after segments 1..3
+//	<dir>/<session>/segment-000004.log     operations since then
+const (
+	opLogSegmentMaxBytes   = 4 * 1024 * 1024
+	opLogCompactInterval   = time.Minute
+	opLogCompactAfterCount = 4 // sealed segments before compaction kicks in
+	
+	opLogSegmentPrefix  = "segment-"
+	opLogSnapshotPrefix = "snapshot-"
+)
+
+// opLogSnapshot is the document state after every segment up to Segment
+type opLogSnapshot struct {
+	Segment   int       `json:"segment"`
+	Content   string    `json:"content"`
+	OpCount   int64     `json:"op_count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OpLog struct {
+	dir          string
+	segment      *os.File
+	writer       *bufio.Writer
+	segmentIndex int
+	segmentSize  int64
+	opCount      int64
+	
+	mutex        sync.Mutex
+	compactMutex sync.Mutex
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// OpenOpLog opens the log for a session under dir, creating it with
+// baseContent as the initial snapshot. An existing log is appended to.
+func OpenOpLog(dir, sessionID, baseContent string) (*OpLog, error) {
+	sessionDir := filepath.Join(dir, sessionID)
+	if err := os.MkdirAll(sessionDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create op log directory: %v", err)
+	}
+	
+	l := &OpLog{
+		dir:  sessionDir,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	
+	snapshot, err := l.latestSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		snapshot = &opLogSnapshot{Segment: 0, Content: baseContent, CreatedAt: time.Now()}
+		if err := l.writeSnapshot(snapshot); err != nil {
+			return nil, err
+		}
+	}
+	l.opCount = snapshot.OpCount
+	
+	// Continue after the newest segment, counting the operations it holds
+	segments, err := l.segmentIndexes()
+	if err != nil {
+		return nil, err
+	}
+	next := snapshot.Segment + 1
+	for _, index := range segments {
+		if index <= snapshot.Segment {
+			continue
+		}
+		ops, err := l.readSegment(index)
+		if err != nil {
+			return nil, err
+		}
+		l.opCount += int64(len(ops))
+		next = index + 1
+	}
+	
+	if err := l.openSegment(next); err != nil {
+		return nil, err
+	}
+	
+	go l.runCompaction()
+	return l, nil
+}
+
+// Append writes an operation to the current segment, rotating when it's full
+func (l *OpLog) Append(op protocol.Operation) error {
+	line, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	
+	if l.writer == nil {
+		return fmt.Errorf("op log is closed")
+	}
+	
+	if l.segmentSize > 0 && l.segmentSize+int64(len(line)) > opLogSegmentMaxBytes {
+		if err := l.openSegment(l.segmentIndex + 1); err != nil {
+			return err
+		}
+	}
+	
+	if _, err := l.writer.Write(line); err != nil {
+		return fmt.Errorf("failed to append to op log: %v", err)
+	}
+	if err := l.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to append to op log: %v", err)
+	}
+	
+	l.segmentSize += int64(len(line))
+	l.opCount++
+	return nil
+}
+
+// Replay returns the latest snapshot's content and the operations logged
+// after it, in order
+func (l *OpLog) Replay() (string, []protocol.Operation, error) {
+	l.compactMutex.Lock()
+	defer l.compactMutex.Unlock()
+	
+	l.mutex.Lock()
+	current := l.segmentIndex
+	l.mutex.Unlock()
+	
+	return l.replayThrough(current)
+}
+
+// Recover rebuilds the document as of the last logged operation
+func (l *OpLog) Recover() (string, int64, error) {
+	content, ops, err := l.Replay()
+	if err != nil {
+		return "", 0, err
+	}
+	for _, op := range ops {
+		content = collabsync.ApplyOperationToContent(content, op)
+	}
+	
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return content, l.opCount, nil
+}
+
+// Compact folds every sealed segment into a new snapshot and deletes them
+func (l *OpLog) Compact() error {
+	l.compactMutex.Lock()
+	defer l.compactMutex.Unlock()
+	
+	l.mutex.Lock()
+	lastSealed := l.segmentIndex - 1
+	l.mutex.Unlock()
+	
+	snapshot, err := l.latestSnapshot()
+	if err != nil {
+		return err
+	}
+	if snapshot == nil || lastSealed <= snapshot.Segment {
+		return nil
+	}
+	
+	content, ops, err := l.replayThrough(lastSealed)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		content = collabsync.ApplyOperationToContent(content, op)
+	}
+	
+	compacted := &opLogSnapshot{
+		Segment:   lastSealed,
+		Content:   content,
+		OpCount:   snapshot.OpCount + int64(len(ops)),
+		CreatedAt: time.Now(),
+	}
+	if err := l.writeSnapshot(compacted); err != nil {
+		return err
+	}
+	
+	// The new snapshot is durable, so everything it covers can go
+	segments, err := l.segmentIndexes()
+	if err != nil {
+		return err
+	}
+	for _, index := range segments {
+		if index <= lastSealed {
+			os.Remove(l.segmentPath(index))
+		}
+	}
+	snapshots, err := l.snapshotIndexes()
+	if err != nil {
+		return err
+	}
+	for _, index := range snapshots {
+		if index < lastSealed {
+			os.Remove(l.snapshotPath(index))
+		}
+	}
+	
+	log.Printf("Compacted op log %s through segment %d (%d operations)", l.dir, lastSealed, compacted.OpCount)
+	return nil
+}
+
+// Close stops background compaction and closes the current segment
+func (l *OpLog) Close() error {
+	close(l.stop)
+	<-l.done
+	
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	
+	if l.writer == nil {
+		return nil
+	}
+	l.writer.Flush()
+	err := l.segment.Close()
+	l.writer = nil
+	l.segment = nil
+	return err
+}
+
+func (l *OpLog) runCompaction() {
+	defer close(l.done)
+	
+	ticker := time.NewTicker(opLogCompactInterval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-ticker.C:
+			if l.sealedSegments() < opLogCompactAfterCount {
+				continue
+			}
+			if err := l.Compact(); err != nil {
+				log.Printf("Op log compaction failed: %v", err)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *OpLog) sealedSegments() int {
+	segments, err := l.segmentIndexes()
+	if err != nil {
+		return 0
+	}
+	
+	l.mutex.Lock()
+	current := l.segmentIndex
+	l.mutex.Unlock()
+	
+	sealed := 0
+	for _, index := range segments {
+		if index < current {
+			sealed++
+		}
+	}
+	return sealed
+}
+
+// replayThrough loads the latest snapshot and the operations in segments
+// after it up to and including last. Caller holds compactMutex.
+func (l *OpLog) replayThrough(last int) (string, []protocol.Operation, error) {
+	snapshot, err := l.latestSnapshot()
+	if err != nil {
+		return "", nil, err
+	}
+	if snapshot == nil {
+		return "", nil, fmt.Errorf("op log %s has no snapshot", l.dir)
+	}
+	
+	segments, err := l.segmentIndexes()
+	if err != nil {
+		return "", nil, err
+	}
+	
+	ops := make([]protocol.Operation, 0)
+	for _, index := range segments {
+		if index <= snapshot.Segment || index > last {
+			continue
+		}
+		segmentOps, err := l.readSegment(index)
+		if err != nil {
+			return "", nil, err
+		}
+		ops = append(ops, segmentOps...)
+	}
+	
+	return snapshot.Content, ops, nil
+}
+
+// openSegment switches appends to segment index. Caller holds mutex.
+func (l *OpLog) openSegment(index int) error {
+	if l.writer != nil {
+		l.writer.Flush()
+		l.segment.Close()
+	}
+	
+	file, err := os.OpenFile(l.segmentPath(index), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open op log segment: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	
+	l.segment = file
+	l.writer = bufio.NewWriter(file)
+	l.segmentIndex = index
+	l.segmentSize = info.Size()
+	return nil
+}
+
+func (l *OpLog) readSegment(index int) ([]protocol.Operation, error) {
+	file, err := os.Open(l.segmentPath(index))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read op log segment: %v", err)
+	}
+	defer file.Close()
+	
+	// Lines aren't size-limited since a single paste can be larger than a segment
+	ops := make([]protocol.Operation, 0)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var op protocol.Operation
+			if jsonErr := json.Unmarshal(line, &op); jsonErr != nil {
+				// A torn final write after a crash; everything before it is intact
+				log.Printf("Skipping corrupt entry in %s: %v", l.segmentPath(index), jsonErr)
+				break
+			}
+			ops = append(ops, op)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read op log segment: %v", err)
+		}
+	}
+	
+	return ops, nil
+}
+
+func (l *OpLog) latestSnapshot() (*opLogSnapshot, error) {
+	snapshots, err := l.snapshotIndexes()
+	if err != nil || len(snapshots) == 0 {
+		return nil, err
+	}
+	
+	data, err := os.ReadFile(l.snapshotPath(snapshots[len(snapshots)-1]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read op log snapshot: %v", err)
+	}
+	
+	var snapshot opLogSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("corrupt op log snapshot: %v", err)
+	}
+	return &snapshot, nil
+}
+
+// writeSnapshot writes atomically so a crash never leaves a partial snapshot
+func (l *OpLog) writeSnapshot(snapshot *opLogSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	
+	path := l.snapshotPath(snapshot.Segment)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write op log snapshot: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write op log snapshot: %v", err)
+	}
+	return nil
+}
+
+func (l *OpLog) segmentPath(index int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%s%06d.log", opLogSegmentPrefix, index))
+}
+
+func (l *OpLog) snapshotPath(index int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%s%06d.json", opLogSnapshotPrefix, index))
+}
+
+func (l *OpLog) segmentIndexes() ([]int, error) {
+	return l.listIndexes(opLogSegmentPrefix, ".log")
+}
+
+func (l *OpLog) snapshotIndexes() ([]int, error) {
+	return l.listIndexes(opLogSnapshotPrefix, ".json")
+}
+
+func (l *OpLog) listIndexes(prefix, suffix string) ([]int, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list op log: %v", err)
+	}
+	
+	indexes := make([]int, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		var index int
+		if _, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), "%d", &index); err != nil {
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	
+	sort.Ints(indexes)
+	return indexes, nil
+}
@@ -0,0 +1,206 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Traffic to and from every peer is counted by kind, so users can see what
+// uses their connection. Messages are counted as the application hands them
+// over or gets them back: before compression and fragmentation on WebRTC, and
+// without the envelope in server mode, where everything is to or from the
+// server. A budget caps the bytes a kind may send and receive together in a
+// minute; the first time a kind goes over in a minute Neovim is warned.
+const (
+	TrafficOps       = "ops"
+	TrafficCursor    = "cursor"
+	TrafficChat      = "chat"
+	TrafficSnapshots = "snapshots"
+	TrafficOther     = "other"
+	
+	trafficBudgetWindow = time.Minute
+)
+
+// messageTypePrefix is how every marshaled Message starts
+var messageTypePrefix = []byte(`{"type":"`)
+
+// trafficKind tells what a message sent to or received from a peer carries
+func trafficKind(data []byte) string {
+	if protocol.IsPresenceFrame(data) {
+		return TrafficCursor
+	}
+	if protocol.IsOperationFrame(data) {
+		return TrafficOps
+	}
+	switch MessageType(data) {
+	case protocol.MsgDocumentOperation, protocol.MsgDocumentOperations:
+		return TrafficOps
+	case protocol.MsgCursorMove, protocol.MsgPresenceChanged:
+		return TrafficCursor
+	case protocol.MsgChat:
+		return TrafficChat
+	}
+	return TrafficOther
+}
+
+// MessageType reads a message's type without decoding the rest of it
+func MessageType(data []byte) string {
+	if rest, ok := bytes.CutPrefix(data, messageTypePrefix); ok {
+		if end := bytes.IndexByte(rest, '"'); end >= 0 {
+			return string(rest[:end])
+		}
+	}
+	var msg struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(data, &msg)
+	return msg.Type
+}
+
+// TrafficWarning reports a kind of traffic over its budget
+type TrafficWarning struct {
+	Kind          string `json:"kind"`
+	Bytes         int64  `json:"bytes"`  // sent and received in the current window
+	Budget        int64  `json:"budget"` // bytes
+	WindowSeconds int    `json:"window_seconds"`
+}
+
+// TrafficMeter counts traffic per peer and kind and checks it against the
+// budgets
+type TrafficMeter struct {
+	since time.Time
+	kinds map[string]*protocol.TrafficCounts
+	peers map[string]map[string]*protocol.TrafficCounts
+	
+	budgets     map[string]int64 // bytes per window by kind
+	windowStart time.Time
+	window      map[string]int64
+	warned      map[string]bool
+	onWarning   func(TrafficWarning)
+	
+	mutex sync.Mutex
+}
+
+func NewTrafficMeter() *TrafficMeter {
+	return &TrafficMeter{
+		since:  time.Now(),
+		kinds:  make(map[string]*protocol.TrafficCounts),
+		peers:  make(map[string]map[string]*protocol.TrafficCounts),
+		window: make(map[string]int64),
+		warned: make(map[string]bool),
+	}
+}
+
+// SetBudgets sets the bytes each kind may use per window and what is told
+// when one goes over
+func (tm *TrafficMeter) SetBudgets(budgets map[string]int64, onWarning func(TrafficWarning)) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.budgets = budgets
+	tm.onWarning = onWarning
+}
+
+// Sent counts a message to userID
+func (tm *TrafficMeter) Sent(userID string, data []byte) {
+	tm.count(userID, trafficKind(data), true, len(data))
+}
+
+// Received counts a message from userID
+func (tm *TrafficMeter) Received(userID string, data []byte) {
+	tm.count(userID, trafficKind(data), false, len(data))
+}
+
+// count adds a message to the totals. Snapshots, which aren't messages on
+// their own, are counted through here directly.
+func (tm *TrafficMeter) count(userID, kind string, sent bool, size int) {
+	tm.mutex.Lock()
+	
+	if tm.kinds[kind] == nil {
+		tm.kinds[kind] = &protocol.TrafficCounts{}
+	}
+	tm.kinds[kind].Add(sent, size)
+	
+	peer := tm.peers[userID]
+	if peer == nil {
+		peer = make(map[string]*protocol.TrafficCounts)
+		tm.peers[userID] = peer
+	}
+	if peer[kind] == nil {
+		peer[kind] = &protocol.TrafficCounts{}
+	}
+	peer[kind].Add(sent, size)
+	
+	warning, over := tm.checkBudget(kind, size, time.Now())
+	handler := tm.onWarning
+	tm.mutex.Unlock()
+	
+	if over && handler != nil {
+		handler(warning)
+	}
+}
+
+// checkBudget adds size to the kind's use in the current window, reporting
+// the first time in the window that it goes over budget
+func (tm *TrafficMeter) checkBudget(kind string, size int, now time.Time) (TrafficWarning, bool) {
+	budget := tm.budgets[kind]
+	if budget <= 0 {
+		return TrafficWarning{}, false
+	}
+	if now.Sub(tm.windowStart) >= trafficBudgetWindow {
+		tm.windowStart = now
+		tm.window = make(map[string]int64)
+		tm.warned = make(map[string]bool)
+	}
+	
+	tm.window[kind] += int64(size)
+	if tm.window[kind] <= budget || tm.warned[kind] {
+		return TrafficWarning{}, false
+	}
+	tm.warned[kind] = true
+	return TrafficWarning{
+		Kind:          kind,
+		Bytes:         tm.window[kind],
+		Budget:        budget,
+		WindowSeconds: int(trafficBudgetWindow / time.Second),
+	}, true
+}
+
+// Report returns the totals by kind and by peer, peers sorted by ID
+func (tm *TrafficMeter) Report() protocol.MetricsResponse {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	
+	report := protocol.MetricsResponse{
+		Since: tm.since,
+		Kinds: make(map[string]protocol.TrafficCounts, len(tm.kinds)),
+		Peers: make([]protocol.PeerTraffic, 0, len(tm.peers)),
+	}
+	for kind, counts := range tm.kinds {
+		report.Kinds[kind] = *counts
+	}
+	for userID, kinds := range tm.peers {
+		peer := protocol.PeerTraffic{UserID: userID, Kinds: make(map[string]protocol.TrafficCounts, len(kinds))}
+		for kind, counts := range kinds {
+			peer.Kinds[kind] = *counts
+		}
+		report.Peers = append(report.Peers, peer)
+	}
+	sort.Slice(report.Peers, func(i, j int) bool { return report.Peers[i].UserID < report.Peers[j].UserID })
+	return report
+}
+
+// SetTrafficBudgets sets the per-kind budgets and the callback for traffic
+// going over them
+func (p2p *P2PManager) SetTrafficBudgets(budgets map[string]int64, onWarning func(TrafficWarning)) {
+	p2p.traffic.SetBudgets(budgets, onWarning)
+}
+
+// TrafficReport returns the traffic with every peer so far
+func (p2p *P2PManager) TrafficReport() protocol.MetricsResponse {
+	return p2p.traffic.Report()
+}
@@ -0,0 +1,96 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// CurrentICEServers returns the ICE servers a connection made now would use,
+// or why WebRTC isn't allowed
+func (p2p *P2PManager) CurrentICEServers() ([]webrtc.ICEServer, error) {
+	if err := p2p.CheckTransport(TransportWebRTC, ""); err != nil {
+		return nil, err
+	}
+	policy := p2p.effectiveICEPolicy()
+	p2p.peersMutex.RLock()
+	defer p2p.peersMutex.RUnlock()
+	return p2p.iceServers(policy), nil
+}
+
+// SignalingURLs returns the central server and signaling server configured,
+// either of them empty
+func (p2p *P2PManager) SignalingURLs() (serverURL, signalingURL string) {
+	p2p.peersMutex.RLock()
+	defer p2p.peersMutex.RUnlock()
+	return p2p.serverURL, p2p.signalingURL
+}
+
+// DialSignaling connects to host the way signaling does, through any proxy,
+// giving up after timeout
+func (p2p *P2PManager) DialSignaling(host string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(p2p.ctx, timeout)
+	defer cancel()
+	return p2p.SignalingDialer().DialContext(ctx, "tcp", host)
+}
+
+// GatherCandidates gathers local ICE candidates with only the given servers,
+// returning those found within timeout
+func (p2p *P2PManager) GatherCandidates(servers []webrtc.ICEServer, relayOnly bool, timeout time.Duration) ([]webrtc.ICECandidate, error) {
+	p2p.peersMutex.RLock()
+	proxyDialer := p2p.proxyDialer
+	p2p.peersMutex.RUnlock()
+	
+	settings := webrtc.SettingEngine{}
+	settings.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	if proxyDialer != nil {
+		settings.SetICEProxyDialer(proxyDialer)
+	}
+	config := webrtc.Configuration{ICEServers: servers}
+	if relayOnly {
+		config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithSettingEngine(settings)).NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	
+	var candidates []webrtc.ICECandidate
+	var mutex sync.Mutex
+	done := make(chan struct{})
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if candidate == nil {
+			close(done)
+			return
+		}
+		candidates = append(candidates, *candidate)
+	})
+	
+	// Gathering starts with a local description, which needs something to
+	// negotiate
+	if _, err := pc.CreateDataChannel("diagnose", nil); err != nil {
+		return nil, err
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return nil, err
+	}
+	
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	return append([]webrtc.ICECandidate(nil), candidates...), nil
+}
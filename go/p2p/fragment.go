@@ -0,0 +1,218 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Data channel messages larger than maxDataChannelMessage are split into
+// fragments. Each fragment starts with a fixed header:
+//
+//	magic (1 byte) | message ID (4) | fragment index (4) | fragment count (4)
+//
+// Regular messages are JSON and always start with '{', so the magic byte
+// tells the two apart on receipt. Messages left incomplete for
+// reassemblyTimeout are dropped, and a peer may have at most
+// maxPartialsPerPeer incomplete at once; beyond that its stalest is dropped.
+const (
+	fragmentMagic         byte = 0xCF
+	fragmentHeaderLen          = 13
+	maxDataChannelMessage      = 16 * 1024
+	maxFragmentPayload         = maxDataChannelMessage - fragmentHeaderLen
+	maxReassembledSize         = 256 * 1024 * 1024
+	reassemblyTimeout          = 30 * time.Second
+	reassemblyExpiryInterval   = 10 * time.Second
+	maxPartialsPerPeer         = 32
+)
+
+// isFragment reports whether a data channel message is a fragment
+func isFragment(data []byte) bool {
+	return len(data) >= fragmentHeaderLen && data[0] == fragmentMagic
+}
+
+// fragmentMessage splits data into fragments small enough for a single SCTP
+// message. Data that already fits is returned unchanged.
+func fragmentMessage(messageID uint32, data []byte) [][]byte {
+	if len(data) <= maxDataChannelMessage {
+		return [][]byte{data}
+	}
+	
+	count := (len(data) + maxFragmentPayload - 1) / maxFragmentPayload
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		start := i * maxFragmentPayload
+		end := start + maxFragmentPayload
+		if end > len(data) {
+			end = len(data)
+		}
+		
+		fragment := make([]byte, fragmentHeaderLen+end-start)
+		fragment[0] = fragmentMagic
+		binary.BigEndian.PutUint32(fragment[1:5], messageID)
+		binary.BigEndian.PutUint32(fragment[5:9], uint32(i))
+		binary.BigEndian.PutUint32(fragment[9:13], uint32(count))
+		copy(fragment[fragmentHeaderLen:], data[start:end])
+		fragments = append(fragments, fragment)
+	}
+	
+	return fragments
+}
+
+type partialMessage struct {
+	peer      string
+	fragments [][]byte
+	received  int
+	size      int
+	lastSeen  time.Time
+}
+
+// Reassembler collects fragments per peer until whole messages are available
+type Reassembler struct {
+	pending map[string]*partialMessage
+	perPeer map[string]int // incomplete messages by peer
+	mutex   sync.Mutex
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		pending: make(map[string]*partialMessage),
+		perPeer: make(map[string]int),
+	}
+}
+
+// removeLocked drops a partial message. Caller holds the mutex.
+func (r *Reassembler) removeLocked(key string, partial *partialMessage) {
+	delete(r.pending, key)
+	r.perPeer[partial.peer]--
+	if r.perPeer[partial.peer] <= 0 {
+		delete(r.perPeer, partial.peer)
+	}
+}
+
+// evictStalestLocked drops the peer's partial message that last made
+// progress longest ago. Caller holds the mutex.
+func (r *Reassembler) evictStalestLocked(peerUserID string) {
+	var stalestKey string
+	var stalest *partialMessage
+	for key, partial := range r.pending {
+		if partial.peer == peerUserID && (stalest == nil || partial.lastSeen.Before(stalest.lastSeen)) {
+			stalestKey, stalest = key, partial
+		}
+	}
+	if stalest != nil {
+		r.removeLocked(stalestKey, stalest)
+	}
+}
+
+// Add stores a fragment from a peer. It returns the complete message once
+// the last missing fragment arrives.
+func (r *Reassembler) Add(peerUserID string, fragment []byte) ([]byte, bool, error) {
+	if !isFragment(fragment) {
+		return nil, false, fmt.Errorf("not a fragment")
+	}
+	
+	messageID := binary.BigEndian.Uint32(fragment[1:5])
+	index := int(binary.BigEndian.Uint32(fragment[5:9]))
+	count := int(binary.BigEndian.Uint32(fragment[9:13]))
+	payload := fragment[fragmentHeaderLen:]
+	
+	if count == 0 || index >= count {
+		return nil, false, fmt.Errorf("invalid fragment %d of %d", index, count)
+	}
+	if count > maxReassembledSize/maxFragmentPayload+1 {
+		return nil, false, fmt.Errorf("message of %d fragments exceeds the reassembly limit", count)
+	}
+	
+	key := fmt.Sprintf("%s/%d", peerUserID, messageID)
+	
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	partial, exists := r.pending[key]
+	if !exists {
+		if r.perPeer[peerUserID] >= maxPartialsPerPeer {
+			r.evictStalestLocked(peerUserID)
+		}
+		partial = &partialMessage{
+			peer:      peerUserID,
+			fragments: make([][]byte, count),
+		}
+		r.pending[key] = partial
+		r.perPeer[peerUserID]++
+	}
+	if len(partial.fragments) != count {
+		r.removeLocked(key, partial)
+		return nil, false, fmt.Errorf("fragment count changed mid-message for %s", key)
+	}
+	
+	partial.lastSeen = time.Now()
+	if partial.fragments[index] != nil {
+		// Duplicate fragment
+		return nil, false, nil
+	}
+	
+	partial.fragments[index] = append([]byte(nil), payload...)
+	partial.received++
+	partial.size += len(payload)
+	
+	if partial.received < count {
+		return nil, false, nil
+	}
+	
+	r.removeLocked(key, partial)
+	message := make([]byte, 0, partial.size)
+	for _, part := range partial.fragments {
+		message = append(message, part...)
+	}
+	
+	return message, true, nil
+}
+
+// ExpireStale drops partially received messages that stopped making progress
+func (r *Reassembler) ExpireStale(timeout time.Duration) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	expired := 0
+	now := time.Now()
+	for key, partial := range r.pending {
+		if now.Sub(partial.lastSeen) > timeout {
+			r.removeLocked(key, partial)
+			expired++
+		}
+	}
+	
+	return expired
+}
+
+// DropPeer discards any partial messages from a disconnected peer
+func (r *Reassembler) DropPeer(peerUserID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	for key, partial := range r.pending {
+		if partial.peer == peerUserID {
+			r.removeLocked(key, partial)
+		}
+	}
+}
+
+// runReassemblyExpiry drops stale partial messages until the manager closes
+func (p2p *P2PManager) runReassemblyExpiry() {
+	ticker := time.NewTicker(reassemblyExpiryInterval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-p2p.ctx.Done():
+			return
+		case <-ticker.C:
+			if expired := p2p.reassembler.ExpireStale(reassemblyTimeout); expired > 0 {
+				log.Printf("Discarded %d incomplete fragmented messages", expired)
+			}
+		}
+	}
+}
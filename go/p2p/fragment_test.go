@@ -0,0 +1,74 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+)
+
+// firstFragment returns the first fragment of a message of count fragments
+func firstFragment(t *testing.T, messageID uint32, count int) []byte {
+	t.Helper()
+	data := make([]byte, count*maxFragmentPayload)
+	fragments := fragmentMessage(messageID, data)
+	if len(fragments) != count {
+		t.Fatalf("got %d fragments, want %d", len(fragments), count)
+	}
+	return fragments[0]
+}
+
+func TestReassemblerExpiresStalePartials(t *testing.T) {
+	r := NewReassembler()
+	if _, complete, err := r.Add("bob", firstFragment(t, 1, 3)); err != nil || complete {
+		t.Fatalf("Add = %v, %v; want an incomplete message", complete, err)
+	}
+	if _, _, err := r.Add("bob", firstFragment(t, 2, 3)); err != nil {
+		t.Fatal(err)
+	}
+	r.mutex.Lock()
+	r.pending["bob/1"].lastSeen = time.Now().Add(-2 * reassemblyTimeout)
+	r.mutex.Unlock()
+	
+	if expired := r.ExpireStale(reassemblyTimeout); expired != 1 {
+		t.Errorf("ExpireStale expired %d messages, want 1", expired)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.pending["bob/1"]; ok {
+		t.Errorf("stale message 1 is still pending")
+	}
+	if _, ok := r.pending["bob/2"]; !ok {
+		t.Errorf("message 2, still in progress, was dropped")
+	}
+	if r.perPeer["bob"] != 1 {
+		t.Errorf("bob has %d partial messages counted, want 1", r.perPeer["bob"])
+	}
+}
+
+func TestReassemblerCapsPartialsPerPeer(t *testing.T) {
+	r := NewReassembler()
+	for id := uint32(1); id <= maxPartialsPerPeer+5; id++ {
+		if _, _, err := r.Add("bob", firstFragment(t, id, 2)); err != nil {
+			t.Fatal(err)
+		}
+		if id == 1 {
+			r.mutex.Lock()
+			r.pending["bob/1"].lastSeen = time.Now().Add(-time.Second)
+			r.mutex.Unlock()
+		}
+	}
+	if _, _, err := r.Add("carol", firstFragment(t, 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.perPeer["bob"] != maxPartialsPerPeer {
+		t.Errorf("bob has %d partial messages, want at most %d", r.perPeer["bob"], maxPartialsPerPeer)
+	}
+	if len(r.pending) != maxPartialsPerPeer+1 {
+		t.Errorf("%d partial messages pending, want %d", len(r.pending), maxPartialsPerPeer+1)
+	}
+	if _, ok := r.pending["bob/1"]; ok {
+		t.Errorf("bob's oldest message wasn't the one dropped")
+	}
+}
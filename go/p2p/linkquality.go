@@ -0,0 +1,328 @@
+package p2p
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Sessions adapt to each connection instead of needing manual tuning. Every
+// second each WebRTC peer is pinged on the unordered channel for its round
+// trip time, and its outgoing bandwidth is estimated from how fast the
+// ordered channel drains. Those pick a sync profile per peer: slower links
+// get larger messages compressed and a longer retransmit timeout, and the
+// slowest connected peer sets how often presence is sent to everyone.
+const (
+	linkProbeInterval = time.Second
+	
+	// A new profile must be measured this many probes in a row to take effect
+	linkProfileSettle = 3
+	
+	compressedMagic byte = 0xCC
+	
+	minRetransmitTimeout = 200 * time.Millisecond
+	maxRetransmitTimeout = 3 * time.Second
+)
+
+// SyncProfile is how sync traffic is paced and shaped for a link
+type SyncProfile struct {
+	Name             string
+	maxRTT           time.Duration // slower round trips fall to the next profile
+	minBandwidth     float64       // bytes per second
+	PresenceInterval time.Duration // shortest gap between presence updates
+	CompressAbove    int           // message size in bytes; 0 disables compression
+}
+
+// syncProfiles are ordered from the fastest links to the slowest
+var syncProfiles = []SyncProfile{
+	{Name: "fast", maxRTT: 80 * time.Millisecond, minBandwidth: 256 * 1024, PresenceInterval: 0, CompressAbove: 0},
+	{Name: "normal", maxRTT: 200 * time.Millisecond, minBandwidth: 64 * 1024, PresenceInterval: 50 * time.Millisecond, CompressAbove: 16 * 1024},
+	{Name: "slow", maxRTT: 600 * time.Millisecond, minBandwidth: 16 * 1024, PresenceInterval: 150 * time.Millisecond, CompressAbove: 2 * 1024},
+	{Name: "constrained", PresenceInterval: 400 * time.Millisecond, CompressAbove: 512},
+}
+
+// profileFor picks the fastest profile a link's measurements allow. An
+// unmeasured bandwidth doesn't hold a link back.
+func profileFor(rtt time.Duration, bandwidth float64) int {
+	for i, profile := range syncProfiles[:len(syncProfiles)-1] {
+		if rtt > profile.maxRTT {
+			continue
+		}
+		if bandwidth > 0 && bandwidth < profile.minBandwidth {
+			continue
+		}
+		return i
+	}
+	return len(syncProfiles) - 1
+}
+
+// linkStats holds one peer's measurements and the profile they chose
+type linkStats struct {
+	srtt      time.Duration
+	rttvar    time.Duration
+	bandwidth float64 // bytes per second, 0 until the link was busy enough to tell
+	profile   int
+	candidate int // profile measured lately, and for how many probes
+	streak    int
+	
+	sent         atomic.Uint64 // bytes queued on the ordered channel
+	lastSent     uint64
+	lastBuffered uint64
+	lastSample   time.Time
+	
+	mutex sync.Mutex
+}
+
+func newLinkStats() *linkStats {
+	return &linkStats{}
+}
+
+// observeRTT smooths a round trip sample the way TCP does (RFC 6298)
+func (ls *linkStats) observeRTT(sample time.Duration) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	
+	if ls.srtt == 0 {
+		ls.srtt = sample
+		ls.rttvar = sample / 2
+		return
+	}
+	diff := ls.srtt - sample
+	if diff < 0 {
+		diff = -diff
+	}
+	ls.rttvar = (3*ls.rttvar + diff) / 4
+	ls.srtt = (7*ls.srtt + sample) / 8
+}
+
+// sampleBandwidth estimates throughput from the bytes that left the ordered
+// channel's buffer since the last sample. Only a link that had data waiting
+// shows its capacity; an idle one only shows what was asked of it.
+func (ls *linkStats) sampleBandwidth(buffered uint64, now time.Time) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	
+	sent := ls.sent.Load()
+	if !ls.lastSample.IsZero() {
+		elapsed := now.Sub(ls.lastSample).Seconds()
+		drained := float64(sent-ls.lastSent) + float64(ls.lastBuffered) - float64(buffered)
+		if elapsed > 0 && drained >= 0 && (ls.lastBuffered > 0 || buffered > 0) {
+			rate := drained / elapsed
+			if ls.bandwidth == 0 {
+				ls.bandwidth = rate
+			} else {
+				ls.bandwidth = (3*ls.bandwidth + rate) / 4
+			}
+		}
+	}
+	ls.lastSent = sent
+	ls.lastBuffered = buffered
+	ls.lastSample = now
+}
+
+// rto returns the retransmit timeout for acked packets
+func (ls *linkStats) rto() time.Duration {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	
+	if ls.srtt == 0 {
+		return retransmitTimeout
+	}
+	timeout := ls.srtt + 4*ls.rttvar
+	if timeout < minRetransmitTimeout {
+		return minRetransmitTimeout
+	}
+	if timeout > maxRetransmitTimeout {
+		return maxRetransmitTimeout
+	}
+	return timeout
+}
+
+// evaluate updates the profile once the measurements have pointed to a new
+// one for linkProfileSettle probes, reporting whether it changed
+func (ls *linkStats) evaluate() bool {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	
+	if ls.srtt == 0 {
+		return false
+	}
+	measured := profileFor(ls.srtt, ls.bandwidth)
+	if measured == ls.profile {
+		ls.streak = 0
+		return false
+	}
+	if measured != ls.candidate {
+		ls.candidate = measured
+		ls.streak = 0
+	}
+	ls.streak++
+	if ls.streak < linkProfileSettle {
+		return false
+	}
+	ls.profile = measured
+	ls.streak = 0
+	return true
+}
+
+func (ls *linkStats) currentProfile() int {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.profile
+}
+
+func (ls *linkStats) quality(userID string) protocol.LinkQuality {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return protocol.LinkQuality{
+		UserID:        userID,
+		RTTMS:         ls.srtt.Milliseconds(),
+		BandwidthKbps: int64(ls.bandwidth * 8 / 1000),
+		Profile:       syncProfiles[ls.profile].Name,
+	}
+}
+
+// compressMessage deflates a message for a slow link, returning it unchanged
+// when that doesn't make it smaller
+func compressMessage(data []byte) []byte {
+	var compressed bytes.Buffer
+	compressed.WriteByte(compressedMagic)
+	writer, err := flate.NewWriter(&compressed, flate.BestSpeed)
+	if err != nil {
+		return data
+	}
+	writer.Write(data)
+	writer.Close()
+	
+	if compressed.Len() >= len(data) {
+		return data
+	}
+	return compressed.Bytes()
+}
+
+// isCompressed reports whether a data channel message was compressed
+func isCompressed(data []byte) bool {
+	return len(data) > 1 && data[0] == compressedMagic
+}
+
+func decompressMessage(data []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data[1:]))
+	defer reader.Close()
+	
+	message, err := io.ReadAll(io.LimitReader(reader, maxReassembledSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("corrupt compressed message: %v", err)
+	}
+	if len(message) > maxReassembledSize {
+		return nil, fmt.Errorf("compressed message too large")
+	}
+	return message, nil
+}
+
+// prepareOutgoing counts a message against the peer's link and compresses
+// it if the link's profile asks for that
+func (peer *PeerConnection) prepareOutgoing(data []byte) []byte {
+	if threshold := syncProfiles[peer.stats.currentProfile()].CompressAbove; threshold > 0 && len(data) > threshold {
+		data = compressMessage(data)
+	}
+	peer.stats.sent.Add(uint64(len(data)))
+	return data
+}
+
+// SetSyncProfileHandler sets the callback for changes of the profile that
+// paces traffic to all peers
+func (p2p *P2PManager) SetSyncProfileHandler(handler func(profile SyncProfile, links []protocol.LinkQuality)) {
+	p2p.peersMutex.Lock()
+	defer p2p.peersMutex.Unlock()
+	p2p.onSyncProfile = handler
+}
+
+// runLinkProbes measures every WebRTC peer's link once per probe interval
+func (p2p *P2PManager) runLinkProbes() {
+	ticker := time.NewTicker(linkProbeInterval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-p2p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			p2p.probeLinks(now)
+		}
+	}
+}
+
+func (p2p *P2PManager) probeLinks(now time.Time) {
+	p2p.peersMutex.RLock()
+	peers := make([]*PeerConnection, 0, len(p2p.peers))
+	for _, peer := range p2p.peers {
+		if peer.Connected {
+			peers = append(peers, peer)
+		}
+	}
+	current := p2p.syncProfile
+	handler := p2p.onSyncProfile
+	p2p.peersMutex.RUnlock()
+	
+	// Without measured peers traffic isn't paced
+	slowest := 0
+	links := make([]protocol.LinkQuality, 0, len(peers))
+	for _, peer := range peers {
+		if dc := peer.UnorderedChannel; dc != nil && dc.ReadyState() == webrtc.DataChannelStateOpen {
+			ping := binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+			if err := dc.Send(encodePacket(packetKindPing, 0, ping)); err != nil {
+				log.Printf("Failed to probe peer %s: %v", peer.UserID, err)
+			}
+		}
+		if dc := peer.DataChannel; dc != nil {
+			peer.stats.sampleBandwidth(dc.BufferedAmount(), now)
+		}
+		if peer.stats.evaluate() {
+			log.Printf("Link to peer %s is now %s", peer.UserID, syncProfiles[peer.stats.currentProfile()].Name)
+		}
+		
+		if profile := peer.stats.currentProfile(); profile > slowest {
+			slowest = profile
+		}
+		links = append(links, peer.stats.quality(peer.UserID))
+	}
+	
+	if slowest == current {
+		return
+	}
+	p2p.peersMutex.Lock()
+	p2p.syncProfile = slowest
+	p2p.peersMutex.Unlock()
+	
+	if handler != nil {
+		handler(syncProfiles[slowest], links)
+	}
+}
+
+// handleProbe answers a ping or records the round trip of a pong
+func (p2p *P2PManager) handleProbe(peer *PeerConnection, dc *webrtc.DataChannel, kind byte, payload []byte) {
+	if len(payload) != 8 {
+		return
+	}
+	if kind == packetKindPing {
+		if err := dc.Send(encodePacket(packetKindPong, 0, payload)); err != nil {
+			log.Printf("Failed to answer probe from peer %s: %v", peer.UserID, err)
+		}
+		return
+	}
+	
+	sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+	if rtt := time.Since(sentAt); rtt > 0 {
+		peer.stats.observeRTT(rtt)
+	}
+}
@@ -0,0 +1,231 @@
+package p2p
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Serverless mode: with no signaling server reachable, the offer and answer
+// are exchanged by hand (chat, email). Each side waits for ICE gathering to
+// finish so a single blob carries every candidate, then compresses it to keep
+// the text short enough to paste.
+const (
+	gatheringTimeout = 10 * time.Second
+	MaxSignalBlobLen = 1024 * 1024
+)
+
+// signalBlob is the payload inside an offer or answer blob
+type signalBlob struct {
+	InviteID  string `json:"invite_id"`
+	SessionID string `json:"session_id,omitempty"`
+	UserID    string `json:"user_id"`
+	Type      string `json:"type"` // "offer" or "answer"
+	SDP       string `json:"sdp"`
+	Relay     string `json:"relay,omitempty"` // TURN server the offer chose
+}
+
+func encodeSignalBlob(blob signalBlob) (string, error) {
+	data, err := json.Marshal(blob)
+	if err != nil {
+		return "", err
+	}
+	
+	var compressed bytes.Buffer
+	writer, err := flate.NewWriter(&compressed, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	writer.Write(data)
+	writer.Close()
+	
+	return base64.RawURLEncoding.EncodeToString(compressed.Bytes()), nil
+}
+
+func decodeSignalBlob(encoded string) (signalBlob, error) {
+	var blob signalBlob
+	
+	// Tolerate whitespace and line breaks picked up while pasting
+	encoded = strings.Join(strings.Fields(encoded), "")
+	compressed, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return blob, fmt.Errorf("invite is not valid base64: %v", err)
+	}
+	
+	reader := flate.NewReader(bytes.NewReader(compressed))
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, MaxSignalBlobLen))
+	if err != nil {
+		return blob, fmt.Errorf("invite is corrupted: %v", err)
+	}
+	
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return blob, fmt.Errorf("invite is corrupted: %v", err)
+	}
+	if blob.InviteID == "" || blob.SDP == "" {
+		return blob, fmt.Errorf("invite is missing connection details")
+	}
+	
+	return blob, nil
+}
+
+// waitForCompleteDescription waits for ICE gathering on a peer and returns the
+// local description with all candidates embedded
+func (p2p *P2PManager) waitForCompleteDescription(peerKey string) (*webrtc.SessionDescription, error) {
+	p2p.peersMutex.RLock()
+	peer, exists := p2p.peers[peerKey]
+	p2p.peersMutex.RUnlock()
+	
+	if !exists {
+		return nil, fmt.Errorf("no peer connection found for %s", peerKey)
+	}
+	
+	select {
+	case <-webrtc.GatheringCompletePromise(peer.Connection):
+	case <-time.After(gatheringTimeout):
+		log.Printf("ICE gathering for %s timed out, using candidates found so far", peerKey)
+	}
+	
+	description := peer.Connection.LocalDescription()
+	if description == nil {
+		return nil, fmt.Errorf("no local description for %s", peerKey)
+	}
+	
+	filtered := *description
+	filtered.SDP = p2p.filterSDPCandidates(description.SDP)
+	return &filtered, nil
+}
+
+// filterSDPCandidates removes candidates the ICE policy forbids sharing.
+// Trickled candidates are filtered as they're gathered, but a complete offer
+// embeds them all in the SDP.
+func (p2p *P2PManager) filterSDPCandidates(sdp string) string {
+	policy := p2p.effectiveICEPolicy()
+	
+	if !policy.DisableHostCandidates && !policy.RelayOnly {
+		return sdp
+	}
+	
+	lines := strings.Split(sdp, "\r\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.HasPrefix(line, "a=candidate:") {
+			isRelay := strings.Contains(line, " typ relay")
+			isHost := strings.Contains(line, " typ host")
+			if (policy.RelayOnly && !isRelay) || (policy.DisableHostCandidates && isHost) {
+				continue
+			}
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\r\n")
+}
+
+// CreateManualOffer creates an offer blob for copy-paste signaling. The peer
+// is tracked under inviteID until the answer reveals who accepted it.
+func (p2p *P2PManager) CreateManualOffer(inviteID, sessionID string) (string, error) {
+	relay := chooseRelay(p2p.RelayRTTs(), nil)
+	p2p.useRelay(inviteID, relay)
+	if _, err := p2p.CreateOffer(inviteID); err != nil {
+		return "", err
+	}
+	
+	offer, err := p2p.waitForCompleteDescription(inviteID)
+	if err != nil {
+		p2p.DisconnectPeer(inviteID)
+		return "", err
+	}
+	
+	return encodeSignalBlob(signalBlob{
+		InviteID:  inviteID,
+		SessionID: sessionID,
+		UserID:    p2p.localUserID,
+		Type:      offer.Type.String(),
+		SDP:       offer.SDP,
+		Relay:     relay,
+	})
+}
+
+// AcceptManualOffer answers an offer blob, returning the answer blob to send
+// back along with the decoded offer
+func (p2p *P2PManager) AcceptManualOffer(encodedOffer string) (string, signalBlob, error) {
+	offerBlob, err := decodeSignalBlob(encodedOffer)
+	if err != nil {
+		return "", offerBlob, err
+	}
+	if offerBlob.Type != webrtc.SDPTypeOffer.String() {
+		return "", offerBlob, fmt.Errorf("expected an invite offer, got %s", offerBlob.Type)
+	}
+	
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offerBlob.SDP}
+	p2p.useRelay(offerBlob.UserID, offerBlob.Relay)
+	if _, err := p2p.HandleOffer(offerBlob.UserID, offer); err != nil {
+		return "", offerBlob, err
+	}
+	
+	answer, err := p2p.waitForCompleteDescription(offerBlob.UserID)
+	if err != nil {
+		p2p.DisconnectPeer(offerBlob.UserID)
+		return "", offerBlob, err
+	}
+	
+	encoded, err := encodeSignalBlob(signalBlob{
+		InviteID:  offerBlob.InviteID,
+		SessionID: offerBlob.SessionID,
+		UserID:    p2p.localUserID,
+		Type:      answer.Type.String(),
+		SDP:       answer.SDP,
+	})
+	return encoded, offerBlob, err
+}
+
+// CompleteManualOffer applies an answer blob to the pending invite and
+// re-keys the connection under the answering user's ID
+func (p2p *P2PManager) CompleteManualOffer(encodedAnswer string) (string, error) {
+	answerBlob, err := decodeSignalBlob(encodedAnswer)
+	if err != nil {
+		return "", err
+	}
+	if answerBlob.Type != webrtc.SDPTypeAnswer.String() {
+		return "", fmt.Errorf("expected an invite answer, got %s", answerBlob.Type)
+	}
+	
+	answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answerBlob.SDP}
+	if err := p2p.HandleAnswer(answerBlob.InviteID, answer); err != nil {
+		return "", err
+	}
+	
+	if err := p2p.renamePeer(answerBlob.InviteID, answerBlob.UserID); err != nil {
+		return "", err
+	}
+	
+	return answerBlob.UserID, nil
+}
+
+// renamePeer moves a connection tracked under a provisional key to its user ID
+func (p2p *P2PManager) renamePeer(oldKey, userID string) error {
+	p2p.peersMutex.Lock()
+	defer p2p.peersMutex.Unlock()
+	
+	peer, exists := p2p.peers[oldKey]
+	if !exists {
+		return fmt.Errorf("no pending invite %s", oldKey)
+	}
+	if _, taken := p2p.peers[userID]; taken && userID != oldKey {
+		return fmt.Errorf("already connected to user %s", userID)
+	}
+	
+	delete(p2p.peers, oldKey)
+	peer.ID = fmt.Sprintf("%s-%s", p2p.localUserID, userID)
+	peer.UserID = userID
+	p2p.peers[userID] = peer
+	return nil
+}
@@ -0,0 +1,54 @@
+package p2p
+
+import (
+	"log"
+	"time"
+)
+
+// How long fragmented messages may wait for their remaining parts under
+// pressure
+const pressureReassemblyTimeout = 5 * time.Second
+
+// BufferedBytes returns the size of partially reassembled messages
+func (r *Reassembler) BufferedBytes() int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	var size int64
+	for _, partial := range r.pending {
+		size += int64(partial.size)
+	}
+	return size
+}
+
+func (rl *reliableLink) bufferedBytes() int64 {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	
+	var size int64
+	for _, pending := range rl.unacked {
+		size += int64(len(pending.packet))
+	}
+	return size
+}
+
+// MemoryUsage estimates bytes held in reassembly and retransmit buffers
+func (p2p *P2PManager) MemoryUsage() int64 {
+	size := p2p.reassembler.BufferedBytes()
+	
+	p2p.peersMutex.RLock()
+	defer p2p.peersMutex.RUnlock()
+	for _, peer := range p2p.peers {
+		if peer.link != nil {
+			size += peer.link.bufferedBytes()
+		}
+	}
+	return size
+}
+
+// ReleaseMemory gives up on slow fragmented messages sooner than usual
+func (p2p *P2PManager) ReleaseMemory() {
+	if expired := p2p.reassembler.ExpireStale(pressureReassemblyTimeout); expired > 0 {
+		log.Printf("Memory pressure: discarded %d incomplete fragmented messages", expired)
+	}
+}
@@ -0,0 +1,186 @@
+package p2p
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Users sharing several sessions reuse one peer connection. The connection's
+// default channels carry the session it was opened for; every additional
+// session gets its own data channel labeled with the session ID, so no extra
+// ICE/DTLS handshake (or NAT binding) is needed.
+const sessionChannelPrefix = "collab/"
+
+func sessionChannelLabel(sessionID string) string {
+	return sessionChannelPrefix + sessionID
+}
+
+// sessionIDFromLabel extracts the session ID from a session channel label
+func sessionIDFromLabel(label string) (string, bool) {
+	if !strings.HasPrefix(label, sessionChannelPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(label, sessionChannelPrefix), true
+}
+
+// SetSessionMessageHandler sets the callback for messages arriving on
+// multiplexed session channels
+func (p2p *P2PManager) SetSessionMessageHandler(onSessionMessage func(sessionID, userID string, data []byte)) {
+	p2p.onSessionMessage = func(sessionID, userID string, data []byte) {
+		p2p.traffic.Received(userID, data)
+		onSessionMessage(sessionID, userID, data)
+	}
+}
+
+// AttachSession multiplexes a session onto an existing connection with the
+// peer. It returns false when there is no usable connection yet, in which case
+// the caller should negotiate a new one.
+func (p2p *P2PManager) AttachSession(peerUserID, sessionID string) (bool, error) {
+	p2p.peersMutex.Lock()
+	defer p2p.peersMutex.Unlock()
+	
+	peer, exists := p2p.peers[peerUserID]
+	if !exists || !peer.Connected {
+		return false, nil
+	}
+	
+	if _, attached := peer.SessionChannels[sessionID]; attached {
+		return true, nil
+	}
+	
+	dc, err := peer.Connection.CreateDataChannel(sessionChannelLabel(sessionID), nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to open session channel to peer %s: %v", peerUserID, err)
+	}
+	
+	peer.SessionChannels[sessionID] = dc
+	p2p.setupSessionChannelHandlers(peer, sessionID, dc)
+	
+	log.Printf("Reusing connection to peer %s for session %s", peerUserID, sessionID)
+	return true, nil
+}
+
+// DetachSession closes a session's channel to a peer. The connection itself is
+// closed once it no longer carries any session.
+func (p2p *P2PManager) DetachSession(peerUserID, sessionID string) error {
+	p2p.peersMutex.Lock()
+	peer, exists := p2p.peers[peerUserID]
+	if !exists {
+		p2p.peersMutex.Unlock()
+		return nil
+	}
+	
+	if dc, attached := peer.SessionChannels[sessionID]; attached {
+		dc.Close()
+		delete(peer.SessionChannels, sessionID)
+	}
+	idle := len(peer.SessionChannels) == 0 && peer.DataChannel == nil
+	p2p.peersMutex.Unlock()
+	
+	if idle {
+		return p2p.DisconnectPeer(peerUserID)
+	}
+	return nil
+}
+
+// SendSessionMessage sends a message to a peer on a multiplexed session channel
+func (p2p *P2PManager) SendSessionMessage(peerUserID, sessionID string, data []byte) error {
+	p2p.peersMutex.RLock()
+	peer, exists := p2p.peers[peerUserID]
+	var dc *webrtc.DataChannel
+	if exists {
+		dc = peer.SessionChannels[sessionID]
+	}
+	p2p.peersMutex.RUnlock()
+	
+	if !exists {
+		return fmt.Errorf("no peer connection found for user %s", peerUserID)
+	}
+	if dc == nil {
+		return fmt.Errorf("session %s is not attached to peer %s", sessionID, peerUserID)
+	}
+	
+	if err := p2p.sendToChannel(peer, dc, data); err != nil {
+		return fmt.Errorf("failed to send session message to peer %s: %v", peerUserID, err)
+	}
+	return nil
+}
+
+// GetSharedSessions returns the IDs of sessions multiplexed onto a peer connection
+func (p2p *P2PManager) GetSharedSessions(peerUserID string) []string {
+	p2p.peersMutex.RLock()
+	defer p2p.peersMutex.RUnlock()
+	
+	peer, exists := p2p.peers[peerUserID]
+	if !exists {
+		return nil
+	}
+	
+	sessions := make([]string, 0, len(peer.SessionChannels))
+	for sessionID := range peer.SessionChannels {
+		sessions = append(sessions, sessionID)
+	}
+	return sessions
+}
+
+// acceptSessionChannel registers a session channel opened by the remote peer
+func (p2p *P2PManager) acceptSessionChannel(peer *PeerConnection, sessionID string, dc *webrtc.DataChannel) {
+	p2p.peersMutex.Lock()
+	peer.SessionChannels[sessionID] = dc
+	p2p.peersMutex.Unlock()
+	
+	p2p.setupSessionChannelHandlers(peer, sessionID, dc)
+}
+
+// setupSessionChannelHandlers sets up handlers for a session channel
+func (p2p *P2PManager) setupSessionChannelHandlers(peer *PeerConnection, sessionID string, dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		log.Printf("Session %s channel opened with peer %s", sessionID, peer.UserID)
+	})
+	
+	dc.OnClose(func() {
+		log.Printf("Session %s channel closed with peer %s", sessionID, peer.UserID)
+		p2p.peersMutex.Lock()
+		if peer.SessionChannels[sessionID] == dc {
+			delete(peer.SessionChannels, sessionID)
+		}
+		p2p.peersMutex.Unlock()
+	})
+	
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		peer.LastHeartbeat = time.Now()
+		
+		data := msg.Data
+		if isFragment(data) {
+			message, complete, err := p2p.reassembler.Add(peer.UserID, data)
+			if err != nil {
+				log.Printf("Dropping fragment from peer %s: %v", peer.UserID, err)
+				return
+			}
+			if !complete {
+				return
+			}
+			data = message
+		}
+		if isCompressed(data) {
+			message, err := decompressMessage(data)
+			if err != nil {
+				log.Printf("Dropping message from peer %s: %v", peer.UserID, err)
+				return
+			}
+			data = message
+		}
+		
+		if p2p.onSessionMessage != nil {
+			p2p.onSessionMessage(sessionID, peer.UserID, data)
+		}
+	})
+	
+	dc.OnError(func(err error) {
+		log.Printf("Session %s channel error with peer %s: %v", sessionID, peer.UserID, err)
+	})
+}
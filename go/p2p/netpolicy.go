@@ -0,0 +1,242 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Administrators constrain where collaboration traffic may go with a network
+// policy in the config file. Unlike a session's ice_policy, which users choose
+// for privacy, the network policy applies to every session and can't be
+// loosened over the protocol.
+const (
+	TransportWebRTC = "webrtc"
+	TransportSSH    = "ssh"
+	TransportServer = "server"
+	
+	transportResolveTimeout = 5 * time.Second
+)
+
+// NetworkPolicy limits the ICE servers, candidates and transports in use
+type NetworkPolicy struct {
+	// Organization STUN/TURN servers used in place of the built-in public
+	// STUN servers
+	ICEServers []protocol.ICEServerConfig `json:"ice_servers,omitempty"`
+	
+	// Never use ICE servers other than ice_servers: the public STUN servers
+	// are dropped and sessions can't add TURN servers
+	NoExternalICEServers bool `json:"no_external_ice_servers,omitempty"`
+	
+	// Every WebRTC connection goes through a TURN server from ice_servers
+	RelayOnly bool `json:"relay_only,omitempty"`
+	
+	// Only connect to addresses on the local network: no ICE servers, and
+	// SSH servers and the central server must resolve to private addresses
+	LANOnly bool `json:"lan_only,omitempty"`
+	
+	// Transports that may be used: "webrtc", "ssh" and "server"; all when empty
+	AllowedTransports []string `json:"allowed_transports,omitempty"`
+}
+
+func (np NetworkPolicy) Validate() error {
+	for _, server := range np.ICEServers {
+		if len(server.URLs) == 0 {
+			return fmt.Errorf("ICE server without urls")
+		}
+		for _, url := range server.URLs {
+			if !isICEServerURL(url) {
+				return fmt.Errorf("invalid ICE server URL %s", url)
+			}
+		}
+	}
+	for _, transport := range np.AllowedTransports {
+		switch transport {
+		case TransportWebRTC, TransportSSH, TransportServer:
+		default:
+			return fmt.Errorf("unknown transport %q", transport)
+		}
+	}
+	
+	if np.LANOnly {
+		if np.RelayOnly {
+			return fmt.Errorf("lan_only and relay_only can't both be set")
+		}
+		if len(np.ICEServers) > 0 {
+			return fmt.Errorf("lan_only uses no ICE servers; remove ice_servers")
+		}
+	}
+	if np.RelayOnly && !hasTURNServer(np.ICEServers) {
+		return fmt.Errorf("relay_only requires a TURN server in ice_servers")
+	}
+	return nil
+}
+
+func isICEServerURL(url string) bool {
+	for _, scheme := range []string{"stun:", "stuns:", "turn:", "turns:"} {
+		if strings.HasPrefix(url, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTURNServer(servers []protocol.ICEServerConfig) bool {
+	for _, server := range servers {
+		for _, url := range server.URLs {
+			if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (np NetworkPolicy) allowsTransport(transport string) bool {
+	if len(np.AllowedTransports) == 0 {
+		return true
+	}
+	for _, allowed := range np.AllowedTransports {
+		if allowed == transport {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsSessionServers reports whether sessions may bring their own TURN
+// servers
+func (np NetworkPolicy) allowsSessionServers() bool {
+	return !np.NoExternalICEServers && !np.LANOnly
+}
+
+// constrain applies the network policy on top of a session's ICE policy
+func (np NetworkPolicy) constrain(policy protocol.ICEPolicy) protocol.ICEPolicy {
+	if np.RelayOnly {
+		policy.RelayOnly = true
+	}
+	if !np.allowsSessionServers() {
+		policy.TURNServers = nil
+	}
+	return policy
+}
+
+// SetNetworkPolicy applies an administrator's network policy to connections
+// made from now on
+func (p2p *P2PManager) SetNetworkPolicy(policy NetworkPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	
+	p2p.peersMutex.Lock()
+	defer p2p.peersMutex.Unlock()
+	
+	p2p.networkPolicy = policy
+	switch {
+	case len(policy.ICEServers) > 0:
+		p2p.config.ICEServers = nil
+		for _, server := range policy.ICEServers {
+			p2p.config.ICEServers = append(p2p.config.ICEServers, webrtc.ICEServer{
+				URLs:       server.URLs,
+				Username:   server.Username,
+				Credential: server.Credential,
+			})
+		}
+	case policy.NoExternalICEServers || policy.LANOnly:
+		p2p.config.ICEServers = nil
+	}
+	return nil
+}
+
+// effectiveICEPolicy returns the session's ICE policy as the network policy
+// and disable_mdns constrain it
+func (p2p *P2PManager) effectiveICEPolicy() protocol.ICEPolicy {
+	p2p.peersMutex.RLock()
+	defer p2p.peersMutex.RUnlock()
+	policy := p2p.networkPolicy.constrain(p2p.icePolicy)
+	if p2p.disableMDNS {
+		policy.DisableMDNS = true
+	}
+	return policy
+}
+
+// CheckTransport refuses transports the network policy doesn't allow, and in
+// LAN-only mode any address outside the local network
+func (p2p *P2PManager) CheckTransport(transport, address string) error {
+	p2p.peersMutex.RLock()
+	policy := p2p.networkPolicy
+	p2p.peersMutex.RUnlock()
+	
+	if !policy.allowsTransport(transport) {
+		return fmt.Errorf("network policy does not allow %s connections", transport)
+	}
+	if !policy.LANOnly || address == "" {
+		return nil
+	}
+	
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ctx, cancel := context.WithTimeout(p2p.ctx, transportResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if !isLocalIP(addr.IP) {
+			return fmt.Errorf("network policy only allows the local network; %s is at %s", host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// isLocalIP reports whether ip is on a private, loopback or link-local network
+func isLocalIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+}
+
+// isLocalCandidate reports whether an ICE candidate ("candidate:..." with or
+// without the SDP "a=" prefix) points into the local network. mDNS names only
+// resolve there.
+func isLocalCandidate(candidate string) bool {
+	fields := strings.Fields(strings.TrimPrefix(candidate, "a="))
+	if len(fields) < 5 {
+		return false
+	}
+	address := fields[4]
+	if strings.HasSuffix(address, ".local") {
+		return true
+	}
+	ip := net.ParseIP(address)
+	return ip != nil && isLocalIP(ip)
+}
+
+// filterRemoteCandidates removes a remote description's candidates outside
+// the local network in LAN-only mode
+func (p2p *P2PManager) filterRemoteCandidates(sdp string) string {
+	p2p.peersMutex.RLock()
+	lanOnly := p2p.networkPolicy.LANOnly
+	p2p.peersMutex.RUnlock()
+	
+	if !lanOnly {
+		return sdp
+	}
+	
+	lines := strings.Split(sdp, "\r\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.HasPrefix(line, "a=candidate:") && !isLocalCandidate(line) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\r\n")
+}
@@ -0,0 +1,1035 @@
+// Package p2p carries messages between peers over WebRTC data channels, SSH
+// tunnels or a central server, and finds them through signaling.
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/EmreDay1/collab.nvim/go/internal/telemetry"
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+type PeerConnection struct {
+	ID            string
+	UserID        string
+	Connection    *webrtc.PeerConnection
+	DataChannel   *webrtc.DataChannel
+	Connected     bool
+	LastHeartbeat time.Time
+	
+	// Unordered, unreliable channel for latency-sensitive traffic
+	UnorderedChannel *webrtc.DataChannel
+	link             *reliableLink
+	
+	// Measured round trip and bandwidth, and the sync profile they chose
+	stats            *linkStats
+	
+	// Messages waiting for the ordered channel to drain, by priority
+	sendQueue *sendQueue
+	
+	// Channels for additional sessions multiplexed onto this connection
+	SessionChannels map[string]*webrtc.DataChannel
+}
+
+type P2PManager struct {
+	localUserID   string
+	peers         map[string]*PeerConnection
+	peersMutex    sync.RWMutex
+	
+	// WebRTC configuration
+	config        webrtc.Configuration
+	icePolicy     protocol.ICEPolicy
+	networkPolicy NetworkPolicy
+	disableMDNS   bool // for every session, from the config
+	
+	// Event handlers
+	onPeerJoined     func(userID string)
+	onPeerLeft       func(userID string)
+	onMessage        func(userID string, data []byte)
+	onSessionMessage func(sessionID, userID string, data []byte)
+	
+	// Fragmentation of large messages
+	reassembler   *Reassembler
+	nextMessageID uint32
+	
+	// Bytes sent to and received from each peer, by kind
+	traffic *TrafficMeter
+	
+	// Join snapshots offered to peers, and the download that last failed
+	snapshots snapshotStore
+	
+	// Index into syncProfiles for the slowest measured peer
+	syncProfile   int
+	onSyncProfile func(profile SyncProfile, links []protocol.LinkQuality)
+	
+	// Signaling server peer-to-peer sessions meet through, and the
+	// connection to it for the current session
+	signalingURL  string
+	signalingPins TLSPins
+	signaling     *signalingClient
+	
+	// Measured round trips to the TURN servers, and the one chosen for the
+	// connection about to be made with a peer
+	relayRTTs  map[string]time.Duration
+	peerRelays map[string]string
+	
+	// Outbound proxy for signaling and TURN over TCP/TLS; nil dials directly
+	proxyDialer ContextDialer
+	
+	// Peers reached through SSH tunnels instead of WebRTC
+	streamPeers map[string]*streamPeer
+	sshClients  []*ssh.Client
+	sshConfig   SSHConfig
+	
+	// Server that mediates all traffic in server mode, and the connection to it
+	serverURL   string
+	serverPins  TLSPins
+	serverToken string // access token presented in the hello
+	server      *serverLink
+	
+	ctx           context.Context
+	cancel        context.CancelFunc
+}
+
+func NewP2PManager() *P2PManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	
+	// Configure WebRTC with STUN servers for NAT traversal
+	config := webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{
+					"stun:stun.l.google.com:19302",
+					"stun:stun1.l.google.com:19302",
+				},
+			},
+		},
+	}
+	
+	p2p := &P2PManager{
+		peers:        make(map[string]*PeerConnection),
+		streamPeers:  make(map[string]*streamPeer),
+		peerRelays:   make(map[string]string),
+		config:       config,
+		reassembler:  NewReassembler(),
+		traffic:      NewTrafficMeter(),
+		snapshots:    snapshotStore{served: make(map[string]*servedSnapshot)},
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+	
+	go p2p.runReliabilityLoop()
+	go p2p.runLinkProbes()
+	go p2p.runReassemblyExpiry()
+	
+	return p2p
+}
+
+// SetUserID sets the local user ID
+func (p2p *P2PManager) SetUserID(userID string) {
+	p2p.localUserID = userID
+}
+
+// SetEventHandlers sets callback functions for P2P events
+func (p2p *P2PManager) SetEventHandlers(
+	onPeerJoined func(string),
+	onPeerLeft func(string), 
+	onMessage func(string, []byte),
+) {
+	p2p.onPeerJoined = onPeerJoined
+	p2p.onPeerLeft = onPeerLeft
+	p2p.onMessage = func(userID string, data []byte) {
+		p2p.traffic.Received(userID, data)
+		onMessage(userID, data)
+	}
+}
+
+// SetProxy routes signaling and TURN TCP/TLS connections through a SOCKS5 or
+// HTTP proxy. An empty URL restores direct connections.
+func (p2p *P2PManager) SetProxy(proxyURL string) error {
+	var dialer ContextDialer
+	if proxyURL != "" {
+		var err error
+		dialer, err = NewProxyDialer(proxyURL)
+		if err != nil {
+			return err
+		}
+	}
+	
+	p2p.peersMutex.Lock()
+	p2p.proxyDialer = dialer
+	p2p.peersMutex.Unlock()
+	
+	return nil
+}
+
+// SignalingDialer returns the dialer to use for signaling connections
+func (p2p *P2PManager) SignalingDialer() ContextDialer {
+	p2p.peersMutex.RLock()
+	defer p2p.peersMutex.RUnlock()
+	
+	if p2p.proxyDialer != nil {
+		return p2p.proxyDialer
+	}
+	return &net.Dialer{}
+}
+
+// SetICEPolicy sets the candidate privacy policy used for new peer connections
+func (p2p *P2PManager) SetICEPolicy(policy protocol.ICEPolicy) error {
+	p2p.peersMutex.RLock()
+	network := p2p.networkPolicy
+	p2p.peersMutex.RUnlock()
+	
+	if len(policy.TURNServers) > 0 && !network.allowsSessionServers() {
+		return fmt.Errorf("network policy only allows the configured ICE servers")
+	}
+	if effective := network.constrain(policy); effective.RelayOnly && !p2p.hasRelayServer(effective) {
+		return fmt.Errorf("relay-only mode requires a TURN server in the ICE configuration")
+	}
+	
+	p2p.peersMutex.Lock()
+	p2p.icePolicy = policy
+	p2p.peersMutex.Unlock()
+	
+	// The session's own TURN servers may be closer than the configured ones
+	if len(policy.TURNServers) > 0 {
+		go p2p.MeasureRelays()
+	}
+	return nil
+}
+
+// SetDisableMDNS has new peer connections publish raw host addresses instead
+// of .local names, whatever the session's ICE policy says
+func (p2p *P2PManager) SetDisableMDNS(disable bool) {
+	p2p.peersMutex.Lock()
+	defer p2p.peersMutex.Unlock()
+	p2p.disableMDNS = disable
+}
+
+// iceServers returns the configured ICE servers plus any from the policy
+func (p2p *P2PManager) iceServers(policy protocol.ICEPolicy) []webrtc.ICEServer {
+	servers := append([]webrtc.ICEServer(nil), p2p.config.ICEServers...)
+	for _, server := range policy.TURNServers {
+		servers = append(servers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+	return servers
+}
+
+// hasRelayServer reports whether any usable ICE server is a TURN server
+func (p2p *P2PManager) hasRelayServer(policy protocol.ICEPolicy) bool {
+	for _, server := range p2p.iceServers(policy) {
+		for _, url := range server.URLs {
+			if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newPeerConnection creates a peer connection honoring the ICE policy and
+// the relay chosen for the peer
+func (p2p *P2PManager) newPeerConnection(peerUserID string) (*webrtc.PeerConnection, error) {
+	if p2p.ServerMode() {
+		return nil, errServerMode
+	}
+	if err := p2p.CheckTransport(TransportWebRTC, ""); err != nil {
+		return nil, err
+	}
+	
+	policy := p2p.effectiveICEPolicy()
+	p2p.peersMutex.RLock()
+	proxyDialer := p2p.proxyDialer
+	lanOnly := p2p.networkPolicy.LANOnly
+	config := p2p.config
+	config.ICEServers = p2p.iceServers(policy)
+	p2p.peersMutex.RUnlock()
+	if relay := p2p.takeRelay(peerUserID); relay != "" {
+		log.Printf("Using relay %s for peer %s", relay, peerUserID)
+		config.ICEServers = onlyRelay(config.ICEServers, relay)
+	}
+	
+	if policy.RelayOnly {
+		config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+	
+	// Host candidates are advertised as random .local names instead of LAN
+	// IPs unless mDNS is disabled for networks that block it
+	settings := webrtc.SettingEngine{}
+	if policy.DisableMDNS {
+		settings.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	} else {
+		settings.SetICEMulticastDNSMode(ice.MulticastDNSModeQueryAndGather)
+	}
+	// Only TCP-based TURN can traverse a proxy; UDP candidates are unaffected
+	if proxyDialer != nil {
+		settings.SetICEProxyDialer(proxyDialer)
+	}
+	if len(policy.Interfaces) > 0 {
+		allowed := make(map[string]bool, len(policy.Interfaces))
+		for _, name := range policy.Interfaces {
+			allowed[name] = true
+		}
+		settings.SetInterfaceFilter(func(name string) bool {
+			return allowed[name]
+		})
+	}
+	if lanOnly {
+		settings.SetIPFilter(isLocalIP)
+	}
+	
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(settings))
+	return api.NewPeerConnection(config)
+}
+
+// shouldShareCandidate applies the ICE policy to a locally gathered candidate
+func (p2p *P2PManager) shouldShareCandidate(candidate *webrtc.ICECandidate) bool {
+	policy := p2p.effectiveICEPolicy()
+	
+	if policy.RelayOnly && candidate.Typ != webrtc.ICECandidateTypeRelay {
+		return false
+	}
+	if policy.DisableHostCandidates && candidate.Typ == webrtc.ICECandidateTypeHost {
+		return false
+	}
+	return true
+}
+
+// CreateOffer creates a WebRTC offer for a new peer connection
+func (p2p *P2PManager) CreateOffer(peerUserID string) (*webrtc.SessionDescription, error) {
+	// Create new peer connection
+	pc, err := p2p.newPeerConnection(peerUserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create peer connection: %v", err)
+	}
+	
+	// Create data channel
+	dc, err := pc.CreateDataChannel("collab", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create data channel: %v", err)
+	}
+	
+	// Create unordered channel without SCTP retransmits; anything that must
+	// arrive is acked and retransmitted by us instead
+	ordered := false
+	noRetransmits := uint16(0)
+	udc, err := pc.CreateDataChannel(unorderedChannelLabel, &webrtc.DataChannelInit{
+		Ordered:        &ordered,
+		MaxRetransmits: &noRetransmits,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create unordered data channel: %v", err)
+	}
+	
+	// Store peer connection
+	peer := &PeerConnection{
+		ID:            fmt.Sprintf("%s-%s", p2p.localUserID, peerUserID),
+		UserID:        peerUserID,
+		Connection:    pc,
+		DataChannel:   dc,
+		Connected:     false,
+		LastHeartbeat: time.Now(),
+		
+		UnorderedChannel: udc,
+		link:             newReliableLink(),
+		stats:            newLinkStats(),
+		sendQueue:        newSendQueue(),
+		SessionChannels:  make(map[string]*webrtc.DataChannel),
+	}
+	
+	p2p.peersMutex.Lock()
+	p2p.peers[peerUserID] = peer
+	p2p.peersMutex.Unlock()
+	
+	// Set up event handlers
+	p2p.setupPeerHandlers(peer)
+	
+	// Create offer
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create offer: %v", err)
+	}
+	
+	// Set local description
+	err = pc.SetLocalDescription(offer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set local description: %v", err)
+	}
+	
+	return &offer, nil
+}
+
+// AddConnectedPeer adds a peer whose connection was set up elsewhere as
+// connected, with no data channels yet
+func (p2p *P2PManager) AddConnectedPeer(peerUserID string, pc *webrtc.PeerConnection) {
+	p2p.peersMutex.Lock()
+	defer p2p.peersMutex.Unlock()
+	p2p.peers[peerUserID] = &PeerConnection{
+		ID:            peerUserID,
+		UserID:        peerUserID,
+		Connection:    pc,
+		Connected:     true,
+		LastHeartbeat: time.Now(),
+		
+		link:            newReliableLink(),
+		stats:           newLinkStats(),
+		sendQueue:       newSendQueue(),
+		SessionChannels: make(map[string]*webrtc.DataChannel),
+	}
+}
+
+// HandleOffer handles an incoming WebRTC offer
+func (p2p *P2PManager) HandleOffer(peerUserID string, offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	// Create new peer connection
+	pc, err := p2p.newPeerConnection(peerUserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create peer connection: %v", err)
+	}
+	
+	// Store peer connection (data channel will be created by remote peer)
+	peer := &PeerConnection{
+		ID:            fmt.Sprintf("%s-%s", peerUserID, p2p.localUserID),
+		UserID:        peerUserID,
+		Connection:    pc,
+		DataChannel:   nil, // Will be set when data channel is received
+		Connected:     false,
+		LastHeartbeat: time.Now(),
+		
+		link:            newReliableLink(),
+		stats:           newLinkStats(),
+		sendQueue:       newSendQueue(),
+		SessionChannels: make(map[string]*webrtc.DataChannel),
+	}
+	
+	p2p.peersMutex.Lock()
+	p2p.peers[peerUserID] = peer
+	p2p.peersMutex.Unlock()
+	
+	// Set up event handlers
+	p2p.setupPeerHandlers(peer)
+	
+	// Set remote description
+	offer.SDP = p2p.filterRemoteCandidates(offer.SDP)
+	err = pc.SetRemoteDescription(offer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set remote description: %v", err)
+	}
+	
+	// Create answer
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create answer: %v", err)
+	}
+	
+	// Set local description
+	err = pc.SetLocalDescription(answer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set local description: %v", err)
+	}
+	
+	return &answer, nil
+}
+
+// HandleAnswer handles an incoming WebRTC answer
+func (p2p *P2PManager) HandleAnswer(peerUserID string, answer webrtc.SessionDescription) error {
+	p2p.peersMutex.RLock()
+	peer, exists := p2p.peers[peerUserID]
+	p2p.peersMutex.RUnlock()
+	
+	if !exists {
+		return fmt.Errorf("no peer connection found for user %s", peerUserID)
+	}
+	
+	// Set remote description
+	answer.SDP = p2p.filterRemoteCandidates(answer.SDP)
+	err := peer.Connection.SetRemoteDescription(answer)
+	if err != nil {
+		return fmt.Errorf("failed to set remote description: %v", err)
+	}
+	
+	return nil
+}
+
+// AddICECandidate adds an ICE candidate to a peer connection
+func (p2p *P2PManager) AddICECandidate(peerUserID string, candidate webrtc.ICECandidateInit) error {
+	p2p.peersMutex.RLock()
+	peer, exists := p2p.peers[peerUserID]
+	p2p.peersMutex.RUnlock()
+	
+	if !exists {
+		return fmt.Errorf("no peer connection found for user %s", peerUserID)
+	}
+	
+	p2p.peersMutex.RLock()
+	lanOnly := p2p.networkPolicy.LANOnly
+	p2p.peersMutex.RUnlock()
+	if lanOnly && !isLocalCandidate(candidate.Candidate) {
+		return fmt.Errorf("network policy only allows candidates on the local network")
+	}
+	
+	err := peer.Connection.AddICECandidate(candidate)
+	if err != nil {
+		return fmt.Errorf("failed to add ICE candidate: %v", err)
+	}
+	
+	return nil
+}
+
+// SendMessage sends a message to a specific peer
+func (p2p *P2PManager) SendMessage(peerUserID string, data []byte) error {
+	if link := p2p.serverLinkIfConnected(); link != nil {
+		p2p.traffic.Sent(peerUserID, data)
+		return link.send(peerUserID, data)
+	}
+	
+	p2p.peersMutex.RLock()
+	peer, exists := p2p.peers[peerUserID]
+	stream := p2p.streamPeers[peerUserID]
+	p2p.peersMutex.RUnlock()
+	
+	if !exists && stream != nil {
+		if err := stream.send(data); err != nil {
+			return fmt.Errorf("failed to send message to peer %s: %v", peerUserID, err)
+		}
+		p2p.traffic.Sent(peerUserID, data)
+		return nil
+	}
+	if !exists {
+		return fmt.Errorf("no peer connection found for user %s", peerUserID)
+	}
+	
+	if !peer.Connected || peer.DataChannel == nil {
+		return fmt.Errorf("peer %s is not connected", peerUserID)
+	}
+	
+	err := p2p.sendPrioritized(peer, data)
+	if err != nil {
+		return fmt.Errorf("failed to send message to peer %s: %v", peerUserID, err)
+	}
+	
+	return nil
+}
+
+// sendToChannel sends data over one of a peer's data channels, compressing it
+// for slow links and fragmenting it when it's too large for a single SCTP
+// message
+func (p2p *P2PManager) sendToChannel(peer *PeerConnection, dc *webrtc.DataChannel, data []byte) error {
+	p2p.traffic.Sent(peer.UserID, data)
+	data = peer.prepareOutgoing(data)
+	messageID := atomic.AddUint32(&p2p.nextMessageID, 1)
+	for _, fragment := range fragmentMessage(messageID, data) {
+		if err := dc.Send(fragment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendUnordered sends a message over the unordered channel. Lossy messages
+// may be dropped; acked messages are retransmitted until the peer confirms
+// them. Messages too large for one packet go over the ordered channel.
+func (p2p *P2PManager) SendUnordered(peerUserID string, data []byte, acked bool) error {
+	p2p.peersMutex.RLock()
+	peer, exists := p2p.peers[peerUserID]
+	p2p.peersMutex.RUnlock()
+	
+	if !exists {
+		return fmt.Errorf("no peer connection found for user %s", peerUserID)
+	}
+	
+	if !peer.Connected {
+		return fmt.Errorf("peer %s is not connected", peerUserID)
+	}
+	
+	return p2p.sendUnorderedToPeer(peer, data, acked)
+}
+
+// BroadcastUnordered sends a message to all connected peers over their
+// unordered channels
+func (p2p *P2PManager) BroadcastUnordered(data []byte, acked bool) error {
+	p2p.peersMutex.RLock()
+	defer p2p.peersMutex.RUnlock()
+	
+	var lastErr error
+	sentCount := 0
+	
+	for userID, peer := range p2p.peers {
+		if !peer.Connected {
+			continue
+		}
+		if err := p2p.sendUnorderedToPeer(peer, data, acked); err != nil {
+			log.Printf("Failed to send unordered message to peer %s: %v", userID, err)
+			lastErr = err
+		} else {
+			sentCount++
+		}
+	}
+	// SSH tunnels only have the ordered stream
+	for userID, peer := range p2p.streamPeers {
+		if err := peer.send(data); err != nil {
+			log.Printf("Failed to send message to peer %s: %v", userID, err)
+			lastErr = err
+		} else {
+			p2p.traffic.Sent(userID, data)
+			sentCount++
+		}
+	}
+	
+	if sentCount == 0 && lastErr != nil {
+		return fmt.Errorf("failed to send message to any peer: %v", lastErr)
+	}
+	
+	return nil
+}
+
+func (p2p *P2PManager) sendUnorderedToPeer(peer *PeerConnection, data []byte, acked bool) error {
+	dc := peer.UnorderedChannel
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen || len(data)+packetHeaderLen > maxDataChannelMessage {
+		if peer.DataChannel == nil {
+			return fmt.Errorf("peer %s has no open data channel", peer.UserID)
+		}
+		return p2p.sendPrioritized(peer, data)
+	}
+	
+	p2p.traffic.Sent(peer.UserID, data)
+	if acked {
+		return dc.Send(peer.link.prepare(data))
+	}
+	return dc.Send(encodePacket(packetKindLossy, 0, data))
+}
+
+// runReliabilityLoop flushes SACKs and retransmits unacknowledged packets
+func (p2p *P2PManager) runReliabilityLoop() {
+	ticker := time.NewTicker(reliabilityTick)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-p2p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			p2p.peersMutex.RLock()
+			peers := make([]*PeerConnection, 0, len(p2p.peers))
+			for _, peer := range p2p.peers {
+				peers = append(peers, peer)
+			}
+			p2p.peersMutex.RUnlock()
+			
+			for _, peer := range peers {
+				p2p.flushReliability(peer, now)
+			}
+		}
+	}
+}
+
+func (p2p *P2PManager) flushReliability(peer *PeerConnection, now time.Time) {
+	dc := peer.UnorderedChannel
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+	
+	if sack := peer.link.buildSACK(); sack != nil {
+		if err := dc.Send(sack); err != nil {
+			log.Printf("Failed to send SACK to peer %s: %v", peer.UserID, err)
+		}
+	}
+	
+	retransmit, exhausted := peer.link.dueForRetransmit(now, peer.stats.rto())
+	for _, packet := range retransmit {
+		if err := dc.Send(packet); err != nil {
+			log.Printf("Failed to retransmit to peer %s: %v", peer.UserID, err)
+		}
+	}
+	
+	// Give up on the unordered channel for packets that keep getting lost
+	for _, payload := range exhausted {
+		if peer.DataChannel == nil {
+			continue
+		}
+		if err := p2p.sendPrioritized(peer, payload); err != nil {
+			log.Printf("Failed to resend to peer %s over ordered channel: %v", peer.UserID, err)
+		}
+	}
+}
+
+// BroadcastMessage sends a message to all connected peers
+func (p2p *P2PManager) BroadcastMessage(data []byte) error {
+	return p2p.BroadcastMessageContext(context.Background(), data)
+}
+
+// BroadcastMessageContext is BroadcastMessage traced as part of ctx
+func (p2p *P2PManager) BroadcastMessageContext(ctx context.Context, data []byte) (err error) {
+	_, span := telemetry.Tracer.Start(ctx, "p2p.broadcast", trace.WithAttributes(telemetry.AttrPayloadBytes.Int(len(data))))
+	defer func() { telemetry.EndSpan(span, err) }()
+	
+	// The server fans broadcasts out to everyone else in the session
+	if link := p2p.serverLinkIfConnected(); link != nil {
+		p2p.traffic.Sent(protocol.ServerUserID, data)
+		return link.send("", data)
+	}
+	
+	p2p.peersMutex.RLock()
+	defer p2p.peersMutex.RUnlock()
+	span.SetAttributes(telemetry.AttrPeerCount.Int(len(p2p.peers) + len(p2p.streamPeers)))
+	
+	var lastErr error
+	sentCount := 0
+	
+	for userID, peer := range p2p.peers {
+		if peer.Connected && peer.DataChannel != nil {
+			err := p2p.sendPrioritized(peer, data)
+			if err != nil {
+				log.Printf("Failed to send message to peer %s: %v", userID, err)
+				lastErr = err
+			} else {
+				sentCount++
+			}
+		}
+	}
+	for userID, peer := range p2p.streamPeers {
+		if err := peer.send(data); err != nil {
+			log.Printf("Failed to send message to peer %s: %v", userID, err)
+			lastErr = err
+		} else {
+			p2p.traffic.Sent(userID, data)
+			sentCount++
+		}
+	}
+	
+	if sentCount == 0 && lastErr != nil {
+		return fmt.Errorf("failed to send message to any peer: %v", lastErr)
+	}
+	
+	return nil
+}
+
+// DisconnectPeer closes connection to a specific peer. The peer is removed
+// before peersMutex is released, and closed and reported as left after, so
+// handlers of its leaving can send to the others.
+func (p2p *P2PManager) DisconnectPeer(peerUserID string) error {
+	p2p.peersMutex.Lock()
+	peer, exists := p2p.peers[peerUserID]
+	if !exists {
+		// The stream's read loop removes it and reports it as left
+		if stream, ok := p2p.streamPeers[peerUserID]; ok {
+			stream.conn.Close()
+		}
+		p2p.peersMutex.Unlock()
+		return nil // Already disconnected
+	}
+	delete(p2p.peers, peerUserID)
+	sessionChannels := make([]*webrtc.DataChannel, 0, len(peer.SessionChannels))
+	for _, dc := range peer.SessionChannels {
+		sessionChannels = append(sessionChannels, dc)
+	}
+	p2p.peersMutex.Unlock()
+	
+	// Close data channels, dropping what waits for them
+	peer.sendQueue.close()
+	if peer.DataChannel != nil {
+		peer.DataChannel.Close()
+	}
+	if peer.UnorderedChannel != nil {
+		peer.UnorderedChannel.Close()
+	}
+	for _, dc := range sessionChannels {
+		dc.Close()
+	}
+	
+	// Close peer connection
+	peer.Connection.Close()
+	p2p.reassembler.DropPeer(peerUserID)
+	
+	// Notify about peer leaving
+	if p2p.onPeerLeft != nil {
+		p2p.onPeerLeft(peerUserID)
+	}
+	
+	return nil
+}
+
+// GetConnectedPeers returns list of connected peer user IDs
+func (p2p *P2PManager) GetConnectedPeers() []string {
+	p2p.peersMutex.RLock()
+	defer p2p.peersMutex.RUnlock()
+	
+	var connectedPeers []string
+	for userID, peer := range p2p.peers {
+		if peer.Connected {
+			connectedPeers = append(connectedPeers, userID)
+		}
+	}
+	for userID := range p2p.streamPeers {
+		connectedPeers = append(connectedPeers, userID)
+	}
+	if p2p.server != nil {
+		for userID := range p2p.server.members {
+			connectedPeers = append(connectedPeers, userID)
+		}
+	}
+	
+	return connectedPeers
+}
+
+// Shutdown closes all peer connections and cleans up
+func (p2p *P2PManager) Shutdown() {
+	p2p.cancel() // Cancel context
+	
+	p2p.peersMutex.Lock()
+	defer p2p.peersMutex.Unlock()
+	
+	// Close all peer connections
+	for userID := range p2p.peers {
+		peer := p2p.peers[userID]
+		if peer.DataChannel != nil {
+			peer.DataChannel.Close()
+		}
+		if peer.UnorderedChannel != nil {
+			peer.UnorderedChannel.Close()
+		}
+		for _, dc := range peer.SessionChannels {
+			dc.Close()
+		}
+		peer.Connection.Close()
+	}
+	
+	// Clear peers map
+	p2p.peers = make(map[string]*PeerConnection)
+	p2p.closeSSH()
+	if p2p.signaling != nil {
+		p2p.signaling.conn.Close()
+		p2p.signaling = nil
+	}
+	if p2p.server != nil {
+		p2p.server.conn.Close()
+		p2p.server = nil
+	}
+}
+
+// setupPeerHandlers sets up event handlers for a peer connection
+func (p2p *P2PManager) setupPeerHandlers(peer *PeerConnection) {
+	// Connection state handler
+	peer.Connection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("Peer %s connection state: %s", peer.UserID, state.String())
+		
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			peer.Connected = true
+			if p2p.onPeerJoined != nil {
+				p2p.onPeerJoined(peer.UserID)
+			}
+		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			peer.Connected = false
+			p2p.DisconnectPeer(peer.UserID)
+		}
+	})
+	
+	// ICE candidate handler
+	peer.Connection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		
+		if !p2p.shouldShareCandidate(candidate) {
+			log.Printf("Withholding %s candidate for peer %s due to ICE policy", candidate.Typ.String(), peer.UserID)
+			return
+		}
+		
+		if p2p.signalCandidate(peer.UserID, candidate.ToJSON()) {
+			return
+		}
+		// Manual signaling carries candidates in the offer or answer instead
+		log.Printf("Generated ICE candidate for peer %s: %s", peer.UserID, candidate.String())
+	})
+	
+	// Data channel handler (for incoming data channels)
+	peer.Connection.OnDataChannel(func(dc *webrtc.DataChannel) {
+		log.Printf("Received data channel %s from peer %s", dc.Label(), peer.UserID)
+		if dc.Label() == unorderedChannelLabel {
+			peer.UnorderedChannel = dc
+			p2p.setupUnorderedChannelHandlers(peer, dc)
+			return
+		}
+		if sessionID, ok := sessionIDFromLabel(dc.Label()); ok {
+			p2p.acceptSessionChannel(peer, sessionID, dc)
+			return
+		}
+		if snapshotID, ok := snapshotIDFromLabel(dc.Label()); ok {
+			p2p.serveSnapshotChannel(peer, snapshotID, dc)
+			return
+		}
+		peer.DataChannel = dc
+		p2p.setupDataChannelHandlers(peer, dc)
+	})
+	
+	// If we have a data channel (outgoing connection), set up handlers
+	if peer.DataChannel != nil {
+		p2p.setupDataChannelHandlers(peer, peer.DataChannel)
+	}
+	if peer.UnorderedChannel != nil {
+		p2p.setupUnorderedChannelHandlers(peer, peer.UnorderedChannel)
+	}
+}
+
+// setupUnorderedChannelHandlers sets up handlers for the unordered channel
+func (p2p *P2PManager) setupUnorderedChannelHandlers(peer *PeerConnection, dc *webrtc.DataChannel) {
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		peer.LastHeartbeat = time.Now()
+		
+		kind, seq, payload, err := decodePacket(msg.Data)
+		if err != nil {
+			log.Printf("Dropping unordered packet from peer %s: %v", peer.UserID, err)
+			return
+		}
+		
+		switch kind {
+		case packetKindLossy:
+			// Delivered as is, no acknowledgment
+		case packetKindAcked:
+			if !peer.link.receive(seq) {
+				return // Retransmit of something we already delivered
+			}
+		case packetKindSACK:
+			if err := peer.link.handleSACK(payload); err != nil {
+				log.Printf("Bad SACK from peer %s: %v", peer.UserID, err)
+			}
+			return
+		case packetKindPing, packetKindPong:
+			p2p.handleProbe(peer, dc, kind, payload)
+			return
+		default:
+			log.Printf("Unknown unordered packet kind %d from peer %s", kind, peer.UserID)
+			return
+		}
+		
+		if p2p.onMessage != nil {
+			p2p.onMessage(peer.UserID, payload)
+		}
+	})
+	
+	dc.OnError(func(err error) {
+		log.Printf("Unordered channel error with peer %s: %v", peer.UserID, err)
+	})
+}
+
+// setupDataChannelHandlers sets up handlers for a data channel
+func (p2p *P2PManager) setupDataChannelHandlers(peer *PeerConnection, dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		log.Printf("Data channel opened with peer %s", peer.UserID)
+		peer.Connected = true
+	})
+	
+	dc.OnClose(func() {
+		log.Printf("Data channel closed with peer %s", peer.UserID)
+		peer.Connected = false
+	})
+	
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		peer.LastHeartbeat = time.Now()
+		
+		data := msg.Data
+		if isFragment(data) {
+			message, complete, err := p2p.reassembler.Add(peer.UserID, data)
+			if err != nil {
+				log.Printf("Dropping fragment from peer %s: %v", peer.UserID, err)
+				return
+			}
+			if !complete {
+				return
+			}
+			data = message
+		}
+		if isCompressed(data) {
+			message, err := decompressMessage(data)
+			if err != nil {
+				log.Printf("Dropping message from peer %s: %v", peer.UserID, err)
+				return
+			}
+			data = message
+		}
+		
+		// Handle incoming message
+		if p2p.onMessage != nil {
+			p2p.onMessage(peer.UserID, data)
+		}
+	})
+	
+	dc.OnError(func(err error) {
+		log.Printf("Data channel error with peer %s: %v", peer.UserID, err)
+	})
+}
+
+// StartHeartbeat starts a heartbeat routine to monitor peer connections
+func (p2p *P2PManager) StartHeartbeat() {
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		
+		for {
+			select {
+			case <-p2p.ctx.Done():
+				return
+			case <-ticker.C:
+				p2p.sendHeartbeats()
+				p2p.checkPeerTimeouts()
+			}
+		}
+	}()
+}
+
+// sendHeartbeats sends heartbeat messages to all connected peers
+func (p2p *P2PManager) sendHeartbeats() {
+	heartbeat := map[string]interface{}{
+		"type": "heartbeat",
+		"from": p2p.localUserID,
+		"time": time.Now().Unix(),
+	}
+	
+	data, _ := json.Marshal(heartbeat)
+	p2p.BroadcastMessage(data)
+}
+
+// checkPeerTimeouts checks for and removes timed-out peers
+func (p2p *P2PManager) checkPeerTimeouts() {
+	timeout := 60 * time.Second
+	now := time.Now()
+	
+	p2p.peersMutex.RLock()
+	var timedOutPeers []string
+	for userID, peer := range p2p.peers {
+		if now.Sub(peer.LastHeartbeat) > timeout {
+			timedOutPeers = append(timedOutPeers, userID)
+		}
+	}
+	p2p.peersMutex.RUnlock()
+	
+	// Disconnect timed-out peers
+	for _, userID := range timedOutPeers {
+		log.Printf("Peer %s timed out, disconnecting", userID)
+		p2p.DisconnectPeer(userID)
+	}
+}
+
+// GetICEPolicy returns the candidate policy used for new peer connections
+func (p2p *P2PManager) GetICEPolicy() protocol.ICEPolicy {
+	p2p.peersMutex.RLock()
+	defer p2p.peersMutex.RUnlock()
+	return p2p.icePolicy
+}
@@ -0,0 +1,254 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// With TURN servers in several regions configured, each peer connection
+// uses only the one that suits that pair of peers. The round trip to every
+// TURN server is measured when the backend starts (a STUN binding request,
+// or a TCP connect for TURN over TCP or TLS) and whenever a session brings
+// its own. Peers meeting through a signaling server share their round
+// trips; the newcomer picks the relay with the smallest sum of both, and
+// the offer tells the other side to use it too. Offers pasted by hand carry
+// the relay nearest to whoever created them. STUN servers are kept either
+// way, so direct connections are unaffected.
+const (
+	relayProbeTimeout  = 2 * time.Second
+	relayProbeAttempts = 3
+	STUNMagicCookie    = 0x2112A442
+)
+
+// relayKey names a TURN server by its first URL
+func relayKey(server webrtc.ICEServer) string {
+	for _, url := range server.URLs {
+		if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+			return url
+		}
+	}
+	return ""
+}
+
+// MeasureRelays measures the round trip to each TURN server in use, when
+// there is more than one to choose from
+func (p2p *P2PManager) MeasureRelays() {
+	if p2p.ServerMode() || p2p.CheckTransport(TransportWebRTC, "") != nil {
+		return
+	}
+	policy := p2p.effectiveICEPolicy()
+	p2p.peersMutex.RLock()
+	servers := p2p.iceServers(policy)
+	p2p.peersMutex.RUnlock()
+	
+	var relays []webrtc.ICEServer
+	for _, server := range servers {
+		if relayKey(server) != "" {
+			relays = append(relays, server)
+		}
+	}
+	if len(relays) < 2 {
+		p2p.peersMutex.Lock()
+		p2p.relayRTTs = nil
+		p2p.peersMutex.Unlock()
+		return
+	}
+	
+	rtts := make(map[string]time.Duration)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, server := range relays {
+		wg.Add(1)
+		go func(server webrtc.ICEServer) {
+			defer wg.Done()
+			best := time.Duration(0)
+			for _, url := range server.URLs {
+				if rtt, err := p2p.probeRelay(url); err == nil && (best == 0 || rtt < best) {
+					best = rtt
+				}
+			}
+			if best == 0 {
+				log.Printf("Relay %s didn't answer; it won't be chosen", relayKey(server))
+				return
+			}
+			mutex.Lock()
+			rtts[relayKey(server)] = best
+			mutex.Unlock()
+		}(server)
+	}
+	wg.Wait()
+	
+	for key, rtt := range rtts {
+		log.Printf("Relay %s is %dms away", key, rtt.Milliseconds())
+	}
+	p2p.peersMutex.Lock()
+	p2p.relayRTTs = rtts
+	p2p.peersMutex.Unlock()
+}
+
+// RelayRTTs returns the measured round trips in milliseconds by relay, nil
+// when there is no choice to make
+func (p2p *P2PManager) RelayRTTs() map[string]int64 {
+	p2p.peersMutex.RLock()
+	defer p2p.peersMutex.RUnlock()
+	if len(p2p.relayRTTs) == 0 {
+		return nil
+	}
+	rtts := make(map[string]int64, len(p2p.relayRTTs))
+	for key, rtt := range p2p.relayRTTs {
+		rtts[key] = rtt.Milliseconds()
+	}
+	return rtts
+}
+
+// chooseRelay picks the relay with the smallest round trip for both peers,
+// or for the local one when remote measured nothing in common. "" leaves
+// every relay in use.
+func chooseRelay(local, remote map[string]int64) string {
+	best, bestRTT := "", int64(-1)
+	consider := func(key string, rtt int64) {
+		if bestRTT < 0 || rtt < bestRTT || rtt == bestRTT && key < best {
+			best, bestRTT = key, rtt
+		}
+	}
+	for key, rtt := range local {
+		if remoteRTT, ok := remote[key]; ok {
+			consider(key, rtt+remoteRTT)
+		}
+	}
+	if best != "" {
+		return best
+	}
+	for key, rtt := range local {
+		consider(key, rtt)
+	}
+	return best
+}
+
+// useRelay has the next connection made with userID use only relay. Relays
+// not configured here are ignored.
+func (p2p *P2PManager) useRelay(userID, relay string) {
+	p2p.peersMutex.Lock()
+	defer p2p.peersMutex.Unlock()
+	if _, ok := p2p.relayRTTs[relay]; !ok {
+		delete(p2p.peerRelays, userID)
+		return
+	}
+	p2p.peerRelays[userID] = relay
+}
+
+// takeRelay returns the relay chosen for the connection being made with
+// userID, if any
+func (p2p *P2PManager) takeRelay(userID string) string {
+	p2p.peersMutex.Lock()
+	defer p2p.peersMutex.Unlock()
+	relay := p2p.peerRelays[userID]
+	delete(p2p.peerRelays, userID)
+	return relay
+}
+
+// onlyRelay drops every TURN server but relay
+func onlyRelay(servers []webrtc.ICEServer, relay string) []webrtc.ICEServer {
+	if relay == "" {
+		return servers
+	}
+	kept := make([]webrtc.ICEServer, 0, len(servers))
+	for _, server := range servers {
+		if key := relayKey(server); key == "" || key == relay {
+			kept = append(kept, server)
+		}
+	}
+	return kept
+}
+
+// probeRelay measures the round trip to a TURN URL such as
+// "turn:eu.example.com:3478?transport=udp"
+func (p2p *P2PManager) probeRelay(url string) (time.Duration, error) {
+	scheme, rest, _ := strings.Cut(url, ":")
+	address, query, _ := strings.Cut(rest, "?")
+	port := "3478"
+	if scheme == "turns" {
+		port = "5349"
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), port)
+	}
+	udp := scheme == "turn" && !strings.Contains(query, "transport=tcp")
+	
+	best := time.Duration(0)
+	var lastErr error
+	for i := 0; i < relayProbeAttempts; i++ {
+		var rtt time.Duration
+		var err error
+		if udp {
+			rtt, err = stunBindingRTT(address)
+		} else {
+			rtt, err = p2p.tcpConnectRTT(address)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if best == 0 || rtt < best {
+			best = rtt
+		}
+	}
+	if best == 0 {
+		return 0, lastErr
+	}
+	return best, nil
+}
+
+// stunBindingRTT times a STUN binding request, which TURN servers answer
+// without credentials
+func stunBindingRTT(address string) (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", address, relayProbeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:], 0x0001)
+	binary.BigEndian.PutUint32(request[4:], STUNMagicCookie)
+	rand.Read(request[8:])
+	
+	conn.SetDeadline(time.Now().Add(relayProbeTimeout))
+	start := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+	response := make([]byte, 1500)
+	for {
+		n, err := conn.Read(response)
+		if err != nil {
+			return 0, err
+		}
+		if n >= 20 && bytes.Equal(response[8:20], request[8:]) {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// tcpConnectRTT times a TCP connect, through the proxy when there is one as
+// TURN over TCP would go
+func (p2p *P2PManager) tcpConnectRTT(address string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(p2p.ctx, relayProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := p2p.SignalingDialer().DialContext(ctx, "tcp", address)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(start), nil
+}
@@ -0,0 +1,203 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The unordered data channel trades reliability for latency. Lossy packets
+// (cursor spam) are fire-and-forget; acked packets (document operations)
+// carry a sequence number and are retransmitted until the receiver reports
+// them in a selective acknowledgment.
+//
+// Packet layout: magic (1 byte) | kind (1) | sequence (4) | payload
+// A SACK payload is the cumulative ack (4) followed by [start, end] ranges
+// (4 + 4 each) of packets received beyond it.
+const (
+	unorderedChannelLabel = "collab-unordered"
+	
+	reliabilityMagic byte = 0xCE
+	packetHeaderLen       = 6
+	packetKindLossy  byte = 0
+	packetKindAcked  byte = 1
+	packetKindSACK   byte = 2
+	packetKindPing   byte = 3 // link probes, see linkquality.go
+	packetKindPong   byte = 4
+	maxSACKRanges         = 64
+	
+	retransmitTimeout = 500 * time.Millisecond
+	maxRetransmits    = 8
+	reliabilityTick   = 100 * time.Millisecond
+)
+
+// isReliabilityPacket reports whether data is an unordered channel packet
+func isReliabilityPacket(data []byte) bool {
+	return len(data) >= packetHeaderLen && data[0] == reliabilityMagic
+}
+
+func encodePacket(kind byte, seq uint32, payload []byte) []byte {
+	packet := make([]byte, packetHeaderLen+len(payload))
+	packet[0] = reliabilityMagic
+	packet[1] = kind
+	binary.BigEndian.PutUint32(packet[2:6], seq)
+	copy(packet[packetHeaderLen:], payload)
+	return packet
+}
+
+func decodePacket(data []byte) (byte, uint32, []byte, error) {
+	if !isReliabilityPacket(data) {
+		return 0, 0, nil, fmt.Errorf("not an unordered channel packet")
+	}
+	return data[1], binary.BigEndian.Uint32(data[2:6]), data[packetHeaderLen:], nil
+}
+
+type pendingPacket struct {
+	packet   []byte
+	sentAt   time.Time
+	attempts int
+}
+
+// reliableLink holds the per-peer sender and receiver state for acked packets
+type reliableLink struct {
+	// Sender side
+	nextSeq uint32
+	unacked map[uint32]*pendingPacket
+	
+	// Receiver side
+	cumulative uint32          // every sequence number up to this was received
+	received   map[uint32]bool // received sequence numbers beyond cumulative
+	ackPending bool
+	
+	mutex sync.Mutex
+}
+
+func newReliableLink() *reliableLink {
+	return &reliableLink{
+		unacked:  make(map[uint32]*pendingPacket),
+		received: make(map[uint32]bool),
+	}
+}
+
+// prepare assigns the next sequence number to payload and tracks it until acked
+func (rl *reliableLink) prepare(payload []byte) []byte {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	
+	rl.nextSeq++
+	packet := encodePacket(packetKindAcked, rl.nextSeq, payload)
+	rl.unacked[rl.nextSeq] = &pendingPacket{
+		packet:   packet,
+		sentAt:   time.Now(),
+		attempts: 1,
+	}
+	return packet
+}
+
+// receive records an acked packet and reports whether it's new
+func (rl *reliableLink) receive(seq uint32) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	
+	rl.ackPending = true
+	if seq <= rl.cumulative || rl.received[seq] {
+		return false
+	}
+	
+	rl.received[seq] = true
+	for rl.received[rl.cumulative+1] {
+		delete(rl.received, rl.cumulative+1)
+		rl.cumulative++
+	}
+	return true
+}
+
+// buildSACK returns a SACK packet if anything was received since the last one
+func (rl *reliableLink) buildSACK() []byte {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	
+	if !rl.ackPending {
+		return nil
+	}
+	rl.ackPending = false
+	
+	seqs := make([]uint32, 0, len(rl.received))
+	for seq := range rl.received {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	
+	payload := make([]byte, 4, 4+8*maxSACKRanges)
+	binary.BigEndian.PutUint32(payload, rl.cumulative)
+	ranges := 0
+	for i := 0; i < len(seqs) && ranges < maxSACKRanges; ranges++ {
+		start := seqs[i]
+		end := start
+		for i+1 < len(seqs) && seqs[i+1] == end+1 {
+			i++
+			end = seqs[i]
+		}
+		i++
+		payload = binary.BigEndian.AppendUint32(payload, start)
+		payload = binary.BigEndian.AppendUint32(payload, end)
+	}
+	
+	return encodePacket(packetKindSACK, 0, payload)
+}
+
+// handleSACK drops every packet the receiver acknowledged
+func (rl *reliableLink) handleSACK(payload []byte) error {
+	if len(payload) < 4 || (len(payload)-4)%8 != 0 {
+		return fmt.Errorf("malformed SACK of %d bytes", len(payload))
+	}
+	
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	
+	cumulative := binary.BigEndian.Uint32(payload[:4])
+	for seq := range rl.unacked {
+		if seq <= cumulative {
+			delete(rl.unacked, seq)
+		}
+	}
+	
+	for offset := 4; offset < len(payload); offset += 8 {
+		start := binary.BigEndian.Uint32(payload[offset : offset+4])
+		end := binary.BigEndian.Uint32(payload[offset+4 : offset+8])
+		for seq := range rl.unacked {
+			if seq >= start && seq <= end {
+				delete(rl.unacked, seq)
+			}
+		}
+	}
+	
+	return nil
+}
+
+// dueForRetransmit returns packets whose ack took longer than timeout, plus
+// payloads that exhausted their retransmits and must fall back to the ordered
+// channel
+func (rl *reliableLink) dueForRetransmit(now time.Time, timeout time.Duration) ([][]byte, [][]byte) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	
+	var retransmit, exhausted [][]byte
+	for seq, pending := range rl.unacked {
+		if now.Sub(pending.sentAt) < timeout {
+			continue
+		}
+		if pending.attempts >= maxRetransmits {
+			exhausted = append(exhausted, pending.packet[packetHeaderLen:])
+			delete(rl.unacked, seq)
+			continue
+		}
+		pending.attempts++
+		pending.sentAt = now
+		retransmit = append(retransmit, pending.packet)
+	}
+	
+	return retransmit, exhausted
+}
@@ -0,0 +1,172 @@
+package p2p
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Messages for a peer's ordered channel are sent right away while little is
+// queued in SCTP for it. Once sendQueueHighWater or more is, they wait in the
+// peer's send queue, one FIFO per priority class, and go out as the channel
+// drains, the highest class first: critical for document operations and
+// control, normal for chat, roster and the rest, low for cursors and metrics.
+// A congested link thus never holds operations behind presence chatter. Low
+// messages are superseded by newer ones, so beyond sendQueueMaxLow queued the
+// oldest are dropped. A peer's queue is discarded when it disconnects.
+const (
+	priorityCritical = iota
+	priorityNormal
+	priorityLow
+	priorityClasses
+)
+
+const (
+	sendQueueHighWater = 256 * 1024
+	sendQueueLowWater  = 64 * 1024
+	sendQueueMaxLow    = 256
+	
+	// How often a waiting queue looks at the channel when no drain is signaled
+	sendQueuePoll = 100 * time.Millisecond
+)
+
+// messagePriority gives the priority class of a peer message
+func messagePriority(data []byte) int {
+	if protocol.IsOperationFrame(data) {
+		return priorityCritical
+	}
+	if protocol.IsPresenceFrame(data) {
+		return priorityLow
+	}
+	switch MessageType(data) {
+	case protocol.MsgDocumentOperation, protocol.MsgDocumentOperations, protocol.MsgTransactionPart, protocol.MsgOperationAck,
+		protocol.MsgRequestControl, protocol.MsgGrantControl, protocol.MsgDenyControl, protocol.MsgReleaseControl,
+		protocol.MsgControlStatus, protocol.MsgGrantTemporaryControl:
+		return priorityCritical
+	case protocol.MsgCursorMove, protocol.MsgPresenceChanged, protocol.MsgSelectionUpdate,
+		protocol.MsgFrontier, protocol.MsgDocumentDigest, protocol.MsgMetrics:
+		return priorityLow
+	}
+	return priorityNormal
+}
+
+// sendQueue holds a peer's messages while its ordered channel is congested.
+// It drains while anything is queued or the last message taken is in flight.
+type sendQueue struct {
+	classes  [priorityClasses][][]byte
+	draining bool
+	closed   bool
+	dropped  int
+	drained  chan struct{}
+	mutex    sync.Mutex
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{drained: make(chan struct{}, 1)}
+}
+
+// push queues data in its class, dropping the oldest low message when there
+// are too many
+func (sq *sendQueue) push(class int, data []byte) {
+	sq.classes[class] = append(sq.classes[class], data)
+	if class == priorityLow && len(sq.classes[class]) > sendQueueMaxLow {
+		sq.classes[class][0] = nil
+		sq.classes[class] = sq.classes[class][1:]
+		sq.dropped++
+	}
+}
+
+// pop takes the oldest message of the highest class queued, or stops
+// draining when there is none
+func (sq *sendQueue) pop() ([]byte, bool) {
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+	for class := range sq.classes {
+		if queued := sq.classes[class]; len(queued) > 0 {
+			data := queued[0]
+			queued[0] = nil
+			sq.classes[class] = queued[1:]
+			return data, true
+		}
+	}
+	sq.draining = false
+	return nil, false
+}
+
+// close discards everything queued, e.g. when the peer disconnects
+func (sq *sendQueue) close() {
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+	sq.closed = true
+	sq.classes = [priorityClasses][][]byte{}
+}
+
+// sendPrioritized sends data over a peer's ordered channel, or queues it by
+// priority while the channel is congested or others wait before it
+func (p2p *P2PManager) sendPrioritized(peer *PeerConnection, data []byte) error {
+	sq := peer.sendQueue
+	dc := peer.DataChannel
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+	if sq.closed {
+		return nil
+	}
+	if !sq.draining && dc.BufferedAmount() < sendQueueHighWater {
+		return p2p.sendToChannel(peer, dc, data)
+	}
+	
+	sq.push(messagePriority(data), data)
+	if !sq.draining {
+		sq.draining = true
+		go p2p.drainSendQueue(peer, dc)
+	}
+	return nil
+}
+
+// drainSendQueue sends a peer's queued messages, highest class first, as its
+// channel has room for them
+func (p2p *P2PManager) drainSendQueue(peer *PeerConnection, dc *webrtc.DataChannel) {
+	sq := peer.sendQueue
+	dc.SetBufferedAmountLowThreshold(sendQueueLowWater)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case sq.drained <- struct{}{}:
+		default:
+		}
+	})
+	
+	for {
+		for dc.BufferedAmount() >= sendQueueHighWater {
+			if dc.ReadyState() != webrtc.DataChannelStateOpen {
+				break
+			}
+			select {
+			case <-sq.drained:
+			case <-time.After(sendQueuePoll):
+			case <-p2p.ctx.Done():
+				sq.close()
+				return
+			}
+		}
+		
+		data, ok := sq.pop()
+		if !ok {
+			break
+		}
+		if err := p2p.sendToChannel(peer, dc, data); err != nil {
+			log.Printf("Failed to send queued message to peer %s: %v", peer.UserID, err)
+		}
+	}
+	
+	sq.mutex.Lock()
+	dropped := sq.dropped
+	sq.dropped = 0
+	sq.mutex.Unlock()
+	if dropped > 0 {
+		log.Printf("Dropped %d stale cursor and metrics messages to congested peer %s", dropped, peer.UserID)
+	}
+}
@@ -0,0 +1,279 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// ServerDefaultPort is used when a server address doesn't name one
+const ServerDefaultPort = "7420"
+
+var errServerMode = fmt.Errorf("direct peer connections are disabled in server mode")
+
+// serverLink is the connection to the server and who else it reports
+type serverLink struct {
+	conn       net.Conn
+	members    map[string]bool
+	writeMutex sync.Mutex
+}
+
+func (sl *serverLink) send(to string, data []byte) error {
+	frame, err := json.Marshal(protocol.ServerEnvelope{To: to, Data: data})
+	if err != nil {
+		return err
+	}
+	sl.writeMutex.Lock()
+	defer sl.writeMutex.Unlock()
+	return protocol.WriteFrame(sl.conn, frame)
+}
+
+// SetServer switches to server mode, where every connection goes through the
+// server at serverURL (tls://host:port or tcp://host:port), checking pins for
+// TLS. Empty restores peer-to-peer connections.
+func (p2p *P2PManager) SetServer(serverURL string, pins TLSPins) error {
+	address, err := ParseServerURL(serverURL)
+	if err != nil {
+		return err
+	}
+	
+	p2p.peersMutex.Lock()
+	p2p.serverURL = address
+	p2p.serverPins = pins
+	p2p.peersMutex.Unlock()
+	return nil
+}
+
+// SetAccessToken sets the token presented to servers that require one
+func (p2p *P2PManager) SetAccessToken(token string) {
+	p2p.peersMutex.Lock()
+	defer p2p.peersMutex.Unlock()
+	p2p.serverToken = token
+}
+
+// ParseServerURL checks a server URL and fills in the default port
+func ParseServerURL(serverURL string) (string, error) {
+	if serverURL == "" {
+		return "", nil
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL: %v", err)
+	}
+	if u.Scheme != "tls" && u.Scheme != "tcp" {
+		return "", fmt.Errorf("server URL must be tls:// or tcp://, got %s", u.Scheme)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), ServerDefaultPort)
+	}
+	return u.String(), nil
+}
+
+// ServerMode reports whether connections go through a server
+func (p2p *P2PManager) ServerMode() bool {
+	p2p.peersMutex.RLock()
+	defer p2p.peersMutex.RUnlock()
+	return p2p.serverURL != ""
+}
+
+// ConnectServer opens the connection for a session and returns the server's
+// view of it. Peers already in the session are reported as joined. progress,
+// when set, hears how much of the welcome has arrived.
+func (p2p *P2PManager) ConnectServer(hello protocol.ServerHello, progress func(read, total int)) (*protocol.ServerWelcome, error) {
+	p2p.peersMutex.RLock()
+	serverURL := p2p.serverURL
+	pins := p2p.serverPins
+	hello.AccessToken = p2p.serverToken
+	p2p.peersMutex.RUnlock()
+	if serverURL == "" {
+		return nil, fmt.Errorf("no server configured")
+	}
+	u, _ := url.Parse(serverURL)
+	if err := p2p.CheckTransport(TransportServer, u.Host); err != nil {
+		return nil, err
+	}
+	
+	ctx, cancel := context.WithTimeout(p2p.ctx, protocol.ServerHandshakeTimeout)
+	defer cancel()
+	
+	var conn net.Conn
+	var err error
+	if u.Scheme == "tls" {
+		conn, err = NewPinnedTLSDialer(p2p.SignalingDialer(), pins).DialTLSContext(ctx, "tcp", u.Host)
+	} else {
+		conn, err = p2p.SignalingDialer().DialContext(ctx, "tcp", u.Host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach server %s: %v", u.Host, err)
+	}
+	
+	hello.UserID = p2p.localUserID
+	data, _ := json.Marshal(hello)
+	if hello.Create != nil {
+		p2p.traffic.count(protocol.ServerUserID, TrafficSnapshots, true, len(data))
+	}
+	conn.SetDeadline(time.Now().Add(protocol.ServerHandshakeTimeout))
+	if err := protocol.WriteFrame(conn, data); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("server handshake failed: %v", err)
+	}
+	data, err = protocol.ReadFrameProgress(conn, progress)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("server handshake failed: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+	p2p.traffic.count(protocol.ServerUserID, TrafficSnapshots, false, len(data))
+	
+	var welcome protocol.ServerWelcome
+	if err := json.Unmarshal(data, &welcome); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("invalid server handshake")
+	}
+	if welcome.Error != "" {
+		conn.Close()
+		return nil, fmt.Errorf("server refused: %s", welcome.Error)
+	}
+	
+	link := &serverLink{conn: conn, members: make(map[string]bool)}
+	p2p.peersMutex.Lock()
+	if p2p.server != nil {
+		p2p.server.conn.Close()
+	}
+	p2p.server = link
+	p2p.peersMutex.Unlock()
+	
+	for _, peer := range welcome.Peers {
+		if peer.UserID != p2p.localUserID {
+			p2p.serverMemberJoined(link, peer.UserID)
+		}
+	}
+	go p2p.readServer(link)
+	
+	log.Printf("Connected to session %s through server %s", welcome.SessionID, u.Host)
+	return &welcome, nil
+}
+
+// CloseServer disconnects from the server, e.g. when leaving the session
+func (p2p *P2PManager) CloseServer() {
+	p2p.peersMutex.Lock()
+	link := p2p.server
+	p2p.server = nil
+	p2p.peersMutex.Unlock()
+	
+	if link != nil {
+		link.conn.Close()
+	}
+}
+
+// serverLinkIfConnected returns the server connection in server mode
+func (p2p *P2PManager) serverLinkIfConnected() *serverLink {
+	p2p.peersMutex.RLock()
+	defer p2p.peersMutex.RUnlock()
+	return p2p.server
+}
+
+func (p2p *P2PManager) readServer(link *serverLink) {
+	for {
+		data, err := protocol.ReadFrame(link.conn)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Server connection closed: %v", err)
+			}
+			break
+		}
+		
+		var envelope protocol.ServerEnvelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			log.Printf("Ignoring malformed server frame: %v", err)
+			continue
+		}
+		if envelope.From != "" {
+			if p2p.onMessage != nil {
+				p2p.onMessage(envelope.From, envelope.Data)
+			}
+			continue
+		}
+		
+		// The server's own events track who is in the session
+		msg, err := protocol.ParseMessage(envelope.Data)
+		if err != nil {
+			continue
+		}
+		switch msg.Type {
+		case protocol.MsgPeerJoined:
+			var event protocol.PeerJoinedEvent
+			if msg.ParseData(&event) == nil {
+				p2p.serverMemberJoined(link, event.Peer.UserID)
+			}
+		case protocol.MsgPeerLeft:
+			var event protocol.PeerLeftEvent
+			if msg.ParseData(&event) == nil {
+				p2p.serverMemberLeft(link, event.UserID)
+			}
+		case protocol.MsgSessionExpired, protocol.MsgSpectatorCount:
+			// An idle session the server ended, which it disconnects next,
+			// or how many spectators are watching
+			if p2p.onMessage != nil {
+				p2p.onMessage(protocol.ServerUserID, envelope.Data)
+			}
+		}
+	}
+	
+	p2p.peersMutex.Lock()
+	current := p2p.server == link
+	if current {
+		p2p.server = nil
+	}
+	p2p.peersMutex.Unlock()
+	link.conn.Close()
+	
+	if current {
+		for _, userID := range p2p.serverMembers(link) {
+			p2p.serverMemberLeft(link, userID)
+		}
+	}
+}
+
+func (p2p *P2PManager) serverMemberJoined(link *serverLink, userID string) {
+	p2p.peersMutex.Lock()
+	known := link.members[userID]
+	link.members[userID] = true
+	p2p.peersMutex.Unlock()
+	
+	if !known && p2p.onPeerJoined != nil {
+		p2p.onPeerJoined(userID)
+	}
+}
+
+func (p2p *P2PManager) serverMemberLeft(link *serverLink, userID string) {
+	p2p.peersMutex.Lock()
+	known := link.members[userID]
+	delete(link.members, userID)
+	p2p.peersMutex.Unlock()
+	
+	if known && p2p.onPeerLeft != nil {
+		p2p.onPeerLeft(userID)
+	}
+}
+
+func (p2p *P2PManager) serverMembers(link *serverLink) []string {
+	p2p.peersMutex.RLock()
+	defer p2p.peersMutex.RUnlock()
+	
+	members := make([]string, 0, len(link.members))
+	for userID := range link.members {
+		members = append(members, userID)
+	}
+	sort.Strings(members)
+	return members
+}
@@ -0,0 +1,349 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/net/websocket"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Peer-to-peer sessions find each other through a WebSocket signaling
+// server. Every member joins the session's room there and is told who is
+// already in it; the newcomer offers a connection to each of them, so two
+// members never offer to each other at once. Offers, answers and trickled
+// ICE candidates are relayed through the room by user ID. Candidates that
+// arrive before the description they belong to wait for it. Without
+// signaling_url, offers and answers are still pasted by hand.
+const (
+	signalingHandshakeTimeout = 15 * time.Second
+	maxPendingCandidates      = 64
+)
+
+// signalingClient is the connection to the signaling server for one session
+type signalingClient struct {
+	conn      *websocket.Conn
+	sessionID string
+	
+	members map[string]bool                      // others in the room
+	pending map[string][]webrtc.ICECandidateInit // candidates waiting for a remote description
+	mutex   sync.Mutex
+	
+	writeMutex sync.Mutex
+}
+
+func (sc *signalingClient) send(msg protocol.SignalMessage) error {
+	sc.writeMutex.Lock()
+	defer sc.writeMutex.Unlock()
+	sc.conn.SetWriteDeadline(time.Now().Add(signalingHandshakeTimeout))
+	return websocket.JSON.Send(sc.conn, msg)
+}
+
+func (sc *signalingClient) setMember(userID string, present bool) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if present {
+		sc.members[userID] = true
+		return
+	}
+	delete(sc.members, userID)
+	delete(sc.pending, userID)
+}
+
+func (sc *signalingClient) isMember(userID string) bool {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return sc.members[userID]
+}
+
+// hold keeps a candidate until the peer's remote description is set
+func (sc *signalingClient) hold(userID string, candidate webrtc.ICECandidateInit) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if len(sc.pending[userID]) < maxPendingCandidates {
+		sc.pending[userID] = append(sc.pending[userID], candidate)
+	}
+}
+
+func (sc *signalingClient) release(userID string) []webrtc.ICECandidateInit {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	candidates := sc.pending[userID]
+	delete(sc.pending, userID)
+	return candidates
+}
+
+// ParseSignalingURL checks a signaling server URL and fills in the default
+// port
+func ParseSignalingURL(signalingURL string) (string, error) {
+	if signalingURL == "" {
+		return "", nil
+	}
+	u, err := url.Parse(signalingURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid signaling URL: %v", err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return "", fmt.Errorf("signaling URL must be ws:// or wss://, got %s", u.Scheme)
+	}
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u.String(), nil
+}
+
+// SetSignaling sets the signaling server peer-to-peer sessions meet through,
+// checking pins for wss. Empty leaves them to manual signaling.
+func (p2p *P2PManager) SetSignaling(signalingURL string, pins TLSPins) error {
+	address, err := ParseSignalingURL(signalingURL)
+	if err != nil {
+		return err
+	}
+	
+	p2p.peersMutex.Lock()
+	p2p.signalingURL = address
+	p2p.signalingPins = pins
+	p2p.peersMutex.Unlock()
+	return nil
+}
+
+// JoinSignaling joins the session's room on the signaling server and offers
+// a connection to everyone already in it. It does nothing in server mode or
+// without a signaling server.
+func (p2p *P2PManager) JoinSignaling(sessionID string) error {
+	p2p.peersMutex.RLock()
+	signalingURL := p2p.signalingURL
+	pins := p2p.signalingPins
+	token := p2p.serverToken
+	serverMode := p2p.serverURL != ""
+	p2p.peersMutex.RUnlock()
+	if signalingURL == "" || serverMode {
+		return nil
+	}
+	u, _ := url.Parse(signalingURL)
+	if err := p2p.CheckTransport(TransportWebRTC, u.Host); err != nil {
+		return err
+	}
+	
+	ctx, cancel := context.WithTimeout(p2p.ctx, signalingHandshakeTimeout)
+	defer cancel()
+	
+	var conn net.Conn
+	var err error
+	if u.Scheme == "wss" {
+		conn, err = NewPinnedTLSDialer(p2p.SignalingDialer(), pins).DialTLSContext(ctx, "tcp", u.Host)
+	} else {
+		conn, err = p2p.SignalingDialer().DialContext(ctx, "tcp", u.Host)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reach signaling server %s: %v", u.Host, err)
+	}
+	
+	config, err := websocket.NewConfig(signalingURL, "http://localhost/")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if token != "" {
+		config.Header = http.Header{protocol.AccessTokenHeader: []string{token}}
+	}
+	conn.SetDeadline(time.Now().Add(signalingHandshakeTimeout))
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("signaling handshake failed: %v", err)
+	}
+	ws.MaxPayloadBytes = MaxSignalBlobLen
+	
+	client := &signalingClient{
+		conn:      ws,
+		sessionID: sessionID,
+		members:   make(map[string]bool),
+		pending:   make(map[string][]webrtc.ICECandidateInit),
+	}
+	join := protocol.SignalMessage{Type: protocol.SignalJoin, SessionID: sessionID, UserID: p2p.localUserID, RelayRTTs: p2p.RelayRTTs()}
+	if err := client.send(join); err != nil {
+		ws.Close()
+		return fmt.Errorf("signaling handshake failed: %v", err)
+	}
+	var reply protocol.SignalMessage
+	if err := websocket.JSON.Receive(ws, &reply); err != nil {
+		ws.Close()
+		return fmt.Errorf("signaling handshake failed: %v", err)
+	}
+	if reply.Type == protocol.SignalError {
+		ws.Close()
+		return fmt.Errorf("signaling server refused: %s", reply.Error)
+	}
+	if reply.Type != protocol.SignalPeers {
+		ws.Close()
+		return fmt.Errorf("unexpected %s from signaling server", reply.Type)
+	}
+	conn.SetDeadline(time.Time{})
+	
+	var peers []string
+	for _, userID := range reply.Peers {
+		if userID != p2p.localUserID {
+			client.setMember(userID, true)
+			peers = append(peers, userID)
+		}
+	}
+	
+	p2p.peersMutex.Lock()
+	if p2p.signaling != nil {
+		p2p.signaling.conn.Close()
+	}
+	p2p.signaling = client
+	p2p.peersMutex.Unlock()
+	
+	go p2p.readSignaling(client)
+	go p2p.offerThroughSignaling(client, peers, reply.PeerRelays)
+	
+	log.Printf("Joined session %s on signaling server %s with %d peers", sessionID, u.Host, len(peers))
+	return nil
+}
+
+// LeaveSignaling leaves the signaling room, e.g. when leaving the session.
+// Connections already made stay up.
+func (p2p *P2PManager) LeaveSignaling() {
+	p2p.peersMutex.Lock()
+	client := p2p.signaling
+	p2p.signaling = nil
+	p2p.peersMutex.Unlock()
+	
+	if client != nil {
+		client.conn.Close()
+	}
+}
+
+// offerThroughSignaling offers a connection to each peer in turn, through
+// the relay best for the two of them
+func (p2p *P2PManager) offerThroughSignaling(client *signalingClient, peers []string, peerRelays map[string]map[string]int64) {
+	local := p2p.RelayRTTs()
+	for _, userID := range peers {
+		relay := chooseRelay(local, peerRelays[userID])
+		p2p.useRelay(userID, relay)
+		offer, err := p2p.CreateOffer(userID)
+		if err != nil {
+			log.Printf("Failed to create offer for %s: %v", userID, err)
+			continue
+		}
+		if err := client.send(protocol.SignalMessage{Type: protocol.SignalOffer, To: userID, SDP: offer.SDP, Relay: relay}); err != nil {
+			log.Printf("Failed to send offer to %s: %v", userID, err)
+			p2p.DisconnectPeer(userID)
+		}
+	}
+}
+
+func (p2p *P2PManager) readSignaling(client *signalingClient) {
+	for {
+		var msg protocol.SignalMessage
+		if err := websocket.JSON.Receive(client.conn, &msg); err != nil {
+			if err != io.EOF {
+				log.Printf("Signaling connection closed: %v", err)
+			}
+			break
+		}
+		
+		switch msg.Type {
+		case protocol.SignalPeerJoined:
+			// The newcomer offers; waiting for it avoids offering both ways
+			client.setMember(msg.From, true)
+		case protocol.SignalPeerLeft:
+			client.setMember(msg.From, false)
+		case protocol.SignalOffer:
+			p2p.answerThroughSignaling(client, msg)
+		case protocol.SignalAnswer:
+			answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: msg.SDP}
+			if err := p2p.HandleAnswer(msg.From, answer); err != nil {
+				log.Printf("Failed to handle answer from %s: %v", msg.From, err)
+				continue
+			}
+			p2p.addHeldCandidates(client, msg.From)
+		case protocol.SignalCandidate:
+			if msg.Candidate != nil {
+				p2p.addSignaledCandidate(client, msg.From, *msg.Candidate)
+			}
+		case protocol.SignalError:
+			log.Printf("Signaling server: %s", msg.Error)
+		}
+	}
+	
+	p2p.peersMutex.Lock()
+	if p2p.signaling == client {
+		p2p.signaling = nil
+	}
+	p2p.peersMutex.Unlock()
+	client.conn.Close()
+}
+
+// answerThroughSignaling answers a peer's offer
+func (p2p *P2PManager) answerThroughSignaling(client *signalingClient, msg protocol.SignalMessage) {
+	client.setMember(msg.From, true)
+	p2p.useRelay(msg.From, msg.Relay)
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: msg.SDP}
+	answer, err := p2p.HandleOffer(msg.From, offer)
+	if err != nil {
+		log.Printf("Failed to handle offer from %s: %v", msg.From, err)
+		return
+	}
+	if err := client.send(protocol.SignalMessage{Type: protocol.SignalAnswer, To: msg.From, SDP: answer.SDP}); err != nil {
+		log.Printf("Failed to send answer to %s: %v", msg.From, err)
+		p2p.DisconnectPeer(msg.From)
+		return
+	}
+	p2p.addHeldCandidates(client, msg.From)
+}
+
+// addSignaledCandidate adds a peer's candidate, or holds it until the
+// peer's description is set
+func (p2p *P2PManager) addSignaledCandidate(client *signalingClient, userID string, candidate webrtc.ICECandidateInit) {
+	p2p.peersMutex.RLock()
+	peer, exists := p2p.peers[userID]
+	p2p.peersMutex.RUnlock()
+	
+	if !exists || peer.Connection.RemoteDescription() == nil {
+		client.hold(userID, candidate)
+		return
+	}
+	if err := p2p.AddICECandidate(userID, candidate); err != nil {
+		log.Printf("Ignoring candidate from %s: %v", userID, err)
+	}
+}
+
+func (p2p *P2PManager) addHeldCandidates(client *signalingClient, userID string) {
+	for _, candidate := range client.release(userID) {
+		if err := p2p.AddICECandidate(userID, candidate); err != nil {
+			log.Printf("Ignoring candidate from %s: %v", userID, err)
+		}
+	}
+}
+
+// signalCandidate trickles a local candidate to a peer met through the
+// signaling server, reporting false for peers it doesn't know
+func (p2p *P2PManager) signalCandidate(userID string, candidate webrtc.ICECandidateInit) bool {
+	p2p.peersMutex.RLock()
+	client := p2p.signaling
+	p2p.peersMutex.RUnlock()
+	
+	if client == nil || !client.isMember(userID) {
+		return false
+	}
+	if err := client.send(protocol.SignalMessage{Type: protocol.SignalCandidate, To: userID, Candidate: &candidate}); err != nil {
+		log.Printf("Failed to send candidate to %s: %v", userID, err)
+	}
+	return true
+}
@@ -0,0 +1,305 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Documents too large to go inline in session_state travel on a data channel
+// of their own, so a large initial sync neither holds up the session's other
+// messages nor starts over when it is cut off. The host offers the snapshot
+// by ID, size and SHA-256; the joiner opens a channel labeled
+// collab-snapshot/<id> and asks for it from an offset, and the host streams
+// it in numbered chunks:
+//
+//	magic (1 byte) | chunk index (4) | data
+//
+// Every chunk but the last holds the offer's chunk size, so a chunk's index
+// gives its offset. When the channel closes or goes quiet for
+// snapshotStallTimeout, the joiner opens another, on whatever connection to
+// the host is up by then, and asks from where it got to. A download that
+// fails is kept, and a later join offered the same snapshot resumes it. The
+// host keeps a snapshot for snapshotKeep after it was last asked for.
+const (
+	snapshotChannelPrefix       = "collab-snapshot/"
+	snapshotChunkMagic     byte = 0xCA
+	snapshotChunkHeaderLen      = 5
+	snapshotChunkSize           = maxDataChannelMessage - snapshotChunkHeaderLen
+	
+	// Documents up to this size go inline in session_state
+	SnapshotInlineLimit = 256 * 1024
+	
+	// The host waits while more than this is queued on the channel
+	snapshotMaxBuffered = 1024 * 1024
+	
+	snapshotStallTimeout = 10 * time.Second
+	snapshotRetryDelay   = time.Second
+	snapshotMaxAttempts  = 5 // channels opened in a row without progress
+	snapshotKeep         = 2 * time.Minute
+)
+
+// snapshotRequest asks for a snapshot from an offset
+type snapshotRequest struct {
+	Offset int `json:"offset"`
+}
+
+type servedSnapshot struct {
+	data     []byte
+	lastUsed time.Time
+}
+
+// snapshotDownload is a snapshot received up to an offset
+type snapshotDownload struct {
+	offer    protocol.SnapshotOffer
+	data     []byte
+	received int
+}
+
+// add takes the next chunk
+func (sd *snapshotDownload) add(chunk []byte) error {
+	if len(chunk) < snapshotChunkHeaderLen || chunk[0] != snapshotChunkMagic {
+		return fmt.Errorf("not a snapshot chunk")
+	}
+	index := int(binary.BigEndian.Uint32(chunk[1:snapshotChunkHeaderLen]))
+	payload := chunk[snapshotChunkHeaderLen:]
+	if index*sd.offer.ChunkSize != sd.received {
+		return fmt.Errorf("chunk %d arrived at offset %d", index, sd.received)
+	}
+	remaining := len(sd.data) - sd.received
+	if len(payload) > remaining || (len(payload) < sd.offer.ChunkSize && len(payload) != remaining) {
+		return fmt.Errorf("chunk %d has %d bytes", index, len(payload))
+	}
+	copy(sd.data[sd.received:], payload)
+	sd.received += len(payload)
+	return nil
+}
+
+func newSnapshotID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// snapshotIDFromLabel extracts the snapshot ID from a snapshot channel label
+func snapshotIDFromLabel(label string) (string, bool) {
+	if !strings.HasPrefix(label, snapshotChannelPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(label, snapshotChannelPrefix), true
+}
+
+// snapshotStore holds the snapshots offered to joiners and the local
+// download that last failed
+type snapshotStore struct {
+	served  map[string]*servedSnapshot
+	partial *snapshotDownload
+	mutex   sync.Mutex
+}
+
+// CanSendSnapshot reports whether a snapshot can be offered to a peer, which
+// takes a WebRTC connection
+func (p2p *P2PManager) CanSendSnapshot(userID string) bool {
+	p2p.peersMutex.RLock()
+	defer p2p.peersMutex.RUnlock()
+	peer, ok := p2p.peers[userID]
+	return ok && peer.Connected
+}
+
+// ServeSnapshot keeps data for joiners to download and returns its offer
+func (p2p *P2PManager) ServeSnapshot(data []byte) protocol.SnapshotOffer {
+	sum := sha256.Sum256(data)
+	offer := protocol.SnapshotOffer{
+		ID:        newSnapshotID(),
+		Size:      len(data),
+		ChunkSize: snapshotChunkSize,
+		SHA256:    hex.EncodeToString(sum[:]),
+	}
+	
+	now := time.Now()
+	p2p.snapshots.mutex.Lock()
+	defer p2p.snapshots.mutex.Unlock()
+	for id, snapshot := range p2p.snapshots.served {
+		if now.Sub(snapshot.lastUsed) > snapshotKeep {
+			delete(p2p.snapshots.served, id)
+		}
+	}
+	p2p.snapshots.served[offer.ID] = &servedSnapshot{data: data, lastUsed: now}
+	return offer
+}
+
+// serveSnapshotChannel answers requests on a snapshot channel a joiner opened
+func (p2p *P2PManager) serveSnapshotChannel(peer *PeerConnection, id string, dc *webrtc.DataChannel) {
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var req snapshotRequest
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			dc.Close()
+			return
+		}
+		p2p.snapshots.mutex.Lock()
+		snapshot := p2p.snapshots.served[id]
+		if snapshot != nil {
+			snapshot.lastUsed = time.Now()
+		}
+		p2p.snapshots.mutex.Unlock()
+		if snapshot == nil || req.Offset < 0 || req.Offset > len(snapshot.data) {
+			log.Printf("Refusing snapshot %s to peer %s", id, peer.UserID)
+			dc.Close()
+			return
+		}
+		go p2p.streamSnapshot(peer, dc, snapshot.data, req.Offset/snapshotChunkSize)
+	})
+}
+
+// streamSnapshot sends data from chunk start on, waiting whenever the
+// channel has plenty queued
+func (p2p *P2PManager) streamSnapshot(peer *PeerConnection, dc *webrtc.DataChannel, data []byte, start int) {
+	drained := make(chan struct{}, 1)
+	dc.SetBufferedAmountLowThreshold(snapshotMaxBuffered / 2)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case drained <- struct{}{}:
+		default:
+		}
+	})
+	
+	for index := start; index*snapshotChunkSize < len(data); index++ {
+		for dc.BufferedAmount() > snapshotMaxBuffered {
+			select {
+			case <-drained:
+			case <-time.After(snapshotStallTimeout):
+				return
+			case <-p2p.ctx.Done():
+				return
+			}
+		}
+		offset := index * snapshotChunkSize
+		end := min(offset+snapshotChunkSize, len(data))
+		chunk := make([]byte, snapshotChunkHeaderLen, snapshotChunkHeaderLen+end-offset)
+		chunk[0] = snapshotChunkMagic
+		binary.BigEndian.PutUint32(chunk[1:], uint32(index))
+		chunk = append(chunk, data[offset:end]...)
+		if err := dc.Send(chunk); err != nil {
+			log.Printf("Snapshot to peer %s interrupted: %v", peer.UserID, err)
+			return
+		}
+		p2p.traffic.count(peer.UserID, TrafficSnapshots, true, len(chunk))
+	}
+}
+
+// FetchSnapshot downloads a snapshot a peer offered, resuming where the
+// channel was cut off, and reports progress as it goes
+func (p2p *P2PManager) FetchSnapshot(userID string, offer protocol.SnapshotOffer, progress func(read, total int)) ([]byte, error) {
+	if offer.Size < 0 || offer.Size > maxReassembledSize || offer.ChunkSize <= 0 || offer.ChunkSize > maxDataChannelMessage {
+		return nil, fmt.Errorf("peer %s offered an invalid snapshot", userID)
+	}
+	
+	p2p.snapshots.mutex.Lock()
+	download := p2p.snapshots.partial
+	p2p.snapshots.partial = nil
+	p2p.snapshots.mutex.Unlock()
+	if download == nil || download.offer.SHA256 != offer.SHA256 || download.offer.Size != offer.Size || download.offer.ChunkSize != offer.ChunkSize {
+		download = &snapshotDownload{data: make([]byte, offer.Size)}
+	} else {
+		log.Printf("Resuming snapshot at %d of %d bytes", download.received, offer.Size)
+	}
+	download.offer = offer
+	
+	for attempts := 0; download.received < offer.Size; {
+		before := download.received
+		err := p2p.downloadSnapshot(userID, download, progress)
+		if err == nil {
+			break
+		}
+		if download.received > before {
+			attempts = 0
+		}
+		attempts++
+		if attempts >= snapshotMaxAttempts {
+			p2p.snapshots.mutex.Lock()
+			p2p.snapshots.partial = download
+			p2p.snapshots.mutex.Unlock()
+			return nil, fmt.Errorf("snapshot download stopped at %d of %d bytes: %v", download.received, offer.Size, err)
+		}
+		log.Printf("Snapshot from %s interrupted at %d of %d bytes, resuming: %v", userID, download.received, offer.Size, err)
+		select {
+		case <-time.After(snapshotRetryDelay):
+		case <-p2p.ctx.Done():
+			return nil, p2p.ctx.Err()
+		}
+	}
+	
+	sum := sha256.Sum256(download.data)
+	if hex.EncodeToString(sum[:]) != offer.SHA256 {
+		return nil, fmt.Errorf("snapshot from %s doesn't match its checksum", userID)
+	}
+	return download.data, nil
+}
+
+// downloadSnapshot receives a snapshot over one channel, from where download
+// got to, until it is complete or the channel fails
+func (p2p *P2PManager) downloadSnapshot(userID string, download *snapshotDownload, progress func(read, total int)) error {
+	p2p.peersMutex.RLock()
+	peer, ok := p2p.peers[userID]
+	connected := ok && peer.Connected
+	p2p.peersMutex.RUnlock()
+	if !connected {
+		return fmt.Errorf("peer %s is not connected", userID)
+	}
+	
+	dc, err := peer.Connection.CreateDataChannel(snapshotChannelPrefix+download.offer.ID, nil)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	
+	chunks := make(chan []byte, 64)
+	closed := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	var closeOnce sync.Once
+	dc.OnOpen(func() {
+		request, _ := json.Marshal(snapshotRequest{Offset: download.received})
+		if err := dc.Send(request); err != nil {
+			dc.Close()
+		}
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		select {
+		case chunks <- msg.Data:
+		case <-stop:
+		}
+	})
+	dc.OnClose(func() { closeOnce.Do(func() { close(closed) }) })
+	
+	for download.received < len(download.data) {
+		select {
+		case chunk := <-chunks:
+			if err := download.add(chunk); err != nil {
+				return err
+			}
+			p2p.traffic.count(userID, TrafficSnapshots, false, len(chunk))
+			if progress != nil {
+				progress(download.received, len(download.data))
+			}
+		case <-closed:
+			return fmt.Errorf("channel closed")
+		case <-time.After(snapshotStallTimeout):
+			return fmt.Errorf("nothing arrived for %v", snapshotStallTimeout)
+		case <-p2p.ctx.Done():
+			return p2p.ctx.Err()
+		}
+	}
+	return nil
+}
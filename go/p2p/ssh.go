@@ -0,0 +1,379 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// SSH tunnels carry the collaboration protocol through a server both users
+// can already reach, instead of STUN/TURN. The host asks the server to listen
+// on a loopback port (like ssh -R) and the joiner connects to that port
+// through its own SSH connection (like ssh -L). Messages are framed with a
+// 4-byte big-endian length.
+const (
+	sshURIScheme        = "ssh"
+	sshDefaultPort      = "22"
+	sshHandshakeTimeout = 15 * time.Second
+)
+
+// SSHConfig holds how to authenticate to tunnel servers
+type SSHConfig struct {
+	IdentityFiles  []string `json:"identity_files,omitempty"`   // defaults to ~/.ssh/id_ed25519, id_ecdsa, id_rsa
+	KnownHostsFile string   `json:"known_hosts_file,omitempty"` // defaults to ~/.ssh/known_hosts
+}
+
+// sshHello is the first frame on a tunnel, identifying each side
+type sshHello struct {
+	UserID    string `json:"user_id"`
+	SessionID string `json:"session_id"`
+}
+
+// streamPeer is a peer reached over a byte stream rather than WebRTC
+type streamPeer struct {
+	UserID     string
+	conn       net.Conn
+	writeMutex sync.Mutex
+}
+
+func (sp *streamPeer) send(data []byte) error {
+	sp.writeMutex.Lock()
+	defer sp.writeMutex.Unlock()
+	return protocol.WriteFrame(sp.conn, data)
+}
+
+// sshTarget is a parsed ssh://user@host:port?forward=127.0.0.1:40123 URI
+type sshTarget struct {
+	User    string
+	Addr    string
+	Forward string
+}
+
+func parseSSHTarget(raw string) (sshTarget, error) {
+	if !strings.Contains(raw, "://") {
+		raw = sshURIScheme + "://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return sshTarget{}, fmt.Errorf("invalid SSH address: %v", err)
+	}
+	if u.Scheme != sshURIScheme || u.Hostname() == "" {
+		return sshTarget{}, fmt.Errorf("invalid SSH address: %s", raw)
+	}
+	
+	target := sshTarget{
+		Addr:    u.Host,
+		Forward: u.Query().Get("forward"),
+	}
+	if u.Port() == "" {
+		target.Addr = net.JoinHostPort(u.Hostname(), sshDefaultPort)
+	}
+	if u.User != nil {
+		target.User = u.User.Username()
+	}
+	if target.User == "" {
+		target.User = os.Getenv("USER")
+	}
+	return target, nil
+}
+
+func (t sshTarget) String() string {
+	u := url.URL{
+		Scheme: sshURIScheme,
+		User:   url.User(t.User),
+		Host:   t.Addr,
+	}
+	if t.Forward != "" {
+		u.RawQuery = url.Values{"forward": {t.Forward}}.Encode()
+	}
+	return u.String()
+}
+
+// sshClientConfig builds auth from the SSH agent and identity files, checking
+// the server against known_hosts
+func sshClientConfig(user string, config SSHConfig) (*ssh.ClientConfig, error) {
+	home, _ := os.UserHomeDir()
+	
+	knownHostsFile := config.KnownHostsFile
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts: %v", err)
+	}
+	
+	var signers []ssh.Signer
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			if agentSigners, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, agentSigners...)
+			}
+		}
+	}
+	
+	identityFiles := config.IdentityFiles
+	if len(identityFiles) == 0 {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			identityFiles = append(identityFiles, filepath.Join(home, ".ssh", name))
+		}
+	}
+	for _, path := range identityFiles {
+		key, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			// Passphrase-protected keys have to come from the agent
+			log.Printf("Skipping SSH key %s: %v", path, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no usable SSH keys found in the agent or identity files")
+	}
+	
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshHandshakeTimeout,
+	}, nil
+}
+
+// SetSSHConfig sets how to authenticate to SSH tunnel servers
+func (p2p *P2PManager) SetSSHConfig(config SSHConfig) {
+	p2p.peersMutex.Lock()
+	defer p2p.peersMutex.Unlock()
+	p2p.sshConfig = config
+}
+
+// dialSSH connects to an SSH server through the signaling proxy, if any
+func (p2p *P2PManager) dialSSH(target sshTarget) (*ssh.Client, error) {
+	if err := p2p.CheckTransport(TransportSSH, target.Addr); err != nil {
+		return nil, err
+	}
+	
+	p2p.peersMutex.RLock()
+	config := p2p.sshConfig
+	p2p.peersMutex.RUnlock()
+	
+	clientConfig, err := sshClientConfig(target.User, config)
+	if err != nil {
+		return nil, err
+	}
+	
+	ctx, cancel := context.WithTimeout(p2p.ctx, sshHandshakeTimeout)
+	defer cancel()
+	conn, err := p2p.SignalingDialer().DialContext(ctx, "tcp", target.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach SSH server %s: %v", target.Addr, err)
+	}
+	
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, target.Addr, clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SSH handshake with %s failed: %v", target.Addr, err)
+	}
+	
+	client := ssh.NewClient(clientConn, channels, requests)
+	p2p.peersMutex.Lock()
+	p2p.sshClients = append(p2p.sshClients, client)
+	p2p.peersMutex.Unlock()
+	return client, nil
+}
+
+// ListenSSH asks the SSH server to accept tunnel connections for a session
+// and returns the address joiners should connect to
+func (p2p *P2PManager) ListenSSH(address, sessionID string) (string, error) {
+	if p2p.ServerMode() {
+		return "", errServerMode
+	}
+	
+	target, err := parseSSHTarget(address)
+	if err != nil {
+		return "", err
+	}
+	
+	client, err := p2p.dialSSH(target)
+	if err != nil {
+		return "", err
+	}
+	
+	listener, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		client.Close()
+		return "", fmt.Errorf("SSH server refused to forward a port: %v", err)
+	}
+	
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("SSH tunnel listener closed: %v", err)
+				return
+			}
+			go p2p.acceptSSHPeer(conn, sessionID)
+		}
+	}()
+	
+	target.Forward = listener.Addr().String()
+	log.Printf("Accepting SSH tunnel connections on %s via %s", target.Forward, target.Addr)
+	return target.String(), nil
+}
+
+// ConnectSSH joins a session through a tunnel address from ListenSSH
+func (p2p *P2PManager) ConnectSSH(address, sessionID string) (string, error) {
+	if p2p.ServerMode() {
+		return "", errServerMode
+	}
+	
+	target, err := parseSSHTarget(address)
+	if err != nil {
+		return "", err
+	}
+	if target.Forward == "" {
+		return "", fmt.Errorf("SSH address has no forward port; use the address shared by the host")
+	}
+	
+	client, err := p2p.dialSSH(target)
+	if err != nil {
+		return "", err
+	}
+	
+	conn, err := client.Dial("tcp", target.Forward)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach the host through %s: %v", target.Addr, err)
+	}
+	
+	if err := writeSSHHello(conn, p2p.localUserID, sessionID); err != nil {
+		conn.Close()
+		return "", err
+	}
+	hello, err := readSSHHello(conn)
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	
+	p2p.addStreamPeer(hello.UserID, conn)
+	return hello.UserID, nil
+}
+
+func (p2p *P2PManager) acceptSSHPeer(conn net.Conn, sessionID string) {
+	hello, err := readSSHHello(conn)
+	if err != nil {
+		log.Printf("Rejected SSH tunnel connection: %v", err)
+		conn.Close()
+		return
+	}
+	if hello.SessionID != sessionID {
+		log.Printf("Rejected SSH tunnel connection from %s for session %s", hello.UserID, hello.SessionID)
+		conn.Close()
+		return
+	}
+	
+	if err := writeSSHHello(conn, p2p.localUserID, sessionID); err != nil {
+		conn.Close()
+		return
+	}
+	p2p.addStreamPeer(hello.UserID, conn)
+}
+
+func writeSSHHello(conn net.Conn, userID, sessionID string) error {
+	data, _ := json.Marshal(sshHello{UserID: userID, SessionID: sessionID})
+	conn.SetWriteDeadline(time.Now().Add(sshHandshakeTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	return protocol.WriteFrame(conn, data)
+}
+
+func readSSHHello(conn net.Conn) (sshHello, error) {
+	var hello sshHello
+	conn.SetReadDeadline(time.Now().Add(sshHandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	
+	data, err := protocol.ReadFrame(conn)
+	if err != nil {
+		return hello, fmt.Errorf("tunnel handshake failed: %v", err)
+	}
+	if err := json.Unmarshal(data, &hello); err != nil || hello.UserID == "" {
+		return hello, fmt.Errorf("invalid tunnel handshake")
+	}
+	return hello, nil
+}
+
+// addStreamPeer registers a connected stream peer and starts reading from it
+func (p2p *P2PManager) addStreamPeer(userID string, conn net.Conn) {
+	peer := &streamPeer{UserID: userID, conn: conn}
+	
+	p2p.peersMutex.Lock()
+	if existing, exists := p2p.streamPeers[userID]; exists {
+		existing.conn.Close()
+	}
+	p2p.streamPeers[userID] = peer
+	p2p.peersMutex.Unlock()
+	
+	log.Printf("Peer %s connected over SSH tunnel", userID)
+	if p2p.onPeerJoined != nil {
+		p2p.onPeerJoined(userID)
+	}
+	
+	go p2p.readStreamPeer(peer)
+}
+
+func (p2p *P2PManager) readStreamPeer(peer *streamPeer) {
+	for {
+		data, err := protocol.ReadFrame(peer.conn)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("SSH tunnel to %s closed: %v", peer.UserID, err)
+			}
+			break
+		}
+		if p2p.onMessage != nil {
+			p2p.onMessage(peer.UserID, data)
+		}
+	}
+	
+	p2p.peersMutex.Lock()
+	current := p2p.streamPeers[peer.UserID] == peer
+	if current {
+		delete(p2p.streamPeers, peer.UserID)
+	}
+	p2p.peersMutex.Unlock()
+	peer.conn.Close()
+	
+	if current && p2p.onPeerLeft != nil {
+		p2p.onPeerLeft(peer.UserID)
+	}
+}
+
+// closeSSH closes stream peers and SSH connections. Caller holds peersMutex.
+func (p2p *P2PManager) closeSSH() {
+	for _, peer := range p2p.streamPeers {
+		peer.conn.Close()
+	}
+	p2p.streamPeers = make(map[string]*streamPeer)
+	
+	for _, client := range p2p.sshClients {
+		client.Close()
+	}
+	p2p.sshClients = nil
+}
@@ -0,0 +1,79 @@
+package collab
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/EmreDay1/collab.nvim/go/session"
+)
+
+// Project sessions name their file by its path relative to the project
+// root, with forward slashes, so collaborators whose checkouts live in
+// different places each find it in their own. The root itself never leaves
+// the machine: Neovim passes it when creating, joining or importing a
+// session, and paths are translated on the way in and out.
+
+// cleanSessionRoot checks that a project root is an absolute directory path
+func cleanSessionRoot(root string) (string, error) {
+	if !filepath.IsAbs(root) {
+		return "", fmt.Errorf("project root %q must be an absolute path", root)
+	}
+	return filepath.Clean(root), nil
+}
+
+// sessionRelativePath turns a local file path, absolute or relative to root,
+// into the path shared with the session
+func sessionRelativePath(root, filePath string) (string, error) {
+	if !filepath.IsAbs(filePath) {
+		filePath = filepath.Join(root, filePath)
+	}
+	rel, err := filepath.Rel(root, filePath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the project root %s", filePath, root)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// sessionLocalPath resolves a shared path under the local root. The path
+// comes from another machine, so one that would leave the root is refused.
+func sessionLocalPath(root, rel string) (string, error) {
+	clean := path.Clean(rel)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") || filepath.VolumeName(rel) != "" {
+		return "", fmt.Errorf("shared path %q leaves the project root", rel)
+	}
+	if root == "" {
+		return filepath.FromSlash(clean), nil
+	}
+	return filepath.Join(root, filepath.FromSlash(clean)), nil
+}
+
+// localFilePath returns where the current session's file is on this
+// machine. Without a root, a project session's path stays relative.
+func (cm *CollabManager) localFilePath(session *session.Session) string {
+	if !session.Project {
+		return session.FilePath
+	}
+	local, err := sessionLocalPath(cm.sessionRoot, session.FilePath)
+	if err != nil {
+		log.Printf("Not mapping %s to a local path: %v", session.FilePath, err)
+		return ""
+	}
+	return local
+}
+
+// joinProject takes the local root of a project session that was just
+// joined or imported, checking that its shared path stays inside
+func (cm *CollabManager) joinProject(session *session.Session, root string) error {
+	cm.sessionRoot = ""
+	if !session.Project {
+		return nil
+	}
+	if _, err := sessionLocalPath(root, session.FilePath); err != nil {
+		return err
+	}
+	cm.sessionRoot = root
+	return nil
+}
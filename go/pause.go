@@ -0,0 +1,166 @@
+package collab
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// A user can pause synchronization to focus without the document moving
+// under them: operations the server relays from others are held in the
+// backend rather than applied, while the user's own edits still go out.
+// Resuming applies everything held in one turn, passes it to Neovim as a
+// single document_operations event and follows it with sync_resumed, which
+// sums up who changed what in the meantime. Should the hold grow past
+// maxPausedOperations, sync resumes by itself.
+const maxPausedOperations = 10000
+
+// SyncPause holds remote operations while synchronization is paused
+type SyncPause struct {
+	paused bool
+	since  time.Time
+	held   []protocol.Operation
+	mutex  sync.Mutex
+}
+
+// Pause starts holding operations, reporting whether sync was running
+func (sp *SyncPause) Pause() bool {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	
+	if sp.paused {
+		return false
+	}
+	sp.paused, sp.since, sp.held = true, time.Now(), nil
+	return true
+}
+
+// Hold keeps ops while sync is paused, reporting whether it took them. Ops
+// that would take the hold past maxPausedOperations aren't taken, and full
+// reports it.
+func (sp *SyncPause) Hold(ops []protocol.Operation) (held, full bool) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	
+	if !sp.paused {
+		return false, false
+	}
+	if len(sp.held)+len(ops) > maxPausedOperations {
+		return false, true
+	}
+	sp.held = append(sp.held, ops...)
+	return true, false
+}
+
+// Resume stops holding operations and returns those held, with how long
+// sync was paused
+func (sp *SyncPause) Resume() ([]protocol.Operation, time.Duration, bool) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	
+	if !sp.paused {
+		return nil, 0, false
+	}
+	held, paused := sp.held, time.Since(sp.since)
+	sp.paused, sp.held = false, nil
+	return held, paused, true
+}
+
+func (sp *SyncPause) Paused() bool {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	return sp.paused
+}
+
+func (sp *SyncPause) Reset() {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	sp.paused, sp.held = false, nil
+}
+
+func (cm *CollabManager) handlePauseSync() *protocol.Message {
+	if cm.sessionManager.GetCurrentSession() == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	if !cm.syncPause.Pause() {
+		return createErrorMessage("pause_sync_failed", "Sync is already paused")
+	}
+	return createStatusMessage("sync_paused", "Holding others' edits until resume_sync")
+}
+
+func (cm *CollabManager) handleResumeSync() *protocol.Message {
+	if !cm.syncPause.Paused() {
+		return createErrorMessage("resume_sync_failed", "Sync is not paused")
+	}
+	cm.resumeSync("")
+	return createStatusMessage("sync_resuming", "Applying the edits held while paused")
+}
+
+// holdWhilePaused keeps relayed operations while sync is paused, reporting
+// whether it did. A full hold resumes sync ahead of ops.
+func (cm *CollabManager) holdWhilePaused(ops []protocol.Operation) bool {
+	held, full := cm.syncPause.Hold(ops)
+	if full {
+		log.Printf("Resuming sync: over %d operations held", maxPausedOperations)
+		cm.resumeSync("hold_full")
+	}
+	return held
+}
+
+// resumeSync applies the operations held while paused once the document is
+// free, ahead of any relayed since
+func (cm *CollabManager) resumeSync(reason string) {
+	cm.opFlow.run(func(queued bool) {
+		ops, paused, ok := cm.syncPause.Resume()
+		if !ok {
+			return
+		}
+		event := cm.syncResumedEvent(ops, paused)
+		event.Reason = reason
+		cm.applyServerOperations(ops)
+		
+		msg, _ := protocol.NewMessage(protocol.MsgSyncResumed, event)
+		if err := cm.sendMessage(msg); err != nil {
+			log.Printf("Failed to send sync resume: %v", err)
+		}
+	})
+}
+
+// syncResumedEvent sums up held operations by who made them
+func (cm *CollabManager) syncResumedEvent(ops []protocol.Operation, paused time.Duration) protocol.SyncResumedEvent {
+	session := cm.sessionManager.GetCurrentSession()
+	byUser := make(map[string]*protocol.PausedChange)
+	for _, op := range ops {
+		change := byUser[op.UserID]
+		if change == nil {
+			change = &protocol.PausedChange{UserID: op.UserID}
+			if session != nil {
+				change.Name = peerName(session, op.UserID)
+			}
+			byUser[op.UserID] = change
+		}
+		change.Operations++
+		switch op.Type {
+		case protocol.OpInsert:
+			change.Inserted += len(op.Content)
+		case protocol.OpDelete:
+			change.Deleted += op.Length
+		}
+	}
+	
+	event := protocol.SyncResumedEvent{PausedMS: paused.Milliseconds(), Operations: len(ops), Changes: []protocol.PausedChange{}}
+	for _, change := range byUser {
+		event.Changes = append(event.Changes, *change)
+	}
+	sort.Slice(event.Changes, func(i, j int) bool {
+		a, b := event.Changes[i], event.Changes[j]
+		if a.Operations != b.Operations {
+			return a.Operations > b.Operations
+		}
+		return a.UserID < b.UserID
+	})
+	return event
+}
@@ -0,0 +1,304 @@
+package collab
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Remote cursors can move many times a second. Rather than forwarding every
+// update, the tracker keeps the latest state per peer and once per tick sends
+// Neovim only the peers whose state differs from what it last sent, so a
+// large session costs one small message per tick instead of a full dump.
+//
+// In project sessions a peer's cursor is in one of the shared files at a
+// time. The tracker remembers where each peer last was in every file, for a
+// map of who is where, and reports each move to another file.
+const presenceTickInterval = 50 * time.Millisecond
+
+// cursorColor derives a peer's color from their user ID, so every screen
+// draws a peer's cursor alike. Neovim takes it modulo the number of colors
+// it has.
+func cursorColor(userID string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(userID))
+	return int(hash.Sum32() & 0xffff)
+}
+
+// PresenceTracker batches presence changes into per-tick deltas
+type PresenceTracker struct {
+	current map[string]protocol.PresenceState
+	emitted map[string]protocol.PresenceState            // last state sent to Neovim
+	files   map[string]map[string]protocol.PresenceState // each peer's last state by file
+	dirty   bool
+	mutex   sync.Mutex
+
+	emit     func(protocol.PresenceDelta)
+	switched func(protocol.PeerSwitchedFileEvent)
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewPresenceTracker starts a tracker that passes each batch to emit, and
+// each peer's move to another file to switched
+func NewPresenceTracker(emit func(protocol.PresenceDelta), switched func(protocol.PeerSwitchedFileEvent)) *PresenceTracker {
+	pt := &PresenceTracker{
+		current:  make(map[string]protocol.PresenceState),
+		emitted:  make(map[string]protocol.PresenceState),
+		files:    make(map[string]map[string]protocol.PresenceState),
+		emit:     emit,
+		switched: switched,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go pt.run()
+	return pt
+}
+
+// Update records a peer's latest state; it is sent on the next tick if it
+// differs from the last one sent
+func (pt *PresenceTracker) Update(state protocol.PresenceState) {
+	state.Color = cursorColor(state.UserID)
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	pt.current[state.UserID] = state
+	if pt.files[state.UserID] == nil {
+		pt.files[state.UserID] = make(map[string]protocol.PresenceState)
+	}
+	pt.files[state.UserID][state.File] = state
+	pt.dirty = true
+}
+
+// Remove forgets a peer, e.g. when it leaves
+func (pt *PresenceTracker) Remove(userID string) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	delete(pt.files, userID)
+	if _, exists := pt.current[userID]; exists {
+		delete(pt.current, userID)
+		pt.dirty = true
+	}
+}
+
+// Reset forgets every peer, e.g. when leaving the session
+func (pt *PresenceTracker) Reset() {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	pt.files = make(map[string]map[string]protocol.PresenceState)
+	if len(pt.current) > 0 {
+		pt.current = make(map[string]protocol.PresenceState)
+		pt.dirty = true
+	}
+}
+
+// Map lists the peers' last cursors in each file, the session's document
+// first
+func (pt *PresenceTracker) Map() []protocol.FilePresence {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	byFile := make(map[string][]protocol.PeerCursor)
+	for userID, states := range pt.files {
+		for file, state := range states {
+			byFile[file] = append(byFile[file], protocol.PeerCursor{
+				PresenceState: state,
+				Focused:       pt.current[userID].File == file,
+			})
+		}
+	}
+
+	files := make([]protocol.FilePresence, 0, len(byFile))
+	for file, cursors := range byFile {
+		sort.Slice(cursors, func(i, j int) bool { return cursors[i].UserID < cursors[j].UserID })
+		files = append(files, protocol.FilePresence{File: file, Cursors: cursors})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].File < files[j].File })
+	return files
+}
+
+// Current returns a peer's latest state, false when there is none
+func (pt *PresenceTracker) Current(userID string) (protocol.PresenceState, bool) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	state, ok := pt.current[userID]
+	return state, ok
+}
+
+// Close stops the tracker after sending any pending changes
+func (pt *PresenceTracker) Close() {
+	close(pt.stop)
+	<-pt.done
+}
+
+func (pt *PresenceTracker) run() {
+	defer close(pt.done)
+
+	ticker := time.NewTicker(presenceTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pt.flush()
+		case <-pt.stop:
+			pt.flush()
+			return
+		}
+	}
+}
+
+// flush diffs the current states against the last emitted snapshot
+func (pt *PresenceTracker) flush() {
+	pt.mutex.Lock()
+	if !pt.dirty {
+		pt.mutex.Unlock()
+		return
+	}
+	pt.dirty = false
+
+	var delta protocol.PresenceDelta
+	var switches []protocol.PeerSwitchedFileEvent
+	for userID, state := range pt.current {
+		last, sent := pt.emitted[userID]
+		if sent && last == state {
+			continue
+		}
+		if (sent && last.File != state.File) || (!sent && state.File != "") {
+			switches = append(switches, protocol.PeerSwitchedFileEvent{UserID: userID, File: state.File, Previous: last.File})
+		}
+		delta.Updated = append(delta.Updated, state)
+		pt.emitted[userID] = state
+	}
+	for userID := range pt.emitted {
+		if _, exists := pt.current[userID]; !exists {
+			delta.Removed = append(delta.Removed, userID)
+			delete(pt.emitted, userID)
+		}
+	}
+	pt.mutex.Unlock()
+
+	if len(delta.Updated) == 0 && len(delta.Removed) == 0 {
+		return
+	}
+
+	// Stable order keeps extmark updates on the Lua side deterministic
+	sort.Slice(delta.Updated, func(i, j int) bool { return delta.Updated[i].UserID < delta.Updated[j].UserID })
+	sort.Strings(delta.Removed)
+	pt.emit(delta)
+
+	sort.Slice(switches, func(i, j int) bool { return switches[i].UserID < switches[j].UserID })
+	for _, event := range switches {
+		pt.switched(event)
+	}
+}
+
+// handlePeerPresence feeds cursor messages from peers into the tracker
+func (cm *CollabManager) handlePeerPresence(userID string, msg *protocol.Message) {
+	var cursor protocol.CursorPosition
+	if err := msg.ParseData(&cursor); err != nil {
+		return
+	}
+	
+	// Trust the connection's identity over what the message claims
+	state := protocol.PresenceState{
+		UserID:         userID,
+		Line:           cursor.Line,
+		Column:         cursor.Column,
+		ViewportTop:    cursor.ViewportTop,
+		ViewportBottom: cursor.ViewportBottom,
+		File:           cursor.File,
+	}
+	// Selections come separately through the server; keep the peer's
+	// while it stays in the file
+	if prev, ok := cm.presence.Current(userID); ok && prev.File == cursor.File {
+		state.Selection = prev.Selection
+	}
+	cm.updatePresence(state)
+}
+
+// handlePeerSelection feeds a peer's selection, relayed by the server, into
+// the tracker, keeping their cursor
+func (cm *CollabManager) handlePeerSelection(userID string, msg *protocol.Message) {
+	var update protocol.SelectionUpdate
+	if err := msg.ParseData(&update); err != nil || protocol.SelectionMode(update.Mode) < 0 {
+		return
+	}
+	state, ok := cm.presence.Current(userID)
+	if !ok || state.File != update.File {
+		state = protocol.PresenceState{Line: update.EndLine, Column: update.EndColumn, File: update.File}
+	}
+	state.UserID = userID
+	state.Selection = update.Selection
+	cm.updatePresence(state)
+}
+
+// handleSelectionUpdate shares the local selection with peers the way the
+// cursor is shared
+func (cm *CollabManager) handleSelectionUpdate(update *protocol.SelectionUpdate) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return nil
+	}
+	if protocol.SelectionMode(update.Mode) < 0 {
+		return createErrorMessage("invalid_selection", fmt.Sprintf("unknown selection mode %q", update.Mode))
+	}
+	file, err := sharedFile(session, update.File)
+	if err != nil {
+		return createErrorMessage("invalid_selection", err.Error())
+	}
+	update.File = file
+	if update.Mode == "" {
+		update.Selection = protocol.Selection{}
+	}
+	
+	if cm.p2pManager.ServerMode() {
+		if err := cm.broadcastToPeers(protocol.MsgSelectionUpdate, update); err != nil {
+			log.Printf("Failed to send selection: %v", err)
+		}
+		return nil
+	}
+	cm.presenceEncoder.Select(update.Selection, file)
+	return nil
+}
+
+// updatePresence records a peer's state if it is in a file the session
+// shares
+func (cm *CollabManager) updatePresence(state protocol.PresenceState) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return
+	}
+	file, err := sharedFile(session, state.File)
+	if err != nil {
+		log.Printf("Ignoring presence from %s: %v", state.UserID, err)
+		return
+	}
+	state.File = file
+	if cm.mutes.Muted(state.UserID) {
+		return
+	}
+	cm.presence.Update(state)
+}
+
+// sendPeerSwitchedFile tells Neovim a peer moved to another file
+func (cm *CollabManager) sendPeerSwitchedFile(event protocol.PeerSwitchedFileEvent) {
+	if session := cm.sessionManager.GetCurrentSession(); session != nil {
+		event.Name = peerName(session, event.UserID)
+	}
+	if err := cm.sendEvent(protocol.MsgPeerSwitchedFile, event); err != nil {
+		log.Printf("Failed to send file switch: %v", err)
+	}
+}
+
+func (cm *CollabManager) handleGetPresenceMap() *protocol.Message {
+	if cm.sessionManager.GetCurrentSession() == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgPresenceMap, protocol.PresenceMapEvent{Files: cm.presence.Map()})
+	return msg
+}
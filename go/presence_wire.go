@@ -0,0 +1,22 @@
+package collab
+
+import "log"
+
+// sendPresenceFrame broadcasts a local presence frame to peers
+func (cm *CollabManager) sendPresenceFrame(frame []byte) {
+	if err := cm.p2pManager.BroadcastUnordered(frame, false); err != nil {
+		log.Printf("Failed to send presence: %v", err)
+	}
+}
+
+// handlePeerPresenceFrame feeds a peer's presence frame into the tracker
+func (cm *CollabManager) handlePeerPresenceFrame(userID string, frame []byte) {
+	state, ok, err := cm.presenceDecoder.Decode(userID, frame)
+	if err != nil {
+		log.Printf("Dropping presence frame from %s: %v", userID, err)
+		return
+	}
+	if ok {
+		cm.updatePresence(state)
+	}
+}
@@ -0,0 +1,185 @@
+package collab
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// With typing_privacy on, the local user's edits are applied at once but
+// reach everyone else only when they are committed: when a word or line is
+// finished, or once typing has paused for debounce_ms. Everything held is
+// then sent as one batch, which the others' Neovim applies as a single
+// change, so they see finished words rather than every keystroke with its
+// typos and corrections. Nothing is held longer than maxTypingHold while
+// the user keeps typing. Held edits are also sent before leaving, closing
+// or confirming the document.
+const (
+	defaultTypingDebounce = 1500 * time.Millisecond
+	maxTypingHold         = 5 * time.Second
+)
+
+// TypingPrivacy configures holding back uncommitted edits
+type TypingPrivacy struct {
+	Enabled    bool `json:"enabled"`
+	DebounceMS int  `json:"debounce_ms,omitempty"` // 1500 when unset
+}
+
+func (t TypingPrivacy) debounce() time.Duration {
+	if t.DebounceMS <= 0 {
+		return defaultTypingDebounce
+	}
+	return time.Duration(t.DebounceMS) * time.Millisecond
+}
+
+// typingBuffer holds local edits until they are committed. Sends happen
+// under its mutex, so held and new edits leave in the order they were made.
+type typingBuffer struct {
+	config TypingPrivacy
+	held   []protocol.Operation
+	since  time.Time // when the oldest held edit was made
+	timer  *time.Timer
+	mutex  sync.Mutex
+}
+
+func newTypingBuffer(config TypingPrivacy) *typingBuffer {
+	return &typingBuffer{config: config}
+}
+
+func (tb *typingBuffer) Config() TypingPrivacy {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	return tb.config
+}
+
+// SetConfig changes the settings; turning privacy off sends nothing by
+// itself, so the caller flushes
+func (tb *typingBuffer) SetConfig(config TypingPrivacy) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	tb.config = config
+}
+
+// relay sends ops with what is held once they commit, holding them
+// otherwise. expired is run when the debounce passes without another edit.
+func (tb *typingBuffer) relay(ops []protocol.Operation, send func([]protocol.Operation) error, expired func()) error {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	
+	if len(tb.held) == 0 {
+		tb.since = time.Now()
+	}
+	tb.held = append(tb.held, ops...)
+	if !tb.config.Enabled || commitsTyping(ops) || time.Since(tb.since) >= maxTypingHold {
+		return tb.sendLocked(send)
+	}
+	if tb.timer != nil {
+		tb.timer.Stop()
+	}
+	tb.timer = time.AfterFunc(tb.config.debounce(), expired)
+	return nil
+}
+
+// flush sends whatever is held
+func (tb *typingBuffer) flush(send func([]protocol.Operation) error) error {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	return tb.sendLocked(send)
+}
+
+func (tb *typingBuffer) sendLocked(send func([]protocol.Operation) error) error {
+	if tb.timer != nil {
+		tb.timer.Stop()
+		tb.timer = nil
+	}
+	ops := tb.held
+	tb.held = nil
+	if len(ops) == 0 {
+		return nil
+	}
+	return send(ops)
+}
+
+// Reset drops what is held, when the session it was made in is gone
+func (tb *typingBuffer) Reset() {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	if tb.timer != nil {
+		tb.timer.Stop()
+		tb.timer = nil
+	}
+	tb.held = nil
+}
+
+// commitsTyping reports whether edits finish a word or line: text inserted
+// ending in whitespace or punctuation, or more than a word's worth of it at
+// once, as a paste or completion is
+func commitsTyping(ops []protocol.Operation) bool {
+	for _, op := range ops {
+		if op.Type != protocol.OpInsert {
+			continue
+		}
+		if strings.Contains(op.Content, "\n") || utf8.RuneCountInString(op.Content) > 1 && strings.ContainsFunc(op.Content, unicode.IsSpace) {
+			return true
+		}
+		last, _ := utf8.DecodeLastRuneInString(op.Content)
+		if unicode.IsSpace(last) || unicode.IsPunct(last) {
+			return true
+		}
+	}
+	return false
+}
+
+// relayOperations sends local operations as one batch to the server, which
+// orders them with everyone else's, or to every peer of a peer-to-peer
+// session. With typing privacy they may wait to go with later ones.
+func (cm *CollabManager) relayOperations(ops []protocol.Operation) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	return cm.typing.relay(ops, cm.sendOperations, func() {
+		cm.onLoop(cm.flushTyping)
+	})
+}
+
+// flushTyping sends the local edits typing privacy is holding
+func (cm *CollabManager) flushTyping() {
+	if err := cm.typing.flush(cm.sendOperations); err != nil {
+		log.Printf("Failed to relay operations: %v", err)
+	}
+}
+
+// stampOperation gives a local operation its vector clock when it goes
+// straight to peers, who order it by that rather than by the server's turn
+func (cm *CollabManager) stampOperation(op protocol.Operation) protocol.Operation {
+	if cm.p2pManager.ServerMode() {
+		return op
+	}
+	return cm.syncManager.StampOperation(op)
+}
+
+func (cm *CollabManager) sendOperations(ops []protocol.Operation) error {
+	cm.latency.Sent(ops, cm.p2pManager.GetConnectedPeers(), time.Now())
+	if len(ops) == 1 {
+		return cm.broadcastToPeers(protocol.MsgDocumentOperation, ops[0])
+	}
+	return cm.broadcastToPeers(protocol.MsgDocumentOperations, protocol.OperationBatch{Operations: ops})
+}
+
+// handleSetTypingPrivacy turns typing privacy on or off until the config
+// file changes it
+func (cm *CollabManager) handleSetTypingPrivacy(req *protocol.SetTypingPrivacyRequest) *protocol.Message {
+	config := cm.typing.Config()
+	config.Enabled = req.Enabled
+	cm.typing.SetConfig(config)
+	if !req.Enabled {
+		cm.flushTyping()
+		return createStatusMessage("typing_privacy", "Edits are sent as you type")
+	}
+	return createStatusMessage("typing_privacy", "Edits are sent once a word or line is finished")
+}
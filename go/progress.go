@@ -0,0 +1,86 @@
+package collab
+
+import (
+	"log"
+	"sync"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Joining a large session can take a while, so the joiner's Neovim hears how
+// far along it is in join_progress events, stage by stage: the handshake
+// with the server, the transfer of the document snapshot, replaying the
+// operations that queued up while the snapshot was set up, and presence.
+// Each stage goes from 0 to 100 percent in steps of at least
+// joinProgressStep, and the presence stage reaching 100 ends the join.
+const (
+	JoinStageHandshake = "handshake"
+	JoinStageSnapshot  = "snapshot"
+	JoinStageReplay    = "replay"
+	JoinStagePresence  = "presence"
+	
+	joinProgressStep = 5
+)
+
+// joinProgress reports the stages of a join, leaving out steps too small
+// to show
+type joinProgress struct {
+	stage   string
+	percent int
+	output  *neovimOutput
+	mutex   sync.Mutex
+}
+
+// start begins a join with its handshake
+func (jp *joinProgress) start() {
+	jp.mutex.Lock()
+	jp.stage, jp.percent = "", 0
+	jp.mutex.Unlock()
+	jp.report(JoinStageHandshake, 0, 1)
+}
+
+// snapshot reports how much of the snapshot has arrived; its first bytes
+// mean the handshake is done
+func (jp *joinProgress) snapshot(read, total int) {
+	jp.mutex.Lock()
+	first := jp.stage == JoinStageHandshake
+	jp.mutex.Unlock()
+	if first {
+		jp.report(JoinStageHandshake, 1, 1)
+	}
+	jp.report(JoinStageSnapshot, read, total)
+}
+
+// report sends a stage's progress when it starts, ends or has moved on by
+// a step
+func (jp *joinProgress) report(stage string, done, total int) {
+	percent := 100
+	if total > 0 {
+		percent = done * 100 / total
+	}
+	
+	jp.mutex.Lock()
+	if stage == jp.stage && (percent == jp.percent || (percent < 100 && percent-jp.percent < joinProgressStep)) {
+		jp.mutex.Unlock()
+		return
+	}
+	jp.stage, jp.percent = stage, percent
+	jp.mutex.Unlock()
+	
+	msg, _ := protocol.NewMessage(protocol.MsgJoinProgress, protocol.JoinProgressEvent{Stage: stage, Percent: percent, Done: done, Total: total})
+	if err := jp.output.send(msg); err != nil {
+		log.Printf("Failed to send join progress: %v", err)
+	}
+}
+
+// replayProgress reports the operations queued behind a join as they apply,
+// then announces the local user's presence to finish the join
+func (cm *CollabManager) replayProgress(applied, total int, done bool) {
+	cm.joinProgress.report(JoinStageReplay, applied, total)
+	if !done {
+		return
+	}
+	cm.joinProgress.report(JoinStagePresence, 0, 1)
+	cm.presenceEncoder.Resend()
+	cm.joinProgress.report(JoinStagePresence, 1, 1)
+}
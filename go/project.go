@@ -0,0 +1,105 @@
+package collab
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// listProjectFiles walks root in lexical order and returns the regular files
+// the rules don't leave out. Ignored directories aren't entered at all.
+func listProjectFiles(root string, rules *IgnoreRules) ([]protocol.ProjectFile, error) {
+	var files []protocol.ProjectFile
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if p == root {
+			return err
+		}
+		if err != nil {
+			log.Printf("Skipping %s: %v", p, err)
+			return nil
+		}
+		
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if rules.ignoredSelf(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, protocol.ProjectFile{Path: rel, Size: info.Size()})
+		return nil
+	})
+	return files, err
+}
+
+// projectRules picks the project to list: the current project session's
+// when root is empty or its own, with the rules the host shared, or else
+// the one at root with its own rules
+func (cm *CollabManager) projectRules(root string) (string, *IgnoreRules, error) {
+	session := cm.sessionManager.GetCurrentSession()
+	inProject := session != nil && session.Project && cm.sessionRoot != ""
+	
+	if root == "" {
+		if !inProject {
+			return "", nil, fmt.Errorf("root is required outside a project session")
+		}
+		root = cm.sessionRoot
+	}
+	root, err := cleanSessionRoot(root)
+	if err != nil {
+		return "", nil, err
+	}
+	if inProject && root == cm.sessionRoot {
+		return root, NewIgnoreRules(session.IgnoreRules), nil
+	}
+	return root, loadIgnoreRules(root), nil
+}
+
+func (cm *CollabManager) handleListProjectFiles(req *protocol.ListProjectFilesRequest) *protocol.Message {
+	if req.Remote {
+		session := cm.sessionManager.GetCurrentSession()
+		if session == nil || !session.Project || cm.hostSession() != nil {
+			return createErrorMessage("list_project_files_failed", "remote needs a project session someone else hosts")
+		}
+		if err := cm.broadcastToPeers(protocol.MsgListProjectFiles, req); err != nil {
+			return createErrorMessage("list_project_files_failed", err.Error())
+		}
+		return createStatusMessage("project_files_requested", "Waiting for the host's project files")
+	}
+	
+	root, rules, err := cm.projectRules(req.Root)
+	if err != nil {
+		return createErrorMessage("invalid_root", err.Error())
+	}
+	
+	files, err := listProjectFiles(root, rules)
+	if err != nil {
+		return createErrorMessage("list_project_files_failed", err.Error())
+	}
+	count, total := cm.projectLimits.ApplyLimits(files)
+	
+	msg, _ := protocol.NewMessage(protocol.MsgProjectFiles, protocol.ProjectFilesResponse{
+		Root:         root,
+		Files:        files,
+		IgnoreRules:  rules.Lines(),
+		Limits:       cm.projectLimits,
+		OfferedFiles: count,
+		OfferedBytes: total,
+	})
+	return msg
+}
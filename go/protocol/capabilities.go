@@ -0,0 +1,28 @@
+package protocol
+
+const (
+	FeatureChat      = "chat"
+	FeatureMultiFile = "multi_file"
+)
+
+// Missing lists the features caps lacks
+func (caps PeerCapabilities) Missing() []string {
+	var missing []string
+	if !caps.Chat {
+		missing = append(missing, FeatureChat)
+	}
+	if !caps.MultiFile {
+		missing = append(missing, FeatureMultiFile)
+	}
+	return missing
+}
+
+func (caps PeerCapabilities) Has(feature string) bool {
+	switch feature {
+	case FeatureChat:
+		return caps.Chat
+	case FeatureMultiFile:
+		return caps.MultiFile
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Stream connections (SSH tunnels and the central server) carry each message
+// as a frame: its length as 4 bytes big-endian, then the message.
+const (
+	maxStreamFrameSize = 64 * 1024 * 1024
+	
+	// Bytes of a frame read between progress reports
+	frameProgressChunk = 64 * 1024
+)
+
+// WriteFrame writes data as one frame
+func WriteFrame(w io.Writer, data []byte) error {
+	if len(data) > maxStreamFrameSize {
+		return fmt.Errorf("message of %d bytes exceeds the %d byte frame limit", len(data), maxStreamFrameSize)
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads the next frame
+func ReadFrame(r io.Reader) ([]byte, error) {
+	return ReadFrameProgress(r, nil)
+}
+
+// ReadFrameProgress reads a frame, telling progress how much of it has
+// arrived as it comes in
+func ReadFrameProgress(r io.Reader, progress func(read, total int)) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxStreamFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the %d byte limit", size, maxStreamFrameSize)
+	}
+	data := make([]byte, size)
+	if progress == nil {
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	
+	for read := 0; read < len(data); {
+		end := min(read+frameProgressChunk, len(data))
+		if _, err := io.ReadFull(r, data[read:end]); err != nil {
+			return nil, err
+		}
+		read = end
+		progress(read, len(data))
+	}
+	return data, nil
+}
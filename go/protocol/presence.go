@@ -0,0 +1,37 @@
+package protocol
+
+// PresenceState is what Neovim renders for one remote peer
+type PresenceState struct {
+	UserID         string    `json:"user_id"`
+	Line           int       `json:"line"`
+	Column         int       `json:"column"`
+	ViewportTop    int       `json:"viewport_top,omitempty"`
+	ViewportBottom int       `json:"viewport_bottom,omitempty"`
+	File           string    `json:"file,omitempty"` // "" is the session's document
+	Selection      Selection `json:"selection"`
+	Color          int       `json:"color"` // picks the peer's entry in cursor_colors
+}
+
+// Selection is a visual-mode selection in the file the cursor is in. Lines
+// and columns are 0-based and the end is included; Mode is "" when nothing
+// is selected.
+type Selection struct {
+	Mode        string `json:"mode"` // "char", "line" or "block"
+	StartLine   int    `json:"start_line"`
+	StartColumn int    `json:"start_column"`
+	EndLine     int    `json:"end_line"`
+	EndColumn   int    `json:"end_column"`
+}
+
+// selectionModes are the selection modes in their wire order
+var selectionModes = []string{"", "char", "line", "block"}
+
+// SelectionMode returns mode's index in selectionModes, -1 when unknown
+func SelectionMode(mode string) int {
+	for i, known := range selectionModes {
+		if known == mode {
+			return i
+		}
+	}
+	return -1
+}
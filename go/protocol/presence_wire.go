@@ -0,0 +1,374 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Presence updates are most of a session's messages, so on data channels
+// they skip JSON. Each update is a small binary frame:
+//
+//	magic (1 byte) | flags (1) | sequence (uvarint) | fields (zigzag varints)
+//
+// A keyframe carries every field. Other frames carry only the fields that
+// changed, as differences from the previous frame, so a cursor moving along
+// a line costs about five bytes instead of a JSON object. Frames go over the
+// lossy unordered channel: a receiver applies a delta only on top of the
+// frame just before it, and after a gap waits for the next keyframe. One is
+// sent every presenceKeyframeEvery frames and once the cursor settles. On
+// slow links updates are coalesced to one per sync profile interval.
+//
+// The shared file the cursor is in follows the numeric fields as a length
+// and its bytes, on keyframes when it isn't the session's document and on
+// deltas when it changed. Peers that predate it stop reading before it. The
+// selection comes last, as its mode's index in selectionModes and its four
+// positions as they are, on keyframes when there is one and on deltas when
+// it changed.
+const (
+	presenceMagic byte = 0xCD
+	
+	presenceFlagKeyframe  byte = 1 << 0
+	presenceFlagLine      byte = 1 << 1
+	presenceFlagColumn    byte = 1 << 2
+	presenceFlagTop       byte = 1 << 3
+	presenceFlagBottom    byte = 1 << 4
+	presenceFlagFile      byte = 1 << 5
+	presenceFlagSelection byte = 1 << 6
+	
+	presenceKeyframeEvery = 16
+	presenceSettleDelay   = 250 * time.Millisecond
+	
+	// A keyframe this far behind the last one means the sender restarted
+	presenceRestartWindow = 64
+)
+
+// IsPresenceFrame reports whether a peer message is a binary presence frame
+func IsPresenceFrame(data []byte) bool {
+	return len(data) >= 3 && data[0] == presenceMagic
+}
+
+// presenceField is one encoded field of a state and the flag marking it
+type presenceField struct {
+	flag  byte
+	value *int
+}
+
+// presenceFields lists a state's encoded fields in wire order
+func presenceFields(state *PresenceState) []presenceField {
+	return []presenceField{
+		{presenceFlagLine, &state.Line},
+		{presenceFlagColumn, &state.Column},
+		{presenceFlagTop, &state.ViewportTop},
+		{presenceFlagBottom, &state.ViewportBottom},
+	}
+}
+
+// selectionFields lists a selection's positions in wire order
+func selectionFields(selection *Selection) []*int {
+	return []*int{&selection.StartLine, &selection.StartColumn, &selection.EndLine, &selection.EndColumn}
+}
+
+// encodePresenceFrame encodes state as a keyframe, or as a delta from prev
+func encodePresenceFrame(seq uint64, state PresenceState, prev *PresenceState) []byte {
+	frame := make([]byte, 2, 16)
+	frame[0] = presenceMagic
+	frame = binary.AppendUvarint(frame, seq)
+	
+	flags := byte(0)
+	if prev == nil {
+		flags |= presenceFlagKeyframe
+	}
+	var base PresenceState
+	if prev != nil {
+		base = *prev
+	}
+	baseFields := presenceFields(&base)
+	for i, field := range presenceFields(&state) {
+		diff := *field.value - *baseFields[i].value
+		if prev != nil && diff == 0 {
+			continue
+		}
+		flags |= field.flag
+		frame = binary.AppendVarint(frame, int64(diff))
+	}
+	if state.File != base.File {
+		flags |= presenceFlagFile
+		frame = appendWireString(frame, state.File)
+	}
+	if state.Selection != base.Selection {
+		flags |= presenceFlagSelection
+		frame = append(frame, byte(SelectionMode(state.Selection.Mode)))
+		for _, value := range selectionFields(&state.Selection) {
+			frame = binary.AppendVarint(frame, int64(*value))
+		}
+	}
+	frame[1] = flags
+	return frame
+}
+
+// PresenceEncoder turns the local cursor's updates into presence frames
+type PresenceEncoder struct {
+	last     *PresenceState
+	pending  *PresenceState // held back until the interval has passed
+	seq      uint64
+	sent     int // frames since the last keyframe
+	sentAt   time.Time
+	interval time.Duration
+	timer    *time.Timer
+	send     func(frame []byte)
+	mutex    sync.Mutex
+	
+	// The local selection and the file it is in, sent with the cursor
+	// while it is in that file
+	selection     Selection
+	selectionFile string
+}
+
+func NewPresenceEncoder(send func(frame []byte)) *PresenceEncoder {
+	return &PresenceEncoder{send: send}
+}
+
+// SetInterval sets the shortest gap between updates; 0 sends each one
+func (pe *PresenceEncoder) SetInterval(interval time.Duration) {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+	pe.interval = interval
+}
+
+// Update sends the local cursor's new state, usually as a delta
+func (pe *PresenceEncoder) Update(state PresenceState) {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+	
+	if state.File == pe.selectionFile {
+		state.Selection = pe.selection
+	}
+	pe.update(state)
+}
+
+// Select sends the local selection in file, with the cursor where it last
+// was there or else at the selection's end
+func (pe *PresenceEncoder) Select(selection Selection, file string) {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+	
+	pe.selection = selection
+	pe.selectionFile = file
+	var state PresenceState
+	switch {
+	case pe.pending != nil && pe.pending.File == file:
+		state = *pe.pending
+	case pe.last != nil && pe.last.File == file:
+		state = *pe.last
+	default:
+		state = PresenceState{Line: selection.EndLine, Column: selection.EndColumn, File: file}
+	}
+	state.Selection = selection
+	pe.update(state)
+}
+
+// update sends state now or once the interval has passed. Caller holds
+// mutex.
+func (pe *PresenceEncoder) update(state PresenceState) {
+	if pe.last != nil && *pe.last == state {
+		pe.pending = nil
+		return
+	}
+	if wait := pe.interval - time.Since(pe.sentAt); wait > 0 {
+		pe.pending = &state
+		pe.schedule(wait)
+		return
+	}
+	pe.sendDelta(state)
+}
+
+// sendDelta sends state as a delta, or as a keyframe when one is due, and
+// schedules the settle keyframe. Caller holds mutex.
+func (pe *PresenceEncoder) sendDelta(state PresenceState) {
+	prev := pe.last
+	if pe.sent >= presenceKeyframeEvery {
+		prev = nil
+	}
+	pe.emit(state, prev)
+	
+	// Repeat the final position as a keyframe in case a delta was lost
+	pe.schedule(presenceSettleDelay)
+}
+
+// schedule runs flush after delay, replacing the previous schedule. Caller
+// holds mutex.
+func (pe *PresenceEncoder) schedule(delay time.Duration) {
+	if pe.timer != nil {
+		pe.timer.Stop()
+	}
+	pe.timer = time.AfterFunc(delay, pe.flush)
+}
+
+// flush sends a held-back update, or else the settled state as a keyframe
+func (pe *PresenceEncoder) flush() {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+	
+	if pe.pending != nil {
+		state := *pe.pending
+		pe.pending = nil
+		pe.sendDelta(state)
+		return
+	}
+	if pe.last != nil {
+		pe.emit(*pe.last, nil)
+	}
+}
+
+// Resend sends the current state as a keyframe, e.g. for a peer that just
+// joined
+func (pe *PresenceEncoder) Resend() {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+	
+	if pe.last != nil {
+		pe.emit(*pe.last, nil)
+	}
+}
+
+// Reset forgets the local state, e.g. when leaving the session
+func (pe *PresenceEncoder) Reset() {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+	
+	if pe.timer != nil {
+		pe.timer.Stop()
+		pe.timer = nil
+	}
+	pe.last = nil
+	pe.pending = nil
+	pe.selection = Selection{}
+	pe.selectionFile = ""
+}
+
+// emit sends one frame. Caller holds mutex.
+func (pe *PresenceEncoder) emit(state PresenceState, prev *PresenceState) {
+	pe.seq++
+	frame := encodePresenceFrame(pe.seq, state, prev)
+	if prev == nil {
+		pe.sent = 0
+	} else {
+		pe.sent++
+	}
+	pe.last = &state
+	pe.sentAt = time.Now()
+	pe.send(frame)
+}
+
+// PresenceDecoder rebuilds each peer's state from their frames
+type PresenceDecoder struct {
+	peers map[string]*decodedPresence
+	mutex sync.Mutex
+}
+
+type decodedPresence struct {
+	state PresenceState
+	seq   uint64
+	valid bool // false after a gap, until the next keyframe
+}
+
+func NewPresenceDecoder() *PresenceDecoder {
+	return &PresenceDecoder{peers: make(map[string]*decodedPresence)}
+}
+
+// Decode applies a frame from userID, reporting false when it can't be
+// applied yet
+func (pd *PresenceDecoder) Decode(userID string, frame []byte) (PresenceState, bool, error) {
+	if !IsPresenceFrame(frame) {
+		return PresenceState{}, false, fmt.Errorf("not a presence frame")
+	}
+	flags := frame[1]
+	seq, n := binary.Uvarint(frame[2:])
+	if n <= 0 {
+		return PresenceState{}, false, fmt.Errorf("invalid presence sequence")
+	}
+	rest := frame[2+n:]
+	
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+	
+	peer, exists := pd.peers[userID]
+	if !exists {
+		peer = &decodedPresence{}
+		pd.peers[userID] = peer
+	}
+	
+	keyframe := flags&presenceFlagKeyframe != 0
+	switch {
+	case keyframe && peer.seq >= presenceRestartWindow && seq < peer.seq-presenceRestartWindow:
+		// The sender started over
+	case seq <= peer.seq:
+		return PresenceState{}, false, nil // late or duplicate
+	case !keyframe && (!peer.valid || seq != peer.seq+1):
+		peer.seq = seq
+		peer.valid = false
+		return PresenceState{}, false, nil
+	}
+	
+	state := peer.state
+	if keyframe {
+		state = PresenceState{}
+	}
+	for _, field := range presenceFields(&state) {
+		if flags&field.flag == 0 {
+			continue
+		}
+		value, n := binary.Varint(rest)
+		if n <= 0 {
+			return PresenceState{}, false, fmt.Errorf("truncated presence frame")
+		}
+		rest = rest[n:]
+		*field.value += int(value)
+	}
+	if flags&presenceFlagFile != 0 {
+		length, n := binary.Uvarint(rest)
+		if n <= 0 || length > uint64(len(rest)-n) {
+			return PresenceState{}, false, fmt.Errorf("truncated presence frame")
+		}
+		state.File = string(rest[n : n+int(length)])
+		rest = rest[n+int(length):]
+	}
+	if flags&presenceFlagSelection != 0 {
+		if len(rest) == 0 || int(rest[0]) >= len(selectionModes) {
+			return PresenceState{}, false, fmt.Errorf("invalid presence selection")
+		}
+		selection := Selection{Mode: selectionModes[rest[0]]}
+		rest = rest[1:]
+		for _, value := range selectionFields(&selection) {
+			v, n := binary.Varint(rest)
+			if n <= 0 {
+				return PresenceState{}, false, fmt.Errorf("truncated presence frame")
+			}
+			rest = rest[n:]
+			*value = int(v)
+		}
+		state.Selection = selection
+	}
+	
+	state.UserID = userID
+	peer.state = state
+	peer.seq = seq
+	peer.valid = true
+	return state, true, nil
+}
+
+// Remove forgets a peer, e.g. when it leaves
+func (pd *PresenceDecoder) Remove(userID string) {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+	delete(pd.peers, userID)
+}
+
+// Reset forgets every peer
+func (pd *PresenceDecoder) Reset() {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+	pd.peers = make(map[string]*decodedPresence)
+}
@@ -0,0 +1,58 @@
+package protocol
+
+import "fmt"
+
+// ProjectFile is a file a project session offers for sharing. Files past
+// the project limits are still listed, but marked on demand: they are only
+// shared when someone opens one explicitly, never as part of the project.
+type ProjectFile struct {
+	Path     string `json:"path"` // relative to the root, with forward slashes
+	Size     int64  `json:"size"`
+	OnDemand bool   `json:"on_demand,omitempty"`
+	Reason   string `json:"reason,omitempty"` // why it is on demand
+}
+
+// ProjectLimits bound how much of a project is offered for sharing
+type ProjectLimits struct {
+	MaxFileBytes  int64 `json:"max_file_bytes,omitempty"`
+	MaxFiles      int   `json:"max_files,omitempty"`
+	MaxTotalBytes int64 `json:"max_total_bytes,omitempty"`
+}
+
+var defaultProjectLimits = ProjectLimits{MaxFileBytes: 1 << 20, MaxFiles: 500, MaxTotalBytes: 20 << 20}
+
+// WithDefaults fills in the limits left unset
+func (l ProjectLimits) WithDefaults() ProjectLimits {
+	if l.MaxFileBytes <= 0 {
+		l.MaxFileBytes = defaultProjectLimits.MaxFileBytes
+	}
+	if l.MaxFiles <= 0 {
+		l.MaxFiles = defaultProjectLimits.MaxFiles
+	}
+	if l.MaxTotalBytes <= 0 {
+		l.MaxTotalBytes = defaultProjectLimits.MaxTotalBytes
+	}
+	return l
+}
+
+// ApplyLimits marks files on demand in listing order: any over the size
+// limit, and every one that would take the project past its file count or
+// total size. Returns how many files and bytes are offered.
+func (l ProjectLimits) ApplyLimits(files []ProjectFile) (int, int64) {
+	count, total := 0, int64(0)
+	for i := range files {
+		file := &files[i]
+		switch {
+		case file.Size > l.MaxFileBytes:
+			file.OnDemand, file.Reason = true, fmt.Sprintf("larger than %d bytes", l.MaxFileBytes)
+		case count >= l.MaxFiles:
+			file.OnDemand, file.Reason = true, fmt.Sprintf("more than %d files", l.MaxFiles)
+		case total+file.Size > l.MaxTotalBytes:
+			file.OnDemand, file.Reason = true, fmt.Sprintf("more than %d bytes in total", l.MaxTotalBytes)
+		default:
+			count++
+			total += file.Size
+		}
+	}
+	return count, total
+}
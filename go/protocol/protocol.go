@@ -0,0 +1,1430 @@
+// Package protocol defines the messages exchanged with Neovim, peers and the
+// central server, and how they are encoded on the wire.
+package protocol
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Message represents the base message structure between Lua and Go. ID is
+// whatever a request from Neovim carried, echoed as is on the response to
+// it; events, which answer nothing, have none.
+type Message struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+	ID   json.RawMessage `json:"id,omitempty"`
+	
+	// The ids of the operations a burst folded in ahead of the one whose id
+	// it carries, which get the same response
+	Folded []json.RawMessage `json:"-"`
+}
+
+// Session Management Messages
+type CreateSessionRequest struct {
+	FilePath         string     `json:"file_path"`
+	Content          string     `json:"content"`
+	ContentEncoding  string     `json:"content_encoding,omitempty"` // "" or "base64"
+	AllowBinary      bool       `json:"allow_binary,omitempty"`     // share binary files as blobs instead of refusing
+	FileEncoding     string     `json:"file_encoding,omitempty"`    // Neovim 'fileencoding', detected when empty
+	ICEPolicy        *ICEPolicy `json:"ice_policy,omitempty"`
+	UseRelay         bool       `json:"use_relay,omitempty"`         // register a room code with the hosted relay
+	Preset           string     `json:"preset,omitempty"`            // "pair" (default) or "broadcast"
+	DurationMinutes  int        `json:"duration_minutes,omitempty"`  // end the session automatically after this long
+	ConflictStrategy string     `json:"conflict_strategy,omitempty"` // how concurrent edits are ordered, "timestamp" by default
+	Root             string     `json:"root,omitempty"`              // project directory; file_path is shared relative to it
+}
+
+type CreateSessionResponse struct {
+	SessionID    string          `json:"session_id"`
+	UserID       string          `json:"user_id"`
+	RelativePath string          `json:"relative_path,omitempty"` // in project sessions
+	Mode         string          `json:"mode"`
+	LineEnding   string          `json:"line_ending"` // original convention of the shared file
+	FileEncoding string          `json:"file_encoding,omitempty"`
+	RoomCode     string          `json:"room_code,omitempty"` // e.g. "blue-otter-42" when hosted on a relay
+	Settings     SessionSettings `json:"settings"`
+}
+
+type JoinSessionRequest struct {
+	SessionID    string     `json:"session_id"` // session ID, relay room code, or invite URI
+	RoomCode     string     `json:"room_code,omitempty"`
+	LineEnding   string     `json:"line_ending,omitempty"`   // joiner's local convention, for mismatch detection
+	FileEncoding string     `json:"file_encoding,omitempty"` // joiner's 'fileencoding', defaults to the session's
+	ICEPolicy    *ICEPolicy `json:"ice_policy,omitempty"`
+	Root         string     `json:"root,omitempty"` // local checkout of a project session
+	Spectate     bool       `json:"spectate,omitempty"` // watch through the central server, off the roster
+}
+
+type JoinSessionResponse struct {
+	UserID             string   `json:"user_id"`
+	FilePath           string   `json:"file_path,omitempty"`     // on this machine, under root in project sessions
+	RelativePath       string   `json:"relative_path,omitempty"` // in project sessions
+	IgnoreRules        []string `json:"ignore_rules,omitempty"`  // the host's, in project sessions
+	Content            string   `json:"content"`
+	ContentEncoding    string   `json:"content_encoding,omitempty"`
+	Mode               string   `json:"mode"`
+	LineEnding         string   `json:"line_ending"`
+	LineEndingMismatch bool     `json:"line_ending_mismatch,omitempty"`
+	FileEncoding       string   `json:"file_encoding,omitempty"`
+	Peers              []Peer   `json:"peers"`
+	
+	// Applied by the joiner's Neovim: in broadcast sessions the buffer is
+	// read-only and the view follows the host
+	Settings SessionSettings `json:"settings"`
+	ReadOnly bool            `json:"read_only,omitempty"`
+	Follow   string          `json:"follow,omitempty"` // user ID to follow
+	
+	Spectators int `json:"spectators,omitempty"` // watching through the central server
+}
+
+// ListSessionsRequest queries session history, e.g. {"hosted": true, "since": "2024-05-01T00:00:00Z"}
+type ListSessionsRequest = SessionQuery
+
+type SessionListResponse struct {
+	Sessions []SessionRecord `json:"sessions"`
+}
+
+// ReplayLogRequest recovers a session's document from its on-disk op log
+type ReplayLogRequest struct {
+	SessionID string `json:"session_id"`
+}
+
+type ReplayLogResponse struct {
+	SessionID       string `json:"session_id"`
+	Content         string `json:"content"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	OpCount         int64  `json:"op_count"`
+}
+
+// ExportAttributionRequest exports every applied operation with its author.
+// Without a path the export is returned inline.
+type ExportAttributionRequest struct {
+	SessionID string `json:"session_id,omitempty"` // defaults to the current session
+	Format    string `json:"format,omitempty"`     // "json" or "csv"; defaults from the path's extension
+	Path      string `json:"path,omitempty"`
+}
+
+type ExportAttributionResponse struct {
+	SessionID string `json:"session_id"`
+	Format    string `json:"format"`
+	Count     int    `json:"count"`
+	Path      string `json:"path,omitempty"`
+	Data      string `json:"data,omitempty"`
+}
+
+// ContributionReportRequest asks for per-user statistics of a session
+type ContributionReportRequest struct {
+	SessionID string `json:"session_id,omitempty"` // defaults to the current session
+}
+
+// ExportSessionStateRequest writes everything needed to resume hosting the
+// current session on another machine
+type ExportSessionStateRequest struct {
+	Path string `json:"path"`
+}
+
+type ExportSessionStateResponse struct {
+	SessionID       string `json:"session_id"`
+	Path            string `json:"path"`
+	DocumentVersion int64  `json:"document_version"`
+	PeerCount       int    `json:"peer_count"`
+}
+
+// ImportSessionStateRequest takes over hosting a session exported elsewhere
+type ImportSessionStateRequest struct {
+	Path         string `json:"path"`
+	FileEncoding string `json:"file_encoding,omitempty"` // local 'fileencoding', defaults to the session's
+	Root         string `json:"root,omitempty"`          // local checkout of a project session
+}
+
+type ImportSessionStateResponse struct {
+	SessionID       string `json:"session_id"`
+	UserID          string `json:"user_id"`
+	PreviousHost    string `json:"previous_host"`
+	FilePath        string `json:"file_path,omitempty"`
+	RelativePath    string `json:"relative_path,omitempty"`
+	Content         string `json:"content"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	Mode            string `json:"mode"`
+	LineEnding      string `json:"line_ending"`
+	FileEncoding    string `json:"file_encoding,omitempty"`
+	RoomCode        string `json:"room_code,omitempty"`
+	Peers           []Peer `json:"peers"`
+}
+
+// SessionCountdownEvent warns that a timed session is about to end
+type SessionCountdownEvent struct {
+	RemainingSeconds int       `json:"remaining_seconds"`
+	EndsAt           time.Time `json:"ends_at"`
+}
+
+// SpectatorCountEvent tells members how many spectators are watching
+type SpectatorCountEvent struct {
+	Count int `json:"count"`
+}
+
+// SessionLinkRequest names the other session of link_session,
+// accept_session_link and unlink_session; unlink_session without one
+// unlinks the host's own
+type SessionLinkRequest struct {
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// SessionLinkOfferedEvent tells a host that another session's host offered
+// to share its document into theirs
+type SessionLinkOfferedEvent struct {
+	SessionID string `json:"session_id"`
+	FilePath  string `json:"file_path"`
+	Host      string `json:"host"`
+}
+
+// SessionLinksEvent lists the sessions sharing the document, the one it
+// came from first; empty once the session is no longer linked. Error says
+// why a link request was refused.
+type SessionLinksEvent struct {
+	Source   string   `json:"source,omitempty"`
+	Sessions []string `json:"sessions"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// SessionExpiredEvent reports that a timed session ended and is now
+// read-only, or that the central server ended an idle one. The host's event
+// also names the files written for it.
+type SessionExpiredEvent struct {
+	SessionID      string    `json:"session_id"`
+	EndsAt         time.Time `json:"ends_at"`
+	PatchPath      string    `json:"patch_path,omitempty"`
+	TranscriptPath string    `json:"transcript_path,omitempty"`
+	Error          string    `json:"error,omitempty"` // why finalizing failed, if it did
+	Reason         string    `json:"reason,omitempty"` // why the server ended it, for sessions that weren't timed
+}
+
+// SessionArchivedEvent reports the archive written on leaving a session
+type SessionArchivedEvent struct {
+	SessionID string `json:"session_id"`
+	Path      string `json:"path,omitempty"`
+	Error     string `json:"error,omitempty"` // why no archive was written
+}
+
+type LeaveSessionRequest struct {
+	SessionID string `json:"session_id"`
+}
+
+// Peer Management
+type Peer struct {
+	UserID       string            `json:"user_id"`
+	Name         string            `json:"name,omitempty"`
+	Email        string            `json:"email,omitempty"`        // verified by the server's identity provider
+	Capabilities *PeerCapabilities `json:"capabilities,omitempty"` // once the peer described its client
+}
+
+// PeerCapabilities is what a peer's client is and can handle
+type PeerCapabilities struct {
+	Client        string `json:"client"`                   // "neovim", or the program embedding the engine
+	ClientVersion string `json:"client_version,omitempty"` // e.g. Neovim's "0.10.2"
+	PluginVersion string `json:"plugin_version,omitempty"` // collab.nvim's
+	Chat          bool   `json:"chat"`
+	MultiFile     bool   `json:"multi_file"`
+}
+
+// PeerCapabilitiesEvent tells Neovim what a peer's client can handle, and
+// which features it lacks
+type PeerCapabilitiesEvent struct {
+	UserID       string           `json:"user_id"`
+	Name         string           `json:"name,omitempty"`
+	Capabilities PeerCapabilities `json:"capabilities"`
+	Missing      []string         `json:"missing,omitempty"` // "chat", "multi_file"
+}
+
+type PeerJoinedEvent struct {
+	Peer Peer `json:"peer"`
+}
+
+type PeerLeftEvent struct {
+	UserID string `json:"user_id"`
+}
+
+// ICEPolicy controls which ICE candidates are gathered and shared with peers,
+// for users who don't want to reveal their network to strangers
+type ICEPolicy struct {
+	DisableHostCandidates bool              `json:"disable_host_candidates,omitempty"` // don't leak LAN addresses
+	RelayOnly             bool              `json:"relay_only,omitempty"`              // only connect through TURN
+	Interfaces            []string          `json:"interfaces,omitempty"`              // only gather on these interfaces
+	TURNServers           []ICEServerConfig `json:"turn_servers,omitempty"`
+	DisableMDNS           bool              `json:"disable_mdns,omitempty"` // publish raw host IPs where mDNS is blocked
+}
+
+type ICEServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Manual signaling: offers and answers are pasted between users by hand
+// when no signaling server is reachable
+type CreateInviteResponse struct {
+	InviteID string `json:"invite_id"`
+	Blob     string `json:"blob"` // compressed offer to send to the joiner
+}
+
+type AcceptInviteRequest struct {
+	Blob string `json:"blob"`
+}
+
+type AcceptInviteResponse struct {
+	SessionID  string `json:"session_id"`
+	HostUserID string `json:"host_user_id"`
+	Blob       string `json:"blob"` // compressed answer to send back to the host
+}
+
+type CompleteInviteRequest struct {
+	Blob string `json:"blob"`
+}
+
+// ShareInviteResponse describes the current session for joining from another
+// device: a URI, a short code registered with the relay, and a scannable QR
+type ShareInviteResponse struct {
+	URI       string   `json:"uri"`                  // collab://join/<session_id>?code=<room_code>
+	ShortCode string   `json:"short_code,omitempty"` // empty when no relay is configured
+	QR        []string `json:"qr"`                   // rows of '1' (dark) and '0' (light) modules
+}
+
+// OpenSSHTunnelRequest asks the host to accept peers through an SSH server
+type OpenSSHTunnelRequest struct {
+	Address string `json:"address"` // [user@]host[:port]
+}
+
+// SSHTunnelOpenedResponse carries the address joiners pass to connect_ssh_tunnel
+type SSHTunnelOpenedResponse struct {
+	URI string `json:"uri"` // ssh://user@host:port?forward=127.0.0.1:<port>
+}
+
+type ConnectSSHTunnelRequest struct {
+	URI       string `json:"uri"`
+	SessionID string `json:"session_id,omitempty"` // the session to join next, when not in one yet
+}
+
+// SessionStateRequest asks the peers of a session for it, on joining
+type SessionStateRequest struct {
+	SessionID string `json:"session_id"`
+	Snapshots bool   `json:"snapshots,omitempty"` // the joiner can download the document on a snapshot channel
+}
+
+// SnapshotOffer names a document the joiner downloads on a snapshot channel
+// instead of receiving it inline
+type SnapshotOffer struct {
+	ID        string `json:"id"`
+	Size      int    `json:"size"`
+	ChunkSize int    `json:"chunk_size"`
+	SHA256    string `json:"sha256"`
+}
+
+// ListProjectFilesRequest lists the files a project offers for sharing. Root
+// defaults to the current project session's.
+type ListProjectFilesRequest struct {
+	Root   string `json:"root,omitempty"`
+	Remote bool   `json:"remote,omitempty"` // list the host's project instead
+}
+
+type ProjectFilesResponse struct {
+	Root        string        `json:"root"`
+	Files       []ProjectFile `json:"files"`
+	IgnoreRules []string      `json:"ignore_rules"` // effective rules, defaults first
+	
+	// Files not on demand, and the limits that decided it
+	Limits       ProjectLimits `json:"limits"`
+	OfferedFiles int           `json:"offered_files"`
+	OfferedBytes int64         `json:"offered_bytes"`
+	
+	Remote bool `json:"remote,omitempty"` // the host's project, without its root
+}
+
+// OpenRemoteFileRequest opens a file of the host's project by its path
+// relative to the root
+type OpenRemoteFileRequest struct {
+	Path string `json:"path"`
+}
+
+type CloseRemoteFileRequest struct {
+	Path string `json:"path"`
+}
+
+// RemoteFileMetadata is how the file is on the host's disk, for setting up
+// the requester's buffer
+type RemoteFileMetadata struct {
+	LineEnding   string `json:"line_ending"`
+	FileEncoding string `json:"file_encoding"`
+	Executable   bool   `json:"executable,omitempty"`
+	Size         int64  `json:"size"`
+}
+
+// RemoteFileOpenedEvent gives a member a file of the host's project, or why
+// it couldn't be opened. Edits to it are document operations with its path
+// as file.
+type RemoteFileOpenedEvent struct {
+	Path            string             `json:"path"`
+	FilePath        string             `json:"file_path,omitempty"` // where it would be under the local root
+	DocumentID      string             `json:"document_id,omitempty"`
+	Content         string             `json:"content,omitempty"`
+	ContentEncoding string             `json:"content_encoding,omitempty"`
+	Metadata        RemoteFileMetadata `json:"metadata"`
+	ReadOnly        bool               `json:"read_only,omitempty"`
+	Error           string             `json:"error,omitempty"`
+}
+
+// RemoteFileSharedEvent tells the host a member opened one of its files,
+// which is now edited together
+type RemoteFileSharedEvent struct {
+	Path     string   `json:"path"`
+	FilePath string   `json:"file_path"`
+	UserID   string   `json:"user_id"`
+	Members  []string `json:"members"`
+}
+
+// Document Operations
+type DocumentOperation struct {
+	Type            string `json:"type"`     // "insert", "delete", "retain", "replace" (blob mode)
+	Position        int    `json:"position"`
+	Content         string `json:"content,omitempty"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	Length          int    `json:"length,omitempty"`
+	UserID          string `json:"user_id"`
+	Breakout        string `json:"breakout,omitempty"`   // set on events for edits made in a breakout
+	File            string `json:"file,omitempty"`       // a remote file's path; the session's document when empty
+	Provenance      string `json:"provenance,omitempty"` // what made the edit, e.g. "formatter"; a person when empty
+}
+
+// DocumentOperations is a burst of operations from one user, applied in
+// order as one step
+type DocumentOperations struct {
+	Operations []DocumentOperation `json:"operations"`
+}
+
+// OperationBatch carries a coalesced burst between peers
+type OperationBatch struct {
+	Operations []Operation `json:"operations"`
+}
+
+// TransactionEdit is one document's operations in a transaction
+type TransactionEdit struct {
+	File       string              `json:"file,omitempty"` // a remote file's path; the session's document when empty
+	Operations []DocumentOperation `json:"operations"`
+}
+
+// TransactionRequest applies edits to several documents, all of them or
+// none
+type TransactionRequest struct {
+	ID    string            `json:"id,omitempty"` // generated when empty
+	Edits []TransactionEdit `json:"edits"`
+}
+
+// TransactionPart carries one document's part of a transaction between
+// peers
+type TransactionPart struct {
+	ID         string      `json:"id"`
+	UserID     string      `json:"user_id"`
+	Files      []string    `json:"files"` // every document in the transaction
+	File       string      `json:"file,omitempty"`
+	Operations []Operation `json:"operations"`
+}
+
+// TransactionEvent tells Neovim a peer's transaction was applied, or
+// dropped and why
+type TransactionEvent struct {
+	ID     string   `json:"id"`
+	UserID string   `json:"user_id"`
+	Name   string   `json:"name"`
+	Files  []string `json:"files"`
+	Reason string   `json:"reason,omitempty"` // "timeout" or "rule_violation"
+}
+
+type ExportDocumentResponse struct {
+	FilePath        string `json:"file_path"`
+	Content         string `json:"content"` // with the original line endings and encoding restored
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	LineEnding      string `json:"line_ending"`
+	FileEncoding    string `json:"file_encoding,omitempty"`
+}
+
+type CursorPosition struct {
+	UserID         string `json:"user_id"`
+	Line           int    `json:"line"`
+	Column         int    `json:"column"`
+	ViewportTop    int    `json:"viewport_top,omitempty"` // first and last visible lines
+	ViewportBottom int    `json:"viewport_bottom,omitempty"`
+	File           string `json:"file,omitempty"` // the shared file it is in; the session's document when empty
+}
+
+// SelectionUpdate is the local visual-mode selection, in the shared file
+// named like a cursor's. A selection with no mode clears it.
+type SelectionUpdate struct {
+	Selection
+	File string `json:"file,omitempty"`
+}
+
+// PresenceDelta lists only the peers whose presence changed since the last
+// presence_changed event
+type PresenceDelta struct {
+	Updated []PresenceState `json:"updated,omitempty"`
+	Removed []string        `json:"removed,omitempty"` // user IDs whose presence should be cleared
+}
+
+// PeerSwitchedFileEvent reports a peer moving their cursor to another
+// shared file
+type PeerSwitchedFileEvent struct {
+	UserID   string `json:"user_id"`
+	Name     string `json:"name"`
+	File     string `json:"file"`     // "" is the session's document
+	Previous string `json:"previous"` // where they were, "" when they just appeared
+}
+
+// PresenceMapEvent lists, for each shared file, where the peers who have
+// been in it last had their cursor there
+type PresenceMapEvent struct {
+	Files []FilePresence `json:"files"`
+}
+
+type FilePresence struct {
+	File    string       `json:"file"`
+	Cursors []PeerCursor `json:"cursors"`
+}
+
+// PeerCursor is a peer's last cursor in a file; focused when the peer is
+// in that file now
+type PeerCursor struct {
+	PresenceState
+	Focused bool `json:"focused"`
+}
+
+// Breakouts: the host forks the document into named groups and later merges
+// their work back
+type CreateBreakoutRequest struct {
+	Name  string   `json:"name"`
+	Peers []string `json:"peers,omitempty"` // user IDs to move in right away
+}
+
+type MoveToBreakoutRequest struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name"` // empty returns the peer to the main session
+}
+
+type MergeBreakoutRequest struct {
+	Name  string `json:"name"`
+	Close bool   `json:"close,omitempty"` // return members to the main session afterwards
+}
+
+type BreakoutInfo struct {
+	Name         string    `json:"name"`
+	BreakoutID   string    `json:"breakout_id"`
+	CreatedAt    time.Time `json:"created_at"`
+	Members      []string  `json:"members"`
+	DocumentSize int       `json:"document_size"`
+}
+
+type BreakoutListResponse struct {
+	Breakouts []BreakoutInfo `json:"breakouts"`
+}
+
+// BreakoutAssignment tells a member which document to edit now; an empty
+// name means the main session
+type BreakoutAssignment struct {
+	Name            string `json:"name,omitempty"`
+	BreakoutID      string `json:"breakout_id,omitempty"`
+	Content         string `json:"content"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+}
+
+type BreakoutMergedResponse struct {
+	Name            string `json:"name"`
+	Operations      int    `json:"operations"` // applied to the main document
+	Closed          bool   `json:"closed"`
+	Content         string `json:"content"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+}
+
+// Control Management
+type ControlRequest struct {
+	RequestedBy string `json:"requested_by"`
+}
+
+// ControlTransfer tells peers who passed control to whom
+type ControlTransfer struct {
+	FromUser string `json:"from_user"`
+	ToUser   string `json:"to_user"`
+}
+
+// ControlRequestedEvent asks whoever hands out control to answer a peer
+type ControlRequestedEvent struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name,omitempty"`
+}
+
+// AnswerControlRequest grants or denies a peer control
+type AnswerControlRequest struct {
+	UserID string `json:"user_id"`
+	Reason string `json:"reason,omitempty"` // deny_control only
+}
+
+// ControllerLeftEvent tells Neovim the peer with control left, and who has
+// it now, "" for nobody
+type ControllerLeftEvent struct {
+	UserID            string `json:"user_id"`
+	Name              string `json:"name,omitempty"`
+	CurrentController string `json:"current_controller"`
+	HasControl        bool   `json:"has_control"`
+}
+
+// ControlDenial tells peers a request for control was refused; the
+// requester's Neovim gets it as control_denied
+type ControlDenial struct {
+	UserID   string `json:"user_id"`
+	DeniedBy string `json:"denied_by"`
+	Name     string `json:"name,omitempty"` // the denier's
+	Reason   string `json:"reason,omitempty"`
+}
+
+type ControlStatus struct {
+	CurrentController string     `json:"current_controller"`
+	HasControl        bool       `json:"has_control"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"` // when temporary control reverts to the host
+}
+
+// LowerHandRequest lowers the local user's hand; the host passes user_id to
+// dismiss someone else's
+type LowerHandRequest struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+type GrantTemporaryControlRequest struct {
+	UserID          string `json:"user_id"`
+	DurationSeconds int    `json:"duration_seconds,omitempty"` // defaults to 5 minutes
+}
+
+// HandsChangedEvent lists raised hands in the order they went up
+type HandsChangedEvent struct {
+	Hands []RaisedHand `json:"hands"`
+}
+
+// RequestCommandRequest asks the host to run a shared command
+type RequestCommandRequest struct {
+	Name string `json:"name"`
+}
+
+// CommandRequestedEvent asks the host's Neovim to approve a peer's request
+type CommandRequestedEvent struct {
+	RequestID string   `json:"request_id"`
+	UserID    string   `json:"user_id"`
+	Name      string   `json:"name"`
+	Command   []string `json:"command"`
+}
+
+type AnswerCommandRequest struct {
+	RequestID string `json:"request_id"`
+	Approved  bool   `json:"approved"`
+	Reason    string `json:"reason,omitempty"` // told to the requester when declining
+}
+
+type CommandDeniedEvent struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// CommandOutputEvent appends to a command's output document. Offset is the
+// byte length of the output before Data.
+type CommandOutputEvent struct {
+	RunID       string `json:"run_id"`
+	Name        string `json:"name"`
+	RequestedBy string `json:"requested_by"`
+	Offset      int    `json:"offset"`
+	Data        string `json:"data"`
+}
+
+// CommandOutputDocument is all a run has written so far, the read-only
+// document command_output events append to
+type CommandOutputDocument struct {
+	RunID       string                `json:"run_id"`
+	Name        string                `json:"name"`
+	RequestedBy string                `json:"requested_by"`
+	Content     string                `json:"content"`
+	Finished    *CommandFinishedEvent `json:"finished,omitempty"` // nil while running
+}
+
+// GetCommandOutputRequest asks for a run's output document, the latest
+// run's when RunID is empty
+type GetCommandOutputRequest struct {
+	RunID string `json:"run_id,omitempty"`
+}
+
+type CommandFinishedEvent struct {
+	RunID       string `json:"run_id"`
+	Name        string `json:"name"`
+	RequestedBy string `json:"requested_by"`
+	ExitCode    int    `json:"exit_code"` // -1 when stopped by a signal
+	Error       string `json:"error,omitempty"`
+	DurationMS  int64  `json:"duration_ms"`
+	OutputBytes int    `json:"output_bytes"`
+	Truncated   bool   `json:"truncated,omitempty"` // output past max_output_bytes wasn't shared
+}
+
+// ConflictHeldEvent asks the user about a remote edit the manual conflict
+// strategy holds, and the local edits it conflicts with. Later remote edits
+// wait behind it.
+type ConflictHeldEvent struct {
+	Remote DocumentOperation   `json:"remote"`
+	Local  []DocumentOperation `json:"local"`
+}
+
+type ResolveConflictRequest struct {
+	Accept bool `json:"accept"` // false reverts the held edit for everyone
+}
+
+// SendChatRequest shares text with the session, or runs it as a command when
+// it starts with "/"
+type SendChatRequest struct {
+	Text string `json:"text"`
+}
+
+// MutePeerRequest names a member, by user ID or name, to mute or unmute
+type MutePeerRequest struct {
+	UserID string `json:"user_id"`
+}
+
+// ChatEvent is a chat message, or with System set a command's reply
+type ChatEvent struct {
+	UserID string    `json:"user_id,omitempty"`
+	Name   string    `json:"name,omitempty"`
+	Text   string    `json:"text"`
+	SentAt time.Time `json:"sent_at"`
+	System bool      `json:"system,omitempty"`
+}
+
+// SlowOperationWarning is sent when handling a message exceeds the configured
+// threshold, with the sizes that usually explain it
+type SlowOperationWarning struct {
+	MessageType     string `json:"message_type"`
+	OperationType   string `json:"operation_type,omitempty"`
+	OperationLength int    `json:"operation_length,omitempty"`
+	DurationMS      int64  `json:"duration_ms"`
+	TransformMS     int64  `json:"transform_ms,omitempty"`
+	ThresholdMS     int64  `json:"threshold_ms"`
+	DocumentSize    int    `json:"document_size"`
+	HistorySize     int    `json:"history_size"`
+	DocumentOps     int    `json:"document_ops"`
+	PendingLocalOps int    `json:"pending_local_ops"`
+}
+
+// SyncProfileEvent is sent when the links to peers get slower or faster
+// enough to change how traffic is paced
+type SyncProfileEvent struct {
+	Profile            string        `json:"profile"` // "fast", "normal", "slow" or "constrained"
+	PresenceIntervalMS int64         `json:"presence_interval_ms"`
+	CompressAbove      int           `json:"compress_above"` // bytes; 0 when not compressing
+	Links              []LinkQuality `json:"links"`
+}
+
+// HelloEvent announces a newly started backend
+type HelloEvent struct {
+	Generation uint64 `json:"generation"`
+}
+
+// KeepaliveMessage is exchanged every few seconds so each side notices when
+// the other restarted or stopped responding
+type KeepaliveMessage struct {
+	Generation     uint64 `json:"generation"`                // the sender's
+	PeerGeneration uint64 `json:"peer_generation,omitempty"` // the last one seen from the other side
+	SessionID      string `json:"session_id,omitempty"`      // the session the sender is in
+}
+
+// ResyncRequiredEvent asks Neovim to join a session again after the backend
+// restarted and couldn't restore it
+type ResyncRequiredEvent struct {
+	SessionID string `json:"session_id"`
+	Reason    string `json:"reason"`
+}
+
+// DiagnoseRequest asks for a check of everything a session depends on
+type DiagnoseRequest struct {
+	SentAt int64 `json:"sent_at,omitempty"` // Unix milliseconds when Neovim sent it, to time stdio
+}
+
+// DiagnosticCheck is the outcome of one check
+type DiagnosticCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // "ok", "warning", "failed" or "skipped"
+	Detail string `json:"detail"`
+}
+
+// DiagnosisEvent reports every check, and the same as text to show as is
+type DiagnosisEvent struct {
+	Checks []DiagnosticCheck `json:"checks"`
+	Report string            `json:"report"`
+}
+
+// ClockProbeMessage asks a peer for its time; the reply carries it along
+// with the sender's time from the probe
+type ClockProbeMessage struct {
+	SentAt int64 `json:"sent_at"`        // Unix nanoseconds on the prober's clock
+	Time   int64 `json:"time,omitempty"` // Unix nanoseconds on the answering peer's clock
+}
+
+// ClockSkewEvent reports that the local clock is off the host's by more or,
+// again, less than the warning threshold. Operations are stamped with the
+// host's time either way.
+type ClockSkewEvent struct {
+	UserID   string `json:"user_id"` // the host
+	Name     string `json:"name"`
+	OffsetMS int64  `json:"offset_ms"` // the host's clock less the local one
+	Skewed   bool   `json:"skewed"`
+}
+
+// StartDemoPeerRequest has the demo peer join the local user's session and
+// follow a script, the built-in one when it is empty
+type StartDemoPeerRequest struct {
+	Script   []DemoStep `json:"script,omitempty"`
+	Repeat   bool       `json:"repeat,omitempty"`
+	TypingMS int        `json:"typing_ms,omitempty"` // per character, 80 when unset
+}
+
+// DemoStep is one thing the demo peer does, after waiting DelayMS (a second
+// when unset, except for "wait")
+type DemoStep struct {
+	Action  string `json:"action"`         // "move", "type", "delete", "chat" or "wait"
+	Line    int    `json:"line,omitempty"` // for "move"; negative is the end
+	Column  int    `json:"column,omitempty"`
+	Text    string `json:"text,omitempty"`   // typed at the cursor, or chatted
+	Length  int    `json:"length,omitempty"` // characters "delete" backspaces over
+	DelayMS int    `json:"delay_ms,omitempty"`
+}
+
+// DesyncDetectedEvent reports that the document diverged from the host's,
+// and where the incident bundle about it was written
+type DesyncDetectedEvent struct {
+	SessionID string `json:"session_id"`
+	HostID    string `json:"host_id"`
+	Version   int64  `json:"version"`
+	Path      string `json:"path,omitempty"`
+	Error     string `json:"error,omitempty"` // why the bundle couldn't be written
+}
+
+// SetTypingPrivacyRequest turns holding back uncommitted edits on or off
+type SetTypingPrivacyRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// CloseProposal asks members to confirm the document the session would
+// close with
+type CloseProposal struct {
+	Round int `json:"round"`
+}
+
+// CloseAckMessage answers a CloseProposal with the member's document
+type CloseAckMessage struct {
+	Round  int            `json:"round"`
+	Digest DocumentDigest `json:"digest"`
+}
+
+// SessionClosingEvent tells Neovim the host is closing the session and
+// local edits are refused, or that the close was given up on
+type SessionClosingEvent struct {
+	SessionID string `json:"session_id"`
+	ClosedBy  string `json:"closed_by"`
+	Name      string `json:"name,omitempty"`
+	Cancelled bool   `json:"cancelled,omitempty"`
+}
+
+// SessionClosedEvent reports the final document a session closed with and
+// which members confirmed it
+type SessionClosedEvent struct {
+	SessionID string   `json:"session_id"`
+	ClosedBy  string   `json:"closed_by"`
+	SHA256    string   `json:"sha256"`
+	Version   int64    `json:"version"`
+	Bytes     int      `json:"bytes"`
+	Unanimous bool     `json:"unanimous"` // every member confirmed the hash
+	Agreed    []string `json:"agreed"`
+	Diverged  []string `json:"diverged"`
+	Missing   []string `json:"missing"` // didn't answer in time
+	Matches   bool     `json:"matches"` // the local document has the final hash
+}
+
+// JoinProgressEvent tells how far a join has got through one of its stages
+type JoinProgressEvent struct {
+	Stage   string `json:"stage"` // "handshake", "snapshot", "replay" or "presence"
+	Percent int    `json:"percent"`
+	Done    int    `json:"done"` // bytes of the snapshot, or operations replayed
+	Total   int    `json:"total"`
+}
+
+// SyncResumedEvent sums up the edits held while sync was paused, sent once
+// they were applied
+type SyncResumedEvent struct {
+	PausedMS   int64          `json:"paused_ms"`
+	Operations int            `json:"operations"`
+	Changes    []PausedChange `json:"changes"`          // by peer, busiest first
+	Reason     string         `json:"reason,omitempty"` // "hold_full" when sync resumed by itself
+}
+
+// PausedChange is what one peer changed while sync was paused
+type PausedChange struct {
+	UserID     string `json:"user_id"`
+	Name       string `json:"name"`
+	Operations int    `json:"operations"`
+	Inserted   int    `json:"inserted"` // bytes
+	Deleted    int    `json:"deleted"`
+}
+
+// BackpressureEvent asks Neovim to hold its messages while the backend
+// catches up, and to send them again once it has
+type BackpressureEvent struct {
+	Paused bool `json:"paused"`
+	Queued int  `json:"queued"` // messages read but not yet handled
+}
+
+// WireFormatRequest switches the messages exchanged with Neovim to another
+// encoding, "json" or "msgpack"
+type WireFormatRequest struct {
+	Format string `json:"format"`
+}
+
+// BusyEvent asks Neovim to hold its edits while document operations queue
+// behind a slow one or a resync
+type BusyEvent struct {
+	Reason string `json:"reason"` // "operation" or "resync"
+	Queued int    `json:"queued"`
+}
+
+// ReadyEvent lets Neovim send its edits again once the queue has drained
+type ReadyEvent struct {
+	Applied int `json:"applied"` // queued operations applied while busy
+}
+
+// MemoryPressureEvent is sent when tracked memory crosses the budget, and
+// again once it has recovered
+type MemoryPressureEvent struct {
+	Level   string      `json:"level"` // "high" or "normal"
+	Budget  int64       `json:"budget"`
+	Usage   MemoryUsage `json:"usage"`
+	Actions []string    `json:"actions,omitempty"` // what was released to recover
+}
+
+const (
+	MemoryPressureHigh   = "high"
+	MemoryPressureNormal = "normal"
+)
+
+// MetricsResponse is the traffic with peers since the backend started, by
+// kind ("ops", "cursor", "chat", "snapshots" or "other") and by peer
+type MetricsResponse struct {
+	Since   time.Time                `json:"since"`
+	Kinds   map[string]TrafficCounts `json:"kinds"`
+	Peers   []PeerTraffic            `json:"peers"`
+	Latency *OperationLatency        `json:"latency,omitempty"`
+	
+	// Peers that reported how far they applied the document
+	Frontiers []PeerFrontier `json:"frontiers,omitempty"`
+}
+
+// PeerFrontier is how many of the local document's operations a peer lacks
+type PeerFrontier struct {
+	UserID     string    `json:"user_id"`
+	Name       string    `json:"name,omitempty"`
+	Behind     int64     `json:"behind"`
+	Lagging    bool      `json:"lagging"`
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+// FrontierMessage tells peers how far the sender applied the document
+type FrontierMessage struct {
+	VectorClock VectorClock `json:"vector_clock"`
+}
+
+// PeerLaggingEvent reports a peer falling frontierLagOps operations behind,
+// or catching up
+type PeerLaggingEvent struct {
+	UserID  string `json:"user_id"`
+	Name    string `json:"name,omitempty"`
+	Behind  int64  `json:"behind"`
+	Lagging bool   `json:"lagging"`
+}
+
+// OperationLatency is how long the latest local edits took to be
+// acknowledged by every peer
+type OperationLatency struct {
+	Samples  int   `json:"samples"`
+	P50MS    int64 `json:"p50_ms"`
+	P90MS    int64 `json:"p90_ms"`
+	P99MS    int64 `json:"p99_ms"`
+	MaxMS    int64 `json:"max_ms"`
+	Pending  int   `json:"pending"` // edits still waiting on a peer
+	BudgetMS int64 `json:"budget_ms"`
+	Degraded bool  `json:"degraded"`
+}
+
+// OperationAckMessage tells the sender of operations that they arrived
+type OperationAckMessage struct {
+	IDs []string `json:"ids"`
+}
+
+// SyncDegradedEvent reports edits taking longer than the budget to reach
+// every peer, or, with Degraded false, that they are back within it
+type SyncDegradedEvent struct {
+	Degraded bool     `json:"degraded"`
+	P90MS    int64    `json:"p90_ms"` // over the last 30 seconds
+	BudgetMS int64    `json:"budget_ms"`
+	Waiting  []string `json:"waiting"` // peers with edits overdue
+}
+
+// ConfigReloadedEvent reports a reload of the config file, by setting name
+type ConfigReloadedEvent struct {
+	Path            string   `json:"path"`
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"` // changed, but in effect only after a restart
+	Error           string   `json:"error,omitempty"`
+}
+
+// SharedDiagnostic is one of Neovim's diagnostics, with vim.diagnostic's
+// 0-based line and byte column and its severity, 1 (error) to 4 (hint)
+type SharedDiagnostic struct {
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity int    `json:"severity"`
+	Source   string `json:"source,omitempty"`
+	Message  string `json:"message"`
+}
+
+// ShareDiagnosticsRequest replaces the local user's shared diagnostics for
+// a file, the session's document when File is empty
+type ShareDiagnosticsRequest struct {
+	File        string             `json:"file,omitempty"` // path relative to the project root
+	Diagnostics []SharedDiagnostic `json:"diagnostics"`
+}
+
+type AddCommentRequest struct {
+	File   string `json:"file,omitempty"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	Text   string `json:"text"`
+}
+
+type RemoveJumpItemRequest struct {
+	ID string `json:"id"`
+}
+
+// JumpToRequest moves everyone's place in the jump list to an item, or by
+// Step items (1 for the next, -1 for the previous)
+type JumpToRequest struct {
+	ID   string `json:"id,omitempty"`
+	Step int    `json:"step,omitempty"`
+}
+
+type SubscribeJumpListRequest struct {
+	Subscribe bool `json:"subscribe"`
+}
+
+// SubscribeRequest turns categories of events to Neovim on or off:
+// "presence", "chat", "metrics" or "activity"
+type SubscribeRequest struct {
+	Categories []string `json:"categories"`
+	Subscribe  bool     `json:"subscribe"`
+}
+
+// SubscriptionsEvent lists the categories of events Neovim receives
+type SubscriptionsEvent struct {
+	Subscribed []string `json:"subscribed"`
+}
+
+// JumpItem is a shared diagnostic, or the same diagnostic from several
+// peers, or a comment
+type JumpItem struct {
+	ID       string   `json:"id"`
+	Kind     string   `json:"kind"` // "diagnostic" or "comment"
+	File     string   `json:"file,omitempty"`
+	Line     int      `json:"line"`
+	Column   int      `json:"column"`
+	Severity int      `json:"severity,omitempty"`
+	Source   string   `json:"source,omitempty"`
+	Message  string   `json:"message"`
+	Users    []string `json:"users"` // who shared it
+	
+	IDs []string `json:"-"` // IDs of the entries merged into it
+}
+
+// JumpListEvent is the session's jump list. MovedBy is set when someone
+// moved the current item, which subscribed Neovims jump to.
+type JumpListEvent struct {
+	Items   []JumpItem `json:"items"`
+	Current string     `json:"current,omitempty"`
+	MovedBy string     `json:"moved_by,omitempty"`
+}
+
+// Breakpoint is a debugger breakpoint on a 0-based line of a file, the
+// session's document when File is empty
+type Breakpoint struct {
+	File         string `json:"file,omitempty"` // path relative to the project root
+	Line         int    `json:"line"`
+	Condition    string `json:"condition,omitempty"`
+	HitCondition string `json:"hit_condition,omitempty"`
+	LogMessage   string `json:"log_message,omitempty"`
+	UserID       string `json:"user_id,omitempty"` // who set it
+}
+
+// SetBreakpointsRequest replaces a file's shared breakpoints
+type SetBreakpointsRequest struct {
+	File        string       `json:"file,omitempty"`
+	Breakpoints []Breakpoint `json:"breakpoints"`
+}
+
+// BreakpointsEvent is every breakpoint in the session, sent whenever one
+// changes
+type BreakpointsEvent struct {
+	Breakpoints []Breakpoint `json:"breakpoints"`
+	ChangedBy   string       `json:"changed_by,omitempty"`
+}
+
+// OperationRules are what the host allows members' edits to do
+type OperationRules struct {
+	MaxInsertBytes int              `json:"max_insert_bytes,omitempty"`
+	Protected      []ProtectedRange `json:"protected"`
+	ReadOnlyFiles  []string         `json:"read_only_files,omitempty"` // .gitignore patterns
+}
+
+// ProtectedRange is lines of the session's document only the host may
+// change, from StartLine up to but not including EndLine, 0-based
+type ProtectedRange struct {
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	Label     string `json:"label,omitempty"`
+}
+
+// RuleViolationEvent tells the host a member's edit broke a rule and was
+// refused
+type RuleViolationEvent struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name,omitempty"`
+	Rule   string `json:"rule"`
+	Detail string `json:"detail"`
+	File   string `json:"file,omitempty"`
+}
+
+// SuggestEditMessage carries edits a peer made without control to the
+// controller, on the sender's UTF-8 document
+type SuggestEditMessage struct {
+	Operations []Operation `json:"operations"`
+}
+
+// SuggestedEdit is one edit of a suggestion at a 0-based line and byte
+// column; Length is the bytes a delete removes
+type SuggestedEdit struct {
+	Type            string `json:"type"` // "insert" or "delete"
+	Line            int    `json:"line"`
+	Column          int    `json:"column"`
+	Content         string `json:"content,omitempty"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	Length          int    `json:"length,omitempty"`
+}
+
+// EditSuggestedEvent shows the controller a peer's suggestion. A suggestion
+// that grows is sent again with the same ID.
+type EditSuggestedEvent struct {
+	ID     string          `json:"id"`
+	UserID string          `json:"user_id"`
+	Name   string          `json:"name"`
+	Edits  []SuggestedEdit `json:"edits"`
+}
+
+type AnswerSuggestionRequest struct {
+	ID string `json:"id"`
+}
+
+// SuggestionAnsweredEvent tells a peer the controller accepted or dismissed
+// their suggestion
+type SuggestionAnsweredEvent struct {
+	ID         string `json:"id"`
+	Accepted   bool   `json:"accepted"`
+	Edits      int    `json:"edits"`
+	AnsweredBy string `json:"answered_by,omitempty"`
+}
+
+type ForkDocumentRequest struct {
+	Name string `json:"name,omitempty"` // defaults to the fork's ID
+}
+
+// DocumentForkedResponse is a private copy of the document for a local-only
+// buffer, with where it came from and who wrote the text it starts from
+type DocumentForkedResponse struct {
+	ForkID          string       `json:"fork_id"`
+	Name            string       `json:"name"`
+	SessionID       string       `json:"session_id"`
+	FilePath        string       `json:"file_path"`
+	Content         string       `json:"content"`
+	ContentEncoding string       `json:"content_encoding,omitempty"`
+	Version         int64        `json:"version"`
+	ForkedAt        time.Time    `json:"forked_at"`
+	ForkedBy        string       `json:"forked_by"`
+	Authors         []ForkAuthor `json:"authors"`
+}
+
+// ForkAuthor is someone who edited the document before it was forked
+type ForkAuthor struct {
+	UserID        string    `json:"user_id"`
+	Name          string    `json:"name"`
+	CharsInserted int       `json:"chars_inserted"`
+	LastEditAt    time.Time `json:"last_edit_at"`
+}
+
+// ProposeForkRequest sends a fork's buffer back as a suggestion
+type ProposeForkRequest struct {
+	ForkID          string `json:"fork_id"`
+	Content         string `json:"content"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	Close           bool   `json:"close,omitempty"` // drop the fork once proposed
+}
+
+type DiscardForkRequest struct {
+	ForkID string `json:"fork_id"`
+}
+
+// ExtensionMessage carries another plugin's payload. From is set on receipt;
+// To lists user IDs and is empty to send to everyone.
+type ExtensionMessage struct {
+	Namespace string          `json:"namespace"`
+	To        []string        `json:"to,omitempty"`
+	From      string          `json:"from,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Identity
+type LoginPendingResponse struct {
+	UserCode                string    `json:"user_code"`
+	VerificationURI         string    `json:"verification_uri"`
+	VerificationURIComplete string    `json:"verification_uri_complete,omitempty"`
+	ExpiresAt               time.Time `json:"expires_at"`
+}
+
+// System Messages
+type ErrorMessage struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type StatusMessage struct {
+	Status string `json:"status"`
+	Info   string `json:"info,omitempty"`
+}
+
+// Message type constants
+const (
+	// Session messages
+	MsgCreateSession        = "create_session"
+	MsgJoinSession          = "join_session"
+	MsgLeaveSession         = "leave_session"
+	MsgSessionCreated       = "session_created"
+	MsgSessionJoined        = "session_joined"
+	MsgJoinProgress         = "join_progress"
+	MsgSessionLeft          = "session_left"
+	MsgListSessions         = "list_sessions"
+	MsgSessionList          = "session_list"
+	MsgReplayLog            = "replay_log"
+	MsgLogReplayed          = "log_replayed"
+	MsgCreateInvite         = "create_invite"
+	MsgInviteCreated        = "invite_created"
+	MsgAcceptInvite         = "accept_invite"
+	MsgInviteAccepted       = "invite_accepted"
+	MsgCompleteInvite       = "complete_invite"
+	MsgShareInvite          = "share_invite"
+	MsgInviteShared         = "invite_shared"
+	MsgOpenSSHTunnel        = "open_ssh_tunnel"
+	MsgSSHTunnelOpened      = "ssh_tunnel_opened"
+	MsgConnectSSHTunnel     = "connect_ssh_tunnel"
+	MsgExportSessionState   = "export_session_state"
+	MsgSessionStateExported = "session_state_exported"
+	MsgImportSessionState   = "import_session_state"
+	MsgSessionStateImported = "session_state_imported"
+	MsgSessionCountdown     = "session_countdown"
+	MsgSessionExpired       = "session_expired"
+	MsgSessionArchived      = "session_archived"
+	MsgSpectatorCount       = "spectator_count"
+	MsgListProjectFiles     = "list_project_files"
+	MsgProjectFiles         = "project_files"
+	MsgOpenRemoteFile       = "open_remote_file"
+	MsgRemoteFileOpened     = "remote_file_opened"
+	MsgCloseRemoteFile      = "close_remote_file"
+	MsgRemoteFileShared     = "remote_file_shared"
+	MsgLinkSession          = "link_session"
+	MsgAcceptSessionLink    = "accept_session_link"
+	MsgUnlinkSession        = "unlink_session"
+	MsgSessionLinkOffered   = "session_link_offered"
+	MsgSessionLinks         = "session_links"
+	
+	// Peer messages
+	MsgPeerJoined        = "peer_joined"
+	MsgPeerLeft          = "peer_left"
+	MsgPeerCapabilities  = "peer_capabilities"
+	MsgClientInfo        = "client_info"
+	
+	// Document messages
+	MsgDocumentOperation   = "document_operation"
+	MsgDocumentOperations  = "document_operations"
+	MsgCursorMove          = "cursor_move"
+	MsgPresenceChanged     = "presence_changed"
+	MsgSelectionUpdate     = "selection_update"
+	MsgPeerSwitchedFile    = "peer_switched_file"
+	MsgGetPresenceMap      = "get_presence_map"
+	MsgPresenceMap         = "presence_map"
+	MsgPauseSync           = "pause_sync"
+	MsgResumeSync          = "resume_sync"
+	MsgSyncResumed         = "sync_resumed"
+	MsgDocumentDigest      = "document_digest"
+	MsgDesyncDetected      = "desync_detected"
+	MsgCloseSession        = "close_session"
+	MsgSetTypingPrivacy    = "set_typing_privacy"
+	MsgCloseProposed       = "close_proposed"
+	MsgCloseAck            = "close_ack"
+	MsgSessionClosing      = "session_closing"
+	MsgSessionClosed       = "session_closed"
+	MsgStartDemoPeer       = "start_demo_peer"
+	MsgStopDemoPeer        = "stop_demo_peer"
+	MsgExportDocument      = "export_document"
+	MsgDocumentExported    = "document_exported"
+	MsgDocumentWritten     = "document_written"
+	MsgExportAttribution   = "export_attribution"
+	MsgAttributionExported = "attribution_exported"
+	MsgContributionReport  = "contribution_report"
+	MsgCreateBreakout      = "create_breakout"
+	MsgMoveToBreakout      = "move_to_breakout"
+	MsgListBreakouts       = "list_breakouts"
+	MsgBreakoutList        = "breakout_list"
+	MsgBreakoutAssigned    = "breakout_assigned"
+	MsgMergeBreakout       = "merge_breakout"
+	MsgBreakoutMerged      = "breakout_merged"
+	MsgShareDiagnostics    = "share_diagnostics"
+	MsgAddComment          = "add_comment"
+	MsgRemoveJumpItem      = "remove_jump_item"
+	MsgJumpTo              = "jump_to"
+	MsgGetJumpList         = "get_jump_list"
+	MsgSubscribeJumpList   = "subscribe_jump_list"
+	MsgJumpList            = "jump_list"
+	MsgSetBreakpoints      = "set_breakpoints"
+	MsgGetBreakpoints      = "get_breakpoints"
+	MsgBreakpoints         = "breakpoints"
+	MsgSetOperationRules   = "set_operation_rules"
+	MsgGetOperationRules   = "get_operation_rules"
+	MsgOperationRules      = "operation_rules"
+	MsgRuleViolation       = "rule_violation"
+	MsgApplyTransaction    = "apply_transaction"
+	MsgTransactionPart     = "transaction_part"
+	MsgTransactionApplied  = "transaction_applied"
+	MsgTransactionDropped  = "transaction_dropped"
+	
+	// Control messages
+	MsgRequestControl        = "request_control"
+	MsgGrantControl          = "grant_control"
+	MsgDenyControl           = "deny_control"
+	MsgControlRequested      = "control_requested"
+	MsgControlDenied         = "control_denied"
+	MsgControllerLeft        = "controller_left"
+	MsgReleaseControl        = "release_control"
+	MsgControlStatus         = "control_status"
+	MsgRaiseHand             = "raise_hand"
+	MsgLowerHand             = "lower_hand"
+	MsgHandsChanged          = "hands_changed"
+	MsgGrantTemporaryControl = "grant_temporary_control"
+	MsgSuggestEdit           = "suggest_edit"
+	MsgEditSuggested         = "edit_suggested"
+	MsgAcceptSuggestion      = "accept_suggestion"
+	MsgDismissSuggestion     = "dismiss_suggestion"
+	MsgSuggestionAnswered    = "suggestion_answered"
+	MsgForkDocument          = "fork_document"
+	MsgDocumentForked        = "document_forked"
+	MsgProposeFork           = "propose_fork"
+	MsgDiscardFork           = "discard_fork"
+	
+	// Conflict messages
+	MsgConflictHeld    = "conflict_held"
+	MsgResolveConflict = "resolve_conflict"
+	
+	// Shared command messages
+	MsgRequestCommand        = "request_command"
+	MsgCommandRequested      = "command_requested"
+	MsgAnswerCommand         = "answer_command"
+	MsgCommandDenied         = "command_denied"
+	MsgCommandOutput         = "command_output"
+	MsgCommandFinished       = "command_finished"
+	MsgGetCommandOutput      = "get_command_output"
+	MsgCommandOutputDocument = "command_output_document"
+	
+	// Chat messages
+	MsgSendChat   = "send_chat"
+	MsgChat       = "chat"
+	MsgMutePeer   = "mute_peer"
+	MsgUnmutePeer = "unmute_peer"
+	
+	// Identity messages
+	MsgLogin        = "login"
+	MsgLoginPending = "login_pending"
+	MsgLoggedIn     = "logged_in"
+	MsgLogout       = "logout"
+	
+	// System messages
+	MsgError             = "error"
+	MsgStatus            = "status"
+	MsgHealthCheck       = "health_check"
+	MsgSlowOperation     = "slow_operation"
+	MsgMemoryPressure    = "memory_pressure"
+	MsgSyncProfile       = "sync_profile"
+	MsgExtension         = "extension"
+	MsgBackpressure      = "backpressure"
+	MsgHello             = "hello"
+	MsgKeepalive         = "keepalive"
+	MsgResyncRequired    = "resync_required"
+	MsgBusy              = "busy"
+	MsgReady             = "ready"
+	MsgGetMetrics        = "get_metrics"
+	MsgMetrics           = "metrics"
+	MsgDiagnose          = "diagnose"
+	MsgDiagnosis         = "diagnosis"
+	MsgClockProbe        = "clock_probe"
+	MsgClockReply        = "clock_reply"
+	MsgClockSkew         = "clock_skew"
+	MsgBandwidthWarning  = "bandwidth_warning"
+	MsgReloadConfig      = "reload_config"
+	MsgConfigReloaded    = "config_reloaded"
+	MsgDaemonAttached    = "daemon_attached"
+	MsgWireFormat        = "wire_format"
+	MsgSubscribe         = "subscribe"
+	MsgSubscriptions     = "subscriptions"
+	MsgOperationAck      = "operation_ack"
+	MsgSyncDegraded      = "sync_degraded"
+	MsgRequestSessionState = "request_session_state"
+	MsgSessionState        = "session_state"
+	MsgFrontier            = "frontier"
+	MsgPeerLagging         = "peer_lagging"
+)
+
+// Helper functions for message creation and parsing
+func NewMessage(msgType string, data interface{}) (*Message, error) {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	
+	return &Message{
+		Type: msgType,
+		Data: dataBytes,
+	}, nil
+}
+
+func (m *Message) ParseData(target interface{}) error {
+	return json.Unmarshal(m.Data, target)
+}
+
+func (m *Message) ToJSON() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func ParseMessage(data []byte) (*Message, error) {
+	var msg Message
+	err := json.Unmarshal(data, &msg)
+	return &msg, err
+}
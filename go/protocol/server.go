@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AccessTokenHeader carries the token on HTTP requests to the relay and the
+// signaling server
+const AccessTokenHeader = "X-Collab-Access-Token"
+
+// In server mode every message goes through a `collab serve` instance instead
+// of directly to peers. The connection uses the SSH tunnel framing: a hello,
+// the server's welcome, then envelopes in both directions.
+const (
+	ServerHandshakeTimeout = 15 * time.Second
+	
+	// Who the server's own events and operations are from
+	ServerUserID = "server"
+)
+
+// ServerHello opens a connection, creating the session when Create is set
+type ServerHello struct {
+	UserID      string             `json:"user_id"`
+	Name        string             `json:"name,omitempty"`
+	SessionID   string             `json:"session_id"`
+	IDToken     string             `json:"id_token,omitempty"`     // required when the server has an identity provider
+	AccessToken string             `json:"access_token,omitempty"` // required when the server has access tokens
+	Create      *ServerSessionSpec `json:"create,omitempty"`
+	Spectator   bool               `json:"spectator,omitempty"` // watch only, without joining the roster
+}
+
+// ServerSessionSpec describes a new session, as the host created it locally
+type ServerSessionSpec struct {
+	FilePath   string          `json:"file_path"`
+	Project    bool            `json:"project,omitempty"`
+	Ignore     []string        `json:"ignore_rules,omitempty"`
+	Content    string          `json:"content"`
+	Mode       string          `json:"mode"`
+	LineEnding string          `json:"line_ending"`
+	Charset    string          `json:"file_encoding"`
+	Settings   SessionSettings `json:"settings"`
+}
+
+// ServerWelcome answers a hello with the session as the server has it
+type ServerWelcome struct {
+	Error string `json:"error,omitempty"`
+	
+	SessionID   string            `json:"session_id"`
+	CreatedBy   string            `json:"created_by"`
+	CreatedAt   time.Time         `json:"created_at"`
+	Controller  string            `json:"controller"`
+	Spec        ServerSessionSpec `json:"spec"`
+	Version     int64             `json:"version"`
+	VectorClock VectorClock       `json:"vector_clock"`
+	Peers       []Peer            `json:"peers"`
+	Spectators  int               `json:"spectators,omitempty"`
+	
+	// Set in place of Spec.Content when a peer sends the document on a
+	// snapshot channel
+	Snapshot *SnapshotOffer `json:"snapshot,omitempty"`
+}
+
+// ServerEnvelope carries one message. From is set by the server and empty
+// for the server's own events; To is empty for broadcasts.
+type ServerEnvelope struct {
+	From string          `json:"from,omitempty"`
+	To   string          `json:"to,omitempty"`
+	Data json.RawMessage `json:"data"`
+}
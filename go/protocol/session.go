@@ -0,0 +1,52 @@
+package protocol
+
+import "time"
+
+// SessionState is the on-disk format of an exported session
+type SessionState struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	ExportedBy string    `json:"exported_by"` // host user ID at export time
+	
+	SessionID  string          `json:"session_id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	FilePath   string          `json:"file_path"`
+	Project    bool            `json:"project,omitempty"`
+	Ignore     []string        `json:"ignore_rules,omitempty"`
+	Mode       string          `json:"mode"`
+	LineEnding string          `json:"line_ending"`
+	Charset    string          `json:"file_encoding"`
+	RoomCode   string          `json:"room_code,omitempty"`
+	Controller string          `json:"controller"`
+	Settings   SessionSettings `json:"settings"`
+	Peers      []Peer          `json:"peers"`
+	
+	// Document and the history frontier it corresponds to
+	Content         string      `json:"content"`
+	ContentEncoding string      `json:"content_encoding,omitempty"`
+	DocumentVersion int64       `json:"document_version"`
+	VectorClock     VectorClock `json:"vector_clock"`
+	
+	ICEPolicy ICEPolicy `json:"ice_policy"`
+}
+
+// RaisedHand is one peer waiting to be called on
+type RaisedHand struct {
+	UserID   string    `json:"user_id"`
+	RaisedAt time.Time `json:"raised_at"`
+}
+
+// SessionSettings are chosen by the host when creating a session and sent to
+// joiners, whose Neovim applies them
+type SessionSettings struct {
+	Preset          string `json:"preset"`
+	ReadOnlyJoiners bool   `json:"read_only_joiners,omitempty"` // only the host (or whoever it grants control) edits
+	FollowHost      bool   `json:"follow_host,omitempty"`       // joiners' views track the host's cursor
+	MaxPeers        int    `json:"max_peers"`
+	
+	// When a timed session ends; it turns read-only for everyone then
+	EndsAt *time.Time `json:"ends_at,omitempty"`
+	
+	// How concurrent edits are ordered, see sync/conflict.go; "" is timestamp
+	ConflictStrategy string `json:"conflict_strategy,omitempty"`
+}
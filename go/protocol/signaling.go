@@ -0,0 +1,35 @@
+package protocol
+
+import "github.com/pion/webrtc/v3"
+
+// Signaling message types
+const (
+	SignalJoin       = "join"        // client: join the room of SessionID
+	SignalPeers      = "peers"       // server: who was in the room on joining
+	SignalPeerJoined = "peer_joined" // server: From joined the room
+	SignalPeerLeft   = "peer_left"   // server: From left the room
+	SignalOffer      = "offer"
+	SignalAnswer     = "answer"
+	SignalCandidate  = "candidate"
+	SignalError      = "error"
+)
+
+// SignalMessage is what a signaling connection carries in both directions.
+// From is set by the server; To addresses offers, answers and candidates.
+type SignalMessage struct {
+	Type      string                   `json:"type"`
+	SessionID string                   `json:"session_id,omitempty"`
+	UserID    string                   `json:"user_id,omitempty"` // on join
+	From      string                   `json:"from,omitempty"`
+	To        string                   `json:"to,omitempty"`
+	Peers     []string                 `json:"peers,omitempty"`
+	SDP       string                   `json:"sdp,omitempty"`
+	Candidate *webrtc.ICECandidateInit `json:"candidate,omitempty"`
+	Error     string                   `json:"error,omitempty"`
+	
+	// Round trips to the TURN servers in ms, sent on join and passed on to
+	// newcomers by peer, and the relay an offer chose for both sides
+	RelayRTTs  map[string]int64            `json:"relay_rtts,omitempty"`
+	PeerRelays map[string]map[string]int64 `json:"peer_relays,omitempty"`
+	Relay      string                      `json:"relay,omitempty"`
+}
@@ -0,0 +1,52 @@
+package protocol
+
+// TrafficCounts are the bytes and messages of one kind of traffic
+type TrafficCounts struct {
+	SentBytes        int64 `json:"sent_bytes"`
+	ReceivedBytes    int64 `json:"received_bytes"`
+	SentMessages     int64 `json:"sent_messages"`
+	ReceivedMessages int64 `json:"received_messages"`
+}
+
+func (tc *TrafficCounts) Add(sent bool, bytes int) {
+	if sent {
+		tc.SentBytes += int64(bytes)
+		tc.SentMessages++
+	} else {
+		tc.ReceivedBytes += int64(bytes)
+		tc.ReceivedMessages++
+	}
+}
+
+// PeerTraffic is the traffic with one peer, by kind
+type PeerTraffic struct {
+	UserID string                   `json:"user_id"`
+	Kinds  map[string]TrafficCounts `json:"kinds"`
+}
+
+// DocumentDigest describes a document's state without its content
+type DocumentDigest struct {
+	Version     int64       `json:"version"`
+	VectorClock VectorClock `json:"vector_clock"`
+	SHA256      string      `json:"sha256"`
+	Bytes       int         `json:"bytes"`
+}
+
+// LinkQuality is one peer's measurements as reported to Neovim
+type LinkQuality struct {
+	UserID        string `json:"user_id"`
+	RTTMS         int64  `json:"rtt_ms"`
+	BandwidthKbps int64  `json:"bandwidth_kbps,omitempty"` // 0 when not measured yet
+	Profile       string `json:"profile"`
+}
+
+// MemoryUsage is the estimated memory held per subsystem, in bytes
+type MemoryUsage struct {
+	Document   int64 `json:"document"`
+	Operations int64 `json:"operations"`
+	History    int64 `json:"history"`
+	Buffers    int64 `json:"buffers"`
+	Network    int64 `json:"network"`
+	Total      int64 `json:"total"`
+	Heap       int64 `json:"heap"` // from the Go runtime, for comparison
+}
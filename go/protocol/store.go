@@ -0,0 +1,53 @@
+package protocol
+
+import "time"
+
+// Roster events
+const (
+	RosterJoined = "joined"
+	RosterLeft   = "left"
+)
+
+// SessionQuery filters stored sessions; zero fields match everything. User IDs
+// change every run, so Hosted is how to find sessions started on this machine.
+type SessionQuery struct {
+	Hosted    bool      `json:"hosted,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	Since     time.Time `json:"since,omitempty"`
+	Until     time.Time `json:"until,omitempty"`
+	Limit     int       `json:"limit,omitempty"`
+}
+
+// ChatRecord is a chat message kept in the store
+type ChatRecord struct {
+	UserID string    `json:"user_id"`
+	Text   string    `json:"text"`
+	At     time.Time `json:"at"`
+}
+
+// SessionRecord summarizes a stored session
+type SessionRecord struct {
+	ID        string     `json:"id"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	FilePath  string     `json:"file_path"`
+	RoomCode  string     `json:"room_code,omitempty"`
+	Hosted    bool       `json:"hosted"`
+}
+
+func (q SessionQuery) Matches(record SessionRecord) bool {
+	if q.Hosted && !record.Hosted {
+		return false
+	}
+	if q.CreatedBy != "" && record.CreatedBy != q.CreatedBy {
+		return false
+	}
+	if !q.Since.IsZero() && record.CreatedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !record.CreatedAt.Before(q.Until) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+package protocol
+
+type OperationType string
+
+const (
+	OpInsert OperationType = "insert"
+	OpDelete OperationType = "delete"
+	OpRetain OperationType = "retain"
+	OpReplace OperationType = "replace" // whole-document replacement, blob mode only
+)
+
+type Operation struct {
+	Type      OperationType `json:"type"`
+	Position  int           `json:"position"`
+	Content   string        `json:"content"`
+	Length    int           `json:"length"`
+	UserID    string        `json:"user_id"`
+	Timestamp int64         `json:"timestamp"`
+	ID        string        `json:"id"`
+	VectorClock VectorClock `json:"vector_clock"`
+	
+	// Provenance names what made the edit, such as "formatter" or
+	// "lsp-rename", as the submitting client tagged it
+	Provenance string `json:"provenance,omitempty"`
+}
+
+type VectorClock map[string]int64
+
+func (vc VectorClock) Copy() VectorClock {
+	copy := make(VectorClock)
+	for k, v := range vc {
+		copy[k] = v
+	}
+	return copy
+}
+
+func (vc VectorClock) Increment(userID string) {
+	vc[userID]++
+}
+
+func (vc VectorClock) Update(other VectorClock) {
+	for userID, timestamp := range other {
+		if vc[userID] < timestamp {
+			vc[userID] = timestamp
+		}
+	}
+}
+
+func (vc VectorClock) HappensBefore(other VectorClock) bool {
+	hasSmaller := false
+	for userID, timestamp := range vc {
+		otherTimestamp, exists := other[userID]
+		if !exists {
+			otherTimestamp = 0
+		}
+		if timestamp > otherTimestamp {
+			return false
+		}
+		if timestamp < otherTimestamp {
+			hasSmaller = true
+		}
+	}
+	
+	for userID, otherTimestamp := range other {
+		timestamp, exists := vc[userID]
+		if !exists {
+			timestamp = 0
+		}
+		if timestamp > otherTimestamp {
+			return false
+		}
+		if timestamp < otherTimestamp {
+			hasSmaller = true
+		}
+	}
+	
+	return hasSmaller
+}
+
+func (vc VectorClock) IsConcurrent(other VectorClock) bool {
+	return !vc.HappensBefore(other) && !other.HappensBefore(vc) && !vc.Equals(other)
+}
+
+func (vc VectorClock) Equals(other VectorClock) bool {
+	if len(vc) != len(other) {
+		// Check if missing entries are all zero
+		allUsers := make(map[string]bool)
+		for userID := range vc {
+			allUsers[userID] = true
+		}
+		for userID := range other {
+			allUsers[userID] = true
+		}
+		
+		for userID := range allUsers {
+			vcTime, vcExists := vc[userID]
+			otherTime, otherExists := other[userID]
+			
+			if !vcExists {
+				vcTime = 0
+			}
+			if !otherExists {
+				otherTime = 0
+			}
+			
+			if vcTime != otherTime {
+				return false
+			}
+		}
+		return true
+	}
+	
+	for userID, timestamp := range vc {
+		if other[userID] != timestamp {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,229 @@
+package collab
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/p2p"
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Room codes are short, speakable aliases for session IDs registered with a
+// hosted relay, so collaborators join with "blue-otter-42" instead of a hash.
+var (
+	roomCodeAdjectives = []string{
+		"amber", "bold", "blue", "brave", "calm", "clever", "coral", "crisp",
+		"eager", "fancy", "gentle", "golden", "green", "happy", "jolly", "keen",
+		"lucky", "mellow", "misty", "noble", "quiet", "rapid", "red", "rosy",
+		"shiny", "silver", "sunny", "swift", "tidy", "violet", "warm", "witty",
+	}
+	roomCodeAnimals = []string{
+		"badger", "beaver", "bison", "crane", "dingo", "eagle", "falcon", "ferret",
+		"gecko", "heron", "ibex", "koala", "lemur", "lynx", "marten", "moose",
+		"newt", "ocelot", "otter", "panda", "puffin", "quokka", "raven", "robin",
+		"salmon", "seal", "sloth", "tapir", "tiger", "walrus", "wombat", "yak",
+	}
+	
+	roomCodePattern = regexp.MustCompile(`^[a-z]+-[a-z]+-[0-9]{2}$`)
+)
+
+const (
+	relayRequestTimeout = 10 * time.Second
+	maxRoomCodeAttempts = 5
+)
+
+// generateRoomCode returns a random code such as "blue-otter-42"
+func generateRoomCode() string {
+	pick := func(n int) int {
+		value, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+		if err != nil {
+			return 0
+		}
+		return int(value.Int64())
+	}
+	
+	return fmt.Sprintf("%s-%s-%02d",
+		roomCodeAdjectives[pick(len(roomCodeAdjectives))],
+		roomCodeAnimals[pick(len(roomCodeAnimals))],
+		pick(100),
+	)
+}
+
+// isRoomCode reports whether s looks like a room code rather than a session ID
+func isRoomCode(s string) bool {
+	return roomCodePattern.MatchString(strings.ToLower(strings.TrimSpace(s)))
+}
+
+type roomRegistration struct {
+	Code      string `json:"code"`
+	SessionID string `json:"session_id"`
+}
+
+// RelayClient talks to a hosted relay's room registry
+type RelayClient struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	
+	// Returns the signed-in user's ID token, sent as a bearer token so the
+	// relay knows who registers and resolves rooms; nil when not configured
+	idToken func() string
+	
+	// Sent so a relay that requires access tokens lets requests through
+	accessToken string
+}
+
+func NewRelayClient(relayURL string, dialer p2p.ContextDialer, pins p2p.TLSPins) (*RelayClient, error) {
+	base, err := url.Parse(strings.TrimRight(relayURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay URL: %v", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("relay URL must be http or https, got %s", base.Scheme)
+	}
+	
+	return &RelayClient{
+		baseURL:    base,
+		httpClient: newPinnedHTTPClient(dialer, pins, relayRequestTimeout),
+	}, nil
+}
+
+// newPinnedHTTPClient returns an HTTP client that connects through dialer and
+// checks pins for TLS
+func newPinnedHTTPClient(dialer p2p.ContextDialer, pins p2p.TLSPins, timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // proxying is handled by the dialer
+	transport.DialContext = dialer.DialContext
+	transport.DialTLSContext = p2p.NewPinnedTLSDialer(dialer, pins).DialTLSContext
+	
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+}
+
+// SetIDTokenSource makes requests carry the signed-in user's ID token
+func (rc *RelayClient) SetIDTokenSource(idToken func() string) {
+	rc.idToken = idToken
+}
+
+// SetAccessToken makes requests carry token, for relays that require one
+func (rc *RelayClient) SetAccessToken(token string) {
+	rc.accessToken = token
+}
+
+// do sends a request to the relay, authenticated when signed in
+func (rc *RelayClient) do(method, endpoint string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if rc.idToken != nil {
+		if token := rc.idToken(); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	if rc.accessToken != "" {
+		req.Header.Set(protocol.AccessTokenHeader, rc.accessToken)
+	}
+	return rc.httpClient.Do(req)
+}
+
+// RegisterRoom reserves a fresh room code for a session, retrying on collisions
+func (rc *RelayClient) RegisterRoom(sessionID string) (string, error) {
+	for attempt := 0; attempt < maxRoomCodeAttempts; attempt++ {
+		code := generateRoomCode()
+		body, _ := json.Marshal(roomRegistration{Code: code, SessionID: sessionID})
+		
+		resp, err := rc.do(http.MethodPost, rc.endpoint("rooms"), bytes.NewReader(body))
+		if err != nil {
+			return "", fmt.Errorf("failed to reach relay: %v", err)
+		}
+		resp.Body.Close()
+		
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated:
+			return code, nil
+		case http.StatusConflict:
+			continue // Code taken, try another
+		default:
+			return "", fmt.Errorf("relay rejected room registration: %s", resp.Status)
+		}
+	}
+	
+	return "", fmt.Errorf("could not find a free room code after %d attempts", maxRoomCodeAttempts)
+}
+
+// ResolveRoom looks up the session ID behind a room code
+func (rc *RelayClient) ResolveRoom(code string) (string, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	resp, err := rc.do(http.MethodGet, rc.endpoint("rooms", code), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach relay: %v", err)
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("no session found for room %s", code)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("relay failed to resolve room %s: %s", code, resp.Status)
+	}
+	
+	var registration roomRegistration
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&registration); err != nil {
+		return "", fmt.Errorf("invalid relay response: %v", err)
+	}
+	if registration.SessionID == "" {
+		return "", fmt.Errorf("relay returned no session for room %s", code)
+	}
+	
+	return registration.SessionID, nil
+}
+
+// ReleaseRoom frees a room code once its session ends
+func (rc *RelayClient) ReleaseRoom(code string) error {
+	resp, err := rc.do(http.MethodDelete, rc.endpoint("rooms", code), nil)
+	if err != nil {
+		return fmt.Errorf("failed to reach relay: %v", err)
+	}
+	resp.Body.Close()
+	
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("relay failed to release room %s: %s", code, resp.Status)
+	}
+	return nil
+}
+
+// Ping checks that the relay answers HTTP requests at all
+func (rc *RelayClient) Ping() error {
+	resp, err := rc.do(http.MethodGet, rc.endpoint(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to reach relay: %v", err)
+	}
+	resp.Body.Close()
+	
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("relay answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (rc *RelayClient) endpoint(parts ...string) string {
+	u := *rc.baseURL
+	for _, part := range parts {
+		u.Path += "/" + url.PathEscape(part)
+	}
+	return u.String()
+}
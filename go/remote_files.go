@@ -0,0 +1,547 @@
+package collab
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/EmreDay1/collab.nvim/go/p2p"
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// In a project session members can browse the host's project and open any
+// of its files, including ones the project limits leave on demand, without
+// having them locally. The host reads the file from disk and shares it as a
+// document of its own, much like a breakout fork: the host keeps every file
+// opened this way, members the ones they opened, and edits travel on a
+// session channel labeled with the file's document ID, relayed by the host.
+// The host's Neovim is told the file is shared so it can edit it too; the
+// requester's gets the content and what it needs to set the buffer up. Like
+// breakouts, this needs direct connections.
+const maxRemoteFileBytes = 16 << 20
+
+// RemoteFile is a project file shared on demand
+type RemoteFile struct {
+	ID       string // document ID, the label of its session channel
+	Path     string // relative to the project root
+	Metadata protocol.RemoteFileMetadata
+	Members  map[string]bool // user IDs that opened it, on the host
+	sync     *collabsync.SyncManager
+}
+
+func remoteFileID(sessionID, rel string) string {
+	return sessionID + "/file/" + rel
+}
+
+func newRemoteFile(id, rel, userID, content string, metadata protocol.RemoteFileMetadata) *RemoteFile {
+	sm := collabsync.NewSyncManager()
+	sm.SetUserID(userID)
+	sm.InitializeDocument(content)
+	
+	return &RemoteFile{
+		ID:       id,
+		Path:     rel,
+		Metadata: metadata,
+		Members:  make(map[string]bool),
+		sync:     sm,
+	}
+}
+
+// RemoteFileManager tracks the files shared on demand, by path
+type RemoteFileManager struct {
+	files map[string]*RemoteFile
+	mutex sync.Mutex
+}
+
+func NewRemoteFileManager() *RemoteFileManager {
+	return &RemoteFileManager{files: make(map[string]*RemoteFile)}
+}
+
+func (rm *RemoteFileManager) Get(rel string) *RemoteFile {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	return rm.files[rel]
+}
+
+// byID returns the file with the given channel ID
+func (rm *RemoteFileManager) byID(id string) *RemoteFile {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	for _, f := range rm.files {
+		if f.ID == id {
+			return f
+		}
+	}
+	return nil
+}
+
+// add keeps f unless the path is already open, returning the one kept
+func (rm *RemoteFileManager) add(f *RemoteFile) *RemoteFile {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	if existing, exists := rm.files[f.Path]; exists {
+		f.sync.Close()
+		return existing
+	}
+	rm.files[f.Path] = f
+	return f
+}
+
+func (rm *RemoteFileManager) remove(rel string) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	if f, exists := rm.files[rel]; exists {
+		f.sync.Close()
+		delete(rm.files, rel)
+	}
+}
+
+// members returns who opened f, except one user
+func (rm *RemoteFileManager) members(f *RemoteFile, except string) []string {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	members := make([]string, 0, len(f.Members))
+	for userID := range f.Members {
+		if userID != except {
+			members = append(members, userID)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// RemoveMember drops a peer that left the session from every file
+func (rm *RemoteFileManager) RemoveMember(userID string) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	for _, f := range rm.files {
+		delete(f.Members, userID)
+	}
+}
+
+func (rm *RemoteFileManager) Reset() {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	for _, f := range rm.files {
+		f.sync.Close()
+	}
+	rm.files = make(map[string]*RemoteFile)
+}
+
+// handleOpenRemoteFile asks the host for one of its project's files
+func (cm *CollabManager) handleOpenRemoteFile(req *protocol.OpenRemoteFileRequest) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || !session.Project {
+		return createErrorMessage("open_remote_file_failed", "Not in a project session")
+	}
+	if cm.hostSession() != nil {
+		return createErrorMessage("open_remote_file_failed", "The host has the project's files locally")
+	}
+	if cm.p2pManager.ServerMode() {
+		return createErrorMessage("open_remote_file_failed", "Opening remote files needs direct connections")
+	}
+	rel, err := cleanRemotePath(req.Path)
+	if err != nil {
+		return createErrorMessage("open_remote_file_failed", err.Error())
+	}
+	
+	if f := cm.remoteFiles.Get(rel); f != nil {
+		cm.sendRemoteFileOpened(f, "")
+		return createStatusMessage("remote_file_open", rel)
+	}
+	
+	// Only the host answers; other peers ignore the request
+	if err := cm.broadcastToPeers(protocol.MsgOpenRemoteFile, protocol.OpenRemoteFileRequest{Path: rel}); err != nil {
+		return createErrorMessage("open_remote_file_failed", err.Error())
+	}
+	return createStatusMessage("remote_file_requested", "Waiting for the host to send "+rel)
+}
+
+// handleCloseRemoteFile stops sharing a file this member opened
+func (cm *CollabManager) handleCloseRemoteFile(req *protocol.CloseRemoteFileRequest) *protocol.Message {
+	rel, err := cleanRemotePath(req.Path)
+	if err != nil {
+		return createErrorMessage("close_remote_file_failed", err.Error())
+	}
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || cm.remoteFiles.Get(rel) == nil || cm.hostSession() != nil {
+		return createErrorMessage("close_remote_file_failed", rel+" is not open")
+	}
+	
+	cm.remoteFiles.remove(rel)
+	msg, _ := protocol.NewMessage(protocol.MsgCloseRemoteFile, protocol.CloseRemoteFileRequest{Path: rel})
+	if payload, err := msg.ToJSON(); err == nil {
+		if err := cm.p2pManager.SendMessage(session.CreatedBy, payload); err != nil {
+			log.Printf("Failed to tell the host %s was closed: %v", rel, err)
+		}
+	}
+	return createStatusMessage("remote_file_closed", rel)
+}
+
+// cleanRemotePath checks a path relative to the project root
+func cleanRemotePath(rel string) (string, error) {
+	if rel == "" {
+		return "", fmt.Errorf("path is required")
+	}
+	if _, err := sessionLocalPath("", rel); err != nil {
+		return "", err
+	}
+	return path.Clean(rel), nil
+}
+
+// handlePeerOpenRemoteFile shares a file of the host's project with the
+// member who asked for it
+func (cm *CollabManager) handlePeerOpenRemoteFile(userID string, msg *protocol.Message) {
+	session := cm.hostSession()
+	if session == nil {
+		return
+	}
+	var req protocol.OpenRemoteFileRequest
+	if err := msg.ParseData(&req); err != nil {
+		return
+	}
+	
+	f, err := cm.shareRemoteFile(session, req.Path)
+	if err != nil {
+		log.Printf("Not sending %s to %s: %v", req.Path, userID, err)
+		cm.sendToPeer(userID, protocol.MsgRemoteFileOpened, protocol.RemoteFileOpenedEvent{Path: req.Path, Error: err.Error()})
+		return
+	}
+	
+	cm.remoteFiles.mutex.Lock()
+	f.Members[userID] = true
+	cm.remoteFiles.mutex.Unlock()
+	if _, err := cm.p2pManager.AttachSession(userID, f.ID); err != nil {
+		cm.remoteFiles.mutex.Lock()
+		delete(f.Members, userID)
+		cm.remoteFiles.mutex.Unlock()
+		log.Printf("Failed to attach %s to %s: %v", f.Path, userID, err)
+		cm.sendToPeer(userID, protocol.MsgRemoteFileOpened, protocol.RemoteFileOpenedEvent{Path: f.Path, Error: err.Error()})
+		return
+	}
+	
+	cm.sendToPeer(userID, protocol.MsgRemoteFileOpened, protocol.RemoteFileOpenedEvent{
+		Path:       f.Path,
+		DocumentID: f.ID,
+		Content:    f.sync.GetDocumentContent(),
+		Metadata:   f.Metadata,
+	})
+	
+	event, _ := protocol.NewMessage(protocol.MsgRemoteFileShared, protocol.RemoteFileSharedEvent{
+		Path:     f.Path,
+		FilePath: filepath.Join(cm.sessionRoot, filepath.FromSlash(f.Path)),
+		UserID:   userID,
+		Members:  cm.remoteFiles.members(f, ""),
+	})
+	if err := cm.sendMessage(event); err != nil {
+		log.Printf("Failed to send remote file share: %v", err)
+	}
+}
+
+// shareRemoteFile returns the shared document of a project file, reading it
+// from disk the first time it is asked for. The path comes from a peer, so
+// it must stay inside the root, symlinks included, and not be ignored.
+func (cm *CollabManager) shareRemoteFile(session *session.Session, rel string) (*RemoteFile, error) {
+	if !session.Project || cm.sessionRoot == "" {
+		return nil, fmt.Errorf("not a project session")
+	}
+	rel, err := cleanRemotePath(rel)
+	if err != nil {
+		return nil, err
+	}
+	if f := cm.remoteFiles.Get(rel); f != nil {
+		return f, nil
+	}
+	if NewIgnoreRules(session.IgnoreRules).Ignored(rel, false) {
+		return nil, fmt.Errorf("%s is ignored", rel)
+	}
+	
+	local, err := sessionLocalPath(cm.sessionRoot, rel)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := filepath.EvalSymlinks(local)
+	if err != nil {
+		return nil, fmt.Errorf("%s not found", rel)
+	}
+	realRoot, err := filepath.EvalSymlinks(cm.sessionRoot)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := sessionRelativePath(realRoot, resolved); err != nil {
+		return nil, fmt.Errorf("%s leaves the project root", rel)
+	}
+	
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", rel)
+	}
+	if info.Size() > maxRemoteFileBytes {
+		return nil, fmt.Errorf("%s is larger than %d bytes", rel, maxRemoteFileBytes)
+	}
+	data, err := os.ReadFile(resolved)
+	if err != nil {
+		return nil, err
+	}
+	
+	content := string(data)
+	if isBinaryContent(content) {
+		return nil, fmt.Errorf("%s looks like a binary file", rel)
+	}
+	charset := detectCharset(content)
+	if content, err = decodeCharset(content, charset); err != nil {
+		return nil, err
+	}
+	metadata := protocol.RemoteFileMetadata{
+		LineEnding:   detectLineEnding(content),
+		FileEncoding: charset,
+		Executable:   info.Mode()&0111 != 0,
+		Size:         info.Size(),
+	}
+	
+	f := newRemoteFile(remoteFileID(session.ID, rel), rel, cm.sessionManager.GetUserID(), normalizeLineEndings(content), metadata)
+	f.sync.SetClock(cm.clock)
+	return cm.remoteFiles.add(f), nil
+}
+
+// handlePeerCloseRemoteFile stops sending a file to a member who closed it
+func (cm *CollabManager) handlePeerCloseRemoteFile(userID string, msg *protocol.Message) {
+	if cm.hostSession() == nil {
+		return
+	}
+	var req protocol.CloseRemoteFileRequest
+	if err := msg.ParseData(&req); err != nil {
+		return
+	}
+	f := cm.remoteFiles.Get(req.Path)
+	if f == nil {
+		return
+	}
+	
+	cm.remoteFiles.mutex.Lock()
+	delete(f.Members, userID)
+	cm.remoteFiles.mutex.Unlock()
+	if err := cm.p2pManager.DetachSession(userID, f.ID); err != nil {
+		log.Printf("Failed to detach %s from %s: %v", f.Path, userID, err)
+	}
+}
+
+// handlePeerRemoteFileOpened takes the file the host sent and hands it to
+// Neovim to open a buffer for
+func (cm *CollabManager) handlePeerRemoteFileOpened(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy != userID {
+		return
+	}
+	var opened protocol.RemoteFileOpenedEvent
+	if err := msg.ParseData(&opened); err != nil {
+		return
+	}
+	if opened.Error != "" {
+		cm.sendRemoteFileOpened(&RemoteFile{Path: opened.Path}, opened.Error)
+		return
+	}
+	rel, err := cleanRemotePath(opened.Path)
+	if err != nil {
+		log.Printf("Ignoring remote file from %s: %v", userID, err)
+		return
+	}
+	
+	f := newRemoteFile(opened.DocumentID, rel, cm.sessionManager.GetUserID(), opened.Content, opened.Metadata)
+	f.sync.SetClock(cm.clock)
+	cm.sendRemoteFileOpened(cm.remoteFiles.add(f), "")
+}
+
+// sendRemoteFileOpened tells Neovim a remote file is ready to edit, or why it
+// isn't
+func (cm *CollabManager) sendRemoteFileOpened(f *RemoteFile, reason string) {
+	event := protocol.RemoteFileOpenedEvent{Path: f.Path, Error: reason}
+	if reason == "" {
+		content, encoding := cm.contentForClient(f.sync.GetDocumentContent(), collabsync.ContentModeText)
+		event.DocumentID = f.ID
+		event.Content = content
+		event.ContentEncoding = encoding
+		event.Metadata = f.Metadata
+		if session := cm.sessionManager.GetCurrentSession(); session != nil {
+			event.FilePath = cm.remoteLocalPath(f.Path)
+			event.ReadOnly = !session.CanEdit(cm.sessionManager.GetUserID()) || cm.spectating
+		}
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgRemoteFileOpened, event)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send remote file: %v", err)
+	}
+}
+
+// remoteLocalPath returns where a remote file would be in the local
+// checkout, "" without one
+func (cm *CollabManager) remoteLocalPath(rel string) string {
+	if cm.sessionRoot == "" {
+		return ""
+	}
+	local, err := sessionLocalPath(cm.sessionRoot, rel)
+	if err != nil {
+		return ""
+	}
+	return local
+}
+
+// handleRemoteFileOperation applies a local edit to a remote file. Members
+// send it to the host; the host sends it to everyone who opened the file.
+func (cm *CollabManager) handleRemoteFileOperation(ctx context.Context, f *RemoteFile, op protocol.Operation) error {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return fmt.Errorf("no active session")
+	}
+	if err := f.sync.ApplyLocalOperation(ctx, op); err != nil {
+		return err
+	}
+	
+	frame, err := protocol.EncodeOperationFrame([]protocol.Operation{op})
+	if err != nil {
+		return err
+	}
+	if cm.hostSession() == nil {
+		return cm.p2pManager.SendSessionMessage(session.CreatedBy, f.ID, frame)
+	}
+	for _, member := range cm.remoteFiles.members(f, "") {
+		if err := cm.p2pManager.SendSessionMessage(member, f.ID, frame); err != nil {
+			log.Printf("Failed to send %s operation to %s: %v", f.Path, member, err)
+		}
+	}
+	return nil
+}
+
+// handleRemoteFileMessage applies an edit to a remote file from its session
+// channel, the host passing it on to the file's other members
+func (cm *CollabManager) handleRemoteFileMessage(f *RemoteFile, userID string, data []byte) {
+	if p2p.MessageType(data) == protocol.MsgTransactionPart {
+		cm.handleFileTransactionPart(f, userID, data)
+		return
+	}
+	// Edits arriving while a transaction holds the file wait behind it
+	if cm.transactions.Defer(f.Path, func() { cm.handleRemoteFileMessage(f, userID, data) }) {
+		return
+	}
+	
+	op, err := decodeSessionOperation(data)
+	if err != nil {
+		log.Printf("Dropping %s message from %s: %v", f.Path, userID, err)
+		return
+	}
+	
+	host := cm.hostSession() != nil
+	if host {
+		op.UserID = userID
+		if violation := cm.rules.Check([]protocol.Operation{op}, f.Path, ""); violation != nil {
+			cm.sendRuleViolation(protocol.RuleViolationEvent{
+				UserID: userID,
+				Name:   peerName(cm.hostSession(), userID),
+				Rule:   violation.rule,
+				Detail: violation.detail,
+				File:   f.Path,
+			})
+			return
+		}
+	}
+	if !cm.applyRemoteFileOperation(f, op) {
+		return
+	}
+	
+	if host {
+		frame, err := protocol.EncodeOperationFrame([]protocol.Operation{op})
+		if err != nil {
+			log.Printf("Failed to relay %s operation: %v", f.Path, err)
+		} else {
+			for _, member := range cm.remoteFiles.members(f, userID) {
+				if err := cm.p2pManager.SendSessionMessage(member, f.ID, frame); err != nil {
+					log.Printf("Failed to relay %s operation to %s: %v", f.Path, member, err)
+				}
+			}
+		}
+	}
+}
+
+// applyRemoteFileOperation applies a peer's edit to a remote file and passes
+// it on to Neovim, reporting whether it applied
+func (cm *CollabManager) applyRemoteFileOperation(f *RemoteFile, op protocol.Operation) bool {
+	if err := f.sync.ApplyRemoteOperation(context.Background(), op); err != nil {
+		log.Printf("Failed to apply %s operation from %s: %v", f.Path, op.UserID, err)
+		return false
+	}
+	event, _ := protocol.NewMessage(protocol.MsgDocumentOperation, protocol.DocumentOperation{
+		Type:       string(op.Type),
+		Position:   op.Position,
+		Content:    op.Content,
+		Length:     op.Length,
+		UserID:     op.UserID,
+		File:       f.Path,
+		Provenance: op.Provenance,
+	})
+	if err := cm.sendMessage(event); err != nil {
+		log.Printf("Failed to send remote file operation: %v", err)
+	}
+	return true
+}
+
+// sendToPeer sends a message to one peer
+func (cm *CollabManager) sendToPeer(userID, msgType string, data interface{}) {
+	msg, err := protocol.NewMessage(msgType, data)
+	if err != nil {
+		return
+	}
+	payload, err := msg.ToJSON()
+	if err != nil {
+		return
+	}
+	if err := cm.p2pManager.SendMessage(userID, payload); err != nil {
+		log.Printf("Failed to send %s to %s: %v", msgType, userID, err)
+	}
+}
+
+// handlePeerListProjectFiles sends the host's listing to a member browsing
+// the project, without the root, which never leaves the host's machine
+func (cm *CollabManager) handlePeerListProjectFiles(userID string) {
+	if cm.hostSession() == nil || cm.sessionRoot == "" {
+		return
+	}
+	root, rules, err := cm.projectRules("")
+	if err != nil {
+		return
+	}
+	files, err := listProjectFiles(root, rules)
+	if err != nil {
+		log.Printf("Failed to list the project for %s: %v", userID, err)
+		return
+	}
+	count, total := cm.projectLimits.ApplyLimits(files)
+	cm.sendToPeer(userID, protocol.MsgProjectFiles, protocol.ProjectFilesResponse{
+		Files:        files,
+		IgnoreRules:  rules.Lines(),
+		Limits:       cm.projectLimits,
+		OfferedFiles: count,
+		OfferedBytes: total,
+		Remote:       true,
+	})
+}
+
+// handlePeerProjectFiles hands the host's listing to Neovim
+func (cm *CollabManager) handlePeerProjectFiles(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy != userID {
+		return
+	}
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send the host's project files: %v", err)
+	}
+}
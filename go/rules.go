@@ -0,0 +1,286 @@
+package collab
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// The host can set rules every other member's edits must keep to, for
+// guarded exercises: a largest insert, protected line ranges of the
+// session's document (a license header, the scaffold around a kata) and
+// files matching read_only_files patterns, written as in .gitignore. Members
+// check their own edits before applying them and refuse the ones breaking a
+// rule, telling the host which rule was broken; the host refuses broken
+// edits to remote files, and the central server drops them as it would a
+// read-only member's. Protected ranges move with the document as it is
+// edited, like breakpoints. The host's own edits aren't checked.
+const maxProtectedRanges = 100
+
+// ruleViolation is an edit a rule refuses
+type ruleViolation struct {
+	rule   string // "max_insert_bytes", "protected" or "read_only_file"
+	detail string
+}
+
+func (v *ruleViolation) Error() string {
+	return v.detail
+}
+
+type protectedSpan struct {
+	label      string
+	start, end int // byte offsets; the range is [start, end)
+}
+
+// RuleSet holds the session's rules, with protected ranges as offsets into
+// the document
+type RuleSet struct {
+	rules    protocol.OperationRules
+	readOnly *IgnoreRules
+	spans    []protectedSpan
+	mutex    sync.Mutex
+}
+
+func NewRuleSet() *RuleSet {
+	return &RuleSet{}
+}
+
+// validateRules checks rules the host set or sent
+func validateRules(rules *protocol.OperationRules) error {
+	if rules.MaxInsertBytes < 0 {
+		return fmt.Errorf("max_insert_bytes must not be negative")
+	}
+	if len(rules.Protected) > maxProtectedRanges {
+		return fmt.Errorf("at most %d ranges can be protected", maxProtectedRanges)
+	}
+	for _, r := range rules.Protected {
+		if r.StartLine < 0 || r.EndLine <= r.StartLine {
+			return fmt.Errorf("invalid protected range %d-%d", r.StartLine, r.EndLine)
+		}
+	}
+	return nil
+}
+
+// Set replaces the rules, placing protected ranges by line in content
+func (rs *RuleSet) Set(rules protocol.OperationRules, content string) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	
+	rs.rules = rules
+	rs.readOnly = nil
+	if len(rules.ReadOnlyFiles) > 0 {
+		rs.readOnly = NewIgnoreRules(rules.ReadOnlyFiles)
+	}
+	rs.spans = make([]protectedSpan, 0, len(rules.Protected))
+	for _, r := range rules.Protected {
+		rs.spans = append(rs.spans, protectedSpan{
+			label: r.Label,
+			start: offsetOf(content, r.StartLine, 0),
+			end:   offsetOf(content, r.EndLine, 0),
+		})
+	}
+}
+
+// Rules returns the rules with protected ranges on their current lines
+func (rs *RuleSet) Rules(content string) protocol.OperationRules {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	
+	rules := rs.rules
+	rules.Protected = make([]protocol.ProtectedRange, 0, len(rs.spans))
+	for _, span := range rs.spans {
+		start, _ := lineColumnOf(content, span.start)
+		end, _ := lineColumnOf(content, span.end)
+		rules.Protected = append(rules.Protected, protocol.ProtectedRange{StartLine: start, EndLine: end, Label: span.label})
+	}
+	return rules
+}
+
+// Active reports whether any rule is set
+func (rs *RuleSet) Active() bool {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return rs.rules.MaxInsertBytes > 0 || rs.readOnly != nil || len(rs.spans) > 0
+}
+
+// Check returns the first rule ops break, in order, each counting on the
+// document the ones before it left. file is the edited file's path, "" for
+// the session's document, which is checked as docPath.
+func (rs *RuleSet) Check(ops []protocol.Operation, file, docPath string) *ruleViolation {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	
+	path := file
+	if path == "" {
+		path = filepath.ToSlash(filepath.Base(docPath))
+	}
+	if rs.readOnly != nil && rs.readOnly.Ignored(path, false) {
+		return &ruleViolation{rule: "read_only_file", detail: path + " is read-only"}
+	}
+	
+	spans := append([]protectedSpan(nil), rs.spans...)
+	for _, op := range ops {
+		if op.Type == protocol.OpInsert && rs.rules.MaxInsertBytes > 0 && len(op.Content) > rs.rules.MaxInsertBytes {
+			return &ruleViolation{
+				rule:   "max_insert_bytes",
+				detail: fmt.Sprintf("inserts are limited to %d bytes, this one has %d", rs.rules.MaxInsertBytes, len(op.Content)),
+			}
+		}
+		if file != "" {
+			continue
+		}
+		for i := range spans {
+			if touchesSpan(op, spans[i]) {
+				name := "a protected range"
+				if spans[i].label != "" {
+					name = spans[i].label
+				}
+				return &ruleViolation{rule: "protected", detail: "edits to " + name + " aren't allowed"}
+			}
+			spans[i] = transformSpan(spans[i], op)
+		}
+	}
+	return nil
+}
+
+// Transform moves protected ranges past an edit to the document
+func (rs *RuleSet) Transform(op protocol.Operation) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	for i := range rs.spans {
+		rs.spans[i] = transformSpan(rs.spans[i], op)
+	}
+}
+
+func (rs *RuleSet) Reset() {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	rs.rules, rs.readOnly, rs.spans = protocol.OperationRules{}, nil, nil
+}
+
+// touchesSpan reports whether op changes text inside span. Inserting right
+// before or after it leaves it alone.
+func touchesSpan(op protocol.Operation, span protectedSpan) bool {
+	if span.start >= span.end {
+		return false
+	}
+	switch op.Type {
+	case protocol.OpInsert:
+		return op.Position > span.start && op.Position < span.end
+	case protocol.OpDelete:
+		return op.Position < span.end && op.Position+op.Length > span.start
+	case protocol.OpReplace:
+		return true
+	}
+	return false
+}
+
+// transformSpan moves a range past an edit; text inserted at its end stays
+// outside it
+func transformSpan(span protectedSpan, op protocol.Operation) protectedSpan {
+	start := transformOffset(span.start, op)
+	end := span.end
+	if op.Type != protocol.OpInsert || op.Position != span.end {
+		end = transformOffset(span.end, op)
+	}
+	span.start, span.end = start, max(start, end)
+	return span
+}
+
+// checkRules refuses local edits that break the host's rules, telling the
+// host about it
+func (cm *CollabManager) checkRules(ops []protocol.Operation, file string) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy == cm.sessionManager.GetUserID() || !cm.rules.Active() {
+		return nil
+	}
+	violation := cm.rules.Check(ops, file, session.FilePath)
+	if violation == nil {
+		return nil
+	}
+	cm.sendToPeer(session.CreatedBy, protocol.MsgRuleViolation, protocol.RuleViolationEvent{Rule: violation.rule, Detail: violation.detail, File: file})
+	return createErrorMessage("operation_rejected", violation.detail)
+}
+
+// handleSetOperationRules sets the rules members' edits must keep to and
+// sends them everyone
+func (cm *CollabManager) handleSetOperationRules(req *protocol.OperationRules) *protocol.Message {
+	if cm.hostSession() == nil {
+		return createErrorMessage("set_operation_rules_failed", "Only the host can set rules")
+	}
+	if err := validateRules(req); err != nil {
+		return createErrorMessage("set_operation_rules_failed", err.Error())
+	}
+	content := cm.syncManager.GetDocumentContent()
+	cm.rules.Set(*req, content)
+	rules := cm.rules.Rules(content)
+	if err := cm.broadcastToPeers(protocol.MsgOperationRules, rules); err != nil {
+		return createErrorMessage("set_operation_rules_failed", err.Error())
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgOperationRules, rules)
+	return msg
+}
+
+func (cm *CollabManager) handleGetOperationRules() *protocol.Message {
+	if cm.sessionManager.GetCurrentSession() == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgOperationRules, cm.rules.Rules(cm.syncManager.GetDocumentContent()))
+	return msg
+}
+
+// sendOperationRules brings a member who just joined up to date
+func (cm *CollabManager) sendOperationRules(userID string) {
+	if !cm.rules.Active() {
+		return
+	}
+	cm.sendToPeer(userID, protocol.MsgOperationRules, cm.rules.Rules(cm.syncManager.GetDocumentContent()))
+}
+
+// handlePeerOperationRules takes over the rules the host set
+func (cm *CollabManager) handlePeerOperationRules(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy != userID || userID == cm.sessionManager.GetUserID() {
+		return
+	}
+	var rules protocol.OperationRules
+	if err := msg.ParseData(&rules); err != nil {
+		return
+	}
+	if err := validateRules(&rules); err != nil {
+		log.Printf("Ignoring rules from %s: %v", userID, err)
+		return
+	}
+	content := cm.syncManager.GetDocumentContent()
+	cm.rules.Set(rules, content)
+	forward, _ := protocol.NewMessage(protocol.MsgOperationRules, cm.rules.Rules(content))
+	if err := cm.sendMessage(forward); err != nil {
+		log.Printf("Failed to send rules: %v", err)
+	}
+}
+
+// handlePeerRuleViolation tells the host's Neovim a member's edit was refused
+func (cm *CollabManager) handlePeerRuleViolation(userID string, msg *protocol.Message) {
+	session := cm.hostSession()
+	if session == nil {
+		return
+	}
+	var event protocol.RuleViolationEvent
+	if err := msg.ParseData(&event); err != nil {
+		return
+	}
+	event.UserID = userID
+	event.Name = peerName(session, userID)
+	cm.sendRuleViolation(event)
+}
+
+func (cm *CollabManager) sendRuleViolation(event protocol.RuleViolationEvent) {
+	log.Printf("Edit by %s refused: %s", event.UserID, event.Detail)
+	msg, _ := protocol.NewMessage(protocol.MsgRuleViolation, event)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send rule violation: %v", err)
+	}
+}
@@ -0,0 +1,910 @@
+package collab
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/p2p"
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// `collab serve` runs a central server for deployments that forbid direct
+// peer connections. Clients with server_url set connect to it instead of to
+// each other: it terminates every connection, puts each session's operations
+// into one order, keeps the authoritative document and records sessions,
+// rosters, operations and audit entries in its store.
+//
+// How often the server looks for sessions idle past session_ttl_minutes
+const sessionReapInterval = time.Minute
+
+// serverMember is one client connection in a session. Actor is who the
+// store's records name: the verified identity when there is one, otherwise
+// the client's user ID.
+type serverMember struct {
+	peer       protocol.Peer
+	actor      string
+	conn       net.Conn
+	writeMutex sync.Mutex
+}
+
+// record is the member as the store's roster names them
+func (m *serverMember) record() protocol.Peer {
+	record := m.peer
+	record.UserID = m.actor
+	return record
+}
+
+func (m *serverMember) send(envelope protocol.ServerEnvelope) error {
+	frame, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	m.writeMutex.Lock()
+	defer m.writeMutex.Unlock()
+	
+	// A client that stopped reading is dropped rather than holding up the
+	// session it is in
+	m.conn.SetWriteDeadline(time.Now().Add(serverWriteTimeout))
+	if err := protocol.WriteFrame(m.conn, frame); err != nil {
+		m.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// serverSession is a live session on the server. Its mutex is held while an
+// operation is applied and relayed, with those of the sessions linked with
+// it, so every member sees the same order.
+type serverSession struct {
+	session    *session.Session
+	sync       *collabsync.SyncManager
+	members    map[string]*serverMember
+	spectators map[*serverMember]bool
+	lastActive time.Time // when a member last joined or sent anything
+	closed     bool      // ended; whoever is still connected is being disconnected
+	token      string    // name of the access token that created it, if any
+	rules      *RuleSet  // the host's rules for everyone else's edits
+	mutex      sync.Mutex
+	
+	// The sessions sharing its document, nil when it isn't linked. The
+	// server's mutex guards it.
+	link *sessionLink
+}
+
+// CollabServer accepts client connections and hosts their sessions
+type CollabServer struct {
+	store       session.Store
+	verifier    *OIDCVerifier // nil when anyone may connect
+	sessions    map[string]*serverSession
+	sessionTTL  time.Duration  // 0 when idle sessions are kept
+	cluster     *serverCluster // nil for a standalone server
+	tokens      AccessTokens   // none when anyone may connect
+	limits      ServerLimits
+	connections *connectionCounter
+	linkOffers  map[string]string // session offered a link -> session offering it
+	mutex       sync.Mutex
+}
+
+func NewCollabServer(store session.Store, verifier *OIDCVerifier) *CollabServer {
+	return &CollabServer{
+		store:       store,
+		verifier:    verifier,
+		sessions:    make(map[string]*serverSession),
+		connections: newConnectionCounter(),
+		linkOffers:  make(map[string]string),
+	}
+}
+
+// RunServe implements `collab serve`
+func RunServe(config *Config, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", ":"+p2p.ServerDefaultPort, "address to accept clients on")
+	certFile := flags.String("tls-cert", "", "TLS certificate; clients then use tls://")
+	keyFile := flags.String("tls-key", "", "TLS private key")
+	adminListen := flags.String("admin-listen", "", "address to serve session stats on, e.g. 127.0.0.1:7421")
+	signaling := flags.Bool("signaling", false, "relay signaling for peer-to-peer sessions instead of hosting sessions")
+	stun := flags.Bool("stun", false, "with -signaling, also answer STUN binding requests over UDP on the -listen port")
+	flags.Parse(args)
+	
+	if *stun && !*signaling {
+		return fmt.Errorf("-stun is only available with -signaling")
+	}
+	if *signaling {
+		listener, err := listenServe(*listen, *certFile, *keyFile)
+		if err != nil {
+			return err
+		}
+		if *stun {
+			stunConn, err := listenSTUN(*listen)
+			if err != nil {
+				listener.Close()
+				return err
+			}
+			defer stunConn.Close()
+		}
+		return runSignalingServer(config, listener, *adminListen)
+	}
+	
+	store, err := session.OpenStore(config.StorePath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if config.StorePath == "" {
+		log.Printf("No store_path configured; sessions are not kept after exit")
+	}
+	
+	var verifier *OIDCVerifier
+	if config.OIDC.enabled() {
+		dialer, err := p2p.NewProxyDialer(config.proxyURL())
+		if err != nil {
+			return err
+		}
+		httpClient := newPinnedHTTPClient(dialer, config.TLSPins, oidcRequestTimeout)
+		if verifier, err = NewOIDCVerifier(config.OIDC, httpClient); err != nil {
+			return err
+		}
+		log.Printf("Requiring sign-in with %s", config.OIDC.Issuer)
+	}
+	
+	listener, err := listenServe(*listen, *certFile, *keyFile)
+	if err != nil {
+		return err
+	}
+	
+	server := NewCollabServer(store, verifier)
+	var clusterListener net.Listener
+	if config.Cluster.enabled() {
+		cluster, err := newServerCluster(config.Cluster)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		if clusterListener, err = net.Listen("tcp", config.Cluster.Listen); err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to listen on %s: %v", config.Cluster.Listen, err)
+		}
+		server.SetCluster(cluster)
+		go server.accept(clusterListener, false)
+		log.Printf("Joined the cluster as %s", cluster.address)
+	}
+	
+	server.SetLimits(config.ServerLimits)
+	if config.AccessTokens.enabled() {
+		server.SetAccessTokens(config.AccessTokens)
+		log.Printf("Requiring an access token from clients")
+	}
+	var adminListener net.Listener
+	if *adminListen != "" {
+		if adminListener, err = net.Listen("tcp", *adminListen); err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to listen on %s: %v", *adminListen, err)
+		}
+		go func() {
+			if err := server.serveAdmin(adminListener); err != nil {
+				log.Printf("Admin endpoint failed: %v", err)
+			}
+		}()
+		log.Printf("Serving session stats on http://%s/sessions", adminListener.Addr())
+	}
+	
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Println("Shutting down server...")
+		listener.Close()
+		if clusterListener != nil {
+			clusterListener.Close()
+		}
+		if adminListener != nil {
+			adminListener.Close()
+		}
+	}()
+	
+	if config.SessionTTLMinutes > 0 {
+		server.SetSessionTTL(time.Duration(config.SessionTTLMinutes) * time.Minute)
+		log.Printf("Ending sessions idle for %d minutes", config.SessionTTLMinutes)
+	}
+	log.Printf("Serving collab sessions on %s", listener.Addr())
+	return server.Serve(listener)
+}
+
+// listenServe listens for clients on address, with TLS when given a key pair
+func listenServe(address, certFile, keyFile string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", address, err)
+	}
+	if certFile == "" && keyFile == "" {
+		log.Printf("Serving without TLS; put it behind a TLS terminator or pass -tls-cert and -tls-key")
+		return listener, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to load TLS key pair: %v", err)
+	}
+	return tls.NewListener(listener, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}), nil
+}
+
+// SetSessionTTL has Serve end sessions no member has sent anything to for
+// ttl; 0 keeps them until everyone has left
+func (cs *CollabServer) SetSessionTTL(ttl time.Duration) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.sessionTTL = ttl
+}
+
+// SetCluster has the server share its sessions with the other instances of
+// a cluster; set it before Serve
+func (cs *CollabServer) SetCluster(cluster *serverCluster) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.cluster = cluster
+}
+
+// Serve accepts clients until the listener is closed
+func (cs *CollabServer) Serve(listener net.Listener) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go cs.reapSessions(stop)
+	if cs.cluster != nil {
+		go cs.cluster.renewClaims(stop)
+	}
+	return cs.accept(listener, true)
+}
+
+// accept hands each connection on listener to handleConn until it is closed.
+// Connections passed on by the rest of a cluster aren't limited again.
+func (cs *CollabServer) accept(listener net.Listener, limited bool) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return nil
+		}
+		if !limited {
+			go cs.handleConn(conn)
+			continue
+		}
+		release, ok := cs.admit(conn)
+		if !ok {
+			continue
+		}
+		go func() {
+			defer release()
+			cs.handleConn(conn)
+		}()
+	}
+}
+
+func (cs *CollabServer) handleConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(protocol.ServerHandshakeTimeout))
+	data, err := protocol.ReadFrame(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var hello protocol.ServerHello
+	if err := json.Unmarshal(data, &hello); err != nil || hello.UserID == "" || hello.SessionID == "" {
+		cs.refuse(conn, "invalid handshake")
+		return
+	}
+	
+	// In a cluster, the session's members meet on the instance that owns it
+	owner, err := cs.cluster.route(hello)
+	if err != nil {
+		log.Printf("Refused %s from %s: %v", hello.UserID, conn.RemoteAddr(), err)
+		cs.refuse(conn, "cluster unavailable")
+		return
+	}
+	if owner != "" {
+		if err := cs.cluster.forward(conn, data, owner); err != nil {
+			log.Printf("Failed to pass %s on to %s: %v", hello.UserID, owner, err)
+			cs.refuse(conn, err.Error())
+		}
+		return
+	}
+	
+	grant, err := cs.authorize(hello)
+	if err != nil {
+		log.Printf("Refused %s from %s: %v", hello.UserID, conn.RemoteAddr(), err)
+		cs.refuse(conn, err.Error())
+		return
+	}
+	
+	var identity *Identity
+	if cs.verifier != nil {
+		if hello.IDToken == "" {
+			cs.refuse(conn, "sign-in required")
+			return
+		}
+		verified, err := cs.verifier.Verify(hello.IDToken)
+		if err != nil {
+			log.Printf("Refused %s from %s: %v", hello.UserID, conn.RemoteAddr(), err)
+			cs.refuse(conn, "sign-in rejected: "+err.Error())
+			return
+		}
+		identity = &verified
+	}
+	
+	room, member, err := cs.join(hello, identity, grant, conn)
+	if err != nil {
+		cs.releaseClaim(hello.SessionID)
+		log.Printf("Refused %s from %s: %v", hello.UserID, conn.RemoteAddr(), err)
+		cs.refuse(conn, err.Error())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("%s joined session %s from %s", member.actor, hello.SessionID, conn.RemoteAddr())
+	
+	for {
+		data, err := protocol.ReadFrame(conn)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Connection from %s closed: %v", member.actor, err)
+			}
+			break
+		}
+		var envelope protocol.ServerEnvelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			continue
+		}
+		cs.handleEnvelope(room, member, envelope)
+	}
+	
+	cs.leave(room, member)
+}
+
+func (cs *CollabServer) refuse(conn net.Conn, reason string) {
+	data, _ := json.Marshal(protocol.ServerWelcome{Error: reason})
+	protocol.WriteFrame(conn, data)
+	conn.Close()
+}
+
+// join adds a connection to its session, creating the session if asked to,
+// and sends it the welcome. Operations are relayed under the same lock, so
+// the welcome's document is exactly what later operations build on.
+// Verified identities replace the name the client chose. Spectators only
+// watch: they are counted but not added to the roster. A new session counts
+// against the limit of the access token that created it.
+func (cs *CollabServer) join(hello protocol.ServerHello, identity *Identity, grant *tokenGrant, conn net.Conn) (*serverSession, *serverMember, error) {
+	if hello.Spectator && hello.Create != nil {
+		return nil, nil, fmt.Errorf("spectators can't create sessions")
+	}
+	
+	cs.mutex.Lock()
+	room, exists := cs.sessions[hello.SessionID]
+	if !exists {
+		if hello.Create == nil {
+			cs.mutex.Unlock()
+			return nil, nil, fmt.Errorf("unknown session %s", hello.SessionID)
+		}
+		if max := cs.limits.MaxSessions; max > 0 && len(cs.sessions) >= max {
+			cs.mutex.Unlock()
+			return nil, nil, fmt.Errorf("server is at its limit of %d sessions", max)
+		}
+		if err := cs.checkTokenSessions(grant); err != nil {
+			cs.mutex.Unlock()
+			return nil, nil, err
+		}
+		room = cs.newSession(hello, identity)
+		if grant != nil {
+			room.token = grant.name
+		}
+		cs.sessions[hello.SessionID] = room
+	}
+	cs.mutex.Unlock()
+	
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	
+	if room.closed {
+		return nil, nil, fmt.Errorf("session %s has ended", hello.SessionID)
+	}
+	if exists && hello.Create != nil {
+		return nil, nil, fmt.Errorf("session %s already exists", hello.SessionID)
+	}
+	settings := room.session.Settings
+	if !hello.Spectator && settings.MaxPeers > 0 && len(room.members)+1 > settings.MaxPeers {
+		return nil, nil, fmt.Errorf("session %s is full", hello.SessionID)
+	}
+	
+	peer := protocol.Peer{UserID: hello.UserID, Name: hello.Name}
+	member := &serverMember{peer: peer, actor: hello.UserID, conn: conn}
+	if identity != nil {
+		peer.Name = identity.Name
+		peer.Email = identity.Email
+		member.peer = peer
+		member.actor = identity.Label()
+	}
+	if existing, ok := room.members[peer.UserID]; ok && !hello.Spectator {
+		existing.conn.Close()
+	}
+	
+	document := room.sync.GetDocumentState()
+	session := room.session
+	session.Mutex.Lock()
+	welcome := &protocol.ServerWelcome{
+		SessionID:  session.ID,
+		CreatedBy:  session.CreatedBy,
+		CreatedAt:  session.CreatedAt,
+		Controller: session.Controller,
+		Spec: protocol.ServerSessionSpec{
+			FilePath:   session.FilePath,
+			Project:    session.Project,
+			Ignore:     session.IgnoreRules,
+			Content:    document.Content,
+			Mode:       session.Mode,
+			LineEnding: session.LineEnding,
+			Charset:    session.Charset,
+			Settings:   session.Settings,
+		},
+		Version:     document.Version,
+		VectorClock: document.VectorClock,
+		Peers:       make([]protocol.Peer, 0, len(room.members)+1),
+		Spectators:  len(room.spectators),
+	}
+	for _, other := range room.members {
+		welcome.Peers = append(welcome.Peers, other.peer)
+	}
+	if !hello.Spectator {
+		welcome.Peers = append(welcome.Peers, peer)
+	}
+	session.Mutex.Unlock()
+	
+	data, _ := json.Marshal(welcome)
+	if err := protocol.WriteFrame(conn, data); err != nil {
+		if !exists {
+			cs.mutex.Lock()
+			delete(cs.sessions, hello.SessionID)
+			cs.mutex.Unlock()
+			room.sync.Close()
+		}
+		return nil, nil, fmt.Errorf("failed to send welcome: %v", err)
+	}
+	
+	if hello.Spectator {
+		room.spectators[member] = true
+		cs.announceSpectators(room)
+		persist("record audit", cs.store.AppendAudit(session.ID, member.actor, "spectate_session", conn.RemoteAddr().String()))
+		return room, member, nil
+	}
+	room.lastActive = time.Now()
+	
+	session.Mutex.Lock()
+	session.Peers[peer.UserID] = &peer
+	session.Mutex.Unlock()
+	
+	joined, _ := protocol.NewMessage(protocol.MsgPeerJoined, protocol.PeerJoinedEvent{Peer: peer})
+	cs.broadcast(room, "", joined, peer.UserID)
+	room.members[peer.UserID] = member
+	
+	persist("save session", cs.store.SaveSession(session, true))
+	persist("record roster", cs.store.RecordRosterEvent(session.ID, member.record(), protocol.RosterJoined))
+	persist("record audit", cs.store.AppendAudit(session.ID, member.actor, "join_session", conn.RemoteAddr().String()))
+	return room, member, nil
+}
+
+// newSession creates a session from a host's hello. Caller holds cs.mutex.
+func (cs *CollabServer) newSession(hello protocol.ServerHello, identity *Identity) *serverSession {
+	spec := hello.Create
+	session := &session.Session{
+		ID:          hello.SessionID,
+		CreatedBy:   hello.UserID,
+		CreatedAt:   time.Now(),
+		FilePath:    spec.FilePath,
+		Project:     spec.Project,
+		IgnoreRules: spec.Ignore,
+		Content:     spec.Content,
+		Mode:        spec.Mode,
+		LineEnding:  spec.LineEnding,
+		Charset:     spec.Charset,
+		Settings:    spec.Settings,
+		Peers:       make(map[string]*protocol.Peer),
+		Controller:  hello.UserID,
+		IsActive:    true,
+	}
+	
+	document := newServerDocument(session, spec.Content)
+	
+	actor := hello.UserID
+	if identity != nil {
+		actor = identity.Label()
+	}
+	persist("record audit", cs.store.AppendAudit(session.ID, actor, "create_session", spec.FilePath))
+	return &serverSession{
+		session:    session,
+		sync:       document,
+		members:    make(map[string]*serverMember),
+		spectators: make(map[*serverMember]bool),
+		lastActive: time.Now(),
+		rules:      NewRuleSet(),
+	}
+}
+
+// newServerDocument is the server's copy of a session's document
+func newServerDocument(session *session.Session, content string) *collabsync.SyncManager {
+	document := collabsync.NewSyncManager()
+	document.SetUserID(protocol.ServerUserID)
+	document.SetContentMode(session.Mode)
+	document.InitializeDocument(content)
+	
+	// Nobody at the server can resolve conflicts by hand; it applies held
+	// edits in the order the manual strategy releases them
+	name := session.Settings.ConflictStrategy
+	if name == collabsync.ConflictManual {
+		name = collabsync.ConflictTimestamp
+	}
+	if strategy, err := collabsync.NewConflictStrategy(name, session.CurrentController); err == nil {
+		document.SetConflictStrategy(strategy)
+	}
+	return document
+}
+
+// handleEnvelope applies and relays what a member sent. Operations are
+// applied to the server's document first; everything is stamped with the
+// sender's identity, whatever the payload claims.
+func (cs *CollabServer) handleEnvelope(room *serverSession, member *serverMember, envelope protocol.ServerEnvelope) {
+	msg, err := protocol.ParseMessage(envelope.Data)
+	if err != nil {
+		return
+	}
+	switch msg.Type {
+	case protocol.MsgLinkSession, protocol.MsgAcceptSessionLink, protocol.MsgUnlinkSession:
+		cs.handleLinkRequest(room, member, msg)
+		return
+	}
+	
+	rooms := cs.lockLinked(room)
+	defer unlockRooms(rooms)
+	
+	if room.members[member.peer.UserID] != member {
+		return
+	}
+	room.lastActive = time.Now()
+	
+	switch msg.Type {
+	case protocol.MsgControlStatus, protocol.MsgSessionExpired, protocol.MsgOperationRules:
+		// The server enforces what the host decides
+		if member.peer.UserID == room.session.CreatedBy {
+			cs.applyHostDecision(room, msg)
+		}
+	
+	case protocol.MsgGrantControl:
+		// The host or whoever has control passes it on
+		if canHandOutControl(room.session, member.peer.UserID) {
+			var transfer protocol.ControlTransfer
+			if msg.ParseData(&transfer) == nil {
+				room.session.Mutex.Lock()
+				room.session.Controller = transfer.ToUser
+				room.session.Mutex.Unlock()
+			}
+		}
+	
+	case protocol.MsgChat:
+		var event protocol.ChatEvent
+		if msg.ParseData(&event) == nil && event.Text != "" {
+			persist("append chat", cs.store.AppendChat(room.session.ID, member.peer.UserID, event.Text))
+		}
+	
+	case protocol.MsgDocumentOperation:
+		var op protocol.Operation
+		if err := msg.ParseData(&op); err != nil {
+			return
+		}
+		op.UserID = member.peer.UserID
+		if !room.session.CanEdit(op.UserID) {
+			log.Printf("Dropped operation from read-only %s in %s", op.UserID, room.session.ID)
+			return
+		}
+		if cs.breaksRules(room, member, []protocol.Operation{op}) {
+			return
+		}
+		if err := room.sync.ApplyRemoteOperation(context.Background(), op); err != nil {
+			log.Printf("Failed to apply operation from %s in %s: %v", op.UserID, room.session.ID, err)
+			return
+		}
+		room.rules.Transform(op)
+		stored := op
+		stored.UserID = member.actor
+		persist("append operation", cs.store.AppendOperation(room.session.ID, stored))
+		msg, _ = protocol.NewMessage(protocol.MsgDocumentOperation, op)
+		cs.relayLinked(rooms, room, member, []protocol.Operation{op}, msg)
+	
+	case protocol.MsgDocumentOperations:
+		// A burst is applied and relayed as one, up to any operation that fails
+		var batch protocol.OperationBatch
+		if err := msg.ParseData(&batch); err != nil {
+			return
+		}
+		if !room.session.CanEdit(member.peer.UserID) {
+			log.Printf("Dropped operations from read-only %s in %s", member.peer.UserID, room.session.ID)
+			return
+		}
+		for i := range batch.Operations {
+			batch.Operations[i].UserID = member.peer.UserID
+		}
+		if cs.breaksRules(room, member, batch.Operations) {
+			return
+		}
+		var applied []protocol.Operation
+		for _, op := range batch.Operations {
+			if err := room.sync.ApplyRemoteOperation(context.Background(), op); err != nil {
+				log.Printf("Failed to apply operation from %s in %s: %v", op.UserID, room.session.ID, err)
+				break
+			}
+			room.rules.Transform(op)
+			stored := op
+			stored.UserID = member.actor
+			persist("append operation", cs.store.AppendOperation(room.session.ID, stored))
+			applied = append(applied, op)
+		}
+		if len(applied) == 0 {
+			return
+		}
+		msg, _ = protocol.NewMessage(protocol.MsgDocumentOperations, protocol.OperationBatch{Operations: applied})
+		cs.relayLinked(rooms, room, member, applied, msg)
+	}
+	
+	if envelope.To != "" {
+		if target, ok := room.members[envelope.To]; ok {
+			data, _ := msg.ToJSON()
+			if err := target.send(protocol.ServerEnvelope{From: member.peer.UserID, Data: data}); err != nil {
+				log.Printf("Failed to relay to %s: %v", envelope.To, err)
+			}
+		}
+		return
+	}
+	cs.broadcast(room, member.peer.UserID, msg, member.peer.UserID)
+}
+
+// breaksRules drops a member's edits that break the host's rules, telling
+// the host. Caller holds room.mutex.
+func (cs *CollabServer) breaksRules(room *serverSession, member *serverMember, ops []protocol.Operation) bool {
+	session := room.session
+	if member.peer.UserID == session.CreatedBy {
+		return false
+	}
+	violation := room.rules.Check(ops, "", session.FilePath)
+	if violation == nil {
+		return false
+	}
+	log.Printf("Dropped operations from %s in %s: %s", member.actor, session.ID, violation.detail)
+	if host, ok := room.members[session.CreatedBy]; ok {
+		msg, _ := protocol.NewMessage(protocol.MsgRuleViolation, protocol.RuleViolationEvent{Rule: violation.rule, Detail: violation.detail})
+		data, _ := msg.ToJSON()
+		if err := host.send(protocol.ServerEnvelope{From: member.peer.UserID, Data: data}); err != nil {
+			log.Printf("Failed to relay to %s: %v", session.CreatedBy, err)
+		}
+	}
+	return true
+}
+
+// applyHostDecision tracks control changes, the end of timed sessions and
+// the host's operation rules, so the server drops operations the host's
+// rules would refuse
+func (cs *CollabServer) applyHostDecision(room *serverSession, msg *protocol.Message) {
+	session := room.session
+	session.Mutex.Lock()
+	defer session.Mutex.Unlock()
+	
+	if msg.Type == protocol.MsgSessionExpired {
+		session.Expired = true
+		return
+	}
+	if msg.Type == protocol.MsgOperationRules {
+		var rules protocol.OperationRules
+		if msg.ParseData(&rules) == nil && validateRules(&rules) == nil {
+			room.rules.Set(rules, room.sync.GetDocumentContent())
+		}
+		return
+	}
+	var status protocol.ControlStatus
+	if msg.ParseData(&status) == nil {
+		session.Controller = status.CurrentController
+	}
+}
+
+// broadcast sends msg from a member (or the server, when from is empty) to
+// everyone in the session but except, and to the spectators. Caller holds
+// room.mutex.
+func (cs *CollabServer) broadcast(room *serverSession, from string, msg *protocol.Message, except string) {
+	data, err := msg.ToJSON()
+	if err != nil {
+		return
+	}
+	for userID, member := range room.members {
+		if userID == except {
+			continue
+		}
+		if err := member.send(protocol.ServerEnvelope{From: from, Data: data}); err != nil {
+			log.Printf("Failed to relay to %s: %v", userID, err)
+		}
+	}
+	for spectator := range room.spectators {
+		if err := spectator.send(protocol.ServerEnvelope{From: from, Data: data}); err != nil {
+			log.Printf("Failed to relay to spectator %s: %v", spectator.actor, err)
+		}
+	}
+}
+
+// announceSpectators tells the members how many spectators are watching.
+// Caller holds room.mutex.
+func (cs *CollabServer) announceSpectators(room *serverSession) {
+	msg, _ := protocol.NewMessage(protocol.MsgSpectatorCount, protocol.SpectatorCountEvent{Count: len(room.spectators)})
+	data, _ := msg.ToJSON()
+	for userID, member := range room.members {
+		if err := member.send(protocol.ServerEnvelope{Data: data}); err != nil {
+			log.Printf("Failed to relay to %s: %v", userID, err)
+		}
+	}
+}
+
+// leave removes a member, ending the session when the last one goes
+func (cs *CollabServer) leave(room *serverSession, member *serverMember) {
+	member.conn.Close()
+	
+	room.mutex.Lock()
+	if room.spectators[member] {
+		delete(room.spectators, member)
+		cs.announceSpectators(room)
+		room.mutex.Unlock()
+		return
+	}
+	if room.members[member.peer.UserID] != member {
+		room.mutex.Unlock()
+		return
+	}
+	delete(room.members, member.peer.UserID)
+	session := room.session
+	session.Mutex.Lock()
+	delete(session.Peers, member.peer.UserID)
+	if session.Controller == member.peer.UserID {
+		// Until the host hands control on, nobody but the host edits
+		session.Controller = ""
+	}
+	empty := len(room.members) == 0
+	if empty {
+		session.IsActive = false
+	}
+	session.Mutex.Unlock()
+	
+	left, _ := protocol.NewMessage(protocol.MsgPeerLeft, protocol.PeerLeftEvent{UserID: member.peer.UserID})
+	cs.broadcast(room, "", left, "")
+	
+	// Spectators have nothing left to watch
+	var spectators []*serverMember
+	if empty {
+		room.closed = true
+		for spectator := range room.spectators {
+			spectators = append(spectators, spectator)
+		}
+	}
+	room.mutex.Unlock()
+	for _, spectator := range spectators {
+		spectator.conn.Close()
+	}
+	
+	log.Printf("%s left session %s", member.actor, session.ID)
+	persist("record roster", cs.store.RecordRosterEvent(session.ID, member.record(), protocol.RosterLeft))
+	persist("record audit", cs.store.AppendAudit(session.ID, member.actor, "leave_session", ""))
+	if !empty {
+		return
+	}
+	
+	cs.mutex.Lock()
+	if cs.sessions[session.ID] == room {
+		delete(cs.sessions, session.ID)
+	}
+	delete(cs.linkOffers, session.ID)
+	cs.mutex.Unlock()
+	cs.releaseClaim(session.ID)
+	cs.unlink(room)
+	
+	// Keep the final document with the stored session
+	session.Mutex.Lock()
+	session.Content = room.sync.GetDocumentContent()
+	session.Mutex.Unlock()
+	room.sync.Close()
+	persist("save session", cs.store.SaveSession(session, true))
+	persist("end session", cs.store.EndSession(session.ID, time.Now()))
+	log.Printf("Session %s ended", session.ID)
+}
+
+// reapSessions ends idle and orphaned sessions until stop is closed
+func (cs *CollabServer) reapSessions(stop <-chan struct{}) {
+	ticker := time.NewTicker(sessionReapInterval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case now := <-ticker.C:
+			cs.expireIdleSessions(now)
+			cs.dropOrphanedSessions(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// expireIdleSessions tells the members of each session idle past the TTL
+// that it is over and disconnects them. The last one to go ends the session
+// as usual, closing its document and saving the final content.
+func (cs *CollabServer) expireIdleSessions(now time.Time) {
+	cs.mutex.Lock()
+	ttl := cs.sessionTTL
+	rooms := make([]*serverSession, 0, len(cs.sessions))
+	for _, room := range cs.sessions {
+		rooms = append(rooms, room)
+	}
+	cs.mutex.Unlock()
+	if ttl <= 0 {
+		return
+	}
+	
+	for _, room := range rooms {
+		room.mutex.Lock()
+		idle := now.Sub(room.lastActive)
+		if room.closed || idle < ttl {
+			room.mutex.Unlock()
+			continue
+		}
+		room.closed = true
+		session := room.session
+		session.Mutex.Lock()
+		session.Expired = true
+		session.Mutex.Unlock()
+		
+		reason := fmt.Sprintf("no activity for %v", idle.Round(time.Minute))
+		expired, _ := protocol.NewMessage(protocol.MsgSessionExpired, protocol.SessionExpiredEvent{SessionID: session.ID, EndsAt: now, Reason: reason})
+		cs.broadcast(room, "", expired, "")
+		members := make([]*serverMember, 0, len(room.members)+len(room.spectators))
+		for _, member := range room.members {
+			members = append(members, member)
+		}
+		for spectator := range room.spectators {
+			members = append(members, spectator)
+		}
+		room.mutex.Unlock()
+		
+		cs.mutex.Lock()
+		if cs.sessions[session.ID] == room {
+			delete(cs.sessions, session.ID)
+		}
+		cs.mutex.Unlock()
+		cs.releaseClaim(session.ID)
+		
+		log.Printf("Ending session %s: %s", session.ID, reason)
+		persist("record audit", cs.store.AppendAudit(session.ID, protocol.ServerUserID, "expire_session", reason))
+		for _, member := range members {
+			member.conn.Close()
+		}
+	}
+}
+
+// persist logs store failures; history is best-effort and never blocks editing
+func persist(action string, err error) {
+	if err != nil {
+		log.Printf("Store: failed to %s: %v", action, err)
+	}
+}
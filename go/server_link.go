@@ -0,0 +1,98 @@
+package collab
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// handleSpectatorCount passes the server's count of spectators on to Neovim
+func (cm *CollabManager) handleSpectatorCount(userID string, msg *protocol.Message) {
+	var event protocol.SpectatorCountEvent
+	if userID != protocol.ServerUserID || msg.ParseData(&event) != nil {
+		return
+	}
+	cm.spectators.Store(int64(event.Count))
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send spectator count: %v", err)
+	}
+}
+
+// handleServerOperation applies an operation the server relayed from
+// another member, or a peer sent directly, and passes it on to Neovim
+func (cm *CollabManager) handleServerOperation(userID string, msg *protocol.Message) {
+	var op protocol.Operation
+	if err := msg.ParseData(&op); err != nil {
+		return
+	}
+	op.UserID = userID
+	cm.ackOperations(userID, []protocol.Operation{op})
+	if cm.holdWhilePaused([]protocol.Operation{op}) {
+		return
+	}
+	
+	// Operations arriving while a join is still setting up the document
+	// wait for it
+	cm.opFlow.run(func(queued bool) {
+		cm.afterTransactions("", func() { cm.applyServerOperation(op) })
+	})
+}
+
+// applyServerOperation applies a relayed operation once the document is free
+func (cm *CollabManager) applyServerOperation(op protocol.Operation) {
+	if !cm.acceptsPeerOperation(op.UserID) {
+		return
+	}
+	
+	err := cm.syncManager.ApplyRemoteOperation(context.Background(), op)
+	if errors.Is(err, collabsync.ErrOperationHeld) {
+		// Passed on once the user resolves the conflict
+		return
+	}
+	if errors.Is(err, collabsync.ErrOperationReplayed) {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to apply operation from %s: %v", op.UserID, err)
+		return
+	}
+	
+	event, _ := protocol.NewMessage(protocol.MsgDocumentOperation, cm.clientOperation(op))
+	if err := cm.sendMessage(event); err != nil {
+		log.Printf("Failed to send operation: %v", err)
+	}
+}
+
+// acceptsPeerOperation reports whether edits userID sent may be applied.
+// The server drops those of members who may not edit before relaying them;
+// a peer's are checked here.
+func (cm *CollabManager) acceptsPeerOperation(userID string) bool {
+	if cm.sessionManager.GetCurrentSession() == nil {
+		return false
+	}
+	if cm.p2pManager.ServerMode() {
+		return true
+	}
+	if failure, _ := cm.editAccess(userID); failure != nil {
+		log.Printf("Ignoring operation from %s, who may not edit", userID)
+		return false
+	}
+	return true
+}
+
+// clientOperation turns an applied operation into the event Neovim expects
+func (cm *CollabManager) clientOperation(op protocol.Operation) protocol.DocumentOperation {
+	content, encoding := cm.contentForClient(op.Content, cm.syncManager.GetContentMode())
+	return protocol.DocumentOperation{
+		Type:            string(op.Type),
+		Position:        op.Position,
+		Content:         content,
+		ContentEncoding: encoding,
+		Length:          op.Length,
+		UserID:          op.UserID,
+		Provenance:      op.Provenance,
+	}
+}
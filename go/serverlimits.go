@@ -0,0 +1,231 @@
+package collab
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// A server left running for weeks must not collect what crashed clients
+// leave behind. Writes to a member time out after serverWriteTimeout, so a
+// client that stopped reading is disconnected rather than stalling its
+// session; sessions nobody is connected to any more are dropped by the reap
+// loop; and server_limits caps connections, overall and per address, and
+// the sessions the server hosts at once. `collab serve -admin-listen` serves
+// the live sessions and their counts as JSON.
+const (
+	serverWriteTimeout = 30 * time.Second
+	
+	// How long a session may have no members before it counts as orphaned
+	orphanGracePeriod = time.Minute
+)
+
+// ServerLimits caps what `collab serve` takes on; 0 leaves a limit off
+type ServerLimits struct {
+	MaxConnections      int `json:"max_connections,omitempty"`
+	MaxConnectionsPerIP int `json:"max_connections_per_ip,omitempty"`
+	MaxSessions         int `json:"max_sessions,omitempty"`
+}
+
+func (l ServerLimits) validate() error {
+	if l.MaxConnections < 0 || l.MaxConnectionsPerIP < 0 || l.MaxSessions < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// connectionCounter counts open client connections, overall and by address
+type connectionCounter struct {
+	total  int
+	byHost map[string]int
+	mutex  sync.Mutex
+}
+
+func newConnectionCounter() *connectionCounter {
+	return &connectionCounter{byHost: make(map[string]int)}
+}
+
+// acquire counts a connection from addr, or says which limit it is over
+func (cc *connectionCounter) acquire(addr net.Addr, limits ServerLimits) (string, error) {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if limits.MaxConnections > 0 && cc.total >= limits.MaxConnections {
+		return "", fmt.Errorf("server is at its limit of %d connections", limits.MaxConnections)
+	}
+	if limits.MaxConnectionsPerIP > 0 && cc.byHost[host] >= limits.MaxConnectionsPerIP {
+		return "", fmt.Errorf("too many connections from %s", host)
+	}
+	cc.total++
+	cc.byHost[host]++
+	return host, nil
+}
+
+func (cc *connectionCounter) release(host string) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.total--
+	if cc.byHost[host]--; cc.byHost[host] <= 0 {
+		delete(cc.byHost, host)
+	}
+}
+
+func (cc *connectionCounter) counts() (int, int) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.total, len(cc.byHost)
+}
+
+// SetLimits caps connections and sessions; set it before Serve
+func (cs *CollabServer) SetLimits(limits ServerLimits) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.limits = limits
+}
+
+// admit counts a client connection, refusing it when it is over a limit.
+// The returned function releases it once the connection is done.
+func (cs *CollabServer) admit(conn net.Conn) (func(), bool) {
+	cs.mutex.Lock()
+	limits := cs.limits
+	cs.mutex.Unlock()
+	
+	host, err := cs.connections.acquire(conn.RemoteAddr(), limits)
+	if err != nil {
+		log.Printf("Refused connection from %s: %v", conn.RemoteAddr(), err)
+		cs.refuse(conn, err.Error())
+		return nil, false
+	}
+	return func() { cs.connections.release(host) }, true
+}
+
+// dropOrphanedSessions ends sessions that have had no members for the grace
+// period, such as one whose join failed after it was created
+func (cs *CollabServer) dropOrphanedSessions(now time.Time) {
+	cs.mutex.Lock()
+	rooms := make([]*serverSession, 0, len(cs.sessions))
+	for _, room := range cs.sessions {
+		rooms = append(rooms, room)
+	}
+	cs.mutex.Unlock()
+	
+	for _, room := range rooms {
+		room.mutex.Lock()
+		orphaned := !room.closed && len(room.members) == 0 && now.Sub(room.lastActive) >= orphanGracePeriod
+		if !orphaned {
+			room.mutex.Unlock()
+			continue
+		}
+		room.closed = true
+		spectators := make([]*serverMember, 0, len(room.spectators))
+		for spectator := range room.spectators {
+			spectators = append(spectators, spectator)
+		}
+		room.mutex.Unlock()
+		
+		session := room.session
+		cs.mutex.Lock()
+		if cs.sessions[session.ID] == room {
+			delete(cs.sessions, session.ID)
+		}
+		delete(cs.linkOffers, session.ID)
+		cs.mutex.Unlock()
+		cs.releaseClaim(session.ID)
+		cs.unlink(room)
+		room.sync.Close()
+		
+		log.Printf("Dropping orphaned session %s", session.ID)
+		persist("end session", cs.store.EndSession(session.ID, now))
+		for _, spectator := range spectators {
+			spectator.conn.Close()
+		}
+	}
+}
+
+// ServerStats is what the admin endpoint reports
+type ServerStats struct {
+	Connections int                  `json:"connections"`
+	Addresses   int                  `json:"addresses"`
+	Sessions    []ServerSessionStats `json:"sessions"`
+}
+
+type ServerSessionStats struct {
+	SessionID   string    `json:"session_id"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	Peers       int       `json:"peers"`
+	Spectators  int       `json:"spectators"`
+	Version     int64     `json:"version"`
+	IdleSeconds int64     `json:"idle_seconds"`
+}
+
+// Stats lists the live sessions, oldest first
+func (cs *CollabServer) Stats() ServerStats {
+	stats := ServerStats{Sessions: []ServerSessionStats{}}
+	stats.Connections, stats.Addresses = cs.connections.counts()
+	
+	cs.mutex.Lock()
+	rooms := make([]*serverSession, 0, len(cs.sessions))
+	for _, room := range cs.sessions {
+		rooms = append(rooms, room)
+	}
+	cs.mutex.Unlock()
+	
+	now := time.Now()
+	for _, room := range rooms {
+		room.mutex.Lock()
+		session := room.session
+		entry := ServerSessionStats{
+			SessionID:   session.ID,
+			CreatedBy:   session.CreatedBy,
+			CreatedAt:   session.CreatedAt,
+			Peers:       len(room.members),
+			Spectators:  len(room.spectators),
+			Version:     room.sync.GetDocumentVersion(),
+			IdleSeconds: int64(now.Sub(room.lastActive).Seconds()),
+		}
+		room.mutex.Unlock()
+		stats.Sessions = append(stats.Sessions, entry)
+	}
+	sort.Slice(stats.Sessions, func(i, j int) bool {
+		return stats.Sessions[i].CreatedAt.Before(stats.Sessions[j].CreatedAt)
+	})
+	return stats
+}
+
+// serveAdmin answers GET /sessions with the server's stats until the
+// listener is closed. Session IDs are all it takes to join without OIDC, so
+// keep it on localhost or a private network.
+func (cs *CollabServer) serveAdmin(listener net.Listener) error {
+	return serveStats(listener, func() interface{} { return cs.Stats() })
+}
+
+// serveStats answers GET /sessions with what stats returns, as JSON, until
+// the listener is closed
+func serveStats(listener net.Listener, stats func() interface{}) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats())
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: protocol.ServerHandshakeTimeout}
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package session
+
+import (
+	"fmt"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// RestoreSession makes an exported session the current one, hosted by the
+// local user. The previous host's roster entry and control pass to us.
+func (sm *SessionManager) RestoreSession(state *protocol.SessionState, content string) (*Session, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	
+	if sm.currentSession != nil {
+		return nil, fmt.Errorf("leave session %s before importing another", sm.currentSession.ID)
+	}
+	
+	controller := state.Controller
+	if controller == state.ExportedBy {
+		controller = sm.userID
+	}
+	
+	session := &Session{
+		ID:          state.SessionID,
+		CreatedBy:   sm.userID,
+		CreatedAt:   state.CreatedAt,
+		FilePath:    state.FilePath,
+		Project:     state.Project,
+		IgnoreRules: state.Ignore,
+		Content:     content,
+		Mode:        state.Mode,
+		LineEnding:  state.LineEnding,
+		Charset:     state.Charset,
+		RoomCode:    state.RoomCode,
+		Settings:    state.Settings,
+		Peers:       make(map[string]*protocol.Peer),
+		Controller:  controller,
+		IsActive:    true,
+	}
+	for _, peer := range state.Peers {
+		if peer.UserID == state.ExportedBy {
+			continue
+		}
+		p := peer
+		session.Peers[p.UserID] = &p
+	}
+	session.Peers[sm.userID] = &protocol.Peer{UserID: sm.userID, Name: "Creator"}
+	
+	sm.currentSession = session
+	
+	persist("save session", sm.store.SaveSession(session, true))
+	persist("record roster", sm.store.RecordRosterEvent(session.ID, protocol.Peer{UserID: state.ExportedBy}, protocol.RosterLeft))
+	persist("record roster", sm.store.RecordRosterEvent(session.ID, *session.Peers[sm.userID], protocol.RosterJoined))
+	persist("record audit", sm.store.AppendAudit(session.ID, sm.userID, "import_session", "from "+state.ExportedBy))
+	
+	return session, nil
+}
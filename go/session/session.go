@@ -0,0 +1,434 @@
+// Package session tracks the current session, its roster and who holds
+// control, and keeps sessions in a store.
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+type Session struct {
+	ID          string                    `json:"id"`
+	CreatedBy   string                    `json:"created_by"`
+	CreatedAt   time.Time                 `json:"created_at"`
+	FilePath    string                    `json:"file_path"`
+	Project     bool                      `json:"project,omitempty"`      // FilePath is relative to each member's project root
+	IgnoreRules []string                  `json:"ignore_rules,omitempty"` // the host's, for project sessions
+	Content     string                    `json:"content"`
+	Mode        string                    `json:"mode"`
+	LineEnding  string                    `json:"line_ending"`
+	Charset     string                    `json:"file_encoding"`
+	RoomCode    string                    `json:"room_code,omitempty"`
+	Settings    protocol.SessionSettings  `json:"settings"`
+	Peers       map[string]*protocol.Peer `json:"peers"`
+	Controller  string                    `json:"controller"`
+	IsActive    bool                      `json:"is_active"`
+	Expired     bool                      `json:"expired,omitempty"` // a timed session that reached its end
+	Mutex       sync.RWMutex              `json:"-"`
+}
+
+type SessionManager struct {
+	currentSession *Session
+	userID         string
+	store          Store
+	mutex          sync.RWMutex
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		userID: GenerateUserID(),
+		store:  newMemoryStore(),
+	}
+}
+
+// SetStore replaces the session store, e.g. with a SQLite database
+func (sm *SessionManager) SetStore(store Store) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.store = store
+}
+
+// persist logs store failures; history is best-effort and never blocks editing
+func persist(action string, err error) {
+	if err != nil {
+		log.Printf("Store: failed to %s: %v", action, err)
+	}
+}
+
+func (sm *SessionManager) CreateSession(filePath, content, mode, lineEnding, charset string, settings protocol.SessionSettings) (*Session, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	
+	sessionID := generateSessionID(filePath, content, sm.userID)
+	
+	session := &Session{
+		ID:         sessionID,
+		CreatedBy:  sm.userID,
+		CreatedAt:  time.Now(),
+		FilePath:   filePath,
+		Content:    content,
+		Mode:       mode,
+		LineEnding: lineEnding,
+		Charset:    charset,
+		Settings:   settings,
+		Peers:      make(map[string]*protocol.Peer),
+		Controller: sm.userID,
+		IsActive:   true,
+	}
+	
+	creatorPeer := &protocol.Peer{
+		UserID: sm.userID,
+		Name:   "Creator",
+	}
+	session.Peers[sm.userID] = creatorPeer
+	
+	sm.currentSession = session
+	
+	persist("save session", sm.store.SaveSession(session, session.CreatedBy == sm.userID))
+	persist("record roster", sm.store.RecordRosterEvent(sessionID, *creatorPeer, protocol.RosterJoined))
+	persist("record audit", sm.store.AppendAudit(sessionID, sm.userID, "create_session", filePath))
+	
+	return session, nil
+}
+
+// JoinSession makes the session a peer or the server described the current
+// one. via says where the description came from, for the audit log.
+func (sm *SessionManager) JoinSession(state *protocol.ServerWelcome, via string) (*Session, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	
+	spec := state.Spec
+	session := &Session{
+		ID:          state.SessionID,
+		CreatedBy:   state.CreatedBy,
+		CreatedAt:   state.CreatedAt,
+		FilePath:    spec.FilePath,
+		Project:     spec.Project,
+		IgnoreRules: spec.Ignore,
+		Content:     spec.Content,
+		Mode:        spec.Mode,
+		LineEnding:  spec.LineEnding,
+		Charset:     spec.Charset,
+		Settings:    spec.Settings,
+		Peers:       make(map[string]*protocol.Peer),
+		Controller:  state.Controller,
+		IsActive:    true,
+	}
+	for _, peer := range state.Peers {
+		p := peer
+		session.Peers[p.UserID] = &p
+	}
+	sm.currentSession = session
+	
+	persist("save session", sm.store.SaveSession(session, false))
+	for _, peer := range session.Peers {
+		persist("record roster", sm.store.RecordRosterEvent(session.ID, *peer, protocol.RosterJoined))
+	}
+	persist("record audit", sm.store.AppendAudit(session.ID, sm.userID, "join_session", via))
+	
+	return session, nil
+}
+
+// RecordPeerJoined adds a peer the host let into its session to the history
+func (sm *SessionManager) RecordPeerJoined(sessionID string, peer protocol.Peer) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	persist("record roster", sm.store.RecordRosterEvent(sessionID, peer, protocol.RosterJoined))
+}
+
+func (sm *SessionManager) LeaveSession() error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	
+	if sm.currentSession == nil {
+		return fmt.Errorf("no active session to leave")
+	}
+	
+	sm.currentSession.Mutex.Lock()
+	delete(sm.currentSession.Peers, sm.userID)
+	
+	if sm.currentSession.Controller == sm.userID {
+		sm.currentSession.Controller = ""
+		for peerID := range sm.currentSession.Peers {
+			sm.currentSession.Controller = peerID
+			break
+		}
+	}
+	
+	if len(sm.currentSession.Peers) == 0 {
+		sm.currentSession.IsActive = false
+	}
+	ended := !sm.currentSession.IsActive
+	sm.currentSession.Mutex.Unlock()
+	
+	session := sm.currentSession
+	persist("save session", sm.store.SaveSession(session, session.CreatedBy == sm.userID))
+	persist("record roster", sm.store.RecordRosterEvent(session.ID, protocol.Peer{UserID: sm.userID}, protocol.RosterLeft))
+	persist("record audit", sm.store.AppendAudit(session.ID, sm.userID, "leave_session", ""))
+	if ended {
+		persist("end session", sm.store.EndSession(session.ID, time.Now()))
+	}
+	
+	sm.currentSession = nil
+	return nil
+}
+
+func (sm *SessionManager) RequestControl() (*protocol.ControlStatus, error) {
+	sm.mutex.RLock()
+	session := sm.currentSession
+	sm.mutex.RUnlock()
+	
+	if session == nil {
+		return nil, fmt.Errorf("no active session")
+	}
+	
+	session.Mutex.Lock()
+	if session.Settings.ReadOnlyJoiners && session.CreatedBy != sm.userID {
+		session.Mutex.Unlock()
+		return nil, fmt.Errorf("only the host can hand out control in a %s session", session.Settings.Preset)
+	}
+	session.Controller = sm.userID
+	session.Mutex.Unlock()
+	
+	persist("save session", sm.store.SaveSession(session, session.CreatedBy == sm.userID))
+	persist("record audit", sm.store.AppendAudit(session.ID, sm.userID, "request_control", ""))
+	
+	status := &protocol.ControlStatus{
+		CurrentController: sm.userID,
+		HasControl:        true,
+	}
+	
+	return status, nil
+}
+
+func (sm *SessionManager) ReleaseControl() (*protocol.ControlStatus, error) {
+	sm.mutex.RLock()
+	session := sm.currentSession
+	sm.mutex.RUnlock()
+	
+	if session == nil {
+		return nil, fmt.Errorf("no active session")
+	}
+	
+	session.Mutex.Lock()
+	if session.Controller != sm.userID {
+		session.Mutex.Unlock()
+		return nil, fmt.Errorf("you don't have control")
+	}
+	session.Controller = ""
+	session.Mutex.Unlock()
+	
+	persist("save session", sm.store.SaveSession(session, session.CreatedBy == sm.userID))
+	persist("record audit", sm.store.AppendAudit(session.ID, sm.userID, "release_control", ""))
+	
+	status := &protocol.ControlStatus{
+		CurrentController: "",
+		HasControl:        false,
+	}
+	
+	return status, nil
+}
+
+// SetRoomCode records the relay room code a session is reachable under
+func (sm *SessionManager) SetRoomCode(sessionID, code string) {
+	sm.mutex.RLock()
+	session := sm.currentSession
+	sm.mutex.RUnlock()
+	
+	if session == nil || session.ID != sessionID {
+		stored, err := sm.store.GetSession(sessionID)
+		if err != nil {
+			return
+		}
+		session = stored
+	}
+	
+	session.Mutex.Lock()
+	session.RoomCode = code
+	session.Mutex.Unlock()
+	
+	persist("save session", sm.store.SaveSession(session, session.CreatedBy == sm.userID))
+}
+
+// RecordOperation appends an applied operation to the current session's log
+func (sm *SessionManager) RecordOperation(op protocol.Operation) {
+	sm.mutex.RLock()
+	session := sm.currentSession
+	store := sm.store
+	sm.mutex.RUnlock()
+	
+	if session == nil {
+		return
+	}
+	persist("append operation", store.AppendOperation(session.ID, op))
+}
+
+// RecordChat appends a chat message to the current session's history
+func (sm *SessionManager) RecordChat(userID, text string) {
+	sm.mutex.RLock()
+	session := sm.currentSession
+	store := sm.store
+	sm.mutex.RUnlock()
+	
+	if session == nil {
+		return
+	}
+	persist("append chat", store.AppendChat(session.ID, userID, text))
+}
+
+// LoadOperations returns every operation logged for a session, in order.
+// Only a durable store keeps them.
+func (sm *SessionManager) LoadOperations(sessionID string) ([]protocol.Operation, error) {
+	sm.mutex.RLock()
+	store := sm.store
+	sm.mutex.RUnlock()
+	
+	if _, inMemory := store.(*memoryStore); inMemory {
+		return nil, fmt.Errorf("operation history requires store_path in the config file")
+	}
+	return store.LoadOperations(sessionID)
+}
+
+// LoadChat returns a session's chat messages, in order. Only a durable store
+// keeps them.
+func (sm *SessionManager) LoadChat(sessionID string) ([]protocol.ChatRecord, error) {
+	sm.mutex.RLock()
+	store := sm.store
+	sm.mutex.RUnlock()
+	
+	if _, inMemory := store.(*memoryStore); inMemory {
+		return nil, fmt.Errorf("chat history requires store_path in the config file")
+	}
+	return store.LoadChat(sessionID)
+}
+
+// ListSessions queries stored sessions, e.g. the ones this user hosted
+func (sm *SessionManager) ListSessions(query protocol.SessionQuery) ([]protocol.SessionRecord, error) {
+	sm.mutex.RLock()
+	store := sm.store
+	sm.mutex.RUnlock()
+	return store.ListSessions(query)
+}
+
+// Close flushes and closes the session store
+func (sm *SessionManager) Close() error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	return sm.store.Close()
+}
+
+// GetCurrentSession returns the session the local user is in, if any
+func (sm *SessionManager) GetCurrentSession() *Session {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	return sm.currentSession
+}
+
+func (sm *SessionManager) GetUserID() string {
+	return sm.userID
+}
+
+func GenerateUserID() string {
+	bytes := make([]byte, 8)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+func generateSessionID(filePath, content, userID string) string {
+	data := fmt.Sprintf("%s:%s:%s:%d", filePath, content, userID, time.Now().Unix())
+	hash := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(hash[:8])
+}
+
+func (s *Session) CurrentController() string {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+	return s.Controller
+}
+
+// GetStoredSession loads a session from the store, e.g. one that has ended
+func (sm *SessionManager) GetStoredSession(sessionID string) (*Session, error) {
+	sm.mutex.RLock()
+	store := sm.store
+	sm.mutex.RUnlock()
+	
+	return store.GetSession(sessionID)
+}
+
+// SetController hands control to userID, or to nobody when empty
+func (sm *SessionManager) SetController(userID string) error {
+	sm.mutex.RLock()
+	session := sm.currentSession
+	sm.mutex.RUnlock()
+
+	if session == nil {
+		return fmt.Errorf("no active session")
+	}
+
+	session.Mutex.Lock()
+	session.Controller = userID
+	session.Mutex.Unlock()
+
+	persist("save session", sm.store.SaveSession(session, session.CreatedBy == sm.userID))
+	persist("record audit", sm.store.AppendAudit(session.ID, sm.userID, "set_control", userID))
+	return nil
+}
+
+// JoinServerSession makes the session described by a server's welcome the
+// current one
+func (sm *SessionManager) JoinServerSession(welcome *protocol.ServerWelcome) (*Session, error) {
+	return sm.JoinSession(welcome, "via server")
+}
+
+// CanEdit reports whether userID may change the document
+func (s *Session) CanEdit(userID string) bool {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+	
+	if s.Expired {
+		return false
+	}
+	if !s.Settings.ReadOnlyJoiners {
+		return true
+	}
+	return userID == s.CreatedBy || userID == s.Controller
+}
+
+// OverPeerCap reports whether connected remote peers plus the local user
+// exceed the session's cap
+func (s *Session) OverPeerCap(connected int) bool {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+	return s.Settings.MaxPeers > 0 && connected+1 > s.Settings.MaxPeers
+}
+
+// ExpireSession makes the current session read-only for everyone, reporting
+// false if it already was
+func (sm *SessionManager) ExpireSession() bool {
+	sm.mutex.RLock()
+	session := sm.currentSession
+	sm.mutex.RUnlock()
+	
+	if session == nil {
+		return false
+	}
+	
+	session.Mutex.Lock()
+	if session.Expired {
+		session.Mutex.Unlock()
+		return false
+	}
+	session.Expired = true
+	session.Mutex.Unlock()
+	
+	persist("save session", sm.store.SaveSession(session, session.CreatedBy == sm.userID))
+	persist("record audit", sm.store.AppendAudit(session.ID, sm.userID, "session_expired", ""))
+	return true
+}
@@ -0,0 +1,290 @@
+package session
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id          TEXT PRIMARY KEY,
+	created_by  TEXT NOT NULL,
+	created_at  INTEGER NOT NULL,
+	ended_at    INTEGER,
+	file_path   TEXT NOT NULL,
+	content     TEXT NOT NULL,
+	mode        TEXT NOT NULL,
+	line_ending TEXT NOT NULL,
+	charset     TEXT NOT NULL,
+	room_code   TEXT NOT NULL DEFAULT '',
+	controller  TEXT NOT NULL DEFAULT '',
+	hosted      INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS sessions_created_at ON sessions (created_at);
+
+CREATE TABLE IF NOT EXISTS roster (
+	session_id TEXT NOT NULL,
+	user_id    TEXT NOT NULL,
+	name       TEXT NOT NULL DEFAULT '',
+	event      TEXT NOT NULL,
+	at         INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS roster_session ON roster (session_id, at);
+
+CREATE TABLE IF NOT EXISTS operations (
+	seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+	session_id TEXT NOT NULL,
+	op_id      TEXT NOT NULL,
+	user_id    TEXT NOT NULL,
+	timestamp  INTEGER NOT NULL,
+	data       TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS operations_session ON operations (session_id, seq);
+
+CREATE TABLE IF NOT EXISTS chat (
+	session_id TEXT NOT NULL,
+	user_id    TEXT NOT NULL,
+	text       TEXT NOT NULL,
+	at         INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS audit (
+	session_id TEXT NOT NULL,
+	user_id    TEXT NOT NULL,
+	action     TEXT NOT NULL,
+	detail     TEXT NOT NULL DEFAULT '',
+	at         INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_session ON audit (session_id, at);
+`
+
+// sqliteStore persists sessions and history to a SQLite database. Times are
+// stored as Unix milliseconds so range queries stay cheap.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %v", err)
+	}
+	
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store %s: %v", path, err)
+	}
+	
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize store %s: %v", path, err)
+	}
+	
+	return &sqliteStore{db: db}, nil
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixMilli()
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.UnixMilli(ms)
+}
+
+func (ss *sqliteStore) SaveSession(session *Session, hosted bool) error {
+	session.Mutex.RLock()
+	defer session.Mutex.RUnlock()
+	
+	_, err := ss.db.Exec(`
+		INSERT INTO sessions (id, created_by, created_at, file_path, content, mode, line_ending, charset, room_code, controller, hosted)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET room_code = excluded.room_code, controller = excluded.controller`,
+		session.ID, session.CreatedBy, toMillis(session.CreatedAt), session.FilePath, session.Content,
+		session.Mode, session.LineEnding, session.Charset, session.RoomCode, session.Controller, hosted,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save session %s: %v", session.ID, err)
+	}
+	return nil
+}
+
+func (ss *sqliteStore) GetSession(sessionID string) (*Session, error) {
+	session := &Session{Peers: make(map[string]*protocol.Peer)}
+	var createdAt int64
+	var endedAt sql.NullInt64
+	
+	err := ss.db.QueryRow(`
+		SELECT id, created_by, created_at, ended_at, file_path, content, mode, line_ending, charset, room_code, controller
+		FROM sessions WHERE id = ?`, sessionID,
+	).Scan(&session.ID, &session.CreatedBy, &createdAt, &endedAt, &session.FilePath, &session.Content,
+		&session.Mode, &session.LineEnding, &session.Charset, &session.RoomCode, &session.Controller)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("session %s not found", sessionID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load session %s: %v", sessionID, err)
+	}
+	session.CreatedAt = fromMillis(createdAt)
+	session.IsActive = !endedAt.Valid
+	
+	// Replay the roster to find who is still in the session
+	rows, err := ss.db.Query(`SELECT user_id, name, event FROM roster WHERE session_id = ? ORDER BY at, rowid`, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load roster for %s: %v", sessionID, err)
+	}
+	defer rows.Close()
+	
+	for rows.Next() {
+		var peer protocol.Peer
+		var event string
+		if err := rows.Scan(&peer.UserID, &peer.Name, &event); err != nil {
+			return nil, err
+		}
+		if event == protocol.RosterLeft {
+			delete(session.Peers, peer.UserID)
+		} else {
+			session.Peers[peer.UserID] = &peer
+		}
+	}
+	
+	return session, rows.Err()
+}
+
+func (ss *sqliteStore) EndSession(sessionID string, endedAt time.Time) error {
+	_, err := ss.db.Exec(`UPDATE sessions SET ended_at = ? WHERE id = ?`, toMillis(endedAt), sessionID)
+	return err
+}
+
+func (ss *sqliteStore) ListSessions(query protocol.SessionQuery) ([]protocol.SessionRecord, error) {
+	conditions := []string{"1 = 1"}
+	args := []interface{}{}
+	if query.Hosted {
+		conditions = append(conditions, "hosted = 1")
+	}
+	if query.CreatedBy != "" {
+		conditions = append(conditions, "created_by = ?")
+		args = append(args, query.CreatedBy)
+	}
+	if !query.Since.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, toMillis(query.Since))
+	}
+	if !query.Until.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, toMillis(query.Until))
+	}
+	
+	statement := `SELECT id, created_by, created_at, ended_at, file_path, room_code, hosted FROM sessions WHERE ` +
+		strings.Join(conditions, " AND ") + ` ORDER BY created_at DESC`
+	if query.Limit > 0 {
+		statement += fmt.Sprintf(" LIMIT %d", query.Limit)
+	}
+	
+	rows, err := ss.db.Query(statement, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %v", err)
+	}
+	defer rows.Close()
+	
+	records := make([]protocol.SessionRecord, 0)
+	for rows.Next() {
+		var record protocol.SessionRecord
+		var createdAt int64
+		var endedAt sql.NullInt64
+		if err := rows.Scan(&record.ID, &record.CreatedBy, &createdAt, &endedAt, &record.FilePath, &record.RoomCode, &record.Hosted); err != nil {
+			return nil, err
+		}
+		record.CreatedAt = fromMillis(createdAt)
+		if endedAt.Valid {
+			ended := fromMillis(endedAt.Int64)
+			record.EndedAt = &ended
+		}
+		records = append(records, record)
+	}
+	
+	return records, rows.Err()
+}
+
+func (ss *sqliteStore) RecordRosterEvent(sessionID string, peer protocol.Peer, event string) error {
+	_, err := ss.db.Exec(`INSERT INTO roster (session_id, user_id, name, event, at) VALUES (?, ?, ?, ?, ?)`,
+		sessionID, peer.UserID, peer.Name, event, toMillis(time.Now()))
+	return err
+}
+
+func (ss *sqliteStore) AppendOperation(sessionID string, op protocol.Operation) error {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	
+	_, err = ss.db.Exec(`INSERT INTO operations (session_id, op_id, user_id, timestamp, data) VALUES (?, ?, ?, ?, ?)`,
+		sessionID, op.ID, op.UserID, op.Timestamp, string(data))
+	return err
+}
+
+func (ss *sqliteStore) LoadOperations(sessionID string) ([]protocol.Operation, error) {
+	rows, err := ss.db.Query(`SELECT data FROM operations WHERE session_id = ? ORDER BY seq`, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load operations for %s: %v", sessionID, err)
+	}
+	defer rows.Close()
+	
+	ops := make([]protocol.Operation, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var op protocol.Operation
+		if err := json.Unmarshal([]byte(data), &op); err != nil {
+			return nil, fmt.Errorf("corrupt operation in store: %v", err)
+		}
+		ops = append(ops, op)
+	}
+	
+	return ops, rows.Err()
+}
+
+func (ss *sqliteStore) AppendChat(sessionID, userID, text string) error {
+	_, err := ss.db.Exec(`INSERT INTO chat (session_id, user_id, text, at) VALUES (?, ?, ?, ?)`,
+		sessionID, userID, text, toMillis(time.Now()))
+	return err
+}
+
+func (ss *sqliteStore) LoadChat(sessionID string) ([]protocol.ChatRecord, error) {
+	rows, err := ss.db.Query(`SELECT user_id, text, at FROM chat WHERE session_id = ? ORDER BY at, rowid`, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chat for %s: %v", sessionID, err)
+	}
+	defer rows.Close()
+	
+	chat := make([]protocol.ChatRecord, 0)
+	for rows.Next() {
+		var record protocol.ChatRecord
+		var at int64
+		if err := rows.Scan(&record.UserID, &record.Text, &at); err != nil {
+			return nil, err
+		}
+		record.At = fromMillis(at).UTC()
+		chat = append(chat, record)
+	}
+	
+	return chat, rows.Err()
+}
+
+func (ss *sqliteStore) AppendAudit(sessionID, userID, action, detail string) error {
+	_, err := ss.db.Exec(`INSERT INTO audit (session_id, user_id, action, detail, at) VALUES (?, ?, ?, ?, ?)`,
+		sessionID, userID, action, detail, toMillis(time.Now()))
+	return err
+}
+
+func (ss *sqliteStore) Close() error {
+	return ss.db.Close()
+}
@@ -0,0 +1,144 @@
+package session
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Store persists sessions and their history. The in-memory store keeps the
+// old behavior; SQLite makes history queryable and survives restarts.
+type Store interface {
+	SaveSession(session *Session, hosted bool) error
+	GetSession(sessionID string) (*Session, error)
+	EndSession(sessionID string, endedAt time.Time) error
+	ListSessions(query protocol.SessionQuery) ([]protocol.SessionRecord, error)
+	
+	RecordRosterEvent(sessionID string, peer protocol.Peer, event string) error
+	AppendOperation(sessionID string, op protocol.Operation) error
+	LoadOperations(sessionID string) ([]protocol.Operation, error)
+	AppendChat(sessionID, userID, text string) error
+	LoadChat(sessionID string) ([]protocol.ChatRecord, error)
+	AppendAudit(sessionID, userID, action, detail string) error
+	
+	Close() error
+}
+
+// OpenStore opens the SQLite store at path, or an in-memory store if empty
+func OpenStore(path string) (Store, error) {
+	if path == "" {
+		return newMemoryStore(), nil
+	}
+	return openSQLiteStore(path)
+}
+
+// memoryStore keeps sessions in process memory
+type memoryStore struct {
+	sessions map[string]*Session
+	hosted   map[string]bool
+	endedAt  map[string]time.Time
+	mutex    sync.RWMutex
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		sessions: make(map[string]*Session),
+		hosted:   make(map[string]bool),
+		endedAt:  make(map[string]time.Time),
+	}
+}
+
+func (ms *memoryStore) SaveSession(session *Session, hosted bool) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.sessions[session.ID] = session
+	ms.hosted[session.ID] = hosted
+	return nil
+}
+
+func (ms *memoryStore) GetSession(sessionID string) (*Session, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	
+	session, exists := ms.sessions[sessionID]
+	if !exists {
+		return nil, fmt.Errorf("session %s not found", sessionID)
+	}
+	return session, nil
+}
+
+func (ms *memoryStore) EndSession(sessionID string, endedAt time.Time) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.endedAt[sessionID] = endedAt
+	return nil
+}
+
+func (ms *memoryStore) ListSessions(query protocol.SessionQuery) ([]protocol.SessionRecord, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	
+	records := make([]protocol.SessionRecord, 0)
+	for _, session := range ms.sessions {
+		session.Mutex.RLock()
+		record := protocol.SessionRecord{
+			ID:        session.ID,
+			CreatedBy: session.CreatedBy,
+			CreatedAt: session.CreatedAt,
+			FilePath:  session.FilePath,
+			RoomCode:  session.RoomCode,
+			Hosted:    ms.hosted[session.ID],
+		}
+		session.Mutex.RUnlock()
+		
+		if endedAt, ended := ms.endedAt[session.ID]; ended {
+			record.EndedAt = &endedAt
+		}
+		if query.Matches(record) {
+			records = append(records, record)
+		}
+	}
+	
+	// Newest first, matching the SQLite store
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.After(records[j].CreatedAt)
+	})
+	if query.Limit > 0 && len(records) > query.Limit {
+		records = records[:query.Limit]
+	}
+	return records, nil
+}
+
+// The roster already lives on the session itself
+func (ms *memoryStore) RecordRosterEvent(sessionID string, peer protocol.Peer, event string) error {
+	return nil
+}
+
+// History is only kept when a durable store is configured, so long-running
+// processes don't grow without bound; the sync manager keeps its own window
+func (ms *memoryStore) AppendOperation(sessionID string, op protocol.Operation) error {
+	return nil
+}
+
+func (ms *memoryStore) LoadOperations(sessionID string) ([]protocol.Operation, error) {
+	return []protocol.Operation{}, nil
+}
+
+func (ms *memoryStore) AppendChat(sessionID, userID, text string) error {
+	return nil
+}
+
+func (ms *memoryStore) LoadChat(sessionID string) ([]protocol.ChatRecord, error) {
+	return []protocol.ChatRecord{}, nil
+}
+
+func (ms *memoryStore) AppendAudit(sessionID, userID, action, detail string) error {
+	return nil
+}
+
+func (ms *memoryStore) Close() error {
+	return nil
+}
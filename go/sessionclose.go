@@ -0,0 +1,334 @@
+package collab
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// close_session ends a session for everyone at once rather than letting it
+// fade out as connections drop. The host proposes closing; from then on
+// nobody makes local edits, and each member applies what it still has
+// queued and answers with its document's digest. The host, once its own
+// queue has drained too, compares every answer with its digest: a member
+// that hasn't seen every operation yet, going by its vector clock, is asked
+// again, up to maxCloseRounds times. Then everyone gets session_closed with
+// the final document hash and who agreed with it, and leaves the session.
+const (
+	closeAckTimeout = 5 * time.Second
+	maxCloseRounds  = 3
+	
+	// How long a member waits for the host to finish closing before it
+	// edits again
+	closeWaitTimeout = closeAckTimeout*maxCloseRounds + 5*time.Second
+)
+
+// sessionEnd is the state of a close under way
+type sessionEnd struct {
+	closing bool
+	round   int
+	asked   map[string]bool                    // peers yet to answer this round
+	acks    map[string]protocol.DocumentDigest // answers by peer
+	timer   *time.Timer
+	mutex   sync.Mutex
+}
+
+// Closing reports whether the session is being closed
+func (se *sessionEnd) Closing() bool {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+	return se.closing
+}
+
+// begin starts closing, reporting false when a close is already under way
+func (se *sessionEnd) begin() bool {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+	if se.closing {
+		return false
+	}
+	se.closing = true
+	se.round = 0
+	se.acks = make(map[string]protocol.DocumentDigest)
+	return true
+}
+
+// ask starts the next round with peers, and the timer concluding it
+func (se *sessionEnd) ask(peers []string, conclude func(round int)) int {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+	se.round++
+	round := se.round
+	se.asked = make(map[string]bool, len(peers))
+	for _, userID := range peers {
+		se.asked[userID] = true
+		delete(se.acks, userID)
+	}
+	if se.timer != nil {
+		se.timer.Stop()
+	}
+	se.timer = time.AfterFunc(closeAckTimeout, func() { conclude(round) })
+	return round
+}
+
+// ack records a peer's answer, reporting whether everyone asked this round
+// has answered
+func (se *sessionEnd) ack(userID string, round int, digest protocol.DocumentDigest) bool {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+	if !se.closing || round != se.round || !se.asked[userID] {
+		return false
+	}
+	delete(se.asked, userID)
+	se.acks[userID] = digest
+	if len(se.asked) > 0 {
+		return false
+	}
+	se.timer.Stop()
+	return true
+}
+
+// current reports whether round is the latest one of a close under way
+func (se *sessionEnd) current(round int) bool {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+	return se.closing && round == se.round
+}
+
+// wait has a member give up on the host after closeWaitTimeout
+func (se *sessionEnd) wait(expired func()) {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+	if se.timer != nil {
+		se.timer.Stop()
+	}
+	se.timer = time.AfterFunc(closeWaitTimeout, expired)
+}
+
+func (se *sessionEnd) Reset() {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+	if se.timer != nil {
+		se.timer.Stop()
+	}
+	se.closing, se.round, se.asked, se.acks, se.timer = false, 0, nil, nil, nil
+}
+
+// handleCloseSession starts closing the hosted session, or closes it
+// straight away when nobody else is connected
+func (cm *CollabManager) handleCloseSession() *protocol.Message {
+	if cm.hostSession() == nil {
+		return createErrorMessage("close_session_failed", "Only the host can close the session")
+	}
+	if !cm.ending.begin() {
+		return createErrorMessage("close_session_failed", "The session is already closing")
+	}
+	
+	cm.flushTyping()
+	peers := cm.p2pManager.GetConnectedPeers()
+	if len(peers) == 0 {
+		cm.finishClose(cm.syncManager.Digest(), nil)
+		return createStatusMessage("session_closed", "Closed the session")
+	}
+	cm.askToClose(peers)
+	return createStatusMessage("session_closing", fmt.Sprintf("Waiting for %d peers to confirm", len(peers)))
+}
+
+// askToClose has peers confirm the document they would close with
+func (cm *CollabManager) askToClose(peers []string) {
+	round := cm.ending.ask(peers, func(round int) {
+		cm.onLoop(func() { cm.concludeClose(round) })
+	})
+	for _, userID := range peers {
+		cm.sendToPeer(userID, protocol.MsgCloseProposed, protocol.CloseProposal{Round: round})
+	}
+}
+
+// handlePeerCloseAck records a member's digest on the host
+func (cm *CollabManager) handlePeerCloseAck(userID string, msg *protocol.Message) {
+	if cm.hostSession() == nil {
+		return
+	}
+	var ack protocol.CloseAckMessage
+	if err := msg.ParseData(&ack); err != nil || ack.Digest.SHA256 == "" {
+		return
+	}
+	if cm.ending.ack(userID, ack.Round, ack.Digest) {
+		cm.onLoop(func() { cm.concludeClose(ack.Round) })
+	}
+}
+
+// concludeClose ends a round once everyone answered or the time is up.
+// The host's digest is taken once what it has queued is applied.
+func (cm *CollabManager) concludeClose(round int) {
+	if !cm.ending.current(round) {
+		return
+	}
+	cm.opFlow.run(func(queued bool) {
+		final := cm.syncManager.Digest()
+		go cm.onLoop(func() { cm.settleClose(round, final) })
+	})
+}
+
+// settleClose asks members that are behind the final document again, or
+// closes the session once they can't catch up any more
+func (cm *CollabManager) settleClose(round int, final protocol.DocumentDigest) {
+	if !cm.ending.current(round) {
+		return
+	}
+	
+	connected := cm.p2pManager.GetConnectedPeers()
+	cm.ending.mutex.Lock()
+	acks := make(map[string]protocol.DocumentDigest, len(cm.ending.acks))
+	for userID, digest := range cm.ending.acks {
+		acks[userID] = digest
+	}
+	cm.ending.mutex.Unlock()
+	
+	var behind []string
+	for _, userID := range connected {
+		if digest, ok := acks[userID]; ok && digest.SHA256 != final.SHA256 && !digest.VectorClock.Equals(final.VectorClock) {
+			behind = append(behind, userID)
+		}
+	}
+	if len(behind) > 0 && round < maxCloseRounds {
+		log.Printf("Asking %d peers behind the final document to confirm again", len(behind))
+		cm.askToClose(behind)
+		return
+	}
+	cm.finishClose(final, acks)
+}
+
+// finishClose sends everyone the final hash and who agreed with it, and
+// leaves the session
+func (cm *CollabManager) finishClose(final protocol.DocumentDigest, acks map[string]protocol.DocumentDigest) {
+	session := cm.hostSession()
+	if session == nil {
+		return
+	}
+	event := protocol.SessionClosedEvent{
+		SessionID: session.ID,
+		ClosedBy:  cm.sessionManager.GetUserID(),
+		SHA256:    final.SHA256,
+		Version:   final.Version,
+		Bytes:     final.Bytes,
+		Agreed:    []string{},
+		Diverged:  []string{},
+		Missing:   []string{},
+		Matches:   true,
+	}
+	for _, userID := range cm.p2pManager.GetConnectedPeers() {
+		digest, ok := acks[userID]
+		switch {
+		case !ok:
+			event.Missing = append(event.Missing, userID)
+		case digest.SHA256 == final.SHA256:
+			event.Agreed = append(event.Agreed, userID)
+		default:
+			event.Diverged = append(event.Diverged, userID)
+		}
+	}
+	sort.Strings(event.Agreed)
+	sort.Strings(event.Diverged)
+	sort.Strings(event.Missing)
+	event.Unanimous = len(event.Diverged) == 0 && len(event.Missing) == 0
+	
+	log.Printf("Closing session %s at version %d (%d agreed, %d diverged, %d missing)",
+		session.ID, final.Version, len(event.Agreed), len(event.Diverged), len(event.Missing))
+	if err := cm.broadcastToPeers(protocol.MsgSessionClosed, event); err != nil {
+		log.Printf("Failed to send session close: %v", err)
+	}
+	cm.sendSessionClosed(event)
+	if err := cm.sendMessage(cm.handleLeaveSession(&protocol.LeaveSessionRequest{})); err != nil {
+		log.Printf("Failed to send response: %v", err)
+	}
+}
+
+// handlePeerCloseProposed answers the host's proposal with the local
+// document's digest, once what is queued has been applied. Neovim is told
+// the session is closing the first time.
+func (cm *CollabManager) handlePeerCloseProposed(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy != userID || userID == cm.sessionManager.GetUserID() {
+		return
+	}
+	var proposal protocol.CloseProposal
+	if err := msg.ParseData(&proposal); err != nil {
+		return
+	}
+	
+	if cm.ending.begin() {
+		cm.ending.wait(func() {
+			cm.onLoop(func() { cm.abandonClose(userID) })
+		})
+		event, _ := protocol.NewMessage(protocol.MsgSessionClosing, protocol.SessionClosingEvent{
+			SessionID: session.ID,
+			ClosedBy:  userID,
+			Name:      peerName(session, userID),
+		})
+		if err := cm.sendMessage(event); err != nil {
+			log.Printf("Failed to send session closing: %v", err)
+		}
+	}
+	cm.opFlow.run(func(queued bool) {
+		cm.flushTyping()
+		cm.sendToPeer(userID, protocol.MsgCloseAck, protocol.CloseAckMessage{Round: proposal.Round, Digest: cm.syncManager.Digest()})
+	})
+}
+
+// abandonClose lets a member edit again when the host never finished closing
+func (cm *CollabManager) abandonClose(hostID string) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || !cm.ending.Closing() {
+		return
+	}
+	cm.ending.Reset()
+	log.Printf("Session %s didn't close; editing again", session.ID)
+	event, _ := protocol.NewMessage(protocol.MsgSessionClosing, protocol.SessionClosingEvent{
+		SessionID: session.ID,
+		ClosedBy:  hostID,
+		Name:      peerName(session, hostID),
+		Cancelled: true,
+	})
+	if err := cm.sendMessage(event); err != nil {
+		log.Printf("Failed to send session closing: %v", err)
+	}
+}
+
+// handlePeerSessionClosed checks the local document against the final hash
+// and leaves the session
+func (cm *CollabManager) handlePeerSessionClosed(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || session.CreatedBy != userID || userID == cm.sessionManager.GetUserID() {
+		return
+	}
+	var event protocol.SessionClosedEvent
+	if err := msg.ParseData(&event); err != nil || event.SessionID != session.ID {
+		return
+	}
+	
+	cm.onLoop(func() {
+		if current := cm.sessionManager.GetCurrentSession(); current == nil || current.ID != event.SessionID {
+			return
+		}
+		event.Matches = cm.syncManager.Digest().SHA256 == event.SHA256
+		if !event.Matches {
+			log.Printf("Document differs from the final one of session %s", event.SessionID)
+		}
+		cm.sendSessionClosed(event)
+		if err := cm.sendMessage(cm.handleLeaveSession(&protocol.LeaveSessionRequest{})); err != nil {
+			log.Printf("Failed to send response: %v", err)
+		}
+	})
+}
+
+func (cm *CollabManager) sendSessionClosed(event protocol.SessionClosedEvent) {
+	msg, _ := protocol.NewMessage(protocol.MsgSessionClosed, event)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send session close: %v", err)
+	}
+}
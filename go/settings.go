@@ -0,0 +1,36 @@
+package collab
+
+import (
+	"fmt"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Session presets
+const (
+	PresetPair      = "pair"      // everyone edits, the default
+	PresetBroadcast = "broadcast" // one-to-many live coding, e.g. a lecture
+)
+
+// Peer caps per preset. Every peer holds a connection to every other one, so
+// regular sessions stay small; broadcast sessions only need the host's.
+const (
+	defaultMaxPeers   = 16
+	broadcastMaxPeers = 200
+)
+
+// settingsForPreset returns the settings a preset stands for
+func settingsForPreset(preset string) (protocol.SessionSettings, error) {
+	switch preset {
+	case "", PresetPair:
+		return protocol.SessionSettings{Preset: PresetPair, MaxPeers: defaultMaxPeers}, nil
+	case PresetBroadcast:
+		return protocol.SessionSettings{
+			Preset:          PresetBroadcast,
+			ReadOnlyJoiners: true,
+			FollowHost:      true,
+			MaxPeers:        broadcastMaxPeers,
+		}, nil
+	}
+	return protocol.SessionSettings{}, fmt.Errorf("unknown session preset %q", preset)
+}
@@ -0,0 +1,691 @@
+package collab
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/EmreDay1/collab.nvim/go/p2p"
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// `collab serve -signaling` runs a signaling server for peer-to-peer
+// sessions, so a small team needs no infrastructure of its own beyond one
+// instance of the binary. It keeps a room per session ID with the user IDs
+// of those in it and relays offers, answers and candidates between them; the
+// sessions' traffic itself goes directly between peers. access_tokens and
+// server_limits apply as they do to the central server, a session counting
+// as a room. With cluster set, several signaling servers share their rooms
+// through Redis as `collab serve` instances share sessions: a room lives on
+// the instance that claimed it, and members who land on another are passed
+// through to it.
+//
+// Rooms must not outlive the clients in them. Every member is pinged each
+// sweep; one that has sent nothing, pongs included, for
+// signalingMemberTimeout has crashed or lost its network and is dropped,
+// and a room is closed with its last member. With session_ttl_minutes, a
+// room nobody has joined or signaled in for that long is closed too.
+const (
+	maxSignalingRoomSize   = 64
+	signalingSweepInterval = 30 * time.Second
+	signalingMemberTimeout = 90 * time.Second
+)
+
+// signalingMember is one connection in a room
+type signalingMember struct {
+	userID     string
+	relayRTTs  map[string]int64
+	conn       *websocket.Conn
+	activity   *activityConn // nil when not accepted by Serve
+	writeMutex sync.Mutex
+}
+
+// silentFor says how long the member's connection has sent nothing
+func (m *signalingMember) silentFor(now time.Time) time.Duration {
+	if m.activity == nil {
+		return 0
+	}
+	return now.Sub(time.Unix(0, m.activity.lastRead.Load()))
+}
+
+// ping sends a WebSocket ping, which clients answer without being asked to
+func (m *signalingMember) ping() error {
+	m.writeMutex.Lock()
+	defer m.writeMutex.Unlock()
+	m.conn.SetWriteDeadline(time.Now().Add(serverWriteTimeout))
+	m.conn.PayloadType = websocket.PingFrame
+	_, err := m.conn.Write(nil)
+	m.conn.PayloadType = websocket.TextFrame
+	if err != nil {
+		m.conn.Close()
+	}
+	return err
+}
+
+func (m *signalingMember) send(msg protocol.SignalMessage) error {
+	m.writeMutex.Lock()
+	defer m.writeMutex.Unlock()
+	m.conn.SetWriteDeadline(time.Now().Add(serverWriteTimeout))
+	if err := websocket.JSON.Send(m.conn, msg); err != nil {
+		m.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// sendRaw sends a message passed on from another instance as it came
+func (m *signalingMember) sendRaw(data string) error {
+	m.writeMutex.Lock()
+	defer m.writeMutex.Unlock()
+	m.conn.SetWriteDeadline(time.Now().Add(serverWriteTimeout))
+	if err := websocket.Message.Send(m.conn, data); err != nil {
+		m.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// signalingRoom is the members of one session. Token is the name of the
+// access token that opened it, if any.
+type signalingRoom struct {
+	members    map[string]*signalingMember
+	token      string
+	createdAt  time.Time
+	lastActive time.Time // last join or signal
+}
+
+// SignalingServer relays signaling between the members of each room
+type SignalingServer struct {
+	rooms       map[string]*signalingRoom
+	forwarded   map[*signalingMember]bool // passed through to other instances
+	roomTTL     time.Duration             // 0 when idle rooms are kept
+	cluster     *serverCluster            // nil for a standalone server
+	tokens      AccessTokens              // none when anyone may connect
+	limits      ServerLimits
+	connections *connectionCounter
+	mutex       sync.Mutex
+}
+
+// activityConn is an accepted connection that records when it last read
+// anything
+type activityConn struct {
+	net.Conn
+	lastRead atomic.Int64 // Unix nanoseconds
+}
+
+func (c *activityConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.lastRead.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// activityListener hands out connections as activityConns
+type activityListener struct {
+	net.Listener
+}
+
+func (l activityListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &activityConn{Conn: conn}
+	c.lastRead.Store(time.Now().UnixNano())
+	return c, nil
+}
+
+// activityKey holds a request's activityConn in its context
+type activityKey struct{}
+
+func NewSignalingServer() *SignalingServer {
+	return &SignalingServer{
+		rooms:       make(map[string]*signalingRoom),
+		forwarded:   make(map[*signalingMember]bool),
+		connections: newConnectionCounter(),
+	}
+}
+
+// SetLimits caps connections and rooms; set it before Serve
+func (ss *SignalingServer) SetLimits(limits ServerLimits) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.limits = limits
+}
+
+// SetAccessTokens has the server require a token from every client; set it
+// before Serve
+func (ss *SignalingServer) SetAccessTokens(tokens AccessTokens) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.tokens = tokens
+}
+
+// SetRoomTTL has Serve close rooms nobody has joined or signaled in for
+// ttl; 0 keeps them until everyone has left
+func (ss *SignalingServer) SetRoomTTL(ttl time.Duration) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.roomTTL = ttl
+}
+
+// SetCluster has the server share its rooms with the other instances of a
+// cluster; set it before Serve
+func (ss *SignalingServer) SetCluster(cluster *serverCluster) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.cluster = cluster
+}
+
+// runSignalingServer implements `collab serve -signaling` on listener,
+// serving room stats on adminListen when it is set
+func runSignalingServer(config *Config, listener net.Listener, adminListen string) error {
+	server := NewSignalingServer()
+	server.SetLimits(config.ServerLimits)
+	if config.AccessTokens.enabled() {
+		server.SetAccessTokens(config.AccessTokens)
+		log.Printf("Requiring an access token from clients")
+	}
+	var clusterListener net.Listener
+	if config.Cluster.enabled() {
+		cluster, err := newServerCluster(config.Cluster)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		if clusterListener, err = net.Listen("tcp", config.Cluster.Listen); err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to listen on %s: %v", config.Cluster.Listen, err)
+		}
+		server.SetCluster(cluster)
+		go server.serve(clusterListener, false)
+		log.Printf("Joined the cluster as %s", cluster.address)
+	}
+	if config.SessionTTLMinutes > 0 {
+		server.SetRoomTTL(time.Duration(config.SessionTTLMinutes) * time.Minute)
+		log.Printf("Closing rooms idle for %d minutes", config.SessionTTLMinutes)
+	}
+	var adminListener net.Listener
+	if adminListen != "" {
+		var err error
+		if adminListener, err = net.Listen("tcp", adminListen); err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to listen on %s: %v", adminListen, err)
+		}
+		go func() {
+			if err := serveStats(adminListener, func() interface{} { return server.Stats() }); err != nil {
+				log.Printf("Admin endpoint failed: %v", err)
+			}
+		}()
+		log.Printf("Serving room stats on http://%s/sessions", adminListener.Addr())
+	}
+	
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Println("Shutting down signaling server...")
+		listener.Close()
+		if clusterListener != nil {
+			clusterListener.Close()
+		}
+		if adminListener != nil {
+			adminListener.Close()
+		}
+	}()
+	
+	log.Printf("Serving signaling for peer-to-peer sessions on %s", listener.Addr())
+	return server.Serve(listener)
+}
+
+// Serve accepts WebSocket connections on any path until the listener is
+// closed, sweeping out dead members and idle rooms meanwhile
+func (ss *SignalingServer) Serve(listener net.Listener) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go ss.sweepRooms(stop)
+	if ss.cluster != nil {
+		go ss.cluster.renewClaims(stop)
+	}
+	return ss.serve(listener, true)
+}
+
+// serve accepts WebSocket connections on listener until it is closed.
+// Connections passed on by the rest of a cluster aren't limited again.
+func (ss *SignalingServer) serve(listener net.Listener, limited bool) error {
+	ws := websocket.Server{
+		// Clients aren't browsers, so there is no origin to check
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   ss.handle,
+	}
+	var handler http.Handler = ws
+	if limited {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { ss.admit(w, r, ws) })
+	}
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: protocol.ServerHandshakeTimeout,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, activityKey{}, conn)
+		},
+	}
+	err := server.Serve(activityListener{listener})
+	if err == http.ErrServerClosed || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// admit counts a connection before upgrading it, refusing it when it is
+// over a limit
+func (ss *SignalingServer) admit(w http.ResponseWriter, r *http.Request, ws websocket.Server) {
+	ss.mutex.Lock()
+	limits := ss.limits
+	ss.mutex.Unlock()
+	
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "bad remote address", http.StatusBadRequest)
+		return
+	}
+	host, err := ss.connections.acquire(addr, limits)
+	if err != nil {
+		log.Printf("Refused connection from %s: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer ss.connections.release(host)
+	ws.ServeHTTP(w, r)
+}
+
+// handle reads a connection's join, then relays what it sends to the rest
+// of its room until it disconnects
+func (ss *SignalingServer) handle(conn *websocket.Conn) {
+	defer conn.Close()
+	conn.MaxPayloadBytes = p2p.MaxSignalBlobLen
+	refuse := func(reason string) {
+		websocket.JSON.Send(conn, protocol.SignalMessage{Type: protocol.SignalError, Error: reason})
+	}
+	
+	conn.SetDeadline(time.Now().Add(protocol.ServerHandshakeTimeout))
+	var join protocol.SignalMessage
+	if err := websocket.JSON.Receive(conn, &join); err != nil {
+		return
+	}
+	if join.Type != protocol.SignalJoin || join.SessionID == "" || join.UserID == "" {
+		refuse("invalid join")
+		return
+	}
+	grant, err := ss.authorize(conn.Request())
+	if err != nil {
+		log.Printf("Refused %s: %v", join.UserID, err)
+		refuse(err.Error())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	
+	member := &signalingMember{userID: join.UserID, relayRTTs: join.RelayRTTs, conn: conn}
+	member.activity, _ = conn.Request().Context().Value(activityKey{}).(*activityConn)
+	
+	// In a cluster, a room's members meet on the instance that owns it
+	owner, err := ss.cluster.claim(join.SessionID)
+	if err != nil {
+		log.Printf("Refused %s: %v", join.UserID, err)
+		refuse("cluster unavailable")
+		return
+	}
+	if owner != "" {
+		if err := ss.forward(member, join, owner); err != nil {
+			log.Printf("Failed to pass %s on to %s: %v", join.UserID, owner, err)
+			refuse(err.Error())
+		}
+		return
+	}
+	
+	peers, relays, err := ss.enter(join.SessionID, member, grant)
+	if err != nil {
+		ss.releaseRoom(join.SessionID)
+		refuse(err.Error())
+		return
+	}
+	defer ss.leave(join.SessionID, member)
+	if err := member.send(protocol.SignalMessage{Type: protocol.SignalPeers, SessionID: join.SessionID, Peers: peers, PeerRelays: relays}); err != nil {
+		return
+	}
+	ss.broadcast(join.SessionID, member, protocol.SignalMessage{Type: protocol.SignalPeerJoined, From: member.userID})
+	
+	for {
+		var msg protocol.SignalMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			if err != io.EOF {
+				log.Printf("Signaling connection of %s closed: %v", member.userID, err)
+			}
+			return
+		}
+		switch msg.Type {
+		case protocol.SignalOffer, protocol.SignalAnswer, protocol.SignalCandidate:
+			ss.relay(join.SessionID, member, msg)
+		}
+	}
+}
+
+// authorize checks the access token a client sent, when the server requires
+// one. The grant is nil when it doesn't.
+func (ss *SignalingServer) authorize(r *http.Request) (*tokenGrant, error) {
+	ss.mutex.Lock()
+	tokens := ss.tokens
+	ss.mutex.Unlock()
+	if !tokens.enabled() {
+		return nil, nil
+	}
+	grant, err := tokens.Verify(r.Header.Get(protocol.AccessTokenHeader), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+// enter adds a member to its room, opening the room if needed, and returns
+// who was already in it with their round trips to the TURN servers
+func (ss *SignalingServer) enter(sessionID string, member *signalingMember, grant *tokenGrant) ([]string, map[string]map[string]int64, error) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	
+	room, ok := ss.rooms[sessionID]
+	if !ok {
+		if ss.limits.MaxSessions > 0 && len(ss.rooms) >= ss.limits.MaxSessions {
+			return nil, nil, fmt.Errorf("server is at its limit of %d sessions", ss.limits.MaxSessions)
+		}
+		if grant != nil && grant.maxSessions > 0 && ss.tokenRooms(grant.name) >= grant.maxSessions {
+			return nil, nil, fmt.Errorf("access token %s is at its limit of %d sessions", grant.name, grant.maxSessions)
+		}
+		room = &signalingRoom{members: make(map[string]*signalingMember), createdAt: time.Now()}
+		if grant != nil {
+			room.token = grant.name
+		}
+		ss.rooms[sessionID] = room
+	}
+	if _, taken := room.members[member.userID]; taken {
+		return nil, nil, fmt.Errorf("%s is already in the session", member.userID)
+	}
+	if len(room.members) >= maxSignalingRoomSize {
+		return nil, nil, fmt.Errorf("session is full")
+	}
+	
+	peers := make([]string, 0, len(room.members))
+	relays := make(map[string]map[string]int64)
+	for userID, other := range room.members {
+		peers = append(peers, userID)
+		if len(other.relayRTTs) > 0 {
+			relays[userID] = other.relayRTTs
+		}
+	}
+	room.members[member.userID] = member
+	room.lastActive = time.Now()
+	return peers, relays, nil
+}
+
+// tokenRooms counts the open rooms a token opened. Caller holds ss.mutex.
+func (ss *SignalingServer) tokenRooms(name string) int {
+	count := 0
+	for _, room := range ss.rooms {
+		if room.token == name {
+			count++
+		}
+	}
+	return count
+}
+
+// leave removes a member, closing its room once it is empty
+func (ss *SignalingServer) leave(sessionID string, member *signalingMember) {
+	ss.mutex.Lock()
+	room, ok := ss.rooms[sessionID]
+	if !ok || room.members[member.userID] != member {
+		ss.mutex.Unlock()
+		return
+	}
+	delete(room.members, member.userID)
+	closed := len(room.members) == 0
+	if closed {
+		delete(ss.rooms, sessionID)
+	}
+	ss.mutex.Unlock()
+	
+	if closed {
+		ss.releaseRoom(sessionID)
+		return
+	}
+	ss.broadcast(sessionID, member, protocol.SignalMessage{Type: protocol.SignalPeerLeft, From: member.userID})
+}
+
+// releaseRoom gives up the cluster's claim on a room unless it is open here
+func (ss *SignalingServer) releaseRoom(sessionID string) {
+	ss.mutex.Lock()
+	_, open := ss.rooms[sessionID]
+	ss.mutex.Unlock()
+	if !open {
+		ss.cluster.release(sessionID)
+	}
+}
+
+// forward passes a member whose join was already read through to the
+// instance that owns its room, relaying messages both ways as they are
+// until either side disconnects. The owner checks the member's access token
+// again.
+func (ss *SignalingServer) forward(member *signalingMember, join protocol.SignalMessage, owner string) error {
+	unreachable := fmt.Errorf("the session's signaling server is unreachable")
+	config, err := websocket.NewConfig("ws://"+owner+"/", "http://localhost/")
+	if err != nil {
+		return err
+	}
+	if token := member.conn.Request().Header.Get(protocol.AccessTokenHeader); token != "" {
+		config.Header = http.Header{protocol.AccessTokenHeader: []string{token}}
+	}
+	config.Dialer = &net.Dialer{Timeout: clusterDialTimeout}
+	upstream, err := websocket.DialConfig(config)
+	if err != nil {
+		return unreachable
+	}
+	defer upstream.Close()
+	upstream.MaxPayloadBytes = p2p.MaxSignalBlobLen
+	upstream.SetWriteDeadline(time.Now().Add(serverWriteTimeout))
+	if err := websocket.JSON.Send(upstream, join); err != nil {
+		return unreachable
+	}
+	
+	// The sweep pings and drops forwarded members like those in rooms
+	ss.mutex.Lock()
+	ss.forwarded[member] = true
+	ss.mutex.Unlock()
+	defer func() {
+		ss.mutex.Lock()
+		delete(ss.forwarded, member)
+		ss.mutex.Unlock()
+	}()
+	
+	done := make(chan struct{}, 2)
+	go func() {
+		for {
+			var data string
+			if err := websocket.Message.Receive(upstream, &data); err != nil || member.sendRaw(data) != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		for {
+			var data string
+			if err := websocket.Message.Receive(member.conn, &data); err != nil {
+				break
+			}
+			upstream.SetWriteDeadline(time.Now().Add(serverWriteTimeout))
+			if err := websocket.Message.Send(upstream, data); err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}()
+	<-done
+	member.conn.Close()
+	upstream.Close()
+	<-done
+	return nil
+}
+
+// relay passes a message on to the member it is addressed to
+func (ss *SignalingServer) relay(sessionID string, from *signalingMember, msg protocol.SignalMessage) {
+	ss.mutex.Lock()
+	var target *signalingMember
+	if room, ok := ss.rooms[sessionID]; ok {
+		target = room.members[msg.To]
+		room.lastActive = time.Now()
+	}
+	ss.mutex.Unlock()
+	
+	if target == nil || target == from {
+		from.send(protocol.SignalMessage{Type: protocol.SignalError, Error: fmt.Sprintf("%s is not in the session", msg.To)})
+		return
+	}
+	msg.From = from.userID
+	msg.To = ""
+	msg.SessionID = ""
+	if err := target.send(msg); err != nil {
+		log.Printf("Failed to relay to %s: %v", target.userID, err)
+	}
+}
+
+// broadcast sends msg to everyone in the room but from
+func (ss *SignalingServer) broadcast(sessionID string, from *signalingMember, msg protocol.SignalMessage) {
+	ss.mutex.Lock()
+	var members []*signalingMember
+	if room, ok := ss.rooms[sessionID]; ok {
+		for _, member := range room.members {
+			if member != from {
+				members = append(members, member)
+			}
+		}
+	}
+	ss.mutex.Unlock()
+	
+	for _, member := range members {
+		if err := member.send(msg); err != nil {
+			log.Printf("Failed to relay to %s: %v", member.userID, err)
+		}
+	}
+}
+
+// sweepRooms pings members, drops those that stopped answering and closes
+// idle rooms until stop is closed
+func (ss *SignalingServer) sweepRooms(stop <-chan struct{}) {
+	ticker := time.NewTicker(signalingSweepInterval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case now := <-ticker.C:
+			ss.sweep(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sweep closes the rooms idle past the TTL, disconnecting their members,
+// disconnects members silent for signalingMemberTimeout and pings the rest.
+// A disconnected member leaves its room as usual, which tells the others.
+func (ss *SignalingServer) sweep(now time.Time) {
+	var closed []string
+	var expired, silent, alive []*signalingMember
+	check := func(member *signalingMember) {
+		if member.silentFor(now) >= signalingMemberTimeout {
+			silent = append(silent, member)
+		} else {
+			alive = append(alive, member)
+		}
+	}
+	ss.mutex.Lock()
+	for sessionID, room := range ss.rooms {
+		if ss.roomTTL > 0 && now.Sub(room.lastActive) >= ss.roomTTL {
+			delete(ss.rooms, sessionID)
+			closed = append(closed, sessionID)
+			log.Printf("Closing room %s: idle for %v", sessionID, now.Sub(room.lastActive).Round(time.Minute))
+			for _, member := range room.members {
+				expired = append(expired, member)
+			}
+			continue
+		}
+		for _, member := range room.members {
+			check(member)
+		}
+	}
+	for member := range ss.forwarded {
+		check(member)
+	}
+	ss.mutex.Unlock()
+	
+	for _, sessionID := range closed {
+		ss.releaseRoom(sessionID)
+	}
+	for _, member := range expired {
+		member.send(protocol.SignalMessage{Type: protocol.SignalError, Error: "session expired on the signaling server"})
+		member.conn.Close()
+	}
+	for _, member := range silent {
+		log.Printf("Dropping %s from signaling: nothing received for %v", member.userID, member.silentFor(now).Round(time.Second))
+		member.conn.Close()
+	}
+	for _, member := range alive {
+		member.ping()
+	}
+}
+
+// SignalingStats is what the signaling server's admin endpoint reports
+type SignalingStats struct {
+	Connections int                  `json:"connections"`
+	Addresses   int                  `json:"addresses"`
+	Sessions    []SignalingRoomStats `json:"sessions"`
+}
+
+type SignalingRoomStats struct {
+	SessionID   string    `json:"session_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Peers       int       `json:"peers"`
+	IdleSeconds int64     `json:"idle_seconds"`
+}
+
+// Stats lists the open rooms, oldest first
+func (ss *SignalingServer) Stats() SignalingStats {
+	stats := SignalingStats{Sessions: []SignalingRoomStats{}}
+	stats.Connections, stats.Addresses = ss.connections.counts()
+	
+	now := time.Now()
+	ss.mutex.Lock()
+	for sessionID, room := range ss.rooms {
+		stats.Sessions = append(stats.Sessions, SignalingRoomStats{
+			SessionID:   sessionID,
+			CreatedAt:   room.createdAt,
+			Peers:       len(room.members),
+			IdleSeconds: int64(now.Sub(room.lastActive).Seconds()),
+		})
+	}
+	ss.mutex.Unlock()
+	sort.Slice(stats.Sessions, func(i, j int) bool {
+		return stats.Sessions[i].CreatedAt.Before(stats.Sessions[j].CreatedAt)
+	})
+	return stats
+}
@@ -0,0 +1,226 @@
+package collab
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// startTestSignaling serves signaling on a local port
+func startTestSignaling(t *testing.T) (*SignalingServer, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := NewSignalingServer()
+	go server.Serve(listener)
+	return server, "ws://" + listener.Addr().String() + "/"
+}
+
+// startTestRedis answers the commands cluster claims use, without expiry,
+// on a local port
+func startTestRedis(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	
+	keys := make(map[string]string)
+	var mutex sync.Mutex
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			args := make([]string, count)
+			for i := range args {
+				reader.ReadString('\n')
+				arg, _ := reader.ReadString('\n')
+				args[i] = strings.TrimSuffix(arg, "\r\n")
+			}
+			
+			mutex.Lock()
+			reply := "+OK\r\n"
+			switch args[0] {
+			case "SET":
+				if _, taken := keys[args[1]]; taken {
+					reply = "$-1\r\n"
+				} else {
+					keys[args[1]] = args[2]
+				}
+			case "GET":
+				if value, ok := keys[args[1]]; ok {
+					reply = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+				} else {
+					reply = "$-1\r\n"
+				}
+			case "DEL":
+				delete(keys, args[1])
+				reply = ":1\r\n"
+			case "PEXPIRE":
+				reply = ":1\r\n"
+			}
+			mutex.Unlock()
+			io.WriteString(conn, reply)
+		}
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return "redis://" + listener.Addr().String()
+}
+
+// startTestSignalingInstance serves signaling on a local port as one
+// instance of a cluster
+func startTestSignalingInstance(t *testing.T, redisURL string) (*SignalingServer, string) {
+	t.Helper()
+	clusterListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clusterListener.Close() })
+	cluster, err := newServerCluster(ClusterConfig{RedisURL: redisURL, Listen: clusterListener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := NewSignalingServer()
+	server.SetCluster(cluster)
+	go server.serve(clusterListener, false)
+	go server.Serve(listener)
+	return server, "ws://" + listener.Addr().String() + "/"
+}
+
+// joinTestRoom joins a room as userID and reads the peers reply
+func joinTestRoom(t *testing.T, address, sessionID, userID string) *websocket.Conn {
+	t.Helper()
+	conn, _ := joinTestRoomPeers(t, address, sessionID, userID)
+	return conn
+}
+
+// joinTestRoomPeers joins a room as userID and returns who was in it
+func joinTestRoomPeers(t *testing.T, address, sessionID, userID string) (*websocket.Conn, []string) {
+	t.Helper()
+	conn, err := websocket.Dial(address, "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := websocket.JSON.Send(conn, protocol.SignalMessage{Type: protocol.SignalJoin, SessionID: sessionID, UserID: userID}); err != nil {
+		t.Fatal(err)
+	}
+	var reply protocol.SignalMessage
+	if err := websocket.JSON.Receive(conn, &reply); err != nil || reply.Type != protocol.SignalPeers {
+		t.Fatalf("join reply = %+v, %v", reply, err)
+	}
+	return conn, reply.Peers
+}
+
+// waitForRooms waits until the server's stats list n rooms
+func waitForRooms(t *testing.T, server *SignalingServer, n int) SignalingStats {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := server.Stats()
+		if len(stats.Sessions) == n {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rooms = %+v, want %d", stats.Sessions, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSignalingRoomExpires(t *testing.T) {
+	server, address := startTestSignaling(t)
+	alice := joinTestRoom(t, address, "s1", "alice")
+	joinTestRoom(t, address, "s1", "bob")
+	
+	stats := waitForRooms(t, server, 1)
+	if room := stats.Sessions[0]; room.SessionID != "s1" || room.Peers != 2 {
+		t.Errorf("room = %+v, want s1 with 2 peers", room)
+	}
+	
+	server.SetRoomTTL(time.Minute)
+	server.sweep(time.Now().Add(30 * time.Second))
+	waitForRooms(t, server, 1)
+	server.sweep(time.Now().Add(time.Minute))
+	waitForRooms(t, server, 0)
+	
+	var msg protocol.SignalMessage
+	websocket.JSON.Receive(alice, &msg)
+	if msg.Type == protocol.SignalPeerJoined {
+		websocket.JSON.Receive(alice, &msg)
+	}
+	if msg.Type != protocol.SignalError {
+		t.Errorf("alice got %+v, want the room's expiry", msg)
+	}
+}
+
+func TestSignalingDropsSilentMembers(t *testing.T) {
+	server, address := startTestSignaling(t)
+	joinTestRoom(t, address, "s1", "alice")
+	
+	server.sweep(time.Now())
+	waitForRooms(t, server, 1)
+	server.sweep(time.Now().Add(signalingMemberTimeout + time.Second))
+	waitForRooms(t, server, 0)
+}
+
+func TestSignalingClusterSharesRooms(t *testing.T) {
+	redisURL := startTestRedis(t)
+	first, firstAddress := startTestSignalingInstance(t, redisURL)
+	second, secondAddress := startTestSignalingInstance(t, redisURL)
+	
+	alice := joinTestRoom(t, firstAddress, "s1", "alice")
+	bob, peers := joinTestRoomPeers(t, secondAddress, "s1", "bob")
+	if len(peers) != 1 || peers[0] != "alice" {
+		t.Fatalf("bob found %v on the second instance, want alice from the first", peers)
+	}
+	if stats := waitForRooms(t, first, 1); stats.Sessions[0].Peers != 2 {
+		t.Errorf("first instance's room = %+v, want both peers", stats.Sessions[0])
+	}
+	waitForRooms(t, second, 0)
+	
+	// Offers reach across instances
+	var msg protocol.SignalMessage
+	if err := websocket.JSON.Receive(alice, &msg); err != nil || msg.Type != protocol.SignalPeerJoined || msg.From != "bob" {
+		t.Fatalf("alice got %+v, %v, want bob joining", msg, err)
+	}
+	if err := websocket.JSON.Send(bob, protocol.SignalMessage{Type: protocol.SignalOffer, To: "alice", SDP: "offer"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := websocket.JSON.Receive(alice, &msg); err != nil || msg.Type != protocol.SignalOffer || msg.From != "bob" {
+		t.Errorf("alice got %+v, %v, want bob's offer", msg, err)
+	}
+}
@@ -0,0 +1,97 @@
+package collab
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/EmreDay1/collab.nvim/go/p2p"
+)
+
+// `collab serve -signaling -stun` also answers STUN binding requests over
+// UDP on the port it signals on, so a self-hosted team needs no public STUN
+// servers: peers list stun:host:port in ice_servers and learn their public
+// addresses from the same binary. Only binding requests are answered, with
+// the address they came from in an XOR-MAPPED-ADDRESS (RFC 5389); relaying
+// is left to TURN servers.
+const (
+	stunHeaderLen        = 20
+	stunBindingRequest   = 0x0001
+	stunBindingSuccess   = 0x0101
+	stunXORMappedAddress = 0x0020
+)
+
+// listenSTUN answers STUN binding requests on address until the returned
+// connection is closed
+func listenSTUN(address string) (net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for STUN on %s: %v", address, err)
+	}
+	go func() {
+		if err := serveSTUN(conn); err != nil {
+			log.Printf("STUN listener failed: %v", err)
+		}
+	}()
+	log.Printf("Answering STUN binding requests on udp %s", conn.LocalAddr())
+	return conn, nil
+}
+
+// serveSTUN answers binding requests on conn until it is closed, ignoring
+// anything else
+func serveSTUN(conn net.PacketConn) error {
+	packet := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(packet)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if response := stunBindingResponse(packet[:n], udpAddr); response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+// stunBindingResponse answers a binding request from addr, or returns nil
+// when request isn't one
+func stunBindingResponse(request []byte, addr *net.UDPAddr) []byte {
+	if len(request) < stunHeaderLen ||
+		binary.BigEndian.Uint16(request[0:]) != stunBindingRequest ||
+		binary.BigEndian.Uint32(request[4:]) != p2p.STUNMagicCookie {
+		return nil
+	}
+	if length := int(binary.BigEndian.Uint16(request[2:])); length%4 != 0 || stunHeaderLen+length > len(request) {
+		return nil
+	}
+	
+	family, ip := byte(0x01), addr.IP.To4()
+	if ip == nil {
+		family, ip = 0x02, addr.IP.To16()
+	}
+	// The port is XORed with the magic cookie's top half, the address with
+	// the cookie followed by the transaction ID
+	key := request[4:stunHeaderLen]
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:], uint16(addr.Port)^uint16(p2p.STUNMagicCookie>>16))
+	for i := range ip {
+		value[4+i] = ip[i] ^ key[i]
+	}
+	
+	response := make([]byte, stunHeaderLen, stunHeaderLen+4+len(value))
+	binary.BigEndian.PutUint16(response[0:], stunBindingSuccess)
+	binary.BigEndian.PutUint16(response[2:], uint16(4+len(value)))
+	copy(response[4:], key)
+	response = binary.BigEndian.AppendUint16(response, stunXORMappedAddress)
+	response = binary.BigEndian.AppendUint16(response, uint16(len(value)))
+	return append(response, value...)
+}
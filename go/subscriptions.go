@@ -0,0 +1,121 @@
+package collab
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Neovim can turn off categories of events it never shows, so setups that
+// can't spare the cycles aren't flooded with them: subscribe with the
+// categories and "subscribe": false, and true to turn them back on. Every
+// category is on at start. Events of a category that is off are dropped
+// before they are serialized; answers to Neovim's requests always arrive.
+// Under the daemon, attached Neovims share one set of subscriptions.
+const (
+	EventsPresence = "presence" // peers' cursors and file switches
+	EventsChat     = "chat"
+	EventsMetrics  = "metrics"  // traffic, link quality, clock skew, slow operations, sync latency and lagging peers
+	EventsActivity = "activity" // raised hands, peers' capabilities and contribution reports
+)
+
+// eventCategories sorts the events that can be turned off
+var eventCategories = map[string]string{
+	protocol.MsgPresenceChanged:    EventsPresence,
+	protocol.MsgPeerSwitchedFile:   EventsPresence,
+	protocol.MsgChat:               EventsChat,
+	protocol.MsgBandwidthWarning:   EventsMetrics,
+	protocol.MsgSyncProfile:        EventsMetrics,
+	protocol.MsgClockSkew:          EventsMetrics,
+	protocol.MsgSlowOperation:      EventsMetrics,
+	protocol.MsgSyncDegraded:       EventsMetrics,
+	protocol.MsgPeerLagging:        EventsMetrics,
+	protocol.MsgHandsChanged:       EventsActivity,
+	protocol.MsgPeerCapabilities:   EventsActivity,
+	protocol.MsgContributionReport: EventsActivity,
+}
+
+// eventSubscriptions holds the categories Neovim turned off
+type eventSubscriptions struct {
+	off   map[string]bool
+	mutex sync.RWMutex
+}
+
+func newEventSubscriptions() *eventSubscriptions {
+	return &eventSubscriptions{off: make(map[string]bool)}
+}
+
+// wants tells whether Neovim receives events of msgType
+func (es *eventSubscriptions) wants(msgType string) bool {
+	category, ok := eventCategories[msgType]
+	if !ok {
+		return true
+	}
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+	return !es.off[category]
+}
+
+func (es *eventSubscriptions) set(categories []string, subscribe bool) {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	for _, category := range categories {
+		if subscribe {
+			delete(es.off, category)
+		} else {
+			es.off[category] = true
+		}
+	}
+}
+
+// subscribed lists the categories that are on
+func (es *eventSubscriptions) subscribed() []string {
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+	on := []string{}
+	for _, category := range []string{EventsActivity, EventsChat, EventsMetrics, EventsPresence} {
+		if !es.off[category] {
+			on = append(on, category)
+		}
+	}
+	return on
+}
+
+// sendEvent sends Neovim an event unless it turned off the event's category,
+// in which case data isn't serialized at all
+func (cm *CollabManager) sendEvent(msgType string, data interface{}) error {
+	if !cm.subscriptions.wants(msgType) {
+		return nil
+	}
+	msg, err := protocol.NewMessage(msgType, data)
+	if err != nil {
+		return err
+	}
+	return cm.sendMessage(msg)
+}
+
+func (cm *CollabManager) handleSubscribe(req *protocol.SubscribeRequest) *protocol.Message {
+	if len(req.Categories) == 0 {
+		return createErrorMessage("subscribe_failed", "categories are required")
+	}
+	known := make(map[string]bool)
+	for _, category := range eventCategories {
+		known[category] = true
+	}
+	for _, category := range req.Categories {
+		if !known[category] {
+			names := make([]string, 0, len(known))
+			for name := range known {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return createErrorMessage("subscribe_failed", fmt.Sprintf("unknown event category %q; use one of %v", category, names))
+		}
+	}
+	
+	cm.subscriptions.set(req.Categories, req.Subscribe)
+	msg, _ := protocol.NewMessage(protocol.MsgSubscriptions, protocol.SubscriptionsEvent{Subscribed: cm.subscriptions.subscribed()})
+	return msg
+}
@@ -0,0 +1,292 @@
+package collab
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// An edit made without control isn't applied, but it isn't lost either: it
+// goes to whoever has control as a suggestion, which their Neovim can show
+// as ghost text and they can accept with one action. Accepting applies it as
+// the controller's own edit. Edits from one peer in quick succession, such
+// as the keystrokes of a word, grow one suggestion rather than making one
+// each. Pending suggestions move with the document as it is edited.
+const (
+	suggestionGroupWindow = 2 * time.Second
+	
+	// Suggestions the controller keeps; the oldest go first
+	maxPendingSuggestions = 50
+)
+
+// editSuggestion is a peer's edits, in the order they would apply
+type editSuggestion struct {
+	id         string
+	userID     string
+	operations []protocol.Operation
+	updatedAt  time.Time
+}
+
+// SuggestionQueue holds the suggestions sent to the local user while they
+// have control
+type SuggestionQueue struct {
+	suggestions []*editSuggestion
+	nextID      int
+	mutex       sync.Mutex
+}
+
+// Add records a peer's edits, continuing their latest suggestion when it
+// was added to within suggestionGroupWindow
+func (sq *SuggestionQueue) Add(userID string, ops []protocol.Operation) *editSuggestion {
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+	
+	now := time.Now()
+	for i := len(sq.suggestions) - 1; i >= 0; i-- {
+		s := sq.suggestions[i]
+		if s.userID == userID && now.Sub(s.updatedAt) < suggestionGroupWindow {
+			s.operations = coalesceOperations(append(s.operations, ops...))
+			s.updatedAt = now
+			return s
+		}
+	}
+	
+	sq.nextID++
+	s := &editSuggestion{id: strconv.Itoa(sq.nextID), userID: userID, operations: coalesceOperations(ops), updatedAt: now}
+	sq.suggestions = append(sq.suggestions, s)
+	if len(sq.suggestions) > maxPendingSuggestions {
+		sq.suggestions = sq.suggestions[1:]
+	}
+	return s
+}
+
+// Take removes a suggestion to accept or dismiss it
+func (sq *SuggestionQueue) Take(id string) *editSuggestion {
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+	
+	for i, s := range sq.suggestions {
+		if s.id == id {
+			sq.suggestions = append(sq.suggestions[:i], sq.suggestions[i+1:]...)
+			return s
+		}
+	}
+	return nil
+}
+
+// Transform moves pending suggestions past an edit to the document. Text
+// a suggestion would delete that is already gone drops out of it.
+func (sq *SuggestionQueue) Transform(op protocol.Operation) {
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+	
+	for _, s := range sq.suggestions {
+		kept := s.operations[:0]
+		for _, suggested := range s.operations {
+			if suggested.Type == protocol.OpDelete {
+				end := transformOffset(suggested.Position+suggested.Length, op)
+				suggested.Position = transformOffset(suggested.Position, op)
+				suggested.Length = end - suggested.Position
+				if suggested.Length <= 0 {
+					continue
+				}
+			} else {
+				suggested.Position = transformOffset(suggested.Position, op)
+			}
+			kept = append(kept, suggested)
+		}
+		s.operations = kept
+	}
+}
+
+func (sq *SuggestionQueue) Reset() {
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+	sq.suggestions = nil
+}
+
+// canSuggest reports whether an edit Neovim made without control can go to
+// the controller: the local user's edits to a text document
+func (cm *CollabManager) canSuggest(userID string) bool {
+	return userID == cm.sessionManager.GetUserID() && cm.syncManager.GetContentMode() == collabsync.ContentModeText
+}
+
+// suggestEdits sends edits the local user made without control to the
+// controller, or to the host when nobody has it
+func (cm *CollabManager) suggestEdits(ops []protocol.DocumentOperation) *protocol.Message {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	
+	suggested := make([]protocol.Operation, 0, len(ops))
+	for i := range ops {
+		syncOp, failure := cm.convertDocumentOperation(&ops[i], cm.syncManager)
+		if failure != nil {
+			return failure
+		}
+		suggested = append(suggested, syncOp)
+	}
+	return cm.sendSuggestion(session, suggested)
+}
+
+// sendSuggestion sends edits to the controller, or to the host when nobody
+// has control, as a suggestion
+func (cm *CollabManager) sendSuggestion(session *session.Session, suggested []protocol.Operation) *protocol.Message {
+	session.Mutex.RLock()
+	controller := session.Controller
+	session.Mutex.RUnlock()
+	if controller == "" {
+		controller = session.CreatedBy
+	}
+	msg, err := protocol.NewMessage(protocol.MsgSuggestEdit, protocol.SuggestEditMessage{Operations: suggested})
+	if err == nil {
+		var payload []byte
+		if payload, err = msg.ToJSON(); err == nil {
+			err = cm.p2pManager.SendMessage(controller, payload)
+		}
+	}
+	if err != nil {
+		return createErrorMessage("suggest_edit_failed", err.Error())
+	}
+	return createStatusMessage("edit_suggested", "Sent to "+peerName(session, controller)+" as a suggestion")
+}
+
+// handlePeerSuggestEdit shows a peer's suggestion to the local user while
+// they have control
+func (cm *CollabManager) handlePeerSuggestEdit(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil {
+		return
+	}
+	if failure, _ := cm.editAccess(cm.sessionManager.GetUserID()); failure != nil {
+		log.Printf("Ignoring suggestion from %s without control", userID)
+		return
+	}
+	var req protocol.SuggestEditMessage
+	if err := msg.ParseData(&req); err != nil || len(req.Operations) == 0 || len(req.Operations) > maxBurstOperations {
+		return
+	}
+	for i := range req.Operations {
+		op := &req.Operations[i]
+		if (op.Type != protocol.OpInsert && op.Type != protocol.OpDelete) || op.Position < 0 || op.Length < 0 {
+			log.Printf("Ignoring malformed suggestion from %s", userID)
+			return
+		}
+		op.UserID = userID
+	}
+	
+	s := cm.suggestions.Add(userID, req.Operations)
+	forward, _ := protocol.NewMessage(protocol.MsgEditSuggested, cm.suggestionEvent(session, s))
+	if err := cm.sendMessage(forward); err != nil {
+		log.Printf("Failed to send suggestion: %v", err)
+	}
+}
+
+// suggestionEvent describes a suggestion by line and column in the document
+// as it is now
+func (cm *CollabManager) suggestionEvent(session *session.Session, s *editSuggestion) protocol.EditSuggestedEvent {
+	content := cm.syncManager.GetDocumentContent()
+	event := protocol.EditSuggestedEvent{ID: s.id, UserID: s.userID, Name: peerName(session, s.userID)}
+	for _, op := range s.operations {
+		line, column := lineColumnOf(content, op.Position)
+		client := cm.clientOperation(op)
+		event.Edits = append(event.Edits, protocol.SuggestedEdit{
+			Type:            client.Type,
+			Line:            line,
+			Column:          column,
+			Content:         client.Content,
+			ContentEncoding: client.ContentEncoding,
+			Length:          op.Length,
+		})
+	}
+	return event
+}
+
+// handleAcceptSuggestion applies a suggestion as the local user's edit and
+// hands it to Neovim, which didn't make it
+func (cm *CollabManager) handleAcceptSuggestion(ctx context.Context, req *protocol.AnswerSuggestionRequest) *protocol.Message {
+	if cm.sessionManager.GetCurrentSession() == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	userID := cm.sessionManager.GetUserID()
+	if failure, _ := cm.editAccess(userID); failure != nil {
+		return failure
+	}
+	s := cm.suggestions.Take(req.ID)
+	if s == nil {
+		return createErrorMessage("accept_suggestion_failed", "No suggestion "+req.ID)
+	}
+	
+	var event protocol.DocumentOperations
+	for _, op := range s.operations {
+		op.UserID = userID
+		op.ID = collabsync.GenerateOperationID(userID)
+		op.Timestamp = cm.syncManager.Timestamp()
+		op.VectorClock = nil
+		if response := cm.applyDocumentOperation(ctx, op); response.Type == protocol.MsgError {
+			cm.sendSuggestionEdits(event)
+			return response
+		}
+		event.Operations = append(event.Operations, cm.clientOperation(op))
+	}
+	cm.sendSuggestionEdits(event)
+	
+	cm.answerSuggestion(s, true)
+	return createStatusMessage("suggestion_accepted", fmt.Sprintf("Applied %d edits from %s", len(event.Operations), s.userID))
+}
+
+func (cm *CollabManager) sendSuggestionEdits(event protocol.DocumentOperations) {
+	if len(event.Operations) == 0 {
+		return
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgDocumentOperations, event)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send operations: %v", err)
+	}
+}
+
+func (cm *CollabManager) handleDismissSuggestion(req *protocol.AnswerSuggestionRequest) *protocol.Message {
+	s := cm.suggestions.Take(req.ID)
+	if s == nil {
+		return createErrorMessage("dismiss_suggestion_failed", "No suggestion "+req.ID)
+	}
+	cm.answerSuggestion(s, false)
+	return createStatusMessage("suggestion_dismissed", req.ID)
+}
+
+// answerSuggestion tells the peer who made a suggestion what became of it
+func (cm *CollabManager) answerSuggestion(s *editSuggestion, accepted bool) {
+	if s.userID == cm.sessionManager.GetUserID() {
+		return // proposed from the local user's own fork
+	}
+	cm.sendToPeer(s.userID, protocol.MsgSuggestionAnswered, protocol.SuggestionAnsweredEvent{
+		ID:       s.id,
+		Accepted: accepted,
+		Edits:    len(s.operations),
+	})
+}
+
+// handlePeerSuggestionAnswered tells Neovim the controller answered one of
+// the local user's suggestions
+func (cm *CollabManager) handlePeerSuggestionAnswered(userID string, msg *protocol.Message) {
+	if cm.sessionManager.GetCurrentSession() == nil {
+		return
+	}
+	var event protocol.SuggestionAnsweredEvent
+	if err := msg.ParseData(&event); err != nil {
+		return
+	}
+	event.AnsweredBy = userID
+	forward, _ := protocol.NewMessage(protocol.MsgSuggestionAnswered, event)
+	if err := cm.sendMessage(forward); err != nil {
+		log.Printf("Failed to send suggestion answer: %v", err)
+	}
+}
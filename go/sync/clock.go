@@ -0,0 +1,77 @@
+package sync
+
+import (
+	"sync"
+	"time"
+)
+
+// Operations are stamped by a hybrid logical clock rather than the bare
+// system clock, since conflict strategies order concurrent edits by their
+// timestamps and a peer whose clock is wrong would otherwise win or lose
+// every conflict. The clock runs at the host's time, as probed; on top of
+// that, a timestamp is never behind one already issued or seen on a peer's
+// operation, so an edit made after another always carries the later time.
+// Neovim gets a clock_skew event when the correction goes past
+// ClockSkewWarning, and when it drops back below it.
+const (
+	// Timestamps further ahead than this aren't taken up by the clock, so a
+	// peer with a wildly wrong clock can't drag everyone's along
+	maxTimestampLead = time.Minute
+	
+	// Clock offsets beyond this are reported as warnings
+	ClockSkewWarning = 2 * time.Second
+)
+
+// HybridClock issues operation timestamps in Unix nanoseconds
+type HybridClock struct {
+	offset time.Duration // added to the system clock
+	skewed bool          // whether offset is past ClockSkewWarning
+	last   int64
+	mutex  sync.Mutex
+}
+
+// Now returns a timestamp later than any issued or observed before
+func (hc *HybridClock) Now() int64 {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	
+	now := time.Now().Add(hc.offset).UnixNano()
+	if now <= hc.last {
+		now = hc.last + 1
+	}
+	hc.last = now
+	return now
+}
+
+// Observe takes up the timestamp of a peer's operation
+func (hc *HybridClock) Observe(timestamp int64) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	
+	if timestamp <= hc.last {
+		return
+	}
+	if lead := time.Duration(timestamp - time.Now().Add(hc.offset).UnixNano()); lead > maxTimestampLead {
+		return
+	}
+	hc.last = timestamp
+}
+
+// SetOffset corrects the system clock by offset, reporting whether that
+// took the correction across ClockSkewWarning
+func (hc *HybridClock) SetOffset(offset time.Duration) bool {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	
+	hc.offset = offset
+	skewed := offset.Abs() > ClockSkewWarning
+	changed := skewed != hc.skewed
+	hc.skewed = skewed
+	return changed
+}
+
+func (hc *HybridClock) Offset() time.Duration {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	return hc.offset
+}
@@ -0,0 +1,249 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"unicode/utf8"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// The host picks how concurrent edits are ordered when creating a session.
+// Every peer and the server must order them alike to converge, so strategies
+// only look at what an operation carries, plus the controller for
+// controller_wins, which control changes keep in step. The manual strategy
+// orders like timestamp, but holds a remote edit that touches text a local
+// edit not yet seen by its author touched, until the user accepts or rejects
+// it. A rejected edit is applied and then reverted by a local edit, so peers
+// converge on the rejection too.
+const (
+	ConflictTimestamp      = "timestamp" // the default
+	ConflictControllerWins = "controller_wins"
+	ConflictLastWriterWins = "last_writer_wins"
+	ConflictManual         = "manual"
+)
+
+var ErrOperationHeld = errors.New("operation held for manual conflict resolution")
+
+// ConflictRank orders concurrent operations. The lower ranked one goes
+// first: where both insert at the same position its text ends up first.
+type ConflictRank struct {
+	Primary   int64
+	Secondary int64
+}
+
+func (r ConflictRank) Before(other ConflictRank) bool {
+	if r.Primary != other.Primary {
+		return r.Primary < other.Primary
+	}
+	return r.Secondary < other.Secondary
+}
+
+// ConflictStrategy ranks concurrent operations for the transform
+type ConflictStrategy interface {
+	Name() string
+	Rank(op protocol.Operation) ConflictRank
+}
+
+// NewConflictStrategy returns the named strategy. controller reports who
+// has control, for controller_wins.
+func NewConflictStrategy(name string, controller func() string) (ConflictStrategy, error) {
+	switch name {
+	case "", ConflictTimestamp:
+		return TimestampStrategy{}, nil
+	case ConflictControllerWins:
+		return controllerWinsStrategy{controller: controller}, nil
+	case ConflictLastWriterWins:
+		return lastWriterWinsStrategy{}, nil
+	case ConflictManual:
+		return manualStrategy{}, nil
+	}
+	return nil, fmt.Errorf("unknown conflict strategy %q", name)
+}
+
+// timestampPriority mixes a hash of the user and operation IDs with the
+// timestamp, for an order that is deterministic but not always the same user
+func timestampPriority(op protocol.Operation) int64 {
+	return hashString(op.UserID+op.ID) + op.Timestamp
+}
+
+type TimestampStrategy struct{}
+
+func (TimestampStrategy) Name() string { return ConflictTimestamp }
+
+func (TimestampStrategy) Rank(op protocol.Operation) ConflictRank {
+	return ConflictRank{Primary: timestampPriority(op)}
+}
+
+// controllerWinsStrategy puts the controller's edits first
+type controllerWinsStrategy struct {
+	controller func() string
+}
+
+func (controllerWinsStrategy) Name() string { return ConflictControllerWins }
+
+func (s controllerWinsStrategy) Rank(op protocol.Operation) ConflictRank {
+	rank := ConflictRank{Primary: 1, Secondary: timestampPriority(op)}
+	if s.controller != nil && op.UserID == s.controller() {
+		rank.Primary = 0
+	}
+	return rank
+}
+
+// lastWriterWinsStrategy puts the most recent edit first
+type lastWriterWinsStrategy struct{}
+
+func (lastWriterWinsStrategy) Name() string { return ConflictLastWriterWins }
+
+func (lastWriterWinsStrategy) Rank(op protocol.Operation) ConflictRank {
+	return ConflictRank{Primary: -op.Timestamp, Secondary: hashString(op.UserID + op.ID)}
+}
+
+// manualStrategy orders like timestamp; the sync manager holds conflicts
+type manualStrategy struct {
+	TimestampStrategy
+}
+
+func (manualStrategy) Name() string { return ConflictManual }
+
+// SetConflictStrategy changes how concurrent operations are ordered from now
+// on. Leaving the manual strategy doesn't release operations already held.
+func (sm *SyncManager) SetConflictStrategy(strategy ConflictStrategy) {
+	sm.do(func() { sm.strategy = strategy })
+}
+
+// SetConflictHeldHandler sets what is told when the manual strategy starts
+// holding remote operations: the first one and the local ones it conflicts
+// with
+func (sm *SyncManager) SetConflictHeldHandler(onConflictHeld func(remoteOp protocol.Operation, localOps []protocol.Operation)) {
+	sm.do(func() { sm.onConflictHeld = onConflictHeld })
+}
+
+// HeldOperations reports how many remote operations wait for a resolution
+func (sm *SyncManager) HeldOperations() int {
+	var held int
+	sm.do(func() { held = len(sm.held) })
+	return held
+}
+
+// ResolveHeld applies the held operations in order. Rejecting reverts the
+// first one, the conflict the user was asked about, with local operations
+// that are returned for relaying; the document then reads as it did before.
+// It returns the operations applied and not reverted. A later operation that
+// conflicts again is held again, with the rest behind it.
+func (sm *SyncManager) ResolveHeld(ctx context.Context, accept bool) (applied, revert []protocol.Operation, err error) {
+	err = errSyncClosed
+	sm.do(func() { applied, revert, err = sm.resolveHeld(ctx, accept) })
+	return applied, revert, err
+}
+
+func (sm *SyncManager) resolveHeld(ctx context.Context, accept bool) ([]protocol.Operation, []protocol.Operation, error) {
+	if len(sm.held) == 0 {
+		return nil, nil, fmt.Errorf("no operation is held")
+	}
+	held := sm.held
+	sm.held = nil
+
+	before := sm.document.Content
+	if err := sm.integrateRemoteOperation(ctx, held[0]); err != nil {
+		return nil, nil, err
+	}
+
+	var applied, revert []protocol.Operation
+	if accept {
+		applied = append(applied, held[0])
+	} else {
+		for _, op := range revertRegion(sm.document.Content, before) {
+			sm.vectorClock.Increment(sm.userID)
+			op.UserID = sm.userID
+			op.Timestamp = sm.clock.Now()
+			op.ID = GenerateOperationID(sm.userID)
+			op.VectorClock = sm.vectorClock.Copy()
+			if err := sm.applyLocalOperation(ctx, op); err != nil {
+				return nil, revert, fmt.Errorf("failed to revert rejected operation: %v", err)
+			}
+			revert = append(revert, op)
+		}
+	}
+
+	for _, op := range held[1:] {
+		err := sm.applyRemoteOperation(ctx, op)
+		if errors.Is(err, ErrOperationHeld) || errors.Is(err, ErrOperationReplayed) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to apply operation from %s after a conflict: %v", op.UserID, err)
+			continue
+		}
+		applied = append(applied, op)
+	}
+	return applied, revert, nil
+}
+
+// holdRemoteOperation holds op under the manual strategy if operations are
+// already held, so order is kept, or if it conflicts with a local operation
+// its author hadn't seen
+func (sm *SyncManager) holdRemoteOperation(op protocol.Operation) bool {
+	if len(sm.held) > 0 {
+		sm.held = append(sm.held, op)
+		return true
+	}
+	if _, manual := sm.strategy.(manualStrategy); !manual {
+		return false
+	}
+
+	var conflicts []protocol.Operation
+	for _, local := range sm.localBuffer.GetAll() {
+		if local.VectorClock.IsConcurrent(op.VectorClock) && operationsOverlap(local, op) {
+			conflicts = append(conflicts, local)
+		}
+	}
+	if len(conflicts) == 0 {
+		return false
+	}
+	sm.held = append(sm.held, op)
+	sm.emitConflictHeld(op, conflicts)
+	return true
+}
+
+// operationsOverlap reports whether two operations touch the same text:
+// inserts at the same position, an insert inside a deleted range, or
+// overlapping deletes
+func operationsOverlap(a, b protocol.Operation) bool {
+	if a.Type == protocol.OpInsert && b.Type == protocol.OpInsert {
+		return a.Position == b.Position
+	}
+	if a.Type == protocol.OpInsert {
+		a, b = b, a
+	}
+	if b.Type == protocol.OpInsert {
+		return b.Position > a.Position && b.Position < a.Position+a.Length
+	}
+	return a.Position < b.Position+b.Length && b.Position < a.Position+a.Length
+}
+
+// revertRegion returns the operations turning content back into previous
+// when the two differ in one region, as they do around a single applied
+// operation. The region is widened to whole characters.
+func revertRegion(content, previous string) []protocol.Operation {
+	prefix := 0
+	for prefix < len(content) && prefix < len(previous) && content[prefix] == previous[prefix] {
+		prefix++
+	}
+	for prefix > 0 && prefix < len(content) && !utf8.RuneStart(content[prefix]) {
+		prefix--
+	}
+
+	suffix := 0
+	for suffix < len(content)-prefix && suffix < len(previous)-prefix &&
+		content[len(content)-1-suffix] == previous[len(previous)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && !utf8.RuneStart(content[len(content)-suffix]) {
+		suffix--
+	}
+
+	return replaceRegion(prefix, content[prefix:len(content)-suffix], previous[prefix:len(previous)-suffix])
+}
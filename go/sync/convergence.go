@@ -0,0 +1,262 @@
+package sync
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// `collab check-convergence` tests the transform functions with random
+// documents and operations. Each iteration checks three properties:
+//
+//   - TP1: two concurrent operations, each transformed against the other,
+//     lead to the same document in either order.
+//   - TP2: transforming a third concurrent operation against the other two
+//     gives the same operation whichever order they are taken in.
+//   - Convergence: replicas that each make a few edits and then receive
+//     everyone else's through the sync manager end with the same document.
+//
+// Iteration i uses seed+i, so every counterexample can be replayed alone.
+const (
+	convergenceAlphabet   = "abcdefghij"
+	convergenceMaxDocSize = 16
+)
+
+// Counterexample is a case where a property doesn't hold
+type Counterexample struct {
+	Property   string
+	Seed       int64
+	Document   string
+	Operations []protocol.Operation
+	Results    []string
+}
+
+func (ce Counterexample) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s fails for seed %d on %q\n", ce.Property, ce.Seed, ce.Document)
+	for _, op := range ce.Operations {
+		fmt.Fprintf(&b, "  %s by %s\n", describeOperation(op), op.UserID)
+	}
+	for _, result := range ce.Results {
+		fmt.Fprintf(&b, "  -> %s\n", result)
+	}
+	fmt.Fprintf(&b, "  reproduce with: collab-nvim check-convergence -seed %d -iterations 1", ce.Seed)
+	return b.String()
+}
+
+// convergenceRun generates one iteration's document and operations
+type convergenceRun struct {
+	rng *rand.Rand
+	sm  *SyncManager // only for its transform functions
+}
+
+func (cr *convergenceRun) document() string {
+	doc := make([]byte, cr.rng.Intn(convergenceMaxDocSize+1))
+	for i := range doc {
+		doc[i] = convergenceAlphabet[cr.rng.Intn(len(convergenceAlphabet))]
+	}
+	return string(doc)
+}
+
+// operation makes a random insert or delete on doc. Its ID and timestamp
+// come from the seed so tie-breaks replay the same way.
+func (cr *convergenceRun) operation(doc, userID string, n int) protocol.Operation {
+	op := protocol.Operation{
+		UserID:    userID,
+		ID:        fmt.Sprintf("%s-%d", userID, n),
+		Timestamp: cr.rng.Int63n(1 << 40),
+	}
+	if len(doc) == 0 || cr.rng.Intn(2) == 0 {
+		content := make([]byte, 1+cr.rng.Intn(3))
+		for i := range content {
+			content[i] = convergenceAlphabet[cr.rng.Intn(len(convergenceAlphabet))] - 'a' + 'A'
+		}
+		op.Type = protocol.OpInsert
+		op.Position = cr.rng.Intn(len(doc) + 1)
+		op.Content = string(content)
+		op.Length = len(content)
+		return op
+	}
+	op.Type = protocol.OpDelete
+	op.Position = cr.rng.Intn(len(doc))
+	op.Length = 1 + cr.rng.Intn(min(3, len(doc)-op.Position))
+	op.Content = doc[op.Position : op.Position+op.Length]
+	return op
+}
+
+// transform transforms op against a concurrent operation, breaking ties the
+// way performOperationalTransformation does
+func (cr *convergenceRun) transform(op, against protocol.Operation) protocol.Operation {
+	hasPriority := timestampPriority(op) < timestampPriority(against)
+	return cr.sm.InclusionTransform(op, against, hasPriority)
+}
+
+func (cr *convergenceRun) checkTP1(seed int64) *Counterexample {
+	doc := cr.document()
+	a, b := cr.operation(doc, "alice", 1), cr.operation(doc, "bob", 1)
+	
+	viaA := ApplyOperationToContent(ApplyOperationToContent(doc, a), cr.transform(b, a))
+	viaB := ApplyOperationToContent(ApplyOperationToContent(doc, b), cr.transform(a, b))
+	if viaA == viaB {
+		return nil
+	}
+	return &Counterexample{
+		Property:   "TP1",
+		Seed:       seed,
+		Document:   doc,
+		Operations: []protocol.Operation{a, b},
+		Results:    []string{fmt.Sprintf("alice's first: %q", viaA), fmt.Sprintf("bob's first: %q", viaB)},
+	}
+}
+
+func (cr *convergenceRun) checkTP2(seed int64) *Counterexample {
+	doc := cr.document()
+	a, b, c := cr.operation(doc, "alice", 1), cr.operation(doc, "bob", 1), cr.operation(doc, "carol", 1)
+	
+	viaA := cr.transform(cr.transform(c, a), cr.transform(b, a))
+	viaB := cr.transform(cr.transform(c, b), cr.transform(a, b))
+	if equivalentOperations(viaA, viaB) {
+		return nil
+	}
+	return &Counterexample{
+		Property:   "TP2",
+		Seed:       seed,
+		Document:   doc,
+		Operations: []protocol.Operation{a, b, c},
+		Results: []string{
+			"carol's through alice's then bob's: " + describeOperation(viaA),
+			"carol's through bob's then alice's: " + describeOperation(viaB),
+		},
+	}
+}
+
+// equivalentOperations compares what two operations do to a document
+func equivalentOperations(a, b protocol.Operation) bool {
+	if a.Type != b.Type || a.Position != b.Position || a.Length != b.Length {
+		return false
+	}
+	return a.Type != protocol.OpInsert || a.Content == b.Content
+}
+
+// checkReplicas has each replica make its edits, then delivers everyone
+// else's to it in a random order that keeps each author's edits in sequence
+func (cr *convergenceRun) checkReplicas(seed int64, replicas, opsPerReplica int) *Counterexample {
+	doc := cr.document()
+	ctx := context.Background()
+	
+	managers := make([]*SyncManager, replicas)
+	made := make([][]protocol.Operation, replicas)
+	var all []protocol.Operation
+	for r := range managers {
+		userID := fmt.Sprintf("r%d", r)
+		sm := NewSyncManager()
+		sm.SetUserID(userID)
+		sm.InitializeDocument(doc)
+		managers[r] = sm
+		defer sm.Close()
+		
+		for n := 1; n <= opsPerReplica; n++ {
+			op := cr.operation(sm.GetDocumentContent(), userID, n)
+			op.VectorClock = sm.tickClock()
+			if err := sm.ApplyLocalOperation(ctx, op); err != nil {
+				continue
+			}
+			made[r] = append(made[r], op)
+			all = append(all, op)
+		}
+	}
+	
+	results := make([]string, replicas)
+	converged := true
+	for r, sm := range managers {
+		next := make([]int, replicas)
+		for remaining := len(all) - len(made[r]); remaining > 0; remaining-- {
+			var authors []int
+			for other := range managers {
+				if other != r && next[other] < len(made[other]) {
+					authors = append(authors, other)
+				}
+			}
+			author := authors[cr.rng.Intn(len(authors))]
+			op := made[author][next[author]]
+			next[author]++
+			if err := sm.ApplyRemoteOperation(ctx, op); err != nil {
+				results[r] = fmt.Sprintf("r%d failed: %v", r, err)
+				converged = false
+				break
+			}
+		}
+		if results[r] == "" {
+			results[r] = fmt.Sprintf("r%d: %q", r, sm.GetDocumentContent())
+		}
+		if managers[0].GetDocumentContent() != sm.GetDocumentContent() {
+			converged = false
+		}
+	}
+	if converged {
+		return nil
+	}
+	return &Counterexample{
+		Property:   fmt.Sprintf("Convergence of %d replicas", replicas),
+		Seed:       seed,
+		Document:   doc,
+		Operations: all,
+		Results:    results,
+	}
+}
+
+// CheckConvergence runs the property checks for the given number of
+// iterations and returns the counterexamples found
+func CheckConvergence(seed int64, iterations, replicas, opsPerReplica int) []Counterexample {
+	var failures []Counterexample
+	for i := 0; i < iterations; i++ {
+		caseSeed := seed + int64(i)
+		run := &convergenceRun{rng: rand.New(rand.NewSource(caseSeed)), sm: NewSyncManager()}
+		for _, failure := range []*Counterexample{
+			run.checkTP1(caseSeed),
+			run.checkTP2(caseSeed),
+			run.checkReplicas(caseSeed, replicas, opsPerReplica),
+		} {
+			if failure != nil {
+				failures = append(failures, *failure)
+			}
+		}
+		run.sm.Close()
+	}
+	return failures
+}
+
+// RunCheckConvergence implements `collab check-convergence`
+func RunCheckConvergence(args []string) error {
+	flags := flag.NewFlagSet("check-convergence", flag.ExitOnError)
+	seed := flags.Int64("seed", time.Now().UnixNano(), "seed of the first iteration")
+	iterations := flags.Int("iterations", 1000, "number of random cases")
+	replicas := flags.Int("replicas", 3, "replicas in the convergence check")
+	opsPerReplica := flags.Int("ops", 3, "edits each replica makes")
+	show := flags.Int("show", 5, "counterexamples to print")
+	flags.Parse(args)
+	
+	if *replicas < 2 || *opsPerReplica < 1 || *iterations < 1 {
+		return fmt.Errorf("need at least 2 replicas, 1 op and 1 iteration")
+	}
+	
+	fmt.Printf("Checking %d cases from seed %d\n", *iterations, *seed)
+	failures := CheckConvergence(*seed, *iterations, *replicas, *opsPerReplica)
+	for i, failure := range failures {
+		if i == *show {
+			fmt.Printf("... and %d more\n", len(failures)-i)
+			break
+		}
+		fmt.Println(failure)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d counterexamples in %d cases", len(failures), *iterations)
+	}
+	fmt.Println("All properties held")
+	return nil
+}
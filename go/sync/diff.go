@@ -0,0 +1,240 @@
+package sync
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Line diffs turn one version of a document into operations producing
+// another, for merging content that was edited outside the shared document
+// (breakouts, imported files), and into patches for people to read. Common
+// leading and trailing lines are skipped and the rest is aligned with an LCS
+// table; when that table would be too big the changed region is replaced
+// wholesale.
+const (
+	maxDiffCells       = 4 * 1024 * 1024
+	unifiedDiffContext = 3
+)
+
+// lineEdit is one line of an edit script: kept ('='), deleted ('-') or
+// inserted ('+')
+type lineEdit struct {
+	kind byte
+	line string // including its line break
+}
+
+// diffLines returns the edit script turning from into to, line by line
+func diffLines(from, to string) []lineEdit {
+	a := splitLines(from)
+	b := splitLines(to)
+	
+	// Skip the common prefix and suffix
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	
+	edits := make([]lineEdit, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		edits = append(edits, lineEdit{'=', line})
+	}
+	tail := a[len(a)-suffix:]
+	a = a[prefix : len(a)-suffix]
+	b = b[prefix : len(b)-suffix]
+	
+	if len(a)*len(b) > maxDiffCells {
+		for _, line := range a {
+			edits = append(edits, lineEdit{'-', line})
+		}
+		for _, line := range b {
+			edits = append(edits, lineEdit{'+', line})
+		}
+	} else {
+		// lcs[i][j] is the LCS length of a[i:] and b[j:]
+		lcs := make([][]int, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] >= lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		
+		i, j := 0, 0
+		for i < len(a) || j < len(b) {
+			switch {
+			case i < len(a) && j < len(b) && a[i] == b[j]:
+				edits = append(edits, lineEdit{'=', a[i]})
+				i++
+				j++
+			case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+				edits = append(edits, lineEdit{'+', b[j]})
+				j++
+			default:
+				edits = append(edits, lineEdit{'-', a[i]})
+				i++
+			}
+		}
+	}
+	
+	for _, line := range tail {
+		edits = append(edits, lineEdit{'=', line})
+	}
+	return edits
+}
+
+// splitLines splits content after each line break
+func splitLines(content string) []string {
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// DiffOperations returns insert and delete operations that turn from into to.
+// Each operation's position assumes the ones before it have been applied.
+func DiffOperations(from, to string) []protocol.Operation {
+	if from == to {
+		return nil
+	}
+	
+	var ops []protocol.Operation
+	var deleted, inserted strings.Builder
+	position := 0
+	flush := func() {
+		ops = append(ops, replaceRegion(position, deleted.String(), inserted.String())...)
+		position += inserted.Len()
+		deleted.Reset()
+		inserted.Reset()
+	}
+	
+	for _, edit := range diffLines(from, to) {
+		switch edit.kind {
+		case '=':
+			flush()
+			position += len(edit.line)
+		case '-':
+			deleted.WriteString(edit.line)
+		case '+':
+			inserted.WriteString(edit.line)
+		}
+	}
+	flush()
+	
+	return ops
+}
+
+// replaceRegion returns the operations replacing deleted with inserted at
+// position: a delete followed by an insert, either of which may be absent
+func replaceRegion(position int, deleted, inserted string) []protocol.Operation {
+	var ops []protocol.Operation
+	if deleted != "" {
+		ops = append(ops, protocol.Operation{Type: protocol.OpDelete, Position: position, Content: deleted, Length: len(deleted)})
+	}
+	if inserted != "" {
+		ops = append(ops, protocol.Operation{Type: protocol.OpInsert, Position: position, Content: inserted, Length: len(inserted)})
+	}
+	return ops
+}
+
+// UnifiedDiff renders the change from one version of a file to another as a
+// patch `git apply` and `patch -p1` understand
+func UnifiedDiff(path, from, to string) string {
+	if from == to {
+		return ""
+	}
+	edits := diffLines(from, to)
+	
+	var out strings.Builder
+	path = strings.TrimPrefix(path, "/")
+	fmt.Fprintf(&out, "--- a/%s\n+++ b/%s\n", path, path)
+	
+	for start := 0; start < len(edits); {
+		// Find the next change and grow the hunk while changes are close
+		first := start
+		for first < len(edits) && edits[first].kind == '=' {
+			first++
+		}
+		if first == len(edits) {
+			break
+		}
+		last := first
+		for k := first; k < len(edits); k++ {
+			if edits[k].kind != '=' {
+				last = k
+			} else if k-last > 2*unifiedDiffContext {
+				break
+			}
+		}
+		
+		lo := first - unifiedDiffContext
+		if lo < start {
+			lo = start
+		}
+		hi := last + unifiedDiffContext + 1
+		if hi > len(edits) {
+			hi = len(edits)
+		}
+		
+		// Line numbers of the hunk in the old and new file
+		oldLine, newLine := 1, 1
+		for _, edit := range edits[:lo] {
+			if edit.kind != '+' {
+				oldLine++
+			}
+			if edit.kind != '-' {
+				newLine++
+			}
+		}
+		oldCount, newCount := 0, 0
+		var body strings.Builder
+		for _, edit := range edits[lo:hi] {
+			switch edit.kind {
+			case '=':
+				oldCount++
+				newCount++
+				body.WriteString(" ")
+			case '-':
+				oldCount++
+				body.WriteString("-")
+			case '+':
+				newCount++
+				body.WriteString("+")
+			}
+			body.WriteString(edit.line)
+			if !strings.HasSuffix(edit.line, "\n") {
+				body.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(oldLine, oldCount), hunkRange(newLine, newCount))
+		out.WriteString(body.String())
+		
+		start = hi
+	}
+	return out.String()
+}
+
+func hunkRange(line, count int) string {
+	if count == 0 {
+		// An empty range names the line before it
+		return fmt.Sprintf("%d,0", line-1)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", line)
+	}
+	return fmt.Sprintf("%d,%d", line, count)
+}
@@ -0,0 +1,39 @@
+package sync
+
+import (
+	"errors"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// RestoreDocument initializes the document at a known version and clock, so
+// operations from peers that saw the previous host's state still line up.
+//
+// The clock is also the snapshot's state vector: an operation its author
+// numbered no later than the clock's entry for them is already in the
+// content. Such operations still turn up after a restore, retransmitted or
+// from a slow peer, and applying them again would duplicate their edits, so
+// they are skipped.
+func (sm *SyncManager) RestoreDocument(content string, version int64, clock protocol.VectorClock) {
+	sm.do(func() {
+		sm.initializeDocument(content)
+		sm.document.Version = version
+		sm.document.VectorClock = clock.Copy()
+		sm.vectorClock.Update(clock)
+		sm.restored = clock.Copy()
+	})
+}
+
+// ErrOperationReplayed is returned for an operation the restored document
+// already contains
+var ErrOperationReplayed = errors.New("operation already in the restored document")
+
+// restoredOperation reports whether a remote operation is covered by the
+// state vector the document was restored from
+func (sm *SyncManager) restoredOperation(op protocol.Operation) bool {
+	if sm.restored == nil {
+		return false
+	}
+	seq := op.VectorClock[op.UserID]
+	return seq > 0 && seq <= sm.restored[op.UserID]
+}
@@ -0,0 +1,50 @@
+package sync
+
+import "github.com/EmreDay1/collab.nvim/go/protocol"
+
+// Rough per-operation cost beyond its content: struct fields, IDs, map
+const (
+	operationOverhead    = 160
+	vectorClockEntrySize = 48
+)
+
+// History kept after trimming under pressure
+const trimmedHistorySize = 100
+
+func operationSize(op protocol.Operation) int64 {
+	return int64(len(op.Content)+len(op.ID)+len(op.UserID)) + operationOverhead + int64(len(op.VectorClock))*vectorClockEntrySize
+}
+
+func operationsSize(ops []protocol.Operation) int64 {
+	var size int64
+	for _, op := range ops {
+		size += operationSize(op)
+	}
+	return size
+}
+
+// MemoryUsage estimates the memory held by the document and its histories
+func (sm *SyncManager) MemoryUsage() protocol.MemoryUsage {
+	var usage protocol.MemoryUsage
+	sm.do(func() {
+		usage.Document = int64(len(sm.document.Content) + len(sm.document.BaseContent))
+		usage.Operations = operationsSize(sm.document.Operations)
+		usage.History = operationsSize(sm.operationHistory)
+		usage.Buffers = operationsSize(sm.localBuffer.operations) + operationsSize(sm.remoteBuffer.operations)
+	})
+	return usage
+}
+
+// ReleaseMemory drops state that isn't needed for correctness: applied
+// operations are folded into the base content, the transform history is cut
+// to its most recent entries, and acknowledged operations are forgotten.
+func (sm *SyncManager) ReleaseMemory() {
+	sm.do(func() {
+		if len(sm.operationHistory) > trimmedHistorySize {
+			sm.operationHistory = append([]protocol.Operation(nil), sm.operationHistory[len(sm.operationHistory)-trimmedHistorySize:]...)
+		}
+		sm.remoteBuffer.Clear()
+		sm.cleanupHistory()
+		sm.foldOldestOperations(len(sm.document.Operations))
+	})
+}
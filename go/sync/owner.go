@@ -0,0 +1,117 @@
+package sync
+
+import (
+	"context"
+	"errors"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// A sync manager's state belongs to one goroutine, its owner. Operations to
+// apply and every other read or change arrive on its channels and are
+// handled one at a time, so the document, buffers and clocks need no locks
+// and there is no pair of locks to take in the wrong order. Event handlers
+// and operation hooks run on the caller's goroutine once its request is
+// done, so they may call back into the sync manager.
+var errSyncClosed = errors.New("sync manager is closed")
+
+// applyRequest asks the owner to apply an operation
+type applyRequest struct {
+	ctx   context.Context
+	op    protocol.Operation
+	local bool
+	done  chan applyResult
+}
+
+type applyResult struct {
+	err    error
+	events []func()
+}
+
+// own handles requests until the sync manager is closed
+func (sm *SyncManager) own() {
+	for {
+		select {
+		case req := <-sm.applies:
+			var err error
+			if req.local {
+				err = sm.applyLocalOperation(req.ctx, req.op)
+			} else {
+				err = sm.applyRemoteOperation(req.ctx, req.op)
+			}
+			req.done <- applyResult{err: err, events: sm.takeEvents()}
+		case call := <-sm.calls:
+			call()
+		case <-sm.stopped:
+			return
+		}
+	}
+}
+
+// request has the owner apply an operation and waits for the result
+func (sm *SyncManager) request(ctx context.Context, op protocol.Operation, local bool) error {
+	req := applyRequest{ctx: ctx, op: op, local: local, done: make(chan applyResult, 1)}
+	select {
+	case sm.applies <- req:
+	case <-sm.stopped:
+		return errSyncClosed
+	}
+	
+	result := <-req.done
+	runEvents(result.events)
+	return result.err
+}
+
+// do runs f on the owner and waits for it. Once the sync manager is closed f
+// doesn't run.
+func (sm *SyncManager) do(f func()) {
+	done := make(chan []func(), 1)
+	select {
+	case sm.calls <- func() { f(); done <- sm.takeEvents() }:
+	case <-sm.stopped:
+		return
+	}
+	runEvents(<-done)
+}
+
+// Close stops the owner. Operations applied afterwards fail.
+func (sm *SyncManager) Close() {
+	sm.stopOnce.Do(func() { close(sm.stopped) })
+}
+
+// takeEvents hands over the events the current request raised
+func (sm *SyncManager) takeEvents() []func() {
+	events := sm.events
+	sm.events = nil
+	return events
+}
+
+func runEvents(events []func()) {
+	for _, event := range events {
+		event()
+	}
+}
+
+func (sm *SyncManager) emitDocumentChanged(content string) {
+	if handler := sm.onDocumentChanged; handler != nil {
+		sm.events = append(sm.events, func() { handler(content) })
+	}
+}
+
+func (sm *SyncManager) emitOperationApplied(op protocol.Operation) {
+	if handler := sm.onOperationApplied; handler != nil {
+		sm.events = append(sm.events, func() { handler(op) })
+	}
+}
+
+func (sm *SyncManager) emitConflictResolved(localOp, remoteOp, resolution protocol.Operation) {
+	if handler := sm.onConflictResolved; handler != nil {
+		sm.events = append(sm.events, func() { handler(localOp, remoteOp, resolution) })
+	}
+}
+
+func (sm *SyncManager) emitConflictHeld(remoteOp protocol.Operation, localOps []protocol.Operation) {
+	if handler := sm.onConflictHeld; handler != nil {
+		sm.events = append(sm.events, func() { handler(remoteOp, localOps) })
+	}
+}
@@ -0,0 +1,1149 @@
+// Package sync keeps one document consistent across peers with operational
+// transformation. Import it as collabsync next to the standard library's
+// sync.
+package sync
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/EmreDay1/collab.nvim/go/internal/telemetry"
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+type DocumentState struct {
+	Content     string               `json:"content"`
+	BaseContent string               `json:"-"` // content before Operations[0]
+	Version     int64                `json:"version"`
+	Operations  []protocol.Operation `json:"operations"`
+	VectorClock protocol.VectorClock `json:"vector_clock"`
+}
+
+type OperationBuffer struct {
+	operations []protocol.Operation
+}
+
+func (ob *OperationBuffer) Add(op protocol.Operation) {
+	ob.operations = append(ob.operations, op)
+}
+
+func (ob *OperationBuffer) GetAll() []protocol.Operation {
+	result := make([]protocol.Operation, len(ob.operations))
+	copy(result, ob.operations)
+	return result
+}
+
+func (ob *OperationBuffer) Clear() {
+	ob.operations = make([]protocol.Operation, 0)
+}
+
+func (ob *OperationBuffer) RemoveApplied(appliedOps []protocol.Operation) {
+	appliedSet := make(map[string]bool)
+	for _, op := range appliedOps {
+		appliedSet[op.ID] = true
+	}
+	
+	filtered := make([]protocol.Operation, 0)
+	for _, op := range ob.operations {
+		if !appliedSet[op.ID] {
+			filtered = append(filtered, op)
+		}
+	}
+	ob.operations = filtered
+}
+
+type SyncManager struct {
+	document    *DocumentState
+	userID      string
+	vectorClock protocol.VectorClock
+	contentMode string
+	lastBlobOp  *protocol.Operation // Most recent replacement applied in blob mode
+	
+	// Operation buffers
+	localBuffer       *OperationBuffer
+	remoteBuffer      *OperationBuffer
+	acknowledgedOps   map[string]bool
+	
+	// Synchronization state; see owner.go
+	isTransforming    bool
+	applies           chan applyRequest
+	calls             chan func()
+	stopped           chan struct{}
+	stopOnce          sync.Once
+	events            []func() // handlers to run once the current request is done
+	
+	// How concurrent operations are ordered, and remote ones the manual
+	// strategy holds until the user resolves them; see conflict.go
+	strategy ConflictStrategy
+	held     []protocol.Operation
+	
+	// Event handlers
+	onDocumentChanged  func(content string)
+	onOperationApplied func(op protocol.Operation)
+	onConflictResolved func(localOp, remoteOp protocol.Operation, resolution protocol.Operation)
+	onConflictHeld     func(remoteOp protocol.Operation, localOps []protocol.Operation)
+	
+	// Hooks around applying operations, nil for none
+	hooks             OperationHooks
+	
+	// Stamps local operations; see clock.go
+	clock             *HybridClock
+	
+	// State vector of the snapshot the document was last restored from, nil
+	// when it started out fresh; see handoff.go
+	restored protocol.VectorClock
+	
+	// Advanced OT state
+	stateVector      map[string]int64     // State vector for each peer
+	operationHistory []protocol.Operation // Complete operation history
+	maxHistorySize   int                  // Maximum history size before cleanup
+	maxDocumentOps   int                  // Applied operations kept before folding into the base
+	lastTransform    time.Duration        // Time spent in the most recent remote transform
+}
+
+// SyncStats describes the sync state, to explain why operations are slow
+type SyncStats struct {
+	DocumentSize    int           `json:"document_size"`
+	HistorySize     int           `json:"history_size"`
+	DocumentOps     int           `json:"document_ops"`
+	PendingLocalOps int           `json:"pending_local_ops"`
+	LastTransform   time.Duration `json:"-"`
+}
+
+func NewSyncManager() *SyncManager {
+	sm := &SyncManager{
+		document: &DocumentState{
+			Content:     "",
+			Version:     0,
+			Operations:  make([]protocol.Operation, 0),
+			VectorClock: make(protocol.VectorClock),
+		},
+		vectorClock:      make(protocol.VectorClock),
+		contentMode:      ContentModeText,
+		strategy:         TimestampStrategy{},
+		clock:            &HybridClock{},
+		localBuffer:      &OperationBuffer{operations: make([]protocol.Operation, 0)},
+		remoteBuffer:     &OperationBuffer{operations: make([]protocol.Operation, 0)},
+		acknowledgedOps:  make(map[string]bool),
+		stateVector:      make(map[string]int64),
+		operationHistory: make([]protocol.Operation, 0),
+		maxHistorySize:   1000,
+		maxDocumentOps:   5000,
+		applies:          make(chan applyRequest),
+		calls:            make(chan func()),
+		stopped:          make(chan struct{}),
+	}
+	go sm.own()
+	return sm
+}
+
+func (sm *SyncManager) SetUserID(userID string) {
+	sm.do(func() {
+		sm.userID = userID
+		sm.vectorClock[userID] = 0
+		sm.stateVector[userID] = 0
+	})
+}
+
+// SetClock shares a clock with other documents, so all of a peer's
+// operations are stamped on one timeline
+func (sm *SyncManager) SetClock(clock *HybridClock) {
+	sm.do(func() { sm.clock = clock })
+}
+
+// Timestamp stamps a new local operation
+func (sm *SyncManager) Timestamp() int64 {
+	var clock *HybridClock
+	sm.do(func() { clock = sm.clock })
+	return clock.Now()
+}
+
+func (sm *SyncManager) SetEventHandlers(
+	onDocumentChanged func(string),
+	onOperationApplied func(protocol.Operation),
+	onConflictResolved func(protocol.Operation, protocol.Operation, protocol.Operation),
+) {
+	sm.do(func() {
+		sm.onDocumentChanged = onDocumentChanged
+		sm.onOperationApplied = onOperationApplied
+		sm.onConflictResolved = onConflictResolved
+	})
+}
+
+// SetContentMode switches between character-level OT and whole-file blob
+// synchronization. Must be called before InitializeDocument.
+func (sm *SyncManager) SetContentMode(mode string) {
+	sm.do(func() {
+		sm.contentMode = mode
+		sm.lastBlobOp = nil
+	})
+}
+
+func (sm *SyncManager) GetContentMode() string {
+	var mode string
+	sm.do(func() { mode = sm.contentMode })
+	return mode
+}
+
+func (sm *SyncManager) InitializeDocument(content string) {
+	sm.do(func() { sm.initializeDocument(content) })
+}
+
+func (sm *SyncManager) initializeDocument(content string) {
+	sm.document.Content = content
+	sm.document.BaseContent = content
+	sm.document.Version = 0
+	sm.document.Operations = make([]protocol.Operation, 0)
+	sm.document.VectorClock = make(protocol.VectorClock)
+	sm.vectorClock = make(protocol.VectorClock)
+	sm.vectorClock[sm.userID] = 0
+	sm.held = nil
+	sm.restored = nil
+}
+
+func (sm *SyncManager) GetDocumentContent() string {
+	var content string
+	sm.do(func() { content = sm.document.Content })
+	return content
+}
+
+func (sm *SyncManager) GetDocumentVersion() int64 {
+	var version int64
+	sm.do(func() { version = sm.document.Version })
+	return version
+}
+
+// GetStats returns the sizes that drive operation cost
+func (sm *SyncManager) GetStats() SyncStats {
+	var stats SyncStats
+	sm.do(func() {
+		stats = SyncStats{
+			DocumentSize:    len(sm.document.Content),
+			HistorySize:     len(sm.operationHistory),
+			DocumentOps:     len(sm.document.Operations),
+			PendingLocalOps: len(sm.localBuffer.operations),
+			LastTransform:   sm.lastTransform,
+		}
+	})
+	return stats
+}
+
+func (sm *SyncManager) GetVectorClock() protocol.VectorClock {
+	var clock protocol.VectorClock
+	sm.do(func() { clock = sm.vectorClock.Copy() })
+	return clock
+}
+
+// tickClock counts a new local operation and returns the clock it carries
+func (sm *SyncManager) tickClock() protocol.VectorClock {
+	var clock protocol.VectorClock
+	sm.do(func() {
+		sm.vectorClock.Increment(sm.userID)
+		clock = sm.vectorClock.Copy()
+	})
+	return clock
+}
+
+func (sm *SyncManager) CreateInsertOperation(position int, content string) protocol.Operation {
+	var op protocol.Operation
+	sm.do(func() {
+		sm.vectorClock.Increment(sm.userID)
+		
+		op = protocol.Operation{
+			Type:        protocol.OpInsert,
+			Position:    position,
+			Content:     content,
+			Length:      len(content),
+			UserID:      sm.userID,
+			Timestamp:   sm.clock.Now(),
+			ID:          GenerateOperationID(sm.userID),
+			VectorClock: sm.vectorClock.Copy(),
+		}
+	})
+	return op
+}
+
+func (sm *SyncManager) CreateDeleteOperation(position int, length int) protocol.Operation {
+	var op protocol.Operation
+	sm.do(func() {
+		sm.vectorClock.Increment(sm.userID)
+		
+		// Extract the content being deleted for better conflict resolution
+		content := ""
+		if position >= 0 && position < len(sm.document.Content) {
+			endPos := position + length
+			if endPos > len(sm.document.Content) {
+				endPos = len(sm.document.Content)
+			}
+			content = sm.document.Content[position:endPos]
+		}
+		
+		op = protocol.Operation{
+			Type:        protocol.OpDelete,
+			Position:    position,
+			Content:     content, // Store deleted content for OT
+			Length:      length,
+			UserID:      sm.userID,
+			Timestamp:   sm.clock.Now(),
+			ID:          GenerateOperationID(sm.userID),
+			VectorClock: sm.vectorClock.Copy(),
+		}
+	})
+	return op
+}
+
+// StampOperation gives an operation from Neovim the local vector clock,
+// counting it as the local user's next edit, so peers applying it directly
+// know which of their own edits it had seen
+func (sm *SyncManager) StampOperation(op protocol.Operation) protocol.Operation {
+	sm.do(func() {
+		sm.vectorClock.Increment(sm.userID)
+		op.VectorClock = sm.vectorClock.Copy()
+	})
+	return op
+}
+
+// OperationHooks wrap applying an operation to the document; the manager's
+// pipeline is one
+type OperationHooks interface {
+	ApplyOperation(ctx context.Context, op protocol.Operation, local bool, apply func(ctx context.Context, op protocol.Operation) error) error
+}
+
+// SetOperationHooks runs every operation applied from now on through hooks
+func (sm *SyncManager) SetOperationHooks(hooks OperationHooks) {
+	sm.hooks = hooks
+}
+
+// ApplyLocalOperation applies an operation made by the local user
+func (sm *SyncManager) ApplyLocalOperation(ctx context.Context, op protocol.Operation) error {
+	return sm.applyHooked(ctx, op, true)
+}
+
+// ApplyRemoteOperation transforms a peer's operation against local ones not
+// yet acknowledged and applies it
+func (sm *SyncManager) ApplyRemoteOperation(ctx context.Context, op protocol.Operation) error {
+	return sm.applyHooked(ctx, op, false)
+}
+
+// applyHooked applies op through the operation hooks, if any
+func (sm *SyncManager) applyHooked(ctx context.Context, op protocol.Operation, local bool) error {
+	apply := func(ctx context.Context, op protocol.Operation) error {
+		return sm.request(ctx, op, local)
+	}
+	if sm.hooks == nil {
+		return apply(ctx, op)
+	}
+	return sm.hooks.ApplyOperation(ctx, op, local, apply)
+}
+
+func (sm *SyncManager) applyLocalOperation(ctx context.Context, op protocol.Operation) (err error) {
+	_, span := telemetry.Tracer.Start(ctx, "sync.apply_local", trace.WithAttributes(
+		telemetry.AttrOperationType.String(string(op.Type)),
+		telemetry.AttrOperationUser.String(op.UserID),
+	))
+	defer func() { telemetry.EndSpan(span, err) }()
+	
+	if sm.contentMode == ContentModeBlob {
+		return sm.applyBlobOperation(op)
+	}
+	if op.Type == protocol.OpReplace {
+		return fmt.Errorf("replace operations are only valid for binary (blob mode) sessions")
+	}
+	
+	// Add to local buffer
+	sm.localBuffer.Add(op)
+	
+	// Apply to document immediately (optimistic execution)
+	err = sm.applyOperationToDocument(op)
+	if err != nil {
+		return fmt.Errorf("failed to apply local operation: %v", err)
+	}
+	
+	// Update our vector clock
+	sm.vectorClock.Update(op.VectorClock)
+	
+	// Add to operation history
+	sm.addToHistory(op)
+	sm.foldDocumentOperations()
+	
+	// Notify about operation
+	sm.emitOperationApplied(op)
+	
+	return nil
+}
+
+func (sm *SyncManager) applyRemoteOperation(ctx context.Context, remoteOp protocol.Operation) (err error) {
+	ctx, span := telemetry.Tracer.Start(ctx, "sync.apply_remote", trace.WithAttributes(
+		telemetry.AttrOperationType.String(string(remoteOp.Type)),
+		telemetry.AttrOperationUser.String(remoteOp.UserID),
+	))
+	defer func() { telemetry.EndSpan(span, err) }()
+	
+	if sm.restoredOperation(remoteOp) {
+		log.Printf("Skipping operation %s from %s, which the restored document already contains", remoteOp.ID, remoteOp.UserID)
+		return ErrOperationReplayed
+	}
+	if sm.contentMode == ContentModeBlob {
+		return sm.applyBlobOperation(remoteOp)
+	}
+	if remoteOp.Type == protocol.OpReplace {
+		return fmt.Errorf("replace operations are only valid for binary (blob mode) sessions")
+	}
+	if sm.holdRemoteOperation(remoteOp) {
+		return ErrOperationHeld
+	}
+	return sm.integrateRemoteOperation(ctx, remoteOp)
+}
+
+// integrateRemoteOperation transforms a remote operation against the local
+// buffer and applies it
+func (sm *SyncManager) integrateRemoteOperation(ctx context.Context, remoteOp protocol.Operation) error {
+	// Add to remote buffer
+	sm.remoteBuffer.Add(remoteOp)
+	sm.clock.Observe(remoteOp.Timestamp)
+	
+	// Update vector clock
+	sm.vectorClock.Update(remoteOp.VectorClock)
+	
+	// Get all operations that need transformation
+	localOps := sm.localBuffer.GetAll()
+	
+	// Perform operational transformation
+	transformStart := time.Now()
+	defer func() { sm.lastTransform = time.Since(transformStart) }()
+	_, transformSpan := telemetry.Tracer.Start(ctx, "sync.transform", trace.WithAttributes(telemetry.AttrLocalOps.Int(len(localOps))))
+	transformedOp, transformedLocalOps, err := sm.performOperationalTransformation(remoteOp, localOps)
+	telemetry.EndSpan(transformSpan, err)
+	if err != nil {
+		return fmt.Errorf("operational transformation failed: %v", err)
+	}
+	
+	// Undo local operations (we need to reapply them after transformation)
+	err = sm.undoLocalOperations(localOps)
+	if err != nil {
+		return fmt.Errorf("failed to undo local operations: %v", err)
+	}
+	
+	// Apply transformed remote operation
+	err = sm.applyOperationToDocument(transformedOp)
+	if err != nil {
+		return fmt.Errorf("failed to apply transformed remote operation: %v", err)
+	}
+	
+	// Reapply transformed local operations
+	for _, transformedLocalOp := range transformedLocalOps {
+		err = sm.applyOperationToDocument(transformedLocalOp)
+		if err != nil {
+			return fmt.Errorf("failed to reapply transformed local operation: %v", err)
+		}
+	}
+	
+	// Update local buffer with transformed operations
+	sm.localBuffer.Clear()
+	for _, op := range transformedLocalOps {
+		sm.localBuffer.Add(op)
+	}
+	
+	// Add to operation history
+	sm.addToHistory(transformedOp)
+	sm.foldDocumentOperations()
+	
+	// Notify about operation
+	sm.emitOperationApplied(transformedOp)
+	
+	return nil
+}
+
+// applyBlobOperation applies a whole-file replacement. Binary content can't
+// be merged, so concurrent replacements are resolved last-writer-wins on
+// (timestamp, user ID) and stale ones are dropped.
+func (sm *SyncManager) applyBlobOperation(op protocol.Operation) error {
+	if op.Type != protocol.OpReplace {
+		return fmt.Errorf("binary sessions only accept replace operations, got %s", op.Type)
+	}
+	
+	sm.vectorClock.Update(op.VectorClock)
+	sm.clock.Observe(op.Timestamp)
+	
+	if last := sm.lastBlobOp; last != nil {
+		if op.Timestamp < last.Timestamp || (op.Timestamp == last.Timestamp && op.UserID < last.UserID) {
+			// A newer replacement already won
+			return nil
+		}
+	}
+	
+	err := sm.applyOperationToDocument(op)
+	if err != nil {
+		return fmt.Errorf("failed to apply blob replacement: %v", err)
+	}
+	
+	applied := op
+	sm.lastBlobOp = &applied
+	sm.addToHistory(op)
+	sm.foldDocumentOperations()
+	
+	sm.emitOperationApplied(op)
+	
+	return nil
+}
+
+// causalOrder is how two operations' vector clocks relate
+type causalOrder int
+
+const (
+	causalEqual causalOrder = iota
+	causalBefore
+	causalAfter
+	causalConcurrent
+)
+
+// compareCausality compares two vector clocks laid out over the same users,
+// which is one pass instead of the map lookups HappensBefore does both ways
+func compareCausality(a, b []int64) causalOrder {
+	less, greater := false, false
+	for i := range a {
+		switch {
+		case a[i] < b[i]:
+			less = true
+		case a[i] > b[i]:
+			greater = true
+		}
+	}
+	switch {
+	case less && greater:
+		return causalConcurrent
+	case less:
+		return causalBefore
+	case greater:
+		return causalAfter
+	}
+	return causalEqual
+}
+
+// denseClocks lays out the vector clocks of ops over all the users they
+// mention, missing entries counting as zero
+func denseClocks(ops []*protocol.Operation) [][]int64 {
+	users := make(map[string]int)
+	for _, op := range ops {
+		for userID := range op.VectorClock {
+			if _, exists := users[userID]; !exists {
+				users[userID] = len(users)
+			}
+		}
+	}
+	clocks := make([][]int64, len(ops))
+	for i, op := range ops {
+		clocks[i] = make([]int64, len(users))
+		for userID, timestamp := range op.VectorClock {
+			clocks[i][users[userID]] = timestamp
+		}
+	}
+	return clocks
+}
+
+// transformEntry is an operation taking part in a transformation, with the
+// transformed copy it updates and its tiebreak rank worked out once
+type transformEntry struct {
+	index  int                 // into the causality table
+	op     *protocol.Operation // as received, which is what others transform against
+	target *protocol.Operation
+	remote bool
+	rank   ConflictRank
+}
+
+// performOperationalTransformation transforms the remote operation and the
+// buffered local ones against each other, pair by pair in causal order.
+// Causality between every pair is classified once up front, transformed
+// copies are found by ID through an index and updated in place, so the
+// pairwise pass does no searching or copying.
+func (sm *SyncManager) performOperationalTransformation(remoteOp protocol.Operation, localOps []protocol.Operation) (protocol.Operation, []protocol.Operation, error) {
+	transformedRemoteOp := remoteOp
+	transformedLocalOps := make([]protocol.Operation, len(localOps))
+	copy(transformedLocalOps, localOps)
+	
+	// An operation's copy is the first with its ID, the remote one's first
+	targets := make(map[string]*protocol.Operation, len(localOps)+1)
+	for k := len(localOps) - 1; k >= 0; k-- {
+		targets[localOps[k].ID] = &transformedLocalOps[k]
+	}
+	targets[remoteOp.ID] = &transformedRemoteOp
+	
+	entries := make([]transformEntry, 0, len(localOps)+1)
+	add := func(op *protocol.Operation) {
+		entries = append(entries, transformEntry{
+			index:  len(entries),
+			op:     op,
+			target: targets[op.ID],
+			remote: op.ID == remoteOp.ID,
+			rank:   sm.strategy.Rank(*op),
+		})
+	}
+	add(&remoteOp)
+	for k := range localOps {
+		add(&localOps[k])
+	}
+	
+	ops := make([]*protocol.Operation, len(entries))
+	for i := range entries {
+		ops[i] = entries[i].op
+	}
+	clocks := denseClocks(ops)
+	causality := make([][]causalOrder, len(entries))
+	for i := range entries {
+		causality[i] = make([]causalOrder, len(entries))
+	}
+	for i := range entries {
+		for j := i + 1; j < len(entries); j++ {
+			order := compareCausality(clocks[i], clocks[j])
+			causality[i][j] = order
+			switch order {
+			case causalBefore:
+				causality[j][i] = causalAfter
+			case causalAfter:
+				causality[j][i] = causalBefore
+			default:
+				causality[j][i] = order
+			}
+		}
+	}
+	
+	// Sort operations by causality, concurrent ones by the strategy's rank
+	sort.Slice(entries, func(i, j int) bool {
+		switch causality[entries[i].index][entries[j].index] {
+		case causalBefore:
+			return true
+		case causalAfter:
+			return false
+		}
+		return entries[i].rank.Before(entries[j].rank)
+	})
+	
+	// Apply inclusion transformation (IT)
+	for i := range entries {
+		e1 := &entries[i]
+		for j := i + 1; j < len(entries); j++ {
+			e2 := &entries[j]
+			
+			switch causality[e1.index][e2.index] {
+			case causalBefore:
+				// e1 happened before e2, transform e2 against e1
+				*e2.target = sm.InclusionTransform(*e2.target, *e1.op, false)
+			case causalAfter:
+				*e1.target = sm.InclusionTransform(*e1.target, *e2.op, true)
+			case causalConcurrent:
+				// Concurrent operations - use deterministic tiebreaker
+				if e1.rank.Before(e2.rank) {
+					*e2.target = sm.InclusionTransform(*e2.target, *e1.op, false)
+				} else {
+					*e1.target = sm.InclusionTransform(*e1.target, *e2.op, true)
+				}
+				
+				// Notify about conflict resolution
+				if e1.remote {
+					sm.emitConflictResolved(*e2.op, *e1.op, transformedRemoteOp)
+				} else {
+					sm.emitConflictResolved(*e1.op, *e2.op, transformedLocalOps[0]) // Simplified
+				}
+			}
+		}
+	}
+	
+	return transformedRemoteOp, transformedLocalOps, nil
+}
+
+func (sm *SyncManager) InclusionTransform(op1, op2 protocol.Operation, op1HasPriority bool) protocol.Operation {
+	result := op1
+	
+	switch {
+	case op1.Type == protocol.OpInsert && op2.Type == protocol.OpInsert:
+		result = sm.transformInsertInsert(op1, op2, op1HasPriority)
+	case op1.Type == protocol.OpInsert && op2.Type == protocol.OpDelete:
+		result = sm.transformInsertDelete(op1, op2)
+	case op1.Type == protocol.OpDelete && op2.Type == protocol.OpInsert:
+		result = sm.transformDeleteInsert(op1, op2)
+	case op1.Type == protocol.OpDelete && op2.Type == protocol.OpDelete:
+		result = sm.transformDeleteDelete(op1, op2, op1HasPriority)
+	}
+	
+	return result
+}
+
+func (sm *SyncManager) transformInsertInsert(op1, op2 protocol.Operation, op1HasPriority bool) protocol.Operation {
+	if op2.Position < op1.Position {
+		// op2 is before op1, shift op1 right
+		return protocol.Operation{
+			Type:        op1.Type,
+			Position:    op1.Position + op2.Length,
+			Content:     op1.Content,
+			Length:      op1.Length,
+			UserID:      op1.UserID,
+			Timestamp:   op1.Timestamp,
+			ID:          op1.ID,
+			VectorClock: op1.VectorClock,
+			Provenance:  op1.Provenance,
+		}
+	} else if op2.Position == op1.Position {
+		// Same position - use priority for deterministic ordering
+		if op1HasPriority {
+			return op1 // op1 stays at same position
+		} else {
+			// op2 has priority, shift op1 right
+			return protocol.Operation{
+				Type:        op1.Type,
+				Position:    op1.Position + op2.Length,
+				Content:     op1.Content,
+				Length:      op1.Length,
+				UserID:      op1.UserID,
+				Timestamp:   op1.Timestamp,
+				ID:          op1.ID,
+				VectorClock: op1.VectorClock,
+				Provenance:  op1.Provenance,
+			}
+		}
+	}
+	
+	// op2 is after op1, no transformation needed
+	return op1
+}
+
+func (sm *SyncManager) transformInsertDelete(op1, op2 protocol.Operation) protocol.Operation {
+	if op2.Position <= op1.Position {
+		// Delete is before or at insert position
+		if op2.Position+op2.Length <= op1.Position {
+			// Delete is completely before insert, shift insert left
+			return protocol.Operation{
+				Type:        op1.Type,
+				Position:    op1.Position - op2.Length,
+				Content:     op1.Content,
+				Length:      op1.Length,
+				UserID:      op1.UserID,
+				Timestamp:   op1.Timestamp,
+				ID:          op1.ID,
+				VectorClock: op1.VectorClock,
+				Provenance:  op1.Provenance,
+			}
+		} else {
+			// Delete overlaps with insert position, place insert at delete start
+			return protocol.Operation{
+				Type:        op1.Type,
+				Position:    op2.Position,
+				Content:     op1.Content,
+				Length:      op1.Length,
+				UserID:      op1.UserID,
+				Timestamp:   op1.Timestamp,
+				ID:          op1.ID,
+				VectorClock: op1.VectorClock,
+				Provenance:  op1.Provenance,
+			}
+		}
+	}
+	
+	// Delete is after insert, no transformation needed
+	return op1
+}
+
+func (sm *SyncManager) transformDeleteInsert(op1, op2 protocol.Operation) protocol.Operation {
+	if op2.Position <= op1.Position {
+		// Insert is before delete, shift delete right
+		return protocol.Operation{
+			Type:        op1.Type,
+			Position:    op1.Position + op2.Length,
+			Content:     op1.Content,
+			Length:      op1.Length,
+			UserID:      op1.UserID,
+			Timestamp:   op1.Timestamp,
+			ID:          op1.ID,
+			VectorClock: op1.VectorClock,
+			Provenance:  op1.Provenance,
+		}
+	} else if op2.Position < op1.Position+op1.Length {
+		// Insert is within delete range, adjust delete length
+		return protocol.Operation{
+			Type:        op1.Type,
+			Position:    op1.Position,
+			Content:     op1.Content,
+			Length:      op1.Length + op2.Length,
+			UserID:      op1.UserID,
+			Timestamp:   op1.Timestamp,
+			ID:          op1.ID,
+			VectorClock: op1.VectorClock,
+			Provenance:  op1.Provenance,
+		}
+	}
+	
+	// Insert is after delete, no transformation needed
+	return op1
+}
+
+func (sm *SyncManager) transformDeleteDelete(op1, op2 protocol.Operation, op1HasPriority bool) protocol.Operation {
+	if op2.Position+op2.Length <= op1.Position {
+		// op2 is completely before op1, shift op1 left
+		return protocol.Operation{
+			Type:        op1.Type,
+			Position:    op1.Position - op2.Length,
+			Content:     op1.Content,
+			Length:      op1.Length,
+			UserID:      op1.UserID,
+			Timestamp:   op1.Timestamp,
+			ID:          op1.ID,
+			VectorClock: op1.VectorClock,
+			Provenance:  op1.Provenance,
+		}
+	} else if op1.Position+op1.Length <= op2.Position {
+		// op1 is completely before op2, no transformation needed
+		return op1
+	} else {
+		// Overlapping deletes - complex case
+		start1, end1 := op1.Position, op1.Position+op1.Length
+		start2, end2 := op2.Position, op2.Position+op2.Length
+		
+		if start2 <= start1 && end2 >= end1 {
+			// op2 completely covers op1, op1 becomes empty
+			return protocol.Operation{
+				Type:        op1.Type,
+				Position:    start2,
+				Content:     "",
+				Length:      0,
+				UserID:      op1.UserID,
+				Timestamp:   op1.Timestamp,
+				ID:          op1.ID,
+				VectorClock: op1.VectorClock,
+				Provenance:  op1.Provenance,
+			}
+		} else if start1 <= start2 && end1 >= end2 {
+			// op1 completely covers op2, adjust op1 length
+			return protocol.Operation{
+				Type:        op1.Type,
+				Position:    op1.Position,
+				Content:     op1.Content,
+				Length:      op1.Length - op2.Length,
+				UserID:      op1.UserID,
+				Timestamp:   op1.Timestamp,
+				ID:          op1.ID,
+				VectorClock: op1.VectorClock,
+				Provenance:  op1.Provenance,
+			}
+		} else {
+			// Partial overlap - determine resolution based on priority and positions
+			newStart := start1
+			newLength := op1.Length
+			
+			if start2 < start1 {
+				// op2 starts before op1
+				overlap := end2 - start1
+				newStart = start2
+				newLength = op1.Length - overlap
+			} else {
+				// op1 starts before op2
+				overlap := end1 - start2
+				newLength = op1.Length - overlap
+			}
+			
+			if newLength < 0 {
+				newLength = 0
+			}
+			
+			return protocol.Operation{
+				Type:        op1.Type,
+				Position:    newStart,
+				Content:     op1.Content,
+				Length:      newLength,
+				UserID:      op1.UserID,
+				Timestamp:   op1.Timestamp,
+				ID:          op1.ID,
+				VectorClock: op1.VectorClock,
+				Provenance:  op1.Provenance,
+			}
+		}
+	}
+}
+
+func (sm *SyncManager) applyOperationToDocument(op protocol.Operation) error {
+	content := sm.document.Content
+	
+	switch op.Type {
+	case protocol.OpInsert:
+		if op.Position < 0 || op.Position > len(content) {
+			return fmt.Errorf("invalid insert position %d for document length %d", op.Position, len(content))
+		}
+		
+		newContent := content[:op.Position] + op.Content + content[op.Position:]
+		sm.document.Content = newContent
+		
+	case protocol.OpDelete:
+		if op.Position < 0 || op.Position >= len(content) {
+			// Position is invalid, but this might be due to concurrent operations
+			// Skip this operation rather than error
+			return nil
+		}
+		
+		endPos := op.Position + op.Length
+		if endPos > len(content) {
+			endPos = len(content)
+		}
+		
+		if endPos <= op.Position {
+			// Nothing to delete
+			return nil
+		}
+		
+		newContent := content[:op.Position] + content[endPos:]
+		sm.document.Content = newContent
+		
+	case protocol.OpReplace:
+		sm.document.Content = op.Content
+		
+	default:
+		return fmt.Errorf("unknown operation type: %s", op.Type)
+	}
+	
+	// Update document state
+	sm.document.Version++
+	sm.document.VectorClock.Update(op.VectorClock)
+	sm.document.Operations = append(sm.document.Operations, op)
+	
+	// Notify about document change
+	sm.emitDocumentChanged(sm.document.Content)
+	
+	return nil
+}
+
+func (sm *SyncManager) undoLocalOperations(operations []protocol.Operation) error {
+	// Reconstruct document state without local operations
+	// This is a simplified approach - in practice, you might want to use snapshots
+	
+	// Get all operations except the ones we're undoing
+	localOpIDs := make(map[string]bool)
+	for _, op := range operations {
+		localOpIDs[op.ID] = true
+	}
+	
+	// Rebuild document from remaining operations
+	sm.document.Content = sm.document.BaseContent
+	sm.document.Version = 0
+	remainingOps := make([]protocol.Operation, 0)
+	
+	for _, op := range sm.document.Operations {
+		if !localOpIDs[op.ID] {
+			remainingOps = append(remainingOps, op)
+		}
+	}
+	
+	sm.document.Operations = make([]protocol.Operation, 0)
+	
+	// Reapply remaining operations
+	for _, op := range remainingOps {
+		err := sm.applyOperationDirectly(op)
+		if err != nil {
+			return fmt.Errorf("failed to reapply operation during undo: %v", err)
+		}
+	}
+	
+	return nil
+}
+
+func (sm *SyncManager) applyOperationDirectly(op protocol.Operation) error {
+	// Apply operation without notifying anyone
+	sm.document.Content = ApplyOperationToContent(sm.document.Content, op)
+	
+	sm.document.Version++
+	sm.document.VectorClock.Update(op.VectorClock)
+	sm.document.Operations = append(sm.document.Operations, op)
+	
+	return nil
+}
+
+// ApplyOperationToContent applies op to content, skipping out-of-range edits
+// the same way a rebuild does
+func ApplyOperationToContent(content string, op protocol.Operation) string {
+	switch op.Type {
+	case protocol.OpInsert:
+		if op.Position >= 0 && op.Position <= len(content) {
+			return content[:op.Position] + op.Content + content[op.Position:]
+		}
+	case protocol.OpDelete:
+		if op.Position >= 0 && op.Position < len(content) {
+			endPos := op.Position + op.Length
+			if endPos > len(content) {
+				endPos = len(content)
+			}
+			if endPos > op.Position {
+				return content[:op.Position] + content[endPos:]
+			}
+		}
+	case protocol.OpReplace:
+		return op.Content
+	}
+	return content
+}
+
+// foldDocumentOperations folds the oldest applied operations into the base
+// content so all-day sessions don't keep every edit in memory. Operations
+// still pending in the local buffer are kept, since undo needs to remove them.
+func (sm *SyncManager) foldDocumentOperations() {
+	count := len(sm.document.Operations)
+	if count > sm.maxDocumentOps {
+		sm.foldOldestOperations(count / 2)
+	}
+}
+
+// foldOldestOperations folds up to target of the oldest operations into the
+// base content, stopping at the first one still pending locally
+func (sm *SyncManager) foldOldestOperations(target int) {
+	pending := make(map[string]bool)
+	for _, op := range sm.localBuffer.GetAll() {
+		pending[op.ID] = true
+	}
+	
+	if target > len(sm.document.Operations) {
+		target = len(sm.document.Operations)
+	}
+	folded := 0
+	for folded < target && !pending[sm.document.Operations[folded].ID] {
+		sm.document.BaseContent = ApplyOperationToContent(sm.document.BaseContent, sm.document.Operations[folded])
+		folded++
+	}
+	
+	sm.document.Operations = append([]protocol.Operation(nil), sm.document.Operations[folded:]...)
+}
+
+func (sm *SyncManager) addToHistory(op protocol.Operation) {
+	if len(sm.operationHistory) >= sm.maxHistorySize {
+		// Remove oldest operations
+		sm.operationHistory = sm.operationHistory[len(sm.operationHistory)/2:]
+	}
+	sm.operationHistory = append(sm.operationHistory, op)
+}
+
+func (sm *SyncManager) GetOperationsSince(vectorClock protocol.VectorClock) []protocol.Operation {
+	var operations []protocol.Operation
+	sm.do(func() {
+		for _, op := range sm.document.Operations {
+			if !op.VectorClock.HappensBefore(vectorClock) && !op.VectorClock.Equals(vectorClock) {
+				operations = append(operations, op)
+			}
+		}
+	})
+	return operations
+}
+
+func (sm *SyncManager) SerializeOperation(op protocol.Operation) ([]byte, error) {
+	return json.Marshal(op)
+}
+
+func (sm *SyncManager) DeserializeOperation(data []byte) (protocol.Operation, error) {
+	var op protocol.Operation
+	err := json.Unmarshal(data, &op)
+	return op, err
+}
+
+func (sm *SyncManager) GetDocumentState() DocumentState {
+	var state DocumentState
+	sm.do(func() {
+		state = DocumentState{
+			Content:     sm.document.Content,
+			Version:     sm.document.Version,
+			Operations:  append([]protocol.Operation(nil), sm.document.Operations...),
+			VectorClock: sm.document.VectorClock.Copy(),
+		}
+	})
+	return state
+}
+
+func (sm *SyncManager) AcknowledgeOperation(opID string) {
+	sm.do(func() { sm.acknowledgedOps[opID] = true })
+}
+
+func (sm *SyncManager) CleanupHistory() {
+	sm.do(sm.cleanupHistory)
+}
+
+func (sm *SyncManager) cleanupHistory() {
+	// Remove acknowledged operations from buffers
+	localOps := sm.localBuffer.GetAll()
+	acknowledgedLocal := make([]protocol.Operation, 0)
+	for _, op := range localOps {
+		if sm.acknowledgedOps[op.ID] {
+			acknowledgedLocal = append(acknowledgedLocal, op)
+		}
+	}
+	sm.localBuffer.RemoveApplied(acknowledgedLocal)
+	
+	// Clean up acknowledgment map
+	for opID := range sm.acknowledgedOps {
+		found := false
+		for _, op := range localOps {
+			if op.ID == opID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			delete(sm.acknowledgedOps, opID)
+		}
+	}
+}
+
+// Utility functions
+func GenerateOperationID(userID string) string {
+	bytes := make([]byte, 8)
+	rand.Read(bytes)
+	timestamp := time.Now().UnixNano()
+	return fmt.Sprintf("%s-%d-%s", userID, timestamp, hex.EncodeToString(bytes))
+}
+
+func hashString(s string) int64 {
+	var hash int64 = 5381
+	for _, c := range s {
+		hash = ((hash << 5) + hash) + int64(c)
+	}
+	if hash < 0 {
+		hash = -hash
+	}
+	return hash
+}
+
+// Content modes a session can synchronize in
+const (
+	ContentModeText = "text" // character-level OT
+	ContentModeBlob = "blob" // whole-file replacement, last writer wins
+)
+
+// Digest returns the document's digest
+func (sm *SyncManager) Digest() protocol.DocumentDigest {
+	var digest protocol.DocumentDigest
+	sm.do(func() {
+		sum := sha256.Sum256([]byte(sm.document.Content))
+		digest = protocol.DocumentDigest{
+			Version:     sm.document.Version,
+			VectorClock: sm.document.VectorClock.Copy(),
+			SHA256:      hex.EncodeToString(sum[:]),
+			Bytes:       len(sm.document.Content),
+		}
+	})
+	return digest
+}
+
+// RecentOperations returns up to n of the operations applied last, oldest
+// first
+func (sm *SyncManager) RecentOperations(n int) []protocol.Operation {
+	var ops []protocol.Operation
+	sm.do(func() {
+		history := sm.operationHistory
+		if len(history) > n {
+			history = history[len(history)-n:]
+		}
+		ops = append(ops, history...)
+	})
+	return ops
+}
@@ -0,0 +1,163 @@
+package sync
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// The transform benchmarks time performOperationalTransformation against the
+// previous implementation, which searched the buffer for every pair and
+// compared vector clocks again at each step, on a remote operation arriving
+// over many buffered local ones. Both must give the same result.
+const benchDocumentSize = 10000
+
+// Buffered local operations the benchmarks and the equivalence test use
+var benchBufferSizes = []int{10, 50, 200}
+
+// benchTransformCase is a remote operation and the local buffer it meets
+type benchTransformCase struct {
+	remote protocol.Operation
+	local  []protocol.Operation
+}
+
+// newBenchTransformCase buffers n local edits, some of which the remote
+// operation has already seen and some concurrent with it
+func newBenchTransformCase(rng *rand.Rand, n int) benchTransformCase {
+	operation := func(userID string, seq int, clock protocol.VectorClock) protocol.Operation {
+		op := protocol.Operation{
+			Type:        protocol.OpInsert,
+			Position:    rng.Intn(benchDocumentSize),
+			UserID:      userID,
+			Timestamp:   rng.Int63(),
+			ID:          fmt.Sprintf("%s-%d", userID, seq),
+			VectorClock: clock,
+		}
+		if rng.Intn(3) == 0 {
+			op.Type, op.Length = protocol.OpDelete, 1+rng.Intn(8)
+		} else {
+			op.Content = "x"
+			op.Length = 1
+		}
+		return op
+	}
+	
+	bc := benchTransformCase{local: make([]protocol.Operation, n)}
+	for i := range bc.local {
+		bc.local[i] = operation("alice", i+1, protocol.VectorClock{"alice": int64(i + 1), "bob": int64(rng.Intn(2))})
+	}
+	bc.remote = operation("bob", 1, protocol.VectorClock{"bob": 1, "alice": int64(rng.Intn(n + 1))})
+	return bc
+}
+
+// previousTransformation is performOperationalTransformation as it was
+// before indexing, kept as the benchmarks' baseline
+func previousTransformation(sm *SyncManager, remoteOp protocol.Operation, localOps []protocol.Operation) (protocol.Operation, []protocol.Operation) {
+	transformedRemoteOp := remoteOp
+	transformedLocalOps := make([]protocol.Operation, len(localOps))
+	copy(transformedLocalOps, localOps)
+	
+	sortedOps := append([]protocol.Operation{remoteOp}, localOps...)
+	sort.Slice(sortedOps, func(i, j int) bool {
+		op1, op2 := sortedOps[i], sortedOps[j]
+		if op1.VectorClock.HappensBefore(op2.VectorClock) {
+			return true
+		}
+		if op2.VectorClock.HappensBefore(op1.VectorClock) {
+			return false
+		}
+		return timestampPriority(op1) < timestampPriority(op2)
+	})
+	
+	transform := func(target, against protocol.Operation, hasPriority bool) {
+		if target.ID == remoteOp.ID {
+			transformedRemoteOp = sm.InclusionTransform(transformedRemoteOp, against, hasPriority)
+			return
+		}
+		for k, localOp := range transformedLocalOps {
+			if localOp.ID == target.ID {
+				transformedLocalOps[k] = sm.InclusionTransform(localOp, against, hasPriority)
+				return
+			}
+		}
+	}
+	for i, op1 := range sortedOps {
+		for j := i + 1; j < len(sortedOps); j++ {
+			op2 := sortedOps[j]
+			switch {
+			case op1.VectorClock.HappensBefore(op2.VectorClock):
+				transform(op2, op1, false)
+			case op2.VectorClock.HappensBefore(op1.VectorClock):
+				transform(op1, op2, true)
+			case op1.VectorClock.IsConcurrent(op2.VectorClock):
+				if timestampPriority(op1) < timestampPriority(op2) {
+					transform(op2, op1, false)
+				} else {
+					transform(op1, op2, true)
+				}
+			}
+		}
+	}
+	return transformedRemoteOp, transformedLocalOps
+}
+
+func TestTransformMatchesPrevious(t *testing.T) {
+	sm := NewSyncManager()
+	defer sm.Close()
+	
+	for _, buffered := range append([]int{1, 2, 3}, benchBufferSizes...) {
+		seed := int64(buffered)
+		rng := rand.New(rand.NewSource(seed))
+		for round := 0; round < max(20, 2000/buffered); round++ {
+			bc := newBenchTransformCase(rng, buffered)
+			wantRemote, wantLocal := previousTransformation(sm, bc.remote, bc.local)
+			gotRemote, gotLocal, err := sm.performOperationalTransformation(bc.remote, bc.local)
+			if err != nil {
+				t.Fatalf("%d buffered, round %d of seed %d: %v", buffered, round, seed, err)
+			}
+			if !sameTransform(gotRemote, wantRemote) {
+				t.Fatalf("%d buffered, round %d of seed %d: remote operation transformed to %+v, previously %+v", buffered, round, seed, gotRemote, wantRemote)
+			}
+			for k := range gotLocal {
+				if !sameTransform(gotLocal[k], wantLocal[k]) {
+					t.Fatalf("%d buffered, round %d of seed %d: local operation %d transformed to %+v, previously %+v", buffered, round, seed, k, gotLocal[k], wantLocal[k])
+				}
+			}
+		}
+	}
+}
+
+// benchmarkTransform times transform on random cases at each buffer size
+func benchmarkTransform(b *testing.B, transform func(sm *SyncManager, bc benchTransformCase)) {
+	for _, buffered := range benchBufferSizes {
+		b.Run(fmt.Sprintf("buffered=%d", buffered), func(b *testing.B) {
+			rng := rand.New(rand.NewSource(1))
+			cases := make([]benchTransformCase, 64)
+			for i := range cases {
+				cases[i] = newBenchTransformCase(rng, buffered)
+			}
+			sm := NewSyncManager()
+			defer sm.Close()
+			
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				transform(sm, cases[i%len(cases)])
+			}
+		})
+	}
+}
+
+func BenchmarkTransformPrevious(b *testing.B) {
+	benchmarkTransform(b, func(sm *SyncManager, bc benchTransformCase) {
+		previousTransformation(sm, bc.remote, bc.local)
+	})
+}
+
+func BenchmarkTransformIndexed(b *testing.B) {
+	benchmarkTransform(b, func(sm *SyncManager, bc benchTransformCase) {
+		sm.performOperationalTransformation(bc.remote, bc.local)
+	})
+}
@@ -0,0 +1,270 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// `collab ot-vectors` writes a corpus of golden transform cases for other
+// client implementations (web, other editors) to check themselves against,
+// and with -verify checks a corpus against this engine. Each case is a local
+// and a remote operation made concurrently on the same document. The site
+// that made the local one applies it, then receives the remote one; the case
+// records how both were transformed and the document that results. The site
+// that made the remote one applies them the other way round and must end up
+// with the same document; cases where this engine's two sites diverge are
+// kept, marked as known failures, so clients don't take them as the answer.
+const transformVectorsVersion = 2
+
+// vectorDocument is the document every case starts from
+const vectorDocument = "abcdefgh"
+
+// TransformCorpus is a set of golden transform cases
+type TransformCorpus struct {
+	Version     int               `json:"version"`
+	Description string            `json:"description"`
+	Cases       []TransformVector `json:"cases"`
+}
+
+// TransformVector is one case. Priority between concurrent operations comes
+// from each operation's user_id, id and timestamp, so they are fixed too.
+type TransformVector struct {
+	Name              string             `json:"name"`
+	Document          string             `json:"document"`
+	Local             protocol.Operation `json:"local"`
+	Remote            protocol.Operation `json:"remote"`
+	RemoteTransformed protocol.Operation `json:"remote_transformed"`
+	LocalTransformed  protocol.Operation `json:"local_transformed"`
+	Result            string             `json:"result"`
+	RemoteSiteResult  string             `json:"remote_site_result"` // the document where the remote one was made
+	KnownFailure      string             `json:"known_failure,omitempty"`
+}
+
+// vectorOp is an operation on vectorDocument, before user and clock are set
+type vectorOp struct {
+	name string
+	op   protocol.Operation
+}
+
+func vectorOps() []vectorOp {
+	var ops []vectorOp
+	for _, insert := range []struct {
+		position int
+		content  string
+	}{{0, "XY"}, {2, "Z"}, {4, "XY"}, {len(vectorDocument), "Z"}} {
+		ops = append(ops, vectorOp{
+			name: fmt.Sprintf("insert@%d", insert.position),
+			op:   protocol.Operation{Type: protocol.OpInsert, Position: insert.position, Content: insert.content, Length: len(insert.content)},
+		})
+	}
+	for _, del := range []struct{ position, length int }{{0, 2}, {1, 3}, {2, 2}, {3, 4}, {6, 2}} {
+		ops = append(ops, vectorOp{
+			name: fmt.Sprintf("delete@%d+%d", del.position, del.length),
+			op: protocol.Operation{
+				Type:     protocol.OpDelete,
+				Position: del.position,
+				Content:  vectorDocument[del.position : del.position+del.length],
+				Length:   del.length,
+			},
+		})
+	}
+	return ops
+}
+
+// GenerateTransformVectors runs every pair of operations through the engine,
+// once with the local operation timestamped earlier and once with the remote
+// one, since timestamps break ties between concurrent operations
+func GenerateTransformVectors() (*TransformCorpus, error) {
+	corpus := &TransformCorpus{
+		Version: transformVectorsVersion,
+		Description: fmt.Sprintf("Concurrent operation pairs on %q. The local operation is applied first; "+
+			"remote_transformed is the remote one as applied after it, local_transformed the local one "+
+			"as rebased on the remote one, and result the final document. remote_site_result is the "+
+			"document where the remote operation was made and the local one received; where it differs "+
+			"from result the engine does not converge, and known_failure says so.", vectorDocument),
+	}
+	
+	ops := vectorOps()
+	for _, local := range ops {
+		for _, remote := range ops {
+			for _, localEarlier := range []bool{true, false} {
+				order := "remote-earlier"
+				localTime, remoteTime := int64(2000), int64(1000)
+				if localEarlier {
+					order = "local-earlier"
+					localTime, remoteTime = 1000, 2000
+				}
+				
+				vector := TransformVector{
+					Name:     local.name + "/" + remote.name + "/" + order,
+					Document: vectorDocument,
+					Local:    local.op,
+					Remote:   remote.op,
+				}
+				vector.Local.UserID, vector.Local.ID, vector.Local.Timestamp = "alice", "alice-1", localTime
+				vector.Local.VectorClock = protocol.VectorClock{"alice": 1}
+				vector.Remote.UserID, vector.Remote.ID, vector.Remote.Timestamp = "bob", "bob-1", remoteTime
+				vector.Remote.VectorClock = protocol.VectorClock{"bob": 1}
+				
+				if err := runTransformVector(&vector); err != nil {
+					return nil, fmt.Errorf("%s: %v", vector.Name, err)
+				}
+				corpus.Cases = append(corpus.Cases, vector)
+			}
+		}
+	}
+	return corpus, nil
+}
+
+// runTransformVector applies a case's operations at both sites and fills in
+// its expected transforms and results
+func runTransformVector(vector *TransformVector) error {
+	sm := NewSyncManager()
+	defer sm.Close()
+	sm.SetUserID(vector.Local.UserID)
+	sm.InitializeDocument(vector.Document)
+	
+	var applied protocol.Operation
+	sm.SetEventHandlers(nil, func(op protocol.Operation) { applied = op }, nil)
+	
+	ctx := context.Background()
+	if err := sm.ApplyLocalOperation(ctx, vector.Local); err != nil {
+		return err
+	}
+	if err := sm.ApplyRemoteOperation(ctx, vector.Remote); err != nil {
+		return err
+	}
+	
+	vector.RemoteTransformed = applied
+	vector.LocalTransformed = protocol.Operation{}
+	var pending []protocol.Operation
+	sm.do(func() { pending = sm.localBuffer.GetAll() })
+	if len(pending) == 1 {
+		vector.LocalTransformed = pending[0]
+	}
+	vector.Result = sm.GetDocumentContent()
+	
+	result, err := remoteSiteResult(vector)
+	vector.RemoteSiteResult, vector.KnownFailure = result, ""
+	switch {
+	case err != nil:
+		vector.KnownFailure = fmt.Sprintf("the remote site fails: %v", err)
+	case result != vector.Result:
+		vector.KnownFailure = fmt.Sprintf("sites diverge: %q where the local operation was made, %q where the remote one was", vector.Result, result)
+	}
+	return nil
+}
+
+// remoteSiteResult applies a case's operations the other way round, as the
+// site that made the remote one does
+func remoteSiteResult(vector *TransformVector) (string, error) {
+	sm := NewSyncManager()
+	defer sm.Close()
+	sm.SetUserID(vector.Remote.UserID)
+	sm.InitializeDocument(vector.Document)
+	
+	ctx := context.Background()
+	if err := sm.ApplyLocalOperation(ctx, vector.Remote); err != nil {
+		return "", err
+	}
+	if err := sm.ApplyRemoteOperation(ctx, vector.Local); err != nil {
+		return "", err
+	}
+	return sm.GetDocumentContent(), nil
+}
+
+// VerifyTransformVectors runs a corpus's cases through the engine and
+// describes every case whose outcome differs
+func VerifyTransformVectors(corpus *TransformCorpus) []string {
+	var failures []string
+	for _, expected := range corpus.Cases {
+		actual := expected
+		if err := runTransformVector(&actual); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", expected.Name, err))
+			continue
+		}
+		if !sameTransform(actual.RemoteTransformed, expected.RemoteTransformed) {
+			failures = append(failures, fmt.Sprintf("%s: remote transformed to %s, expected %s",
+				expected.Name, describeOperation(actual.RemoteTransformed), describeOperation(expected.RemoteTransformed)))
+		}
+		if !sameTransform(actual.LocalTransformed, expected.LocalTransformed) {
+			failures = append(failures, fmt.Sprintf("%s: local transformed to %s, expected %s",
+				expected.Name, describeOperation(actual.LocalTransformed), describeOperation(expected.LocalTransformed)))
+		}
+		if actual.Result != expected.Result {
+			failures = append(failures, fmt.Sprintf("%s: result %q, expected %q", expected.Name, actual.Result, expected.Result))
+		}
+		if actual.RemoteSiteResult != expected.RemoteSiteResult {
+			failures = append(failures, fmt.Sprintf("%s: remote site result %q, expected %q", expected.Name, actual.RemoteSiteResult, expected.RemoteSiteResult))
+		}
+		if (actual.KnownFailure == "") != (expected.KnownFailure == "") {
+			failures = append(failures, fmt.Sprintf("%s: known failure %q, expected %q", expected.Name, actual.KnownFailure, expected.KnownFailure))
+		}
+	}
+	return failures
+}
+
+// sameTransform compares the parts of two operations a transform may change
+func sameTransform(a, b protocol.Operation) bool {
+	return a.Type == b.Type && a.Position == b.Position && a.Length == b.Length && a.Content == b.Content
+}
+
+func describeOperation(op protocol.Operation) string {
+	return fmt.Sprintf("%s@%d+%d %q", op.Type, op.Position, op.Length, op.Content)
+}
+
+// RunTransformVectors implements `collab ot-vectors`
+func RunTransformVectors(args []string) error {
+	flags := flag.NewFlagSet("ot-vectors", flag.ExitOnError)
+	output := flags.String("o", "", "file to write the corpus to instead of stdout")
+	verify := flags.String("verify", "", "corpus to check against this engine instead of writing one")
+	flags.Parse(args)
+	
+	if *verify != "" {
+		data, err := os.ReadFile(*verify)
+		if err != nil {
+			return err
+		}
+		var corpus TransformCorpus
+		if err := json.Unmarshal(data, &corpus); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", *verify, err)
+		}
+		if corpus.Version != transformVectorsVersion {
+			return fmt.Errorf("%s is version %d, expected %d", *verify, corpus.Version, transformVectorsVersion)
+		}
+		if failures := VerifyTransformVectors(&corpus); len(failures) > 0 {
+			return fmt.Errorf("%d of %d cases failed:\n%s", len(failures), len(corpus.Cases), strings.Join(failures, "\n"))
+		}
+		fmt.Fprintf(os.Stderr, "All %d cases passed\n", len(corpus.Cases))
+		return nil
+	}
+	
+	corpus, err := GenerateTransformVectors()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(corpus, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	_, err = out.Write(data)
+	return err
+}
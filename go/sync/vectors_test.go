@@ -0,0 +1,31 @@
+package sync
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTransformVectorsMarkDivergence(t *testing.T) {
+	corpus, err := GenerateTransformVectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vector := range corpus.Cases {
+		if converges := vector.Result == vector.RemoteSiteResult; converges != (vector.KnownFailure == "") {
+			t.Errorf("%s: results %q and %q, known failure %q", vector.Name, vector.Result, vector.RemoteSiteResult, vector.KnownFailure)
+		}
+	}
+	
+	// A corpus read back checks out against the engine that wrote it
+	data, err := json.Marshal(corpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read TransformCorpus
+	if err := json.Unmarshal(data, &read); err != nil {
+		t.Fatal(err)
+	}
+	if failures := VerifyTransformVectors(&read); len(failures) > 0 {
+		t.Errorf("%d cases failed, e.g. %s", len(failures), failures[0])
+	}
+}
@@ -0,0 +1,198 @@
+package collab
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// Timed sessions end on their own, e.g. a 60-minute interview. The host's
+// process keeps the clock: it warns everyone as the end approaches, then
+// makes the document read-only and writes the final patch and transcript.
+var sessionWarnings = []time.Duration{10 * time.Minute, 5 * time.Minute, time.Minute}
+
+// SessionClock fires the warnings and the expiry of a timed session
+type SessionClock struct {
+	timers []*time.Timer
+	mutex  sync.Mutex
+}
+
+// Start schedules warn for each warning still ahead of endsAt and expire at
+// endsAt, replacing any previous schedule
+func (sc *SessionClock) Start(endsAt time.Time, warn func(remaining time.Duration), expire func()) {
+	sc.Stop()
+	
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	
+	for _, before := range sessionWarnings {
+		delay := time.Until(endsAt.Add(-before))
+		if delay <= 0 {
+			continue
+		}
+		remaining := before
+		sc.timers = append(sc.timers, time.AfterFunc(delay, func() { warn(remaining) }))
+	}
+	sc.timers = append(sc.timers, time.AfterFunc(time.Until(endsAt), expire))
+}
+
+func (sc *SessionClock) Stop() {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	
+	for _, timer := range sc.timers {
+		timer.Stop()
+	}
+	sc.timers = nil
+}
+
+// startSessionClock runs the host's clock for a timed session
+func (cm *CollabManager) startSessionClock(session *session.Session) {
+	if session.Settings.EndsAt == nil {
+		return
+	}
+	endsAt := *session.Settings.EndsAt
+	
+	cm.sessionClock.Start(endsAt,
+		func(remaining time.Duration) {
+			countdown := protocol.SessionCountdownEvent{RemainingSeconds: int(remaining / time.Second), EndsAt: endsAt}
+			if err := cm.broadcastToPeers(protocol.MsgSessionCountdown, countdown); err != nil {
+				log.Printf("Failed to announce countdown: %v", err)
+			}
+			msg, _ := protocol.NewMessage(protocol.MsgSessionCountdown, countdown)
+			if err := cm.sendMessage(msg); err != nil {
+				log.Printf("Failed to send countdown: %v", err)
+			}
+		},
+		func() {
+			cm.expireSession(session.ID)
+		},
+	)
+}
+
+// expireSession ends a timed session on the host: editing stops, peers are
+// told, and the outcome is written to the data directory
+func (cm *CollabManager) expireSession(sessionID string) {
+	session := cm.hostSession()
+	if session == nil || session.ID != sessionID {
+		return
+	}
+	if !cm.sessionManager.ExpireSession() {
+		return
+	}
+	cm.stopControlRevert()
+	log.Printf("Session %s reached its end time", sessionID)
+	
+	event := protocol.SessionExpiredEvent{SessionID: sessionID, EndsAt: *session.Settings.EndsAt}
+	if err := cm.broadcastToPeers(protocol.MsgSessionExpired, event); err != nil {
+		log.Printf("Failed to announce session end: %v", err)
+	}
+	
+	patchPath, transcriptPath, err := cm.finalizeSession(session)
+	if err != nil {
+		log.Printf("Failed to finalize session %s: %v", sessionID, err)
+		event.Error = err.Error()
+	}
+	event.PatchPath = patchPath
+	event.TranscriptPath = transcriptPath
+	
+	msg, _ := protocol.NewMessage(protocol.MsgSessionExpired, event)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send session end: %v", err)
+	}
+}
+
+// finalizeSession writes the patch from the shared file's original content to
+// the final document, and a transcript of who did what, under
+// <data_dir>/sessions/<session ID>/
+func (cm *CollabManager) finalizeSession(session *session.Session) (string, string, error) {
+	if session.Mode != collabsync.ContentModeText {
+		return "", "", fmt.Errorf("blob sessions have no patch or transcript")
+	}
+	if cm.dataDir == "" {
+		return "", "", fmt.Errorf("no data directory")
+	}
+	
+	dir := filepath.Join(cm.dataDir, "sessions", session.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	
+	final := cm.syncManager.GetDocumentContent()
+	patchPath := filepath.Join(dir, "final.patch")
+	if err := os.WriteFile(patchPath, []byte(collabsync.UnifiedDiff(session.FilePath, session.Content, final)), 0600); err != nil {
+		return "", "", fmt.Errorf("failed to write %s: %v", patchPath, err)
+	}
+	
+	// Operations are only kept by a durable store; without one the transcript
+	// still records who took part
+	var records []AttributionRecord
+	if ops, err := cm.sessionManager.LoadOperations(session.ID); err == nil {
+		records = buildAttribution(ops)
+	}
+	
+	session.Mutex.RLock()
+	transcript := SessionTranscript{
+		SessionID:  session.ID,
+		FilePath:   session.FilePath,
+		CreatedAt:  session.CreatedAt,
+		EndedAt:    time.Now().UTC(),
+		Peers:      make([]protocol.Peer, 0, len(session.Peers)),
+		Operations: records,
+		Summary:    cm.contributions.Report(),
+		Content:    final,
+	}
+	for _, peer := range session.Peers {
+		transcript.Peers = append(transcript.Peers, *peer)
+	}
+	session.Mutex.RUnlock()
+	
+	data, err := json.MarshalIndent(transcript, "", "  ")
+	if err != nil {
+		return patchPath, "", err
+	}
+	transcriptPath := filepath.Join(dir, "transcript.json")
+	if err := os.WriteFile(transcriptPath, data, 0600); err != nil {
+		return patchPath, "", fmt.Errorf("failed to write %s: %v", transcriptPath, err)
+	}
+	return patchPath, transcriptPath, nil
+}
+
+// SessionTranscript is the record of a timed session written at its end
+type SessionTranscript struct {
+	SessionID  string              `json:"session_id"`
+	FilePath   string              `json:"file_path"`
+	CreatedAt  time.Time           `json:"created_at"`
+	EndedAt    time.Time           `json:"ended_at"`
+	Peers      []protocol.Peer     `json:"peers"`
+	Operations []AttributionRecord `json:"operations"`
+	Summary    ContributionReport  `json:"summary"` // per-user statistics
+	Content    string              `json:"content"` // final document
+}
+
+// handlePeerSessionClock passes the host's countdown and expiry, and the
+// central server's ending of an idle session, on to Neovim, making the
+// session read-only locally once it has ended
+func (cm *CollabManager) handlePeerSessionClock(userID string, msg *protocol.Message) {
+	session := cm.sessionManager.GetCurrentSession()
+	if session == nil || (session.CreatedBy != userID && userID != protocol.ServerUserID) {
+		return
+	}
+	
+	if msg.Type == protocol.MsgSessionExpired {
+		if !cm.sessionManager.ExpireSession() {
+			return
+		}
+	}
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send %s: %v", msg.Type, err)
+	}
+}
@@ -0,0 +1,581 @@
+package collab
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// A refactor such as a rename touches several documents at once: the
+// session's and the project files opened on demand (see remote_files.go).
+// apply_transaction groups its edits so each peer applies all of them or
+// none. The backend making it checks every edit before applying any, then
+// sends each document's part the way that document's edits travel: the
+// session document's to every peer, a file's over its session channel
+// through the host. Each part lists every document in the transaction. A
+// peer holds the parts until it has one for each of those documents it has
+// open, then applies them in one turn, and edits to those documents arriving
+// meanwhile wait behind it. A transaction still incomplete after
+// transactionTimeout, say because a connection dropped mid-way, is dropped
+// whole and Neovim gets transaction_dropped. Transactions edit text
+// documents from UTF-8 clients, since each position counts on the document
+// the edits before it leave.
+const (
+	transactionTimeout  = 30 * time.Second
+	maxTransactionFiles = 64
+)
+
+// pendingTransaction is a peer's transaction with parts still to come, or
+// complete but not yet applied
+type pendingTransaction struct {
+	key      string
+	id       string
+	from     string
+	all      []string                        // every document in it
+	files    []string                        // those open here, which it holds
+	parts    map[string][]protocol.Operation // by document
+	complete bool
+	timer    *time.Timer
+}
+
+// TransactionAssembler holds peers' transactions until every part is in,
+// and the work on their documents that arrives meanwhile. Transactions
+// sharing a document are assembled one at a time, in the order their first
+// parts arrived.
+type TransactionAssembler struct {
+	pending  map[string]*pendingTransaction // by author and ID
+	deferred map[string][]func()            // by document
+	mutex    sync.Mutex
+}
+
+func NewTransactionAssembler() *TransactionAssembler {
+	return &TransactionAssembler{
+		pending:  make(map[string]*pendingTransaction),
+		deferred: make(map[string][]func()),
+	}
+}
+
+func transactionKey(from, id string) string {
+	return from + "/" + id
+}
+
+// holdsLocked tells whether a transaction other than except holds file
+func (ta *TransactionAssembler) holdsLocked(file, except string) bool {
+	for key, tx := range ta.pending {
+		if key != except && containsString(tx.files, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// Defer keeps work on file for when no transaction holds it, reporting
+// whether it did
+func (ta *TransactionAssembler) Defer(file string, work func()) bool {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	if !ta.holdsLocked(file, "") {
+		return false
+	}
+	ta.deferred[file] = append(ta.deferred[file], work)
+	return true
+}
+
+// Add records a part of a transaction from a peer. Its first part starts it
+// with the documents it needs here, unless a transaction before it holds one
+// of them: then retry runs once that is done. Add returns the transaction
+// once every part is in, and whether the part was deferred.
+func (ta *TransactionAssembler) Add(from string, part protocol.TransactionPart, needed []string, retry func(), expire func(key string)) (*pendingTransaction, bool) {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	
+	key := transactionKey(from, part.ID)
+	tx := ta.pending[key]
+	if tx == nil {
+		for _, file := range needed {
+			if ta.holdsLocked(file, key) {
+				ta.deferred[file] = append(ta.deferred[file], retry)
+				return nil, true
+			}
+		}
+		tx = &pendingTransaction{
+			key:   key,
+			id:    part.ID,
+			from:  from,
+			all:   part.Files,
+			files: needed,
+			parts: make(map[string][]protocol.Operation),
+		}
+		tx.timer = time.AfterFunc(transactionTimeout, func() { expire(key) })
+		ta.pending[key] = tx
+	}
+	if tx.complete || !containsString(tx.files, part.File) {
+		return nil, false
+	}
+	if _, exists := tx.parts[part.File]; exists {
+		return nil, false
+	}
+	tx.parts[part.File] = part.Operations
+	if len(tx.parts) < len(tx.files) {
+		return nil, false
+	}
+	tx.complete = true
+	tx.timer.Stop()
+	return tx, false
+}
+
+// Finish forgets an applied transaction, returning the work deferred behind
+// it that nothing holds any longer
+func (ta *TransactionAssembler) Finish(key string) []func() {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	tx := ta.pending[key]
+	if tx == nil {
+		return nil
+	}
+	return ta.removeLocked(tx)
+}
+
+// Drop forgets a transaction that is still incomplete, returning it and the
+// work it released; nil when it completed meanwhile or is gone
+func (ta *TransactionAssembler) Drop(key string) (*pendingTransaction, []func()) {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	tx := ta.pending[key]
+	if tx == nil || tx.complete {
+		return nil, nil
+	}
+	return tx, ta.removeLocked(tx)
+}
+
+func (ta *TransactionAssembler) removeLocked(tx *pendingTransaction) []func() {
+	tx.timer.Stop()
+	delete(ta.pending, tx.key)
+	var released []func()
+	for _, file := range tx.files {
+		if work := ta.deferred[file]; len(work) > 0 && !ta.holdsLocked(file, "") {
+			released = append(released, work...)
+			delete(ta.deferred, file)
+		}
+	}
+	return released
+}
+
+func (ta *TransactionAssembler) Reset() {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	for _, tx := range ta.pending {
+		tx.timer.Stop()
+	}
+	ta.pending = make(map[string]*pendingTransaction)
+	ta.deferred = make(map[string][]func())
+}
+
+// transactionEdit is a document's checked operations in a local transaction
+type transactionEdit struct {
+	file   string
+	remote *RemoteFile // nil for the session's document
+	ops    []protocol.Operation
+}
+
+func (e transactionEdit) sync(cm *CollabManager) *collabsync.SyncManager {
+	if e.remote != nil {
+		return e.remote.sync
+	}
+	return cm.syncManager
+}
+
+// handleApplyTransaction applies Neovim's edits to several documents, all of
+// them or none
+func (cm *CollabManager) handleApplyTransaction(ctx context.Context, requestID json.RawMessage, req *protocol.TransactionRequest) *protocol.Message {
+	if cm.sessionManager.GetCurrentSession() == nil {
+		return createErrorMessage("no_session", "Not in a session")
+	}
+	if len(req.Edits) == 0 {
+		return createErrorMessage("transaction_failed", "edits is empty")
+	}
+	if len(req.Edits) > maxTransactionFiles {
+		return createErrorMessage("transaction_failed", fmt.Sprintf("A transaction edits at most %d documents", maxTransactionFiles))
+	}
+	if cm.breakouts.Joined() != nil {
+		return createErrorMessage("transaction_failed", "Transactions aren't available in a breakout")
+	}
+	if cm.clientCharset != CharsetUTF8 {
+		return createErrorMessage("transaction_failed", "Transactions need a UTF-8 client")
+	}
+	
+	userID := cm.sessionManager.GetUserID()
+	edits := make([]transactionEdit, 0, len(req.Edits))
+	seen := make(map[string]bool)
+	for _, edit := range req.Edits {
+		e := transactionEdit{}
+		if edit.File != "" {
+			rel, err := cleanRemotePath(edit.File)
+			if err != nil {
+				return createErrorMessage("transaction_failed", err.Error())
+			}
+			if e.remote = cm.remoteFiles.Get(rel); e.remote == nil {
+				return createErrorMessage("transaction_failed", rel+" is not open")
+			}
+			e.file = rel
+		}
+		if seen[e.file] {
+			return createErrorMessage("transaction_failed", documentName(e.file)+" is edited twice")
+		}
+		seen[e.file] = true
+		if len(edit.Operations) == 0 {
+			return createErrorMessage("transaction_failed", documentName(e.file)+" has no operations")
+		}
+		
+		sm := e.sync(cm)
+		if sm.GetContentMode() != collabsync.ContentModeText {
+			return createErrorMessage("transaction_failed", "Transactions only edit text documents")
+		}
+		for i := range edit.Operations {
+			op := edit.Operations[i]
+			op.UserID = userID
+			if op.Type != string(protocol.OpInsert) && op.Type != string(protocol.OpDelete) {
+				return createErrorMessage("invalid_operation", "Transactions only insert and delete")
+			}
+			syncOp, failure := cm.prepareDocumentOperation(&op, sm)
+			if failure != nil {
+				return failure
+			}
+			e.ops = append(e.ops, syncOp)
+		}
+		if failure := cm.checkRules(e.ops, e.file); failure != nil {
+			return failure
+		}
+		edits = append(edits, e)
+	}
+	
+	// The server orders the session document's edits; without direct
+	// connections there are no remote files
+	if cm.p2pManager.ServerMode() {
+		ops := edits[0].ops
+		var response *protocol.Message
+		if cm.opFlow.run(func(queued bool) {
+			if err := checkTransactionOperations(cm.syncManager.GetDocumentContent(), ops); err != nil {
+				response = createErrorMessage("transaction_failed", err.Error())
+			} else {
+				response = cm.applyDocumentOperations(ctx, ops, len(ops))
+			}
+			if queued {
+				cm.respond(response, requestID)
+			}
+		}) {
+			return createStatusMessage("transaction_queued", "Transaction queued until the document is ready")
+		}
+		return response
+	}
+	
+	id := req.ID
+	if id == "" {
+		id = collabsync.GenerateOperationID(userID)
+	}
+	var response *protocol.Message
+	if cm.opFlow.run(func(queued bool) {
+		response = cm.commitTransaction(ctx, id, edits)
+		if queued {
+			cm.respond(response, requestID)
+		}
+	}) {
+		return createStatusMessage("transaction_queued", "Transaction queued until the document is ready")
+	}
+	return response
+}
+
+// commitTransaction applies a checked transaction once the documents are
+// free and sends peers their parts. Should a document refuse an edit after
+// all, peers are sent what was applied, as a transaction of the documents
+// that were, so they still end up where this backend did.
+func (cm *CollabManager) commitTransaction(ctx context.Context, id string, edits []transactionEdit) *protocol.Message {
+	for _, e := range edits {
+		if err := checkTransactionOperations(e.sync(cm).GetDocumentContent(), e.ops); err != nil {
+			return createErrorMessage("transaction_failed", fmt.Sprintf("%s: %v", documentName(e.file), err))
+		}
+	}
+	
+	// Edits typing privacy holds go first, as they were made first
+	cm.flushTyping()
+	
+	var applied []transactionEdit
+	var failed error
+	for _, e := range edits {
+		done := transactionEdit{file: e.file, remote: e.remote}
+		for _, op := range e.ops {
+			var err error
+			if e.remote == nil {
+				op = cm.stampOperation(op)
+				err = cm.syncManager.ApplyLocalOperation(ctx, op)
+			} else {
+				err = e.remote.sync.ApplyLocalOperation(ctx, op)
+			}
+			if err != nil {
+				failed = fmt.Errorf("%s: %v", documentName(e.file), err)
+				break
+			}
+			done.ops = append(done.ops, op)
+		}
+		if len(done.ops) > 0 {
+			applied = append(applied, done)
+		}
+		if failed != nil {
+			break
+		}
+	}
+	
+	files := make([]string, 0, len(applied))
+	for _, e := range applied {
+		files = append(files, e.file)
+	}
+	for _, e := range applied {
+		part := protocol.TransactionPart{ID: id, UserID: cm.sessionManager.GetUserID(), Files: files, File: e.file, Operations: e.ops}
+		if err := cm.sendTransactionPart(part, e.remote, ""); err != nil {
+			log.Printf("Failed to send transaction %s part for %s: %v", id, documentName(e.file), err)
+		}
+	}
+	
+	if failed != nil {
+		return createErrorMessage("transaction_failed", failed.Error())
+	}
+	return createStatusMessage("transaction_applied", fmt.Sprintf("Transaction %s applied to %d documents", id, len(files)))
+}
+
+// checkTransactionOperations checks that each operation fits the content
+// the ones before it leave
+func checkTransactionOperations(content string, ops []protocol.Operation) error {
+	size := len(content)
+	for _, op := range ops {
+		switch op.Type {
+		case protocol.OpInsert:
+			if op.Position < 0 || op.Position > size {
+				return fmt.Errorf("insert at %d is outside the document (%d bytes)", op.Position, size)
+			}
+			size += len(op.Content)
+		case protocol.OpDelete:
+			if op.Position < 0 || op.Length <= 0 || op.Position+op.Length > size {
+				return fmt.Errorf("delete of %d bytes at %d is outside the document (%d bytes)", op.Length, op.Position, size)
+			}
+			size -= op.Length
+		default:
+			return fmt.Errorf("unsupported operation type %s", op.Type)
+		}
+	}
+	return nil
+}
+
+// documentName names a document in messages
+func documentName(file string) string {
+	if file == "" {
+		return "the session document"
+	}
+	return file
+}
+
+// sendTransactionPart sends a document's part of a transaction the way its
+// edits travel: the session document's to every peer, a file's to the host,
+// or from the host to the file's members except one
+func (cm *CollabManager) sendTransactionPart(part protocol.TransactionPart, f *RemoteFile, except string) error {
+	if f == nil {
+		cm.latency.Sent(part.Operations, cm.p2pManager.GetConnectedPeers(), time.Now())
+		return cm.broadcastToPeers(protocol.MsgTransactionPart, part)
+	}
+	
+	msg, err := protocol.NewMessage(protocol.MsgTransactionPart, part)
+	if err != nil {
+		return err
+	}
+	data, err := msg.ToJSON()
+	if err != nil {
+		return err
+	}
+	if cm.hostSession() == nil {
+		session := cm.sessionManager.GetCurrentSession()
+		if session == nil {
+			return fmt.Errorf("no active session")
+		}
+		return cm.p2pManager.SendSessionMessage(session.CreatedBy, f.ID, data)
+	}
+	for _, member := range cm.remoteFiles.members(f, except) {
+		if err := cm.p2pManager.SendSessionMessage(member, f.ID, data); err != nil {
+			log.Printf("Failed to send %s transaction part to %s: %v", f.Path, member, err)
+		}
+	}
+	return nil
+}
+
+// handlePeerTransactionPart takes the session document's part of a peer's
+// transaction in turn with the peer's other edits to it
+func (cm *CollabManager) handlePeerTransactionPart(userID string, msg *protocol.Message) {
+	var part protocol.TransactionPart
+	if err := msg.ParseData(&part); err != nil || part.File != "" {
+		return
+	}
+	cm.opFlow.run(func(queued bool) { cm.receiveTransactionPart(userID, part, true) })
+}
+
+// handleFileTransactionPart takes a file's part of a transaction from its
+// session channel. The host trusts the connection's identity; members trust
+// the host's relay.
+func (cm *CollabManager) handleFileTransactionPart(f *RemoteFile, userID string, data []byte) {
+	msg, err := protocol.ParseMessage(data)
+	if err != nil {
+		return
+	}
+	var part protocol.TransactionPart
+	if err := msg.ParseData(&part); err != nil {
+		log.Printf("Dropping %s transaction part from %s: %v", f.Path, userID, err)
+		return
+	}
+	from := userID
+	if cm.hostSession() == nil {
+		session := cm.sessionManager.GetCurrentSession()
+		if session == nil || userID != session.CreatedBy {
+			return
+		}
+		from = part.UserID
+	}
+	part.File = f.Path
+	cm.receiveTransactionPart(from, part, false)
+}
+
+// receiveTransactionPart records a part, applying the transaction once it is
+// complete: straight away when the caller has the document, otherwise in its
+// turn
+func (cm *CollabManager) receiveTransactionPart(from string, part protocol.TransactionPart, inFlow bool) {
+	if from == "" || from == cm.sessionManager.GetUserID() || part.ID == "" ||
+		len(part.Files) > maxTransactionFiles || !containsString(part.Files, part.File) {
+		return
+	}
+	for i := range part.Operations {
+		part.Operations[i].UserID = from
+	}
+	
+	needed := cm.transactionDocuments(part.Files)
+	retry := func() { cm.receiveTransactionPart(from, part, true) }
+	tx, deferred := cm.transactions.Add(from, part, needed, retry, func(key string) {
+		cm.dropTransaction(key, "timeout")
+	})
+	if deferred || tx == nil {
+		return
+	}
+	if inFlow {
+		cm.applyTransaction(tx)
+		return
+	}
+	cm.opFlow.run(func(queued bool) { cm.applyTransaction(tx) })
+}
+
+// transactionDocuments returns the documents of a transaction open here
+func (cm *CollabManager) transactionDocuments(files []string) []string {
+	var open []string
+	for _, file := range files {
+		if file == "" || cm.remoteFiles.Get(file) != nil {
+			open = append(open, file)
+		}
+	}
+	return open
+}
+
+// applyTransaction applies a complete transaction from a peer, the host
+// passing files' parts on to their other members, then runs the work that
+// waited for it
+func (cm *CollabManager) applyTransaction(tx *pendingTransaction) {
+	host := cm.hostSession() != nil
+	if host {
+		for _, file := range tx.files {
+			if file == "" {
+				continue
+			}
+			if violation := cm.rules.Check(tx.parts[file], file, ""); violation != nil {
+				cm.sendRuleViolation(protocol.RuleViolationEvent{
+					UserID: tx.from,
+					Name:   peerName(cm.hostSession(), tx.from),
+					Rule:   violation.rule,
+					Detail: violation.detail,
+					File:   file,
+				})
+				cm.finishTransaction(tx, protocol.MsgTransactionDropped, "rule_violation")
+				return
+			}
+		}
+	}
+	
+	for _, file := range tx.files {
+		ops := tx.parts[file]
+		if file == "" {
+			cm.ackOperations(tx.from, ops)
+			if !cm.holdWhilePaused(ops) {
+				cm.applyServerOperations(ops)
+			}
+			continue
+		}
+		f := cm.remoteFiles.Get(file)
+		if f == nil {
+			continue
+		}
+		for _, op := range ops {
+			if !cm.applyRemoteFileOperation(f, op) {
+				break
+			}
+		}
+		if host {
+			part := protocol.TransactionPart{ID: tx.id, UserID: tx.from, Files: tx.all, File: file, Operations: ops}
+			if err := cm.sendTransactionPart(part, f, tx.from); err != nil {
+				log.Printf("Failed to relay transaction %s part for %s: %v", tx.id, file, err)
+			}
+		}
+	}
+	cm.finishTransaction(tx, protocol.MsgTransactionApplied, "")
+}
+
+// dropTransaction gives up on a transaction still missing parts, in turn
+// with the document's edits
+func (cm *CollabManager) dropTransaction(key, reason string) {
+	cm.opFlow.run(func(queued bool) {
+		tx, released := cm.transactions.Drop(key)
+		if tx == nil {
+			return
+		}
+		log.Printf("Dropping transaction %s from %s: %s", tx.id, tx.from, reason)
+		cm.sendTransactionEvent(tx, protocol.MsgTransactionDropped, reason)
+		for _, work := range released {
+			work()
+		}
+	})
+}
+
+// finishTransaction tells Neovim how a transaction ended and runs the work
+// that waited for it
+func (cm *CollabManager) finishTransaction(tx *pendingTransaction, msgType, reason string) {
+	released := cm.transactions.Finish(tx.key)
+	cm.sendTransactionEvent(tx, msgType, reason)
+	for _, work := range released {
+		work()
+	}
+}
+
+func (cm *CollabManager) sendTransactionEvent(tx *pendingTransaction, msgType, reason string) {
+	event := protocol.TransactionEvent{ID: tx.id, UserID: tx.from, Name: tx.from, Files: tx.all, Reason: reason}
+	if session := cm.sessionManager.GetCurrentSession(); session != nil {
+		event.Name = peerName(session, tx.from)
+	}
+	msg, _ := protocol.NewMessage(msgType, event)
+	if err := cm.sendMessage(msg); err != nil {
+		log.Printf("Failed to send %s: %v", msgType, err)
+	}
+}
+
+// afterTransactions runs work on file now, or once no transaction holds it
+func (cm *CollabManager) afterTransactions(file string, work func()) {
+	if !cm.transactions.Defer(file, work) {
+		work()
+	}
+}
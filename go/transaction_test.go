@@ -0,0 +1,114 @@
+package collab
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	"github.com/EmreDay1/collab.nvim/go/session"
+)
+
+// openTestRemoteFile shares a file of the host's project as if a member had
+// opened it
+func openTestRemoteFile(t *testing.T, cm *CollabManager, session *session.Session, rel, content string) *RemoteFile {
+	t.Helper()
+	f := newRemoteFile(remoteFileID(session.ID, rel), rel, cm.sessionManager.GetUserID(), content, protocol.RemoteFileMetadata{})
+	return cm.remoteFiles.add(f)
+}
+
+// renameParts returns bob's transaction renaming Foo to Bar in the session's
+// document and in util.go
+func renameParts() (protocol.TransactionPart, protocol.TransactionPart) {
+	files := []string{"", "util.go"}
+	main := protocol.TransactionPart{ID: "rename", Files: files, Operations: []protocol.Operation{
+		{Type: protocol.OpDelete, Position: 13, Length: 3, ID: "bob-1"},
+		{Type: protocol.OpInsert, Position: 13, Content: "Bar", Length: 3, ID: "bob-2"},
+	}}
+	util := protocol.TransactionPart{ID: "rename", Files: files, File: "util.go", Operations: []protocol.Operation{
+		{Type: protocol.OpDelete, Position: 5, Length: 3, ID: "bob-3"},
+		{Type: protocol.OpInsert, Position: 5, Content: "Bar", Length: 3, ID: "bob-4"},
+	}}
+	return main, util
+}
+
+func TestTransactionWaitsForEveryPart(t *testing.T) {
+	cm, session := newTestManager(t)
+	addTestPeer(t, cm, session, "bob")
+	cm.syncManager.InitializeDocument("package main\nFoo()\n")
+	f := openTestRemoteFile(t, cm, session, "util.go", "func Foo() {}\n")
+	main, util := renameParts()
+	
+	cm.receiveTransactionPart("bob", main, false)
+	if content := cm.syncManager.GetDocumentContent(); content != "package main\nFoo()\n" {
+		t.Fatalf("document = %q before the transaction was complete", content)
+	}
+	
+	// Bob's next edit waits behind the transaction
+	next, _ := protocol.NewMessage(protocol.MsgDocumentOperation, protocol.Operation{Type: protocol.OpInsert, Position: 0, Content: "// x\n", Length: 5, ID: "bob-5"})
+	cm.handleServerOperation("bob", next)
+	if content := cm.syncManager.GetDocumentContent(); content != "package main\nFoo()\n" {
+		t.Fatalf("document = %q, want the edit waiting behind the transaction", content)
+	}
+	
+	cm.receiveTransactionPart("bob", util, false)
+	if content := cm.syncManager.GetDocumentContent(); content != "// x\npackage main\nBar()\n" {
+		t.Errorf("document = %q, want the transaction then bob's edit", content)
+	}
+	if content := f.sync.GetDocumentContent(); content != "func Bar() {}\n" {
+		t.Errorf("util.go = %q, want the rename", content)
+	}
+}
+
+func TestTransactionDroppedWhole(t *testing.T) {
+	cm, session := newTestManager(t)
+	addTestPeer(t, cm, session, "bob")
+	cm.syncManager.InitializeDocument("package main\nFoo()\n")
+	f := openTestRemoteFile(t, cm, session, "util.go", "func Foo() {}\n")
+	main, _ := renameParts()
+	
+	cm.receiveTransactionPart("bob", main, false)
+	next, _ := protocol.NewMessage(protocol.MsgDocumentOperation, protocol.Operation{Type: protocol.OpInsert, Position: 0, Content: "// x\n", Length: 5, ID: "bob-5"})
+	cm.handleServerOperation("bob", next)
+	
+	cm.dropTransaction(transactionKey("bob", "rename"), "timeout")
+	if content := cm.syncManager.GetDocumentContent(); content != "// x\npackage main\nFoo()\n" {
+		t.Errorf("document = %q, want only bob's edit after the transaction", content)
+	}
+	if content := f.sync.GetDocumentContent(); content != "func Foo() {}\n" {
+		t.Errorf("util.go = %q, want it untouched", content)
+	}
+}
+
+func TestApplyTransactionAllOrNothing(t *testing.T) {
+	cm, session := newTestManager(t)
+	cm.syncManager.InitializeDocument("package main\nFoo()\n")
+	f := openTestRemoteFile(t, cm, session, "util.go", "func Foo() {}\n")
+	
+	req := &protocol.TransactionRequest{ID: "rename", Edits: []protocol.TransactionEdit{
+		{Operations: []protocol.DocumentOperation{
+			{Type: "delete", Position: 13, Length: 3},
+			{Type: "insert", Position: 13, Content: "Bar"},
+		}},
+		{File: "util.go", Operations: []protocol.DocumentOperation{
+			{Type: "delete", Position: 5, Length: 3},
+			{Type: "insert", Position: 50, Content: "Bar"},
+		}},
+	}}
+	if response := cm.handleApplyTransaction(context.Background(), nil, req); response.Type != protocol.MsgError {
+		t.Fatalf("response = %s, want an error for the insert past the end of util.go", response.Type)
+	}
+	if content := cm.syncManager.GetDocumentContent(); content != "package main\nFoo()\n" {
+		t.Errorf("document = %q after a failed transaction", content)
+	}
+	
+	req.Edits[1].Operations[1].Position = 5
+	if response := cm.handleApplyTransaction(context.Background(), nil, req); response.Type == protocol.MsgError {
+		t.Fatalf("response = %s", response.Data)
+	}
+	if content := cm.syncManager.GetDocumentContent(); content != "package main\nBar()\n" {
+		t.Errorf("document = %q, want the rename", content)
+	}
+	if content := f.sync.GetDocumentContent(); content != "func Bar() {}\n" {
+		t.Errorf("util.go = %q, want the rename", content)
+	}
+}
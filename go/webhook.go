@@ -0,0 +1,201 @@
+package collab
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/session"
+)
+
+// Webhooks tell other tools what happens in sessions: each configured URL
+// gets a JSON POST for the events it asks for. The body carries the details
+// and a one-line summary as both `text` and `content`, which is what Slack and
+// Discord incoming webhooks display, so either can be pointed at directly.
+// Posts go out in the background, one attempt each; a failing endpoint only
+// costs a log line.
+const (
+	WebhookSessionCreated = "session_created"
+	WebhookSessionJoined  = "session_joined"
+	WebhookSessionEnded   = "session_ended"
+	WebhookPeerJoined     = "peer_joined"
+	WebhookPeerLeft       = "peer_left"
+	
+	webhookRequestTimeout = 10 * time.Second
+	webhookQueueSize      = 64
+)
+
+var webhookEvents = map[string]bool{
+	WebhookSessionCreated: true,
+	WebhookSessionJoined:  true,
+	WebhookSessionEnded:   true,
+	WebhookPeerJoined:     true,
+	WebhookPeerLeft:       true,
+}
+
+// Webhook is an endpoint and the events it receives
+type Webhook struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"` // all of them when empty
+}
+
+func (w Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url %q must be an http or https URL", w.URL)
+	}
+	for _, event := range w.Events {
+		if !webhookEvents[event] {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	return nil
+}
+
+func (w Webhook) wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, wanted := range w.Events {
+		if wanted == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEvent is the body posted to a webhook
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	SessionID string    `json:"session_id"`
+	FilePath  string    `json:"file_path,omitempty"`
+	UserID    string    `json:"user_id"` // who created, joined or left
+	Name      string    `json:"name,omitempty"`
+	Time      time.Time `json:"time"`
+	Text      string    `json:"text"`
+	Content   string    `json:"content"`
+}
+
+type webhookPost struct {
+	url  string
+	body []byte
+}
+
+// WebhookNotifier posts events to the configured webhooks
+type WebhookNotifier struct {
+	webhooks   []Webhook
+	httpClient *http.Client
+	posts      chan webhookPost
+}
+
+// NewWebhookNotifier returns nil when there are no webhooks, which notifies
+// no one
+func NewWebhookNotifier(webhooks []Webhook, httpClient *http.Client) *WebhookNotifier {
+	if len(webhooks) == 0 {
+		return nil
+	}
+	wn := &WebhookNotifier{
+		webhooks:   webhooks,
+		httpClient: httpClient,
+		posts:      make(chan webhookPost, webhookQueueSize),
+	}
+	go wn.deliver()
+	return wn
+}
+
+// Notify queues an event for every webhook that wants it
+func (wn *WebhookNotifier) Notify(event WebhookEvent) {
+	if wn == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	event.Text = event.summary()
+	event.Content = event.Text
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	
+	for _, webhook := range wn.webhooks {
+		if !webhook.wants(event.Event) {
+			continue
+		}
+		select {
+		case wn.posts <- webhookPost{url: webhook.URL, body: body}:
+		default:
+			log.Printf("Dropping %s webhook to %s: too many pending", event.Event, webhook.URL)
+		}
+	}
+}
+
+func (wn *WebhookNotifier) deliver() {
+	for post := range wn.posts {
+		resp, err := wn.httpClient.Post(post.url, "application/json", bytes.NewReader(post.body))
+		if err != nil {
+			log.Printf("Webhook to %s failed: %v", post.url, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Webhook to %s failed: %s", post.url, resp.Status)
+		}
+	}
+}
+
+func (e WebhookEvent) summary() string {
+	who := e.Name
+	if who == "" {
+		who = e.UserID
+	}
+	what := e.FilePath
+	if what == "" {
+		what = "session " + e.SessionID
+	}
+	switch e.Event {
+	case WebhookSessionCreated:
+		return fmt.Sprintf("%s started sharing %s", who, what)
+	case WebhookSessionJoined:
+		return fmt.Sprintf("%s joined %s", who, what)
+	case WebhookSessionEnded:
+		return fmt.Sprintf("%s left %s", who, what)
+	case WebhookPeerJoined:
+		return fmt.Sprintf("%s connected to %s", who, what)
+	case WebhookPeerLeft:
+		return fmt.Sprintf("%s disconnected from %s", who, what)
+	}
+	return e.Event
+}
+
+// notifyWebhooks sends an event about userID in the current session
+func (cm *CollabManager) notifyWebhooks(event, userID string) {
+	session := cm.sessionManager.GetCurrentSession()
+	if cm.webhooks == nil || session == nil {
+		return
+	}
+	cm.notifySessionWebhooks(event, session, userID)
+}
+
+func (cm *CollabManager) notifySessionWebhooks(event string, session *session.Session, userID string) {
+	if cm.webhooks == nil {
+		return
+	}
+	
+	session.Mutex.RLock()
+	name := ""
+	if peer, ok := session.Peers[userID]; ok {
+		name = peer.Name
+	}
+	session.Mutex.RUnlock()
+	
+	cm.webhooks.Notify(WebhookEvent{
+		Event:     event,
+		SessionID: session.ID,
+		FilePath:  session.FilePath,
+		UserID:    userID,
+		Name:      name,
+	})
+}
@@ -0,0 +1,178 @@
+package collab
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+// Neovim and the backend exchange a JSON object per line by default. In the
+// framed-json wire format each message is instead preceded by its length as
+// a 4-byte big-endian integer, so nothing depends on finding the end of a
+// line in a large payload. In the msgpack format the frames hold MessagePack
+// maps with the same fields, which spares Neovim parsing JSON on every
+// keystroke and both sides escaping document content. A format is chosen at
+// startup with -wire, or by Neovim sending wire_format: that is the last
+// message it sends in the old format, the backend answers it in the old
+// format too, and everything after uses the new one. The daemon only speaks
+// JSON lines.
+//
+// Reading JSON lines, the backend also takes a framed JSON message in their
+// place, told apart by its first byte: a length under the message limit
+// starts with a control character no line starts with. Clients can send
+// frames without negotiating anything, and older ones keep sending lines.
+const (
+	WireJSON       = "json"
+	WireFramedJSON = "framed-json"
+	WireMsgpack    = "msgpack"
+)
+
+func checkFormatName(format string) error {
+	switch format {
+	case WireJSON, WireFramedJSON, WireMsgpack:
+		return nil
+	}
+	return fmt.Errorf("unknown wire format %q; use %s, %s or %s", format, WireJSON, WireFramedJSON, WireMsgpack)
+}
+
+// neovimOutput is where a manager writes messages for Neovim, stdout unless
+// it is embedded, and the wire format they are written in, which messages
+// from Neovim are read in until it asks for another
+type neovimOutput struct {
+	writer io.Writer
+	format string
+	mutex  sync.Mutex
+}
+
+func newNeovimOutput() *neovimOutput {
+	return &neovimOutput{writer: os.Stdout, format: WireJSON}
+}
+
+func (o *neovimOutput) setWriter(w io.Writer) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.writer = w
+}
+
+func (o *neovimOutput) Format() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.format
+}
+
+// send writes a message to Neovim in the current wire format
+func (o *neovimOutput) send(msg *protocol.Message) error {
+	if msg == nil {
+		return nil
+	}
+	
+	jsonData, err := msg.ToJSON()
+	if err != nil {
+		return err
+	}
+	
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.write(jsonData)
+}
+
+// write writes a message encoded as JSON in the current wire format. Caller
+// holds the mutex.
+func (o *neovimOutput) write(jsonData []byte) error {
+	switch o.format {
+	case WireFramedJSON:
+		return o.writeFrame(jsonData)
+	case WireMsgpack:
+		payload, err := protocol.MsgpackFromJSON(jsonData)
+		if err != nil {
+			return err
+		}
+		return o.writeFrame(payload)
+	}
+	_, err := fmt.Fprintln(o.writer, string(jsonData))
+	return err
+}
+
+// writeFrame writes payload after its length, in one write. Caller holds
+// the mutex.
+func (o *neovimOutput) writeFrame(payload []byte) error {
+	if uint64(len(payload)) > math.MaxUint32 {
+		return fmt.Errorf("message of %d bytes is too large to frame", len(payload))
+	}
+	frame := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	_, err := o.writer.Write(append(frame, payload...))
+	return err
+}
+
+// SetWireFormat chooses how messages are exchanged with Neovim; set it before
+// Run
+func (cm *CollabManager) SetWireFormat(format string) error {
+	if err := checkFormatName(format); err != nil {
+		return err
+	}
+	cm.output.mutex.Lock()
+	defer cm.output.mutex.Unlock()
+	cm.output.format = format
+	return nil
+}
+
+// checkWireFormat reports why the backend can't switch to format, if it can't
+func (cm *CollabManager) checkWireFormat(format string) error {
+	if err := checkFormatName(format); err != nil {
+		return err
+	}
+	if cm.liveness.shared && format != WireJSON {
+		return fmt.Errorf("the daemon only speaks %s", WireJSON)
+	}
+	return nil
+}
+
+// requestedWireFormat returns the format a message from Neovim switches to,
+// if it is a wire_format the backend will act on. The reader switches as
+// soon as it has read one, since the next message already comes in the new
+// format.
+func (cm *CollabManager) requestedWireFormat(line []byte) (string, bool) {
+	if !bytes.Contains(line, []byte(protocol.MsgWireFormat)) {
+		return "", false
+	}
+	msg, err := protocol.ParseMessage(line)
+	if err != nil || msg.Type != protocol.MsgWireFormat {
+		return "", false
+	}
+	var req protocol.WireFormatRequest
+	if msg.ParseData(&req) != nil || cm.checkWireFormat(req.Format) != nil {
+		return "", false
+	}
+	return req.Format, true
+}
+
+// handleWireFormat answers wire_format in the format it came in, then
+// switches to the one asked for, with nothing sent in between
+func (cm *CollabManager) handleWireFormat(id json.RawMessage, req *protocol.WireFormatRequest) *protocol.Message {
+	if err := cm.checkWireFormat(req.Format); err != nil {
+		return createErrorMessage("wire_format_failed", err.Error())
+	}
+	
+	response := createStatusMessage(protocol.MsgWireFormat, req.Format)
+	response.ID = id
+	jsonData, err := response.ToJSON()
+	if err != nil {
+		return createErrorMessage("wire_format_failed", err.Error())
+	}
+	
+	cm.output.mutex.Lock()
+	defer cm.output.mutex.Unlock()
+	if err := cm.output.write(jsonData); err != nil {
+		return createErrorMessage("wire_format_failed", err.Error())
+	}
+	cm.output.format = req.Format
+	return nil
+}
@@ -0,0 +1,45 @@
+package collab
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+)
+
+func TestManagersKeepTheirOwnOutput(t *testing.T) {
+	var jsonOut, msgpackOut bytes.Buffer
+	first := NewCollabManager(&Config{})
+	t.Cleanup(first.Close)
+	first.SetOutput(&jsonOut)
+	second := NewCollabManager(&Config{})
+	t.Cleanup(second.Close)
+	second.SetOutput(&msgpackOut)
+	if err := second.SetWireFormat(WireMsgpack); err != nil {
+		t.Fatal(err)
+	}
+	first.handleSubscribe(&protocol.SubscribeRequest{Categories: []string{EventsChat}, Subscribe: false})
+	jsonOut.Reset()
+	
+	if err := first.sendMessage(createStatusMessage("ok", "first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.sendMessage(createStatusMessage("ok", "second")); err != nil {
+		t.Fatal(err)
+	}
+	if line := jsonOut.Bytes(); !bytes.HasPrefix(line, []byte("{")) || !bytes.HasSuffix(line, []byte("\n")) {
+		t.Errorf("first wrote %q, want a JSON line", line)
+	}
+	frame := msgpackOut.Bytes()
+	if len(frame) < 4 || int(binary.BigEndian.Uint32(frame)) != len(frame)-4 {
+		t.Errorf("second wrote %q, want one length-prefixed frame", frame)
+	}
+	
+	if first.subscriptions.wants(protocol.MsgChat) {
+		t.Error("first still wants chat after turning it off")
+	}
+	if !second.subscriptions.wants(protocol.MsgChat) {
+		t.Error("second stopped wanting chat when first turned it off")
+	}
+}
@@ -0,0 +1,261 @@
+package collab
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/EmreDay1/collab.nvim/go/protocol"
+	collabsync "github.com/EmreDay1/collab.nvim/go/sync"
+)
+
+// With write_through enabled, the host writes the shared document to its
+// file once changes have settled for debounce_ms, so the file on disk keeps
+// up with the session even when nobody saves. The file is replaced through a
+// temporary file next to it, so a crash never leaves it half written. With
+// fsync, the data and the rename are synced to disk before the write counts
+// as done; with backup, the file as it was before a session's first write is
+// kept as "<file>~". Neovim gets a document_written event after each write,
+// and leaving the session writes what is still waiting.
+const defaultWriteThroughDebounce = time.Second
+
+// WriteThrough configures writing the hosted document to disk on its own
+type WriteThrough struct {
+	Enabled    bool `json:"enabled"`
+	DebounceMS int  `json:"debounce_ms,omitempty"` // 1000 when unset
+	Fsync      bool `json:"fsync,omitempty"`
+	Backup     bool `json:"backup,omitempty"`
+}
+
+func (w WriteThrough) debounce() time.Duration {
+	if w.DebounceMS <= 0 {
+		return defaultWriteThroughDebounce
+	}
+	return time.Duration(w.DebounceMS) * time.Millisecond
+}
+
+// DocumentWrittenEvent reports a write of the document to its file
+type DocumentWrittenEvent struct {
+	Path    string `json:"path"`
+	Bytes   int    `json:"bytes"`
+	Version int64  `json:"version"`
+	Error   string `json:"error,omitempty"`
+}
+
+// diskWriter debounces writes of the hosted document
+type diskWriter struct {
+	config   WriteThrough
+	timer    *time.Timer
+	written  string          // session and document version last written
+	backedUp map[string]bool // files backed up in this session
+	mutex    sync.Mutex
+}
+
+func newDiskWriter(config WriteThrough) *diskWriter {
+	return &diskWriter{config: config, backedUp: make(map[string]bool)}
+}
+
+func (dw *diskWriter) SetConfig(config WriteThrough) {
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+	dw.config = config
+}
+
+// schedule runs write once no change has come for the debounce interval
+func (dw *diskWriter) schedule(write func()) {
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+	
+	if !dw.config.Enabled {
+		return
+	}
+	if dw.timer != nil {
+		dw.timer.Stop()
+	}
+	dw.timer = time.AfterFunc(dw.config.debounce(), write)
+}
+
+// stop cancels a waiting write, reporting whether there was one
+func (dw *diskWriter) stop() bool {
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+	
+	pending := dw.timer != nil && dw.timer.Stop()
+	dw.timer = nil
+	return pending
+}
+
+func (dw *diskWriter) Reset() {
+	dw.stop()
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+	dw.written = ""
+	dw.backedUp = make(map[string]bool)
+}
+
+// scheduleWriteThrough writes the document to disk after a change, when the
+// local user hosts the session
+func (cm *CollabManager) scheduleWriteThrough() {
+	if cm.hostSession() == nil {
+		return
+	}
+	cm.diskWriter.schedule(func() {
+		if err := cm.writeThrough(); err != nil {
+			log.Printf("Failed to write the document through: %v", err)
+		}
+	})
+}
+
+// flushWriteThrough writes a change still waiting for the debounce, such as
+// before leaving the session
+func (cm *CollabManager) flushWriteThrough() {
+	if cm.diskWriter.stop() {
+		if err := cm.writeThrough(); err != nil {
+			log.Printf("Failed to write the document through: %v", err)
+		}
+	}
+}
+
+// writeThrough writes the hosted document to its file as saving it from
+// Neovim would, with its line endings and encoding, unless that version was
+// written already
+func (cm *CollabManager) writeThrough() error {
+	session := cm.hostSession()
+	if session == nil {
+		return nil
+	}
+	path := cm.localFilePath(session)
+	if path == "" {
+		return fmt.Errorf("the session's file has no local path")
+	}
+	
+	version := cm.syncManager.GetDocumentVersion()
+	key := fmt.Sprintf("%s@%d", session.ID, version)
+	content := cm.syncManager.GetDocumentContent()
+	if session.Mode == collabsync.ContentModeText {
+		content = restoreLineEndings(content, session.LineEnding)
+		if cm.clientCharset != CharsetUTF8 {
+			encoded, err := encodeCharset(content, cm.clientCharset)
+			if err != nil {
+				return err
+			}
+			content = encoded
+		}
+	}
+	
+	cm.diskWriter.mutex.Lock()
+	defer cm.diskWriter.mutex.Unlock()
+	if key == cm.diskWriter.written {
+		return nil
+	}
+	config := cm.diskWriter.config
+	
+	// Write through a symlink rather than replacing it
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	err := func() error {
+		if config.Backup && !cm.diskWriter.backedUp[path] {
+			if err := copyFile(path, path+"~", config.Fsync); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to back up %s: %v", path, err)
+			}
+			cm.diskWriter.backedUp[path] = true
+		}
+		return writeFileAtomic(path, []byte(content), config.Fsync)
+	}()
+	
+	event := DocumentWrittenEvent{Path: path, Bytes: len(content), Version: version}
+	if err != nil {
+		event.Error = err.Error()
+	} else {
+		cm.diskWriter.written = key
+	}
+	msg, _ := protocol.NewMessage(protocol.MsgDocumentWritten, event)
+	if sendErr := cm.sendMessage(msg); sendErr != nil {
+		log.Printf("Failed to send document write: %v", sendErr)
+	}
+	return err
+}
+
+// writeFileAtomic replaces path with data through a temporary file in the
+// same directory, keeping the file's permissions
+func writeFileAtomic(path string, data []byte, fsync bool) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".collab-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if fsync {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if fsync {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+// copyFile copies src to dst, replacing it
+func copyFile(src, dst string, fsync bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if fsync {
+		if err := out.Sync(); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -6,6 +6,28 @@ M.defaults = {
   binary_name = "collab-nvim",
   auto_build = true,
   
+  -- Share one Go daemon between all Neovims over a Unix socket, so they are
+  -- in the same session; daemon_socket overrides where it listens
+  daemon = false,
+  daemon_socket = nil,
+  
+  -- How messages are exchanged with the Go process: "json" lines,
+  -- "framed-json" with each message after its length, or "msgpack" to spare
+  -- parsing JSON on every edit (the daemon only speaks JSON lines)
+  wire_format = "json",
+  
+  -- Categories of events the backend shouldn't send at all, for setups that
+  -- never show them: "presence", "chat", "metrics" or "activity"
+  muted_events = {},
+  
+  -- Which network addresses sessions reveal to peers, for collaborating with
+  -- strangers: { disable_host_candidates = true } keeps LAN addresses out,
+  -- relay_only = true connects only through a TURN server, interfaces =
+  -- { "eth0" } gathers candidates on those interfaces only, and disable_mdns
+  -- = true publishes raw LAN addresses where mDNS is blocked. Sessions can
+  -- override it in the opts of create_session and join_session.
+  ice_policy = nil,
+  
   -- Keybindings
   create_key = "<leader>cc",
   join_key = "<leader>cj", 
@@ -76,6 +98,16 @@ function M.validate()
     error("collab.nvim: cursor_colors must be a table")
   end
   
+  -- Check the ICE policy
+  if opts.ice_policy ~= nil then
+    if type(opts.ice_policy) ~= "table" then
+      error("collab.nvim: ice_policy must be a table")
+    end
+    if opts.ice_policy.interfaces ~= nil and type(opts.ice_policy.interfaces) ~= "table" then
+      error("collab.nvim: ice_policy.interfaces must be a list of interface names")
+    end
+  end
+  
   -- Check log level
   local valid_log_levels = { "debug", "info", "warn", "error" }
   local log_level_valid = false
@@ -130,7 +162,7 @@ function M.get_binary_path()
   -- Binary not found and couldn't build
   local tried_paths = table.concat(possible_paths, "\n  ")
   error(string.format(
-    "collab.nvim: Go binary not found. Tried:\n  %s\n\nPlease build the binary with:\n  cd %s && go build -o %s ./go",
+    "collab.nvim: Go binary not found. Tried:\n  %s\n\nPlease build the binary with:\n  cd %s && go build -o %s ./go/cmd/collab-nvim",
     tried_paths, plugin_root, opts.binary_name
   ))
 end
@@ -173,7 +205,7 @@ function M.build_binary()
   end
   
   -- Build command
-  local build_cmd = string.format("cd %s && go build -o %s ./go", plugin_root, opts.binary_name)
+  local build_cmd = string.format("cd %s && go build -o %s ./go/cmd/collab-nvim", plugin_root, opts.binary_name)
   
   if opts.debug then
     print("collab.nvim: Running: " .. build_cmd)
@@ -8,19 +8,41 @@ M.stdin = nil
 M.stdout = nil
 M.stderr = nil
 M.is_running = false
+M.daemon = false -- attached to the shared daemon instead of a child process
+M.wire_format = "json" -- or "framed-json" and "msgpack", each message after its length
+M.stdout_buffer = ""
 M.message_queue = {}
+M.paused = false -- the Go process asked us to hold messages
+M.busy = false -- the Go process asked us to hold document edits
+M.join_progress = nil -- stage and percent of the join under way, for statuslines
 M.response_callbacks = {}
 M.next_message_id = 1
 
+-- Liveness: our generation counts process starts, go_generation is the last
+-- one the Go process announced. Both survive restarts.
+M.generation = 0
+M.go_generation = nil
+M.session_id = nil
+M.last_keepalive = nil
+M.keepalive_timer = nil
+M.stopping = false
+M.keepalive_interval = 5000
+M.keepalive_timeout = 15000
+
 -- Event handlers
 M.on_message = nil
 M.on_error = nil
 M.on_disconnect = nil
 
+-- Extension message handlers by namespace, registered by other plugins
+M.extension_handlers = {}
+
 -- Initialize the P2P manager
 function M.init()
   M.is_running = false
   M.message_queue = {}
+  M.paused = false
+  M.busy = false
   M.response_callbacks = {}
   M.next_message_id = 1
 end
@@ -44,28 +66,43 @@ function M.start()
     error("collab.nvim: " .. error_msg)
   end
   
-  -- Spawn the Go process
-  local handle = vim.loop.spawn(binary_path, {
-    args = {},
-    stdio = {
-      vim.loop.new_pipe(false), -- stdin
-      vim.loop.new_pipe(false), -- stdout  
-      vim.loop.new_pipe(false), -- stderr
-    }
-  }, function(code, signal)
-    -- Process exit callback
-    M.on_process_exit(code, signal)
-  end)
-  
-  if not handle then
-    error("collab.nvim: Failed to spawn Go process")
+  M.wire_format = "json"
+  M.stdout_buffer = ""
+  if opts.daemon then
+    M.start_daemon(binary_path)
+  else
+    local args = {}
+    if opts.wire_format == "framed-json" or opts.wire_format == "msgpack" then
+      args = { "-wire", opts.wire_format }
+      M.wire_format = opts.wire_format
+    end
+    
+    -- Spawn the Go process
+    local handle = vim.loop.spawn(binary_path, {
+      args = args,
+      stdio = {
+        vim.loop.new_pipe(false), -- stdin
+        vim.loop.new_pipe(false), -- stdout  
+        vim.loop.new_pipe(false), -- stderr
+      }
+    }, function(code, signal)
+      -- Process exit callback
+      M.on_process_exit(code, signal)
+    end)
+    
+    if not handle then
+      error("collab.nvim: Failed to spawn Go process")
+    end
+    
+    M.process_handle = handle
+    M.stdin = handle.stdio[1]
+    M.stdout = handle.stdio[2] 
+    M.stderr = handle.stdio[3]
   end
-  
-  M.process_handle = handle
-  M.stdin = handle.stdio[1]
-  M.stdout = handle.stdio[2] 
-  M.stderr = handle.stdio[3]
   M.is_running = true
+  M.stopping = false
+  M.generation = M.generation + 1
+  M.last_keepalive = vim.loop.now()
   
   -- Set up stdout reading
   M.setup_stdout_reading()
@@ -75,14 +112,90 @@ function M.start()
   
   config.log("info", "Go process started successfully")
   
-  -- Send initial health check
+  -- Send initial health check, and tell peers what this client can handle
   vim.defer_fn(function()
     M.health_check()
+    M.send_client_info()
+    if #opts.muted_events > 0 then
+      M.subscribe(opts.muted_events, false)
+    end
   end, 100)
   
+  M.start_keepalive()
+  
   return true
 end
 
+-- Socket of the shared daemon, where the Go side puts it by default
+function M.daemon_socket()
+  local opts = config.get()
+  if opts.daemon_socket then
+    return vim.fn.expand(opts.daemon_socket)
+  end
+  
+  local runtime_dir = vim.env.XDG_RUNTIME_DIR
+  if runtime_dir and runtime_dir ~= "" then
+    return runtime_dir .. "/collab.nvim/daemon.sock"
+  end
+  return vim.loop.os_tmpdir() .. "/collab.nvim-" .. vim.loop.getuid() .. "/daemon.sock"
+end
+
+-- Connect to the daemon's socket, returning the pipe or nil
+function M.connect_daemon(socket)
+  local pipe = vim.loop.new_pipe(false)
+  local done, failed = false, nil
+  pipe:connect(socket, function(err)
+    failed = err
+    done = true
+  end)
+  vim.wait(1000, function() return done end, 10)
+  
+  if not done or failed then
+    pipe:close()
+    return nil
+  end
+  return pipe
+end
+
+-- Attach to the daemon every Neovim shares, starting it when none is
+-- listening. The daemon outlives this Neovim while others are attached.
+function M.start_daemon(binary_path)
+  local socket = M.daemon_socket()
+  local pipe = M.connect_daemon(socket)
+  
+  if not pipe then
+    config.log("debug", "Starting daemon on " .. socket)
+    local handle
+    handle = vim.loop.spawn(binary_path, {
+      args = { "daemon", "-socket", socket },
+      detached = true,
+    }, function()
+      handle:close()
+    end)
+    if not handle then
+      error("collab.nvim: Failed to spawn Go daemon")
+    end
+    handle:unref()
+    
+    -- Wait for it to listen
+    for _ = 1, 20 do
+      pipe = M.connect_daemon(socket)
+      if pipe then
+        break
+      end
+      vim.wait(100)
+    end
+  end
+  
+  if not pipe then
+    error("collab.nvim: Failed to connect to the Go daemon at " .. socket)
+  end
+  
+  M.stdin = pipe
+  M.stdout = pipe
+  M.daemon = true
+end
+
 -- Stop the Go process
 function M.stop()
   if not M.is_running then
@@ -90,14 +203,17 @@ function M.stop()
   end
   
   config.log("debug", "Stopping Go process")
+  M.stopping = true
+  M.stop_keepalive()
   
   -- Close stdin to signal shutdown
   if M.stdin then
     M.stdin:close()
   end
   
-  -- Close stdout and stderr
-  if M.stdout then
+  -- Close stdout and stderr. Attached to the daemon, stdin and stdout are
+  -- its socket, and closing it detaches without stopping the daemon.
+  if M.stdout and M.stdout ~= M.stdin then
     M.stdout:close()
   end
   
@@ -122,7 +238,10 @@ function M.cleanup()
   M.stdout = nil
   M.stderr = nil
   M.is_running = false
+  M.daemon = false
   M.message_queue = {}
+  M.paused = false
+  M.busy = false
   M.response_callbacks = {}
 end
 
@@ -130,11 +249,58 @@ end
 function M.on_process_exit(code, signal)
   config.log("warn", string.format("Go process exited with code %d, signal %d", code or -1, signal or -1))
   
+  local unexpected = not M.stopping
+  M.stop_keepalive()
   M.cleanup()
   
   if M.on_disconnect then
     M.on_disconnect(code, signal)
   end
+  
+  -- A crash during a session restarts the process, which then restores or
+  -- asks to rejoin the session during the keepalive handshake
+  if unexpected and M.session_id then
+    vim.schedule(function()
+      M.restart()
+    end)
+  end
+end
+
+-- Send keepalives and restart the Go process when it stops answering
+function M.start_keepalive()
+  M.stop_keepalive()
+  M.keepalive_timer = vim.loop.new_timer()
+  M.keepalive_timer:start(M.keepalive_interval, M.keepalive_interval, vim.schedule_wrap(function()
+    if not M.is_running then
+      return
+    end
+    if M.last_keepalive and vim.loop.now() - M.last_keepalive > M.keepalive_timeout then
+      config.log("warn", "Go process stopped answering keepalives; restarting it")
+      M.restart()
+      return
+    end
+    M.send_keepalive(M.go_generation)
+  end))
+end
+
+function M.stop_keepalive()
+  if M.keepalive_timer then
+    M.keepalive_timer:stop()
+    M.keepalive_timer:close()
+    M.keepalive_timer = nil
+  end
+end
+
+-- Send a keepalive naming the Go generation we last saw
+function M.send_keepalive(go_generation)
+  return M.send_message({
+    type = "keepalive",
+    data = {
+      generation = M.generation,
+      peer_generation = go_generation,
+      session_id = M.session_id
+    }
+  })
 end
 
 -- Set up stdout reading for JSON responses
@@ -151,6 +317,11 @@ function M.setup_stdout_reading()
     
     if not data then
       config.log("debug", "stdout closed")
+      -- The daemon going away is the only sign it exited
+      if M.daemon and M.is_running then
+        M.stdout:close()
+        M.on_process_exit(0, 0)
+      end
       return
     end
     
@@ -187,6 +358,11 @@ end
 
 -- Process stdout data and parse JSON messages
 function M.process_stdout_data(data)
+  if M.wire_format ~= "json" then
+    M.process_framed_data(data)
+    return
+  end
+  
   -- Split data by newlines (each JSON message should be on one line)
   local lines = vim.split(data, "\n", { trimempty = true })
   
@@ -197,6 +373,33 @@ function M.process_stdout_data(data)
   end
 end
 
+-- Process stdout data made of JSON or MessagePack frames, each after its
+-- length as a 4-byte big-endian integer; a frame may span reads
+function M.process_framed_data(data)
+  local buffer = M.stdout_buffer .. data
+  while #buffer >= 4 do
+    local b1, b2, b3, b4 = buffer:byte(1, 4)
+    local size = ((b1 * 256 + b2) * 256 + b3) * 256 + b4
+    if #buffer < 4 + size then
+      break
+    end
+    local payload = buffer:sub(5, 4 + size)
+    buffer = buffer:sub(5 + size)
+    
+    if M.wire_format == "msgpack" then
+      local ok, message = pcall(vim.mpack.decode, payload)
+      if ok then
+        M.handle_message(message)
+      else
+        config.log("error", "Failed to parse MessagePack: " .. message)
+      end
+    else
+      M.handle_json_message(payload)
+    end
+  end
+  M.stdout_buffer = buffer
+end
+
 -- Handle a single JSON message from Go process
 function M.handle_json_message(json_str)
   config.log("debug", "Received: " .. json_str)
@@ -208,20 +411,335 @@ function M.handle_json_message(json_str)
     config.log("error", "Parse error: " .. message)
     return
   end
-  
+  M.handle_message(message)
+end
+
+-- Handle a single decoded message from Go process
+function M.handle_message(message)
   -- Validate message structure
   if type(message) ~= "table" or not message.type then
-    config.log("error", "Invalid message format: " .. json_str)
+    config.log("error", "Invalid message format: " .. vim.inspect(message))
     return
   end
+  if M.wire_format == "msgpack" then
+    config.log("debug", "Received: " .. message.type)
+  end
   
-  -- Handle response callbacks
+  -- Responses carry the id of their request; run its callback, then handle
+  -- them like any other message. Events have no id.
   if message.id and M.response_callbacks[message.id] then
     local callback = M.response_callbacks[message.id]
     M.response_callbacks[message.id] = nil
     callback(message)
+  end
+  
+  -- Liveness and the session the Go process is in
+  if message.type == "hello" and type(message.data) == "table" then
+    local previous = M.go_generation
+    M.go_generation = message.data.generation
+    M.last_keepalive = vim.loop.now()
+    if previous and previous ~= M.go_generation then
+      config.log("info", "Go process restarted; resuming session state")
+      M.send_keepalive(previous)
+    end
+    return
+  end
+  if message.type == "keepalive" and type(message.data) == "table" then
+    M.go_generation = message.data.generation
+    M.last_keepalive = vim.loop.now()
+    return
+  end
+  if type(message.data) == "table" then
+    if message.type == "session_created" or message.type == "session_joined" or message.type == "session_state_imported" then
+      M.session_id = message.data.session_id
+    elseif message.type == "daemon_attached" and message.data.session_id then
+      M.session_id = message.data.session_id
+    elseif message.type == "status" and message.data.status == "left" then
+      M.session_id = nil
+    end
+  end
+  
+  -- Hold messages while the Go process catches up
+  if message.type == "backpressure" and type(message.data) == "table" then
+    M.paused = message.data.paused
+    if not M.paused then
+      M.flush_queue()
+    end
+    return
+  end
+  
+  -- Hold edits while the document is busy with a slow operation or resync
+  if message.type == "busy" then
+    M.busy = true
     return
   end
+  if message.type == "ready" then
+    M.busy = false
+    M.flush_queue()
+    return
+  end
+  
+  -- Show how far a join has got; the presence stage finishing ends it
+  if message.type == "join_progress" and type(message.data) == "table" then
+    local progress = message.data
+    M.join_progress = progress
+    if progress.stage == "presence" and progress.percent == 100 then
+      M.join_progress = nil
+    end
+    vim.schedule(function()
+      vim.api.nvim_echo({{string.format("Joining session: %s %d%%", progress.stage, progress.percent)}}, false, {})
+    end)
+  end
+  
+  -- Open a buffer for a file of the host's project
+  if message.type == "remote_file_opened" and type(message.data) == "table" and not message.data.error then
+    vim.schedule(function()
+      M.open_remote_buffer(message.data)
+    end)
+  end
+  
+  -- Open a private copy of the document in a buffer of its own
+  if message.type == "document_forked" and type(message.data) == "table" then
+    vim.schedule(function()
+      M.open_fork_buffer(message.data)
+    end)
+  end
+  
+  -- Keep shared commands' output in read-only buffers
+  if message.type == "command_output" and type(message.data) == "table" then
+    vim.schedule(function()
+      M.append_command_output(message.data)
+    end)
+  end
+  if message.type == "command_output_document" and type(message.data) == "table" then
+    vim.schedule(function()
+      M.show_command_output(message.data)
+    end)
+  end
+  if message.type == "command_finished" and type(message.data) == "table" then
+    vim.schedule(function()
+      local result = message.data.error ~= nil and message.data.error ~= "" and message.data.error
+        or ("exit code " .. tostring(message.data.exit_code))
+      config.log("info", message.data.name .. " finished with " .. result .. "; output in collab://command/" .. message.data.run_id)
+    end)
+  end
+  
+  -- Keep the quickfix list in step with the session's jump list
+  if message.type == "jump_list" and type(message.data) == "table" then
+    vim.schedule(function()
+      M.show_jump_list(message.data)
+    end)
+  end
+  
+  -- Keep nvim-dap's breakpoints in step with the session's
+  if message.type == "breakpoints" and type(message.data) == "table" then
+    vim.schedule(function()
+      M.apply_breakpoints(message.data)
+    end)
+  end
+  
+  -- Ask about peers' requests for control, and say when yours was refused
+  if message.type == "control_requested" and type(message.data) == "table" then
+    vim.schedule(function()
+      local who = message.data.name or message.data.user_id
+      config.log("info", who .. " asks for control; answer with grant_control(\"" .. message.data.user_id .. "\") or deny_control(\"" .. message.data.user_id .. "\")")
+    end)
+  end
+  if message.type == "controller_left" and type(message.data) == "table" then
+    vim.schedule(function()
+      local who = message.data.name or message.data.user_id
+      if message.data.has_control then
+        config.log("info", who .. " left with control; you have it now")
+      elseif (message.data.current_controller or "") ~= "" then
+        config.log("info", who .. " left with control; it went to " .. message.data.current_controller)
+      else
+        config.log("info", who .. " left with control; nobody has it now")
+      end
+    end)
+  end
+  if message.type == "control_denied" and type(message.data) == "table" then
+    vim.schedule(function()
+      local who = message.data.name or message.data.denied_by
+      local reason = (message.data.reason or "") ~= "" and (": " .. message.data.reason) or ""
+      config.log("warn", who .. " refused you control" .. reason)
+    end)
+  end
+  
+  -- Draw peers' cursors where they are
+  if message.type == "presence_changed" and type(message.data) == "table" then
+    vim.schedule(function()
+      M.show_cursors(message.data)
+    end)
+  end
+  
+  -- Show suggestions from peers without control as ghost text
+  if message.type == "edit_suggested" and type(message.data) == "table" then
+    vim.schedule(function()
+      M.show_suggestion(message.data)
+    end)
+  end
+  
+  -- The host's backend saved the document; the buffer holds nothing unsaved
+  if message.type == "document_written" and type(message.data) == "table" and not message.data.error then
+    vim.schedule(function()
+      local buf = vim.fn.bufnr(message.data.path)
+      if buf > 0 then
+        vim.bo[buf].modified = false
+      end
+    end)
+  end
+  
+  -- Show the diagnosis report as it came
+  if message.type == "diagnosis" and type(message.data) == "table" then
+    vim.schedule(function()
+      config.log("info", message.data.report)
+    end)
+  end
+  
+  -- Point at the incident bundle when the document diverged from the host's
+  if message.type == "desync_detected" and type(message.data) == "table" then
+    vim.schedule(function()
+      if message.data.path then
+        config.log("error", "The document diverged from the host's; please attach " .. message.data.path .. " to a bug report and rejoin")
+      else
+        config.log("error", "The document diverged from the host's; rejoin the session")
+      end
+    end)
+  end
+  
+  -- Say when the host is closing the session, and with what result
+  if message.type == "session_closing" and type(message.data) == "table" then
+    vim.schedule(function()
+      if message.data.cancelled then
+        config.log("warn", "The host didn't finish closing the session; you can edit again")
+      else
+        config.log("info", (message.data.name or message.data.closed_by) .. " is closing the session; edits are paused")
+      end
+    end)
+  end
+  
+  -- Offers to link sessions, and which sessions share the document
+  if message.type == "session_link_offered" and type(message.data) == "table" then
+    vim.schedule(function()
+      local who = (message.data.host or "") ~= "" and message.data.host or "A host"
+      config.log("info", who .. " offers to share " .. (message.data.file_path or "their document") .. " into this session; accept with accept_session_link(\"" .. message.data.session_id .. "\")")
+    end)
+  end
+  -- Explain what a peer's client can't do
+  if message.type == "peer_capabilities" and type(message.data) == "table" and message.data.missing then
+    vim.schedule(function()
+      local caps = message.data.capabilities or {}
+      local who = message.data.name or message.data.user_id
+      local missing = table.concat(message.data.missing, " or "):gsub("_", "-")
+      config.log("info", string.format("%s uses %s %s, which has no %s support", who, caps.client or "a client", caps.client_version or "", missing))
+    end)
+  end
+  if message.type == "session_links" and type(message.data) == "table" then
+    vim.schedule(function()
+      if message.data.error then
+        config.log("error", "Session link refused: " .. message.data.error)
+        return
+      end
+      M.session_links = message.data.sessions
+      if #message.data.sessions == 0 then
+        config.log("info", "This session is no longer linked")
+      else
+        config.log("info", "Document shared by " .. table.concat(message.data.sessions, ", "))
+      end
+    end)
+  end
+  
+  -- Keep the host's rules, and tell the host when a member's edit broke one
+  if message.type == "operation_rules" and type(message.data) == "table" then
+    M.operation_rules = message.data
+  end
+  if message.type == "rule_violation" and type(message.data) == "table" then
+    vim.schedule(function()
+      local who = message.data.name or message.data.user_id or "A member"
+      config.log("warn", who .. "'s edit was refused: " .. (message.data.detail or message.data.rule))
+    end)
+  end
+  if message.type == "transaction_dropped" and type(message.data) == "table" then
+    vim.schedule(function()
+      local who = message.data.name or message.data.user_id or "A peer"
+      config.log("warn", who .. "'s edit across " .. #(message.data.files or {}) .. " documents was dropped: " .. (message.data.reason or "incomplete"))
+    end)
+  end
+  if message.type == "session_closed" and type(message.data) == "table" then
+    M.last_close = message.data
+    vim.schedule(function()
+      local hash = string.sub(message.data.sha256 or "", 1, 12)
+      if message.data.matches == false then
+        config.log("error", "Session closed, but your document differs from the final one (" .. hash .. ")")
+      elseif message.data.unanimous then
+        config.log("info", "Session closed; everyone agreed on the final document (" .. hash .. ")")
+      else
+        config.log("warn", string.format("Session closed at %s; %d diverged, %d didn't answer",
+          hash, #(message.data.diverged or {}), #(message.data.missing or {})))
+      end
+    end)
+  end
+  
+  -- Warn when the system clock is off the host's; edits are stamped with
+  -- the host's time regardless
+  if message.type == "clock_skew" and type(message.data) == "table" and message.data.skewed then
+    vim.schedule(function()
+      config.log("warn", string.format("Your clock is %.1fs off %s's; check the system time",
+        math.abs(message.data.offset_ms) / 1000, message.data.name or message.data.user_id))
+    end)
+  end
+  
+  if message.type == "sync_degraded" and type(message.data) == "table" then
+    vim.schedule(function()
+      if message.data.degraded then
+        config.log("warn", string.format("Your edits are taking %dms to reach peers (budget %dms); the network is falling behind",
+          message.data.p90_ms, message.data.budget_ms))
+      else
+        config.log("info", "Edits are reaching peers in time again")
+      end
+    end)
+  end
+  
+  -- Say when a collaborator falls behind, and when they caught up
+  if message.type == "peer_lagging" and type(message.data) == "table" then
+    vim.schedule(function()
+      local who = message.data.name or message.data.user_id
+      if message.data.lagging then
+        config.log("warn", string.format("%s is %d operations behind", who, message.data.behind))
+      else
+        config.log("info", who .. " caught up")
+      end
+    end)
+  end
+  
+  -- Sum up what peers changed while sync was paused
+  if message.type == "sync_resumed" and type(message.data) == "table" then
+    vim.schedule(function()
+      local parts = {}
+      for _, change in ipairs(message.data.changes or {}) do
+        table.insert(parts, string.format("%s +%d -%d", change.name or change.user_id, change.inserted, change.deleted))
+      end
+      local summary = #parts > 0 and table.concat(parts, ", ") or "no edits"
+      config.log("info", string.format("Sync resumed after %ds: %s", math.floor(message.data.paused_ms / 1000), summary))
+    end)
+  end
+  
+  -- Say when a peer moves to another shared file
+  if message.type == "peer_switched_file" and type(message.data) == "table" then
+    vim.schedule(function()
+      local file = message.data.file ~= "" and message.data.file or "the session's document"
+      config.log("info", (message.data.name or message.data.user_id) .. " switched to " .. file)
+    end)
+  end
+  
+  -- Hand extension messages to the plugin that owns the namespace
+  if message.type == "extension" and type(message.data) == "table" then
+    local handler = M.extension_handlers[message.data.namespace]
+    if handler then
+      handler(message.data.payload, message.data.from)
+      return
+    end
+  end
   
   -- Handle general messages
   if M.on_message then
@@ -246,22 +764,98 @@ function M.send_message(message, callback)
     M.response_callbacks[message_id] = callback
   end
   
-  -- Serialize to JSON
-  local ok, json_str = pcall(vim.json.encode, message)
+  -- Serialize to JSON, or to MessagePack
+  local encode = M.wire_format == "msgpack" and vim.mpack.encode or vim.json.encode
+  local ok, payload = pcall(encode, message)
   if not ok then
     config.log("error", "Failed to serialize message: " .. vim.inspect(message))
     return false
   end
+  config.log("debug", "Sending: " .. (M.wire_format == "msgpack" and message.type or payload))
   
-  config.log("debug", "Sending: " .. json_str)
+  -- Send to Go process after its length, or as a line
+  local data
+  if M.wire_format == "json" then
+    data = payload .. "\n"
+  else
+    local size = #payload
+    data = string.char(math.floor(size / 16777216) % 256, math.floor(size / 65536) % 256, math.floor(size / 256) % 256, size % 256) .. payload
+  end
   
-  -- Send to Go process (add newline)
-  local data = json_str .. "\n"
+  -- Queue it while paused, and anything about the document while busy
+  if M.paused or (M.busy and M.document_messages[message.type]) then
+    table.insert(M.message_queue, data)
+    return true
+  end
   M.stdin:write(data)
   
   return true
 end
 
+-- Messages that refer to the document as the buffer has it: edits, and the
+-- positions, diagnostics and control changes that must not overtake the
+-- edits made before them. While the Go process is busy they all wait, in
+-- the order they were sent; other requests, like leaving, still go out.
+M.document_messages = {
+  document_operation = true,
+  document_operations = true,
+  apply_transaction = true,
+  cursor_move = true,
+  selection_update = true,
+  add_comment = true,
+  share_diagnostics = true,
+  set_breakpoints = true,
+  accept_suggestion = true,
+  resolve_conflict = true,
+  fork_document = true,
+  propose_fork = true,
+  request_control = true,
+  grant_control = true,
+  deny_control = true,
+  release_control = true
+}
+
+-- Send the messages queued while the Go process was busy
+function M.flush_queue()
+  if M.paused or M.busy then
+    return
+  end
+  local queued = M.message_queue
+  M.message_queue = {}
+  if not M.stdin then
+    return
+  end
+  for _, data in ipairs(queued) do
+    M.stdin:write(data)
+  end
+end
+
+-- Describe this client to peers: Neovim's version and the features it has
+function M.send_client_info()
+  local v = vim.version()
+  return M.send_message({
+    type = "client_info",
+    data = {
+      client = "neovim",
+      client_version = string.format("%d.%d.%d", v.major, v.minor, v.patch),
+      chat = true,
+      multi_file = true
+    }
+  })
+end
+
+-- Turn categories of events ("presence", "chat", "metrics", "activity") on
+-- or off, answered with the categories now on
+function M.subscribe(categories, subscribe, callback)
+  return M.send_message({
+    type = "subscribe",
+    data = {
+      categories = categories,
+      subscribe = subscribe
+    }
+  }, callback)
+end
+
 -- Send health check message
 function M.health_check(callback)
   return M.send_message({
@@ -269,67 +863,888 @@ function M.health_check(callback)
   }, callback)
 end
 
--- Create a new session
-function M.create_session(file_path, content, callback)
+-- Ask how much traffic went to and came from peers, by kind and by peer
+function M.get_metrics(callback)
+  return M.send_message({
+    type = "get_metrics"
+  }, callback)
+end
+
+-- Check STUN, TURN, signaling, peers' clocks, stdio and history, answered
+-- with a diagnosis message once the network checks finish
+function M.diagnose(callback)
+  local sec, usec = vim.loop.gettimeofday()
+  return M.send_message({
+    type = "diagnose",
+    data = {
+      sent_at = sec * 1000 + math.floor(usec / 1000)
+    }
+  }, callback)
+end
+
+-- Read the config file again, applying what can change while running. With
+-- the daemon this affects every Neovim attached to it.
+function M.reload_config(callback)
+  return M.send_message({
+    type = "reload_config"
+  }, callback)
+end
+
+-- The ICE policy a session is started or joined with: opts.ice_policy, or
+-- the one from setup. It is always sent, so a session never keeps the
+-- previous one's.
+local function session_ice_policy(opts)
+  local policy = (opts or {}).ice_policy or config.opts.ice_policy
+  if policy == nil or vim.tbl_isempty(policy) then
+    return vim.empty_dict()
+  end
+  return policy
+end
+
+-- Create a new session. With a root (the project directory) the file is
+-- shared by its path relative to it. opts.ice_policy overrides the setup's
+-- ice_policy for this session.
+function M.create_session(file_path, content, callback, root, opts)
   return M.send_message({
     type = "create_session",
     data = {
       file_path = file_path,
-      content = content
+      content = content,
+      root = root,
+      ice_policy = session_ice_policy(opts)
     }
   }, callback)
 end
 
--- Join an existing session
-function M.join_session(session_id, callback)
+-- Join an existing session. root is the local checkout that a project
+-- session's relative path is resolved against. opts.ice_policy overrides
+-- the setup's ice_policy for this session.
+function M.join_session(session_id, callback, root, opts)
   return M.send_message({
     type = "join_session", 
     data = {
-      session_id = session_id
+      session_id = session_id,
+      root = root,
+      ice_policy = session_ice_policy(opts)
     }
   }, callback)
 end
 
--- Leave current session
-function M.leave_session(session_id, callback)
+-- Watch a session through the central server without joining its roster
+function M.spectate_session(session_id, callback)
   return M.send_message({
-    type = "leave_session",
+    type = "join_session",
     data = {
-      session_id = session_id or ""
+      session_id = session_id,
+      spectate = true
     }
   }, callback)
 end
 
--- Send document operation
-function M.send_operation(operation, callback)
+-- List the files a project offers for sharing; root defaults to the current
+-- project session's
+function M.list_project_files(root, callback)
   return M.send_message({
-    type = "document_operation",
-    data = operation
+    type = "list_project_files",
+    data = {
+      root = root
+    }
   }, callback)
 end
 
--- Send cursor movement
-function M.send_cursor_move(cursor_pos, callback)
+-- Ask the host to run one of its shared commands
+function M.request_command(name, callback)
   return M.send_message({
-    type = "cursor_move",
-    data = cursor_pos
+    type = "request_command",
+    data = {
+      name = name
+    }
   }, callback)
 end
 
--- Request control
-function M.request_control(user_id, callback)
+-- Approve or decline a peer's command request (host only)
+function M.answer_command(request_id, approved, reason, callback)
   return M.send_message({
-    type = "request_control",
+    type = "answer_command",
     data = {
-      requested_by = user_id
+      request_id = request_id,
+      approved = approved,
+      reason = reason
     }
   }, callback)
 end
 
--- Release control
-function M.release_control(callback)
+-- Fetch a shared command's whole output, the latest run's without run_id
+function M.get_command_output(run_id, callback)
   return M.send_message({
-    type = "release_control"
+    type = "get_command_output",
+    data = {
+      run_id = run_id
+    }
+  }, callback)
+end
+
+-- The read-only buffer holding a run's output
+function M.command_output_buffer(run_id)
+  local name = "collab://command/" .. run_id
+  local buf = vim.fn.bufnr(name)
+  if buf == -1 then
+    buf = vim.api.nvim_create_buf(true, true)
+    vim.api.nvim_buf_set_name(buf, name)
+    vim.bo[buf].modifiable = false
+  end
+  return buf
+end
+
+-- Append streamed output where the buffer ends, continuing its last line
+function M.append_command_output(event)
+  local buf = M.command_output_buffer(event.run_id)
+  local last = vim.api.nvim_buf_line_count(buf)
+  local tail = vim.api.nvim_buf_get_lines(buf, last - 1, last, false)[1] or ""
+  local lines = vim.split(tail .. (event.data or ""), "\n", { plain = true })
+  vim.bo[buf].modifiable = true
+  vim.api.nvim_buf_set_lines(buf, last - 1, last, false, lines)
+  vim.bo[buf].modifiable = false
+end
+
+-- Replace a run's buffer with its whole output document and show it
+function M.show_command_output(doc)
+  local buf = M.command_output_buffer(doc.run_id)
+  local lines = vim.split(doc.content or "", "\n", { plain = true })
+  vim.bo[buf].modifiable = true
+  vim.api.nvim_buf_set_lines(buf, 0, -1, false, lines)
+  vim.bo[buf].modifiable = false
+  vim.api.nvim_set_current_buf(buf)
+  return buf
+end
+
+-- Send a chat message to the session; text starting with "/" runs a
+-- command such as /who or /help instead, answered only to us
+function M.send_chat(text, callback)
+  return M.send_message({
+    type = "send_chat",
+    data = {
+      text = text
+    }
+  }, callback)
+end
+
+-- Hide a peer's chat and cursor, named by user ID or display name; their
+-- edits still apply
+function M.mute_peer(user, callback)
+  return M.send_message({
+    type = "mute_peer",
+    data = {
+      user_id = user
+    }
+  }, callback)
+end
+
+function M.unmute_peer(user, callback)
+  return M.send_message({
+    type = "unmute_peer",
+    data = {
+      user_id = user
+    }
+  }, callback)
+end
+
+-- Accept or reject the remote edit held under the manual conflict strategy
+function M.resolve_conflict(accept, callback)
+  return M.send_message({
+    type = "resolve_conflict",
+    data = {
+      accept = accept
+    }
+  }, callback)
+end
+
+-- Ask the host of a project session for its project's files
+function M.list_remote_files(callback)
+  return M.send_message({
+    type = "list_project_files",
+    data = {
+      remote = true
+    }
+  }, callback)
+end
+
+-- Open a file of the host's project by its path relative to the root
+function M.open_remote_file(path, callback)
+  return M.send_message({
+    type = "open_remote_file",
+    data = {
+      path = path
+    }
+  }, callback)
+end
+
+-- Stop following a remote file
+function M.close_remote_file(path, callback)
+  return M.send_message({
+    type = "close_remote_file",
+    data = {
+      path = path
+    }
+  }, callback)
+end
+
+-- Create the buffer for a remote file, set up the way the host has it.
+-- Edits to it go out as document operations with its path as file.
+function M.open_remote_buffer(file)
+  local name = file.file_path
+  if not name or name == "" then
+    name = "collab://" .. file.path
+  end
+  local buf = vim.fn.bufnr(name)
+  if buf == -1 then
+    buf = vim.api.nvim_create_buf(true, false)
+    vim.api.nvim_buf_set_name(buf, name)
+  end
+  
+  local content = file.content or ""
+  if file.content_encoding == "base64" then
+    content = vim.base64.decode(content)
+  end
+  local lines = vim.split(content, "\n", { plain = true })
+  vim.bo[buf].modifiable = true
+  vim.api.nvim_buf_set_lines(buf, 0, -1, false, lines)
+  
+  local metadata = file.metadata or {}
+  vim.bo[buf].fileformat = metadata.line_ending == "crlf" and "dos" or "unix"
+  if metadata.file_encoding and metadata.file_encoding ~= "" then
+    vim.bo[buf].fileencoding = metadata.file_encoding
+  end
+  local filetype = vim.filetype.match({ filename = file.path, contents = lines })
+  if filetype then
+    vim.bo[buf].filetype = filetype
+  end
+  vim.bo[buf].modifiable = not file.read_only
+  vim.bo[buf].modified = false
+  vim.b[buf].collab_remote_file = file.path
+  
+  vim.api.nvim_set_current_buf(buf)
+  return buf
+end
+
+-- Share this buffer's diagnostics (vim.diagnostic.get) in the session's
+-- jump list, replacing those shared before; file is "" for the session's
+-- document or a path relative to the project root
+function M.share_diagnostics(file, diagnostics, callback)
+  local shared = {}
+  for _, diagnostic in ipairs(diagnostics) do
+    table.insert(shared, {
+      line = diagnostic.lnum,
+      column = diagnostic.col,
+      severity = diagnostic.severity,
+      source = diagnostic.source,
+      message = diagnostic.message
+    })
+  end
+  return M.send_message({
+    type = "share_diagnostics",
+    data = {
+      file = file,
+      diagnostics = shared
+    }
+  }, callback)
+end
+
+-- Leave a comment in the jump list at a 0-based line and column
+function M.add_comment(file, line, column, text, callback)
+  return M.send_message({
+    type = "add_comment",
+    data = {
+      file = file,
+      line = line,
+      column = column,
+      text = text
+    }
+  }, callback)
+end
+
+function M.remove_jump_item(id, callback)
+  return M.send_message({
+    type = "remove_jump_item",
+    data = {
+      id = id
+    }
+  }, callback)
+end
+
+-- Move everyone to a jump list item, or by step items (1 next, -1 previous)
+function M.jump_to(id, step, callback)
+  return M.send_message({
+    type = "jump_to",
+    data = {
+      id = id,
+      step = step
+    }
+  }, callback)
+end
+
+function M.get_jump_list(callback)
+  return M.send_message({
+    type = "get_jump_list",
+    data = {}
+  }, callback)
+end
+
+-- Receive jump_list events whenever the list or the current item changes
+function M.subscribe_jump_list(subscribe, callback)
+  return M.send_message({
+    type = "subscribe_jump_list",
+    data = {
+      subscribe = subscribe
+    }
+  }, callback)
+end
+
+-- Show the jump list as the quickfix list, jumping to the current item when
+-- someone moved to it. Items in the session's document go to session_buf,
+-- the current buffer by default.
+function M.show_jump_list(event, session_buf)
+  session_buf = session_buf or vim.api.nvim_get_current_buf()
+  local severities = { "E", "W", "I", "N" }
+  local entries, current = {}, nil
+  for i, item in ipairs(event.items or {}) do
+    local entry = {
+      lnum = item.line + 1,
+      col = item.column + 1,
+      text = item.message,
+      type = item.kind == "comment" and "" or severities[item.severity],
+      user_data = item.id
+    }
+    if item.file and item.file ~= "" then
+      entry.filename = item.file
+    else
+      entry.bufnr = session_buf
+    end
+    table.insert(entries, entry)
+    if item.id == event.current then
+      current = i
+    end
+  end
+  
+  vim.fn.setqflist({}, "r", { title = "collab jump list", items = entries, idx = current })
+  if event.moved_by and current then
+    vim.cmd("cc " .. current)
+  end
+end
+
+-- Share a buffer's nvim-dap breakpoints, replacing those shared for file
+-- before; file is "" for the session's document or a path relative to the
+-- project root
+function M.share_breakpoints(file, bufnr, callback)
+  local ok, breakpoints = pcall(require, "dap.breakpoints")
+  if not ok then
+    config.log("error", "Sharing breakpoints needs nvim-dap")
+    return false
+  end
+  local shared = {}
+  for _, bp in ipairs(breakpoints.get(bufnr)[bufnr] or {}) do
+    table.insert(shared, {
+      line = bp.line - 1,
+      condition = bp.condition,
+      hit_condition = bp.hitCondition,
+      log_message = bp.logMessage
+    })
+  end
+  return M.send_message({
+    type = "set_breakpoints",
+    data = {
+      file = file,
+      breakpoints = shared
+    }
+  }, callback)
+end
+
+function M.get_breakpoints(callback)
+  return M.send_message({
+    type = "get_breakpoints",
+    data = {}
+  }, callback)
+end
+
+-- Set nvim-dap's breakpoints to the session's. Breakpoints in the session's
+-- document go to session_buf, the current buffer by default; those in other
+-- files to their buffers if loaded.
+function M.apply_breakpoints(event, session_buf)
+  local ok, breakpoints = pcall(require, "dap.breakpoints")
+  if not ok then
+    return
+  end
+  session_buf = session_buf or vim.api.nvim_get_current_buf()
+  
+  local by_buf = { [session_buf] = {} }
+  for _, bp in ipairs(event.breakpoints or {}) do
+    local buf = session_buf
+    if bp.file and bp.file ~= "" then
+      buf = vim.fn.bufnr(bp.file)
+    end
+    if buf > 0 then
+      by_buf[buf] = by_buf[buf] or {}
+      table.insert(by_buf[buf], bp)
+    end
+  end
+  
+  for buf, shared in pairs(by_buf) do
+    for _, bp in ipairs(breakpoints.get(buf)[buf] or {}) do
+      breakpoints.remove(buf, bp.line)
+    end
+    for _, bp in ipairs(shared) do
+      breakpoints.set({
+        condition = bp.condition,
+        hit_condition = bp.hit_condition,
+        log_message = bp.log_message
+      }, buf, bp.line + 1)
+    end
+  end
+end
+
+-- Accept a suggestion a peer made without control, applying it as your edit
+function M.accept_suggestion(id, callback)
+  M.clear_suggestion(id)
+  return M.send_message({
+    type = "accept_suggestion",
+    data = {
+      id = id
+    }
+  }, callback)
+end
+
+function M.dismiss_suggestion(id, callback)
+  M.clear_suggestion(id)
+  return M.send_message({
+    type = "dismiss_suggestion",
+    data = {
+      id = id
+    }
+  }, callback)
+end
+
+-- Fork the document into a private copy only you see, opened in a new
+-- buffer; name defaults to the fork's ID
+function M.fork_document(name, callback)
+  return M.send_message({
+    type = "fork_document",
+    data = {
+      name = name or ""
+    }
+  }, callback)
+end
+
+-- Create the local-only buffer for a fork. Nothing typed in it is sent
+-- until it is proposed.
+function M.open_fork_buffer(fork)
+  local buf = vim.api.nvim_create_buf(true, true)
+  vim.api.nvim_buf_set_name(buf, "collab-fork://" .. fork.name)
+  
+  local content = fork.content or ""
+  if fork.content_encoding == "base64" then
+    content = vim.base64.decode(content)
+  end
+  local lines = vim.split(content, "\n", { plain = true })
+  vim.api.nvim_buf_set_lines(buf, 0, -1, false, lines)
+  local filetype = vim.filetype.match({ filename = fork.file_path, contents = lines })
+  if filetype then
+    vim.bo[buf].filetype = filetype
+  end
+  vim.b[buf].collab_fork_id = fork.fork_id
+  
+  vim.api.nvim_set_current_buf(buf)
+  config.log("info", "Forked " .. vim.fn.fnamemodify(fork.file_path or "", ":t") .. " as " .. fork.name)
+  return buf
+end
+
+-- Propose a fork buffer's changes back as a suggestion; close drops the
+-- fork afterwards
+function M.propose_fork(buf, close, callback)
+  buf = buf or vim.api.nvim_get_current_buf()
+  local fork_id = vim.b[buf].collab_fork_id
+  if not fork_id then
+    config.log("error", "Not a fork buffer")
+    return false
+  end
+  local lines = vim.api.nvim_buf_get_lines(buf, 0, -1, false)
+  return M.send_message({
+    type = "propose_fork",
+    data = {
+      fork_id = fork_id,
+      content = table.concat(lines, "\n"),
+      close = close or false
+    }
+  }, callback)
+end
+
+function M.discard_fork(fork_id, callback)
+  return M.send_message({
+    type = "discard_fork",
+    data = {
+      fork_id = fork_id
+    }
+  }, callback)
+end
+
+M.cursor_namespace = vim.api.nvim_create_namespace("collab_cursors")
+M.cursor_marks = {}
+
+-- Draw the cursors in a presence_changed event, each in the peer's entry of
+-- cursor_colors, with their selections underlined in the same color.
+-- Cursors in the session's document go to session_buf, the current buffer
+-- by default; those in other shared files to their buffers, when open.
+function M.show_cursors(delta, session_buf)
+  local opts = config.get()
+  local colors = opts.cursor_colors or {}
+  if not opts.show_remote_cursors or #colors == 0 then
+    return
+  end
+  session_buf = session_buf or vim.api.nvim_get_current_buf()
+  
+  for _, user_id in ipairs(delta.removed or {}) do
+    M.clear_cursor(user_id)
+  end
+  for _, state in ipairs(delta.updated or {}) do
+    M.clear_cursor(state.user_id)
+    local buf = session_buf
+    if state.file and state.file ~= "" then
+      buf = vim.fn.bufnr(state.file)
+    end
+    if buf > 0 and vim.api.nvim_buf_is_loaded(buf) and state.line < vim.api.nvim_buf_line_count(buf) then
+      local slot = (state.color or 0) % #colors + 1
+      local group = "CollabCursor" .. slot
+      vim.api.nvim_set_hl(0, group, { bg = colors[slot], default = true })
+      if state.selection and (state.selection.mode or "") ~= "" then
+        vim.api.nvim_set_hl(0, "CollabSelection" .. slot, { sp = colors[slot], underline = true, default = true })
+        M.show_selection(buf, state.user_id, state.selection, "CollabSelection" .. slot)
+      end
+      local line = vim.api.nvim_buf_get_lines(buf, state.line, state.line + 1, false)[1] or ""
+      local column = math.min(state.column, #line)
+      local mark_opts
+      if column < #line then
+        mark_opts = { end_col = column + 1, hl_group = group }
+      else
+        mark_opts = { virt_text = { { " ", group } }, virt_text_pos = "overlay" }
+      end
+      M.add_cursor_mark(buf, state.user_id, state.line, column, mark_opts)
+    end
+  end
+end
+
+-- Underline a peer's selection: whole lines, a run of characters or a block
+function M.show_selection(buf, user_id, selection, group)
+  local first, last = selection.start_line, selection.end_line
+  local first_col, last_col = selection.start_column, selection.end_column
+  if first > last or (first == last and first_col > last_col) then
+    first, last, first_col, last_col = last, first, last_col, first_col
+  end
+  local line_count = vim.api.nvim_buf_line_count(buf)
+  if first >= line_count then
+    return
+  end
+  last = math.min(last, line_count - 1)
+  local lines = vim.api.nvim_buf_get_lines(buf, first, last + 1, false)
+  
+  if selection.mode == "line" then
+    M.add_cursor_mark(buf, user_id, first, 0, { end_row = last, end_col = #lines[#lines], hl_group = group, hl_eol = true })
+  elseif selection.mode == "block" then
+    local left, right = math.min(first_col, last_col), math.max(first_col, last_col)
+    for i, line in ipairs(lines) do
+      if left < #line then
+        M.add_cursor_mark(buf, user_id, first + i - 1, left, { end_col = math.min(right + 1, #line), hl_group = group })
+      end
+    end
+  else
+    M.add_cursor_mark(buf, user_id, first, math.min(first_col, #lines[1]),
+      { end_row = last, end_col = math.min(last_col + 1, #lines[#lines]), hl_group = group })
+  end
+end
+
+function M.add_cursor_mark(buf, user_id, line, column, opts)
+  local ok, mark = pcall(vim.api.nvim_buf_set_extmark, buf, M.cursor_namespace, line, column, opts)
+  if ok then
+    M.cursor_marks[user_id] = M.cursor_marks[user_id] or {}
+    table.insert(M.cursor_marks[user_id], { buf = buf, id = mark })
+  end
+end
+
+function M.clear_cursor(user_id)
+  for _, mark in ipairs(M.cursor_marks[user_id] or {}) do
+    pcall(vim.api.nvim_buf_del_extmark, mark.buf, M.cursor_namespace, mark.id)
+  end
+  M.cursor_marks[user_id] = nil
+end
+
+M.suggestion_namespace = vim.api.nvim_create_namespace("collab_suggestions")
+M.suggestion_marks = {}
+
+-- Show a suggestion as ghost text in buf, the current buffer by default:
+-- inserted text inline, deleted text struck through
+function M.show_suggestion(event, buf)
+  buf = buf or vim.api.nvim_get_current_buf()
+  M.clear_suggestion(event.id)
+  local marks = {}
+  local line_count = vim.api.nvim_buf_line_count(buf)
+  for _, edit in ipairs(event.edits or {}) do
+    if edit.line < line_count then
+      local text = edit.content or ""
+      if edit.content_encoding == "base64" then
+        text = vim.base64.decode(text)
+      end
+      local opts
+      if edit.type == "insert" then
+        opts = { virt_text = { { text:gsub("\n", "⏎"), "Comment" } }, virt_text_pos = "inline" }
+      else
+        local line = vim.api.nvim_buf_get_lines(buf, edit.line, edit.line + 1, false)[1] or ""
+        opts = { end_col = math.min(edit.column + edit.length, #line), hl_group = "DiffDelete" }
+      end
+      local ok, mark = pcall(vim.api.nvim_buf_set_extmark, buf, M.suggestion_namespace, edit.line, edit.column, opts)
+      if ok then
+        table.insert(marks, { buf = buf, id = mark })
+      end
+    end
+  end
+  M.suggestion_marks[event.id] = marks
+  config.log("info", (event.name or event.user_id) .. " suggests an edit (" .. event.id .. ")")
+end
+
+function M.clear_suggestion(id)
+  for _, mark in ipairs(M.suggestion_marks[id] or {}) do
+    pcall(vim.api.nvim_buf_del_extmark, mark.buf, M.suggestion_namespace, mark.id)
+  end
+  M.suggestion_marks[id] = nil
+end
+
+-- Close the hosted session for everyone once they confirm the final
+-- document; a session_closed event carries its hash
+function M.close_session(callback)
+  return M.send_message({
+    type = "close_session",
+    data = {}
+  }, callback)
+end
+
+-- Set the rules everyone else's edits must keep to: max_insert_bytes,
+-- protected line ranges ({start_line, end_line, label}, end exclusive) and
+-- read_only_files patterns
+function M.set_operation_rules(rules, callback)
+  return M.send_message({
+    type = "set_operation_rules",
+    data = rules or {}
+  }, callback)
+end
+
+function M.get_operation_rules(callback)
+  return M.send_message({
+    type = "get_operation_rules",
+    data = {}
+  }, callback)
+end
+
+-- Offer to share this session's document into another session on the
+-- server; its host accepts with accept_session_link
+function M.link_session(session_id, callback)
+  return M.send_message({
+    type = "link_session",
+    data = {
+      session_id = session_id
+    }
+  }, callback)
+end
+
+function M.accept_session_link(session_id, callback)
+  return M.send_message({
+    type = "accept_session_link",
+    data = {
+      session_id = session_id
+    }
+  }, callback)
+end
+
+-- Unlink this session, or as the source a linked one
+function M.unlink_session(session_id, callback)
+  return M.send_message({
+    type = "unlink_session",
+    data = {
+      session_id = session_id or ""
+    }
+  }, callback)
+end
+
+-- Leave current session
+function M.leave_session(session_id, callback)
+  return M.send_message({
+    type = "leave_session",
+    data = {
+      session_id = session_id or ""
+    }
+  }, callback)
+end
+
+-- Send document operation. A tool making the edit can set its provenance,
+-- such as "formatter", for peers to tell it from typing.
+function M.send_operation(operation, callback)
+  return M.send_message({
+    type = "document_operation",
+    data = operation
+  }, callback)
+end
+
+-- Send a burst of document operations (a paste or macro replay) to be
+-- applied as one
+function M.send_operations(operations, callback)
+  return M.send_message({
+    type = "document_operations",
+    data = {
+      operations = operations
+    }
+  }, callback)
+end
+
+-- Edit several documents all or nothing, e.g. for a rename across files.
+-- Each of edits has file (a remote file's path, nil for the session's
+-- document) and its operations in order; id is optional.
+function M.apply_transaction(edits, id, callback)
+  return M.send_message({
+    type = "apply_transaction",
+    data = {
+      id = id,
+      edits = edits
+    }
+  }, callback)
+end
+
+-- Send cursor movement. In a project session, cursor_pos.file names the
+-- shared file the cursor is in; leave it out for the session's document.
+function M.send_cursor_move(cursor_pos, callback)
+  return M.send_message({
+    type = "cursor_move",
+    data = cursor_pos
+  }, callback)
+end
+
+-- Share a visual-mode selection: mode ("char", "line" or "block", nil to
+-- clear) and 0-based, inclusive start_line, start_column, end_line and
+-- end_column, with file as for send_cursor_move
+function M.send_selection(selection, callback)
+  return M.send_message({
+    type = "selection_update",
+    data = selection
+  }, callback)
+end
+
+-- Ask where each peer last was in every shared file, answered with a
+-- presence_map message
+function M.get_presence_map(callback)
+  return M.send_message({
+    type = "get_presence_map",
+    data = {}
+  }, callback)
+end
+
+-- Have a pretend collaborator join the session you host alone and follow a
+-- script (a list of steps, the built-in one when nil), to try things out
+function M.start_demo_peer(script, opts, callback)
+  opts = opts or {}
+  return M.send_message({
+    type = "start_demo_peer",
+    data = {
+      script = script,
+      ["repeat"] = opts["repeat"],
+      typing_ms = opts.typing_ms
+    }
+  }, callback)
+end
+
+function M.stop_demo_peer(callback)
+  return M.send_message({
+    type = "stop_demo_peer",
+    data = {}
+  }, callback)
+end
+
+-- Send your edits only once a word or line is finished rather than as you
+-- type them (needs server_url)
+function M.set_typing_privacy(enabled, callback)
+  return M.send_message({
+    type = "set_typing_privacy",
+    data = {
+      enabled = enabled
+    }
+  }, callback)
+end
+
+-- Hold others' edits in the Go process until resume_sync, to focus without
+-- the document moving
+function M.pause_sync(callback)
+  return M.send_message({
+    type = "pause_sync",
+    data = {}
+  }, callback)
+end
+
+-- Apply the edits held while paused; a sync_resumed event sums them up
+function M.resume_sync(callback)
+  return M.send_message({
+    type = "resume_sync",
+    data = {}
+  }, callback)
+end
+
+-- Request control
+function M.request_control(user_id, callback)
+  return M.send_message({
+    type = "request_control",
+    data = {
+      requested_by = user_id
+    }
+  }, callback)
+end
+
+-- Hand control to a peer, answering their request or not
+function M.grant_control(user_id, callback)
+  return M.send_message({
+    type = "grant_control",
+    data = {
+      user_id = user_id
+    }
+  }, callback)
+end
+
+-- Refuse a peer's request for control
+function M.deny_control(user_id, reason, callback)
+  return M.send_message({
+    type = "deny_control",
+    data = {
+      user_id = user_id,
+      reason = reason
+    }
+  }, callback)
+end
+
+-- Release control
+function M.release_control(callback)
+  return M.send_message({
+    type = "release_control"
+  }, callback)
+end
+
+-- Register a plugin's handler for extension messages in its namespace.
+-- The handler receives the payload and the sending peer's user ID.
+function M.register_extension(namespace, handler)
+  M.extension_handlers[namespace] = handler
+end
+
+-- Send a plugin's payload to the given user IDs, or to every peer when
+-- `to` is nil
+function M.send_extension(namespace, payload, to, callback)
+  return M.send_message({
+    type = "extension",
+    data = {
+      namespace = namespace,
+      to = to,
+      payload = payload
+    }
   }, callback)
 end
 